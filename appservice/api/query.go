@@ -20,6 +20,7 @@ package api
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -61,6 +62,94 @@ type UserIDExistsResponse struct {
 	UserIDExists bool `json:"exists"`
 }
 
+// ThirdPartyProtocolsRequest is a request to the application services for the
+// third party protocols they provide
+type ThirdPartyProtocolsRequest struct {
+	// Only return this protocol, if set
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// ThirdPartyProtocolsResponse is a response from the application services with
+// the third party protocols they provide, keyed by protocol name. The
+// instances of a protocol provided by several application services are merged.
+type ThirdPartyProtocolsResponse struct {
+	Protocols map[string]ThirdPartyProtocol `json:"protocols"`
+}
+
+// ThirdPartyProtocol describes a third party protocol
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-thirdparty-protocol-protocol
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           string                         `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyFieldType describes a field used to identify third party
+// locations or users
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is an instance of a third party protocol, e.g.
+// one IRC network
+type ThirdPartyProtocolInstance struct {
+	Desc      string          `json:"desc"`
+	Icon      string          `json:"icon,omitempty"`
+	Fields    json.RawMessage `json:"fields"`
+	NetworkID string          `json:"network_id"`
+	// InstanceID is assigned by the homeserver and is unique across
+	// application services
+	InstanceID string `json:"instance_id"`
+}
+
+// ThirdPartyLocationRequest is a request to the application services for
+// third party locations. Either Protocol and Fields are set, to search for
+// locations in a protocol, or Alias is set, to find the locations bridged to
+// a Matrix room alias.
+type ThirdPartyLocationRequest struct {
+	Protocol string            `json:"protocol,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Alias    string            `json:"alias,omitempty"`
+}
+
+// ThirdPartyLocationResponse is a response from the application services with
+// the matching third party locations
+type ThirdPartyLocationResponse struct {
+	Locations []ThirdPartyLocation `json:"locations"`
+}
+
+// ThirdPartyLocation is a third party location bridged to a Matrix room alias
+type ThirdPartyLocation struct {
+	Alias    string          `json:"alias"`
+	Protocol string          `json:"protocol"`
+	Fields   json.RawMessage `json:"fields"`
+}
+
+// ThirdPartyUserRequest is a request to the application services for third
+// party users. Either Protocol and Fields are set, to search for users in a
+// protocol, or UserID is set, to find the third party users of a Matrix user.
+type ThirdPartyUserRequest struct {
+	Protocol string            `json:"protocol,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	UserID   string            `json:"user_id,omitempty"`
+}
+
+// ThirdPartyUserResponse is a response from the application services with the
+// matching third party users
+type ThirdPartyUserResponse struct {
+	Users []ThirdPartyUser `json:"users"`
+}
+
+// ThirdPartyUser is a third party user bridged to a Matrix user ID
+type ThirdPartyUser struct {
+	UserID   string          `json:"userid"`
+	Protocol string          `json:"protocol"`
+	Fields   json.RawMessage `json:"fields"`
+}
+
 // AppServiceQueryAPI is used to query user and room alias data from application
 // services
 type AppServiceQueryAPI interface {
@@ -76,6 +165,24 @@ type AppServiceQueryAPI interface {
 		req *UserIDExistsRequest,
 		resp *UserIDExistsResponse,
 	) error
+	// Get the third party protocols provided by the application services
+	ThirdPartyProtocols(
+		ctx context.Context,
+		req *ThirdPartyProtocolsRequest,
+		resp *ThirdPartyProtocolsResponse,
+	) error
+	// Look up third party locations on the application services
+	ThirdPartyLocation(
+		ctx context.Context,
+		req *ThirdPartyLocationRequest,
+		resp *ThirdPartyLocationResponse,
+	) error
+	// Look up third party users on the application services
+	ThirdPartyUser(
+		ctx context.Context,
+		req *ThirdPartyUserRequest,
+		resp *ThirdPartyUserResponse,
+	) error
 }
 
 // RetrieveUserProfile is a wrapper that queries both the local database and
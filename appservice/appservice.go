@@ -69,10 +69,10 @@ func NewInternalAPI(
 	// Wrap application services in a type that relates the application service and
 	// a sync.Cond object that can be used to notify workers when there are new
 	// events to be sent out.
-	workerStates := make([]types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
+	workerStates := make([]*types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
 	for i, appservice := range base.Cfg.Derived.ApplicationServices {
 		m := sync.Mutex{}
-		ws := types.ApplicationServiceWorkerState{
+		ws := &types.ApplicationServiceWorkerState{
 			AppService: appservice,
 			Cond:       sync.NewCond(&m),
 		}
@@ -96,15 +96,42 @@ func NewInternalAPI(
 	// Only consume if we actually have ASes to track, else we'll just chew cycles needlessly.
 	// We can't add ASes at runtime so this is safe to do.
 	if len(workerStates) > 0 {
-		consumer := consumers.NewOutputRoomEventConsumer(
+		rsConsumer := consumers.NewOutputRoomEventConsumer(
 			base.ProcessContext, base.Cfg, consumer, appserviceDB,
 			rsAPI, workerStates,
 		)
-		if err := consumer.Start(); err != nil {
+		if err := rsConsumer.Start(); err != nil {
 			logrus.WithError(err).Panicf("failed to start appservice roomserver consumer")
 		}
 	}
 
+	// Likewise, only consume EDUs if an AS wants ephemeral events (MSC2409).
+	if consumers.WantsEphemeralEvents(workerStates) {
+		typingConsumer := consumers.NewOutputTypingEventConsumer(
+			base.ProcessContext, base.Cfg, consumer, appserviceDB,
+			rsAPI, workerStates,
+		)
+		if err := typingConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start appservice typing consumer")
+		}
+
+		receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+			base.ProcessContext, base.Cfg, consumer, appserviceDB,
+			rsAPI, workerStates,
+		)
+		if err := receiptConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start appservice receipt consumer")
+		}
+
+		presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+			base.ProcessContext, base.Cfg, consumer, appserviceDB,
+			workerStates,
+		)
+		if err := presenceConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start appservice presence consumer")
+		}
+	}
+
 	// Create application service transaction workers
 	if err := workers.SetupTransactionWorkers(client, appserviceDB, workerStates); err != nil {
 		logrus.WithError(err).Panicf("failed to start app service transaction workers")
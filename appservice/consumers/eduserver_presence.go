@@ -0,0 +1,89 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputPresenceEventConsumer consumes presence updates that originated in
+// the EDU server and passes them on to application services.
+type OutputPresenceEventConsumer struct {
+	presenceConsumer *internal.ContinualConsumer
+	workerStates     []*types.ApplicationServiceWorkerState
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputPresenceEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	appserviceDB storage.Database,
+	workerStates []*types.ApplicationServiceWorkerState,
+) *OutputPresenceEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Process:        process,
+		ComponentName:  "appservice/eduserver/presence",
+		Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: appserviceDB,
+	}
+	s := &OutputPresenceEventConsumer{
+		presenceConsumer: &consumer,
+		workerStates:     workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output eduAPI.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	ev := gomatrixserverlib.ClientEvent{
+		Type:   eduAPI.MPresence,
+		Sender: output.UserID,
+	}
+	var err error
+	ev.Content, err = json.Marshal(eduAPI.NewPresenceContent(&output))
+	if err != nil {
+		log.WithError(err).Error("json.Marshal failed")
+		return nil
+	}
+
+	queueEphemeralUserEvent(s.workerStates, output.UserID, ev)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputReceiptEventConsumer consumes read receipts that originated in the
+// EDU server and passes them on to application services.
+type OutputReceiptEventConsumer struct {
+	receiptConsumer *internal.ContinualConsumer
+	rsAPI           api.RoomserverInternalAPI
+	workerStates    []*types.ApplicationServiceWorkerState
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputReceiptEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	appserviceDB storage.Database,
+	rsAPI api.RoomserverInternalAPI,
+	workerStates []*types.ApplicationServiceWorkerState,
+) *OutputReceiptEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Process:        process,
+		ComponentName:  "appservice/eduserver/receipt",
+		Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: appserviceDB,
+	}
+	s := &OutputReceiptEventConsumer{
+		receiptConsumer: &consumer,
+		rsAPI:           rsAPI,
+		workerStates:    workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputReceiptEventConsumer) Start() error {
+	return s.receiptConsumer.Start()
+}
+
+func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output eduAPI.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	ev := gomatrixserverlib.ClientEvent{
+		Type:   gomatrixserverlib.MReceipt,
+		RoomID: output.RoomID,
+	}
+	var err error
+	ev.Content, err = json.Marshal(map[string]eduAPI.ReceiptMRead{
+		output.EventID: {
+			User: map[string]eduAPI.ReceiptTS{
+				output.UserID: {TS: output.Timestamp},
+			},
+		},
+	})
+	if err != nil {
+		log.WithError(err).Error("json.Marshal failed")
+		return nil
+	}
+
+	queueEphemeralRoomEvent(context.TODO(), s.rsAPI, s.workerStates, output.RoomID, ev)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputTypingEventConsumer consumes typing events that originated in the
+// EDU server and passes them on to application services.
+type OutputTypingEventConsumer struct {
+	typingConsumer *internal.ContinualConsumer
+	eduCache       *cache.EDUCache
+	rsAPI          api.RoomserverInternalAPI
+	workerStates   []*types.ApplicationServiceWorkerState
+}
+
+// NewOutputTypingEventConsumer creates a new OutputTypingEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputTypingEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	appserviceDB storage.Database,
+	rsAPI api.RoomserverInternalAPI,
+	workerStates []*types.ApplicationServiceWorkerState,
+) *OutputTypingEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Process:        process,
+		ComponentName:  "appservice/eduserver/typing",
+		Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputTypingEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: appserviceDB,
+	}
+	s := &OutputTypingEventConsumer{
+		typingConsumer: &consumer,
+		eduCache:       cache.New(),
+		rsAPI:          rsAPI,
+		workerStates:   workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputTypingEventConsumer) Start() error {
+	s.eduCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		s.queueTypingUsers(context.Background(), roomID)
+	})
+	return s.typingConsumer.Start()
+}
+
+func (s *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output eduAPI.OutputTypingEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	typingEvent := output.Event
+	if typingEvent.Typing {
+		s.eduCache.AddTypingUser(typingEvent.UserID, typingEvent.RoomID, output.ExpireTime)
+	} else {
+		s.eduCache.RemoveUser(typingEvent.UserID, typingEvent.RoomID)
+	}
+
+	s.queueTypingUsers(context.TODO(), typingEvent.RoomID)
+	return nil
+}
+
+// queueTypingUsers sends the users currently typing in the room to any
+// interested application services.
+func (s *OutputTypingEventConsumer) queueTypingUsers(ctx context.Context, roomID string) {
+	ev := gomatrixserverlib.ClientEvent{
+		Type:   gomatrixserverlib.MTyping,
+		RoomID: roomID,
+	}
+	var err error
+	ev.Content, err = json.Marshal(map[string]interface{}{
+		"user_ids": s.eduCache.GetTypingUsers(roomID),
+	})
+	if err != nil {
+		log.WithError(err).Error("json.Marshal failed")
+		return
+	}
+	queueEphemeralRoomEvent(ctx, s.rsAPI, s.workerStates, roomID, ev)
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// WantsEphemeralEvents returns whether any of the given application services
+// has asked to receive ephemeral events (MSC2409), and so whether the EDU
+// server consumers need to be started at all.
+func WantsEphemeralEvents(workerStates []*types.ApplicationServiceWorkerState) bool {
+	for _, ws := range workerStates {
+		if wantsEphemeralEvents(ws) {
+			return true
+		}
+	}
+	return false
+}
+
+func wantsEphemeralEvents(ws *types.ApplicationServiceWorkerState) bool {
+	return ws.AppService.URL != "" && ws.AppService.PushEphemeral
+}
+
+// queueEphemeralRoomEvent queues an ephemeral event which happened in the
+// given room for every application service that wants ephemeral events and
+// is interested in the room.
+func queueEphemeralRoomEvent(
+	ctx context.Context,
+	rsAPI api.RoomserverInternalAPI,
+	workerStates []*types.ApplicationServiceWorkerState,
+	roomID string,
+	event gomatrixserverlib.ClientEvent,
+) {
+	for _, ws := range workerStates {
+		if wantsEphemeralEvents(ws) && appserviceIsInterestedInRoom(ctx, rsAPI, roomID, ws.AppService) {
+			ws.NotifyNewEphemeralEvent(event)
+		}
+	}
+}
+
+// queueEphemeralUserEvent queues an ephemeral event about the given user for
+// every application service that wants ephemeral events and has the user in
+// its namespace.
+func queueEphemeralUserEvent(
+	workerStates []*types.ApplicationServiceWorkerState,
+	userID string,
+	event gomatrixserverlib.ClientEvent,
+) {
+	for _, ws := range workerStates {
+		if wantsEphemeralEvents(ws) && ws.AppService.IsInterestedInUserID(userID) {
+			ws.NotifyNewEphemeralEvent(event)
+		}
+	}
+}
@@ -12,8 +12,11 @@ import (
 
 // HTTP paths for the internal HTTP APIs
 const (
-	AppServiceRoomAliasExistsPath = "/appservice/RoomAliasExists"
-	AppServiceUserIDExistsPath    = "/appservice/UserIDExists"
+	AppServiceRoomAliasExistsPath     = "/appservice/RoomAliasExists"
+	AppServiceUserIDExistsPath        = "/appservice/UserIDExists"
+	AppServiceThirdPartyProtocolsPath = "/appservice/ThirdPartyProtocols"
+	AppServiceThirdPartyLocationPath  = "/appservice/ThirdPartyLocation"
+	AppServiceThirdPartyUserPath      = "/appservice/ThirdPartyUser"
 )
 
 // httpAppServiceQueryAPI contains the URL to an appservice query API and a
@@ -61,3 +64,42 @@ func (h *httpAppServiceQueryAPI) UserIDExists(
 	apiURL := h.appserviceURL + AppServiceUserIDExistsPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// ThirdPartyProtocols implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyProtocols(
+	ctx context.Context,
+	request *api.ThirdPartyProtocolsRequest,
+	response *api.ThirdPartyProtocolsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyProtocols")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyProtocolsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyLocation implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyLocation(
+	ctx context.Context,
+	request *api.ThirdPartyLocationRequest,
+	response *api.ThirdPartyLocationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyLocation")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyLocationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyUser implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyUser(
+	ctx context.Context,
+	request *api.ThirdPartyUserRequest,
+	response *api.ThirdPartyUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyUser")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyUserPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -40,4 +40,46 @@ func AddRoutes(a api.AppServiceQueryAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		AppServiceThirdPartyProtocolsPath,
+		httputil.MakeInternalAPI("appserviceThirdPartyProtocols", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyProtocolsRequest
+			var response api.ThirdPartyProtocolsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyProtocols(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceThirdPartyLocationPath,
+		httputil.MakeInternalAPI("appserviceThirdPartyLocation", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyLocationRequest
+			var response api.ThirdPartyLocationResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyLocation(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		AppServiceThirdPartyUserPath,
+		httputil.MakeInternalAPI("appserviceThirdPartyUser", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyUserRequest
+			var response api.ThirdPartyUserResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -18,6 +18,8 @@ package query
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 
@@ -29,6 +31,7 @@ import (
 
 const roomAliasExistsPath = "/rooms/"
 const userIDExistsPath = "/users/"
+const thirdPartyPath = "/_matrix/app/v1/thirdparty"
 
 // AppServiceQueryAPI is an implementation of api.AppServiceQueryAPI
 type AppServiceQueryAPI struct {
@@ -158,3 +161,186 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	response.UserIDExists = false
 	return nil
 }
+
+// ThirdPartyProtocols performs a request to '/thirdparty/protocol/{protocol}'
+// on all application services providing a protocol, and merges the instances
+// of each protocol provided by several application services
+func (a *AppServiceQueryAPI) ThirdPartyProtocols(
+	ctx context.Context,
+	request *api.ThirdPartyProtocolsRequest,
+	response *api.ThirdPartyProtocolsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyProtocols")
+	defer span.Finish()
+
+	response.Protocols = make(map[string]api.ThirdPartyProtocol)
+	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+		if appservice.URL == "" {
+			continue
+		}
+		for _, protocol := range appservice.Protocols {
+			if request.Protocol != "" && protocol != request.Protocol {
+				continue
+			}
+			var res api.ThirdPartyProtocol
+			if err := a.queryThirdParty(ctx, appservice, "/protocol/"+url.PathEscape(protocol), url.Values{}, &res); err != nil {
+				log.WithFields(log.Fields{
+					"appservice_id": appservice.ID,
+					"protocol":      protocol,
+				}).WithError(err).Warn("Unable to query third party protocol on application service")
+				continue
+			}
+			// Instance IDs are only unique per application service, so
+			// qualify them with the application service ID
+			for i := range res.Instances {
+				res.Instances[i].InstanceID = appservice.ID + "|" + res.Instances[i].NetworkID
+			}
+			if existing, ok := response.Protocols[protocol]; ok {
+				existing.Instances = append(existing.Instances, res.Instances...)
+				res = existing
+			}
+			if res.Instances == nil {
+				res.Instances = []api.ThirdPartyProtocolInstance{}
+			}
+			response.Protocols[protocol] = res
+		}
+	}
+
+	return nil
+}
+
+// ThirdPartyLocation performs a request to '/thirdparty/location/{protocol}'
+// on all application services providing the protocol, or to
+// '/thirdparty/location' on all application services interested in the alias,
+// and merges the results
+func (a *AppServiceQueryAPI) ThirdPartyLocation(
+	ctx context.Context,
+	request *api.ThirdPartyLocationRequest,
+	response *api.ThirdPartyLocationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyLocation")
+	defer span.Finish()
+
+	response.Locations = []api.ThirdPartyLocation{}
+	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+		if appservice.URL == "" {
+			continue
+		}
+		path, params := thirdPartyLookup("/location", request.Protocol, request.Fields)
+		if request.Alias != "" {
+			if !appservice.IsInterestedInRoomAlias(request.Alias) {
+				continue
+			}
+			params.Set("alias", request.Alias)
+		} else if !providesProtocol(appservice, request.Protocol) {
+			continue
+		}
+		var res []api.ThirdPartyLocation
+		if err := a.queryThirdParty(ctx, appservice, path, params, &res); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+			}).WithError(err).Warn("Unable to look up third party location on application service")
+			continue
+		}
+		response.Locations = append(response.Locations, res...)
+	}
+
+	return nil
+}
+
+// ThirdPartyUser performs a request to '/thirdparty/user/{protocol}' on all
+// application services providing the protocol, or to '/thirdparty/user' on
+// all application services interested in the user ID, and merges the results
+func (a *AppServiceQueryAPI) ThirdPartyUser(
+	ctx context.Context,
+	request *api.ThirdPartyUserRequest,
+	response *api.ThirdPartyUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyUser")
+	defer span.Finish()
+
+	response.Users = []api.ThirdPartyUser{}
+	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+		if appservice.URL == "" {
+			continue
+		}
+		path, params := thirdPartyLookup("/user", request.Protocol, request.Fields)
+		if request.UserID != "" {
+			if !appservice.IsInterestedInUserID(request.UserID) {
+				continue
+			}
+			params.Set("userid", request.UserID)
+		} else if !providesProtocol(appservice, request.Protocol) {
+			continue
+		}
+		var res []api.ThirdPartyUser
+		if err := a.queryThirdParty(ctx, appservice, path, params, &res); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+			}).WithError(err).Warn("Unable to look up third party user on application service")
+			continue
+		}
+		response.Users = append(response.Users, res...)
+	}
+
+	return nil
+}
+
+// thirdPartyLookup returns the path and query parameters of a third party
+// lookup. Lookups in a protocol go to the protocol's path with its fields as
+// parameters, reverse lookups go to the base path.
+func thirdPartyLookup(path, protocol string, fields map[string]string) (string, url.Values) {
+	params := url.Values{}
+	if protocol == "" {
+		return path, params
+	}
+	for k, v := range fields {
+		params.Set(k, v)
+	}
+	return path + "/" + url.PathEscape(protocol), params
+}
+
+// providesProtocol returns whether the application service provides the
+// given third party protocol
+func providesProtocol(appservice config.ApplicationService, protocol string) bool {
+	for _, p := range appservice.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// queryThirdParty performs a GET request to the given third party path on
+// an application service, and decodes the JSON response into res
+func (a *AppServiceQueryAPI) queryThirdParty(
+	ctx context.Context,
+	appservice config.ApplicationService,
+	path string,
+	params url.Values,
+	res interface{},
+) error {
+	params.Set("access_token", appservice.HSToken)
+	apiURL := appservice.URL + thirdPartyPath + path + "?" + params.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"status_code":   resp.StatusCode,
+			}).WithError(err).Error("Unable to close application service response body")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("application service responded with status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
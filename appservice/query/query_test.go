@@ -0,0 +1,119 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func newThirdPartyAppService(t *testing.T, networkID string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("access_token") != "hs_token_"+networkID {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var res interface{}
+		switch req.URL.Path {
+		case "/_matrix/app/v1/thirdparty/protocol/irc":
+			res = map[string]interface{}{
+				"user_fields":     []string{"network", "nickname"},
+				"location_fields": []string{"network", "channel"},
+				"icon":            "mxc://example.org/irc",
+				"field_types":     map[string]interface{}{},
+				"instances": []map[string]interface{}{
+					{"desc": networkID, "network_id": networkID, "fields": map[string]string{"network": networkID}},
+				},
+			}
+		case "/_matrix/app/v1/thirdparty/location/irc":
+			res = []map[string]interface{}{
+				{
+					"alias":    "#" + networkID + "_" + req.URL.Query().Get("channel") + ":test",
+					"protocol": "irc",
+					"fields":   map[string]string{"network": networkID},
+				},
+			}
+		case "/_matrix/app/v1/thirdparty/user":
+			res = []map[string]interface{}{
+				{"userid": req.URL.Query().Get("userid"), "protocol": "irc", "fields": map[string]string{"network": networkID}},
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+}
+
+func TestThirdPartyLookups(t *testing.T) {
+	libera := newThirdPartyAppService(t, "libera")
+	defer libera.Close()
+	oftc := newThirdPartyAppService(t, "oftc")
+	defer oftc.Close()
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{
+			ID: "libera", URL: libera.URL, HSToken: "hs_token_libera", Protocols: []string{"irc"},
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {{Regex: "@libera_.*", RegexpObject: regexp.MustCompile("@libera_.*")}},
+			},
+		},
+		{ID: "oftc", URL: oftc.URL, HSToken: "hs_token_oftc", Protocols: []string{"irc"}},
+		{ID: "nourl", Protocols: []string{"irc"}},
+	}
+	a := &AppServiceQueryAPI{HTTPClient: http.DefaultClient, Cfg: cfg}
+	ctx := context.Background()
+
+	var protocols api.ThirdPartyProtocolsResponse
+	if err := a.ThirdPartyProtocols(ctx, &api.ThirdPartyProtocolsRequest{}, &protocols); err != nil {
+		t.Fatalf("ThirdPartyProtocols failed: %s", err)
+	}
+	irc, ok := protocols.Protocols["irc"]
+	if !ok || len(protocols.Protocols) != 1 {
+		t.Fatalf("expected only the irc protocol, got %+v", protocols.Protocols)
+	}
+	if len(irc.Instances) != 2 {
+		t.Fatalf("expected instances of both application services, got %+v", irc.Instances)
+	}
+	if irc.Instances[0].InstanceID != "libera|libera" || irc.Instances[1].InstanceID != "oftc|oftc" {
+		t.Fatalf("unexpected instance IDs: %+v", irc.Instances)
+	}
+
+	var locations api.ThirdPartyLocationResponse
+	if err := a.ThirdPartyLocation(ctx, &api.ThirdPartyLocationRequest{
+		Protocol: "irc",
+		Fields:   map[string]string{"channel": "matrix"},
+	}, &locations); err != nil {
+		t.Fatalf("ThirdPartyLocation failed: %s", err)
+	}
+	if len(locations.Locations) != 2 || locations.Locations[0].Alias != "#libera_matrix:test" || locations.Locations[1].Alias != "#oftc_matrix:test" {
+		t.Fatalf("unexpected locations: %+v", locations.Locations)
+	}
+
+	// Reverse lookups only go to the application services interested in the user
+	var users api.ThirdPartyUserResponse
+	if err := a.ThirdPartyUser(ctx, &api.ThirdPartyUserRequest{
+		UserID: "@libera_alice:test",
+	}, &users); err != nil {
+		t.Fatalf("ThirdPartyUser failed: %s", err)
+	}
+	if len(users.Users) != 1 || users.Users[0].UserID != "@libera_alice:test" {
+		t.Fatalf("unexpected users: %+v", users.Users)
+	}
+
+	// Unknown protocols return no results rather than an error
+	locations = api.ThirdPartyLocationResponse{}
+	if err := a.ThirdPartyLocation(ctx, &api.ThirdPartyLocationRequest{Protocol: "xmpp"}, &locations); err != nil {
+		t.Fatalf("ThirdPartyLocation failed: %s", err)
+	}
+	if len(locations.Locations) != 0 {
+		t.Fatalf("expected no locations, got %+v", locations.Locations)
+	}
+}
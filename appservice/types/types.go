@@ -16,11 +16,16 @@ import (
 	"sync"
 
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const (
 	// AppServiceDeviceID is the AS dummy device ID
 	AppServiceDeviceID = "AS_Device"
+	// MaxEphemeralEvents is the maximum number of ephemeral events that are
+	// queued for an application service. Once reached, the oldest events are
+	// dropped, so that an unreachable application service can't use up memory.
+	MaxEphemeralEvents = 100
 )
 
 // ApplicationServiceWorkerState is a type that couples an application service,
@@ -32,6 +37,9 @@ type ApplicationServiceWorkerState struct {
 	Cond       *sync.Cond
 	// Events ready to be sent
 	EventsReady bool
+	// Ephemeral events (receipts, typing, presence) ready to be sent, as
+	// per MSC2409. Guarded by Cond.L.
+	EphemeralEvents []gomatrixserverlib.ClientEvent
 	// Backoff exponent (2^x secs). Max 6, aka 64s.
 	Backoff int
 }
@@ -53,11 +61,53 @@ func (a *ApplicationServiceWorkerState) FinishEventProcessing() {
 	a.Cond.L.Unlock()
 }
 
+// NotifyNewEphemeralEvent queues an ephemeral event for this application
+// service worker and wakes up all waiting goroutines.
+func (a *ApplicationServiceWorkerState) NotifyNewEphemeralEvent(event gomatrixserverlib.ClientEvent) {
+	a.Cond.L.Lock()
+	a.queueEphemeralEvents(a.EphemeralEvents, []gomatrixserverlib.ClientEvent{event})
+	a.Cond.Broadcast()
+	a.Cond.L.Unlock()
+}
+
+// TakeEphemeralEvents removes all queued ephemeral events of this worker and
+// returns them.
+func (a *ApplicationServiceWorkerState) TakeEphemeralEvents() []gomatrixserverlib.ClientEvent {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	events := a.EphemeralEvents
+	a.EphemeralEvents = nil
+	return events
+}
+
+// RequeueEphemeralEvents puts ephemeral events which could not be sent back
+// at the front of the queue, so that they are retried with the next transaction.
+func (a *ApplicationServiceWorkerState) RequeueEphemeralEvents(events []gomatrixserverlib.ClientEvent) {
+	if len(events) == 0 {
+		return
+	}
+	a.Cond.L.Lock()
+	a.queueEphemeralEvents(events, a.EphemeralEvents)
+	a.Cond.L.Unlock()
+}
+
+// queueEphemeralEvents replaces the ephemeral event queue with older followed
+// by newer, dropping the oldest events if there are too many. Cond.L must be held.
+func (a *ApplicationServiceWorkerState) queueEphemeralEvents(older, newer []gomatrixserverlib.ClientEvent) {
+	events := make([]gomatrixserverlib.ClientEvent, 0, len(older)+len(newer))
+	events = append(events, older...)
+	events = append(events, newer...)
+	if len(events) > MaxEphemeralEvents {
+		events = events[len(events)-MaxEphemeralEvents:]
+	}
+	a.EphemeralEvents = events
+}
+
 // WaitForNewEvents causes the calling goroutine to wait on the worker state's
 // condition for a broadcast or similar wakeup, if there are no events ready.
 func (a *ApplicationServiceWorkerState) WaitForNewEvents() {
 	a.Cond.L.Lock()
-	if !a.EventsReady {
+	if !a.EventsReady && len(a.EphemeralEvents) == 0 {
 		a.Cond.Wait()
 	}
 	a.Cond.L.Unlock()
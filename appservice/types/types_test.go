@@ -0,0 +1,41 @@
+package types
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestEphemeralEventQueue(t *testing.T) {
+	ws := &ApplicationServiceWorkerState{
+		Cond: sync.NewCond(&sync.Mutex{}),
+	}
+	for i := 0; i < MaxEphemeralEvents+10; i++ {
+		ws.NotifyNewEphemeralEvent(gomatrixserverlib.ClientEvent{
+			Type:   gomatrixserverlib.MTyping,
+			RoomID: fmt.Sprintf("!%d:test", i),
+		})
+	}
+
+	// The oldest events should have been dropped
+	events := ws.TakeEphemeralEvents()
+	if len(events) != MaxEphemeralEvents {
+		t.Fatalf("expected %d events, got %d", MaxEphemeralEvents, len(events))
+	}
+	if events[0].RoomID != "!10:test" {
+		t.Fatalf("expected oldest event to be for !10:test, got %s", events[0].RoomID)
+	}
+	if len(ws.TakeEphemeralEvents()) != 0 {
+		t.Fatalf("expected queue to be empty after taking events")
+	}
+
+	// Requeued events should be sent before newer ones
+	ws.NotifyNewEphemeralEvent(gomatrixserverlib.ClientEvent{Type: gomatrixserverlib.MReceipt})
+	ws.RequeueEphemeralEvents(events[:1])
+	events = ws.TakeEphemeralEvents()
+	if len(events) != 2 || events[0].Type != gomatrixserverlib.MTyping || events[1].Type != gomatrixserverlib.MReceipt {
+		t.Fatalf("unexpected events after requeue: %+v", events)
+	}
+}
@@ -44,7 +44,7 @@ var (
 func SetupTransactionWorkers(
 	client *http.Client,
 	appserviceDB storage.Database,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates []*types.ApplicationServiceWorkerState,
 ) error {
 	// Create a worker that handles transmitting events to a single homeserver
 	for _, workerState := range workerStates {
@@ -58,7 +58,7 @@ func SetupTransactionWorkers(
 
 // worker is a goroutine that sends any queued events to the application service
 // it is given.
-func worker(client *http.Client, db storage.Database, ws types.ApplicationServiceWorkerState) {
+func worker(client *http.Client, db storage.Database, ws *types.ApplicationServiceWorkerState) {
 	log.WithFields(log.Fields{
 		"appservice": ws.AppService.ID,
 	}).Info("Starting application service")
@@ -81,8 +81,9 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 		// Wait for more events if we've sent all the events in the database
 		ws.WaitForNewEvents()
 
-		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
+		// Batch events up into a transaction, along with any ephemeral events
+		ephemeral := ws.TakeEphemeralEvents()
+		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID, ephemeral)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
@@ -98,8 +99,10 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
 			}).WithError(err).Error("unable to send event")
+			// Retry the ephemeral events with the next transaction
+			ws.RequeueEphemeralEvents(ephemeral)
 			// Backoff
-			backoff(&ws, err)
+			backoff(ws, err)
 			continue
 		}
 
@@ -143,12 +146,20 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 	time.Sleep(backoffSeconds)
 }
 
+// transaction is an application service transaction, extended with the
+// ephemeral events from MSC2409.
+type transaction struct {
+	gomatrixserverlib.ApplicationServiceTransaction
+	Ephemeral []gomatrixserverlib.ClientEvent `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+}
+
 // createTransaction takes in a slice of AS events, stores them in an AS
-// transaction, and JSON-encodes the results.
+// transaction along with the given ephemeral events, and JSON-encodes the results.
 func createTransaction(
 	ctx context.Context,
 	db storage.Database,
 	appserviceID string,
+	ephemeral []gomatrixserverlib.ClientEvent,
 ) (
 	transactionJSON []byte,
 	txnID, maxID int,
@@ -165,8 +176,9 @@ func createTransaction(
 		return
 	}
 
-	// Check if these events do not already have a transaction ID
-	if txnID == -1 {
+	// Check if these events do not already have a transaction ID. A transaction
+	// of only ephemeral events always needs a new one.
+	if txnID == -1 || len(events) == 0 {
 		// If not, grab next available ID from the DB
 		txnID, err = db.GetLatestTxnID(ctx)
 		if err != nil {
@@ -185,11 +197,14 @@ func createTransaction(
 	}
 
 	// Create a transaction and store the events inside
-	transaction := gomatrixserverlib.ApplicationServiceTransaction{
-		Events: gomatrixserverlib.HeaderedToClientEvents(ev, gomatrixserverlib.FormatAll),
+	txn := transaction{
+		ApplicationServiceTransaction: gomatrixserverlib.ApplicationServiceTransaction{
+			Events: gomatrixserverlib.HeaderedToClientEvents(ev, gomatrixserverlib.FormatAll),
+		},
+		Ephemeral: ephemeral,
 	}
 
-	transactionJSON, err = json.Marshal(transaction)
+	transactionJSON, err = json.Marshal(txn)
 	if err != nil {
 		return
 	}
@@ -10,4 +10,10 @@ const (
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
+	LoginTypeEmail              = "m.login.email.identity"
+	LoginTypeRegistrationToken  = "m.login.registration_token"
+	LoginTypeToken              = "m.login.token"
+	LoginTypeSSO                = "m.login.sso"
+	// The unstable name of m.login.registration_token from MSC3231
+	LoginTypeRegistrationTokenUnstable = "org.matrix.msc3231.login.registration_token"
 )
@@ -19,3 +19,20 @@ type ThreePID struct {
 	Address string `json:"address"`
 	Medium  string `json:"medium"`
 }
+
+// ThreePIDValidationSession is a session used by the homeserver to verify
+// that a user owns a third-party identifier, without going through an
+// identity server.
+type ThreePIDValidationSession struct {
+	SessionID    string
+	ClientSecret string
+	Medium       string
+	Address      string
+	Token        string
+	SendAttempt  int
+	// When the last token was sent, as a unix timestamp (ms resolution).
+	CreatedTS int64
+	// When the token was submitted, as a unix timestamp (ms resolution), or
+	// 0 if the session hasn't been validated yet.
+	ValidatedTS int64
+}
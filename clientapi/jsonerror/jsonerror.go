@@ -15,6 +15,7 @@
 package jsonerror
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -81,6 +82,23 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when a parameter, e.g. in the request path, is
+// syntactically invalid.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
+// MissingParam is an error when a required parameter was not supplied.
+func MissingParam(msg string) *MatrixError {
+	return &MatrixError{"M_MISSING_PARAM", msg}
+}
+
+// InvalidSignature is an error when a signature is invalid or was made by
+// the wrong key.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -93,6 +111,23 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// UnknownTokenError is an M_UNKNOWN_TOKEN error which tells the client
+// whether it was soft logged out.
+type UnknownTokenError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// SoftLogout is an error when the access token of the client has expired. The
+// device still exists, so the client can refresh the access token or log in
+// again without losing its encryption keys.
+func SoftLogout(msg string) *UnknownTokenError {
+	return &UnknownTokenError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
@@ -111,6 +146,12 @@ func UserInUse(msg string) *MatrixError {
 	return &MatrixError{"M_USER_IN_USE", msg}
 }
 
+// RoomInUse is an error returned when the client tries to create a room
+// with an alias that already exists
+func RoomInUse(msg string) *MatrixError {
+	return &MatrixError{"M_ROOM_IN_USE", msg}
+}
+
 // ASExclusive is an error returned when an application service tries to
 // register an username that is outside of its registered namespace, or if a
 // user attempts to register a username or room alias within an exclusive
@@ -169,3 +210,61 @@ func NotTrusted(serverName string) *MatrixError {
 		Err:     fmt.Sprintf("Untrusted server '%s'", serverName),
 	}
 }
+
+// FederationErrorCause is a machine-readable reason for a FederationError.
+// It is only ever logged, never sent over the wire.
+type FederationErrorCause string
+
+const (
+	// FederationErrorBuildEvent means an event could not be built.
+	FederationErrorBuildEvent FederationErrorCause = "build_event"
+	// FederationErrorParseEvent means an event that we already accepted as
+	// well formed could not be parsed.
+	FederationErrorParseEvent FederationErrorCause = "parse_event"
+	// FederationErrorVerifySignatures means signatures could not be checked,
+	// as opposed to being checked and found to be invalid.
+	FederationErrorVerifySignatures FederationErrorCause = "verify_signatures"
+	// FederationErrorRoomserver means a roomserver query or input failed.
+	FederationErrorRoomserver FederationErrorCause = "roomserver"
+)
+
+// FederationError is an internal error that occurred while handling a
+// federation request. The cause, operation and underlying error are there to
+// be logged, but it always serialises to a plain M_UNKNOWN so that none of
+// that detail is leaked to the requesting server.
+type FederationError struct {
+	Cause     FederationErrorCause
+	Operation string
+	Err       error
+}
+
+// NewFederationError returns a FederationError for the given cause, failed
+// operation (e.g. "builder.SetContent") and underlying error.
+func NewFederationError(cause FederationErrorCause, operation string, err error) *FederationError {
+	return &FederationError{
+		Cause:     cause,
+		Operation: operation,
+		Err:       err,
+	}
+}
+
+func (e *FederationError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Cause, e.Operation, e.Err)
+}
+
+func (e *FederationError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON serialises the error as a generic M_UNKNOWN.
+func (e *FederationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Unknown("Internal Server Error"))
+}
+
+// JSONResponse returns a 500 Internal Server Error for the error.
+func (e *FederationError) JSONResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusInternalServerError,
+		JSON: e,
+	}
+}
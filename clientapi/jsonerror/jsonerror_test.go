@@ -16,6 +16,8 @@ package jsonerror
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
 	"testing"
 )
 
@@ -42,3 +44,23 @@ func TestForbidden(t *testing.T) {
 		t.Errorf("TestForbidden: want %s, got %s", want, string(jsonBytes))
 	}
 }
+
+func TestFederationError(t *testing.T) {
+	cause := errors.New("database is on fire")
+	e := NewFederationError(FederationErrorRoomserver, "rsAPI.QueryLatestEventsAndState", cause)
+	if !errors.Is(e, cause) {
+		t.Errorf("TestFederationError: want error to wrap %q", cause)
+	}
+	res := e.JSONResponse()
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("TestFederationError: want HTTP %d, got %d", http.StatusInternalServerError, res.Code)
+	}
+	jsonBytes, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("TestFederationError: Failed to marshal FederationError. %s", err.Error())
+	}
+	want := `{"errcode":"M_UNKNOWN","error":"Internal Server Error"}`
+	if string(jsonBytes) != want {
+		t.Errorf("TestFederationError: want %s, got %s", want, string(jsonBytes))
+	}
+}
@@ -15,10 +15,13 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -26,6 +29,7 @@ import (
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -101,6 +105,13 @@ func SaveAccountData(
 		}
 	}
 
+	if dataType == "m.push_rules" {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Unable to set push rules, use the /pushrules API instead"),
+		}
+	}
+
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
@@ -172,31 +183,51 @@ func SaveReadMarker(
 		}
 	}
 
-	data, err := json.Marshal(fullyReadEvent{EventID: r.FullyRead})
+	// The fully-read marker only moves forwards, so that a client catching
+	// up on an old device doesn't move the unread line back for the others.
+	later, err := isFullyReadMarkerLater(req.Context(), userAPI, rsAPI, device.UserID, roomID, r.FullyRead)
+	if err == errUnknownFullyReadEvent {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotFound(err.Error()),
+		}
+	}
 	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("isFullyReadMarkerLater failed")
 		return jsonerror.InternalServerError()
 	}
+	if later {
+		data, err := json.Marshal(fullyReadEvent{EventID: r.FullyRead})
+		if err != nil {
+			return jsonerror.InternalServerError()
+		}
 
-	dataReq := api.InputAccountDataRequest{
-		UserID:      device.UserID,
-		DataType:    "m.fully_read",
-		RoomID:      roomID,
-		AccountData: data,
-	}
-	dataRes := api.InputAccountDataResponse{}
-	if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
-		return util.ErrorResponse(err)
-	}
+		dataReq := api.InputAccountDataRequest{
+			UserID:      device.UserID,
+			DataType:    "m.fully_read",
+			RoomID:      roomID,
+			AccountData: data,
+		}
+		dataRes := api.InputAccountDataResponse{}
+		if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
+			return util.ErrorResponse(err)
+		}
 
-	if err := syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
-		return jsonerror.InternalServerError()
+		if err := syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+			return jsonerror.InternalServerError()
+		}
 	}
 
-	// Handle the read receipt that may be included in the read marker
+	// Handle the read receipt that may be included in the read marker. The
+	// membership was already checked above.
 	if r.Read != "" {
-		return SetReceipt(req, eduAPI, device, roomID, "m.read", r.Read)
+		timestamp := gomatrixserverlib.AsTimestamp(time.Now())
+		if err := eduserverAPI.SendReceipt(req.Context(), eduAPI, device.UserID, roomID, r.Read, "m.read", timestamp); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("eduserverAPI.SendReceipt failed")
+			return jsonerror.InternalServerError()
+		}
 	}
 
 	return util.JSONResponse{
@@ -204,3 +235,64 @@ func SaveReadMarker(
 		JSON: struct{}{},
 	}
 }
+
+// errUnknownFullyReadEvent is returned by isFullyReadMarkerLater if the event
+// isn't one the roomserver knows in the room.
+var errUnknownFullyReadEvent = errors.New("unknown event ID for m.fully_read")
+
+// isFullyReadMarkerLater returns whether the event comes after the current
+// fully-read marker of the user in the room. Events are compared by depth.
+// Returns errUnknownFullyReadEvent if the event isn't in the room.
+func isFullyReadMarkerLater(
+	ctx context.Context, userAPI api.UserInternalAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID, roomID, eventID string,
+) (bool, error) {
+	dataRes := api.QueryAccountDataResponse{}
+	if err := userAPI.QueryAccountData(ctx, &api.QueryAccountDataRequest{
+		UserID:   userID,
+		RoomID:   roomID,
+		DataType: "m.fully_read",
+	}, &dataRes); err != nil {
+		return false, fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	var current fullyReadEvent
+	if data, ok := dataRes.RoomAccountData[roomID]["m.fully_read"]; ok {
+		if err := json.Unmarshal(data, &current); err != nil {
+			// Overwrite a broken marker.
+			current = fullyReadEvent{}
+		}
+	}
+
+	eventIDs := []string{eventID}
+	if current.EventID != "" && current.EventID != eventID {
+		eventIDs = append(eventIDs, current.EventID)
+	}
+	eventsRes := roomserverAPI.QueryEventsByIDResponse{}
+	if err := rsAPI.QueryEventsByID(ctx, &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs: eventIDs,
+	}, &eventsRes); err != nil {
+		return false, fmt.Errorf("rsAPI.QueryEventsByID: %w", err)
+	}
+	depths := make(map[string]int64, len(eventsRes.Events))
+	for _, ev := range eventsRes.Events {
+		if ev.RoomID() == roomID {
+			depths[ev.EventID()] = ev.Depth()
+		}
+	}
+	newDepth, ok := depths[eventID]
+	if !ok {
+		return false, errUnknownFullyReadEvent
+	}
+	if current.EventID == "" {
+		return true, nil
+	}
+	if current.EventID == eventID {
+		return false, nil
+	}
+	currentDepth, ok := depths[current.EventID]
+	if !ok {
+		// Overwrite a marker which points at an event we don't know.
+		return true, nil
+	}
+	return newDepth > currentDepth, nil
+}
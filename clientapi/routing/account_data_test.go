@@ -0,0 +1,101 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type readMarkerUserAPI struct {
+	userapi.UserInternalAPI
+	fullyRead string
+}
+
+func (u *readMarkerUserAPI) QueryAccountData(
+	ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse,
+) error {
+	res.RoomAccountData = map[string]map[string]json.RawMessage{}
+	if u.fullyRead != "" {
+		data, _ := json.Marshal(fullyReadEvent{EventID: u.fullyRead})
+		res.RoomAccountData[req.RoomID] = map[string]json.RawMessage{"m.fully_read": data}
+	}
+	return nil
+}
+
+func TestIsFullyReadMarkerLater(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	events := map[string]*gomatrixserverlib.HeaderedEvent{}
+	var eventIDs []string
+	for depth := int64(1); depth <= 4; depth++ {
+		roomID := redactionTestRoomID
+		if depth == 4 {
+			roomID = "!other:localhost"
+		}
+		eb := gomatrixserverlib.EventBuilder{
+			Sender: redactionTestUserID,
+			RoomID: roomID,
+			Type:   "m.room.message",
+			Depth:  depth,
+		}
+		if err = eb.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events[ev.EventID()] = ev.Headered(gomatrixserverlib.RoomVersionV6)
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	rsAPI := &redactionRoomserverAPI{events: events}
+
+	for _, tt := range []struct {
+		name      string
+		fullyRead string
+		eventID   string
+		want      bool
+		wantErr   error
+	}{
+		{name: "no marker yet", eventID: eventIDs[0], want: true},
+		{name: "later event", fullyRead: eventIDs[1], eventID: eventIDs[2], want: true},
+		{name: "earlier event", fullyRead: eventIDs[1], eventID: eventIDs[0], want: false},
+		{name: "same event", fullyRead: eventIDs[1], eventID: eventIDs[1], want: false},
+		{name: "unknown event", fullyRead: eventIDs[1], eventID: "$unknown", wantErr: errUnknownFullyReadEvent},
+		{name: "unknown event without marker", eventID: "$unknown", wantErr: errUnknownFullyReadEvent},
+		{name: "event in another room", fullyRead: eventIDs[1], eventID: eventIDs[3], wantErr: errUnknownFullyReadEvent},
+		{name: "current marker unknown", fullyRead: "$unknown", eventID: eventIDs[0], want: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			userAPI := &readMarkerUserAPI{fullyRead: tt.fullyRead}
+			got, err := isFullyReadMarkerLater(context.Background(), userAPI, rsAPI, redactionTestUserID, redactionTestRoomID, tt.eventID)
+			if err != tt.wantErr {
+				t.Fatalf("isFullyReadMarkerLater: got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("isFullyReadMarkerLater: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
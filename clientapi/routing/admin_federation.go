@@ -0,0 +1,96 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type federationDestinationsResponse struct {
+	Destinations []federationSenderAPI.ServerBackoff `json:"destinations"`
+}
+
+// GetFederationDestinations implements GET /admin/federation/destinations,
+// which lists the destinations that are blacklisted, blocked or backing off.
+func GetFederationDestinations(
+	req *http.Request, fsAPI federationSenderAPI.FederationSenderInternalAPI,
+) util.JSONResponse {
+	var res federationSenderAPI.QueryServerBackoffResponse
+	if err := fsAPI.QueryServerBackoff(req.Context(), &federationSenderAPI.QueryServerBackoffRequest{}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryServerBackoff failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Servers == nil {
+		res.Servers = []federationSenderAPI.ServerBackoff{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationDestinationsResponse{Destinations: res.Servers},
+	}
+}
+
+// ResetFederationDestination implements POST /admin/federation/destinations/{serverName}/reset,
+// which clears the backoff and blacklist for a destination so that it is retried
+// straight away. Blocked destinations stay blocked.
+func ResetFederationDestination(
+	req *http.Request, fsAPI federationSenderAPI.FederationSenderInternalAPI, serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if serverName == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Server name must not be empty"),
+		}
+	}
+	if err := fsAPI.PerformServersAlive(req.Context(), &federationSenderAPI.PerformServersAliveRequest{
+		Servers: []gomatrixserverlib.ServerName{serverName},
+	}, &federationSenderAPI.PerformServersAliveResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformServersAlive failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// BlockFederationDestination implements PUT and DELETE on
+// /admin/federation/destinations/{serverName}/block, which block and
+// unblock sending to a destination respectively.
+func BlockFederationDestination(
+	req *http.Request, fsAPI federationSenderAPI.FederationSenderInternalAPI, serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if serverName == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Server name must not be empty"),
+		}
+	}
+	if err := fsAPI.PerformBlockServer(req.Context(), &federationSenderAPI.PerformBlockServerRequest{
+		ServerName: serverName,
+		Blocked:    req.Method != http.MethodDelete,
+	}, &federationSenderAPI.PerformBlockServerResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformBlockServer failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type adminFederationSenderAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	servers []federationSenderAPI.ServerBackoff
+	blocked map[gomatrixserverlib.ServerName]bool
+	alive   []gomatrixserverlib.ServerName
+}
+
+func (f *adminFederationSenderAPI) QueryServerBackoff(
+	ctx context.Context,
+	req *federationSenderAPI.QueryServerBackoffRequest,
+	res *federationSenderAPI.QueryServerBackoffResponse,
+) error {
+	res.Servers = f.servers
+	return nil
+}
+
+func (f *adminFederationSenderAPI) PerformBlockServer(
+	ctx context.Context,
+	req *federationSenderAPI.PerformBlockServerRequest,
+	res *federationSenderAPI.PerformBlockServerResponse,
+) error {
+	f.blocked[req.ServerName] = req.Blocked
+	return nil
+}
+
+func (f *adminFederationSenderAPI) PerformServersAlive(
+	ctx context.Context,
+	req *federationSenderAPI.PerformServersAliveRequest,
+	res *federationSenderAPI.PerformServersAliveResponse,
+) error {
+	f.alive = append(f.alive, req.Servers...)
+	return nil
+}
+
+func TestGetFederationDestinations(t *testing.T) {
+	fsAPI := &adminFederationSenderAPI{}
+	req := httptest.NewRequest(http.MethodGet, "/admin/federation/destinations", nil)
+	res := GetFederationDestinations(req, fsAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	if dests := res.JSON.(federationDestinationsResponse).Destinations; dests == nil || len(dests) != 0 {
+		t.Fatalf("expected empty destinations list, got %v", dests)
+	}
+
+	fsAPI.servers = []federationSenderAPI.ServerBackoff{
+		{ServerName: "bad.server", Blacklisted: true, FailureCount: 16},
+	}
+	res = GetFederationDestinations(req, fsAPI)
+	if dests := res.JSON.(federationDestinationsResponse).Destinations; len(dests) != 1 || dests[0].ServerName != "bad.server" {
+		t.Fatalf("expected bad.server to be listed, got %v", dests)
+	}
+}
+
+func TestBlockFederationDestination(t *testing.T) {
+	fsAPI := &adminFederationSenderAPI{
+		blocked: map[gomatrixserverlib.ServerName]bool{},
+	}
+	for _, tc := range []struct {
+		method string
+		want   bool
+	}{
+		{http.MethodPut, true},
+		{http.MethodDelete, false},
+	} {
+		req := httptest.NewRequest(tc.method, "/admin/federation/destinations/bad.server/block", nil)
+		if res := BlockFederationDestination(req, fsAPI, "bad.server"); res.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", tc.method, res.Code)
+		}
+		if got := fsAPI.blocked["bad.server"]; got != tc.want {
+			t.Fatalf("%s: expected blocked=%v, got %v", tc.method, tc.want, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/federation/destinations/bad.server/reset", nil)
+	if res := ResetFederationDestination(req, fsAPI, "bad.server"); res.Code != http.StatusOK {
+		t.Fatalf("reset: expected status 200, got %d", res.Code)
+	}
+	if len(fsAPI.alive) != 1 || fsAPI.alive[0] != "bad.server" {
+		t.Fatalf("expected bad.server to be marked alive, got %v", fsAPI.alive)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type roomServersResponse struct {
+	Servers []gomatrixserverlib.ServerName `json:"servers"`
+}
+
+// GetRoomServers implements GET /admin/rooms/{roomID}/servers, which lists
+// the servers that currently have joined members in the room.
+func GetRoomServers(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string) util.JSONResponse {
+	var res roomserverAPI.QueryServersInRoomResponse
+	if err := rsAPI.QueryServersInRoom(req.Context(), &roomserverAPI.QueryServersInRoomRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryServersInRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+	if res.ServerNames == nil {
+		res.ServerNames = []gomatrixserverlib.ServerName{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomServersResponse{Servers: res.ServerNames},
+	}
+}
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -28,7 +29,9 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -49,6 +52,14 @@ type createRoomRequest struct {
 	GuestCanJoin              bool                          `json:"guest_can_join"`
 	RoomVersion               gomatrixserverlib.RoomVersion `json:"room_version"`
 	PowerLevelContentOverride json.RawMessage               `json:"power_level_content_override"`
+	Invite3PID                []invite3PID                  `json:"invite_3pid"`
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-createroom
+type invite3PID struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
 }
 
 const (
@@ -87,6 +98,14 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			}
 		}
 	}
+	for _, invite := range r.Invite3PID {
+		if invite.IDServer == "" || invite.Medium == "" || invite.Address == "" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("invite_3pid entries must have id_server, medium and address"),
+			}
+		}
+	}
 	switch r.Preset {
 	case presetPrivateChat, presetTrustedPrivateChat, presetPublicChat, "":
 	default:
@@ -139,11 +158,12 @@ func CreateRoom(
 	cfg *config.ClientAPI,
 	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	// TODO (#267): Check room ID doesn't clash with an existing one, and we
 	//              probably shouldn't be using pseudo-random strings, maybe GUIDs?
 	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	return createRoom(req, device, cfg, roomID, accountDB, rsAPI, asAPI)
+	return createRoom(req, device, cfg, roomID, accountDB, rsAPI, asAPI, spamChecker)
 }
 
 // createRoom implements /createRoom
@@ -153,6 +173,7 @@ func createRoom(
 	cfg *config.ClientAPI, roomID string,
 	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	logger := util.GetLogger(req.Context())
 	userID := device.UserID
@@ -167,6 +188,32 @@ func createRoom(
 		return *resErr
 	}
 
+	if err := spamChecker.CheckRoomCreation(req.Context(), &spamcheck.RoomCreationRequest{
+		Creator:  userID,
+		Name:     r.Name,
+		Topic:    r.Topic,
+		Invitees: r.Invite,
+	}); err != nil {
+		return *spamCheckResponse(req, err)
+	}
+	for _, invitee := range r.Invite {
+		if err := spamChecker.CheckInvite(req.Context(), &spamcheck.InviteRequest{
+			Inviter: userID,
+			Invitee: invitee,
+			RoomID:  roomID,
+		}); err != nil {
+			return *spamCheckResponse(req, err)
+		}
+	}
+	for range r.Invite3PID {
+		if err := spamChecker.CheckInvite(req.Context(), &spamcheck.InviteRequest{
+			Inviter: userID,
+			RoomID:  roomID,
+		}); err != nil {
+			return *spamCheckResponse(req, err)
+		}
+	}
+
 	evTime, err := httputil.ParseTSParam(req)
 	if err != nil {
 		return util.JSONResponse{
@@ -191,8 +238,7 @@ func createRoom(
 	}
 
 	// TODO: visibility/presets/raw initial state
-	// TODO: Create room alias association
-	// Make sure this doesn't fall into an application service's namespace though!
+	// TODO: Make sure the room alias doesn't fall into an application service's namespace.
 
 	logger.WithFields(log.Fields{
 		"userID":      userID,
@@ -310,23 +356,40 @@ func createRoom(
 	}
 
 	var roomAlias string
+	var roomCreated bool
 	if r.RoomAliasName != "" {
 		roomAlias = fmt.Sprintf("#%s:%s", r.RoomAliasName, cfg.Matrix.ServerName)
-		// check it's free TODO: This races but is better than nothing
-		hasAliasReq := roomserverAPI.GetRoomIDForAliasRequest{
-			Alias:              roomAlias,
-			IncludeAppservices: false,
+		// Reserve the alias before creating the room, so that the room isn't
+		// created with a canonical alias that turns out to be taken.
+		aliasReq := roomserverAPI.SetRoomAliasRequest{
+			Alias:  roomAlias,
+			RoomID: roomID,
+			UserID: userID,
 		}
-
-		var aliasResp roomserverAPI.GetRoomIDForAliasResponse
-		err = rsAPI.GetRoomIDForAlias(req.Context(), &hasAliasReq, &aliasResp)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+		var aliasResp roomserverAPI.SetRoomAliasResponse
+		if err = rsAPI.SetRoomAlias(req.Context(), &aliasReq, &aliasResp); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.SetRoomAlias failed")
 			return jsonerror.InternalServerError()
 		}
-		if aliasResp.RoomID != "" {
-			return util.MessageResponse(400, "Alias already exists")
+		if aliasResp.AliasExists {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Room alias already exists."),
+			}
 		}
+		// Release the alias again if creating the room fails.
+		defer func() {
+			if roomCreated {
+				return
+			}
+			var removeRes roomserverAPI.RemoveRoomAliasResponse
+			if rerr := rsAPI.RemoveRoomAlias(context.Background(), &roomserverAPI.RemoveRoomAliasRequest{
+				Alias:  roomAlias,
+				UserID: userID,
+			}, &removeRes); rerr != nil {
+				util.GetLogger(req.Context()).WithError(rerr).Error("aliasAPI.RemoveRoomAlias failed")
+			}
+		}()
 
 		aliasEvent = &fledglingEvent{
 			Type: gomatrixserverlib.MRoomCanonicalAlias,
@@ -382,7 +445,7 @@ func createRoom(
 	//  9- m.room.name (opt)
 	//  10- m.room.topic (opt)
 	//  11- invite events (opt) - with is_direct flag if applicable TODO
-	//  12- 3pid invite events (opt) TODO
+	//  12- 3pid invite events (opt)
 	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
 	// depending on if those events were in "initial_state" or not. This made it
 	// harder to reason about, hence sticking to a strict static ordering.
@@ -401,92 +464,20 @@ func createRoom(
 		eventsToMake = append(eventsToMake, *topicEvent)
 	}
 	if aliasEvent != nil {
-		// TODO: bit of a chicken and egg problem here as the alias doesn't exist and cannot until we have made the room.
-		// This means we might fail creating the alias but say the canonical alias is something that doesn't exist.
 		eventsToMake = append(eventsToMake, *aliasEvent)
 	}
 
 	// TODO: invite events
 	// TODO: 3pid invite events
 
-	var builtEvents []*gomatrixserverlib.HeaderedEvent
-	authEvents := gomatrixserverlib.NewAuthEvents(nil)
-	for i, e := range eventsToMake {
-		depth := i + 1 // depth starts at 1
-
-		builder := gomatrixserverlib.EventBuilder{
-			Sender:   userID,
-			RoomID:   roomID,
-			Type:     e.Type,
-			StateKey: &e.StateKey,
-			Depth:    int64(depth),
-		}
-		err = builder.SetContent(e.Content)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
-			return jsonerror.InternalServerError()
-		}
-		if i > 0 {
-			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
-		}
-		var ev *gomatrixserverlib.Event
-		ev, err = buildEvent(&builder, &authEvents, cfg, evTime, roomVersion)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("buildEvent failed")
-			return jsonerror.InternalServerError()
-		}
-
-		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.Allowed failed")
-			return jsonerror.InternalServerError()
-		}
-
-		// Add the event to the list of auth events
-		builtEvents = append(builtEvents, ev.Headered(roomVersion))
-		err = authEvents.AddEvent(ev)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
-			return jsonerror.InternalServerError()
-		}
-
-		accumulated := gomatrixserverlib.UnwrapEventHeaders(builtEvents)
-		if err = roomserverAPI.SendEventWithState(
-			req.Context(),
-			rsAPI,
-			roomserverAPI.KindNew,
-			&gomatrixserverlib.RespState{
-				StateEvents: accumulated,
-				AuthEvents:  accumulated,
-			},
-			ev.Headered(roomVersion),
-			nil,
-		); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("SendEventWithState failed")
-			return jsonerror.InternalServerError()
-		}
+	builtEvents, err := sendInitialRoomEvents(req.Context(), cfg, rsAPI, userID, roomID, roomVersion, evTime, eventsToMake)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sendInitialRoomEvents failed")
+		return jsonerror.InternalServerError()
 	}
 
-	// TODO(#269): Reserve room alias while we create the room. This stops us
-	// from creating the room but still failing due to the alias having already
-	// been taken.
-	if roomAlias != "" {
-		aliasReq := roomserverAPI.SetRoomAliasRequest{
-			Alias:  roomAlias,
-			RoomID: roomID,
-			UserID: userID,
-		}
-
-		var aliasResp roomserverAPI.SetRoomAliasResponse
-		err = rsAPI.SetRoomAlias(req.Context(), &aliasReq, &aliasResp)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.SetRoomAlias failed")
-			return jsonerror.InternalServerError()
-		}
-
-		if aliasResp.AliasExists {
-			return util.MessageResponse(400, "Alias already exists")
-		}
-	}
+	// The room exists now, so keep the alias that was reserved for it.
+	roomCreated = true
 
 	// If this is a direct message then we should invite the participants.
 	if len(r.Invite) > 0 {
@@ -549,6 +540,49 @@ func createRoom(
 		}
 	}
 
+	// Process the 3PID invites. If the identity server knows which Matrix ID
+	// the 3PID belongs to then that user is invited directly, otherwise the
+	// identity server stores the invite and we send a m.room.third_party_invite
+	// event.
+	for _, invite := range r.Invite3PID {
+		body := &threepid.MembershipRequest{
+			IDServer: invite.IDServer,
+			Medium:   invite.Medium,
+			Address:  invite.Address,
+		}
+		inviteStored, errRes := checkAndProcessThreepid(req, device, body, cfg, rsAPI, accountDB, roomID, evTime)
+		if errRes != nil {
+			return *errRes
+		}
+		if inviteStored {
+			continue
+		}
+		inviteEvent, err := buildMembershipEvent(
+			req.Context(), body.UserID, "", accountDB, device, gomatrixserverlib.Invite,
+			roomID, false, cfg, evTime, rsAPI, asAPI,
+		)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
+			continue
+		}
+		err = roomserverAPI.SendInvite(
+			req.Context(),
+			rsAPI,
+			inviteEvent.Headered(roomVersion),
+			nil, // ask the roomserver to draw up invite room state for us
+			cfg.Matrix.ServerName,
+			nil,
+		)
+		switch e := err.(type) {
+		case *roomserverAPI.PerformError:
+			return e.JSONResponse()
+		case nil:
+		default:
+			util.GetLogger(req.Context()).WithError(err).Error("roomserverAPI.SendInvite failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	if r.Visibility == "public" {
 		// expose this room in the published room list
 		var pubRes roomserverAPI.PerformPublishResponse
@@ -573,6 +607,65 @@ func createRoom(
 	}
 }
 
+// sendInitialRoomEvents builds the given events, chaining each one to the
+// previous, and sends them to the roomserver as the initial events of a new
+// room. The first event must be the m.room.create event.
+func sendInitialRoomEvents(
+	ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID, roomID string, roomVersion gomatrixserverlib.RoomVersion, evTime time.Time,
+	eventsToMake []fledglingEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var builtEvents []*gomatrixserverlib.HeaderedEvent
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i, e := range eventsToMake {
+		depth := i + 1 // depth starts at 1
+
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     e.Type,
+			StateKey: &e.StateKey,
+			Depth:    int64(depth),
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return nil, fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		ev, err := buildEvent(&builder, &authEvents, cfg, evTime, roomVersion)
+		if err != nil {
+			return nil, fmt.Errorf("buildEvent: %w", err)
+		}
+
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+		}
+
+		// Add the event to the list of auth events
+		builtEvents = append(builtEvents, ev.Headered(roomVersion))
+		if err = authEvents.AddEvent(ev); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+
+		accumulated := gomatrixserverlib.UnwrapEventHeaders(builtEvents)
+		if err = roomserverAPI.SendEventWithState(
+			ctx,
+			rsAPI,
+			roomserverAPI.KindNew,
+			&gomatrixserverlib.RespState{
+				StateEvents: accumulated,
+				AuthEvents:  accumulated,
+			},
+			ev.Headered(roomVersion),
+			nil,
+		); err != nil {
+			return nil, fmt.Errorf("roomserverAPI.SendEventWithState: %w", err)
+		}
+	}
+	return builtEvents, nil
+}
+
 // buildEvent fills out auth_events for the builder then builds the event
 func buildEvent(
 	builder *gomatrixserverlib.EventBuilder,
@@ -0,0 +1,164 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+type createRoomRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPITrace
+	aliases         map[string]string
+	failInput       bool
+	inputRoomEvents []roomserverAPI.InputRoomEvent
+}
+
+func (r *createRoomRoomserverAPI) SetRoomAlias(
+	ctx context.Context,
+	req *roomserverAPI.SetRoomAliasRequest,
+	res *roomserverAPI.SetRoomAliasResponse,
+) error {
+	if _, ok := r.aliases[req.Alias]; ok {
+		res.AliasExists = true
+		return nil
+	}
+	r.aliases[req.Alias] = req.RoomID
+	return nil
+}
+
+func (r *createRoomRoomserverAPI) RemoveRoomAlias(
+	ctx context.Context,
+	req *roomserverAPI.RemoveRoomAliasRequest,
+	res *roomserverAPI.RemoveRoomAliasResponse,
+) error {
+	_, res.Found = r.aliases[req.Alias]
+	res.Removed = res.Found
+	delete(r.aliases, req.Alias)
+	return nil
+}
+
+func (r *createRoomRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *roomserverAPI.InputRoomEventsRequest,
+	res *roomserverAPI.InputRoomEventsResponse,
+) {
+	if r.failInput {
+		res.ErrMsg = "failed to input events"
+		return
+	}
+	r.inputRoomEvents = append(r.inputRoomEvents, req.InputRoomEvents...)
+}
+
+type createRoomAccountDB struct {
+	accounts.Database
+}
+
+func (d *createRoomAccountDB) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart}, nil
+}
+
+func mustCreateRoom(t *testing.T, rsAPI *createRoomRoomserverAPI, body string) (string, int, interface{}) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	device := &userapi.Device{UserID: "@alice:localhost"}
+	roomID := "!room:localhost"
+	req := httptest.NewRequest(http.MethodPost, "/createRoom", bytes.NewBufferString(body))
+	res := createRoom(req, device, cfg, roomID, &createRoomAccountDB{}, rsAPI, nil, spamcheck.Checkers{})
+	return roomID, res.Code, res.JSON
+}
+
+func TestCreateRoomWithAlias(t *testing.T) {
+	rsAPI := &createRoomRoomserverAPI{aliases: map[string]string{}}
+	roomID, code, body := mustCreateRoom(t, rsAPI, `{"room_alias_name":"test"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, code, body)
+	}
+	if got := rsAPI.aliases["#test:localhost"]; got != roomID {
+		t.Errorf("expected alias to point to %s, got %q", roomID, got)
+	}
+	var canonicalAlias string
+	for _, ire := range rsAPI.inputRoomEvents {
+		if ire.Kind == roomserverAPI.KindNew && ire.Event.Type() == gomatrixserverlib.MRoomCanonicalAlias {
+			canonicalAlias = gjson.GetBytes(ire.Event.Content(), "alias").Str
+		}
+	}
+	if canonicalAlias != "#test:localhost" {
+		t.Errorf("expected canonical alias %q, got %q", "#test:localhost", canonicalAlias)
+	}
+}
+
+func TestCreateRoomWithAliasInUse(t *testing.T) {
+	rsAPI := &createRoomRoomserverAPI{aliases: map[string]string{"#test:localhost": "!other:localhost"}}
+	_, code, body := mustCreateRoom(t, rsAPI, `{"room_alias_name":"test"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if merr, ok := body.(*jsonerror.MatrixError); !ok || merr.ErrCode != "M_ROOM_IN_USE" {
+		t.Errorf("expected M_ROOM_IN_USE, got %+v", body)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no room to be created, got %d events", len(rsAPI.inputRoomEvents))
+	}
+	if got := rsAPI.aliases["#test:localhost"]; got != "!other:localhost" {
+		t.Errorf("expected existing alias to be kept, got %q", got)
+	}
+}
+
+func TestCreateRoomReleasesAliasOnFailure(t *testing.T) {
+	rsAPI := &createRoomRoomserverAPI{aliases: map[string]string{}, failInput: true}
+	_, code, _ := mustCreateRoom(t, rsAPI, `{"room_alias_name":"test"}`)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+	if _, ok := rsAPI.aliases["#test:localhost"]; ok {
+		t.Errorf("expected alias to be released after room creation failed")
+	}
+}
+
+func TestCreateRoomWithIncomplete3PIDInvite(t *testing.T) {
+	rsAPI := &createRoomRoomserverAPI{aliases: map[string]string{}}
+	_, code, body := mustCreateRoom(t, rsAPI, `{"invite_3pid":[{"medium":"email","address":"alice@example.com"}]}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if merr, ok := body.(*jsonerror.MatrixError); !ok || merr.ErrCode != "M_BAD_JSON" {
+		t.Errorf("expected M_BAD_JSON, got %+v", body)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no room to be created, got %d events", len(rsAPI.inputRoomEvents))
+	}
+}
+
+func TestCreateRoomWithUntrusted3PIDInvite(t *testing.T) {
+	rsAPI := &createRoomRoomserverAPI{aliases: map[string]string{}}
+	_, code, body := mustCreateRoom(t, rsAPI, `{"invite_3pid":[{"id_server":"id.example.com","medium":"email","address":"alice@example.com"}]}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if merr, ok := body.(*jsonerror.MatrixError); !ok || merr.ErrCode != "M_SERVER_NOT_TRUSTED" {
+		t.Errorf("expected M_SERVER_NOT_TRUSTED, got %+v", body)
+	}
+}
@@ -20,7 +20,6 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
-	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -48,7 +47,6 @@ func DirectoryRoom(
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
-	fedSenderAPI federationSenderAPI.FederationSenderInternalAPI,
 ) util.JSONResponse {
 	_, domain, err := gomatrixserverlib.SplitID('#', roomAlias)
 	if err != nil {
@@ -97,13 +95,13 @@ func DirectoryRoom(
 			}
 		}
 	} else {
-		joinedHostsReq := federationSenderAPI.QueryJoinedHostServerNamesInRoomRequest{RoomID: res.RoomID}
-		var joinedHostsRes federationSenderAPI.QueryJoinedHostServerNamesInRoomResponse
-		if err = fedSenderAPI.QueryJoinedHostServerNamesInRoom(req.Context(), &joinedHostsReq, &joinedHostsRes); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("fedSenderAPI.QueryJoinedHostServerNamesInRoom failed")
+		serversReq := roomserverAPI.QueryServersInRoomRequest{RoomID: res.RoomID}
+		var serversRes roomserverAPI.QueryServersInRoomResponse
+		if err = rsAPI.QueryServersInRoom(req.Context(), &serversReq, &serversRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryServersInRoom failed")
 			return jsonerror.InternalServerError()
 		}
-		res.fillServers(joinedHostsRes.ServerNames)
+		res.fillServers(serversRes.ServerNames)
 	}
 
 	return util.JSONResponse{
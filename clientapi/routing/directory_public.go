@@ -16,11 +16,10 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"net/http"
-	"sort"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/matrix-org/dendrite/clientapi/api"
@@ -34,18 +33,16 @@ import (
 
 var (
 	cacheMu          sync.Mutex
-	publicRoomsCache []gomatrixserverlib.PublicRoom
+	publicRoomsCache []roomserverAPI.PublicRoom
 )
 
 type PublicRoomReq struct {
-	Since  string `json:"since,omitempty"`
-	Limit  int16  `json:"limit,omitempty"`
-	Filter filter `json:"filter,omitempty"`
-	Server string `json:"server,omitempty"`
-}
-
-type filter struct {
-	SearchTerms string `json:"generic_search_term,omitempty"`
+	Since                string                          `json:"since,omitempty"`
+	Limit                int16                           `json:"limit,omitempty"`
+	Filter               roomserverAPI.PublicRoomsFilter `json:"filter,omitempty"`
+	Server               string                          `json:"server,omitempty"`
+	IncludeAllNetworks   bool                            `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string                          `json:"third_party_instance_id,omitempty"`
 }
 
 // GetPostPublicRooms implements GET and POST /publicRooms
@@ -63,7 +60,7 @@ func GetPostPublicRooms(
 	serverName := gomatrixserverlib.ServerName(request.Server)
 
 	if serverName != "" && serverName != cfg.Matrix.ServerName {
-		res, err := federation.GetPublicRooms(req.Context(), serverName, int(request.Limit), request.Since, false, "")
+		res, err := remotePublicRooms(req.Context(), serverName, request, federation, cfg)
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("failed to get public rooms")
 			return jsonerror.InternalServerError()
@@ -75,7 +72,12 @@ func GetPostPublicRooms(
 	}
 
 	response, err := publicRooms(req.Context(), request, rsAPI, extRoomsProvider)
-	if err != nil {
+	if errors.Is(err, roomserverAPI.ErrInvalidPublicRoomsToken) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(err.Error()),
+		}
+	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Errorf("failed to work out public rooms")
 		return jsonerror.InternalServerError()
 	}
@@ -85,73 +87,87 @@ func GetPostPublicRooms(
 	}
 }
 
+// remotePublicRooms queries the room directory of a remote server on behalf
+// of the client.
+func remotePublicRooms(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, request PublicRoomReq,
+	federation *gomatrixserverlib.FederationClient, cfg *config.ClientAPI,
+) (*roomserverAPI.RespPublicRooms, error) {
+	var res roomserverAPI.RespPublicRooms
+	if request.Filter.SearchTerms == "" && len(request.Filter.RoomTypes) == 0 {
+		fres, err := federation.GetPublicRooms(
+			ctx, serverName, int(request.Limit), request.Since,
+			request.IncludeAllNetworks, request.ThirdPartyInstanceID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res.Chunk = make([]roomserverAPI.PublicRoom, 0, len(fres.Chunk))
+		for _, room := range fres.Chunk {
+			res.Chunk = append(res.Chunk, roomserverAPI.PublicRoom{PublicRoom: room})
+		}
+		res.NextBatch = fres.NextBatch
+		res.PrevBatch = fres.PrevBatch
+		res.TotalRoomCountEstimate = fres.TotalRoomCountEstimate
+		return &res, nil
+	}
+
+	// gomatrixserverlib can only send GET requests to /publicRooms, which
+	// can't be filtered, so build and sign the POST request ourselves.
+	request.Server = ""
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPost, serverName, "/_matrix/federation/v1/publicRooms")
+	if err := fedReq.SetContent(request); err != nil {
+		return nil, err
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return nil, err
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	if err = federation.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
 func publicRooms(
 	ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI.RoomserverInternalAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
-) (*gomatrixserverlib.RespPublicRooms, error) {
+) (*roomserverAPI.RespPublicRooms, error) {
 
-	response := gomatrixserverlib.RespPublicRooms{
-		Chunk: []gomatrixserverlib.PublicRoom{},
+	response := roomserverAPI.RespPublicRooms{
+		Chunk: []roomserverAPI.PublicRoom{},
 	}
-	var limit int16
-	var offset int64
-	limit = request.Limit
-	if limit == 0 {
+	limit := int(request.Limit)
+	if limit <= 0 {
 		limit = 50
 	}
-	offset, err := strconv.ParseInt(request.Since, 10, 64)
-	// ParseInt returns 0 and an error when trying to parse an empty string
-	// In that case, we want to assign 0 so we ignore the error
-	if err != nil && len(request.Since) > 0 {
-		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
-		return nil, err
-	}
-	err = nil
 
-	var rooms []gomatrixserverlib.PublicRoom
+	var rooms []roomserverAPI.PublicRoom
 	if request.Since == "" {
 		rooms = refreshPublicRoomCache(ctx, rsAPI, extRoomsProvider)
 	} else {
 		rooms = getPublicRoomsFromCache()
 	}
+	rooms = roomserverAPI.PublicRoomsInNetwork(rooms, request.IncludeAllNetworks, request.ThirdPartyInstanceID)
 
 	response.TotalRoomCountEstimate = len(rooms)
 
-	rooms = filterRooms(rooms, request.Filter.SearchTerms)
-
-	chunk, prev, next := sliceInto(rooms, offset, limit)
-	if prev >= 0 {
-		response.PrevBatch = "T" + strconv.Itoa(prev)
-	}
-	if next >= 0 {
-		response.NextBatch = "T" + strconv.Itoa(next)
-	}
-	if chunk != nil {
-		response.Chunk = chunk
-	}
-	return &response, err
-}
-
-func filterRooms(rooms []gomatrixserverlib.PublicRoom, searchTerm string) []gomatrixserverlib.PublicRoom {
-	if searchTerm == "" {
-		return rooms
-	}
+	rooms = roomserverAPI.FilterPublicRooms(rooms, request.Filter)
 
-	normalizedTerm := strings.ToLower(searchTerm)
-
-	result := make([]gomatrixserverlib.PublicRoom, 0)
-	for _, room := range rooms {
-		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
-			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
-			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
-			result = append(result, room)
-		}
+	chunk, prev, next, err := roomserverAPI.PaginatePublicRooms(rooms, request.Since, limit)
+	if err != nil {
+		return nil, err
 	}
-
-	return result
+	response.Chunk = chunk
+	response.PrevBatch = prev
+	response.NextBatch = next
+	return &response, nil
 }
 
-// fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
-// on /publicRooms by parsing the incoming HTTP request
+// fillPublicRoomsReq fills the attributes of a GET or POST request on
+// /publicRooms by parsing the incoming HTTP request.
 // Filter is only filled for POST requests
 func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSONResponse {
 	if httpReq.Method != "GET" && httpReq.Method != "POST" {
@@ -174,6 +190,8 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
 		request.Server = httpReq.FormValue("server")
+		request.IncludeAllNetworks = httpReq.FormValue("include_all_networks") == "true"
+		request.ThirdPartyInstanceID = httpReq.FormValue("third_party_instance_id")
 	} else {
 		resErr := httputil.UnmarshalJSONRequest(httpReq, request)
 		if resErr != nil {
@@ -182,55 +200,25 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		request.Server = httpReq.FormValue("server")
 	}
 
-	// strip the 'T' which is only required because when sytest does pagination tests it stops
-	// iterating when !prev_batch which then fails if prev_batch==0, so add arbitrary text to
-	// make it truthy not falsey.
-	request.Since = strings.TrimPrefix(request.Since, "T")
-	return nil
-}
-
-// sliceInto returns a subslice of `slice` which honours the since/limit values given.
-//
-//    0  1  2  3  4  5  6   index
-//   [A, B, C, D, E, F, G]  slice
-//
-//   limit=3          => A,B,C (prev='', next='3')
-//   limit=3&since=3  => D,E,F (prev='0', next='6')
-//   limit=3&since=6  => G     (prev='3', next='')
-//
-//  A value of '-1' for prev/next indicates no position.
-func sliceInto(slice []gomatrixserverlib.PublicRoom, since int64, limit int16) (subset []gomatrixserverlib.PublicRoom, prev, next int) {
-	prev = -1
-	next = -1
-
-	if since > 0 {
-		prev = int(since) - int(limit)
-	}
-	nextIndex := int(since) + int(limit)
-	if len(slice) > nextIndex { // there are more rooms ahead of us
-		next = nextIndex
-	}
-
-	// apply sanity caps
-	if since < 0 {
-		since = 0
-	}
-	if nextIndex > len(slice) {
-		nextIndex = len(slice)
+	if request.IncludeAllNetworks && request.ThirdPartyInstanceID != "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("include_all_networks and third_party_instance_id can't both be set"),
+		}
 	}
-
-	subset = slice[since:nextIndex]
-	return
+	return nil
 }
 
 func refreshPublicRoomCache(
 	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
-) []gomatrixserverlib.PublicRoom {
+) []roomserverAPI.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
-	var extraRooms []gomatrixserverlib.PublicRoom
+	var extraRooms []roomserverAPI.PublicRoom
 	if extRoomsProvider != nil {
-		extraRooms = extRoomsProvider.Rooms()
+		for _, room := range extRoomsProvider.Rooms() {
+			extraRooms = append(extraRooms, roomserverAPI.PublicRoom{PublicRoom: room})
+		}
 	}
 
 	var queryRes roomserverAPI.QueryPublishedRoomsResponse
@@ -244,28 +232,25 @@ func refreshPublicRoomCache(
 		util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
 		return publicRoomsCache
 	}
-	publicRoomsCache = []gomatrixserverlib.PublicRoom{}
+	publicRoomsCache = []roomserverAPI.PublicRoom{}
 	publicRoomsCache = append(publicRoomsCache, pubRooms...)
 	publicRoomsCache = append(publicRoomsCache, extraRooms...)
 	publicRoomsCache = dedupeAndShuffle(publicRoomsCache)
 
-	// sort by total joined member count (big to small)
-	sort.SliceStable(publicRoomsCache, func(i, j int) bool {
-		return publicRoomsCache[i].JoinedMembersCount > publicRoomsCache[j].JoinedMembersCount
-	})
+	roomserverAPI.SortPublicRooms(publicRoomsCache)
 	return publicRoomsCache
 }
 
-func getPublicRoomsFromCache() []gomatrixserverlib.PublicRoom {
+func getPublicRoomsFromCache() []roomserverAPI.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
 	return publicRoomsCache
 }
 
-func dedupeAndShuffle(in []gomatrixserverlib.PublicRoom) []gomatrixserverlib.PublicRoom {
+func dedupeAndShuffle(in []roomserverAPI.PublicRoom) []roomserverAPI.PublicRoom {
 	// de-duplicate rooms with the same room ID. We can join the room via any of these aliases as we know these servers
 	// are alive and well, so we arbitrarily pick one (purposefully shuffling them to spread the load a bit)
-	var publicRooms []gomatrixserverlib.PublicRoom
+	var publicRooms []roomserverAPI.PublicRoom
 	haveRoomIDs := make(map[string]bool)
 	rand.Shuffle(len(in), func(i, j int) {
 		in[i], in[j] = in[j], in[i]
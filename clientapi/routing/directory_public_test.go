@@ -1,58 +1,36 @@
 package routing
 
 import (
-	"reflect"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
-
-	"github.com/matrix-org/gomatrixserverlib"
 )
 
-func pubRoom(name string) gomatrixserverlib.PublicRoom {
-	return gomatrixserverlib.PublicRoom{
-		Name: name,
+func TestFillPublicRoomsReq(t *testing.T) {
+	httpReq := httptest.NewRequest(http.MethodGet, "/publicRooms?limit=5&since=n3_!a:test&include_all_networks=true", nil)
+	var request PublicRoomReq
+	if resErr := fillPublicRoomsReq(httpReq, &request); resErr != nil {
+		t.Fatalf("fillPublicRoomsReq failed: %+v", resErr)
+	}
+	if request.Limit != 5 || request.Since != "n3_!a:test" || !request.IncludeAllNetworks {
+		t.Fatalf("unexpected request: %+v", request)
 	}
-}
 
-func TestSliceInto(t *testing.T) {
-	slice := []gomatrixserverlib.PublicRoom{
-		pubRoom("a"), pubRoom("b"), pubRoom("c"), pubRoom("d"), pubRoom("e"), pubRoom("f"), pubRoom("g"),
+	httpReq = httptest.NewRequest(http.MethodPost, "/publicRooms?server=example.org", strings.NewReader(
+		`{"filter":{"generic_search_term":"matrix"},"third_party_instance_id":"irc|libera"}`,
+	))
+	request = PublicRoomReq{}
+	if resErr := fillPublicRoomsReq(httpReq, &request); resErr != nil {
+		t.Fatalf("fillPublicRoomsReq failed: %+v", resErr)
 	}
-	limit := int16(3)
-	testCases := []struct {
-		since      int64
-		wantPrev   int
-		wantNext   int
-		wantSubset []gomatrixserverlib.PublicRoom
-	}{
-		{
-			since:      0,
-			wantPrev:   -1,
-			wantNext:   3,
-			wantSubset: slice[0:3],
-		},
-		{
-			since:      3,
-			wantPrev:   0,
-			wantNext:   6,
-			wantSubset: slice[3:6],
-		},
-		{
-			since:      6,
-			wantPrev:   3,
-			wantNext:   -1,
-			wantSubset: slice[6:7],
-		},
+	if request.Server != "example.org" || request.Filter.SearchTerms != "matrix" || request.ThirdPartyInstanceID != "irc|libera" {
+		t.Fatalf("unexpected request: %+v", request)
 	}
-	for _, tc := range testCases {
-		subset, prev, next := sliceInto(slice, tc.since, limit)
-		if !reflect.DeepEqual(subset, tc.wantSubset) {
-			t.Errorf("returned subset is wrong, got %v want %v", subset, tc.wantSubset)
-		}
-		if prev != tc.wantPrev {
-			t.Errorf("returned prev is wrong, got %d want %d", prev, tc.wantPrev)
-		}
-		if next != tc.wantNext {
-			t.Errorf("returned next is wrong, got %d want %d", next, tc.wantNext)
-		}
+
+	// include_all_networks and third_party_instance_id are mutually exclusive
+	httpReq = httptest.NewRequest(http.MethodGet, "/publicRooms?include_all_networks=true&third_party_instance_id=irc|libera", nil)
+	if resErr := fillPublicRoomsReq(httpReq, &PublicRoomReq{}); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a 400 error, got %+v", resErr)
 	}
 }
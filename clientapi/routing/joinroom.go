@@ -40,6 +40,7 @@ func JoinRoomByIDOrAlias(
 		RoomIDOrAlias: roomIDOrAlias,
 		UserID:        device.UserID,
 		Content:       map[string]interface{}{},
+		IsGuest:       device.AccountType == api.AccountTypeGuest,
 	}
 	joinRes := roomserverAPI.PerformJoinResponse{}
 
@@ -0,0 +1,132 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// UploadCrossSigningDeviceKeys handles POST /keys/device_signing/upload
+func UploadCrossSigningDeviceKeys(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, keyAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot upload cross-signing keys for another user"),
+		}
+	}
+
+	uploadReq := &api.PerformUploadDeviceKeysRequest{
+		UserID: device.UserID,
+	}
+	if err = json.Unmarshal(bodyBytes, &uploadReq.CrossSigningKeys); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	uploadRes := &api.PerformUploadDeviceKeysResponse{}
+	keyAPI.PerformUploadDeviceKeys(ctx, uploadReq, uploadRes)
+	if uploadRes.Error != nil {
+		return keyErrorResponse(req, uploadRes.Error)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadCrossSigningDeviceSignatures handles POST /keys/signatures/upload
+func UploadCrossSigningDeviceSignatures(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
+	uploadReq := &api.PerformUploadDeviceSignaturesRequest{
+		UserID: device.UserID,
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &uploadReq.Signatures); resErr != nil {
+		return *resErr
+	}
+	uploadRes := &api.PerformUploadDeviceSignaturesResponse{}
+	keyAPI.PerformUploadDeviceSignatures(req.Context(), uploadReq, uploadRes)
+	if uploadRes.Error != nil {
+		return keyErrorResponse(req, uploadRes.Error)
+	}
+
+	failures := make(map[string]map[string]*jsonerror.MatrixError)
+	for userID, keys := range uploadRes.Failures {
+		failures[userID] = make(map[string]*jsonerror.MatrixError)
+		for keyID, keyErr := range keys {
+			failures[userID][keyID] = keyErrorToMatrixError(keyErr)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"failures": failures,
+		},
+	}
+}
+
+func keyErrorResponse(req *http.Request, keyErr *api.KeyError) util.JSONResponse {
+	if !keyErr.IsInvalidSignature && !keyErr.IsMissingParam && !keyErr.IsInvalidParam {
+		util.GetLogger(req.Context()).WithError(keyErr).Error("Failed to upload cross-signing keys")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: keyErrorToMatrixError(keyErr),
+	}
+}
+
+func keyErrorToMatrixError(keyErr *api.KeyError) *jsonerror.MatrixError {
+	switch {
+	case keyErr.IsInvalidSignature:
+		return jsonerror.InvalidSignature(keyErr.Err)
+	case keyErr.IsMissingParam:
+		return jsonerror.MissingParam(keyErr.Err)
+	case keyErr.IsInvalidParam:
+		return jsonerror.InvalidParam(keyErr.Err)
+	default:
+		return jsonerror.Unknown(keyErr.Err)
+	}
+}
@@ -15,10 +15,13 @@
 package routing
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
@@ -27,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 type loginResponse struct {
@@ -34,6 +38,9 @@ type loginResponse struct {
 	AccessToken string                       `json:"access_token"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id"`
+	// Only set if the client supports refresh tokens and access tokens expire.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 type flows struct {
@@ -41,15 +48,39 @@ type flows struct {
 }
 
 type flow struct {
-	Type string `json:"type"`
+	Type              string             `json:"type"`
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
+	// Whether logged in clients can get login tokens for other devices
+	GetLoginToken bool `json:"get_login_token,omitempty"`
 }
 
-func passwordLogin() flows {
-	f := flows{}
-	s := flow{
-		Type: "m.login.password",
+type identityProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Icon string `json:"icon,omitempty"`
+}
+
+func loginFlows(cfg *config.ClientAPI) flows {
+	f := flows{
+		Flows: []flow{
+			{Type: authtypes.LoginTypePassword},
+			{
+				Type:          authtypes.LoginTypeToken,
+				GetLoginToken: cfg.MSCs != nil && cfg.MSCs.Enabled("msc3882"),
+			},
+		},
+	}
+	if cfg.SSO.Enabled {
+		s := flow{Type: authtypes.LoginTypeSSO}
+		for _, p := range cfg.SSO.Providers {
+			s.IdentityProviders = append(s.IdentityProviders, identityProvider{
+				ID:   p.ID,
+				Name: p.Name,
+				Icon: p.Icon,
+			})
+		}
+		f.Flows = append(f.Flows, s)
 	}
-	f.Flows = append(f.Flows, s)
 	return f
 }
 
@@ -59,22 +90,34 @@ func Login(
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(cfg),
 		}
 	} else if req.Method == http.MethodPost {
-		typePassword := auth.LoginTypePassword{
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+			}
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var loginType auth.Type = &auth.LoginTypePassword{
 			GetAccountByPassword: accountDB.GetAccountByPassword,
 			Config:               cfg,
 		}
-		r := typePassword.Request()
+		if gjson.GetBytes(body, "type").Str == authtypes.LoginTypeToken {
+			loginType = &auth.LoginTypeToken{
+				UserAPI: userAPI,
+			}
+		}
+		r := loginType.Request()
 		resErr := httputil.UnmarshalJSONRequest(req, r)
 		if resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		login, authErr := loginType.Login(req.Context(), r)
 		if authErr != nil {
 			return *authErr
 		}
@@ -111,6 +154,7 @@ func completeAuth(
 		Localpart:         localpart,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		RefreshToken:      login.RefreshToken,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -118,14 +162,19 @@ func completeAuth(
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if performRes.DeviceLimitExceeded {
+		return deviceLimitExceededResponse()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			HomeServer:  serverName,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			HomeServer:   serverName,
+			DeviceID:     performRes.Device.ID,
+			RefreshToken: performRes.RefreshToken,
+			ExpiresInMS:  performRes.ExpiresInMS,
 		},
 	}
 }
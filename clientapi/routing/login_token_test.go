@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestGetLoginToken(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "localhost"},
+		MSCs:   &config.MSCs{MSCs: []string{"msc3882"}},
+	}
+	userAPI := &ssoUserAPI{accounts: map[string]bool{}, loginTokens: map[string]string{}}
+	accountDB := &ssoAccountDB{}
+	device := &userapi.Device{ID: "PHONE", UserID: "@bob:localhost"}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login", nil)
+	var tokenFlow *flow
+	for _, f := range Login(req, accountDB, userAPI, cfg).JSON.(flows).Flows {
+		if f.Type == "m.login.token" {
+			f := f
+			tokenFlow = &f
+		}
+	}
+	if tokenFlow == nil || !tokenFlow.GetLoginToken {
+		t.Fatalf("expected m.login.token to be advertised with get_login_token, got %+v", tokenFlow)
+	}
+
+	userInteractiveAuth := auth.NewUserInteractive(func(ctx context.Context, localpart, password string) (*userapi.Account, error) {
+		if localpart != "bob" || password != "secret" {
+			return nil, sql.ErrNoRows
+		}
+		return &userapi.Account{Localpart: localpart, ServerName: "localhost"}, nil
+	}, cfg)
+
+	// Without user-interactive auth, the client is told how to authenticate.
+	req = httptest.NewRequest(http.MethodPost, "/_matrix/client/v1/login/get_token", strings.NewReader("{}"))
+	res := GetLoginToken(req, userInteractiveAuth, device, userAPI)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 without auth, got %d: %+v", res.Code, res.JSON)
+	}
+	challenge, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal the challenge: %s", err)
+	}
+	var uia struct {
+		Flows []struct {
+			Stages []string `json:"stages"`
+		} `json:"flows"`
+		Session string `json:"session"`
+	}
+	if err = json.Unmarshal(challenge, &uia); err != nil || uia.Session == "" || len(uia.Flows) == 0 || uia.Flows[0].Stages[0] != "m.login.password" {
+		t.Fatalf("expected a challenge with the password flow, got %s", challenge)
+	}
+	if len(userAPI.loginTokens) != 0 {
+		t.Fatalf("expected no login token to be created without auth")
+	}
+
+	authBody := func(password string) string {
+		return `{"auth":{"type":"m.login.password","session":"` + uia.Session + `","identifier":{"type":"m.id.user","user":"bob"},"password":"` + password + `"}}`
+	}
+	req = httptest.NewRequest(http.MethodPost, "/_matrix/client/v1/login/get_token", strings.NewReader(authBody("wrong")))
+	if res = GetLoginToken(req, userInteractiveAuth, device, userAPI); res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 with the wrong password, got %d: %+v", res.Code, res.JSON)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/_matrix/client/v1/login/get_token", strings.NewReader(authBody("secret")))
+	res = GetLoginToken(req, userInteractiveAuth, device, userAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	token := res.JSON.(loginTokenResponse)
+	if token.LoginToken == "" || token.ExpiresInMS <= 0 || token.ExpiresInMS > 120000 {
+		t.Fatalf("unexpected login token response %+v", token)
+	}
+
+	body := `{"type":"m.login.token","token":"` + token.LoginToken + `","initial_device_display_name":"Laptop"}`
+	req = httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(body))
+	res = Login(req, accountDB, userAPI, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	if userID := res.JSON.(loginResponse).UserID; userID != device.UserID {
+		t.Fatalf("expected to log in as %s, got %s", device.UserID, userID)
+	}
+}
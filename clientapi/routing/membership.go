@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -95,7 +96,7 @@ func sendMembership(ctx context.Context, accountDB accounts.Database, device *us
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON(err.Error()),
 		}
-	} else if err == eventutil.ErrRoomNoExists {
+	} else if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound(err.Error()),
@@ -201,12 +202,21 @@ func SendInvite(
 	req *http.Request, accountDB accounts.Database, device *userapi.Device,
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	body, evTime, _, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
 
+	if err := spamChecker.CheckInvite(req.Context(), &spamcheck.InviteRequest{
+		Inviter: device.UserID,
+		Invitee: body.UserID,
+		RoomID:  roomID,
+	}); err != nil {
+		return *spamCheckResponse(req, err)
+	}
+
 	inviteStored, jsonErrResp := checkAndProcessThreepid(
 		req, device, body, cfg, rsAPI, accountDB, roomID, evTime,
 	)
@@ -233,7 +243,7 @@ func SendInvite(
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON(err.Error()),
 		}
-	} else if err == eventutil.ErrRoomNoExists {
+	} else if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound(err.Error()),
@@ -383,7 +393,7 @@ func checkAndProcessThreepid(
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.NotTrusted(body.IDServer),
 		}
-	} else if err == eventutil.ErrRoomNoExists {
+	} else if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
 		return inviteStored, &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound(err.Error()),
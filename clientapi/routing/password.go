@@ -7,6 +7,8 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -25,8 +27,13 @@ type newPasswordAuth struct {
 	Type    string `json:"type"`
 	Session string `json:"session"`
 	auth.PasswordRequest
+	// m.login.email.identity
+	ThreePIDCreds *threepid.Credentials `json:"threepid_creds"`
 }
 
+// Password implements POST /account/password. The device is nil if the
+// request wasn't authenticated, in which case the user must verify their
+// email address to reset their password.
 func Password(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
@@ -51,31 +58,67 @@ func Password(
 		sessionID = util.RandomString(sessionIDLength)
 	}
 
-	// Require password auth to change the password.
-	if r.Auth.Type != authtypes.LoginTypePassword {
-		return util.JSONResponse{
-			Code: http.StatusUnauthorized,
-			JSON: newUserInteractiveResponse(
-				sessionID,
-				[]authtypes.Flow{
-					{
-						Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
-					},
+	var flows []authtypes.Flow
+	if device != nil {
+		flows = append(flows, authtypes.Flow{
+			Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
+		})
+	}
+	if cfg.Email.Enabled {
+		flows = append(flows, authtypes.Flow{
+			Stages: []authtypes.LoginType{authtypes.LoginTypeEmail},
+		})
+	}
+
+	var localpart, validationSessionID string
+	switch {
+	case r.Auth.Type == authtypes.LoginTypePassword && device != nil:
+		// Check if the existing password is correct.
+		typePassword := auth.LoginTypePassword{
+			GetAccountByPassword: accountDB.GetAccountByPassword,
+			Config:               cfg,
+		}
+		if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
+			return *authErr
+		}
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypePassword)
+
+	case r.Auth.Type == authtypes.LoginTypeEmail && cfg.Email.Enabled:
+		// Check that the user verified an email address of the account.
+		if r.Auth.ThreePIDCreds == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam("threepid_creds is required"),
+			}
+		}
+		session, resErr := checkLocalThreePIDSession(req, *r.Auth.ThreePIDCreds, accountDB, cfg)
+		if resErr != nil {
+			return *resErr
+		}
+		var err error
+		localpart, err = accountDB.GetLocalpartForThreePID(req.Context(), session.Address, session.Medium)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if localpart == "" {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_NOT_FOUND",
+					Err:     "This email address is not associated with any account",
 				},
-				nil,
-			),
+			}
 		}
-	}
+		validationSessionID = session.SessionID
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
 
-	// Check if the existing password is correct.
-	typePassword := auth.LoginTypePassword{
-		GetAccountByPassword: accountDB.GetAccountByPassword,
-		Config:               cfg,
-	}
-	if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
-		return *authErr
+	default:
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: newUserInteractiveResponse(sessionID, flows, nil),
+		}
 	}
-	AddCompletedSessionStage(sessionID, authtypes.LoginTypePassword)
 
 	// Check the new password strength.
 	if resErr = validatePassword(r.NewPassword); resErr != nil {
@@ -83,10 +126,20 @@ func Password(
 	}
 
 	// Get the local part.
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
-		return jsonerror.InternalServerError()
+	if device != nil {
+		deviceLocalpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		// An authenticated user can only change their own password.
+		if localpart != "" && localpart != deviceLocalpart {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("This email address is associated with another account"),
+			}
+		}
+		localpart = deviceLocalpart
 	}
 
 	// Ask the user API to perform the password change.
@@ -104,13 +157,23 @@ func Password(
 		return jsonerror.InternalServerError()
 	}
 
+	// The validation session can't be used again.
+	if validationSessionID != "" {
+		if err := accountDB.RemoveThreePIDValidationSession(req.Context(), validationSessionID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDValidationSession failed")
+		}
+	}
+
 	// If the request asks us to log out all other devices then
-	// ask the user API to do that.
+	// ask the user API to do that. Unauthenticated requests log out
+	// all of the devices.
 	if r.LogoutDevices {
 		logoutReq := &userapi.PerformDeviceDeletionRequest{
-			UserID:         device.UserID,
-			DeviceIDs:      nil,
-			ExceptDeviceID: device.ID,
+			UserID:    userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+			DeviceIDs: nil,
+		}
+		if device != nil {
+			logoutReq.ExceptDeviceID = device.ID
 		}
 		logoutRes := &userapi.PerformDeviceDeletionResponse{}
 		if err := userAPI.PerformDeviceDeletion(req.Context(), logoutReq, logoutRes); err != nil {
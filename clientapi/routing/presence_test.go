@@ -0,0 +1,133 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/input"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// testPresenceProducer records the presence events which the EDU server
+// produces.
+type testPresenceProducer struct {
+	sarama.SyncProducer
+	events []api.OutputPresenceEvent
+}
+
+func (p *testPresenceProducer) SendMessage(m *sarama.ProducerMessage) (int32, int64, error) {
+	b, err := m.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	var ev api.OutputPresenceEvent
+	if err = json.Unmarshal(b, &ev); err != nil {
+		return 0, 0, err
+	}
+	p.events = append(p.events, ev)
+	return 0, 0, nil
+}
+
+func newTestPresenceEDUAPI(cfg *config.ClientAPI) (*input.EDUServerInputAPI, *testPresenceProducer) {
+	producer := &testPresenceProducer{}
+	return &input.EDUServerInputAPI{
+		Producer:                   producer,
+		ServerName:                 "localhost",
+		PresenceStatusMsgMaxLength: cfg.PresenceStatusMsgMaxLength,
+	}, producer
+}
+
+var testPresenceDevice = &userapi.Device{UserID: "@alice:localhost", ID: "device"}
+
+func TestSetPresenceStatusMsgLength(t *testing.T) {
+	cfg := &config.ClientAPI{PresenceStatusMsgMaxLength: 10}
+	for _, tt := range []struct {
+		name      string
+		statusMsg string
+		wantCode  int
+	}{
+		{name: "no status message", wantCode: http.StatusOK},
+		{name: "within limit", statusMsg: "at lunch", wantCode: http.StatusOK},
+		{name: "exactly at limit", statusMsg: "0123456789", wantCode: http.StatusOK},
+		{name: "multi-byte characters count once", statusMsg: "ééééééééé", wantCode: http.StatusOK},
+		{name: "control characters aren't counted", statusMsg: "0123456789\u0000\u001b\u007f", wantCode: http.StatusOK},
+		{name: "oversized", statusMsg: "0123456789a", wantCode: http.StatusBadRequest},
+		{name: "very large", statusMsg: strings.Repeat("a", 65536), wantCode: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"presence": "online"}
+			if tt.statusMsg != "" {
+				body["status_msg"] = tt.statusMsg
+			}
+			b, err := json.Marshal(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPut, "/presence/@alice:localhost/status", strings.NewReader(string(b)))
+			eduAPI, _ := newTestPresenceEDUAPI(cfg)
+			res := SetPresence(req, cfg, testPresenceDevice, eduAPI, "@alice:localhost")
+			if res.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+		})
+	}
+}
+
+func TestSetPresenceStatusMsgUnlimited(t *testing.T) {
+	cfg := &config.ClientAPI{}
+	req := httptest.NewRequest(http.MethodPut, "/presence/@alice:localhost/status",
+		strings.NewReader(`{"presence":"online","status_msg":"`+strings.Repeat("a", 4096)+`"}`))
+	eduAPI, _ := newTestPresenceEDUAPI(cfg)
+	if res := SetPresence(req, cfg, testPresenceDevice, eduAPI, "@alice:localhost"); res.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+}
+
+func TestSetPresence(t *testing.T) {
+	cfg := &config.ClientAPI{}
+	eduAPI, producer := newTestPresenceEDUAPI(cfg)
+	req := httptest.NewRequest(http.MethodPut, "/presence/@alice:localhost/status",
+		strings.NewReader(`{"presence":"unavailable","status_msg":"at\u0000 lunch"}`))
+	if res := SetPresence(req, cfg, testPresenceDevice, eduAPI, "@alice:localhost"); res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+	if len(producer.events) != 1 {
+		t.Fatalf("expected 1 presence update, got %d", len(producer.events))
+	}
+	got := producer.events[0]
+	if got.UserID != "@alice:localhost" || got.Presence != api.PresenceUnavailable || got.StatusMsg == nil || *got.StatusMsg != "at lunch" {
+		t.Errorf("unexpected presence update %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/presence/@alice:localhost/status", strings.NewReader(`{"presence":"away"}`))
+	if res := SetPresence(req, cfg, testPresenceDevice, eduAPI, "@alice:localhost"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for unknown presence, got %d", http.StatusBadRequest, res.Code)
+	}
+	req = httptest.NewRequest(http.MethodPut, "/presence/@bob:localhost/status", strings.NewReader(`{"presence":"online"}`))
+	if res := SetPresence(req, cfg, testPresenceDevice, eduAPI, "@bob:localhost"); res.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for another user, got %d", http.StatusForbidden, res.Code)
+	}
+	if len(producer.events) != 1 {
+		t.Errorf("expected rejected updates not to be sent, got %d updates", len(producer.events))
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// pushGatewayPath is the path which HTTP pusher URLs must use, see
+// https://spec.matrix.org/unstable/push-gateway-api/#post_matrixpushv1notify
+const pushGatewayPath = "/_matrix/push/v1/notify"
+
+// GetPushers handles /_matrix/client/r0/pushers
+func GetPushers(
+	req *http.Request, device *userapi.Device,
+	userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	var queryRes userapi.QueryPushersResponse
+	err = userAPI.QueryPushers(req.Context(), &userapi.QueryPushersRequest{
+		Localpart: localpart,
+	}, &queryRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Pushers == nil {
+		queryRes.Pushers = []userapi.Pusher{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// SetPusher handles /_matrix/client/r0/pushers/set
+// This endpoint allows the creation, modification and deletion of pushers for this user ID.
+// The behaviour of this endpoint varies depending on the values in the JSON body.
+func SetPusher(
+	req *http.Request, device *userapi.Device,
+	userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	body := userapi.PerformPusherSetRequest{}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePusher(&body.Pusher); resErr != nil {
+		return *resErr
+	}
+	body.Localpart = localpart
+	// The timestamp is set by the server when the pusher is stored.
+	body.PushKeyTS = 0
+	err = userAPI.PerformPusherSet(req.Context(), &body, &userapi.PerformPusherSetResponse{})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherSet failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// validatePusher checks the fields which are required when creating a pusher.
+// A pusher without a kind deletes the existing pusher, so only needs the app ID and push key.
+func validatePusher(pusher *userapi.Pusher) *util.JSONResponse {
+	missing := func(field string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam(field + " is required"),
+		}
+	}
+	invalid := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(msg),
+		}
+	}
+	if pusher.AppID == "" {
+		return missing("app_id")
+	}
+	if pusher.PushKey == "" {
+		return missing("pushkey")
+	}
+	if len(pusher.AppID) > 64 {
+		return invalid("app_id must be at most 64 characters")
+	}
+	if len(pusher.PushKey) > 512 {
+		return invalid("pushkey must be at most 512 characters")
+	}
+	switch pusher.Kind {
+	case "":
+		return nil
+	case userapi.EmailKind:
+	case userapi.HTTPKind:
+		pushURL, ok := pusher.Data["url"].(string)
+		if !ok {
+			return missing("data.url")
+		}
+		u, err := url.Parse(pushURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return invalid("data.url must be an HTTP or HTTPS URL")
+		}
+		if !strings.HasSuffix(u.Path, pushGatewayPath) {
+			return invalid("data.url must use the path " + pushGatewayPath)
+		}
+	default:
+		return invalid("kind must be http or email")
+	}
+	if pusher.AppDisplayName == "" {
+		return missing("app_display_name")
+	}
+	if pusher.DeviceDisplayName == "" {
+		return missing("device_display_name")
+	}
+	if pusher.Language == "" {
+		return missing("lang")
+	}
+	return nil
+}
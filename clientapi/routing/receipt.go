@@ -22,13 +22,18 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/eduserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
 )
 
-func SetReceipt(req *http.Request, eduAPI api.EDUServerInputAPI, device *userapi.Device, roomId, receiptType, eventId string) util.JSONResponse {
+// SetReceipt implements POST /rooms/{roomId}/receipt/{receiptType}/{eventId}
+func SetReceipt(
+	req *http.Request, eduAPI api.EDUServerInputAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *userapi.Device, roomId, receiptType, eventId string,
+) util.JSONResponse {
 	timestamp := gomatrixserverlib.AsTimestamp(time.Now())
 	logrus.WithFields(logrus.Fields{
 		"roomId":      roomId,
@@ -43,6 +48,12 @@ func SetReceipt(req *http.Request, eduAPI api.EDUServerInputAPI, device *userapi
 		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read not '%s'", receiptType))
 	}
 
+	// Only members of the room can send receipts to it, which are then
+	// shared with the other members and their servers.
+	if resErr := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomId); resErr != nil {
+		return *resErr
+	}
+
 	if err := api.SendReceipt(req.Context(), eduAPI, device.UserID, roomId, eventId, receiptType, timestamp); err != nil {
 		return util.ErrorResponse(err)
 	}
@@ -60,6 +60,12 @@ func SendRedaction(
 			JSON: jsonerror.NotFound("cannot redact event in another room"),
 		}
 	}
+	if ev.StateKey() != nil && cfg.Redactions.IsProtected(ev.Type()) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Redacting " + ev.Type() + " events is not allowed on this server"),
+		}
+	}
 
 	// "Users may redact their own events, and any user with a power level greater than or equal
 	// to the redact power level of the room may redact events there"
@@ -115,7 +121,7 @@ func SendRedaction(
 
 	var queryRes api.QueryLatestEventsAndStateResponse
 	e, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
-	if err == eventutil.ErrRoomNoExists {
+	if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Room does not exist"),
@@ -0,0 +1,178 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	redactionTestRoomID = "!room:localhost"
+	redactionTestUserID = "@alice:localhost"
+)
+
+type redactionRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPITrace
+	events          map[string]*gomatrixserverlib.HeaderedEvent
+	state           []*gomatrixserverlib.HeaderedEvent
+	inputRoomEvents []roomserverAPI.InputRoomEvent
+}
+
+func (r *redactionRoomserverAPI) QueryCurrentState(
+	ctx context.Context,
+	req *roomserverAPI.QueryCurrentStateRequest,
+	res *roomserverAPI.QueryCurrentStateResponse,
+) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, tuple := range req.StateTuples {
+		for _, ev := range r.state {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents[tuple] = ev
+			}
+		}
+	}
+	return nil
+}
+
+func (r *redactionRoomserverAPI) QueryEventsByID(
+	ctx context.Context,
+	req *roomserverAPI.QueryEventsByIDRequest,
+	res *roomserverAPI.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range req.EventIDs {
+		if ev, ok := r.events[eventID]; ok {
+			res.Events = append(res.Events, ev)
+		}
+	}
+	return nil
+}
+
+func (r *redactionRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	req *roomserverAPI.QueryLatestEventsAndStateRequest,
+	res *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	res.StateEvents = r.state
+	res.Depth = int64(len(r.events) + 1)
+	return nil
+}
+
+func (r *redactionRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *roomserverAPI.InputRoomEventsRequest,
+	res *roomserverAPI.InputRoomEventsResponse,
+) {
+	r.inputRoomEvents = append(r.inputRoomEvents, req.InputRoomEvents...)
+}
+
+func mustCreateRedactionTestEvent(
+	t *testing.T, key ed25519.PrivateKey, evType string, stateKey *string, content interface{},
+) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   redactionTestUserID,
+		RoomID:   redactionTestRoomID,
+		Type:     evType,
+		StateKey: stateKey,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
+
+func TestSendRedactionProtectedStateEvents(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	emptyStateKey := ""
+	userID := redactionTestUserID
+	create := mustCreateRedactionTestEvent(t, key, gomatrixserverlib.MRoomCreate, &emptyStateKey, map[string]interface{}{
+		"creator": redactionTestUserID,
+	})
+	join := mustCreateRedactionTestEvent(t, key, gomatrixserverlib.MRoomMember, &userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	})
+	message := mustCreateRedactionTestEvent(t, key, "m.room.message", nil, map[string]interface{}{
+		"body": "oops",
+	})
+
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	cfg.Redactions.Defaults()
+	device := &userapi.Device{UserID: redactionTestUserID}
+
+	for _, tc := range []struct {
+		name     string
+		target   *gomatrixserverlib.HeaderedEvent
+		wantCode int
+	}{
+		{"create event", create, http.StatusForbidden},
+		{"membership event", join, http.StatusOK},
+		{"message", message, http.StatusOK},
+	} {
+		rsAPI := &redactionRoomserverAPI{
+			events: map[string]*gomatrixserverlib.HeaderedEvent{
+				create.EventID():  create,
+				join.EventID():    join,
+				message.EventID(): message,
+			},
+			state: []*gomatrixserverlib.HeaderedEvent{create, join},
+		}
+		req := httptest.NewRequest(http.MethodPut, "/redact", strings.NewReader(`{"reason":"test"}`))
+		res := SendRedaction(req, device, redactionTestRoomID, tc.target.EventID(), cfg, rsAPI)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: expected status %d, got %d: %+v", tc.name, tc.wantCode, res.Code, res.JSON)
+			continue
+		}
+		switch res.Code {
+		case http.StatusForbidden:
+			if merr, ok := res.JSON.(*jsonerror.MatrixError); !ok || merr.ErrCode != "M_FORBIDDEN" {
+				t.Errorf("%s: expected M_FORBIDDEN, got %+v", tc.name, res.JSON)
+			}
+			if len(rsAPI.inputRoomEvents) != 0 {
+				t.Errorf("%s: expected no redaction to be sent, got %d events", tc.name, len(rsAPI.inputRoomEvents))
+			}
+		case http.StatusOK:
+			if len(rsAPI.inputRoomEvents) != 1 || rsAPI.inputRoomEvents[0].Event.Redacts() != tc.target.EventID() {
+				t.Errorf("%s: expected a redaction of %s to be sent, got %+v", tc.name, tc.target.EventID(), rsAPI.inputRoomEvents)
+			}
+		}
+	}
+}
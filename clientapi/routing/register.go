@@ -36,6 +36,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -73,6 +74,12 @@ func init() {
 type sessionsDict struct {
 	sync.Mutex
 	sessions map[string][]authtypes.LoginType
+	// The email validation sessions completed for each session, whose
+	// addresses are associated with the account once it is created.
+	threepids map[string]*authtypes.ThreePIDValidationSession
+	// The registration token provided for each session, which is used up
+	// once the account is created.
+	registrationTokens map[string]string
 }
 
 // GetCompletedStages returns the completed stages for a session.
@@ -89,10 +96,43 @@ func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginTyp
 
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
+		sessions:           make(map[string][]authtypes.LoginType),
+		threepids:          make(map[string]*authtypes.ThreePIDValidationSession),
+		registrationTokens: make(map[string]string),
 	}
 }
 
+// setRegistrationToken records the registration token provided for a session.
+func (d *sessionsDict) setRegistrationToken(sessionID, token string) {
+	d.Lock()
+	defer d.Unlock()
+	d.registrationTokens[sessionID] = token
+}
+
+// getRegistrationToken returns the registration token provided for a
+// session, or an empty string if there is none.
+func (d *sessionsDict) getRegistrationToken(sessionID string) string {
+	d.Lock()
+	defer d.Unlock()
+	return d.registrationTokens[sessionID]
+}
+
+// setThreePIDSession records the email validation session completed for a
+// session.
+func (d *sessionsDict) setThreePIDSession(sessionID string, session *authtypes.ThreePIDValidationSession) {
+	d.Lock()
+	defer d.Unlock()
+	d.threepids[sessionID] = session
+}
+
+// getThreePIDSession returns the email validation session completed for a
+// session, or nil if there is none.
+func (d *sessionsDict) getThreePIDSession(sessionID string) *authtypes.ThreePIDValidationSession {
+	d.Lock()
+	defer d.Unlock()
+	return d.threepids[sessionID]
+}
+
 // AddCompletedSessionStage records that a session has completed an auth stage.
 func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
 	sessions.Lock()
@@ -135,6 +175,9 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refresh tokens (MSC2918)
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -147,6 +190,10 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// m.login.email.identity
+	ThreePIDCreds *threepid.Credentials `json:"threepid_creds"`
+	// m.login.registration_token
+	Token string `json:"token"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -176,6 +223,9 @@ type registerResponse struct {
 	AccessToken string                       `json:"access_token,omitempty"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id,omitempty"`
+	// Only set if the client supports refresh tokens and access tokens expire.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -522,7 +572,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accessToken, accessTokenErr)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accountDB, accessToken, accessTokenErr)
 }
 
 func handleGuestRegistration(
@@ -531,6 +581,13 @@ func handleGuestRegistration(
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
 ) util.JSONResponse {
+	if cfg.GuestsDisabled {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Guest registration is disabled"),
+		}
+	}
+
 	var res userapi.PerformAccountCreationResponse
 	err := userAPI.PerformAccountCreation(req.Context(), &userapi.PerformAccountCreationRequest{
 		AccountType: userapi.AccountTypeGuest,
@@ -561,6 +618,8 @@ func handleGuestRegistration(
 		AccessToken:       token,
 		IPAddr:            req.RemoteAddr,
 		UserAgent:         req.UserAgent(),
+		RefreshToken:      r.RefreshToken,
+		AccountType:       userapi.AccountTypeGuest,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -568,13 +627,18 @@ func handleGuestRegistration(
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if devRes.DeviceLimitExceeded {
+		return deviceLimitExceededResponse()
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  res.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			HomeServer:   res.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: devRes.RefreshToken,
+			ExpiresInMS:  devRes.ExpiresInMS,
 		},
 	}
 }
@@ -588,6 +652,7 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 	accessToken string,
 	accessTokenErr error,
 ) util.JSONResponse {
@@ -597,7 +662,7 @@ func handleRegistrationFlow(
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
+	// TODO: msisdn auth type.
 
 	// Appservices are special and are not affected by disabled
 	// registration or user exclusivity. We'll go onto the appservice
@@ -644,6 +709,69 @@ func handleRegistrationFlow(
 		// Add Dummy to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
+	case authtypes.LoginTypeEmail:
+		if !cfg.Email.Enabled {
+			return util.JSONResponse{
+				Code: http.StatusNotImplemented,
+				JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+			}
+		}
+		if r.Auth.ThreePIDCreds == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam("threepid_creds is required"),
+			}
+		}
+		// Check that the email address was verified by the homeserver
+		// and isn't in use by another account yet.
+		session, resErr := checkLocalThreePIDSession(req, *r.Auth.ThreePIDCreds, accountDB, cfg)
+		if resErr != nil {
+			return *resErr
+		}
+		localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), session.Address, session.Medium)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if localpart != "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_IN_USE",
+					Err:     accounts.Err3PIDInUse.Error(),
+				},
+			}
+		}
+
+		// Add the email address to the list of completed registration stages
+		sessions.setThreePIDSession(sessionID, session)
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
+	case authtypes.LoginTypeRegistrationToken, authtypes.LoginTypeRegistrationTokenUnstable:
+		if !cfg.RegistrationRequiresToken {
+			return util.JSONResponse{
+				Code: http.StatusNotImplemented,
+				JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+			}
+		}
+		// Check that the token exists and can still be used. It is only
+		// used up once the account is created.
+		token, err := accountDB.GetRegistrationToken(req.Context(), r.Auth.Token)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+		if token == nil || !token.Valid(nowMS()) {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("Invalid registration token"),
+			}
+		}
+
+		// Add the registration token to the list of completed registration stages
+		sessions.setRegistrationToken(sessionID, token.Token)
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
 	case "":
 		// An empty auth type means that we want to fetch the available
 		// flows. It can also mean that we want to register as an appservice
@@ -659,7 +787,7 @@ func handleRegistrationFlow(
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, accountDB)
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -701,7 +829,7 @@ func handleApplicationServiceRegistration(
 	// application service registration is entirely separate.
 	return completeRegistration(
 		req.Context(), userAPI, r.Username, "", appserviceID, req.RemoteAddr, req.UserAgent(),
-		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		r.InhibitLogin, r.InitialDisplayName, r.DeviceID, r.RefreshToken,
 	)
 }
 
@@ -715,13 +843,40 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
+		// Use up the registration token, if any, before creating the account
+		// so that it can't be used more times than it allows.
+		token := sessions.getRegistrationToken(sessionID)
+		if token != "" {
+			used, err := accountDB.UseRegistrationToken(req.Context(), token, nowMS())
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.UseRegistrationToken failed")
+				return jsonerror.InternalServerError()
+			}
+			if !used {
+				return util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: jsonerror.Forbidden("The registration token is no longer valid"),
+				}
+			}
+		}
+
 		// This flow was completed, registration can continue
-		return completeRegistration(
+		res := completeRegistration(
 			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			r.InhibitLogin, r.InitialDisplayName, r.DeviceID, r.RefreshToken,
 		)
+		if res.Code == http.StatusOK {
+			saveRegistrationThreePID(req.Context(), accountDB, sessionID, r.Username)
+		} else if token != "" {
+			// The account wasn't created, so give the use of the token back.
+			if err := accountDB.ReleaseRegistrationToken(req.Context(), token); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.ReleaseRegistrationToken failed")
+			}
+		}
+		return res
 	}
 
 	// There are still more stages to complete.
@@ -733,6 +888,25 @@ func checkAndCompleteFlow(
 	}
 }
 
+// saveRegistrationThreePID associates the email address verified during the
+// registration, if any, with the new account. The account has already been
+// created by then, so failures are only logged.
+func saveRegistrationThreePID(
+	ctx context.Context, accountDB accounts.Database, sessionID, localpart string,
+) {
+	session := sessions.getThreePIDSession(sessionID)
+	if session == nil {
+		return
+	}
+	logger := util.GetLogger(ctx).WithField("localpart", localpart)
+	if err := accountDB.SaveThreePIDAssociation(ctx, session.Address, localpart, session.Medium); err != nil {
+		logger.WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+	}
+	if err := accountDB.RemoveThreePIDValidationSession(ctx, session.SessionID); err != nil {
+		logger.WithError(err).Error("accountDB.RemoveThreePIDValidationSession failed")
+	}
+}
+
 // completeRegistration runs some rudimentary checks against the submitted
 // input, then if successful creates an account and a newly associated device
 // We pass in each individual part of the request here instead of just passing a
@@ -745,6 +919,7 @@ func completeRegistration(
 	username, password, appserviceID, ipAddr, userAgent string,
 	inhibitLogin eventutil.WeakBoolean,
 	displayName, deviceID *string,
+	refreshToken bool,
 ) util.JSONResponse {
 	if username == "" {
 		return util.JSONResponse{
@@ -812,6 +987,7 @@ func completeRegistration(
 		DeviceID:          deviceID,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		RefreshToken:      refreshToken,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -819,14 +995,19 @@ func completeRegistration(
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if devRes.DeviceLimitExceeded {
+		return deviceLimitExceededResponse()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  accRes.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			HomeServer:   accRes.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: devRes.RefreshToken,
+			ExpiresInMS:  devRes.ExpiresInMS,
 		},
 	}
 }
@@ -963,5 +1144,14 @@ func handleSharedSecretRegistration(userAPI userapi.UserInternalAPI, sr *SharedS
 		return *resErr
 	}
 	deviceID := "shared_secret_registration"
-	return completeRegistration(req.Context(), userAPI, ssrr.User, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), false, &ssrr.User, &deviceID)
+	return completeRegistration(req.Context(), userAPI, ssrr.User, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), false, &ssrr.User, &deviceID, false)
+}
+
+// deviceLimitExceededResponse is returned when a device can't be created
+// because the user is already at the configured per-user device limit.
+func deviceLimitExceededResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: jsonerror.LimitExceeded("Too many devices, log out of an existing device first", 0),
+	}
 }
@@ -0,0 +1,281 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+	registrationTokenChars         = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._~-"
+)
+
+var validRegistrationTokenRegex = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+type registrationTokenValidityResponse struct {
+	Valid bool `json:"valid"`
+}
+
+type registrationTokensResponse struct {
+	RegistrationTokens []userapi.RegistrationToken `json:"registration_tokens"`
+}
+
+type newRegistrationTokenRequest struct {
+	Token       string `json:"token"`
+	UsesAllowed *int32 `json:"uses_allowed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+	Length      int    `json:"length"`
+}
+
+// CheckRegistrationTokenValidity implements
+// GET /v1/register/m.login.registration_token/validity, which tells clients
+// whether a registration token can be used before they ask for the other
+// registration details.
+func CheckRegistrationTokenValidity(
+	req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI,
+) util.JSONResponse {
+	if !cfg.RegistrationRequiresToken {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration doesn't require a token"),
+		}
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("token is required"),
+		}
+	}
+	res, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: registrationTokenValidityResponse{
+			Valid: res != nil && res.Valid(nowMS()),
+		},
+	}
+}
+
+// GetRegistrationTokens implements GET /admin/registration_tokens. The valid
+// query parameter optionally restricts the results to the tokens which can
+// (true) or can't (false) still be used.
+func GetRegistrationTokens(
+	req *http.Request, accountDB accounts.Database,
+) util.JSONResponse {
+	tokens, err := accountDB.GetRegistrationTokens(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+		return jsonerror.InternalServerError()
+	}
+	res := registrationTokensResponse{
+		RegistrationTokens: []userapi.RegistrationToken{},
+	}
+	valid := req.URL.Query().Get("valid")
+	now := nowMS()
+	for i := range tokens {
+		if valid != "" && tokens[i].Valid(now) != (valid == "true") {
+			continue
+		}
+		res.RegistrationTokens = append(res.RegistrationTokens, tokens[i])
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// CreateRegistrationToken implements POST /admin/registration_tokens/new.
+// A random token is generated unless one is given.
+func CreateRegistrationToken(
+	req *http.Request, accountDB accounts.Database,
+) util.JSONResponse {
+	var r newRegistrationTokenRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Token != "" && !validRegistrationTokenRegex.MatchString(r.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("token must consist of at most 64 characters from [A-Za-z0-9._~-]"),
+		}
+	}
+	if r.Length == 0 {
+		r.Length = defaultRegistrationTokenLength
+	}
+	if r.Length < 0 || r.Length > maxRegistrationTokenLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("length must be between 1 and 64"),
+		}
+	}
+	if resErr := validateRegistrationTokenLimits(r.UsesAllowed, r.ExpiryTime); resErr != nil {
+		return *resErr
+	}
+
+	token := userapi.RegistrationToken{
+		Token:       r.Token,
+		UsesAllowed: r.UsesAllowed,
+		ExpiryTime:  r.ExpiryTime,
+	}
+	// Generated tokens are retried a few times in the unlikely event that
+	// they already exist.
+	for attempt := 0; attempt < 3; attempt++ {
+		if r.Token == "" {
+			generated, err := generateRegistrationToken(r.Length)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("generateRegistrationToken failed")
+				return jsonerror.InternalServerError()
+			}
+			token.Token = generated
+		}
+		created, err := accountDB.CreateRegistrationToken(req.Context(), &token)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+		if created {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: token,
+			}
+		}
+		if r.Token != "" {
+			break
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidParam("The registration token already exists"),
+	}
+}
+
+// RegistrationToken implements GET, PUT and DELETE on
+// /admin/registration_tokens/{token}. PUT updates the uses_allowed and
+// expiry_time of the token which are present in the request, where null
+// removes the limit.
+func RegistrationToken(
+	req *http.Request, accountDB accounts.Database, tokenName string,
+) util.JSONResponse {
+	token, err := accountDB.GetRegistrationToken(req.Context(), tokenName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if token == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No such registration token"),
+		}
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var r map[string]json.RawMessage
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if raw, ok := r["uses_allowed"]; ok {
+			token.UsesAllowed = nil
+			if err = json.Unmarshal(raw, &token.UsesAllowed); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidParam("uses_allowed must be an integer or null"),
+				}
+			}
+		}
+		if raw, ok := r["expiry_time"]; ok {
+			token.ExpiryTime = nil
+			if err = json.Unmarshal(raw, &token.ExpiryTime); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidParam("expiry_time must be an integer or null"),
+				}
+			}
+		}
+		if resErr := validateRegistrationTokenLimits(token.UsesAllowed, token.ExpiryTime); resErr != nil {
+			return *resErr
+		}
+		if err = accountDB.UpdateRegistrationToken(req.Context(), token.Token, token.UsesAllowed, token.ExpiryTime); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.UpdateRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+
+	case http.MethodDelete:
+		if err = accountDB.RemoveRegistrationToken(req.Context(), token.Token); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: token,
+	}
+}
+
+func validateRegistrationTokenLimits(usesAllowed *int32, expiryTime *int64) *util.JSONResponse {
+	if usesAllowed != nil && *usesAllowed < 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("uses_allowed must not be negative"),
+		}
+	}
+	if expiryTime != nil && *expiryTime < nowMS() {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("expiry_time must not be in the past"),
+		}
+	}
+	return nil
+}
+
+func generateRegistrationToken(length int) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(registrationTokenChars)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = registrationTokenChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+func nowMS() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
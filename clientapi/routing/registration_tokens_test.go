@@ -0,0 +1,189 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type registrationTokensAccountDB struct {
+	accounts.Database
+	tokens map[string]*userapi.RegistrationToken
+}
+
+func (d *registrationTokensAccountDB) CreateRegistrationToken(ctx context.Context, token *userapi.RegistrationToken) (bool, error) {
+	if _, ok := d.tokens[token.Token]; ok {
+		return false, nil
+	}
+	t := *token
+	d.tokens[token.Token] = &t
+	return true, nil
+}
+
+func (d *registrationTokensAccountDB) GetRegistrationToken(ctx context.Context, token string) (*userapi.RegistrationToken, error) {
+	if t, ok := d.tokens[token]; ok {
+		res := *t
+		return &res, nil
+	}
+	return nil, nil
+}
+
+func (d *registrationTokensAccountDB) GetRegistrationTokens(ctx context.Context) ([]userapi.RegistrationToken, error) {
+	var res []userapi.RegistrationToken
+	for _, t := range d.tokens {
+		res = append(res, *t)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Token < res[j].Token })
+	return res, nil
+}
+
+func (d *registrationTokensAccountDB) UpdateRegistrationToken(ctx context.Context, token string, usesAllowed *int32, expiryTime *int64) error {
+	d.tokens[token].UsesAllowed, d.tokens[token].ExpiryTime = usesAllowed, expiryTime
+	return nil
+}
+
+func (d *registrationTokensAccountDB) RemoveRegistrationToken(ctx context.Context, token string) error {
+	delete(d.tokens, token)
+	return nil
+}
+
+func (d *registrationTokensAccountDB) UseRegistrationToken(ctx context.Context, token string, nowMS int64) (bool, error) {
+	t, ok := d.tokens[token]
+	if !ok || !t.Valid(nowMS) {
+		return false, nil
+	}
+	t.Completed++
+	return true, nil
+}
+
+func (d *registrationTokensAccountDB) ReleaseRegistrationToken(ctx context.Context, token string) error {
+	d.tokens[token].Completed--
+	return nil
+}
+
+type registrationTokensUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (a *registrationTokensUserAPI) PerformAccountCreation(ctx context.Context, req *userapi.PerformAccountCreationRequest, res *userapi.PerformAccountCreationResponse) error {
+	if req.Localpart == "taken" {
+		return &userapi.ErrorConflict{Message: "user already exists"}
+	}
+	res.AccountCreated = true
+	res.Account = &userapi.Account{Localpart: req.Localpart, ServerName: "localhost"}
+	return nil
+}
+
+func TestRegistrationTokensAdmin(t *testing.T) {
+	accountDB := &registrationTokensAccountDB{tokens: map[string]*userapi.RegistrationToken{}}
+
+	create := func(body string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/registration_tokens/new", strings.NewReader(body))
+		res := CreateRegistrationToken(req, accountDB)
+		return res.Code, res.JSON
+	}
+
+	code, res := create(`{"token":"invite-only","uses_allowed":1}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", code, res)
+	}
+	if token := res.(userapi.RegistrationToken); token.Token != "invite-only" || *token.UsesAllowed != 1 {
+		t.Fatalf("unexpected token %+v", token)
+	}
+	if code, res = create(`{"token":"invite-only"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for an existing token, got %d: %+v", code, res)
+	}
+	if code, res = create(`{"token":"not allowed!"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for an invalid token, got %d: %+v", code, res)
+	}
+	if code, res = create(`{"expiry_time":1}`); code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for an expiry time in the past, got %d: %+v", code, res)
+	}
+	code, res = create(`{"length":20}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", code, res)
+	}
+	generated := res.(userapi.RegistrationToken).Token
+	if !validRegistrationTokenRegex.MatchString(generated) || len(generated) != 20 {
+		t.Fatalf("unexpected generated token %q", generated)
+	}
+
+	// Use up the first token, so that only the generated one is valid.
+	accountDB.tokens["invite-only"].Completed = 1
+	req := httptest.NewRequest(http.MethodGet, "/admin/registration_tokens?valid=true", nil)
+	list := GetRegistrationTokens(req, accountDB).JSON.(registrationTokensResponse).RegistrationTokens
+	if len(list) != 1 || list[0].Token != generated {
+		t.Fatalf("expected only %q to be valid, got %+v", generated, list)
+	}
+
+	// Removing the limit makes the token valid again.
+	req = httptest.NewRequest(http.MethodPut, "/admin/registration_tokens/invite-only", strings.NewReader(`{"uses_allowed":null}`))
+	if updateRes := RegistrationToken(req, accountDB, "invite-only"); updateRes.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", updateRes.Code, updateRes.JSON)
+	}
+	if accountDB.tokens["invite-only"].UsesAllowed != nil {
+		t.Fatalf("expected uses_allowed to be removed")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/admin/registration_tokens/invite-only", nil)
+	if deleteRes := RegistrationToken(req, accountDB, "invite-only"); deleteRes.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", deleteRes.Code, deleteRes.JSON)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/admin/registration_tokens/invite-only", nil)
+	if getRes := RegistrationToken(req, accountDB, "invite-only"); getRes.Code != http.StatusNotFound {
+		t.Fatalf("expected HTTP 404 after deletion, got %d: %+v", getRes.Code, getRes.JSON)
+	}
+}
+
+func TestRegistrationTokenRegistration(t *testing.T) {
+	one := int32(1)
+	accountDB := &registrationTokensAccountDB{tokens: map[string]*userapi.RegistrationToken{
+		"invite-only": {Token: "invite-only", UsesAllowed: &one},
+	}}
+	cfg := &config.ClientAPI{
+		Matrix:                    &config.Global{ServerName: "localhost"},
+		Derived:                   &config.Derived{},
+		RegistrationRequiresToken: true,
+	}
+	cfg.Derived.Registration.Flows = []authtypes.Flow{
+		{Stages: []authtypes.LoginType{authtypes.LoginTypeRegistrationToken}},
+	}
+	userAPI := &registrationTokensUserAPI{}
+
+	register := func(username, token string) int {
+		body := `{"username":"` + username + `","password":"correct horse battery staple","inhibit_login":true,` +
+			`"auth":{"type":"m.login.registration_token","token":"` + token + `"}}`
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/register", strings.NewReader(body))
+		return Register(req, userAPI, accountDB, cfg).Code
+	}
+
+	if code := register("alice", "unknown"); code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 for an unknown token, got %d", code)
+	}
+	// A failed registration doesn't use the token up.
+	if code := register("taken", "invite-only"); code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for a taken username, got %d", code)
+	}
+	if completed := accountDB.tokens["invite-only"].Completed; completed != 0 {
+		t.Fatalf("expected the token to be released, got %d completed", completed)
+	}
+	if code := register("alice", "invite-only"); code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d", code)
+	}
+	if code := register("bob", "invite-only"); code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 once the token is used up, got %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v1/register/m.login.registration_token/validity?token=invite-only", nil)
+	if res := CheckRegistrationTokenValidity(req, accountDB, cfg); res.JSON.(registrationTokenValidityResponse).Valid {
+		t.Fatalf("expected the used up token to be invalid")
+	}
+}
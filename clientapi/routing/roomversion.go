@@ -0,0 +1,268 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// roomVersionCacheLifetime is how long we remember the room version
+// of a remote room for before asking the resident servers again.
+const roomVersionCacheLifetime = time.Minute * 5
+
+type roomVersionResponse struct {
+	RoomID      string                        `json:"room_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// Whether this server supports the room version, i.e. whether
+	// a join is expected to work.
+	Supported bool `json:"supported"`
+	// Whether the room version is considered stable.
+	Stable bool `json:"stable"`
+}
+
+type cachedRoomVersion struct {
+	roomVersion gomatrixserverlib.RoomVersion
+	expires     time.Time
+}
+
+// RoomVersionCache remembers the room versions of remote rooms for
+// a short while, so that repeated lookups don't result in repeated
+// federation requests.
+type RoomVersionCache struct {
+	mutex    sync.Mutex
+	versions map[string]cachedRoomVersion
+	lifetime time.Duration
+}
+
+// NewRoomVersionCache creates a new room version cache, where entries
+// expire after the given lifetime.
+func NewRoomVersionCache(lifetime time.Duration) *RoomVersionCache {
+	return &RoomVersionCache{
+		versions: make(map[string]cachedRoomVersion),
+		lifetime: lifetime,
+	}
+}
+
+func (c *RoomVersionCache) get(roomID string) (gomatrixserverlib.RoomVersion, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.versions[roomID]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(cached.expires) {
+		delete(c.versions, roomID)
+		return "", false
+	}
+	return cached.roomVersion, true
+}
+
+func (c *RoomVersionCache) store(roomID string, roomVersion gomatrixserverlib.RoomVersion) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	// Take the opportunity to clean up anything that has expired.
+	for id, cached := range c.versions {
+		if now.After(cached.expires) {
+			delete(c.versions, id)
+		}
+	}
+	c.versions[roomID] = cachedRoomVersion{
+		roomVersion: roomVersion,
+		expires:     now.Add(c.lifetime),
+	}
+}
+
+// GetRoomVersion implements GET /rooms/{roomIDOrAlias}/version, which
+// allows clients to find out the version of a room, and whether this
+// server supports it, before trying to join it. Rooms that we don't
+// know about are looked up on the resident servers over federation.
+func GetRoomVersion(
+	req *http.Request,
+	device *userapi.Device,
+	roomIDOrAlias string,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	federation *gomatrixserverlib.FederationClient,
+	cache *RoomVersionCache,
+) util.JSONResponse {
+	ctx := req.Context()
+	roomID := roomIDOrAlias
+	var serverNames []gomatrixserverlib.ServerName
+	for _, serverName := range req.URL.Query()["server_name"] {
+		serverNames = append(serverNames, gomatrixserverlib.ServerName(serverName))
+	}
+
+	switch roomIDOrAlias[0] {
+	case '!':
+		_, domain, err := gomatrixserverlib.SplitID('!', roomIDOrAlias)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid room ID"),
+			}
+		}
+		serverNames = append(serverNames, domain)
+	case '#':
+		_, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid room alias"),
+			}
+		}
+		aliasReq := &roomserverAPI.GetRoomIDForAliasRequest{
+			Alias:              roomIDOrAlias,
+			IncludeAppservices: true,
+		}
+		aliasRes := &roomserverAPI.GetRoomIDForAliasResponse{}
+		if err = rsAPI.GetRoomIDForAlias(ctx, aliasReq, aliasRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		roomID = aliasRes.RoomID
+		if roomID == "" && domain != cfg.Matrix.ServerName {
+			dirRes, dirErr := federation.LookupRoomAlias(ctx, domain, roomIDOrAlias)
+			if dirErr != nil {
+				util.GetLogger(ctx).WithError(dirErr).Warn("federation.LookupRoomAlias failed")
+			} else {
+				roomID = dirRes.RoomID
+				serverNames = append(serverNames, dirRes.Servers...)
+			}
+		}
+		if roomID == "" {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("Room alias not found"),
+			}
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Expected a room ID or a room alias"),
+		}
+	}
+
+	roomVersion, err := roomVersionForRoom(ctx, device, roomID, serverNames, cfg, rsAPI, federation, cache)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to find room version")
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unable to find the version of the room"),
+		}
+	}
+
+	res := roomVersionResponse{
+		RoomID:      roomID,
+		RoomVersion: roomVersion,
+	}
+	if desc, ok := gomatrixserverlib.SupportedRoomVersions()[roomVersion]; ok {
+		res.Supported = true
+		res.Stable = desc.Stable
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// roomVersionForRoom returns the room version of the given room, either
+// from the roomserver if we know about the room already, or by asking
+// the given resident servers for a make_join template otherwise.
+func roomVersionForRoom(
+	ctx context.Context,
+	device *userapi.Device,
+	roomID string,
+	serverNames []gomatrixserverlib.ServerName,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	federation *gomatrixserverlib.FederationClient,
+	cache *RoomVersionCache,
+) (gomatrixserverlib.RoomVersion, error) {
+	verReq := &roomserverAPI.QueryRoomVersionForRoomRequest{RoomID: roomID}
+	verRes := &roomserverAPI.QueryRoomVersionForRoomResponse{}
+	if err := rsAPI.QueryRoomVersionForRoom(ctx, verReq, verRes); err == nil {
+		return verRes.RoomVersion, nil
+	}
+	if roomVersion, ok := cache.get(roomID); ok {
+		return roomVersion, nil
+	}
+
+	supported := make([]gomatrixserverlib.RoomVersion, 0, len(gomatrixserverlib.SupportedRoomVersions()))
+	for roomVersion := range gomatrixserverlib.SupportedRoomVersions() {
+		supported = append(supported, roomVersion)
+	}
+
+	lastErr := errors.New("no resident servers to ask")
+	tried := map[gomatrixserverlib.ServerName]struct{}{}
+	for _, serverName := range serverNames {
+		if _, ok := tried[serverName]; ok || serverName == cfg.Matrix.ServerName {
+			continue
+		}
+		tried[serverName] = struct{}{}
+		// A make_join doesn't change any state on the remote side, but the
+		// template that comes back tells us what the room version is.
+		res, err := federation.MakeJoin(ctx, serverName, roomID, device.UserID, supported)
+		if err == nil {
+			if res.RoomVersion == "" {
+				// Servers are allowed to omit this for version 1 rooms.
+				res.RoomVersion = gomatrixserverlib.RoomVersionV1
+			}
+			cache.store(roomID, res.RoomVersion)
+			return res.RoomVersion, nil
+		}
+		// If the remote server tells us that we don't support the room
+		// version then that's still an answer.
+		if roomVersion, ok := incompatibleRoomVersion(err); ok {
+			cache.store(roomID, roomVersion)
+			return roomVersion, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// incompatibleRoomVersion extracts the room version from a make_join
+// M_INCOMPATIBLE_ROOM_VERSION error response, if there is one.
+func incompatibleRoomVersion(err error) (gomatrixserverlib.RoomVersion, bool) {
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return "", false
+	}
+	var res struct {
+		Code        string                        `json:"errcode"`
+		RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	}
+	if json.Unmarshal(httpErr.Contents, &res) != nil {
+		return "", false
+	}
+	if res.Code != "M_INCOMPATIBLE_ROOM_VERSION" || res.RoomVersion == "" {
+		return "", false
+	}
+	return res.RoomVersion, true
+}
@@ -0,0 +1,153 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type roomVersionRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPITrace
+	versions map[string]gomatrixserverlib.RoomVersion
+}
+
+func (r *roomVersionRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context,
+	req *roomserverAPI.QueryRoomVersionForRoomRequest,
+	res *roomserverAPI.QueryRoomVersionForRoomResponse,
+) error {
+	roomVersion, ok := r.versions[req.RoomID]
+	if !ok {
+		return fmt.Errorf("missing room info for room %s", req.RoomID)
+	}
+	res.RoomVersion = roomVersion
+	return nil
+}
+
+func (r *roomVersionRoomserverAPI) GetRoomIDForAlias(
+	ctx context.Context,
+	req *roomserverAPI.GetRoomIDForAliasRequest,
+	res *roomserverAPI.GetRoomIDForAliasResponse,
+) error {
+	return nil
+}
+
+type roomVersionRoundTripper struct {
+	fn func(*http.Request) (*http.Response, error)
+}
+
+func (t *roomVersionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.fn(req)
+}
+
+func roomVersionFedClient(fn func(*http.Request) (*http.Response, error)) *gomatrixserverlib.FederationClient {
+	_, pkey, _ := ed25519.GenerateKey(nil)
+	fedClient := gomatrixserverlib.NewFederationClient(
+		gomatrixserverlib.ServerName("localhost"), gomatrixserverlib.KeyID("ed25519:test"), pkey,
+	)
+	fedClient.Client = *gomatrixserverlib.NewClient(
+		gomatrixserverlib.WithTransport(&roomVersionRoundTripper{fn}),
+	)
+	return fedClient
+}
+
+func getRoomVersion(
+	t *testing.T, roomIDOrAlias string, rsAPI roomserverAPI.RoomserverInternalAPI,
+	fedClient *gomatrixserverlib.FederationClient, cache *RoomVersionCache,
+) roomVersionResponse {
+	t.Helper()
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "localhost"},
+	}
+	device := &userapi.Device{UserID: "@alice:localhost"}
+	req := httptest.NewRequest(http.MethodGet, "/rooms/"+roomIDOrAlias+"/version", nil)
+	res := GetRoomVersion(req, device, roomIDOrAlias, cfg, rsAPI, fedClient, cache)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	return res.JSON.(roomVersionResponse)
+}
+
+func TestGetRoomVersionLocal(t *testing.T) {
+	rsAPI := &roomVersionRoomserverAPI{
+		versions: map[string]gomatrixserverlib.RoomVersion{
+			"!local:localhost": gomatrixserverlib.RoomVersionV6,
+		},
+	}
+	fedClient := roomVersionFedClient(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unexpected federation request to %s", req.URL)
+	})
+	res := getRoomVersion(t, "!local:localhost", rsAPI, fedClient, NewRoomVersionCache(time.Minute))
+	if res.RoomVersion != gomatrixserverlib.RoomVersionV6 {
+		t.Fatalf("expected room version %s, got %s", gomatrixserverlib.RoomVersionV6, res.RoomVersion)
+	}
+	if !res.Supported {
+		t.Fatalf("expected room version %s to be supported", res.RoomVersion)
+	}
+}
+
+func TestGetRoomVersionRemote(t *testing.T) {
+	rsAPI := &roomVersionRoomserverAPI{}
+	requests := 0
+	fedClient := roomVersionFedClient(func(req *http.Request) (*http.Response, error) {
+		requests++
+		if req.URL.Host != "remote" || !strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/make_join/") {
+			return nil, fmt.Errorf("unexpected federation request to %s", req.URL)
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"room_version": gomatrixserverlib.RoomVersionV5,
+			"event": map[string]interface{}{
+				"type":      "m.room.member",
+				"room_id":   "!remote:remote",
+				"sender":    "@alice:localhost",
+				"state_key": "@alice:localhost",
+				"content":   map[string]interface{}{"membership": "join"},
+			},
+		})
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(string(body))),
+		}, nil
+	})
+	cache := NewRoomVersionCache(time.Minute)
+	for i := 0; i < 2; i++ {
+		res := getRoomVersion(t, "!remote:remote", rsAPI, fedClient, cache)
+		if res.RoomVersion != gomatrixserverlib.RoomVersionV5 {
+			t.Fatalf("expected room version %s, got %s", gomatrixserverlib.RoomVersionV5, res.RoomVersion)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected the remote room version to be cached, but made %d requests", requests)
+	}
+}
+
+func TestGetRoomVersionRemoteUnsupported(t *testing.T) {
+	rsAPI := &roomVersionRoomserverAPI{}
+	fedClient := roomVersionFedClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"errcode":"M_INCOMPATIBLE_ROOM_VERSION","error":"unsupported","room_version":"org.example.future"}`,
+			)),
+		}, nil
+	})
+	res := getRoomVersion(t, "!remote:remote", rsAPI, fedClient, NewRoomVersionCache(time.Minute))
+	if res.RoomVersion != "org.example.future" {
+		t.Fatalf("expected room version org.example.future, got %s", res.RoomVersion)
+	}
+	if res.Supported {
+		t.Fatalf("expected room version %s to be unsupported", res.RoomVersion)
+	}
+}
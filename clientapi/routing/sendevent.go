@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -22,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -72,6 +75,7 @@ func SendEvent(
 	cfg *config.ClientAPI,
 	rsAPI api.RoomserverInternalAPI,
 	txnCache *transactions.Cache,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
@@ -97,7 +101,7 @@ func SendEvent(
 	defer mutex.(*sync.Mutex).Unlock()
 
 	startedGeneratingEvent := time.Now()
-	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI)
+	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI, spamChecker)
 	if resErr != nil {
 		return *resErr
 	}
@@ -150,12 +154,34 @@ func SendEvent(
 	return res
 }
 
+// spamCheckResponse returns the response for a request which failed a
+// spam check.
+func spamCheckResponse(req *http.Request, err error) *util.JSONResponse {
+	var rejected *spamcheck.RejectedError
+	if !errors.As(err, &rejected) {
+		util.GetLogger(req.Context()).WithError(err).Error("spam check failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if rejected.RetryAfter > 0 {
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded(rejected.Reason, rejected.RetryAfter.Milliseconds()),
+		}
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden(rejected.Reason),
+	}
+}
+
 func generateSendEvent(
 	req *http.Request,
 	device *userapi.Device,
 	roomID, eventType string, stateKey *string,
 	cfg *config.ClientAPI,
 	rsAPI api.RoomserverInternalAPI,
+	spamChecker spamcheck.Checker,
 ) (*gomatrixserverlib.Event, *util.JSONResponse) {
 	// parse the incoming http request
 	userID := device.UserID
@@ -186,10 +212,25 @@ func generateSendEvent(
 		resErr := jsonerror.InternalServerError()
 		return nil, &resErr
 	}
+	if err = eventutil.DefaultContentValidators.Validate(eventType, stateKey, builder.Content); err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(err.Error()),
+		}
+	}
+	if err = spamChecker.CheckEvent(req.Context(), &spamcheck.EventRequest{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Content:  json.RawMessage(builder.Content),
+	}); err != nil {
+		return nil, spamCheckResponse(req, err)
+	}
 
 	var queryRes api.QueryLatestEventsAndStateResponse
 	e, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, evTime, rsAPI, &queryRes)
-	if err == eventutil.ErrRoomNoExists {
+	if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
 		return nil, &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Room does not exist"),
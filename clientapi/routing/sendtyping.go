@@ -24,6 +24,14 @@ import (
 	"github.com/matrix-org/util"
 )
 
+const (
+	// defaultTypingTimeout is used when the client doesn't give a timeout.
+	defaultTypingTimeout = 30 * 1000
+	// maxTypingTimeout caps how long a client can show as typing for
+	// without sending another typing notification.
+	maxTypingTimeout = 120 * 1000
+)
+
 type typingContentJSON struct {
 	Typing  bool  `json:"typing"`
 	Timeout int64 `json:"timeout"`
@@ -58,7 +66,7 @@ func SendTyping(
 	}
 
 	if err := api.SendTyping(
-		req.Context(), eduAPI, userID, roomID, r.Typing, r.Timeout,
+		req.Context(), eduAPI, userID, roomID, r.Typing, typingTimeout(r.Timeout),
 	); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("eduProducer.Send failed")
 		return jsonerror.InternalServerError()
@@ -69,3 +77,16 @@ func SendTyping(
 		JSON: struct{}{},
 	}
 }
+
+// typingTimeout returns the timeout in milliseconds to use for the timeout
+// requested by the client.
+func typingTimeout(timeout int64) int64 {
+	switch {
+	case timeout <= 0:
+		return defaultTypingTimeout
+	case timeout > maxTypingTimeout:
+		return maxTypingTimeout
+	default:
+		return timeout
+	}
+}
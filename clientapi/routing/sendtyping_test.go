@@ -0,0 +1,34 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import "testing"
+
+func TestTypingTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeout int64
+		want    int64
+	}{
+		{timeout: 0, want: defaultTypingTimeout},
+		{timeout: -5, want: defaultTypingTimeout},
+		{timeout: 5000, want: 5000},
+		{timeout: maxTypingTimeout, want: maxTypingTimeout},
+		{timeout: 24 * 60 * 60 * 1000, want: maxTypingTimeout},
+	} {
+		if got := typingTimeout(tt.timeout); got != tt.want {
+			t.Errorf("typingTimeout(%d): got %d, want %d", tt.timeout, got, tt.want)
+		}
+	}
+}
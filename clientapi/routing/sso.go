@@ -0,0 +1,308 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/sso"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// ssoCallbackPath is the path, relative to the client API, which the
+	// identity providers send users back to.
+	ssoCallbackPath = "/_matrix/client/unstable/org.matrix.dendrite/login/sso/callback"
+	// ssoStateCookie ties the callback to the browser which started the login.
+	ssoStateCookie = "dendrite_sso_state"
+	// How long users have to log in with the identity provider.
+	ssoLoginTimeout = 10 * time.Minute
+	// How many numbered localparts are tried if the one derived from the
+	// claims of a new user is taken.
+	maxSSOLocalpartAttempts = 10
+)
+
+// SSORedirect implements GET /login/sso/redirect and
+// /login/sso/redirect/{idpID}, which send the user to the identity provider.
+// The first configured provider is used if none is given.
+func SSORedirect(
+	req *http.Request, idpID string, accountDB accounts.Database,
+	providers map[string]*sso.Provider, cfg *config.ClientAPI,
+) util.JSONResponse {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("redirectUrl is required"),
+		}
+	}
+	// The user is sent back to the client with a login token for their
+	// account, so only clients which the homeserver trusts may ask for it.
+	if !cfg.SSO.RedirectURLAllowed(redirectURL) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("redirectUrl isn't an allowed client URL"),
+		}
+	}
+	if idpID == "" {
+		idpID = cfg.SSO.Providers[0].ID
+	}
+	provider, ok := providers[idpID]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown identity provider"),
+		}
+	}
+
+	state, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	nonce, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	authURL, err := provider.AuthorizationURL(req.Context(), ssoCallbackURL(cfg), state, nonce)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.AuthorizationURL failed")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to contact the identity provider"),
+		}
+	}
+	expiresAtMS := nowMS() + int64(ssoLoginTimeout/time.Millisecond)
+	if err = accountDB.CreateSSOLogin(req.Context(), state, idpID, redirectURL, nonce, expiresAtMS, nowMS()); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateSSOLogin failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusFound,
+		Headers: map[string]string{
+			"Location":   authURL,
+			"Set-Cookie": ssoCookie(cfg, state, int(ssoLoginTimeout/time.Second)).String(),
+		},
+		JSON: struct{}{},
+	}
+}
+
+// SSOCallback implements the endpoint which the identity providers send
+// users back to. The user is mapped to an account, which is created if the
+// provider allows it, and sent back to the client with a login token.
+func SSOCallback(
+	req *http.Request, userAPI userapi.UserInternalAPI, accountDB accounts.Database,
+	providers map[string]*sso.Provider, cfg *config.ClientAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	state := query.Get("state")
+	cookie, err := req.Cookie(ssoStateCookie)
+	if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Forbidden("The login wasn't started from this browser"),
+		}
+	}
+	idpID, redirectURL, nonce, err := accountDB.ConsumeSSOLogin(req.Context(), state, nowMS())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.ConsumeSSOLogin failed")
+		return jsonerror.InternalServerError()
+	}
+	provider, ok := providers[idpID]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Forbidden("The login has expired, please try again"),
+		}
+	}
+	if e := query.Get("error"); e != "" {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("The identity provider refused the login: %s %s", e, query.Get("error_description"))),
+		}
+	}
+	code := query.Get("code")
+	if code == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("code is required"),
+		}
+	}
+	claims, err := provider.Exchange(req.Context(), ssoCallbackURL(cfg), code, nonce)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.Exchange failed")
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("Failed to log in with the identity provider"),
+		}
+	}
+
+	localpart, resErr := ssoAccount(req.Context(), provider.Config, claims, userAPI, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	var tokenRes userapi.PerformLoginTokenCreationResponse
+	if err = userAPI.PerformLoginTokenCreation(req.Context(), &userapi.PerformLoginTokenCreationRequest{
+		UserID: userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+	}, &tokenRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The redirect URL was checked against the allowed client URLs when the
+	// login started.
+	clientURL, err := url.Parse(redirectURL)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("url.Parse failed")
+		return jsonerror.InternalServerError()
+	}
+	q := clientURL.Query()
+	q.Set("loginToken", tokenRes.Token)
+	clientURL.RawQuery = q.Encode()
+	return util.JSONResponse{
+		Code: http.StatusFound,
+		Headers: map[string]string{
+			"Location":   clientURL.String(),
+			"Set-Cookie": ssoCookie(cfg, "", -1).String(),
+		},
+		JSON: struct{}{},
+	}
+}
+
+// ssoAccount returns the localpart of the account the user of an identity
+// provider logs in as, creating the account if the user is new and the
+// provider allows it.
+func ssoAccount(
+	ctx context.Context, idp *config.IdentityProvider, claims sso.Claims,
+	userAPI userapi.UserInternalAPI, accountDB accounts.Database,
+) (string, *util.JSONResponse) {
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(ctx, idp.ID, claims.Subject())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForSSOIdentity failed")
+		jsonErr := jsonerror.InternalServerError()
+		return "", &jsonErr
+	}
+	if localpart != "" {
+		return localpart, nil
+	}
+	if !idp.AllowRegistration {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("There is no account for this user and registration is disabled"),
+		}
+	}
+
+	claim := idp.LocalpartClaim
+	if claim == "" {
+		claim = "preferred_username"
+	}
+	base := ssoLocalpart(claims.String(claim))
+	if base == "" {
+		base = ssoLocalpart(claims.Subject())
+	}
+	for attempt := 1; attempt <= maxSSOLocalpartAttempts; attempt++ {
+		localpart = base
+		if attempt > 1 {
+			localpart = fmt.Sprintf("%s%d", base, attempt)
+		}
+		var accRes userapi.PerformAccountCreationResponse
+		err = userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+			AccountType: userapi.AccountTypeUser,
+			Localpart:   localpart,
+			OnConflict:  userapi.ConflictAbort,
+		}, &accRes)
+		if _, ok := err.(*userapi.ErrorConflict); ok {
+			continue
+		}
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountCreation failed")
+			jsonErr := jsonerror.InternalServerError()
+			return "", &jsonErr
+		}
+		amtRegUsers.Inc()
+
+		if err = accountDB.SaveSSOIdentity(ctx, idp.ID, claims.Subject(), localpart); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.SaveSSOIdentity failed")
+			jsonErr := jsonerror.InternalServerError()
+			return "", &jsonErr
+		}
+		displayNameClaim := idp.DisplayNameClaim
+		if displayNameClaim == "" {
+			displayNameClaim = "name"
+		}
+		if displayName := claims.String(displayNameClaim); displayName != "" {
+			if err = accountDB.SetDisplayName(ctx, localpart, displayName); err != nil {
+				util.GetLogger(ctx).WithError(err).Warn("accountDB.SetDisplayName failed")
+			}
+		}
+		return localpart, nil
+	}
+	return "", &util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.UserInUse("Couldn't find a free username for this user"),
+	}
+}
+
+// ssoLocalpart maps a claim to a localpart. It's lower-cased, and characters
+// which aren't allowed in localparts are replaced by "=" and their hex code,
+// e.g. "Alice Smith" becomes "alice=20smith".
+func ssoLocalpart(claim string) string {
+	var b strings.Builder
+	for _, c := range []byte(strings.ToLower(claim)) {
+		if validUsernameRegex.Match([]byte{c}) && c != '=' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "=%02x", c)
+		}
+	}
+	localpart := b.String()
+	// Leave room for the numbers added if the localpart is taken.
+	if len(localpart) > maxUsernameLength-2 {
+		localpart = localpart[:maxUsernameLength-2]
+	}
+	return localpart
+}
+
+func ssoCallbackURL(cfg *config.ClientAPI) string {
+	return strings.TrimRight(cfg.SSO.PublicBaseURL, "/") + ssoCallbackPath
+}
+
+func ssoCookie(cfg *config.ClientAPI, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    value,
+		Path:     ssoCallbackPath,
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(cfg.SSO.PublicBaseURL, "https://"),
+		HttpOnly: true,
+		// The identity provider sends the user back with a top-level
+		// navigation, which lax cookies are sent with.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,314 @@
+package routing
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/sso"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type ssoAccountDB struct {
+	accounts.Database
+	identities   map[string]string
+	displayNames map[string]string
+	logins       map[string][3]string
+}
+
+func (d *ssoAccountDB) CreateSSOLogin(ctx context.Context, state, idpID, redirectURL, nonce string, expiresAtMS, nowMS int64) error {
+	d.logins[state] = [3]string{idpID, redirectURL, nonce}
+	return nil
+}
+
+func (d *ssoAccountDB) ConsumeSSOLogin(ctx context.Context, state string, nowMS int64) (idpID, redirectURL, nonce string, err error) {
+	login := d.logins[state]
+	delete(d.logins, state)
+	return login[0], login[1], login[2], nil
+}
+
+func (d *ssoAccountDB) GetLocalpartForSSOIdentity(ctx context.Context, idpID, subject string) (string, error) {
+	return d.identities[idpID+"/"+subject], nil
+}
+
+func (d *ssoAccountDB) SaveSSOIdentity(ctx context.Context, idpID, subject, localpart string) error {
+	d.identities[idpID+"/"+subject] = localpart
+	return nil
+}
+
+func (d *ssoAccountDB) SetDisplayName(ctx context.Context, localpart, displayName string) error {
+	d.displayNames[localpart] = displayName
+	return nil
+}
+
+type ssoUserAPI struct {
+	userapi.UserInternalAPI
+	accounts    map[string]bool
+	loginTokens map[string]string
+}
+
+func (a *ssoUserAPI) PerformAccountCreation(ctx context.Context, req *userapi.PerformAccountCreationRequest, res *userapi.PerformAccountCreationResponse) error {
+	if a.accounts[req.Localpart] {
+		return &userapi.ErrorConflict{Message: "user already exists"}
+	}
+	a.accounts[req.Localpart] = true
+	res.AccountCreated = true
+	res.Account = &userapi.Account{Localpart: req.Localpart, ServerName: "localhost"}
+	return nil
+}
+
+func (a *ssoUserAPI) PerformLoginTokenCreation(ctx context.Context, req *userapi.PerformLoginTokenCreationRequest, res *userapi.PerformLoginTokenCreationResponse) error {
+	res.Token = "token-" + req.UserID
+	res.ExpiresAtMS = nowMS() + 120000
+	a.loginTokens[res.Token] = req.UserID
+	return nil
+}
+
+func (a *ssoUserAPI) PerformLoginTokenConsumption(ctx context.Context, req *userapi.PerformLoginTokenConsumptionRequest, res *userapi.PerformLoginTokenConsumptionResponse) error {
+	res.UserID = a.loginTokens[req.Token]
+	delete(a.loginTokens, req.Token)
+	return nil
+}
+
+func (a *ssoUserAPI) PerformDeviceCreation(ctx context.Context, req *userapi.PerformDeviceCreationRequest, res *userapi.PerformDeviceCreationResponse) error {
+	res.DeviceCreated = true
+	res.Device = &userapi.Device{ID: "DEVICE", UserID: "@" + req.Localpart + ":localhost", AccessToken: req.AccessToken}
+	return nil
+}
+
+// testOIDCProvider is an identity provider which logs everyone in as the
+// user with the given claims. The ID tokens it issues can be tampered with
+// by changing its fields.
+type testOIDCProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	claims   map[string]interface{}
+	nonce    string
+	audience string
+}
+
+func newTestOIDCProvider(t *testing.T, claims map[string]interface{}) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	p := &testOIDCProvider{key: key, claims: claims, audience: "dendrite"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "dendrite" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     p.idToken(t),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(claims)
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *testOIDCProvider) idToken(t *testing.T) string {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to marshal: %s", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "test"}) + "." + encode(map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   p.claims["sub"],
+		"aud":   p.audience,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": p.nonce,
+	})
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestSSOLogin(t *testing.T) {
+	idp := newTestOIDCProvider(t, map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "Alice Smith",
+		"name":               "Alice",
+	})
+	defer idp.Close()
+
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "localhost"},
+	}
+	cfg.SSO.Enabled = true
+	cfg.SSO.PublicBaseURL = "https://matrix.example.com"
+	cfg.SSO.AllowedRedirectURLs = []string{"https://client.example.com/"}
+	cfg.SSO.Providers = []config.IdentityProvider{{
+		ID:                "example",
+		Name:              "Example",
+		Issuer:            idp.URL,
+		ClientID:          "dendrite",
+		ClientSecret:      "secret",
+		AllowRegistration: true,
+	}}
+	providers := sso.NewProviders(&cfg.SSO, idp.Client())
+	accountDB := &ssoAccountDB{identities: map[string]string{}, displayNames: map[string]string{}, logins: map[string][3]string{}}
+	userAPI := &ssoUserAPI{accounts: map[string]bool{"alice=20smith": true}, loginTokens: map[string]string{}}
+
+	login := func(code string, tamper func()) (int, *url.URL) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/redirect?redirectUrl="+url.QueryEscape("https://client.example.com/?app=1"), nil)
+		res := SSORedirect(req, "", accountDB, providers, cfg)
+		if res.Code != http.StatusFound {
+			t.Fatalf("expected HTTP 302, got %d: %+v", res.Code, res.JSON)
+		}
+		authURL, err := url.Parse(res.Headers["Location"])
+		if err != nil || authURL.Path != "/authorize" {
+			t.Fatalf("unexpected authorization URL %q", res.Headers["Location"])
+		}
+		if redirectURI := authURL.Query().Get("redirect_uri"); redirectURI != "https://matrix.example.com"+ssoCallbackPath {
+			t.Fatalf("unexpected redirect URI %q", redirectURI)
+		}
+
+		// The provider puts the nonce of the authorization request into
+		// the ID token.
+		idp.nonce = authURL.Query().Get("nonce")
+		if tamper != nil {
+			tamper()
+		}
+		callback := url.Values{"state": {authURL.Query().Get("state")}, "code": {code}}
+		req = httptest.NewRequest(http.MethodGet, ssoCallbackPath+"?"+callback.Encode(), nil)
+		req.Header.Set("Cookie", res.Headers["Set-Cookie"])
+		res = SSOCallback(req, userAPI, accountDB, providers, cfg)
+		if res.Code != http.StatusFound {
+			return res.Code, nil
+		}
+		redirectURL, err := url.Parse(res.Headers["Location"])
+		if err != nil {
+			t.Fatalf("failed to parse the redirect URL: %s", err)
+		}
+		return res.Code, redirectURL
+	}
+
+	if code, _ := login("bad-code", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 for a bad code, got %d", code)
+	}
+
+	// The derived localpart is taken, so the user gets a numbered one.
+	code, redirectURL := login("good-code", nil)
+	if code != http.StatusFound {
+		t.Fatalf("expected HTTP 302, got %d", code)
+	}
+	if redirectURL.Host != "client.example.com" || redirectURL.Query().Get("app") != "1" {
+		t.Fatalf("unexpected redirect URL %q", redirectURL)
+	}
+	if localpart := accountDB.identities["example/1234"]; localpart != "alice=20smith2" {
+		t.Fatalf("expected the user to be mapped to alice=20smith2, got %q", localpart)
+	}
+	if accountDB.displayNames["alice=20smith2"] != "Alice" {
+		t.Fatalf("expected the display name to be set from the claims")
+	}
+
+	// Logging in again uses the same account.
+	if _, redirectURL = login("good-code", nil); len(userAPI.accounts) != 2 {
+		t.Fatalf("expected no other account to be created, got %v", userAPI.accounts)
+	}
+
+	body := `{"type":"m.login.token","token":"` + redirectURL.Query().Get("loginToken") + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(body))
+	res := Login(req, accountDB, userAPI, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	if userID := res.JSON.(loginResponse).UserID; userID != "@alice=20smith2:localhost" {
+		t.Fatalf("expected to log in as @alice=20smith2:localhost, got %q", userID)
+	}
+	// Login tokens can only be used once.
+	req = httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(body))
+	if res = Login(req, accountDB, userAPI, cfg); res.Code != http.StatusForbidden {
+		t.Fatalf("expected HTTP 403 when reusing the login token, got %d: %+v", res.Code, res.JSON)
+	}
+
+	// The callback only works in the browser which started the login.
+	req = httptest.NewRequest(http.MethodGet, ssoCallbackPath+"?state=unknown&code=good-code", nil)
+	if res = SSOCallback(req, userAPI, accountDB, providers, cfg); res.Code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 without the state cookie, got %d: %+v", res.Code, res.JSON)
+	}
+
+	// Logins whose ID token isn't valid for this login are refused.
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	for name, tamper := range map[string]func(){
+		"wrong nonce":    func() { idp.nonce = "replayed" },
+		"wrong audience": func() { idp.audience = "someone-else" },
+		"bad signature":  func() { idp.key = otherKey },
+	} {
+		key := idp.key
+		if code, _ := login("good-code", tamper); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected HTTP 401, got %d", name, code)
+		}
+		idp.key, idp.audience = key, "dendrite"
+	}
+
+	// Users are only sent back to allowed clients with a login token.
+	for _, redirectURL := range []string{
+		"https://evil.example.com/",
+		"https://client.example.com.evil.example.com/",
+		"http://client.example.com/",
+		"client.example.com/",
+	} {
+		req = httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/redirect?redirectUrl="+url.QueryEscape(redirectURL), nil)
+		if res = SSORedirect(req, "", accountDB, providers, cfg); res.Code != http.StatusBadRequest {
+			t.Errorf("expected HTTP 400 for redirect URL %q, got %d", redirectURL, res.Code)
+		}
+	}
+}
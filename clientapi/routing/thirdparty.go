@@ -0,0 +1,135 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// GetThirdPartyProtocols implements GET /thirdparty/protocols
+func GetThirdPartyProtocols(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyProtocolsResponse
+	if err := asAPI.ThirdPartyProtocols(req.Context(), &appserviceAPI.ThirdPartyProtocolsRequest{}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyProtocols failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Protocols,
+	}
+}
+
+// GetThirdPartyProtocol implements GET /thirdparty/protocol/{protocol}
+func GetThirdPartyProtocol(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string,
+) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyProtocolsResponse
+	if err := asAPI.ThirdPartyProtocols(req.Context(), &appserviceAPI.ThirdPartyProtocolsRequest{
+		Protocol: protocol,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyProtocols failed")
+		return jsonerror.InternalServerError()
+	}
+	p, ok := res.Protocols[protocol]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The protocol is unknown"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: p,
+	}
+}
+
+// GetThirdPartyLocation implements GET /thirdparty/location/{protocol}, or
+// GET /thirdparty/location if the protocol is empty, in which case the
+// locations bridged to the room alias in the query string are returned.
+func GetThirdPartyLocation(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string,
+) util.JSONResponse {
+	request := appserviceAPI.ThirdPartyLocationRequest{
+		Protocol: protocol,
+		Fields:   thirdPartyFields(req),
+	}
+	if protocol == "" {
+		request.Alias = req.URL.Query().Get("alias")
+		if request.Alias == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("The alias parameter is required"),
+			}
+		}
+	}
+	var res appserviceAPI.ThirdPartyLocationResponse
+	if err := asAPI.ThirdPartyLocation(req.Context(), &request, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyLocation failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Locations,
+	}
+}
+
+// GetThirdPartyUser implements GET /thirdparty/user/{protocol}, or
+// GET /thirdparty/user if the protocol is empty, in which case the third
+// party users of the Matrix user ID in the query string are returned.
+func GetThirdPartyUser(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string,
+) util.JSONResponse {
+	request := appserviceAPI.ThirdPartyUserRequest{
+		Protocol: protocol,
+		Fields:   thirdPartyFields(req),
+	}
+	if protocol == "" {
+		request.UserID = req.URL.Query().Get("userid")
+		if request.UserID == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("The userid parameter is required"),
+			}
+		}
+	}
+	var res appserviceAPI.ThirdPartyUserResponse
+	if err := asAPI.ThirdPartyUser(req.Context(), &request, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyUser failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Users,
+	}
+}
+
+// thirdPartyFields returns the protocol fields of a third party lookup, which
+// are all query parameters apart from the access token.
+func thirdPartyFields(req *http.Request) map[string]string {
+	fields := make(map[string]string)
+	for k, v := range req.URL.Query() {
+		if k == "access_token" || len(v) == 0 {
+			continue
+		}
+		fields[k] = v[0]
+	}
+	return fields
+}
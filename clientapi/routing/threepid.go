@@ -16,6 +16,8 @@ package routing
 
 import (
 	"net/http"
+	"net/mail"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -31,6 +33,18 @@ import (
 
 type reqTokenResponse struct {
 	SID string `json:"sid"`
+	// Where the client can submit the token, if the homeserver sent it itself
+	SubmitURL string `json:"submit_url,omitempty"`
+}
+
+type submitTokenRequest struct {
+	SID    string `json:"sid"`
+	Secret string `json:"client_secret"`
+	Token  string `json:"token"`
+}
+
+type submitTokenResponse struct {
+	Success bool `json:"success"`
 }
 
 type threePIDsResponse struct {
@@ -40,15 +54,15 @@ type threePIDsResponse struct {
 // RequestEmailToken implements:
 //     POST /account/3pid/email/requestToken
 //     POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI) util.JSONResponse {
+func RequestEmailToken(
+	req *http.Request, accountDB accounts.Database, mailer threepid.Mailer,
+	cfg *config.ClientAPI,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
-	var resp reqTokenResponse
-	var err error
-
 	// Check if the 3PID is already in use locally
 	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Email, "email")
 	if err != nil {
@@ -66,6 +80,92 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 		}
 	}
 
+	action := "add this email address to your account"
+	if strings.HasSuffix(req.URL.Path, "/register/email/requestToken") {
+		action = "register"
+	}
+	return requestEmailToken(req, body, action, accountDB, mailer, cfg)
+}
+
+// RequestPasswordResetEmailToken implements:
+//     POST /account/password/email/requestToken
+func RequestPasswordResetEmailToken(
+	req *http.Request, accountDB accounts.Database, mailer threepid.Mailer,
+	cfg *config.ClientAPI,
+) util.JSONResponse {
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+
+	// Passwords can only be reset with addresses verified by the homeserver.
+	if mailer == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_MEDIUM_NOT_SUPPORTED",
+				Err:     "Password reset by email is not enabled on this homeserver",
+			},
+		}
+	}
+
+	// Check that the 3PID belongs to a local user
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Email, "email")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if len(localpart) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "This email address is not associated with any account",
+			},
+		}
+	}
+
+	return requestEmailToken(req, body, "reset your password", accountDB, mailer, cfg)
+}
+
+// requestEmailToken sends a validation token to the email address in the
+// request. The homeserver sends it itself if a mailer is given, otherwise the
+// identity server in the request is asked to send it.
+func requestEmailToken(
+	req *http.Request, body threepid.EmailAssociationRequest, action string,
+	accountDB accounts.Database, mailer threepid.Mailer, cfg *config.ClientAPI,
+) util.JSONResponse {
+	var resp reqTokenResponse
+	var err error
+
+	if mailer != nil {
+		if body.Secret == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam("client_secret is required"),
+			}
+		}
+		if addr, perr := mail.ParseAddress(body.Email); perr != nil || addr.Address != body.Email {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Invalid email address"),
+			}
+		}
+
+		resp.SID, err = threepid.RequestEmailValidation(req.Context(), body, action, accountDB, mailer, cfg)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("threepid.RequestEmailValidation failed")
+			return jsonerror.InternalServerError()
+		}
+		resp.SubmitURL = threepid.SubmitURL(cfg)
+
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: resp,
+		}
+	}
+
 	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
@@ -83,6 +183,86 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 	}
 }
 
+// SubmitEmailToken implements:
+//     GET /unstable/org.matrix.dendrite/email/submit_token
+//     POST /unstable/org.matrix.dendrite/email/submit_token
+// The GET form is used by the links sent in the validation emails.
+func SubmitEmailToken(
+	req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI,
+) util.JSONResponse {
+	var body submitTokenRequest
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		body.SID = query.Get("sid")
+		body.Secret = query.Get("client_secret")
+		body.Token = query.Get("token")
+	} else if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+
+	if body.SID == "" || body.Secret == "" || body.Token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("sid, client_secret and token are required"),
+		}
+	}
+
+	err := threepid.ValidateSession(req.Context(), body.SID, body.Secret, body.Token, accountDB, cfg)
+	switch err {
+	case nil:
+	case threepid.ErrSessionNotFound, threepid.ErrSessionExpired:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_NO_VALID_SESSION",
+				Err:     err.Error(),
+			},
+		}
+	case threepid.ErrBadToken:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     err.Error(),
+			},
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.ValidateSession failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: submitTokenResponse{Success: true},
+	}
+}
+
+// checkLocalThreePIDSession checks a validation session created by the
+// homeserver itself. It returns the session if it was validated, or an error
+// response otherwise.
+func checkLocalThreePIDSession(
+	req *http.Request, creds threepid.Credentials,
+	accountDB accounts.Database, cfg *config.ClientAPI,
+) (*authtypes.ThreePIDValidationSession, *util.JSONResponse) {
+	session, err := threepid.CheckValidatedSession(req.Context(), creds, accountDB, cfg)
+	switch err {
+	case nil:
+		return session, nil
+	case threepid.ErrSessionNotFound, threepid.ErrSessionExpired, threepid.ErrSessionNotValidated:
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     err.Error(),
+			},
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckValidatedSession failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+}
+
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
 	req *http.Request, accountDB accounts.Database, device *api.Device,
@@ -93,6 +273,16 @@ func CheckAndSave3PIDAssociation(
 		return *reqErr
 	}
 
+	// Addresses verified by the homeserver itself don't involve an
+	// identity server.
+	if cfg.Email.Enabled && body.Creds.IDServer == "" {
+		session, resErr := checkLocalThreePIDSession(req, body.Creds, accountDB, cfg)
+		if resErr != nil {
+			return *resErr
+		}
+		return save3PIDAssociation(req, accountDB, device, session.Address, session.Medium, session.SessionID)
+	}
+
 	// Check if the association has been validated
 	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
 	if err == threepid.ErrNotTrusted {
@@ -129,7 +319,16 @@ func CheckAndSave3PIDAssociation(
 		}
 	}
 
-	// Save the association in the database
+	return save3PIDAssociation(req, accountDB, device, address, medium, "")
+}
+
+// save3PIDAssociation saves the association between a 3PID and the user in
+// the database, and removes the local validation session it was verified
+// with, if any.
+func save3PIDAssociation(
+	req *http.Request, accountDB accounts.Database, device *api.Device,
+	address, medium, validationSessionID string,
+) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
@@ -141,6 +340,12 @@ func CheckAndSave3PIDAssociation(
 		return jsonerror.InternalServerError()
 	}
 
+	if validationSessionID != "" {
+		if err = accountDB.RemoveThreePIDValidationSession(req.Context(), validationSessionID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDValidationSession failed")
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
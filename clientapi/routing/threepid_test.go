@@ -0,0 +1,205 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type threePIDAccountDB struct {
+	accounts.Database
+	threepids map[string]string
+	sessions  map[string]*authtypes.ThreePIDValidationSession
+}
+
+func (d *threePIDAccountDB) GetLocalpartForThreePID(ctx context.Context, threepid, medium string) (string, error) {
+	return d.threepids[medium+"/"+threepid], nil
+}
+
+func (d *threePIDAccountDB) CreateThreePIDValidationSession(ctx context.Context, session *authtypes.ThreePIDValidationSession) error {
+	s := *session
+	d.sessions[session.SessionID] = &s
+	return nil
+}
+
+func (d *threePIDAccountDB) GetThreePIDValidationSession(ctx context.Context, sessionID string) (*authtypes.ThreePIDValidationSession, error) {
+	if s, ok := d.sessions[sessionID]; ok {
+		session := *s
+		return &session, nil
+	}
+	return nil, nil
+}
+
+func (d *threePIDAccountDB) GetThreePIDValidationSessionBySecret(ctx context.Context, clientSecret, medium, address string) (*authtypes.ThreePIDValidationSession, error) {
+	for _, s := range d.sessions {
+		if s.ClientSecret == clientSecret && s.Medium == medium && s.Address == address {
+			session := *s
+			return &session, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *threePIDAccountDB) UpdateThreePIDValidationSessionToken(ctx context.Context, sessionID, token string, sendAttempt int, createdTS int64) error {
+	s := d.sessions[sessionID]
+	s.Token, s.SendAttempt, s.CreatedTS, s.ValidatedTS = token, sendAttempt, createdTS, 0
+	return nil
+}
+
+func (d *threePIDAccountDB) ValidateThreePIDValidationSession(ctx context.Context, sessionID string, validatedTS int64) error {
+	d.sessions[sessionID].ValidatedTS = validatedTS
+	return nil
+}
+
+func (d *threePIDAccountDB) RemoveThreePIDValidationSession(ctx context.Context, sessionID string) error {
+	delete(d.sessions, sessionID)
+	return nil
+}
+
+func (d *threePIDAccountDB) RemoveExpiredThreePIDValidationSessions(ctx context.Context, createdBeforeTS int64) error {
+	for id, s := range d.sessions {
+		if s.CreatedTS < createdBeforeTS {
+			delete(d.sessions, id)
+		}
+	}
+	return nil
+}
+
+type testMailer struct {
+	to     []string
+	bodies []string
+}
+
+func (m *testMailer) SendMail(to, subject, body string) error {
+	m.to = append(m.to, to)
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+type passwordResetUserAPI struct {
+	userapi.UserInternalAPI
+	localpart string
+	password  string
+	logout    *userapi.PerformDeviceDeletionRequest
+}
+
+func (a *passwordResetUserAPI) PerformPasswordUpdate(ctx context.Context, req *userapi.PerformPasswordUpdateRequest, res *userapi.PerformPasswordUpdateResponse) error {
+	a.localpart, a.password = req.Localpart, req.Password
+	res.PasswordUpdated = true
+	return nil
+}
+
+func (a *passwordResetUserAPI) PerformDeviceDeletion(ctx context.Context, req *userapi.PerformDeviceDeletionRequest, res *userapi.PerformDeviceDeletionResponse) error {
+	a.logout = req
+	return nil
+}
+
+var linkRegexp = regexp.MustCompile(`https://\S+`)
+
+func TestEmailPasswordReset(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "localhost"},
+	}
+	cfg.Email.Enabled = true
+	cfg.Email.PublicBaseURL = "https://matrix.example.com/"
+	cfg.Email.TokenLifetime = time.Hour
+	accountDB := &threePIDAccountDB{
+		threepids: map[string]string{"email/alice@example.com": "alice"},
+		sessions:  map[string]*authtypes.ThreePIDValidationSession{},
+	}
+	mailer := &testMailer{}
+	userAPI := &passwordResetUserAPI{}
+
+	requestToken := func(email string, sendAttempt int) (int, interface{}) {
+		body := `{"client_secret":"secret","email":"` + email + `","send_attempt":` + strconv.Itoa(sendAttempt) + `}`
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/account/password/email/requestToken", strings.NewReader(body))
+		res := RequestPasswordResetEmailToken(req, accountDB, mailer, cfg)
+		return res.Code, res.JSON
+	}
+	resetPassword := func(sid string) (int, interface{}) {
+		body := `{"new_password":"correct horse battery staple","auth":{"type":"m.login.email.identity","threepid_creds":{"sid":"` + sid + `","client_secret":"secret"}}}`
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/account/password", strings.NewReader(body))
+		res := Password(req, userAPI, accountDB, nil, cfg)
+		return res.Code, res.JSON
+	}
+
+	// Unknown addresses can't be used to reset a password.
+	if code, res := requestToken("bob@example.com", 1); code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for an unknown address, got %d: %+v", code, res)
+	}
+
+	code, res := requestToken("alice@example.com", 1)
+	if code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", code, res)
+	}
+	sid := res.(reqTokenResponse).SID
+	if res.(reqTokenResponse).SubmitURL != "https://matrix.example.com/_matrix/client/unstable/org.matrix.dendrite/email/submit_token" {
+		t.Fatalf("unexpected submit URL %q", res.(reqTokenResponse).SubmitURL)
+	}
+	if len(mailer.to) != 1 || mailer.to[0] != "alice@example.com" {
+		t.Fatalf("expected one email to alice@example.com, got %v", mailer.to)
+	}
+
+	// Retrying with the same send attempt doesn't send another email.
+	if _, res = requestToken("alice@example.com", 1); res.(reqTokenResponse).SID != sid {
+		t.Fatalf("expected the same session to be returned")
+	}
+	if len(mailer.to) != 1 {
+		t.Fatalf("expected no other email to be sent, got %d", len(mailer.to))
+	}
+
+	// The session can't be used before the token is submitted.
+	if code, res = resetPassword(sid); code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 before validation, got %d: %+v", code, res)
+	}
+
+	link, err := url.Parse(linkRegexp.FindString(mailer.bodies[0]))
+	if err != nil {
+		t.Fatalf("failed to parse the link in the email: %s", err)
+	}
+	query := link.Query()
+	if query.Get("sid") != sid {
+		t.Fatalf("expected the link to be for session %q, got %q", sid, query.Get("sid"))
+	}
+
+	wrongToken := url.Values{"sid": {sid}, "client_secret": {"secret"}, "token": {"wrong"}}
+	req := httptest.NewRequest(http.MethodGet, link.Path+"?"+wrongToken.Encode(), nil)
+	if submitRes := SubmitEmailToken(req, accountDB, cfg); submitRes.Code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for a wrong token, got %d: %+v", submitRes.Code, submitRes.JSON)
+	}
+	req = httptest.NewRequest(http.MethodGet, link.RequestURI(), nil)
+	if submitRes := SubmitEmailToken(req, accountDB, cfg); submitRes.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", submitRes.Code, submitRes.JSON)
+	}
+
+	if code, res = resetPassword(sid); code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", code, res)
+	}
+	if userAPI.localpart != "alice" || userAPI.password != "correct horse battery staple" {
+		t.Fatalf("unexpected password update for %q", userAPI.localpart)
+	}
+	if userAPI.logout == nil || userAPI.logout.UserID != "@alice:localhost" || userAPI.logout.ExceptDeviceID != "" {
+		t.Fatalf("expected all devices of @alice:localhost to be logged out, got %+v", userAPI.logout)
+	}
+
+	// The session can only be used once.
+	code, res = resetPassword(sid)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 when reusing the session, got %d: %+v", code, res)
+	}
+	if e, ok := res.(jsonerror.MatrixError); !ok || e.ErrCode != "M_THREEPID_AUTH_FAILED" {
+		t.Fatalf("expected M_THREEPID_AUTH_FAILED, got %+v", res)
+	}
+}
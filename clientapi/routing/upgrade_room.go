@@ -0,0 +1,455 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-rooms-roomid-upgrade
+type upgradeRoomRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// upgradeRoomCopiedState is the state, other than the power levels and bans,
+// that is carried over from the old room into the replacement room.
+var upgradeRoomCopiedState = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	gomatrixserverlib.MRoomGuestAccess,
+	gomatrixserverlib.MRoomName,
+	gomatrixserverlib.MRoomTopic,
+	gomatrixserverlib.MRoomAvatar,
+	gomatrixserverlib.MRoomEncryption,
+	gomatrixserverlib.MRoomCanonicalAlias,
+	"m.room.server_acl",
+	"m.room.related_groups",
+}
+
+// UpgradeRoom implements /rooms/{roomID}/upgrade. It creates a replacement
+// room with the requested room version, copies the relevant state across,
+// tombstones the old room, moves the local aliases and restricts the old
+// room so that only moderators can still talk in it.
+// nolint: gocyclo
+func UpgradeRoom(
+	req *http.Request, device *userapi.Device,
+	cfg *config.ClientAPI, roomID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	var r upgradeRoomRequest
+	if rErr := httputil.UnmarshalJSONRequest(req, &r); rErr != nil {
+		return *rErr
+	}
+	if r.NewVersion == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("new_version is required"),
+		}
+	}
+	newVersion := gomatrixserverlib.RoomVersion(r.NewVersion)
+	if _, err := roomserverVersion.SupportedRoomVersion(newVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	ctx := req.Context()
+	userID := device.UserID
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id":     userID,
+		"room_id":     roomID,
+		"new_version": newVersion,
+	})
+
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	if err = rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, &queryRes); err != nil {
+		logger.WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryRes.RoomExists || len(queryRes.LatestEvents) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	oldState := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent, len(queryRes.StateEvents))
+	for _, ev := range queryRes.StateEvents {
+		if ev.StateKey() == nil {
+			continue
+		}
+		oldState[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+
+	// Only joined users who are allowed to tombstone the room may upgrade it.
+	memberEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}]
+	if memberEvent == nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not in the room"),
+		}
+	}
+	if membership, merr := memberEvent.Membership(); merr != nil || membership != gomatrixserverlib.Join {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not in the room"),
+		}
+	}
+	createEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}]
+	plEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	if createEvent == nil || plEvent == nil {
+		logger.Error("Room has no create or power levels event")
+		return jsonerror.InternalServerError()
+	}
+	powerLevels, err := plEvent.PowerLevels()
+	if err != nil {
+		logger.WithError(err).Error("plEvent.PowerLevels failed")
+		return jsonerror.InternalServerError()
+	}
+	if powerLevels.UserLevel(userID) < powerLevels.EventLevel("m.room.tombstone", true) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to upgrade the room"),
+		}
+	}
+
+	profile, err := appserviceAPI.RetrieveUserProfile(ctx, userID, asAPI, accountDB)
+	if err != nil {
+		logger.WithError(err).Error("appserviceAPI.RetrieveUserProfile failed")
+		return jsonerror.InternalServerError()
+	}
+
+	createContent, err := upgradeCreateContent(
+		createEvent.Content(), userID, newVersion, roomID, queryRes.LatestEvents[0].EventID,
+	)
+	if err != nil {
+		logger.WithError(err).Error("upgradeCreateContent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Copy across the state that should survive the upgrade, followed by the
+	// bans so that banned users can't simply join the replacement room.
+	var copiedState []fledglingEvent
+	for _, evType := range upgradeRoomCopiedState {
+		ev := oldState[gomatrixserverlib.StateKeyTuple{EventType: evType, StateKey: ""}]
+		if ev == nil {
+			continue
+		}
+		copiedState = append(copiedState, fledglingEvent{
+			Type:    evType,
+			Content: json.RawMessage(ev.Content()),
+		})
+	}
+	for tuple, ev := range oldState {
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		if membership, merr := ev.Membership(); merr != nil || membership != gomatrixserverlib.Ban {
+			continue
+		}
+		copiedState = append(copiedState, fledglingEvent{
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: tuple.StateKey,
+			Content:  json.RawMessage(ev.Content()),
+		})
+	}
+
+	// The upgrading user may not have enough power to send all of the copied
+	// state, so they're temporarily given enough and the original power levels
+	// are restored once everything else has been sent.
+	initialPowerLevels, raised := upgradeInitialPowerLevels(*powerLevels, userID, copiedState)
+	eventsToMake := []fledglingEvent{
+		{
+			Type:    gomatrixserverlib.MRoomCreate,
+			Content: createContent,
+		},
+		{
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: userID,
+			Content: gomatrixserverlib.MemberContent{
+				Membership:  gomatrixserverlib.Join,
+				DisplayName: profile.DisplayName,
+				AvatarURL:   profile.AvatarURL,
+			},
+		},
+		{
+			Type:    gomatrixserverlib.MRoomPowerLevels,
+			Content: initialPowerLevels,
+		},
+	}
+	eventsToMake = append(eventsToMake, copiedState...)
+	if raised {
+		eventsToMake = append(eventsToMake, fledglingEvent{
+			Type:    gomatrixserverlib.MRoomPowerLevels,
+			Content: json.RawMessage(plEvent.Content()),
+		})
+	}
+
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	logger = logger.WithField("new_room_id", newRoomID)
+	logger.Info("Upgrading room")
+	if _, err = sendInitialRoomEvents(ctx, cfg, rsAPI, userID, newRoomID, newVersion, evTime, eventsToMake); err != nil {
+		logger.WithError(err).Error("sendInitialRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Point the old room at the replacement. Once this has been sent clients
+	// will start moving over, so the remaining steps are best-effort.
+	if err = sendUpgradeStateEvent(ctx, cfg, rsAPI, userID, roomID, "m.room.tombstone", eventutil.TombstoneContent{
+		Body:            "This room has been replaced",
+		ReplacementRoom: newRoomID,
+	}, evTime); err != nil {
+		logger.WithError(err).Error("Failed to send tombstone")
+		return jsonerror.InternalServerError()
+	}
+
+	moveRoomAliases(ctx, cfg, rsAPI, userID, roomID, newRoomID, oldState, evTime)
+	moveRoomDirectoryVisibility(ctx, rsAPI, roomID, newRoomID)
+
+	if restricted, changed := restrictedPowerLevels(*powerLevels); changed {
+		if err = sendUpgradeStateEvent(ctx, cfg, rsAPI, userID, roomID, gomatrixserverlib.MRoomPowerLevels, restricted, evTime); err != nil {
+			logger.WithError(err).Error("Failed to restrict power levels in old room")
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{
+			ReplacementRoom: newRoomID,
+		},
+	}
+}
+
+// upgradeCreateContent returns the m.room.create content for the replacement
+// room, keeping any extra keys such as m.federate from the old room.
+func upgradeCreateContent(
+	oldContent []byte, userID string, newVersion gomatrixserverlib.RoomVersion,
+	oldRoomID, lastEventID string,
+) (map[string]interface{}, error) {
+	content := map[string]interface{}{}
+	if err := json.Unmarshal(oldContent, &content); err != nil {
+		return nil, err
+	}
+	content["creator"] = userID
+	content["room_version"] = newVersion
+	content["predecessor"] = gomatrixserverlib.PreviousRoom{
+		RoomID:  oldRoomID,
+		EventID: lastEventID,
+	}
+	return content, nil
+}
+
+// upgradeInitialPowerLevels returns the power levels to start the replacement
+// room with, so that the user can send all of the given events. If the user's
+// power level had to be raised then raised is true.
+func upgradeInitialPowerLevels(
+	pl gomatrixserverlib.PowerLevelContent, userID string, events []fledglingEvent,
+) (initial gomatrixserverlib.PowerLevelContent, raised bool) {
+	needed := pl.EventLevel(gomatrixserverlib.MRoomPowerLevels, true)
+	for _, ev := range events {
+		level := pl.EventLevel(ev.Type, true)
+		if ev.Type == gomatrixserverlib.MRoomMember {
+			level = pl.Ban
+		}
+		if level > needed {
+			needed = level
+		}
+	}
+	if pl.UserLevel(userID) >= needed {
+		return pl, false
+	}
+	initial = pl
+	initial.Users = make(map[string]int64, len(pl.Users)+1)
+	for user, level := range pl.Users {
+		initial.Users[user] = level
+	}
+	initial.Users[userID] = needed
+	return initial, true
+}
+
+// restrictedPowerLevels returns the power levels for the old room, which stop
+// regular users from sending events or inviting people. If the power levels
+// are already restrictive enough then changed is false.
+func restrictedPowerLevels(pl gomatrixserverlib.PowerLevelContent) (restricted gomatrixserverlib.PowerLevelContent, changed bool) {
+	level := pl.UsersDefault + 1
+	if level < 50 {
+		level = 50
+	}
+	restricted = pl
+	if restricted.EventsDefault < level {
+		restricted.EventsDefault = level
+		changed = true
+	}
+	if restricted.Invite < level {
+		restricted.Invite = level
+		changed = true
+	}
+	return restricted, changed
+}
+
+// moveRoomAliases points the local aliases of the old room at the replacement
+// room, and removes the canonical alias from the old room if it was moved.
+func moveRoomAliases(
+	ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID, oldRoomID, newRoomID string,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent, evTime time.Time,
+) {
+	logger := util.GetLogger(ctx).WithField("room_id", oldRoomID)
+	var aliasesRes roomserverAPI.GetAliasesForRoomIDResponse
+	if err := rsAPI.GetAliasesForRoomID(ctx, &roomserverAPI.GetAliasesForRoomIDRequest{
+		RoomID: oldRoomID,
+	}, &aliasesRes); err != nil {
+		logger.WithError(err).Error("rsAPI.GetAliasesForRoomID failed")
+		return
+	}
+	moved := make(map[string]bool, len(aliasesRes.Aliases))
+	for _, alias := range aliasesRes.Aliases {
+		// Keep the original creator of the alias, so that they can still
+		// remove it from the replacement room later.
+		var creatorRes roomserverAPI.GetCreatorIDForAliasResponse
+		if err := rsAPI.GetCreatorIDForAlias(ctx, &roomserverAPI.GetCreatorIDForAliasRequest{
+			Alias: alias,
+		}, &creatorRes); err != nil {
+			logger.WithError(err).WithField("alias", alias).Error("rsAPI.GetCreatorIDForAlias failed")
+			continue
+		}
+		var removeRes roomserverAPI.RemoveRoomAliasResponse
+		if err := rsAPI.RemoveRoomAlias(ctx, &roomserverAPI.RemoveRoomAliasRequest{
+			Alias:  alias,
+			UserID: creatorRes.UserID,
+		}, &removeRes); err != nil || !removeRes.Removed {
+			logger.WithError(err).WithField("alias", alias).Error("rsAPI.RemoveRoomAlias failed")
+			continue
+		}
+		var setRes roomserverAPI.SetRoomAliasResponse
+		if err := rsAPI.SetRoomAlias(ctx, &roomserverAPI.SetRoomAliasRequest{
+			Alias:  alias,
+			RoomID: newRoomID,
+			UserID: creatorRes.UserID,
+		}, &setRes); err != nil || setRes.AliasExists {
+			logger.WithError(err).WithField("alias", alias).Error("rsAPI.SetRoomAlias failed")
+			continue
+		}
+		moved[alias] = true
+	}
+
+	canonicalAliasEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}]
+	if canonicalAliasEvent == nil {
+		return
+	}
+	var canonicalAlias eventutil.CanonicalAlias
+	if err := json.Unmarshal(canonicalAliasEvent.Content(), &canonicalAlias); err != nil || !moved[canonicalAlias.Alias] {
+		return
+	}
+	if err := sendUpgradeStateEvent(
+		ctx, cfg, rsAPI, userID, oldRoomID, gomatrixserverlib.MRoomCanonicalAlias, map[string]interface{}{}, evTime,
+	); err != nil {
+		logger.WithError(err).Error("Failed to remove canonical alias from old room")
+	}
+}
+
+// moveRoomDirectoryVisibility publishes the replacement room in the room
+// directory in place of the old room, if the old room was published.
+func moveRoomDirectoryVisibility(ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, oldRoomID, newRoomID string) {
+	logger := util.GetLogger(ctx).WithField("room_id", oldRoomID)
+	var publishedRes roomserverAPI.QueryPublishedRoomsResponse
+	if err := rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{
+		RoomID: oldRoomID,
+	}, &publishedRes); err != nil {
+		logger.WithError(err).Error("rsAPI.QueryPublishedRooms failed")
+		return
+	}
+	if len(publishedRes.RoomIDs) == 0 {
+		return
+	}
+	var publishRes roomserverAPI.PerformPublishResponse
+	rsAPI.PerformPublish(ctx, &roomserverAPI.PerformPublishRequest{
+		RoomID:     newRoomID,
+		Visibility: "public",
+	}, &publishRes)
+	if publishRes.Error != nil {
+		logger.WithError(publishRes.Error).Error("Failed to publish replacement room")
+		return
+	}
+	rsAPI.PerformPublish(ctx, &roomserverAPI.PerformPublishRequest{
+		RoomID:     oldRoomID,
+		Visibility: "private",
+	}, &publishRes)
+	if publishRes.Error != nil {
+		logger.WithError(publishRes.Error).Error("Failed to unpublish old room")
+	}
+}
+
+// sendUpgradeStateEvent sends a state event with an empty state key into an
+// existing room, checking that the user is allowed to send it first.
+func sendUpgradeStateEvent(
+	ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID, roomID, eventType string, content interface{}, evTime time.Time,
+) error {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return fmt.Errorf("builder.SetContent: %w", err)
+	}
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &builder, cfg.Matrix, evTime, rsAPI, &queryRes)
+	if err != nil {
+		return fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+	stateEvents := gomatrixserverlib.UnwrapEventHeaders(queryRes.StateEvents)
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(event.Event, &provider); err != nil {
+		return fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+	}
+	return roomserverAPI.SendEvents(
+		ctx, rsAPI, roomserverAPI.KindNew, []*gomatrixserverlib.HeaderedEvent{event}, cfg.Matrix.ServerName, nil,
+	)
+}
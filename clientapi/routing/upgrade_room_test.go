@@ -0,0 +1,325 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	upgradeTestRoomID = "!old:localhost"
+	upgradeTestUserID = "@alice:localhost"
+	upgradeTestAlias  = "#test:localhost"
+)
+
+type upgradeRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPITrace
+	state     []*gomatrixserverlib.HeaderedEvent
+	latest    gomatrixserverlib.EventReference
+	aliases   map[string]string
+	published map[string]bool
+	input     []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *upgradeRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	req *roomserverAPI.QueryLatestEventsAndStateRequest,
+	res *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	if req.RoomID != upgradeTestRoomID {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	res.LatestEvents = []gomatrixserverlib.EventReference{r.latest}
+	res.StateEvents = r.state
+	res.Depth = int64(len(r.state) + 1)
+	return nil
+}
+
+func (r *upgradeRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *roomserverAPI.InputRoomEventsRequest,
+	res *roomserverAPI.InputRoomEventsResponse,
+) {
+	for _, ev := range req.InputRoomEvents {
+		r.input = append(r.input, ev.Event)
+	}
+}
+
+func (r *upgradeRoomserverAPI) GetAliasesForRoomID(
+	ctx context.Context,
+	req *roomserverAPI.GetAliasesForRoomIDRequest,
+	res *roomserverAPI.GetAliasesForRoomIDResponse,
+) error {
+	for alias, roomID := range r.aliases {
+		if roomID == req.RoomID {
+			res.Aliases = append(res.Aliases, alias)
+		}
+	}
+	return nil
+}
+
+func (r *upgradeRoomserverAPI) GetCreatorIDForAlias(
+	ctx context.Context,
+	req *roomserverAPI.GetCreatorIDForAliasRequest,
+	res *roomserverAPI.GetCreatorIDForAliasResponse,
+) error {
+	res.UserID = "@creator:localhost"
+	return nil
+}
+
+func (r *upgradeRoomserverAPI) RemoveRoomAlias(
+	ctx context.Context,
+	req *roomserverAPI.RemoveRoomAliasRequest,
+	res *roomserverAPI.RemoveRoomAliasResponse,
+) error {
+	_, res.Found = r.aliases[req.Alias]
+	res.Removed = res.Found && req.UserID == "@creator:localhost"
+	if res.Removed {
+		delete(r.aliases, req.Alias)
+	}
+	return nil
+}
+
+func (r *upgradeRoomserverAPI) SetRoomAlias(
+	ctx context.Context,
+	req *roomserverAPI.SetRoomAliasRequest,
+	res *roomserverAPI.SetRoomAliasResponse,
+) error {
+	if _, res.AliasExists = r.aliases[req.Alias]; !res.AliasExists {
+		r.aliases[req.Alias] = req.RoomID
+	}
+	return nil
+}
+
+func (r *upgradeRoomserverAPI) QueryPublishedRooms(
+	ctx context.Context,
+	req *roomserverAPI.QueryPublishedRoomsRequest,
+	res *roomserverAPI.QueryPublishedRoomsResponse,
+) error {
+	if r.published[req.RoomID] {
+		res.RoomIDs = []string{req.RoomID}
+	}
+	return nil
+}
+
+func (r *upgradeRoomserverAPI) PerformPublish(
+	ctx context.Context,
+	req *roomserverAPI.PerformPublishRequest,
+	res *roomserverAPI.PerformPublishResponse,
+) {
+	r.published[req.RoomID] = req.Visibility == "public"
+}
+
+type upgradeAccountDB struct {
+	accounts.Database
+}
+
+func (d *upgradeAccountDB) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart, DisplayName: localpart}, nil
+}
+
+func mustCreateUpgradeTestState(t *testing.T, key ed25519.PrivateKey) []*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	var events []*gomatrixserverlib.HeaderedEvent
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	add := func(sender, evType, stateKey string, content interface{}) {
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:   sender,
+			RoomID:   upgradeTestRoomID,
+			Type:     evType,
+			StateKey: &stateKey,
+			Depth:    int64(len(events) + 1),
+		}
+		if err := eb.SetContent(content); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if len(events) > 0 {
+			eb.PrevEvents = []gomatrixserverlib.EventReference{events[len(events)-1].EventReference()}
+		}
+		ev, err := buildEvent(&eb, &authEvents, &config.ClientAPI{Matrix: &config.Global{
+			ServerName: "localhost", KeyID: "ed25519:test", PrivateKey: key,
+		}}, time.Now(), gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			t.Fatalf("event %s not allowed: %s", evType, err)
+		}
+		if err = authEvents.AddEvent(ev); err != nil {
+			t.Fatalf("failed to add auth event: %s", err)
+		}
+		events = append(events, ev.Headered(gomatrixserverlib.RoomVersionV6))
+	}
+	add(upgradeTestUserID, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": upgradeTestUserID, "room_version": "6", "m.federate": false,
+	})
+	add(upgradeTestUserID, gomatrixserverlib.MRoomMember, upgradeTestUserID, map[string]interface{}{"membership": "join"})
+	add(upgradeTestUserID, gomatrixserverlib.MRoomPowerLevels, "", map[string]interface{}{
+		"users": map[string]int64{upgradeTestUserID: 100, "@bob:localhost": 0},
+		"ban":   50, "kick": 50, "redact": 50, "invite": 0, "state_default": 50, "events_default": 0,
+	})
+	add(upgradeTestUserID, gomatrixserverlib.MRoomJoinRules, "", map[string]interface{}{"join_rule": "public"})
+	add("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]interface{}{"membership": "join"})
+	add(upgradeTestUserID, gomatrixserverlib.MRoomMember, "@mallory:localhost", map[string]interface{}{"membership": "ban"})
+	add(upgradeTestUserID, gomatrixserverlib.MRoomName, "", map[string]interface{}{"name": "Test room"})
+	add(upgradeTestUserID, gomatrixserverlib.MRoomCanonicalAlias, "", map[string]interface{}{"alias": upgradeTestAlias})
+	return events
+}
+
+func TestUpgradeRoom(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "localhost",
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	state := mustCreateUpgradeTestState(t, key)
+	rsAPI := &upgradeRoomserverAPI{
+		state:     state,
+		latest:    state[len(state)-1].EventReference(),
+		aliases:   map[string]string{upgradeTestAlias: upgradeTestRoomID},
+		published: map[string]bool{upgradeTestRoomID: true},
+	}
+
+	// Users without permission to send a tombstone can't upgrade the room.
+	req := httptest.NewRequest(http.MethodPost, "/upgrade", strings.NewReader(`{"new_version":"6"}`))
+	res := UpgradeRoom(req, &userapi.Device{UserID: "@bob:localhost"}, cfg, upgradeTestRoomID, &upgradeAccountDB{}, rsAPI, nil)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d for bob, got %d: %+v", http.StatusForbidden, res.Code, res.JSON)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/upgrade", strings.NewReader(`{"new_version":"unknown"}`))
+	res = UpgradeRoom(req, &userapi.Device{UserID: upgradeTestUserID}, cfg, upgradeTestRoomID, &upgradeAccountDB{}, rsAPI, nil)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for unknown version, got %d: %+v", http.StatusBadRequest, res.Code, res.JSON)
+	}
+	if len(rsAPI.input) != 0 {
+		t.Fatalf("expected no events to be sent, got %d", len(rsAPI.input))
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upgrade", strings.NewReader(`{"new_version":"6"}`))
+	res = UpgradeRoom(req, &userapi.Device{UserID: upgradeTestUserID}, cfg, upgradeTestRoomID, &upgradeAccountDB{}, rsAPI, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+	newRoomID := res.JSON.(upgradeRoomResponse).ReplacementRoom
+
+	sent := map[string]map[string]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range rsAPI.input {
+		if sent[ev.RoomID()] == nil {
+			sent[ev.RoomID()] = map[string]*gomatrixserverlib.HeaderedEvent{}
+		}
+		sent[ev.RoomID()][ev.Type()+"|"+*ev.StateKey()] = ev
+	}
+
+	var createContent struct {
+		Creator     string                         `json:"creator"`
+		Federate    bool                           `json:"m.federate"`
+		Predecessor gomatrixserverlib.PreviousRoom `json:"predecessor"`
+	}
+	create := sent[newRoomID][gomatrixserverlib.MRoomCreate+"|"]
+	if create == nil {
+		t.Fatalf("no create event sent to replacement room")
+	}
+	if err = json.Unmarshal(create.Content(), &createContent); err != nil {
+		t.Fatal(err)
+	}
+	if createContent.Creator != upgradeTestUserID || createContent.Federate ||
+		createContent.Predecessor.RoomID != upgradeTestRoomID || createContent.Predecessor.EventID != rsAPI.latest.EventID {
+		t.Errorf("unexpected create content %s", string(create.Content()))
+	}
+	for _, key := range []string{
+		gomatrixserverlib.MRoomJoinRules + "|",
+		gomatrixserverlib.MRoomName + "|",
+		gomatrixserverlib.MRoomCanonicalAlias + "|",
+		gomatrixserverlib.MRoomMember + "|@mallory:localhost",
+	} {
+		if sent[newRoomID][key] == nil {
+			t.Errorf("expected %s to be copied to the replacement room", key)
+		}
+	}
+	if sent[newRoomID][gomatrixserverlib.MRoomMember+"|@bob:localhost"] != nil {
+		t.Errorf("expected bob's membership not to be copied")
+	}
+
+	tombstone := sent[upgradeTestRoomID]["m.room.tombstone|"]
+	if tombstone == nil || !strings.Contains(string(tombstone.Content()), newRoomID) {
+		t.Errorf("expected a tombstone pointing at %s in the old room, got %v", newRoomID, tombstone)
+	}
+	if alias := sent[upgradeTestRoomID][gomatrixserverlib.MRoomCanonicalAlias+"|"]; alias == nil || string(alias.Content()) != "{}" {
+		t.Errorf("expected the canonical alias to be removed from the old room, got %v", alias)
+	}
+	pl := sent[upgradeTestRoomID][gomatrixserverlib.MRoomPowerLevels+"|"]
+	if pl == nil {
+		t.Fatalf("expected the power levels of the old room to be restricted")
+	}
+	levels, err := pl.PowerLevels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels.EventsDefault != 50 || levels.Invite != 50 {
+		t.Errorf("unexpected restricted power levels %s", string(pl.Content()))
+	}
+
+	if rsAPI.aliases[upgradeTestAlias] != newRoomID {
+		t.Errorf("expected %s to point at %s, got %s", upgradeTestAlias, newRoomID, rsAPI.aliases[upgradeTestAlias])
+	}
+	if rsAPI.published[upgradeTestRoomID] || !rsAPI.published[newRoomID] {
+		t.Errorf("expected the replacement room to be published instead of the old room, got %v", rsAPI.published)
+	}
+}
+
+func TestUpgradeInitialPowerLevels(t *testing.T) {
+	var pl gomatrixserverlib.PowerLevelContent
+	pl.Defaults()
+	pl.Users = map[string]int64{"@alice:localhost": 60}
+	pl.Events = map[string]int64{gomatrixserverlib.MRoomPowerLevels: 100}
+	events := []fledglingEvent{
+		{Type: gomatrixserverlib.MRoomName},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: "@mallory:localhost"},
+	}
+	// Sending the power levels needs 100, so alice is raised.
+	initial, raised := upgradeInitialPowerLevels(pl, "@alice:localhost", events)
+	if !raised || initial.UserLevel("@alice:localhost") != 100 {
+		t.Errorf("expected alice to be raised to 100, got raised=%v level=%d", raised, initial.UserLevel("@alice:localhost"))
+	}
+	if pl.Users["@alice:localhost"] != 60 {
+		t.Errorf("original power levels were modified")
+	}
+	pl.Users["@alice:localhost"] = 100
+	if _, raised = upgradeInitialPowerLevels(pl, "@alice:localhost", events); raised {
+		t.Errorf("expected alice not to be raised")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -30,12 +29,13 @@ type UserDirectoryResponse struct {
 	Limited bool                              `json:"limited"`
 }
 
+// SearchUserDirectory implements POST /user_directory/search. Users are searched
+// in the roomserver's user directory index, which only returns users sharing
+// a room with the searching user.
 func SearchUserDirectory(
 	ctx context.Context,
 	device *userapi.Device,
-	userAPI userapi.UserInternalAPI,
 	rsAPI api.RoomserverInternalAPI,
-	serverName gomatrixserverlib.ServerName,
 	searchString string,
 	limit int,
 ) *util.JSONResponse {
@@ -43,69 +43,29 @@ func SearchUserDirectory(
 		limit = 10
 	}
 
-	results := map[string]authtypes.FullyQualifiedProfile{}
-	response := &UserDirectoryResponse{
-		Results: []authtypes.FullyQualifiedProfile{},
-		Limited: false,
-	}
-
-	// First start searching local users.
-
-	userReq := &userapi.QuerySearchProfilesRequest{
+	// Ask for one more result than the limit, so that we know whether the
+	// results are limited.
+	stateReq := &api.QueryKnownUsersRequest{
+		UserID:       device.UserID,
 		SearchString: searchString,
-		Limit:        limit,
+		Limit:        limit + 1,
 	}
-	userRes := &userapi.QuerySearchProfilesResponse{}
-	if err := userAPI.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
-		errRes := util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
+	stateRes := &api.QueryKnownUsersResponse{}
+	if err := rsAPI.QueryKnownUsers(ctx, stateReq, stateRes); err != nil {
+		errRes := util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
 		return &errRes
 	}
 
-	for _, user := range userRes.Profiles {
-		if len(results) == limit {
+	response := &UserDirectoryResponse{
+		Results: []authtypes.FullyQualifiedProfile{},
+		Limited: false,
+	}
+	for _, user := range stateRes.Users {
+		if len(response.Results) == limit {
 			response.Limited = true
 			break
 		}
-
-		userID := fmt.Sprintf("@%s:%s", user.Localpart, serverName)
-		if _, ok := results[userID]; !ok {
-			results[userID] = authtypes.FullyQualifiedProfile{
-				UserID:      userID,
-				DisplayName: user.DisplayName,
-				AvatarURL:   user.AvatarURL,
-			}
-		}
-	}
-
-	// Then, if we have enough room left in the response,
-	// start searching for known users from joined rooms.
-
-	if len(results) <= limit {
-		stateReq := &api.QueryKnownUsersRequest{
-			UserID:       device.UserID,
-			SearchString: searchString,
-			Limit:        limit - len(results),
-		}
-		stateRes := &api.QueryKnownUsersResponse{}
-		if err := rsAPI.QueryKnownUsers(ctx, stateReq, stateRes); err != nil {
-			errRes := util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
-			return &errRes
-		}
-
-		for _, user := range stateRes.Users {
-			if len(results) == limit {
-				response.Limited = true
-				break
-			}
-
-			if _, ok := results[user.UserID]; !ok {
-				results[user.UserID] = user
-			}
-		}
-	}
-
-	for _, result := range results {
-		response.Results = append(response.Results, result)
+		response.Results = append(response.Results, user)
 	}
 
 	return &util.JSONResponse{
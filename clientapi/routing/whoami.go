@@ -15,6 +15,7 @@ package routing
 import (
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 )
@@ -22,13 +23,41 @@ import (
 // whoamiResponse represents an response for a `whoami` request
 type whoamiResponse struct {
 	UserID string `json:"user_id"`
+	// The last-seen information for the requesting device, only included
+	// if asked for with ?include_last_seen=true.
+	LastSeenTS int64  `json:"last_seen_ts,omitempty"`
+	LastSeenIP string `json:"last_seen_ip,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
 }
 
 // Whoami implements `/account/whoami` which enables client to query their account user id.
 // https://matrix.org/docs/spec/client_server/r0.3.0.html#get-matrix-client-r0-account-whoami
-func Whoami(req *http.Request, device *api.Device) util.JSONResponse {
+// If ?include_last_seen=true is given then the response also includes when and
+// where the requesting device was last seen. Since this is only ever about the
+// device whose access token was used, no further authorisation is needed.
+func Whoami(req *http.Request, device *api.Device, userAPI api.UserInternalAPI) util.JSONResponse {
+	res := whoamiResponse{UserID: device.UserID}
+	if req.URL.Query().Get("include_last_seen") == "true" {
+		// The device that we get from the access token doesn't include the
+		// last-seen information, so we have to look it up.
+		var queryRes api.QueryDevicesResponse
+		if err := userAPI.QueryDevices(req.Context(), &api.QueryDevicesRequest{
+			UserID: device.UserID,
+		}, &queryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDevices failed")
+			return jsonerror.InternalServerError()
+		}
+		for _, dev := range queryRes.Devices {
+			if dev.ID != device.ID {
+				continue
+			}
+			res.LastSeenTS = dev.LastSeenTS
+			res.LastSeenIP = dev.LastSeenIP
+			res.UserAgent = dev.UserAgent
+		}
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: whoamiResponse{UserID: device.UserID},
+		JSON: res,
 	}
 }
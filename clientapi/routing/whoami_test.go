@@ -0,0 +1,72 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type whoamiUserAPI struct {
+	userapi.UserInternalAPI
+	devices []userapi.Device
+}
+
+func (u *whoamiUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.UserExists = true
+	for _, dev := range u.devices {
+		if dev.UserID == req.UserID {
+			res.Devices = append(res.Devices, dev)
+		}
+	}
+	return nil
+}
+
+func TestWhoamiLastSeen(t *testing.T) {
+	userAPI := &whoamiUserAPI{
+		devices: []userapi.Device{
+			{ID: "OTHER", UserID: "@alice:localhost", LastSeenTS: 1, LastSeenIP: "10.0.0.1", UserAgent: "other"},
+			{ID: "PHONE", UserID: "@alice:localhost", LastSeenTS: 1234, LastSeenIP: "10.0.0.2", UserAgent: "phone"},
+		},
+	}
+	// The device from the access token doesn't have last-seen information.
+	device := &userapi.Device{ID: "PHONE", UserID: "@alice:localhost"}
+
+	req := httptest.NewRequest(http.MethodGet, "/account/whoami?include_last_seen=true", nil)
+	res := Whoami(req, device, userAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	want := whoamiResponse{
+		UserID:     "@alice:localhost",
+		LastSeenTS: 1234,
+		LastSeenIP: "10.0.0.2",
+		UserAgent:  "phone",
+	}
+	if got := res.JSON.(whoamiResponse); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// Without the query parameter only the user ID is returned.
+	req = httptest.NewRequest(http.MethodGet, "/account/whoami", nil)
+	res = Whoami(req, device, userAPI)
+	if got := res.JSON.(whoamiResponse); got != (whoamiResponse{UserID: "@alice:localhost"}) {
+		t.Errorf("expected only the user ID, got %+v", got)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements single sign-on through OpenID Connect identity
+// providers, using the authorization code flow.
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+var defaultScopes = []string{"openid", "profile"}
+
+// How far the clocks of the provider and the homeserver may be apart when
+// checking the expiry of ID tokens.
+const idTokenClockSkew = time.Minute
+
+// Claims are the claims about a user returned by an identity provider.
+type Claims map[string]interface{}
+
+// String returns the value of a claim, or an empty string if the claim is
+// missing or isn't a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Subject returns the identifier of the user at the identity provider.
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is a public key of a provider, as per RFC 7517. Only RSA and
+// P-256 keys are supported.
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// Provider is an OpenID Connect identity provider. The endpoints of the
+// provider are discovered on first use.
+type Provider struct {
+	Config *config.IdentityProvider
+
+	client    *http.Client
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	keys      map[string]crypto.PublicKey // by key ID
+}
+
+// NewProviders returns the identity providers in the configuration, by ID.
+func NewProviders(cfg *config.SSO, client *http.Client) map[string]*Provider {
+	providers := make(map[string]*Provider, len(cfg.Providers))
+	for i := range cfg.Providers {
+		providers[cfg.Providers[i].ID] = &Provider{
+			Config: &cfg.Providers[i],
+			client: client,
+		}
+	}
+	return providers
+}
+
+// AuthorizationURL returns the URL users are sent to in order to log in with
+// the provider. The provider sends them back to the callback URL with the
+// given state, and puts the nonce into the ID token.
+func (p *Provider) AuthorizationURL(ctx context.Context, callbackURL, state, nonce string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	scopes := p.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.Config.ClientID)
+	q.Set("redirect_uri", callbackURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems the authorization code the provider sent the user back
+// with, and returns the claims about the user. The ID token which comes with
+// the access token must be signed by the provider, be meant for us and
+// contain the nonce of the login.
+func (p *Provider) Exchange(ctx context.Context, callbackURL, code, nonce string) (Claims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {callbackURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err = p.do(req, &token); err != nil {
+		return nil, fmt.Errorf("failed to redeem the authorization code: %w", err)
+	}
+	if token.AccessToken == "" || token.IDToken == "" {
+		return nil, fmt.Errorf("no access token or ID token was returned for the authorization code")
+	}
+	claims, err := p.verifyIDToken(ctx, d, token.IDToken, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	// The userinfo endpoint may return more claims than the ID token, but
+	// they must be about the same user.
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, d.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var userinfo Claims
+	if err = p.do(req, &userinfo); err != nil {
+		return nil, fmt.Errorf("failed to get the user info: %w", err)
+	}
+	if userinfo.Subject() != claims.Subject() {
+		return nil, fmt.Errorf("the user info is about %q rather than %q", userinfo.Subject(), claims.Subject())
+	}
+	for name, value := range userinfo {
+		claims[name] = value
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks the signature and the claims of an ID token, as per
+// section 3.1.3.7 of OpenID Connect Core, and returns the claims.
+func (p *Provider) verifyIDToken(ctx context.Context, d *discoveryDocument, idToken, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	key, err := p.publicKey(ctx, d, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err = decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if claims.String("iss") != d.Issuer {
+		return nil, fmt.Errorf("issued by %q rather than %q", claims.String("iss"), d.Issuer)
+	}
+	if !claims.hasAudience(p.Config.ClientID) {
+		return nil, fmt.Errorf("not meant for client %q", p.Config.ClientID)
+	}
+	if azp := claims.String("azp"); azp != "" && azp != p.Config.ClientID {
+		return nil, fmt.Errorf("authorised party is %q rather than %q", azp, p.Config.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Unix(int64(exp), 0).Add(idTokenClockSkew).Before(time.Now()) {
+		return nil, fmt.Errorf("expired or has no expiry")
+	}
+	if nonce == "" || claims.String("nonce") != nonce {
+		return nil, fmt.Errorf("the nonce doesn't match the login")
+	}
+	if claims.Subject() == "" {
+		return nil, fmt.Errorf("no subject")
+	}
+	return claims, nil
+}
+
+// hasAudience returns whether the aud claim, which is either a string or an
+// array of strings, contains the given client ID.
+func (c Claims) hasAudience(clientID string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature checks a JWS signature. Only the asymmetric algorithms of
+// the supported key types are accepted, so in particular unsigned tokens are
+// rejected.
+func verifySignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the key doesn't match the algorithm %q", algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], signature); err != nil {
+			return fmt.Errorf("bad signature: %w", err)
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("the key or signature doesn't match the algorithm %q", algorithm)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, hash[:], r, s) {
+			return fmt.Errorf("bad signature")
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	return nil
+}
+
+// publicKey returns the signing key of the provider with the given ID. The
+// keys are fetched again if the key ID isn't known, as providers rotate
+// their keys.
+func (p *Provider) publicKey(ctx context.Context, d *discoveryDocument, keyID string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = p.do(req, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to get the signing keys: %w", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key := jwk.publicKey(); key != nil {
+			p.keys[jwk.KeyID] = key
+		}
+	}
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+	return key, nil
+}
+
+// publicKey returns the key, or nil if it's malformed or of an unsupported
+// type.
+func (k *jsonWebKey) publicKey() crypto.PublicKey {
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, e := decode(k.N), decode(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		x, y := decode(k.X), decode(k.Y)
+		if k.Curve != "P-256" || x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	}
+	return nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimRight(p.Config.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d discoveryDocument
+	if err = p.do(req, &d); err != nil {
+		return nil, fmt.Errorf("failed to discover the OpenID Connect endpoints of %q: %w", issuer, err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("the discovered issuer %q doesn't match %q", d.Issuer, issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("the OpenID Connect provider %q is missing required endpoints", issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *Provider) do(req *http.Request, res interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d: %s", req.URL.String(), resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, res)
+}
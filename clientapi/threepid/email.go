@@ -0,0 +1,215 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+// SubmitTokenPath is the path, relative to the client API, of the endpoint
+// which validates the tokens sent by the homeserver.
+const SubmitTokenPath = "/_matrix/client/unstable/org.matrix.dendrite/email/submit_token"
+
+var (
+	// ErrSessionNotFound is the error returned if a validation session
+	// doesn't exist, or if the client secret doesn't match.
+	ErrSessionNotFound = errors.New("unknown validation session")
+	// ErrSessionExpired is the error returned if the token of a validation
+	// session was sent too long ago to be used.
+	ErrSessionExpired = errors.New("validation session has expired")
+	// ErrSessionNotValidated is the error returned if the token of a
+	// validation session hasn't been submitted yet.
+	ErrSessionNotValidated = errors.New("validation session has not been validated")
+	// ErrBadToken is the error returned if the submitted token doesn't match
+	// the one that was sent.
+	ErrBadToken = errors.New("invalid validation token")
+)
+
+// Mailer sends emails on behalf of the homeserver.
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+type smtpMailer struct {
+	cfg *config.EmailVerification
+}
+
+// NewSMTPMailer returns a Mailer which sends the emails through the SMTP
+// server in the given configuration.
+func NewSMTPMailer(cfg *config.EmailVerification) Mailer {
+	return &smtpMailer{cfg}
+}
+
+func (m *smtpMailer) SendMail(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	var auth smtp.Auth
+	if m.cfg.SMTP.Username != "" {
+		host, _, err := net.SplitHostPort(m.cfg.SMTP.Host)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.cfg.SMTP.Username, m.cfg.SMTP.Password, host)
+	}
+	msg := "From: " + m.cfg.SMTP.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.cfg.SMTP.Host, auth, m.cfg.SMTP.From, []string{to}, []byte(msg))
+}
+
+// RequestEmailValidation starts or continues a validation session for the
+// email address in the request, and sends it a validation link if the client
+// made a new send attempt. The action describes what the address is being
+// verified for, e.g. "reset your password".
+// Returns the session's ID.
+func RequestEmailValidation(
+	ctx context.Context, req EmailAssociationRequest, action string,
+	accountDB accounts.Database, mailer Mailer, cfg *config.ClientAPI,
+) (string, error) {
+	now := time.Now()
+	if err := accountDB.RemoveExpiredThreePIDValidationSessions(
+		ctx, now.Add(-cfg.Email.TokenLifetime).UnixNano()/int64(time.Millisecond),
+	); err != nil {
+		return "", err
+	}
+
+	session, err := accountDB.GetThreePIDValidationSessionBySecret(ctx, req.Secret, "email", req.Email)
+	if err != nil {
+		return "", err
+	}
+	// Clients retry with the same send attempt to get the session back
+	// without sending another email.
+	if session != nil && req.SendAttempt <= session.SendAttempt {
+		return session.SessionID, nil
+	}
+
+	// The token grants control of the address, so it must be unguessable.
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	createdTS := now.UnixNano() / int64(time.Millisecond)
+	if session == nil {
+		session = &authtypes.ThreePIDValidationSession{
+			SessionID:    util.RandomString(24),
+			ClientSecret: req.Secret,
+			Medium:       "email",
+			Address:      req.Email,
+			Token:        token,
+			SendAttempt:  req.SendAttempt,
+			CreatedTS:    createdTS,
+		}
+		err = accountDB.CreateThreePIDValidationSession(ctx, session)
+	} else {
+		err = accountDB.UpdateThreePIDValidationSessionToken(ctx, session.SessionID, token, req.SendAttempt, createdTS)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	link := SubmitURL(cfg) + "?" + url.Values{
+		"sid":           {session.SessionID},
+		"client_secret": {req.Secret},
+		"token":         {token},
+	}.Encode()
+	body := fmt.Sprintf(
+		"To %s on %s, please follow this link to confirm your email address:\n\n%s\n\n"+
+			"The link is valid for %s. If you didn't ask for this, you can ignore this email.\n",
+		action, cfg.Matrix.ServerName, link, cfg.Email.TokenLifetime,
+	)
+	subject := fmt.Sprintf("Confirm your email address for %s", cfg.Matrix.ServerName)
+	if err = mailer.SendMail(req.Email, subject, body); err != nil {
+		return "", err
+	}
+	return session.SessionID, nil
+}
+
+// SubmitURL returns the URL of the endpoint which validates the tokens sent
+// by the homeserver.
+func SubmitURL(cfg *config.ClientAPI) string {
+	return strings.TrimRight(cfg.Email.PublicBaseURL, "/") + SubmitTokenPath
+}
+
+// ValidateSession checks the token submitted for a validation session and
+// marks the session as validated if it matches.
+func ValidateSession(
+	ctx context.Context, sessionID, clientSecret, token string,
+	accountDB accounts.Database, cfg *config.ClientAPI,
+) error {
+	session, err := getSession(ctx, sessionID, clientSecret, accountDB, cfg)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(session.Token)) != 1 {
+		return ErrBadToken
+	}
+	return accountDB.ValidateThreePIDValidationSession(
+		ctx, session.SessionID, time.Now().UnixNano()/int64(time.Millisecond),
+	)
+}
+
+// CheckValidatedSession returns the validation session matching the given
+// credentials if its token was submitted.
+// Returns ErrSessionNotValidated if the token hasn't been submitted yet.
+func CheckValidatedSession(
+	ctx context.Context, creds Credentials,
+	accountDB accounts.Database, cfg *config.ClientAPI,
+) (*authtypes.ThreePIDValidationSession, error) {
+	session, err := getSession(ctx, creds.SID, creds.Secret, accountDB, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if session.ValidatedTS == 0 {
+		return nil, ErrSessionNotValidated
+	}
+	return session, nil
+}
+
+func getSession(
+	ctx context.Context, sessionID, clientSecret string,
+	accountDB accounts.Database, cfg *config.ClientAPI,
+) (*authtypes.ThreePIDValidationSession, error) {
+	session, err := accountDB.GetThreePIDValidationSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(session.ClientSecret)) != 1 {
+		return nil, ErrSessionNotFound
+	}
+	expiry := time.Unix(0, session.CreatedTS*int64(time.Millisecond)).Add(cfg.Email.TokenLifetime)
+	if time.Now().After(expiry) {
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
@@ -102,7 +102,7 @@ func CheckAndProcessInvite(
 		return
 	}
 
-	lookupRes, storeInviteRes, err := queryIDServer(ctx, db, cfg, device, body, roomID)
+	lookupRes, storeInviteRes, err := queryIDServer(ctx, db, cfg, rsAPI, device, body, roomID)
 	if err != nil {
 		return
 	}
@@ -137,8 +137,8 @@ func CheckAndProcessInvite(
 // Returns an error if a check or a request failed.
 func queryIDServer(
 	ctx context.Context,
-	db accounts.Database, cfg *config.ClientAPI, device *userapi.Device,
-	body *MembershipRequest, roomID string,
+	db accounts.Database, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, body *MembershipRequest, roomID string,
 ) (lookupRes *idServerLookupResponse, storeInviteRes *idServerStoreInviteResponse, err error) {
 	if err = isTrusted(body.IDServer, cfg); err != nil {
 		return
@@ -153,7 +153,7 @@ func queryIDServer(
 	if lookupRes.MXID == "" {
 		// No Matrix ID matches with the given 3PID, ask the server to store the
 		// invite and return a token
-		storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, device, body, roomID)
+		storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, rsAPI, device, body, roomID)
 		return
 	}
 
@@ -162,9 +162,10 @@ func queryIDServer(
 	// by the identity server
 	now := time.Now().UnixNano() / 1000000
 	if lookupRes.NotBefore > now || now > lookupRes.NotAfter {
-		// If the current timestamp isn't in the time frame in which the association
-		// is known to be valid, re-run the query
-		return queryIDServer(ctx, db, cfg, device, body, roomID)
+		// The identity server returned an association which isn't valid at
+		// the moment, so we can't trust it
+		err = fmt.Errorf("association for %s from %s is not currently valid", body.Address, body.IDServer)
+		return
 	}
 
 	// Check the request signatures and send an error if one isn't valid
@@ -189,10 +190,11 @@ func queryIDServerLookup(ctx context.Context, body *MembershipRequest) (*idServe
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	if resp.StatusCode != http.StatusOK {
 		// TODO: Log the error supplied with the identity server?
-		errMgs := fmt.Sprintf("Failed to ask %s to store an invite for %s", body.IDServer, body.Address)
+		errMgs := fmt.Sprintf("Failed to ask %s to look up %s", body.IDServer, body.Address)
 		return nil, errors.New(errMgs)
 	}
 
@@ -206,8 +208,8 @@ func queryIDServerLookup(ctx context.Context, body *MembershipRequest) (*idServe
 // Returns an error if the request failed to send or if the response couldn't be parsed.
 func queryIDServerStoreInvite(
 	ctx context.Context,
-	db accounts.Database, cfg *config.ClientAPI, device *userapi.Device,
-	body *MembershipRequest, roomID string,
+	db accounts.Database, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, body *MembershipRequest, roomID string,
 ) (*idServerStoreInviteResponse, error) {
 	// Retrieve the sender's profile to get their display name
 	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
@@ -233,12 +235,12 @@ func queryIDServerStoreInvite(
 	data.Add("room_id", roomID)
 	data.Add("sender", device.UserID)
 	data.Add("sender_display_name", profile.DisplayName)
-	// TODO: Also send:
-	//      - The room name (room_name)
-	//      - The room's avatar url (room_avatar_url)
-	//      See https://github.com/matrix-org/sydent/blob/master/sydent/http/servlets/store_invite_servlet.py#L82-L91
-	//      These can be easily retrieved by requesting the public rooms API
-	//      server's database.
+	data.Add("sender_avatar_url", profile.AvatarURL)
+	// The identity server uses these to describe the room in the invite
+	// that it sends. See https://github.com/matrix-org/sydent/blob/master/sydent/http/servlets/store_invite_servlet.py#L82-L91
+	for key, value := range roomDetails(ctx, rsAPI, roomID) {
+		data.Add(key, value)
+	}
 
 	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/store-invite", body.IDServer)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
@@ -251,6 +253,7 @@ func queryIDServerStoreInvite(
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	if resp.StatusCode != http.StatusOK {
 		errMsg := fmt.Sprintf("Identity server %s responded with a %d error code", body.IDServer, resp.StatusCode)
@@ -262,6 +265,46 @@ func queryIDServerStoreInvite(
 	return &idResp, err
 }
 
+// roomDetails returns the parts of the room's current state that the
+// identity server can use to describe the room in the invite it sends,
+// keyed by the store-invite parameter name. Missing state is left out.
+func roomDetails(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string) map[string]string {
+	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName}
+	avatarTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.avatar"}
+	joinRulesTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules}
+	aliasTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias}
+	var res api.QueryCurrentStateResponse
+	if err := rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{nameTuple, avatarTuple, joinRulesTuple, aliasTuple},
+	}, &res); err != nil {
+		return nil
+	}
+	details := map[string]string{}
+	for param, field := range map[string]struct {
+		tuple gomatrixserverlib.StateKeyTuple
+		key   string
+	}{
+		"room_name":       {nameTuple, "name"},
+		"room_avatar_url": {avatarTuple, "url"},
+		"room_join_rules": {joinRulesTuple, "join_rule"},
+		"room_alias":      {aliasTuple, "alias"},
+	} {
+		ev, ok := res.StateEvents[field.tuple]
+		if !ok || ev == nil {
+			continue
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			continue
+		}
+		if value, ok := content[field.key].(string); ok && value != "" {
+			details[param] = value
+		}
+	}
+	return details
+}
+
 // queryIDServerPubKey requests a public key identified with a given ID to the
 // a given identity server and returns the matching base64-decoded public key.
 // We assume that the ID server is trusted at this point.
@@ -277,6 +320,7 @@ func queryIDServerPubKey(ctx context.Context, idServerName string, keyID string)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	var pubKeyRes struct {
 		PublicKey gomatrixserverlib.Base64Bytes `json:"public_key"`
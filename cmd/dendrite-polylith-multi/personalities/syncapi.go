@@ -29,8 +29,8 @@ func SyncAPI(base *setup.BaseDendrite, cfg *config.Dendrite) {
 	syncapi.AddPublicRoutes(
 		base.ProcessContext,
 		base.PublicClientAPIMux, userAPI, rsAPI,
-		base.KeyServerHTTPClient(),
-		federation, &cfg.SyncAPI,
+		base.KeyServerHTTPClient(), base.EDUServerClient(),
+		federation, &cfg.SyncAPI, &cfg.MSCs,
 	)
 
 	base.SetupAndServeHTTP(
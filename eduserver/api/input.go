@@ -75,6 +75,30 @@ type InputReceiptEventRequest struct {
 // InputReceiptEventResponse is a response to InputReceiptEventRequest
 type InputReceiptEventResponse struct{}
 
+// InputPresence is an update to the presence of a user.
+type InputPresence struct {
+	UserID string `json:"user_id"`
+	// Presence is one of PresenceOnline, PresenceUnavailable or PresenceOffline.
+	Presence string `json:"presence"`
+	// StatusMsg is the new status message of the user. A nil status
+	// message leaves the current one unchanged.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// LastActiveTS is when the user was last active.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+}
+
+// InputPresenceRequest is a request to EDUServerInputAPI
+type InputPresenceRequest struct {
+	InputPresence InputPresence `json:"input_presence"`
+}
+
+// InputPresenceResponse is a response to InputPresenceRequest
+type InputPresenceResponse struct {
+	// StatusMsgTooLong is set if the update was rejected because its status
+	// message is longer than the configured maximum.
+	StatusMsgTooLong bool `json:"status_msg_too_long,omitempty"`
+}
+
 // EDUServerInputAPI is used to write events to the typing server.
 type EDUServerInputAPI interface {
 	InputTypingEvent(
@@ -94,4 +118,10 @@ type EDUServerInputAPI interface {
 		request *InputReceiptEventRequest,
 		response *InputReceiptEventResponse,
 	) error
+
+	InputPresence(
+		ctx context.Context,
+		request *InputPresenceRequest,
+		response *InputPresenceResponse,
+	) error
 }
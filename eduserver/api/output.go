@@ -17,7 +17,9 @@
 package api
 
 import (
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -67,6 +69,95 @@ type OutputReceiptEvent struct {
 	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
 }
 
+// The presence states of a user.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// IsValidPresence returns whether the presence is one of the presence
+// states of the specification.
+func IsValidPresence(presence string) bool {
+	switch presence {
+	case PresenceOnline, PresenceUnavailable, PresenceOffline:
+		return true
+	default:
+		return false
+	}
+}
+
+// SanitisePresenceStatusMsg strips control characters, which have no place
+// in a status message and can be used to mess with how clients display it.
+func SanitisePresenceStatusMsg(statusMsg string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, statusMsg)
+}
+
+// CurrentlyActiveThreshold is how recently an online user must have been
+// active to be reported as currently active.
+const CurrentlyActiveThreshold = time.Minute
+
+// IsCurrentlyActive returns whether a user with the given presence, last
+// active at the given time, should be reported as currently active.
+func IsCurrentlyActive(presence string, lastActiveTS gomatrixserverlib.Timestamp) bool {
+	return presence == PresenceOnline && time.Since(lastActiveTS.Time()) < CurrentlyActiveThreshold
+}
+
+// OutputPresenceEvent is an entry in the presence output kafka log
+type OutputPresenceEvent struct {
+	UserID    string  `json:"user_id"`
+	Presence  string  `json:"presence"`
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// LastActiveTS is when the user was last active.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+}
+
+// PresenceContent is the content of an m.presence event, and the body of
+// the response to GET /presence/{userId}/status.
+type PresenceContent struct {
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool    `json:"currently_active,omitempty"`
+}
+
+// NewPresenceContent returns the client-facing content of the presence event,
+// with the last active time relative to now.
+func NewPresenceContent(e *OutputPresenceEvent) PresenceContent {
+	lastActiveAgo := time.Since(e.LastActiveTS.Time()).Milliseconds()
+	if lastActiveAgo < 0 {
+		lastActiveAgo = 0
+	}
+	return PresenceContent{
+		Presence:        e.Presence,
+		StatusMsg:       e.StatusMsg,
+		LastActiveAgo:   lastActiveAgo,
+		CurrentlyActive: IsCurrentlyActive(e.Presence, e.LastActiveTS),
+	}
+}
+
+// MPresence is the type of presence EDUs and events.
+const MPresence = "m.presence"
+
+// FederationPresence is the content of an m.presence EDU.
+type FederationPresence struct {
+	Push []FederationPresenceUpdate `json:"push"`
+}
+
+// FederationPresenceUpdate is the presence of one user in an m.presence EDU.
+type FederationPresenceUpdate struct {
+	UserID          string  `json:"user_id"`
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago"`
+	CurrentlyActive bool    `json:"currently_active,omitempty"`
+}
+
 // Helper structs for receipts json creation
 type ReceiptMRead struct {
 	User map[string]ReceiptTS `json:"m.read"`
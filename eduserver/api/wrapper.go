@@ -17,6 +17,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -86,3 +87,33 @@ func SendReceipt(
 	response := InputReceiptEventResponse{}
 	return eduAPI.InputReceiptEvent(ctx, &request, &response)
 }
+
+// ErrPresenceStatusMsgTooLong is returned by SendPresence if the status
+// message is longer than the configured maximum.
+var ErrPresenceStatusMsgTooLong = errors.New("presence status message is too long")
+
+// SendPresence sends a presence update to EDU Server. The status message is
+// stripped of control characters, and the update is rejected with
+// ErrPresenceStatusMsgTooLong if the status message is too long.
+func SendPresence(
+	ctx context.Context,
+	eduAPI EDUServerInputAPI, userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp,
+) error {
+	request := InputPresenceRequest{
+		InputPresence: InputPresence{
+			UserID:       userID,
+			Presence:     presence,
+			StatusMsg:    statusMsg,
+			LastActiveTS: lastActiveTS,
+		},
+	}
+	response := InputPresenceResponse{}
+	if err := eduAPI.InputPresence(ctx, &request, &response); err != nil {
+		return err
+	}
+	if response.StatusMsgTooLong {
+		return ErrPresenceStatusMsgTooLong
+	}
+	return nil
+}
@@ -52,6 +52,9 @@ func NewInternalAPI(
 		OutputTypingEventTopic:       cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent),
 		OutputSendToDeviceEventTopic: cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent),
 		OutputReceiptEventTopic:      cfg.Matrix.Kafka.TopicFor(config.TopicOutputReceiptEvent),
+		OutputPresenceEventTopic:     cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
 		ServerName:                   cfg.Matrix.ServerName,
+		DisablePresence:              cfg.Matrix.DisablePresence,
+		PresenceStatusMsgMaxLength:   base.Cfg.ClientAPI.PresenceStatusMsgMaxLength,
 	}
 }
@@ -19,7 +19,10 @@ package input
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/eduserver/api"
@@ -39,12 +42,38 @@ type EDUServerInputAPI struct {
 	OutputSendToDeviceEventTopic string
 	// The kafka topic to output new receipt events to
 	OutputReceiptEventTopic string
+	// The kafka topic to output new presence events to
+	OutputPresenceEventTopic string
 	// kafka producer
 	Producer sarama.SyncProducer
 	// Internal user query API
 	UserAPI userapi.UserInternalAPI
 	// our server name
 	ServerName gomatrixserverlib.ServerName
+	// Whether presence updates are ignored
+	DisablePresence bool
+	// The maximum length of a presence status message, in characters, or 0
+	// for no limit
+	PresenceStatusMsgMaxLength int
+
+	presenceMutex sync.Mutex
+	// The presence of local users, along with the timers which mark them
+	// idle once they stop being active.
+	presence map[string]*localPresence
+}
+
+// The presence of local users becomes unavailable once they haven't been
+// active for presenceIdleTimeout, and offline after presenceOfflineTimeout.
+const (
+	presenceIdleTimeout    = 5 * time.Minute
+	presenceOfflineTimeout = 30 * time.Minute
+)
+
+type localPresence struct {
+	presence     string
+	statusMsg    *string
+	lastActiveTS gomatrixserverlib.Timestamp
+	timer        *time.Timer
 }
 
 // InputTypingEvent implements api.EDUServerInputAPI
@@ -203,3 +232,136 @@ func (t *EDUServerInputAPI) InputReceiptEvent(
 	_, _, err = t.Producer.SendMessage(m)
 	return err
 }
+
+// InputPresence implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputPresence(
+	ctx context.Context,
+	request *api.InputPresenceRequest,
+	response *api.InputPresenceResponse,
+) error {
+	if t.DisablePresence {
+		return nil
+	}
+	ip := &request.InputPresence
+	if !api.IsValidPresence(ip.Presence) {
+		return fmt.Errorf("invalid presence %q", ip.Presence)
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', ip.UserID)
+	if err != nil {
+		return err
+	}
+	// Both local clients and remote servers set status messages, which end
+	// up in the syncs of local users, so they are checked here.
+	statusMsg := ip.StatusMsg
+	if statusMsg != nil {
+		sanitised := api.SanitisePresenceStatusMsg(*statusMsg)
+		if max := t.PresenceStatusMsgMaxLength; max > 0 && utf8.RuneCountInString(sanitised) > max {
+			response.StatusMsgTooLong = true
+			return nil
+		}
+		statusMsg = &sanitised
+	}
+	output := &api.OutputPresenceEvent{
+		UserID:       ip.UserID,
+		Presence:     ip.Presence,
+		StatusMsg:    statusMsg,
+		LastActiveTS: ip.LastActiveTS,
+	}
+	if domain == t.ServerName {
+		t.updateLocalPresence(output)
+	}
+	return t.sendPresenceEvent(output)
+}
+
+// updateLocalPresence remembers the presence of a local user, filling in
+// the status message if it wasn't changed, and (re)starts the timer which
+// marks the user idle.
+func (t *EDUServerInputAPI) updateLocalPresence(output *api.OutputPresenceEvent) {
+	t.presenceMutex.Lock()
+	defer t.presenceMutex.Unlock()
+	if t.presence == nil {
+		t.presence = make(map[string]*localPresence)
+	}
+	lp, ok := t.presence[output.UserID]
+	if !ok {
+		lp = &localPresence{}
+		t.presence[output.UserID] = lp
+	}
+	if output.StatusMsg == nil {
+		output.StatusMsg = lp.statusMsg
+	}
+	lp.presence = output.Presence
+	lp.statusMsg = output.StatusMsg
+	lp.lastActiveTS = output.LastActiveTS
+	t.resetPresenceTimer(output.UserID, lp)
+}
+
+// resetPresenceTimer starts the timer for the next presence state of an
+// inactive user. Must be called with presenceMutex held.
+func (t *EDUServerInputAPI) resetPresenceTimer(userID string, lp *localPresence) {
+	if lp.timer != nil {
+		lp.timer.Stop()
+		lp.timer = nil
+	}
+	var timeout time.Duration
+	switch lp.presence {
+	case api.PresenceOnline:
+		timeout = presenceIdleTimeout
+	case api.PresenceUnavailable:
+		timeout = presenceOfflineTimeout
+	default:
+		delete(t.presence, userID)
+		return
+	}
+	wait := time.Until(lp.lastActiveTS.Time().Add(timeout))
+	lp.timer = time.AfterFunc(wait, func() {
+		t.onPresenceTimeout(userID, lp)
+	})
+}
+
+// onPresenceTimeout moves an inactive local user to the next presence
+// state: online users become unavailable, unavailable users go offline.
+func (t *EDUServerInputAPI) onPresenceTimeout(userID string, lp *localPresence) {
+	t.presenceMutex.Lock()
+	if t.presence[userID] != lp {
+		// The presence was updated while the timer fired.
+		t.presenceMutex.Unlock()
+		return
+	}
+	switch lp.presence {
+	case api.PresenceOnline:
+		lp.presence = api.PresenceUnavailable
+	case api.PresenceUnavailable:
+		lp.presence = api.PresenceOffline
+	}
+	output := &api.OutputPresenceEvent{
+		UserID:       userID,
+		Presence:     lp.presence,
+		StatusMsg:    lp.statusMsg,
+		LastActiveTS: lp.lastActiveTS,
+	}
+	t.resetPresenceTimer(userID, lp)
+	t.presenceMutex.Unlock()
+
+	if err := t.sendPresenceEvent(output); err != nil {
+		logrus.WithError(err).WithField("user_id", userID).Error("Failed to send idle presence")
+	}
+}
+
+func (t *EDUServerInputAPI) sendPresenceEvent(output *api.OutputPresenceEvent) error {
+	logrus.WithFields(logrus.Fields{
+		"user_id":  output.UserID,
+		"presence": output.Presence,
+	}).Debugf("Producing to topic '%s'", t.OutputPresenceEventTopic)
+	js, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputPresenceEventTopic,
+		Key:   sarama.StringEncoder(output.UserID),
+		Value: sarama.ByteEncoder(js),
+	}
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
@@ -17,7 +17,6 @@ package routing
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -42,11 +41,11 @@ func InviteV2(
 	err := json.Unmarshal(request.Content(), &inviteReq)
 	switch e := err.(type) {
 	case gomatrixserverlib.UnsupportedRoomVersionError:
+		// The spec asks for M_INCOMPATIBLE_ROOM_VERSION here, so that the
+		// inviting server knows that we can't take part in the room.
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.UnsupportedRoomVersion(
-				fmt.Sprintf("Room version %q is not supported by this server.", e.Version),
-			),
+			JSON: jsonerror.IncompatibleRoomVersion(e.Version),
 		}
 	case gomatrixserverlib.BadJSONError:
 		return util.JSONResponse{
@@ -54,6 +53,9 @@ func InviteV2(
 			JSON: jsonerror.BadJSON(err.Error()),
 		}
 	case nil:
+		if err = validateInboundPDU(inviteReq.Event()); err != nil {
+			return inboundPDUErrorResponse(&InboundPDUError{err})
+		}
 		return processInvite(
 			httpReq.Context(), true, inviteReq.Event(), inviteReq.RoomVersion(), inviteReq.InviteRoomState(), roomID, eventID, cfg, rsAPI, keys,
 		)
@@ -77,19 +79,9 @@ func InviteV1(
 ) util.JSONResponse {
 	roomVer := gomatrixserverlib.RoomVersionV1
 	body := request.Content()
-	event, err := gomatrixserverlib.NewEventFromTrustedJSON(body, false, roomVer)
-	switch err.(type) {
-	case gomatrixserverlib.BadJSONError:
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON(err.Error()),
-		}
-	case nil:
-	default:
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.NotJSON("The request body could not be decoded into an invite v1 request. " + err.Error()),
-		}
+	event, err := parseTrustedInboundPDU(body, roomVer)
+	if err != nil {
+		return inboundPDUErrorResponse(err)
 	}
 	var strippedState []gomatrixserverlib.InviteV2StrippedState
 	if err := json.Unmarshal(event.Unsigned(), &strippedState); err != nil {
@@ -118,9 +110,7 @@ func processInvite(
 	if _, err := roomserverVersion.SupportedRoomVersion(roomVer); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.UnsupportedRoomVersion(
-				fmt.Sprintf("Room version %q is not supported by this server.", roomVer),
-			),
+			JSON: jsonerror.IncompatibleRoomVersion(roomVer),
 		}
 	}
 
@@ -188,9 +178,6 @@ func processInvite(
 		}
 	default:
 		util.GetLogger(ctx).WithError(err).Error("api.SendInvite failed")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: jsonerror.InternalServerError(),
-		}
+		return jsonerror.InternalServerError()
 	}
 }
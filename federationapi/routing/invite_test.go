@@ -0,0 +1,124 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+type inviteTestRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	invites []*api.PerformInviteRequest
+}
+
+func (r *inviteTestRoomserverAPI) PerformInvite(
+	ctx context.Context,
+	req *api.PerformInviteRequest,
+	res *api.PerformInviteResponse,
+) error {
+	r.invites = append(r.invites, req)
+	return nil
+}
+
+func TestInviteKeepsReason(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	rsAPI := &inviteTestRoomserverAPI{}
+	roomID := "!roomid:white.orchard"
+	userID := "@userid:kaer.morhen"
+	invite := mustCreateEvent(t, key, roomID, "@inviter:white.orchard", &userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Invite,
+		"reason":     "Come and help with the contract",
+	})
+	strippedState := []gomatrixserverlib.InviteV2StrippedState{
+		gomatrixserverlib.NewInviteV2StrippedState(invite),
+	}
+
+	res := processInvite(
+		context.Background(), true, invite, testRoomVersion, strippedState,
+		roomID, invite.EventID(), cfg, rsAPI, &leaveTestKeyRing{},
+	)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+	if len(rsAPI.invites) != 1 {
+		t.Fatalf("expected 1 invite to be passed to the roomserver, got %d", len(rsAPI.invites))
+	}
+	got := rsAPI.invites[0]
+	if reason := gjson.GetBytes(got.Event.Content(), "reason").Str; reason != "Come and help with the contract" {
+		t.Errorf("expected reason to be kept in the invite event, got %q", reason)
+	}
+	if len(got.InviteRoomState) != 1 {
+		t.Fatalf("expected invite room state to be passed to the roomserver")
+	}
+	if reason := gjson.GetBytes(got.InviteRoomState[0].Content(), "reason").Str; reason != "Come and help with the contract" {
+		t.Errorf("expected reason to be kept in the stripped state, got %q", reason)
+	}
+}
+
+func TestInviteIncompatibleRoomVersion(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	rsAPI := &inviteTestRoomserverAPI{}
+	roomID := "!roomid:white.orchard"
+	userID := "@userid:kaer.morhen"
+	invite := mustCreateEvent(t, key, roomID, "@inviter:white.orchard", &userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Invite,
+	})
+
+	// A room version that gomatrixserverlib doesn't know about at all.
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		"PUT", testOrigin, "/_matrix/federation/v2/invite/"+roomID+"/"+invite.EventID(),
+	)
+	if err = fedReq.SetContent(map[string]interface{}{
+		"event":        json.RawMessage(invite.JSON()),
+		"room_version": "unsupported",
+	}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	res := InviteV2(
+		httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+		roomID, invite.EventID(), cfg, rsAPI, &leaveTestKeyRing{},
+	)
+	if res.Code != http.StatusBadRequest || errCode(t, res) != "M_INCOMPATIBLE_ROOM_VERSION" {
+		t.Errorf("unknown room version: expected M_INCOMPATIBLE_ROOM_VERSION, got %d: %+v", res.Code, res.JSON)
+	}
+
+	// processInvite checks the room version itself as well.
+	res = processInvite(
+		context.Background(), true, invite, "unsupported", nil,
+		roomID, invite.EventID(), cfg, rsAPI, &leaveTestKeyRing{},
+	)
+	if res.Code != http.StatusBadRequest || errCode(t, res) != "M_INCOMPATIBLE_ROOM_VERSION" {
+		t.Errorf("unsupported room version: expected M_INCOMPATIBLE_ROOM_VERSION, got %d: %+v", res.Code, res.JSON)
+	}
+	if len(rsAPI.invites) != 0 {
+		t.Errorf("expected no invites to be passed to the roomserver, got %d", len(rsAPI.invites))
+	}
+}
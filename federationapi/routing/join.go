@@ -38,13 +38,36 @@ func MakeJoin(
 	roomID, userID string,
 	remoteVersions []gomatrixserverlib.RoomVersion,
 ) util.JSONResponse {
+	// Check if we think we are still joined to the room. This has to happen
+	// before anything else, as we don't know the room version of rooms that
+	// we have never been in.
+	inRoomReq := &api.QueryServerJoinedToRoomRequest{
+		ServerName: cfg.Matrix.ServerName,
+		RoomID:     roomID,
+	}
+	inRoomRes := &api.QueryServerJoinedToRoomResponse{}
+	if err := rsAPI.QueryServerJoinedToRoom(httpReq.Context(), inRoomReq, inRoomRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !inRoomRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
+		}
+	}
+	if !inRoomRes.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q has no remaining users on this server", roomID)),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: jsonerror.InternalServerError(),
-		}
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
+		return jsonerror.InternalServerError()
 	}
 
 	// Check that the room that the remote side is trying to join is actually
@@ -80,29 +103,6 @@ func MakeJoin(
 		}
 	}
 
-	// Check if we think we are still joined to the room
-	inRoomReq := &api.QueryServerJoinedToRoomRequest{
-		ServerName: cfg.Matrix.ServerName,
-		RoomID:     roomID,
-	}
-	inRoomRes := &api.QueryServerJoinedToRoomResponse{}
-	if err = rsAPI.QueryServerJoinedToRoom(httpReq.Context(), inRoomReq, inRoomRes); err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
-		return jsonerror.InternalServerError()
-	}
-	if !inRoomRes.RoomExists {
-		return util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
-		}
-	}
-	if !inRoomRes.IsInRoom {
-		return util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q has no remaining users on this server", roomID)),
-		}
-	}
-
 	// Try building an event for the server
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -120,7 +120,7 @@ func MakeJoin(
 		RoomVersion: verRes.RoomVersion,
 	}
 	event, err := eventutil.QueryAndBuildEvent(httpReq.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
-	if err == eventutil.ErrRoomNoExists {
+	if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Room does not exist"),
@@ -161,6 +161,8 @@ func MakeJoin(
 // SendJoin implements the /send_join API
 // The make-join send-join dance makes much more sense as a single
 // flow so the cyclomatic complexity is high:
+// If partialState is true then the membership events are left out of the
+// state in the response, as the requesting server asked for with MSC3706.
 func SendJoin(
 	httpReq *http.Request,
 	request *gomatrixserverlib.FederationRequest,
@@ -168,23 +170,32 @@ func SendJoin(
 	rsAPI api.RoomserverInternalAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	roomID, eventID string,
+	partialState bool,
 ) util.JSONResponse {
+	// We don't know the room version of rooms that we have never been in.
+	joinedReq := api.QueryServerJoinedToRoomRequest{RoomID: roomID}
+	joinedRes := api.QueryServerJoinedToRoomResponse{}
+	if err := rsAPI.QueryServerJoinedToRoom(httpReq.Context(), &joinedReq, &joinedRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !joinedRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: jsonerror.InternalServerError(),
-		}
+		return jsonerror.InternalServerError()
 	}
 
-	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), verRes.RoomVersion)
+	event, err := parseInboundPDU(request.Content(), verRes.RoomVersion)
 	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
-		}
+		return inboundPDUErrorResponse(err)
 	}
 
 	// Check that a state key is provided.
@@ -328,7 +339,7 @@ func SendJoin(
 			util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).Error("SendEvents failed")
 			if response.NotAllowed {
 				return util.JSONResponse{
-					Code: http.StatusBadRequest,
+					Code: http.StatusForbidden,
 					JSON: jsonerror.Forbidden(response.ErrMsg),
 				}
 			}
@@ -342,6 +353,22 @@ func SendJoin(
 	sort.Sort(eventsByDepth(stateAndAuthChainResponse.StateEvents))
 	sort.Sort(eventsByDepth(stateAndAuthChainResponse.AuthChainEvents))
 
+	if partialState {
+		stateEvents, authChainEvents, serversInRoom := omitMembersFromSendJoin(
+			stateAndAuthChainResponse.StateEvents, stateAndAuthChainResponse.AuthChainEvents, *event.StateKey(),
+		)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: respSendJoinPartialState{
+				StateEvents:   gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				AuthEvents:    gomatrixserverlib.UnwrapEventHeaders(authChainEvents),
+				Origin:        cfg.Matrix.ServerName,
+				PartialState:  true,
+				ServersInRoom: serversInRoom,
+			},
+		}
+	}
+
 	// https://matrix.org/docs/spec/server_server/latest#put-matrix-federation-v1-send-join-roomid-eventid
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -353,6 +380,60 @@ func SendJoin(
 	}
 }
 
+// respSendJoinPartialState is the response to /send_join when the requesting
+// server asked for partial state. The membership events are left out of the
+// state, so the server can start using the room sooner and fetch the rest of
+// the state afterwards, from the servers in servers_in_room.
+// https://github.com/matrix-org/matrix-doc/pull/3706
+type respSendJoinPartialState struct {
+	StateEvents   []*gomatrixserverlib.Event     `json:"state"`
+	AuthEvents    []*gomatrixserverlib.Event     `json:"auth_chain"`
+	Origin        gomatrixserverlib.ServerName   `json:"origin"`
+	PartialState  bool                           `json:"org.matrix.msc3706.partial_state"`
+	ServersInRoom []gomatrixserverlib.ServerName `json:"org.matrix.msc3706.servers_in_room"`
+}
+
+// omitMembersFromSendJoin returns the state without any membership events
+// other than that of the joining user, and the auth chain without any events
+// which are already in the returned state. Membership events which are needed
+// to authenticate the rest of the state are still in the auth chain. It also
+// returns the servers which had joined users in the full state.
+func omitMembersFromSendJoin(
+	stateEvents, authChainEvents []*gomatrixserverlib.HeaderedEvent, userID string,
+) ([]*gomatrixserverlib.HeaderedEvent, []*gomatrixserverlib.HeaderedEvent, []gomatrixserverlib.ServerName) {
+	partialState := make([]*gomatrixserverlib.HeaderedEvent, 0, len(stateEvents))
+	inState := make(map[string]struct{}, len(stateEvents))
+	serversInRoom := []gomatrixserverlib.ServerName{}
+	seenServers := map[gomatrixserverlib.ServerName]struct{}{}
+	for _, ev := range stateEvents {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Join {
+				if _, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey()); err == nil {
+					if _, ok := seenServers[domain]; !ok {
+						seenServers[domain] = struct{}{}
+						serversInRoom = append(serversInRoom, domain)
+					}
+				}
+			}
+			if !ev.StateKeyEquals(userID) {
+				continue
+			}
+		}
+		partialState = append(partialState, ev)
+		inState[ev.EventID()] = struct{}{}
+	}
+	partialAuthChain := make([]*gomatrixserverlib.HeaderedEvent, 0, len(authChainEvents))
+	for _, ev := range authChainEvents {
+		if _, ok := inState[ev.EventID()]; !ok {
+			partialAuthChain = append(partialAuthChain, ev)
+		}
+	}
+	sort.Slice(serversInRoom, func(i, j int) bool {
+		return serversInRoom[i] < serversInRoom[j]
+	})
+	return partialState, partialAuthChain, serversInRoom
+}
+
 type eventsByDepth []*gomatrixserverlib.HeaderedEvent
 
 func (e eventsByDepth) Len() int {
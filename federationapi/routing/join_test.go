@@ -0,0 +1,262 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// errCode returns the Matrix error code in the body of the response.
+func errCode(t *testing.T, res util.JSONResponse) string {
+	t.Helper()
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	return gjson.GetBytes(body, "errcode").Str
+}
+
+func TestMakeJoinErrorCodes(t *testing.T) {
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	tests := []struct {
+		name           string
+		rsAPI          *leaveTestRoomserverAPI
+		remoteVersions []gomatrixserverlib.RoomVersion
+		wantCode       int
+		wantErrCode    string
+	}{
+		{
+			name:           "unknown room",
+			rsAPI:          &leaveTestRoomserverAPI{unknownRoom: true},
+			remoteVersions: []gomatrixserverlib.RoomVersion{testRoomVersion},
+			wantCode:       http.StatusNotFound,
+			wantErrCode:    "M_NOT_FOUND",
+		},
+		{
+			name:           "not in room",
+			rsAPI:          &leaveTestRoomserverAPI{notInRoom: true},
+			remoteVersions: []gomatrixserverlib.RoomVersion{testRoomVersion},
+			wantCode:       http.StatusNotFound,
+			wantErrCode:    "M_NOT_FOUND",
+		},
+		{
+			name:           "incompatible room version",
+			rsAPI:          &leaveTestRoomserverAPI{},
+			remoteVersions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV6},
+			wantCode:       http.StatusBadRequest,
+			wantErrCode:    "M_INCOMPATIBLE_ROOM_VERSION",
+		},
+		{
+			name:           "room version query failed",
+			rsAPI:          &leaveTestRoomserverAPI{roomVersionErr: errors.New("database is on fire")},
+			remoteVersions: []gomatrixserverlib.RoomVersion{testRoomVersion},
+			wantCode:       http.StatusInternalServerError,
+			wantErrCode:    "M_UNKNOWN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fedReq := gomatrixserverlib.NewFederationRequest(
+				"GET", testOrigin, "/_matrix/federation/v1/make_join/"+roomID+"/"+userID,
+			)
+			res := MakeJoin(
+				httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq,
+				cfg, tt.rsAPI, roomID, userID, tt.remoteVersions,
+			)
+			if res.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if got := errCode(t, res); got != tt.wantErrCode {
+				t.Errorf("expected errcode %s, got %s", tt.wantErrCode, got)
+			}
+		})
+	}
+}
+
+func TestSendJoinErrorCodes(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	join := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join)
+	tests := []struct {
+		name        string
+		rsAPI       *leaveTestRoomserverAPI
+		wantCode    int
+		wantErrCode string
+	}{
+		{
+			name:        "unknown room",
+			rsAPI:       &leaveTestRoomserverAPI{unknownRoom: true},
+			wantCode:    http.StatusNotFound,
+			wantErrCode: "M_NOT_FOUND",
+		},
+		{
+			name:        "unsupported room version",
+			rsAPI:       &leaveTestRoomserverAPI{roomVersion: "unsupported"},
+			wantCode:    http.StatusBadRequest,
+			wantErrCode: "M_UNSUPPORTED_ROOM_VERSION",
+		},
+		{
+			name:        "room version query failed",
+			rsAPI:       &leaveTestRoomserverAPI{roomVersionErr: errors.New("database is on fire")},
+			wantCode:    http.StatusInternalServerError,
+			wantErrCode: "M_UNKNOWN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fedReq := gomatrixserverlib.NewFederationRequest(
+				"PUT", testOrigin, "/_matrix/federation/v2/send_join/"+roomID+"/"+join.EventID(),
+			)
+			if err = fedReq.SetContent(json.RawMessage(join.JSON())); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+			res := SendJoin(
+				httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+				cfg, tt.rsAPI, &leaveTestKeyRing{}, roomID, join.EventID(), false,
+			)
+			if res.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if got := errCode(t, res); got != tt.wantErrCode {
+				t.Errorf("expected errcode %s, got %s", tt.wantErrCode, got)
+			}
+		})
+	}
+}
+
+type sendJoinTestRoomserverAPI struct {
+	*leaveTestRoomserverAPI
+	authChain []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *sendJoinTestRoomserverAPI) QueryStateAndAuthChain(
+	ctx context.Context,
+	req *api.QueryStateAndAuthChainRequest,
+	res *api.QueryStateAndAuthChainResponse,
+) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.RoomVersion = r.roomVersion
+	res.StateEvents = r.extraState
+	res.AuthChainEvents = r.authChain
+	return nil
+}
+
+func TestSendJoinPartialState(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	// create, the creator's join, join rules and name
+	state := knockTestRoomState(t, key, roomID, gomatrixserverlib.Public)
+	state = append(state,
+		mustCreateKnockTestEvent(t, key, testDestination, roomID, "@bob:white.orchard", gomatrixserverlib.MRoomMember, "@bob:white.orchard", map[string]interface{}{
+			"membership": gomatrixserverlib.Join,
+		}),
+		mustCreateKnockTestEvent(t, key, "other.server", roomID, "@carol:other.server", gomatrixserverlib.MRoomMember, "@carol:other.server", map[string]interface{}{
+			"membership": gomatrixserverlib.Leave,
+		}),
+		mustCreateKnockTestEvent(t, key, testOrigin, roomID, "@creator:kaer.morhen", gomatrixserverlib.MRoomMember, userID, map[string]interface{}{
+			"membership": gomatrixserverlib.Invite,
+		}),
+	)
+	create, creatorJoin := state[0], state[1]
+	join := mustCreateKnockTestEvent(t, key, testDestination, roomID, userID, gomatrixserverlib.MRoomMember, userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	})
+
+	sendJoin := func(partialState bool) util.JSONResponse {
+		rsAPI := &sendJoinTestRoomserverAPI{
+			leaveTestRoomserverAPI: &leaveTestRoomserverAPI{
+				roomVersion: gomatrixserverlib.RoomVersionV7,
+				extraState:  state,
+			},
+			authChain: []*gomatrixserverlib.HeaderedEvent{create, creatorJoin},
+		}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_join/"+roomID+"/"+join.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(join.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendJoin(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, roomID, join.EventID(), partialState,
+		)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+		}
+		return res
+	}
+	eventIDs := func(events []*gomatrixserverlib.Event) []string {
+		ids := make([]string, len(events))
+		for i, ev := range events {
+			ids[i] = ev.EventID()
+		}
+		return ids
+	}
+
+	full, ok := sendJoin(false).JSON.(gomatrixserverlib.RespSendJoin)
+	if !ok {
+		t.Fatalf("expected a full send_join response")
+	}
+	if len(full.StateEvents) != len(state) || len(full.AuthEvents) != 2 {
+		t.Errorf("expected full state and auth chain, got %d state and %d auth events", len(full.StateEvents), len(full.AuthEvents))
+	}
+
+	partial, ok := sendJoin(true).JSON.(respSendJoinPartialState)
+	if !ok {
+		t.Fatalf("expected a partial state send_join response")
+	}
+	// Only the joining user's membership is left in the state.
+	wantState := []string{state[0].EventID(), state[2].EventID(), state[3].EventID(), state[6].EventID()}
+	if got := eventIDs(partial.StateEvents); !reflect.DeepEqual(got, wantState) {
+		t.Errorf("expected state %v, got %v", wantState, got)
+	}
+	// The create event is already in the state, but the creator's join is
+	// still needed to authenticate it.
+	wantAuthChain := []string{creatorJoin.EventID()}
+	if got := eventIDs(partial.AuthEvents); !reflect.DeepEqual(got, wantAuthChain) {
+		t.Errorf("expected auth chain %v, got %v", wantAuthChain, got)
+	}
+	wantServers := []gomatrixserverlib.ServerName{testOrigin, testDestination}
+	if !partial.PartialState || !reflect.DeepEqual(partial.ServersInRoom, wantServers) {
+		t.Errorf("expected partial state with servers %v, got %v with servers %v", wantServers, partial.PartialState, partial.ServersInRoom)
+	}
+}
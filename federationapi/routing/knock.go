@@ -0,0 +1,339 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// knockRoomStateTypes are the types of the state events which are sent back
+// in the response to /send_knock, so that the knocking user's server can show
+// them something about the room they have knocked on.
+// https://github.com/matrix-org/matrix-doc/pull/2403
+var knockRoomStateTypes = []string{
+	gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias,
+	gomatrixserverlib.MRoomAvatar, gomatrixserverlib.MRoomEncryption,
+}
+
+// MakeKnockResponse is the response body of the /make_knock API.
+type MakeKnockResponse struct {
+	Event       gomatrixserverlib.EventBuilder `json:"event"`
+	RoomVersion gomatrixserverlib.RoomVersion  `json:"room_version"`
+}
+
+// SendKnockResponse is the response body of the /send_knock API. It has the
+// stripped state of the room, so that the knocking user's server can show
+// them something about the room they have knocked on.
+type SendKnockResponse struct {
+	KnockStateEvents []gomatrixserverlib.InviteV2StrippedState `json:"knock_state_events"`
+}
+
+// knockingNotSupportedResponse returns the response for a knock on a room
+// whose room version doesn't support knocking, i.e. versions before 7.
+func knockingNotSupportedResponse(roomVersion gomatrixserverlib.RoomVersion) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden(fmt.Sprintf("Room version %q does not support knocking", roomVersion)),
+	}
+}
+
+// queryKnockRoomVersion checks that the room exists and that this server is
+// still in it, and returns the room version if it supports knocking. If not
+// then it returns a response to send instead.
+func queryKnockRoomVersion(
+	httpReq *http.Request,
+	cfg *config.FederationAPI,
+	rsAPI api.RoomserverInternalAPI,
+	roomID string,
+) (gomatrixserverlib.RoomVersion, *util.JSONResponse) {
+	// We don't know the room version of rooms that we have never been in.
+	inRoomReq := &api.QueryServerJoinedToRoomRequest{
+		ServerName: cfg.Matrix.ServerName,
+		RoomID:     roomID,
+	}
+	inRoomRes := &api.QueryServerJoinedToRoomResponse{}
+	if err := rsAPI.QueryServerJoinedToRoom(httpReq.Context(), inRoomReq, inRoomRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		res := jsonerror.InternalServerError()
+		return "", &res
+	}
+	if !inRoomRes.RoomExists {
+		return "", &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
+		}
+	}
+	if !inRoomRes.IsInRoom {
+		return "", &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q has no remaining users on this server", roomID)),
+		}
+	}
+
+	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
+	verRes := api.QueryRoomVersionForRoomResponse{}
+	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
+		res := jsonerror.InternalServerError()
+		return "", &res
+	}
+	if allowed, err := verRes.RoomVersion.AllowKnockingInEventAuth(); err != nil || !allowed {
+		res := knockingNotSupportedResponse(verRes.RoomVersion)
+		return "", &res
+	}
+	return verRes.RoomVersion, nil
+}
+
+// MakeKnock implements the /make_knock API. The caller must check that the
+// user belongs to the origin server.
+func MakeKnock(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.RoomserverInternalAPI,
+	roomID, userID string,
+	remoteVersions []gomatrixserverlib.RoomVersion,
+) util.JSONResponse {
+	roomVersion, errRes := queryKnockRoomVersion(httpReq, cfg, rsAPI, roomID)
+	if errRes != nil {
+		return *errRes
+	}
+
+	// Check that the room that the remote side is trying to knock on is one
+	// of the room versions that they listed in their supported ?ver= in the
+	// make_knock URL.
+	remoteSupportsVersion := false
+	for _, v := range remoteVersions {
+		if v == roomVersion {
+			remoteSupportsVersion = true
+			break
+		}
+	}
+	if !remoteSupportsVersion {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.IncompatibleRoomVersion(roomVersion),
+		}
+	}
+
+	// Try building an event for the server
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     "m.room.member",
+		StateKey: &userID,
+	}
+	err := builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Knock})
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("builder.SetContent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	queryRes := api.QueryLatestEventsAndStateResponse{
+		RoomVersion: roomVersion,
+	}
+	event, err := eventutil.QueryAndBuildEvent(httpReq.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
+	if err == eventutil.ErrRoomNoExists || err == eventutil.ErrRoomPurged {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if e, ok := err.(gomatrixserverlib.BadJSONError); ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(e.Error()),
+		}
+	} else if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("eventutil.BuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Check that the knock is allowed, e.g. that the join rules are knock
+	// and that the user isn't already in the room or banned from it.
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = queryRes.StateEvents[i].Event
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(event.Event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: MakeKnockResponse{
+			Event:       builder,
+			RoomVersion: roomVersion,
+		},
+	}
+}
+
+// SendKnock implements the /send_knock API
+func SendKnock(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.RoomserverInternalAPI,
+	keys gomatrixserverlib.JSONVerifier,
+	roomID, eventID string,
+) util.JSONResponse {
+	if emptyRes := checkRequestBodyNotEmpty(request.Content()); emptyRes != nil {
+		return *emptyRes
+	}
+
+	roomVersion, errRes := queryKnockRoomVersion(httpReq, cfg, rsAPI, roomID)
+	if errRes != nil {
+		return *errRes
+	}
+
+	event, err := parseInboundPDU(request.Content(), roomVersion)
+	if err != nil {
+		return inboundPDUErrorResponse(err)
+	}
+	if err = checkInboundPDUFormat(event, roomVersion); err != nil {
+		return inboundPDUErrorResponse(err)
+	}
+
+	// Check that the room ID is correct.
+	if event.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the knock event JSON"),
+		}
+	}
+
+	// Check that the event ID is correct.
+	if event.EventID() != eventID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the knock event JSON"),
+		}
+	}
+
+	// Check that this is a knock by the sender on their own behalf.
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil || !event.StateKeyEquals(event.Sender()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The state key of the knock event must be the sender"),
+		}
+	}
+	membership, err := event.Membership()
+	if err != nil || membership != gomatrixserverlib.Knock {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The membership in the event content must be set to knock"),
+		}
+	}
+
+	// Check that the event is from the server sending the request, and that
+	// the user is from there too.
+	_, senderDomain, err := validateUserID(event.Sender())
+	if err != nil {
+		return invalidUserIDResponse(err)
+	}
+	if event.Origin() != request.Origin() || senderDomain != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The knock must be sent by the server of the user"),
+		}
+	}
+
+	// Check that the event is signed by the server sending the request.
+	redacted := event.Redact()
+	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName:             event.Origin(),
+		Message:                redacted.JSON(),
+		AtTS:                   event.OriginServerTS(),
+		StrictValidityChecking: cfg.StrictKeyValidity,
+	}}
+	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("keys.VerifyJSONs failed")
+		return jsonerror.InternalServerError()
+	}
+	if verifyResults[0].Error != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The knock must be signed by the server it originated on"),
+		}
+	}
+
+	// Send the event to the room server. We are responsible for sending it
+	// on to the other servers in the room, so set SendAsServer.
+	var response api.InputRoomEventsResponse
+	rsAPI.InputRoomEvents(httpReq.Context(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event.Headered(roomVersion),
+				AuthEventIDs: event.AuthEventIDs(),
+				SendAsServer: string(cfg.Matrix.ServerName),
+			},
+		},
+	}, &response)
+	if response.ErrMsg != "" {
+		util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).Error("SendEvents failed")
+		if response.NotAllowed {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(response.ErrMsg),
+			}
+		}
+		return jsonerror.InternalServerError()
+	}
+
+	// Tell the knocking server about the room, so that it can show the
+	// knock to the user.
+	stateTuples := make([]gomatrixserverlib.StateKeyTuple, len(knockRoomStateTypes))
+	for i, eventType := range knockRoomStateTypes {
+		stateTuples[i] = gomatrixserverlib.StateKeyTuple{EventType: eventType}
+	}
+	var stateRes api.QueryCurrentStateResponse
+	if err = rsAPI.QueryCurrentState(httpReq.Context(), &api.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: stateTuples,
+	}, &stateRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryCurrentState failed")
+		return jsonerror.InternalServerError()
+	}
+	knockState := []gomatrixserverlib.InviteV2StrippedState{}
+	for _, tuple := range stateTuples {
+		if ev, ok := stateRes.StateEvents[tuple]; ok && ev != nil {
+			knockState = append(knockState, gomatrixserverlib.NewInviteV2StrippedState(ev.Event))
+		}
+	}
+
+	// https://github.com/matrix-org/matrix-doc/pull/2403
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: SendKnockResponse{
+			KnockStateEvents: knockState,
+		},
+	}
+}
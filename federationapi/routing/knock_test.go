@@ -0,0 +1,376 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type knockTestRoomserverAPI struct {
+	*leaveTestRoomserverAPI
+}
+
+func (r *knockTestRoomserverAPI) QueryCurrentState(
+	ctx context.Context,
+	req *api.QueryCurrentStateRequest,
+	res *api.QueryCurrentStateResponse,
+) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, tuple := range req.StateTuples {
+		for _, ev := range r.extraState {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents[tuple] = ev
+			}
+		}
+	}
+	return nil
+}
+
+func mustCreateKnockTestEvent(
+	t *testing.T, key ed25519.PrivateKey, origin gomatrixserverlib.ServerName,
+	roomID, sender, eventType, stateKey string, content map[string]interface{},
+) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   roomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), origin, "ed25519:test", key, gomatrixserverlib.RoomVersionV7)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV7)
+}
+
+// knockTestRoomState returns the state of a room created on testOrigin with
+// the given join rule.
+func knockTestRoomState(t *testing.T, key ed25519.PrivateKey, roomID, joinRule string) []*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	creator := "@creator:kaer.morhen"
+	return []*gomatrixserverlib.HeaderedEvent{
+		mustCreateKnockTestEvent(t, key, testOrigin, roomID, creator, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+			"creator": creator, "room_version": gomatrixserverlib.RoomVersionV7,
+		}),
+		mustCreateKnockTestEvent(t, key, testOrigin, roomID, creator, gomatrixserverlib.MRoomMember, creator, map[string]interface{}{
+			"membership": gomatrixserverlib.Join,
+		}),
+		mustCreateKnockTestEvent(t, key, testOrigin, roomID, creator, gomatrixserverlib.MRoomJoinRules, "", map[string]interface{}{
+			"join_rule": joinRule,
+		}),
+		mustCreateKnockTestEvent(t, key, testOrigin, roomID, creator, gomatrixserverlib.MRoomName, "", map[string]interface{}{
+			"name": "Knock knock",
+		}),
+	}
+}
+
+func TestMakeKnock(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	v7 := []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV7}
+	tests := []struct {
+		name           string
+		rsAPI          *leaveTestRoomserverAPI
+		remoteVersions []gomatrixserverlib.RoomVersion
+		wantCode       int
+		wantErrCode    string
+	}{
+		{
+			name: "allowed",
+			rsAPI: &leaveTestRoomserverAPI{
+				roomVersion: gomatrixserverlib.RoomVersionV7,
+				extraState:  knockTestRoomState(t, key, roomID, gomatrixserverlib.Knock),
+			},
+			remoteVersions: v7,
+			wantCode:       http.StatusOK,
+		},
+		{
+			name:           "unknown room",
+			rsAPI:          &leaveTestRoomserverAPI{unknownRoom: true},
+			remoteVersions: v7,
+			wantCode:       http.StatusNotFound,
+			wantErrCode:    "M_NOT_FOUND",
+		},
+		{
+			name:           "room version without knocking",
+			rsAPI:          &leaveTestRoomserverAPI{roomVersion: gomatrixserverlib.RoomVersionV6},
+			remoteVersions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV6},
+			wantCode:       http.StatusForbidden,
+			wantErrCode:    "M_FORBIDDEN",
+		},
+		{
+			name:           "incompatible room version",
+			rsAPI:          &leaveTestRoomserverAPI{roomVersion: gomatrixserverlib.RoomVersionV7},
+			remoteVersions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV6},
+			wantCode:       http.StatusBadRequest,
+			wantErrCode:    "M_INCOMPATIBLE_ROOM_VERSION",
+		},
+		{
+			name: "room isn't knockable",
+			rsAPI: &leaveTestRoomserverAPI{
+				roomVersion: gomatrixserverlib.RoomVersionV7,
+				extraState:  knockTestRoomState(t, key, roomID, gomatrixserverlib.Invite),
+			},
+			remoteVersions: v7,
+			wantCode:       http.StatusForbidden,
+			wantErrCode:    "M_FORBIDDEN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fedReq := gomatrixserverlib.NewFederationRequest(
+				"GET", testOrigin, "/_matrix/federation/v1/make_knock/"+roomID+"/"+userID,
+			)
+			res := MakeKnock(
+				httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq,
+				cfg, tt.rsAPI, roomID, userID, tt.remoteVersions,
+			)
+			if res.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if tt.wantErrCode != "" {
+				if got := errCode(t, res); got != tt.wantErrCode {
+					t.Errorf("expected errcode %s, got %s", tt.wantErrCode, got)
+				}
+				return
+			}
+			body := res.JSON.(MakeKnockResponse)
+			if body.RoomVersion != gomatrixserverlib.RoomVersionV7 {
+				t.Errorf("expected room version %s, got %v", gomatrixserverlib.RoomVersionV7, body.RoomVersion)
+			}
+			builder := body.Event
+			var content struct {
+				Membership string `json:"membership"`
+			}
+			if err := json.Unmarshal(builder.Content, &content); err != nil {
+				t.Fatalf("failed to unmarshal content: %s", err)
+			}
+			if content.Membership != gomatrixserverlib.Knock || builder.Sender != userID || *builder.StateKey != userID {
+				t.Errorf("expected a knock by %s, got %+v", userID, builder)
+			}
+		})
+	}
+}
+
+func TestSendKnock(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	state := knockTestRoomState(t, key, roomID, gomatrixserverlib.Knock)
+	knock := mustCreateKnockTestEvent(t, key, testDestination, roomID, userID, gomatrixserverlib.MRoomMember, userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Knock,
+	})
+	join := mustCreateKnockTestEvent(t, key, testDestination, roomID, userID, gomatrixserverlib.MRoomMember, userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	})
+	otherUser := mustCreateKnockTestEvent(t, key, testDestination, roomID, "@userid:kaer.morhen", gomatrixserverlib.MRoomMember, "@userid:kaer.morhen", map[string]interface{}{
+		"membership": gomatrixserverlib.Knock,
+	})
+	tests := []struct {
+		name        string
+		roomVersion gomatrixserverlib.RoomVersion
+		event       *gomatrixserverlib.HeaderedEvent
+		eventID     string
+		keys        gomatrixserverlib.JSONVerifier
+		wantCode    int
+		wantErrCode string
+	}{
+		{
+			name:     "allowed",
+			event:    knock,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:        "room version without knocking",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			event:       knock,
+			wantCode:    http.StatusForbidden,
+			wantErrCode: "M_FORBIDDEN",
+		},
+		{
+			name:        "wrong event ID",
+			event:       knock,
+			eventID:     join.EventID(),
+			wantCode:    http.StatusBadRequest,
+			wantErrCode: "M_BAD_JSON",
+		},
+		{
+			name:        "not a knock",
+			event:       join,
+			wantCode:    http.StatusBadRequest,
+			wantErrCode: "M_BAD_JSON",
+		},
+		{
+			name:        "user on another server",
+			event:       otherUser,
+			wantCode:    http.StatusForbidden,
+			wantErrCode: "M_FORBIDDEN",
+		},
+		{
+			name:        "bad signature",
+			event:       knock,
+			keys:        &failingKeyRing{verifyErr: errors.New("bad signature")},
+			wantCode:    http.StatusForbidden,
+			wantErrCode: "M_FORBIDDEN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomVersion := gomatrixserverlib.RoomVersionV7
+			if tt.roomVersion != "" {
+				roomVersion = tt.roomVersion
+			}
+			rsAPI := &knockTestRoomserverAPI{&leaveTestRoomserverAPI{
+				roomVersion: roomVersion,
+				extraState:  state,
+			}}
+			eventID := tt.event.EventID()
+			if tt.eventID != "" {
+				eventID = tt.eventID
+			}
+			keys := tt.keys
+			if keys == nil {
+				keys = &leaveTestKeyRing{}
+			}
+			fedReq := gomatrixserverlib.NewFederationRequest(
+				"PUT", testOrigin, "/_matrix/federation/v1/send_knock/"+roomID+"/"+eventID,
+			)
+			if err = fedReq.SetContent(json.RawMessage(tt.event.JSON())); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+			if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+				t.Fatalf("failed to sign request: %s", err)
+			}
+			res := SendKnock(
+				httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+				cfg, rsAPI, keys, roomID, eventID,
+			)
+			if res.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if tt.wantErrCode != "" {
+				if got := errCode(t, res); got != tt.wantErrCode {
+					t.Errorf("expected errcode %s, got %s", tt.wantErrCode, got)
+				}
+				if len(rsAPI.inputRoomEvents) != 0 {
+					t.Errorf("expected rejected knock not to be sent to the roomserver")
+				}
+				return
+			}
+
+			if len(rsAPI.inputRoomEvents) != 1 {
+				t.Fatalf("expected 1 event to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+			}
+			input := rsAPI.inputRoomEvents[0]
+			if input.Kind != api.KindNew || input.Event.EventID() != knock.EventID() || input.SendAsServer != string(testOrigin) {
+				t.Errorf("expected knock to be sent to the roomserver as a new event, got %+v", input)
+			}
+
+			// The response has the stripped state of the room, but not
+			// anything else like the creator's membership.
+			knockState := res.JSON.(SendKnockResponse).KnockStateEvents
+			gotTypes := map[string]bool{}
+			for _, ev := range knockState {
+				gotTypes[ev.Type()] = true
+			}
+			for _, eventType := range []string{gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomJoinRules, gomatrixserverlib.MRoomName} {
+				if !gotTypes[eventType] {
+					t.Errorf("expected knock state to include %s, got %v", eventType, gotTypes)
+				}
+			}
+			if len(knockState) != 3 {
+				t.Errorf("expected 3 knock state events, got %d", len(knockState))
+			}
+		})
+	}
+}
+
+// strictRecordingKeyRing records whether signatures were verified with strict
+// key validity checking.
+type strictRecordingKeyRing struct {
+	strict []bool
+}
+
+func (k *strictRecordingKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	for _, req := range reqs {
+		k.strict = append(k.strict, req.StrictValidityChecking)
+	}
+	return make([]gomatrixserverlib.VerifyJSONResult, len(reqs)), nil
+}
+
+func TestSendKnockStrictKeyValidity(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	state := knockTestRoomState(t, key, roomID, gomatrixserverlib.Knock)
+	knock := mustCreateKnockTestEvent(t, key, testDestination, roomID, userID, gomatrixserverlib.MRoomMember, userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Knock,
+	})
+	for _, strict := range []bool{true, false} {
+		cfg := &config.FederationAPI{
+			Matrix: &config.Global{
+				ServerName: testOrigin,
+			},
+			StrictKeyValidity: strict,
+		}
+		rsAPI := &knockTestRoomserverAPI{&leaveTestRoomserverAPI{
+			roomVersion: gomatrixserverlib.RoomVersionV7,
+			extraState:  state,
+		}}
+		keys := &strictRecordingKeyRing{}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v1/send_knock/"+roomID+"/"+knock.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(knock.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendKnock(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, keys, roomID, knock.EventID(),
+		)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+		}
+		if len(keys.strict) != 1 || keys.strict[0] != strict {
+			t.Errorf("expected knock to be verified with strict key validity %v, got %v", strict, keys.strict)
+		}
+	}
+}
@@ -13,7 +13,14 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -22,29 +29,115 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
-// MakeLeave implements the /make_leave API
+// sendEventsInitialBackoff is how long to wait before the first retry
+// when the roomserver fails to process a leave event.
+const sendEventsInitialBackoff = time.Millisecond * 250
+
+var sendLeaveRetriesTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "send_leave_retries",
+		Help:      "Number of times that sending a leave event to the roomserver was retried",
+	},
+)
+
+// leaveOutcomesTotal counts federated leave requests by endpoint, bucketed
+// origin and outcome, so that spikes in rejections can be alerted on.
+var leaveOutcomesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "leave_outcomes",
+		Help:      "Number of federated make_leave and send_leave requests by outcome",
+	},
+	[]string{"endpoint", "origin", "outcome"},
+)
+
+// leaveOriginBuckets is the number of buckets that origins are hashed into
+// for leaveOutcomesTotal, which bounds the cardinality of the origin label.
+const leaveOriginBuckets = 32
+
+func init() {
+	prometheus.MustRegister(sendLeaveRetriesTotal, leaveOutcomesTotal)
+}
+
+// MakeLeaveResponse is the response body of the /make_leave API.
+type MakeLeaveResponse struct {
+	// Event is the leave event template, as a gomatrixserverlib.EventBuilder,
+	// or the user's existing *gomatrixserverlib.HeaderedEvent leave event if
+	// they have already left the room.
+	Event       interface{}                   `json:"event"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// AuthChain is only set when debugging was requested, see debugAuthChain.
+	AuthChain []DebugAuthEvent `json:"org.matrix.dendrite.debug_auth_chain,omitempty"`
+}
+
+// DebugAuthEvent describes a state event that a leave was checked against.
+// The content is left out to keep the response small.
+type DebugAuthEvent struct {
+	EventID  string `json:"event_id"`
+	Type     string `json:"type"`
+	StateKey string `json:"state_key"`
+}
+
+// makeLeaveDebugError is a /make_leave error response with the auth chain
+// attached, so that it's possible to see why the leave wasn't allowed.
+type makeLeaveDebugError struct {
+	*jsonerror.MatrixError
+	AuthChain []DebugAuthEvent `json:"org.matrix.dendrite.debug_auth_chain"`
+}
+
+// debugAuthChain returns the state events that a leave was checked against,
+// if the request asked for them with ?debug_auth_chain=true and the origin is
+// allowed to by the debug_auth_chain_servers config option. Otherwise it
+// returns nil, so normal federation traffic never sees it.
+func debugAuthChain(
+	httpReq *http.Request, origin gomatrixserverlib.ServerName, cfg *config.FederationAPI,
+	stateEvents []*gomatrixserverlib.HeaderedEvent,
+) []DebugAuthEvent {
+	if httpReq.URL.Query().Get("debug_auth_chain") != "true" || !cfg.AllowsDebugAuthChain(origin) {
+		return nil
+	}
+	authChain := make([]DebugAuthEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		authEvent := DebugAuthEvent{
+			EventID: ev.EventID(),
+			Type:    ev.Type(),
+		}
+		if ev.StateKey() != nil {
+			authEvent.StateKey = *ev.StateKey()
+		}
+		authChain = append(authChain, authEvent)
+	}
+	return authChain
+}
+
+// MakeLeave implements the /make_leave API. The user ID must already have
+// been checked to belong to the origin, see requireUserFromOrigin.
 func MakeLeave(
 	httpReq *http.Request,
 	request *gomatrixserverlib.FederationRequest,
 	cfg *config.FederationAPI,
 	rsAPI api.RoomserverInternalAPI,
 	roomID, userID string,
-) util.JSONResponse {
-	_, domain, err := gomatrixserverlib.SplitID('@', userID)
-	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("Invalid UserID"),
-		}
-	}
-	if domain != request.Origin() {
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("The leave must be sent by the server of the user"),
-		}
+) (res util.JSONResponse) {
+	span, ctx := startLeaveSpan(httpReq, "MakeLeave", request.Origin(), roomID, userID)
+	defer func() {
+		finishLeaveSpan(span, res)
+		countLeaveOutcome("make_leave", request.Origin(), res)
+	}()
+	httpReq = httpReq.WithContext(ctx)
+
+	if !rsAPI.Ready(ctx) {
+		return roomserverNotReady()
 	}
 
 	// Try building an event for the server
@@ -54,45 +147,92 @@ func MakeLeave(
 		Type:     "m.room.member",
 		StateKey: &userID,
 	}
-	err = builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave})
+	err := builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave})
 	if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("builder.SetContent failed")
-		return jsonerror.InternalServerError()
+		return federationErrorResponse(httpReq.Context(), jsonerror.NewFederationError(
+			jsonerror.FederationErrorBuildEvent, "builder.SetContent", err,
+		))
 	}
 
 	var queryRes api.QueryLatestEventsAndStateResponse
-	event, err := eventutil.QueryAndBuildEvent(httpReq.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
+	buildSpan, buildCtx := opentracing.StartSpanFromContext(ctx, "MakeLeave.BuildEvent")
+	event, err := eventutil.QueryAndBuildEvent(buildCtx, &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
+	if err != nil {
+		setSpanError(buildSpan, err)
+	}
+	buildSpan.Finish()
 	if err == eventutil.ErrRoomNoExists {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Room does not exist"),
 		}
+	} else if err == eventutil.ErrRoomPurged {
+		// We know about the room but can't build a leave without its state.
+		// The origin should try another server that is still in the room.
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("This server no longer has the state for this room"),
+		}
+	} else if err == eventutil.ErrDepthExceeded {
+		// The room's latest events are already deeper than the room version
+		// allows, so any leave event we built would be rejected.
+		util.GetLogger(httpReq.Context()).WithField("room_id", roomID).Error("Room depth exceeds room version maximum, refusing to build leave event")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("The depth of this room has exceeded the maximum allowed by its room version"),
+		}
 	} else if e, ok := err.(gomatrixserverlib.BadJSONError); ok {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON(e.Error()),
 		}
 	} else if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("eventutil.BuildEvent failed")
-		return jsonerror.InternalServerError()
+		return federationErrorResponse(httpReq.Context(), jsonerror.NewFederationError(
+			jsonerror.FederationErrorBuildEvent, "eventutil.QueryAndBuildEvent", err,
+		))
 	}
+	span.SetTag("room_version", string(event.RoomVersion))
 
 	// If the user has already left then just return their last leave
 	// event. This means that /send_leave will be a no-op, which helps
 	// to reject invites multiple times - hopefully.
+	var membership string
 	for _, state := range queryRes.StateEvents {
-		if !state.StateKeyEquals(userID) {
+		if state.Type() != gomatrixserverlib.MRoomMember || !state.StateKeyEquals(userID) {
+			continue
+		}
+		mem, merr := state.Membership()
+		if merr != nil {
 			continue
 		}
-		if mem, merr := state.Membership(); merr == nil && mem == gomatrixserverlib.Leave {
+		if mem == gomatrixserverlib.Leave {
 			return util.JSONResponse{
 				Code: http.StatusOK,
-				JSON: map[string]interface{}{
-					"room_version": event.RoomVersion,
-					"event":        state,
+				JSON: MakeLeaveResponse{
+					RoomVersion: event.RoomVersion,
+					Event:       state,
 				},
 			}
 		}
+		membership = mem
+	}
+
+	// A leave has to follow some previous membership, e.g. a join, an
+	// invite or a knock, otherwise we'd be building a leave from nowhere.
+	switch membership {
+	case "":
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("user is not in the room"),
+		}
+	case gomatrixserverlib.Ban:
+		// No room version allows a banned user to lift their own ban by
+		// leaving, so reject this up-front rather than handing out a
+		// template that will fail the auth checks.
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("user is banned from the room"),
+		}
 	}
 
 	// Check that the leave is allowed or not
@@ -101,7 +241,23 @@ func MakeLeave(
 		stateEvents[i] = queryRes.StateEvents[i].Event
 	}
 	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
-	if err = gomatrixserverlib.Allowed(event.Event, &provider); err != nil {
+	authSpan, _ := opentracing.StartSpanFromContext(ctx, "MakeLeave.AuthCheck")
+	err = gomatrixserverlib.Allowed(event.Event, &provider)
+	if err != nil {
+		setSpanError(authSpan, err)
+	}
+	authSpan.Finish()
+	authChain := debugAuthChain(httpReq, request.Origin(), cfg, queryRes.StateEvents)
+	if err != nil {
+		if authChain != nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: makeLeaveDebugError{
+					MatrixError: jsonerror.Forbidden(err.Error()),
+					AuthChain:   authChain,
+				},
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden(err.Error()),
@@ -110,9 +266,10 @@ func MakeLeave(
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: map[string]interface{}{
-			"room_version": event.RoomVersion,
-			"event":        builder,
+		JSON: MakeLeaveResponse{
+			RoomVersion: event.RoomVersion,
+			Event:       builder,
+			AuthChain:   authChain,
 		},
 	}
 }
@@ -124,103 +281,373 @@ func SendLeave(
 	cfg *config.FederationAPI,
 	rsAPI api.RoomserverInternalAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	leaveNotifier LeaveNotifier,
+	breaker *LeaveCircuitBreaker,
 	roomID, eventID string,
-) util.JSONResponse {
+) (res util.JSONResponse) {
+	span, ctx := startLeaveSpan(httpReq, "SendLeave", request.Origin(), roomID, "")
+	defer func() {
+		finishLeaveSpan(span, res)
+		countLeaveOutcome("send_leave", request.Origin(), res)
+	}()
+	httpReq = httpReq.WithContext(ctx)
+
+	if !rsAPI.Ready(ctx) {
+		return roomserverNotReady()
+	}
+	if breakerRes := breaker.Allow(request.Origin()); breakerRes != nil {
+		return *breakerRes
+	}
+	if emptyRes := checkRequestBodyNotEmpty(request.Content()); emptyRes != nil {
+		return *emptyRes
+	}
+
+	// If we have never participated in the room then we have no business
+	// processing the leave. Rooms that we have left are still known to the
+	// roomserver, so leaves for those are processed as normal.
+	joinedReq := api.QueryServerJoinedToRoomRequest{RoomID: roomID}
+	joinedRes := api.QueryServerJoinedToRoomResponse{}
+	if err := rsAPI.QueryServerJoinedToRoom(ctx, &joinedReq, &joinedRes); err != nil {
+		return federationErrorResponse(ctx, jsonerror.NewFederationError(
+			jsonerror.FederationErrorRoomserver, "rsAPI.QueryServerJoinedToRoom", err,
+		))
+	}
+	if !joinedRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("This server is not participating in the room"),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
-	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
+	verSpan, verCtx := opentracing.StartSpanFromContext(ctx, "SendLeave.QueryRoomVersion")
+	err := rsAPI.QueryRoomVersionForRoom(verCtx, &verReq, &verRes)
+	if err != nil {
+		setSpanError(verSpan, err)
+	}
+	verSpan.Finish()
+	if err != nil {
+		// We know about the room, so we should know its version.
+		return federationErrorResponse(ctx, jsonerror.NewFederationError(
+			jsonerror.FederationErrorRoomserver, "rsAPI.QueryRoomVersionForRoom", err,
+		))
+	}
+	span.SetTag("room_version", string(verRes.RoomVersion))
+
+	// Decode the event JSON from the request.
+	event, err := parseInboundPDU(request.Content(), verRes.RoomVersion)
+	if err != nil {
+		return inboundPDUErrorResponse(err)
+	}
+	if err = checkInboundPDUFormat(event, verRes.RoomVersion); err != nil {
+		return inboundPDUErrorResponse(err)
+	}
+
+	verifier := &concurrentKeyRing{keys: keys, maxWorkers: cfg.SignatureVerifyConcurrency}
+	if err = ValidateLeaveEvent(ctx, event, roomID, eventID, request.Origin(), verifier, cfg.StrictKeyValidity); err != nil {
+		if verr, ok := err.(*LeaveEventError); ok {
+			return verr.JSONResponse()
+		}
+		if ferr, ok := err.(*jsonerror.FederationError); ok {
+			return federationErrorResponse(httpReq.Context(), ferr)
+		}
+		util.GetLogger(httpReq.Context()).WithError(err).Error("ValidateLeaveEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	span.SetTag("user_id", *event.StateKey())
+
+	// Check if the user has already left. If so, no-op!
+	prevMembership, err := api.GetSingleStateEvent(httpReq.Context(), rsAPI, roomID, gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomMember,
+		StateKey:  *event.StateKey(),
+	})
+	if err == api.ErrStateEventNotFound {
+		// The room doesn't exist or we weren't ever joined to it. Might as well
+		// no-op here.
 		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	} else if err != nil {
+		return federationErrorResponse(httpReq.Context(), jsonerror.NewFederationError(
+			jsonerror.FederationErrorRoomserver, "rsAPI.QuerySingleStateEvent", err,
+		))
+	}
+	// Check if we're recycling a previous leave event, or if the user has
+	// already left some other way. Either way there's nothing to do, and
+	// the spec says that repeating a leave should succeed, so return the
+	// same response as if we had just processed it.
+	if event.EventID() == prevMembership.EventID() || isLeaveMembership(prevMembership) {
+		return sendLeaveSuccess(ctx, cfg, rsAPI, roomID)
+	}
+	if !cfg.AllowLeaveFromBan {
+		if mem, merr := prevMembership.Membership(); merr == nil && mem == gomatrixserverlib.Ban {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("This server does not accept leaves from users who are banned from the room"),
+			}
+		}
+	}
+	// If the user is shadow-banned then pretend that the leave succeeded, so
+	// that their server can't tell that they have been shadow-banned, but
+	// don't send it into the room. This has a privacy cost: the user and
+	// their server believe that they have left, while this server still
+	// treats them as a member, so they will keep receiving the room's events
+	// over federation. Only opt-in deployments that accept this are affected.
+	if cfg.IsShadowBanned(*event.StateKey()) {
+		util.GetLogger(httpReq.Context()).WithField("user_id", *event.StateKey()).Info("Dropping leave from shadow-banned user")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
 		}
 	}
 
-	// Decode the event JSON from the request.
-	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), verRes.RoomVersion)
-	switch err.(type) {
-	case gomatrixserverlib.BadJSONError:
+	// Send the events to the room server.
+	// We are responsible for notifying other servers that the user has left
+	// the room, so set SendAsServer to cfg.Matrix.ServerName
+	sendSpan, sendCtx := opentracing.StartSpanFromContext(ctx, "SendLeave.InputRoomEvents")
+	response := inputLeaveEvent(sendCtx, cfg, rsAPI, &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:          api.KindNew,
+				Event:         event.Headered(verRes.RoomVersion),
+				AuthEventIDs:  event.AuthEventIDs(),
+				SendAsServer:  string(cfg.Matrix.ServerName),
+				TransactionID: nil,
+			},
+		},
+	})
+	if response.ErrMsg != "" {
+		setSpanError(sendSpan, errors.New(response.ErrMsg))
+	}
+	sendSpan.Finish()
+
+	if response.ErrMsg != "" {
+		// The same leave may have been sent more than once at the same time,
+		// in which case the roomserver rejects all but the first, as a leave
+		// can't follow a leave. That's still a success as far as the origin
+		// is concerned.
+		if current, qerr := api.GetSingleStateEvent(ctx, rsAPI, roomID, gomatrixserverlib.StateKeyTuple{
+			EventType: gomatrixserverlib.MRoomMember,
+			StateKey:  *event.StateKey(),
+		}); qerr == nil && isLeaveMembership(current) {
+			util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).Info("Leave event failed but user has already left")
+			return sendLeaveSuccess(ctx, cfg, rsAPI, roomID)
+		}
+		if response.NotAllowed {
+			util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).Warn("Leave event was not allowed")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(response.ErrMsg),
+			}
+		}
+		breaker.Failure(request.Origin())
+		return federationErrorResponse(httpReq.Context(), jsonerror.NewFederationError(
+			jsonerror.FederationErrorRoomserver, "rsAPI.InputRoomEvents", errors.New(response.ErrMsg),
+		))
+	}
+	breaker.Success(request.Origin())
+
+	if leaveNotifier != nil {
+		leaveNotifier.NotifyLeave(LeaveNotification{
+			RoomID:    roomID,
+			UserID:    *event.StateKey(),
+			EventID:   event.EventID(),
+			Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+	}
+
+	scheduleRoomEviction(ctx, rsAPI, roomID)
+
+	return sendLeaveSuccess(ctx, cfg, rsAPI, roomID)
+}
+
+// scheduleRoomEviction tells the roomserver that the room may now be
+// dormant, so that it can evict it from its caches if there are no local
+// users left. This is best effort, so failures are only logged.
+func scheduleRoomEviction(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string) {
+	var res api.PerformScheduleRoomEvictionResponse
+	if err := rsAPI.PerformScheduleRoomEviction(ctx, &api.PerformScheduleRoomEvictionRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to schedule room eviction")
+	}
+}
+
+// sendLeaveSuccess returns the response to a successful /send_leave.
+func sendLeaveSuccess(ctx context.Context, cfg *config.FederationAPI, rsAPI api.RoomserverInternalAPI, roomID string) util.JSONResponse {
+	var res SendLeaveResponse
+	if cfg.LeaveTombstoneHint {
+		res.ReplacementRoom = leaveReplacementRoom(ctx, rsAPI, roomID)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// isLeaveMembership returns true if the event is a leave membership event.
+func isLeaveMembership(ev *gomatrixserverlib.HeaderedEvent) bool {
+	mem, err := ev.Membership()
+	return err == nil && mem == gomatrixserverlib.Leave
+}
+
+// SendLeaveResponse is the response to a successful /send_leave.
+type SendLeaveResponse struct {
+	// Set if leave_tombstone_hint is enabled and the room has been replaced,
+	// so that the user's server can point them at the new room.
+	ReplacementRoom *LeaveReplacementRoom `json:"org.matrix.dendrite.replacement_room,omitempty"`
+}
+
+// LeaveReplacementRoom is the room that a tombstoned room was replaced by.
+type LeaveReplacementRoom struct {
+	RoomID string `json:"room_id"`
+	// The message from the tombstone explaining the replacement, if any.
+	Body string `json:"body,omitempty"`
+}
+
+// leaveReplacementRoom returns the replacement room from the room's
+// m.room.tombstone event, or nil if the room hasn't been replaced. Errors
+// are logged and treated as there being no replacement, as the leave has
+// already been accepted by this point.
+func leaveReplacementRoom(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string) *LeaveReplacementRoom {
+	tombstone, err := api.GetSingleStateEvent(ctx, rsAPI, roomID, gomatrixserverlib.StateKeyTuple{
+		EventType: "m.room.tombstone",
+		StateKey:  "",
+	})
+	if err == api.ErrStateEventNotFound {
+		return nil
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to query tombstone")
+		return nil
+	}
+	var content struct {
+		Body            string `json:"body"`
+		ReplacementRoom string `json:"replacement_room"`
+	}
+	if err = json.Unmarshal(tombstone.Content(), &content); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("event_id", tombstone.EventID()).Warn("Failed to parse tombstone content")
+		return nil
+	}
+	if content.ReplacementRoom == "" {
+		return nil
+	}
+	return &LeaveReplacementRoom{
+		RoomID: content.ReplacementRoom,
+		Body:   content.Body,
+	}
+}
+
+// LeaveEventErrorCode is the reason that a leave event failed validation.
+type LeaveEventErrorCode int
+
+const (
+	// LeaveEventBadRoomID means the room ID of the event doesn't match the request.
+	LeaveEventBadRoomID LeaveEventErrorCode = iota + 1
+	// LeaveEventBadEventID means the event ID of the event doesn't match the request.
+	LeaveEventBadEventID
+	// LeaveEventBadOrigin means the event didn't originate on the requesting server.
+	LeaveEventBadOrigin
+	// LeaveEventMissingStateKey means the event has no state key.
+	LeaveEventMissingStateKey
+	// LeaveEventBadSignature means the event isn't signed by the requesting server.
+	LeaveEventBadSignature
+	// LeaveEventBadContent means the event content is missing a membership or
+	// has malformed fields.
+	LeaveEventBadContent
+	// LeaveEventNotLeave means the membership of the event isn't leave.
+	LeaveEventNotLeave
+)
+
+// LeaveEventError is returned by ValidateLeaveEvent if the leave event is
+// invalid. Any other error means the event couldn't be validated.
+type LeaveEventError struct {
+	Code LeaveEventErrorCode
+	Msg  string
+}
+
+func (e *LeaveEventError) Error() string {
+	return fmt.Sprintf("%d : %s", e.Code, e.Msg)
+}
+
+// JSONResponse maps error codes to suitable HTTP error responses.
+func (e *LeaveEventError) JSONResponse() util.JSONResponse {
+	switch e.Code {
+	case LeaveEventBadOrigin, LeaveEventBadSignature:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(e.Msg),
+		}
+	case LeaveEventMissingStateKey:
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON(err.Error()),
+			JSON: jsonerror.InvalidArgumentValue(e.Msg),
 		}
-	case nil:
 	default:
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			JSON: jsonerror.BadJSON(e.Msg),
 		}
 	}
+}
+
+// KeyRefresher can optionally be implemented by the JSONVerifier passed to
+// ValidateLeaveEvent. It is called before retrying verification of a leave
+// event signed with an unknown key, so that any keys cached for the server
+// can be discarded and fetched again.
+type KeyRefresher interface {
+	RefreshKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) error
+}
 
+// isUnknownKeyError returns true if a verification error means that no key
+// could be found for the key ID that the message was signed with.
+func isUnknownKeyError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "could not download key")
+}
+
+// ValidateLeaveEvent checks that a leave event received from the origin
+// server is for the given room and event IDs, was sent and signed by the
+// origin and is a leave membership event. If the event is signed with an
+// unknown key then the keys are refreshed and verification is retried once.
+// It returns a *LeaveEventError if the event is invalid, or a
+// *jsonerror.FederationError if it couldn't be validated.
+func ValidateLeaveEvent(
+	ctx context.Context,
+	event *gomatrixserverlib.Event,
+	roomID, eventID string,
+	origin gomatrixserverlib.ServerName,
+	keys gomatrixserverlib.JSONVerifier,
+	strictKeyValidity bool,
+) error {
 	// Check that the room ID is correct.
 	if event.RoomID() != roomID {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the leave event JSON"),
+		return &LeaveEventError{
+			Code: LeaveEventBadRoomID,
+			Msg:  "The room ID in the request path must match the room ID in the leave event JSON",
 		}
 	}
 
 	// Check that the event ID is correct.
 	if event.EventID() != eventID {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the leave event JSON"),
+		return &LeaveEventError{
+			Code: LeaveEventBadEventID,
+			Msg:  "The event ID in the request path must match the event ID in the leave event JSON",
 		}
 	}
 
 	// Check that the event is from the server sending the request.
-	if event.Origin() != request.Origin() {
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("The leave must be sent by the server it originated on"),
+	if event.Origin() != origin {
+		return &LeaveEventError{
+			Code: LeaveEventBadOrigin,
+			Msg:  "The leave must be sent by the server it originated on",
 		}
 	}
 
 	if event.StateKey() == nil {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.InvalidArgumentValue("missing state_key"),
-		}
-	}
-
-	// Check if the user has already left. If so, no-op!
-	queryReq := &api.QueryLatestEventsAndStateRequest{
-		RoomID: roomID,
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{
-			{
-				EventType: gomatrixserverlib.MRoomMember,
-				StateKey:  *event.StateKey(),
-			},
-		},
-	}
-	queryRes := &api.QueryLatestEventsAndStateResponse{}
-	err = rsAPI.QueryLatestEventsAndState(httpReq.Context(), queryReq, queryRes)
-	if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
-		return jsonerror.InternalServerError()
-	}
-	// The room doesn't exist or we weren't ever joined to it. Might as well
-	// no-op here.
-	if !queryRes.RoomExists || len(queryRes.StateEvents) == 0 {
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: struct{}{},
-		}
-	}
-	// Check if we're recycling a previous leave event.
-	if event.EventID() == queryRes.StateEvents[0].EventID() {
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: struct{}{},
-		}
-	}
-	// We are/were joined/invited/banned or something. Check if
-	// we can no-op here.
-	if len(queryRes.StateEvents) == 1 {
-		if mem, merr := queryRes.StateEvents[0].Membership(); merr == nil && mem == gomatrixserverlib.Leave {
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct{}{},
-			}
+		return &LeaveEventError{
+			Code: LeaveEventMissingStateKey,
+			Msg:  "missing state_key",
 		}
 	}
 
@@ -230,65 +657,184 @@ func SendLeave(
 		ServerName:             event.Origin(),
 		Message:                redacted.JSON(),
 		AtTS:                   event.OriginServerTS(),
-		StrictValidityChecking: true,
+		StrictValidityChecking: strictKeyValidity,
 	}}
-	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	authSpan, authCtx := opentracing.StartSpanFromContext(ctx, "SendLeave.AuthCheck")
+	verifyResults, err := keys.VerifyJSONs(authCtx, verifyRequests)
+	if err == nil && isUnknownKeyError(verifyResults[0].Error) {
+		// The origin may have rotated its signing keys since we last fetched
+		// them, so refresh them and try once more before giving up.
+		logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+			"event_id":    event.EventID(),
+			"server_name": event.Origin(),
+		})
+		logger.WithError(verifyResults[0].Error).Info("Refreshing signing keys to verify leave event")
+		if refresher, ok := keys.(KeyRefresher); ok {
+			if rerr := refresher.RefreshKeys(authCtx, event.Origin()); rerr != nil {
+				logger.WithError(rerr).Warn("Failed to refresh signing keys")
+			}
+		}
+		verifyResults, err = keys.VerifyJSONs(authCtx, verifyRequests)
+	}
+	switch {
+	case err != nil:
+		setSpanError(authSpan, err)
+	case verifyResults[0].Error != nil:
+		setSpanError(authSpan, verifyResults[0].Error)
+	}
+	authSpan.Finish()
 	if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("keys.VerifyJSONs failed")
-		return jsonerror.InternalServerError()
+		return jsonerror.NewFederationError(jsonerror.FederationErrorVerifySignatures, "keys.VerifyJSONs", err)
 	}
 	if verifyResults[0].Error != nil {
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("The leave must be signed by the server it originated on"),
+		return &LeaveEventError{
+			Code: LeaveEventBadSignature,
+			Msg:  "The leave must be signed by the server it originated on",
 		}
 	}
 
-	// check membership is set to leave
+	// Check that the content is well formed before looking at the membership.
+	if err = eventutil.ValidateMemberContent(event.Content()); err != nil {
+		return &LeaveEventError{
+			Code: LeaveEventBadContent,
+			Msg:  err.Error(),
+		}
+	}
 	mem, err := event.Membership()
 	if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("event.Membership failed")
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("missing content.membership key"),
-		}
+		return jsonerror.NewFederationError(jsonerror.FederationErrorParseEvent, "event.Membership", err)
 	}
 	if mem != gomatrixserverlib.Leave {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("The membership in the event content must be set to leave"),
+		return &LeaveEventError{
+			Code: LeaveEventNotLeave,
+			Msg:  "The membership in the event content must be set to leave",
 		}
 	}
+	return nil
+}
 
-	// Send the events to the room server.
-	// We are responsible for notifying other servers that the user has left
-	// the room, so set SendAsServer to cfg.Matrix.ServerName
-	var response api.InputRoomEventsResponse
-	rsAPI.InputRoomEvents(httpReq.Context(), &api.InputRoomEventsRequest{
-		InputRoomEvents: []api.InputRoomEvent{
-			{
-				Kind:          api.KindNew,
-				Event:         event.Headered(verRes.RoomVersion),
-				AuthEventIDs:  event.AuthEventIDs(),
-				SendAsServer:  string(cfg.Matrix.ServerName),
-				TransactionID: nil,
-			},
-		},
-	}, &response)
-
-	if response.ErrMsg != "" {
-		util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).WithField("not_allowed", response.NotAllowed).Error("producer.SendEvents failed")
-		if response.NotAllowed {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.Forbidden(response.ErrMsg),
-			}
+// inputLeaveEvent sends the leave event to the roomserver. If the roomserver
+// fails with a transient error, e.g. because it is restarting or the database
+// is busy, then the input is retried with an exponential backoff up to
+// cfg.SendEventsRetries times before giving up. Other errors, such as the
+// event failing auth, would fail again in the same way so aren't retried.
+func inputLeaveEvent(
+	ctx context.Context,
+	cfg *config.FederationAPI,
+	rsAPI api.RoomserverInternalAPI,
+	request *api.InputRoomEventsRequest,
+) *api.InputRoomEventsResponse {
+	backoff := sendEventsInitialBackoff
+	for attempt := 0; ; attempt++ {
+		response := &api.InputRoomEventsResponse{}
+		rsAPI.InputRoomEvents(ctx, request, response)
+		if response.ErrMsg == "" || !response.Transient || attempt >= cfg.SendEventsRetries {
+			return response
 		}
-		return jsonerror.InternalServerError()
+		util.GetLogger(ctx).WithField(logrus.ErrorKey, response.ErrMsg).Warnf("Retrying leave event input in %s", backoff)
+		sendLeaveRetriesTotal.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return response
+		}
+		backoff *= 2
 	}
+}
 
+// roomserverNotReadyRetryAfter is how long remote servers are asked to wait
+// before retrying a leave while the roomserver is still starting up.
+const roomserverNotReadyRetryAfter = 5 * time.Second
+
+// roomserverNotReady returns a 503 telling the remote server to back off and
+// retry, rather than failing part way through the request with a 500.
+func roomserverNotReady() util.JSONResponse {
 	return util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: struct{}{},
+		Code: http.StatusServiceUnavailable,
+		JSON: jsonerror.Unknown("The room server is not ready yet"),
+		Headers: map[string]string{
+			"Retry-After": strconv.Itoa(int(roomserverNotReadyRetryAfter / time.Second)),
+		},
+	}
+}
+
+// startLeaveSpan starts the top-level span for a federated leave request.
+// The span is a child of any span already in the request context, otherwise
+// it continues the trace of the remote server from the request headers, if
+// there is one. If no tracer is configured then this is a no-op.
+func startLeaveSpan(
+	httpReq *http.Request, operationName string,
+	origin gomatrixserverlib.ServerName, roomID, userID string,
+) (opentracing.Span, context.Context) {
+	tracer := opentracing.GlobalTracer()
+	var opts []opentracing.StartSpanOption
+	if parent := opentracing.SpanFromContext(httpReq.Context()); parent != nil {
+		opts = append(opts, opentracing.ChildOf(parent.Context()))
+	} else if clientContext, err := tracer.Extract(
+		opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(httpReq.Header),
+	); err == nil {
+		opts = append(opts, ext.RPCServerOption(clientContext))
 	}
+	span := tracer.StartSpan(operationName, opts...)
+	span.SetTag("origin", string(origin))
+	span.SetTag("room_id", roomID)
+	if userID != "" {
+		span.SetTag("user_id", userID)
+	}
+	return span, opentracing.ContextWithSpan(httpReq.Context(), span)
+}
+
+// finishLeaveSpan records the outcome of a federated leave request on the
+// span, marking it as failed if the request was not successful.
+func finishLeaveSpan(span opentracing.Span, res util.JSONResponse) {
+	ext.HTTPStatusCode.Set(span, uint16(res.Code))
+	if res.Code >= http.StatusBadRequest {
+		ext.Error.Set(span, true)
+	}
+	span.Finish()
+}
+
+// countLeaveOutcome records the outcome of a federated leave request in
+// leaveOutcomesTotal.
+func countLeaveOutcome(endpoint string, origin gomatrixserverlib.ServerName, res util.JSONResponse) {
+	leaveOutcomesTotal.WithLabelValues(endpoint, leaveOriginBucket(origin), leaveOutcome(res)).Inc()
+}
+
+// leaveOutcome maps the response to a leave request to an outcome label.
+func leaveOutcome(res util.JSONResponse) string {
+	switch {
+	case res.Code < http.StatusMultipleChoices:
+		return "ok"
+	case res.Code == http.StatusForbidden:
+		return "forbidden"
+	case res.Code == http.StatusNotFound:
+		return "not_found"
+	case res.Code < http.StatusInternalServerError:
+		return "bad_json"
+	default:
+		return "internal_error"
+	}
+}
+
+// leaveOriginBucket hashes the origin into one of leaveOriginBuckets buckets.
+func leaveOriginBucket(origin gomatrixserverlib.ServerName) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(origin))
+	return fmt.Sprintf("%02d", h.Sum32()%leaveOriginBuckets)
+}
+
+// federationErrorResponse logs the error along with its cause and the
+// operation that failed, and returns a 500 which hides both.
+func federationErrorResponse(ctx context.Context, ferr *jsonerror.FederationError) util.JSONResponse {
+	util.GetLogger(ctx).WithError(ferr.Err).WithFields(logrus.Fields{
+		"cause":     ferr.Cause,
+		"operation": ferr.Operation,
+	}).Error("Failed to handle federation request")
+	return ferr.JSONResponse()
+}
+
+// setSpanError marks the span as failed with the given error.
+func setSpanError(span opentracing.Span, err error) {
+	ext.Error.Set(span, true)
+	span.LogFields(otlog.Error(err))
 }
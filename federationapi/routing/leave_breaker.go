@@ -0,0 +1,157 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// leaveCircuitBreakersTripped is the number of origins whose circuit
+	// breaker has tripped and not yet been reset by a successful leave.
+	leaveCircuitBreakersTripped = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "leave_circuit_breakers_tripped",
+			Help:      "Number of servers whose leaves are being rejected by the circuit breaker, or will be retried after the cooldown",
+		},
+	)
+	// leaveCircuitBreakerRejectionsTotal counts leaves rejected by the
+	// circuit breaker, by bucketed origin.
+	leaveCircuitBreakerRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "leave_circuit_breaker_rejections",
+			Help:      "Number of send_leave requests rejected by the circuit breaker",
+		},
+		[]string{"origin"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(leaveCircuitBreakersTripped, leaveCircuitBreakerRejectionsTotal)
+}
+
+type leaveCircuitState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// LeaveCircuitBreaker stops leaves from a server being sent to the roomserver
+// for a cooldown period once the roomserver has failed to process several of
+// them in a row, e.g. because of corrupt state in the room. Once the cooldown
+// has passed leaves are let through again: the first success resets the
+// circuit breaker, whereas a failure trips it again straight away. Leaves
+// which the roomserver rejects as not allowed don't count either way, as
+// they were processed successfully. A nil *LeaveCircuitBreaker lets
+// everything through.
+type LeaveCircuitBreaker struct {
+	mu        sync.Mutex
+	servers   map[gomatrixserverlib.ServerName]*leaveCircuitState
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+// NewLeaveCircuitBreaker returns a LeaveCircuitBreaker for the given config,
+// or nil if the circuit breaker is disabled.
+func NewLeaveCircuitBreaker(cfg *config.LeaveCircuitBreaker) *LeaveCircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	return &LeaveCircuitBreaker{
+		servers:   make(map[gomatrixserverlib.ServerName]*leaveCircuitState),
+		threshold: cfg.FailureThreshold,
+		cooldown:  time.Duration(cfg.CooldownMS) * time.Millisecond,
+		now:       time.Now,
+	}
+}
+
+// Allow returns nil if leaves from the origin should be processed, or
+// otherwise a 503 response asking the origin to retry after the cooldown.
+func (b *LeaveCircuitBreaker) Allow(origin gomatrixserverlib.ServerName) *util.JSONResponse {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.servers[origin]
+	if !ok {
+		return nil
+	}
+	wait := state.openUntil.Sub(b.now())
+	if wait <= 0 {
+		return nil
+	}
+	leaveCircuitBreakerRejectionsTotal.WithLabelValues(leaveOriginBucket(origin)).Inc()
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	return &util.JSONResponse{
+		Code: http.StatusServiceUnavailable,
+		JSON: jsonerror.Unknown("Leaves from this server are temporarily not being accepted"),
+		Headers: map[string]string{
+			"Retry-After": strconv.Itoa(retryAfter),
+		},
+	}
+}
+
+// Success resets the circuit breaker for the origin.
+func (b *LeaveCircuitBreaker) Success(origin gomatrixserverlib.ServerName) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.servers[origin]
+	if !ok {
+		return
+	}
+	if state.failures >= b.threshold {
+		leaveCircuitBreakersTripped.Dec()
+	}
+	delete(b.servers, origin)
+}
+
+// Failure records that the roomserver failed to process a leave from the
+// origin, tripping the circuit breaker if there have been too many.
+func (b *LeaveCircuitBreaker) Failure(origin gomatrixserverlib.ServerName) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.servers[origin]
+	if !ok {
+		state = &leaveCircuitState{}
+		b.servers[origin] = state
+	}
+	state.failures++
+	if state.failures == b.threshold {
+		leaveCircuitBreakersTripped.Inc()
+	}
+	if state.failures >= b.threshold {
+		state.openUntil = b.now().Add(b.cooldown)
+	}
+}
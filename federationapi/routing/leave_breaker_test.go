@@ -0,0 +1,150 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLeaveCircuitBreaker(t *testing.T) {
+	if NewLeaveCircuitBreaker(&config.LeaveCircuitBreaker{CooldownMS: 1000}) != nil {
+		t.Fatalf("expected circuit breaker to be disabled without a failure threshold")
+	}
+	var disabled *LeaveCircuitBreaker
+	disabled.Failure(testOrigin)
+	if disabled.Allow(testOrigin) != nil {
+		t.Fatalf("expected disabled circuit breaker to allow everything")
+	}
+
+	breaker := NewLeaveCircuitBreaker(&config.LeaveCircuitBreaker{
+		FailureThreshold: 2,
+		CooldownMS:       60000,
+	})
+	now := time.Unix(1000, 0)
+	breaker.now = func() time.Time { return now }
+	trippedBefore := testutil.ToFloat64(leaveCircuitBreakersTripped)
+	tripped := func() float64 {
+		return testutil.ToFloat64(leaveCircuitBreakersTripped) - trippedBefore
+	}
+
+	breaker.Failure(testOrigin)
+	if breaker.Allow(testOrigin) != nil {
+		t.Fatalf("expected circuit breaker not to trip before the threshold")
+	}
+	breaker.Failure(testOrigin)
+	res := breaker.Allow(testOrigin)
+	if res == nil || res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected circuit breaker to trip at the threshold, got %+v", res)
+	}
+	if got := res.Headers["Retry-After"]; got != "60" {
+		t.Errorf("expected Retry-After of 60, got %q", got)
+	}
+	if tripped() != 1 {
+		t.Errorf("expected 1 tripped circuit breaker, got %v", tripped())
+	}
+	if breaker.Allow(testDestination) != nil {
+		t.Errorf("expected other servers not to be affected")
+	}
+
+	// After the cooldown a failure trips it again straight away.
+	now = now.Add(time.Minute)
+	if breaker.Allow(testOrigin) != nil {
+		t.Fatalf("expected circuit breaker to let a leave through after the cooldown")
+	}
+	breaker.Failure(testOrigin)
+	if breaker.Allow(testOrigin) == nil {
+		t.Fatalf("expected circuit breaker to trip again on failure after the cooldown")
+	}
+
+	// After the cooldown a success resets it.
+	now = now.Add(time.Minute)
+	breaker.Success(testOrigin)
+	if tripped() != 0 {
+		t.Errorf("expected no tripped circuit breakers, got %v", tripped())
+	}
+	breaker.Failure(testOrigin)
+	if breaker.Allow(testOrigin) != nil {
+		t.Errorf("expected failures to be counted from zero after a success")
+	}
+}
+
+func TestSendLeaveCircuitBreaker(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+		SignatureVerifyConcurrency: 1,
+	}
+	breaker := NewLeaveCircuitBreaker(&config.LeaveCircuitBreaker{
+		FailureThreshold: 1,
+		CooldownMS:       60000,
+	})
+	rsAPI := &leaveTestRoomserverAPI{
+		prevMembership: mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join),
+		inputErrMsg:    "corrupt state",
+	}
+	leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+	sendLeave := func() int {
+		t.Helper()
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, breaker, roomID, leave.EventID(),
+		)
+		return res.Code
+	}
+
+	if code := sendLeave(); code != http.StatusInternalServerError {
+		t.Fatalf("expected roomserver failure to return %d, got %d", http.StatusInternalServerError, code)
+	}
+	if code := sendLeave(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected circuit breaker to return %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Errorf("expected leave not to be sent to the roomserver while the circuit breaker is tripped, got %d", len(rsAPI.inputRoomEvents))
+	}
+
+	breaker.now = func() time.Time { return time.Now().Add(time.Minute) }
+	rsAPI.inputErrMsg = ""
+	if code := sendLeave(); code != http.StatusOK {
+		t.Fatalf("expected leave after the cooldown to succeed, got %d", code)
+	}
+	if breaker.Allow(testDestination) != nil {
+		t.Errorf("expected circuit breaker to be reset by the successful leave")
+	}
+}
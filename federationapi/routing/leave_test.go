@@ -0,0 +1,1283 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type notReadyRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+}
+
+func (r *notReadyRoomserverAPI) Ready(ctx context.Context) bool {
+	return false
+}
+
+func TestLeaveRoomserverNotReady(t *testing.T) {
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testDestination,
+		},
+	}
+	rsAPI := &notReadyRoomserverAPI{}
+	roomID := "!roomid:kaer.morhen"
+
+	makeReq := gomatrixserverlib.NewFederationRequest(
+		"GET", testDestination, "/_matrix/federation/v1/make_leave/"+roomID+"/@userid:white.orchard",
+	)
+	res := MakeLeave(
+		httptest.NewRequest("GET", makeReq.RequestURI(), nil), &makeReq,
+		cfg, rsAPI, roomID, "@userid:white.orchard",
+	)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("MakeLeave: expected status %d, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	if res.Headers["Retry-After"] == "" {
+		t.Errorf("MakeLeave: expected Retry-After header to be set")
+	}
+
+	sendReq := gomatrixserverlib.NewFederationRequest(
+		"PUT", testDestination, "/_matrix/federation/v2/send_leave/"+roomID+"/$event:white.orchard",
+	)
+	res = SendLeave(
+		httptest.NewRequest("PUT", sendReq.RequestURI(), nil), &sendReq,
+		cfg, rsAPI, nil, nil, nil, roomID, "$event:white.orchard",
+	)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("SendLeave: expected status %d, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	if res.Headers["Retry-After"] == "" {
+		t.Errorf("SendLeave: expected Retry-After header to be set")
+	}
+}
+
+type leaveTestRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	unknownRoom     bool
+	stubRoom        bool
+	notInRoom       bool
+	roomVersion     gomatrixserverlib.RoomVersion
+	roomVersionErr  error
+	depth           int64
+	prevMembership  *gomatrixserverlib.HeaderedEvent
+	extraState      []*gomatrixserverlib.HeaderedEvent
+	tombstone       *gomatrixserverlib.HeaderedEvent
+	inputErrMsg     string
+	inputRoomEvents []api.InputRoomEvent
+	evictions       []string
+}
+
+func (r *leaveTestRoomserverAPI) Ready(ctx context.Context) bool {
+	return true
+}
+
+func (r *leaveTestRoomserverAPI) QueryServerJoinedToRoom(
+	ctx context.Context,
+	req *api.QueryServerJoinedToRoomRequest,
+	res *api.QueryServerJoinedToRoomResponse,
+) error {
+	res.RoomExists = !r.unknownRoom
+	res.IsInRoom = !r.unknownRoom && !r.notInRoom
+	return nil
+}
+
+func (r *leaveTestRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context,
+	req *api.QueryRoomVersionForRoomRequest,
+	res *api.QueryRoomVersionForRoomResponse,
+) error {
+	if r.roomVersionErr != nil {
+		return r.roomVersionErr
+	}
+	res.RoomVersion = testRoomVersion
+	if r.roomVersion != "" {
+		res.RoomVersion = r.roomVersion
+	}
+	return nil
+}
+
+func (r *leaveTestRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	req *api.QueryLatestEventsAndStateRequest,
+	res *api.QueryLatestEventsAndStateResponse,
+) error {
+	if r.unknownRoom || r.stubRoom {
+		res.RoomIsStub = r.stubRoom
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = testRoomVersion
+	if r.roomVersion != "" {
+		res.RoomVersion = r.roomVersion
+	}
+	res.Depth = r.depth
+	if r.prevMembership != nil {
+		res.StateEvents = append(res.StateEvents, r.prevMembership)
+	}
+	res.StateEvents = append(res.StateEvents, r.extraState...)
+	return nil
+}
+
+func (r *leaveTestRoomserverAPI) QuerySingleStateEvent(
+	ctx context.Context,
+	req *api.QuerySingleStateEventRequest,
+	res *api.QuerySingleStateEventResponse,
+) error {
+	if r.unknownRoom || r.stubRoom {
+		return nil
+	}
+	res.RoomExists = true
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{r.prevMembership, r.tombstone} {
+		if ev != nil && ev.Type() == req.EventType && ev.StateKeyEquals(req.StateKey) {
+			res.Event = ev
+		}
+	}
+	return nil
+}
+
+func (r *leaveTestRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *api.InputRoomEventsRequest,
+	res *api.InputRoomEventsResponse,
+) {
+	r.inputRoomEvents = append(r.inputRoomEvents, req.InputRoomEvents...)
+	res.ErrMsg = r.inputErrMsg
+}
+
+func (r *leaveTestRoomserverAPI) PerformScheduleRoomEviction(
+	ctx context.Context,
+	req *api.PerformScheduleRoomEvictionRequest,
+	res *api.PerformScheduleRoomEvictionResponse,
+) error {
+	r.evictions = append(r.evictions, req.RoomID)
+	return nil
+}
+
+type leaveTestNotifier struct {
+	notifications []LeaveNotification
+}
+
+func (n *leaveTestNotifier) NotifyLeave(notification LeaveNotification) {
+	n.notifications = append(n.notifications, notification)
+}
+
+type leaveTestKeyRing struct{}
+
+func (k *leaveTestKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	return make([]gomatrixserverlib.VerifyJSONResult, len(reqs)), nil
+}
+
+func mustCreateMemberEvent(
+	t *testing.T, key ed25519.PrivateKey, origin gomatrixserverlib.ServerName,
+	roomID, sender, userID, membership string,
+) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &userID,
+	}
+	if err := eb.SetContent(map[string]interface{}{"membership": membership}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), origin, "ed25519:test", key, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(testRoomVersion)
+}
+
+func TestSendLeaveFromBan(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+
+	for _, allow := range []bool{true, false} {
+		cfg := &config.FederationAPI{
+			Matrix: &config.Global{
+				ServerName: testOrigin,
+			},
+			AllowLeaveFromBan: allow,
+		}
+		rsAPI := &leaveTestRoomserverAPI{
+			prevMembership: mustCreateMemberEvent(t, key, testOrigin, roomID, "@mod:kaer.morhen", userID, gomatrixserverlib.Ban),
+		}
+		leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+		)
+
+		if allow {
+			if res.Code != http.StatusOK {
+				t.Errorf("allow_leave_from_ban=true: expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+			}
+			if len(rsAPI.inputRoomEvents) != 1 {
+				t.Errorf("allow_leave_from_ban=true: expected leave to be sent to the roomserver")
+			}
+		} else {
+			if res.Code != http.StatusForbidden {
+				t.Errorf("allow_leave_from_ban=false: expected status %d, got %d: %+v", http.StatusForbidden, res.Code, res.JSON)
+			}
+			if len(rsAPI.inputRoomEvents) != 0 {
+				t.Errorf("allow_leave_from_ban=false: expected leave not to be sent to the roomserver")
+			}
+		}
+	}
+}
+
+func TestSendLeaveUnknownRoom(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+		AllowLeaveFromBan: true,
+	}
+	leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+
+	for _, unknownRoom := range []bool{true, false} {
+		// A room we have left is still known, so the leave is processed.
+		rsAPI := &leaveTestRoomserverAPI{
+			unknownRoom:    unknownRoom,
+			prevMembership: mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join),
+		}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+		)
+		wantCode := http.StatusOK
+		if unknownRoom {
+			wantCode = http.StatusNotFound
+		}
+		if res.Code != wantCode {
+			t.Errorf("unknown room %v: expected status %d, got %d: %+v", unknownRoom, wantCode, res.Code, res.JSON)
+		}
+		if unknownRoom && len(rsAPI.inputRoomEvents) != 0 {
+			t.Errorf("expected leave for unknown room not to be sent to the roomserver")
+		}
+	}
+}
+
+// racingLeaveRoomserverAPI rejects leaves as if another copy of the same
+// leave had been processed first.
+type racingLeaveRoomserverAPI struct {
+	*leaveTestRoomserverAPI
+}
+
+func (r *racingLeaveRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *api.InputRoomEventsRequest,
+	res *api.InputRoomEventsResponse,
+) {
+	r.prevMembership = req.InputRoomEvents[0].Event
+	res.ErrMsg = "leave is not allowed"
+	res.NotAllowed = true
+}
+
+func TestSendLeaveIdempotent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+		SignatureVerifyConcurrency: 1,
+	}
+	join := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join)
+	leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+	sendLeave := func(rsAPI api.RoomserverInternalAPI) util.JSONResponse {
+		t.Helper()
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		return SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+		)
+	}
+
+	rsAPI := &leaveTestRoomserverAPI{prevMembership: join}
+	first := sendLeave(rsAPI)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first leave: expected status %d, got %d: %+v", http.StatusOK, first.Code, first.JSON)
+	}
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Fatalf("first leave: expected leave to be sent to the roomserver")
+	}
+	// The roomserver now has the user as left.
+	rsAPI.prevMembership = leave
+	second := sendLeave(rsAPI)
+	if second.Code != http.StatusOK {
+		t.Fatalf("second leave: expected status %d, got %d: %+v", http.StatusOK, second.Code, second.JSON)
+	}
+	if !reflect.DeepEqual(first.JSON, second.JSON) {
+		t.Errorf("second leave: expected the same response as the first, got %+v and %+v", first.JSON, second.JSON)
+	}
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Errorf("second leave: expected leave not to be sent to the roomserver again")
+	}
+
+	// A copy of the leave which loses a race with another is rejected by
+	// the roomserver, but the user has still left.
+	racing := &racingLeaveRoomserverAPI{&leaveTestRoomserverAPI{prevMembership: join}}
+	if res := sendLeave(racing); res.Code != http.StatusOK {
+		t.Errorf("racing leave: expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+}
+
+func TestSendLeaveShadowBanned(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	bannedUserID := "@banned:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+		ShadowBannedUsers: []string{bannedUserID},
+	}
+
+	for _, userID := range []string{bannedUserID, "@userid:white.orchard"} {
+		leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+		rsAPI := &leaveTestRoomserverAPI{
+			prevMembership: mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join),
+		}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+		)
+		// The origin must not be able to tell the difference.
+		if res.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d: %+v", userID, http.StatusOK, res.Code, res.JSON)
+		}
+		shadowBanned := userID == bannedUserID
+		if shadowBanned && len(rsAPI.inputRoomEvents) != 0 {
+			t.Errorf("%s: expected leave from shadow-banned user not to be sent to the roomserver", userID)
+		}
+		if !shadowBanned && len(rsAPI.inputRoomEvents) != 1 {
+			t.Errorf("%s: expected leave to be sent to the roomserver, got %d events", userID, len(rsAPI.inputRoomEvents))
+		}
+	}
+}
+
+func TestSendLeaveErrorCodes(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+	tests := []struct {
+		name        string
+		rsAPI       *leaveTestRoomserverAPI
+		wantCode    int
+		wantErrCode string
+	}{
+		{
+			name:        "unknown room",
+			rsAPI:       &leaveTestRoomserverAPI{unknownRoom: true},
+			wantCode:    http.StatusNotFound,
+			wantErrCode: "M_NOT_FOUND",
+		},
+		{
+			name:        "unsupported room version",
+			rsAPI:       &leaveTestRoomserverAPI{roomVersion: "unsupported"},
+			wantCode:    http.StatusBadRequest,
+			wantErrCode: "M_UNSUPPORTED_ROOM_VERSION",
+		},
+		{
+			name:        "room version query failed",
+			rsAPI:       &leaveTestRoomserverAPI{roomVersionErr: errors.New("database is on fire")},
+			wantCode:    http.StatusInternalServerError,
+			wantErrCode: "M_UNKNOWN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fedReq := gomatrixserverlib.NewFederationRequest(
+				"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+			)
+			if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+			res := SendLeave(
+				httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+				cfg, tt.rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+			)
+			if res.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if got := errCode(t, res); got != tt.wantErrCode {
+				t.Errorf("expected errcode %s, got %s", tt.wantErrCode, got)
+			}
+		})
+	}
+}
+
+func TestMakeLeaveUnknownOrPurgedRoom(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	tests := []struct {
+		name    string
+		rsAPI   *leaveTestRoomserverAPI
+		wantMsg string
+	}{
+		{
+			name:    "unknown room",
+			rsAPI:   &leaveTestRoomserverAPI{unknownRoom: true},
+			wantMsg: "Room does not exist",
+		},
+		{
+			name:    "purged room",
+			rsAPI:   &leaveTestRoomserverAPI{stubRoom: true},
+			wantMsg: "This server no longer has the state for this room",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fedReq := gomatrixserverlib.NewFederationRequest(
+				"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID,
+			)
+			if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+				t.Fatalf("failed to sign request: %s", err)
+			}
+			res := MakeLeave(
+				httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq,
+				cfg, tt.rsAPI, roomID, userID,
+			)
+			if res.Code != http.StatusNotFound {
+				t.Fatalf("expected status %d, got %d: %+v", http.StatusNotFound, res.Code, res.JSON)
+			}
+			merr, ok := res.JSON.(*jsonerror.MatrixError)
+			if !ok {
+				t.Fatalf("expected a *jsonerror.MatrixError, got %T", res.JSON)
+			}
+			if merr.ErrCode != "M_NOT_FOUND" || merr.Err != tt.wantMsg {
+				t.Errorf("expected M_NOT_FOUND %q, got %s %q", tt.wantMsg, merr.ErrCode, merr.Err)
+			}
+		})
+	}
+}
+
+func TestMakeLeaveDepthExceeded(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	rsAPI := &leaveTestRoomserverAPI{
+		roomVersion:    gomatrixserverlib.RoomVersionV6,
+		prevMembership: mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join),
+		// The latest events are already beyond the largest depth that can
+		// be represented in canonical JSON.
+		depth: 1<<53 + 1,
+	}
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID,
+	)
+	if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	res := MakeLeave(
+		httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq,
+		cfg, rsAPI, roomID, userID,
+	)
+	if res.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusInternalServerError, res.Code, res.JSON)
+	}
+	merr, ok := res.JSON.(*jsonerror.MatrixError)
+	if !ok {
+		t.Fatalf("expected a *jsonerror.MatrixError, got %T", res.JSON)
+	}
+	if merr.Err != "The depth of this room has exceeded the maximum allowed by its room version" {
+		t.Errorf("unexpected error message %q", merr.Err)
+	}
+}
+
+func TestMakeLeaveDebugAuthChain(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+		DebugAuthChainServers: []gomatrixserverlib.ServerName{testDestination},
+	}
+	emptyStateKey := ""
+	createBuilder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomCreate,
+		StateKey: &emptyStateKey,
+	}
+	if err = createBuilder.SetContent(map[string]interface{}{"creator": userID}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	create, err := createBuilder.Build(time.Now(), testDestination, "ed25519:test", key, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	join := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join)
+
+	makeLeave := func(query string, withCreate bool) util.JSONResponse {
+		rsAPI := &leaveTestRoomserverAPI{prevMembership: join}
+		if withCreate {
+			rsAPI.extraState = []*gomatrixserverlib.HeaderedEvent{create.Headered(testRoomVersion)}
+		}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID+query,
+		)
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		return MakeLeave(
+			httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, roomID, userID,
+		)
+	}
+
+	// Allowed leaves include the state that they were checked against.
+	res := makeLeave("?debug_auth_chain=true", true)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+	authChain := res.JSON.(MakeLeaveResponse).AuthChain
+	want := []DebugAuthEvent{
+		{EventID: join.EventID(), Type: gomatrixserverlib.MRoomMember, StateKey: userID},
+		{EventID: create.EventID(), Type: gomatrixserverlib.MRoomCreate, StateKey: ""},
+	}
+	if !reflect.DeepEqual(authChain, want) {
+		t.Errorf("expected auth chain %+v, got %+v", want, authChain)
+	}
+
+	// So do disallowed leaves, which is where it's most useful.
+	res = makeLeave("?debug_auth_chain=true", false)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusForbidden, res.Code, res.JSON)
+	}
+	if debugErr, ok := res.JSON.(makeLeaveDebugError); !ok || len(debugErr.AuthChain) != 1 {
+		t.Errorf("expected forbidden response to include the auth chain, got %+v", res.JSON)
+	}
+
+	// Without the query parameter nothing changes.
+	res = makeLeave("", true)
+	if authChain = res.JSON.(MakeLeaveResponse).AuthChain; authChain != nil {
+		t.Errorf("expected no auth chain without the query parameter, got %+v", authChain)
+	}
+
+	// Nor for servers that aren't allowed to debug.
+	cfg.DebugAuthChainServers = nil
+	res = makeLeave("?debug_auth_chain=true", true)
+	if authChain = res.JSON.(MakeLeaveResponse).AuthChain; authChain != nil {
+		t.Errorf("expected no auth chain for other servers, got %+v", authChain)
+	}
+	res = makeLeave("?debug_auth_chain=true", false)
+	if _, ok := res.JSON.(*jsonerror.MatrixError); !ok {
+		t.Errorf("expected a plain error for other servers, got %T", res.JSON)
+	}
+}
+
+func TestMakeLeavePriorMembership(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+	}
+	ban := mustCreateMemberEvent(t, key, testDestination, roomID, "@mod:white.orchard", userID, gomatrixserverlib.Ban)
+
+	for _, tc := range []struct {
+		name           string
+		prevMembership *gomatrixserverlib.HeaderedEvent
+		wantErr        string
+	}{
+		{"no prior membership", nil, "user is not in the room"},
+		{"banned", ban, "user is banned from the room"},
+	} {
+		rsAPI := &leaveTestRoomserverAPI{prevMembership: tc.prevMembership}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID,
+		)
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := MakeLeave(
+			httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, roomID, userID,
+		)
+		if res.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected status %d, got %d: %+v", tc.name, http.StatusForbidden, res.Code, res.JSON)
+		}
+		merr, ok := res.JSON.(*jsonerror.MatrixError)
+		if !ok || merr.ErrCode != "M_FORBIDDEN" || merr.Err != tc.wantErr {
+			t.Errorf("%s: expected M_FORBIDDEN %q, got %+v", tc.name, tc.wantErr, res.JSON)
+		}
+	}
+}
+
+type failingKeyRing struct {
+	err       error
+	verifyErr error
+}
+
+func (k *failingKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(reqs))
+	for i := range results {
+		results[i].Error = k.verifyErr
+	}
+	return results, nil
+}
+
+func mustCreateEvent(
+	t *testing.T, key ed25519.PrivateKey, roomID, sender string,
+	stateKey *string, content map[string]interface{},
+) *gomatrixserverlib.Event {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: stateKey,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), testDestination, "ed25519:test", key, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev
+}
+
+func TestValidateLeaveEvent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	leave := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{"membership": gomatrixserverlib.Leave})
+	join := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{"membership": gomatrixserverlib.Join})
+	badMembership := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{"membership": 1})
+	badReason := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{"membership": gomatrixserverlib.Leave, "reason": 42})
+	noStateKey := mustCreateEvent(t, key, roomID, userID, nil, map[string]interface{}{"membership": gomatrixserverlib.Leave})
+
+	testCases := []struct {
+		name     string
+		event    *gomatrixserverlib.Event
+		roomID   string
+		eventID  string
+		origin   gomatrixserverlib.ServerName
+		keys     gomatrixserverlib.JSONVerifier
+		wantCode LeaveEventErrorCode
+	}{
+		{"valid", leave, roomID, leave.EventID(), testDestination, &leaveTestKeyRing{}, 0},
+		{"wrong room ID", leave, "!other:kaer.morhen", leave.EventID(), testDestination, &leaveTestKeyRing{}, LeaveEventBadRoomID},
+		{"wrong event ID", leave, roomID, "$other:white.orchard", testDestination, &leaveTestKeyRing{}, LeaveEventBadEventID},
+		{"wrong origin", leave, roomID, leave.EventID(), testOrigin, &leaveTestKeyRing{}, LeaveEventBadOrigin},
+		{"missing state key", noStateKey, roomID, noStateKey.EventID(), testDestination, &leaveTestKeyRing{}, LeaveEventMissingStateKey},
+		{"bad signature", leave, roomID, leave.EventID(), testDestination, &failingKeyRing{verifyErr: errors.New("bad signature")}, LeaveEventBadSignature},
+		{"invalid membership", badMembership, roomID, badMembership.EventID(), testDestination, &leaveTestKeyRing{}, LeaveEventBadContent},
+		{"malformed reason", badReason, roomID, badReason.EventID(), testDestination, &leaveTestKeyRing{}, LeaveEventBadContent},
+		{"not a leave", join, roomID, join.EventID(), testDestination, &leaveTestKeyRing{}, LeaveEventNotLeave},
+	}
+	for _, tc := range testCases {
+		err := ValidateLeaveEvent(context.Background(), tc.event, tc.roomID, tc.eventID, tc.origin, tc.keys, true)
+		if tc.wantCode == 0 {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %s", tc.name, err)
+			}
+			continue
+		}
+		verr, ok := err.(*LeaveEventError)
+		if !ok {
+			t.Errorf("%s: expected *LeaveEventError, got %v", tc.name, err)
+			continue
+		}
+		if verr.Code != tc.wantCode {
+			t.Errorf("%s: expected code %d, got %d", tc.name, tc.wantCode, verr.Code)
+		}
+	}
+
+	err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, &failingKeyRing{err: errors.New("unavailable")}, true)
+	if _, ok := err.(*LeaveEventError); err == nil || ok {
+		t.Errorf("expected untyped error when keys can't be verified, got %v", err)
+	}
+}
+
+// rotatedKeyRing fails to find the signing key on the first attempt, as if
+// the origin had rotated its keys since they were last fetched.
+type rotatedKeyRing struct {
+	calls int
+}
+
+func (k *rotatedKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	k.calls++
+	return unknownKeyResults(reqs, k.calls == 1), nil
+}
+
+// refreshingKeyRing fails to find the signing key until it is refreshed.
+type refreshingKeyRing struct {
+	refreshes int
+	calls     int
+}
+
+func (k *refreshingKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	k.calls++
+	return unknownKeyResults(reqs, k.refreshes == 0), nil
+}
+
+func (k *refreshingKeyRing) RefreshKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	k.refreshes++
+	return nil
+}
+
+func unknownKeyResults(reqs []gomatrixserverlib.VerifyJSONRequest, unknown bool) []gomatrixserverlib.VerifyJSONResult {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(reqs))
+	if unknown {
+		for i := range results {
+			results[i].Error = fmt.Errorf("gomatrixserverlib: could not download key for %q", reqs[i].ServerName)
+		}
+	}
+	return results
+}
+
+func TestValidateLeaveEventRefreshesKeys(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	leave := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{"membership": gomatrixserverlib.Leave})
+
+	// The key is found on the second attempt.
+	keys := &rotatedKeyRing{}
+	if err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, keys, true); err != nil {
+		t.Errorf("expected leave to be valid after retrying, got %s", err)
+	}
+	if keys.calls != 2 {
+		t.Errorf("expected 2 verification attempts, got %d", keys.calls)
+	}
+
+	// The key is only found once the key ring has been refreshed.
+	refreshing := &refreshingKeyRing{}
+	if err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, refreshing, true); err != nil {
+		t.Errorf("expected leave to be valid after refreshing keys, got %s", err)
+	}
+	if refreshing.refreshes != 1 || refreshing.calls != 2 {
+		t.Errorf("expected 1 refresh and 2 verification attempts, got %d and %d", refreshing.refreshes, refreshing.calls)
+	}
+
+	// The key is never found, so verification is only retried once.
+	missing := &failingKeyRing{verifyErr: errors.New("gomatrixserverlib: could not download key for \"remote\"")}
+	counting := &countingKeyRing{JSONVerifier: missing}
+	err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, counting, true)
+	if verr, ok := err.(*LeaveEventError); !ok || verr.Code != LeaveEventBadSignature {
+		t.Errorf("expected bad signature error, got %v", err)
+	}
+	if counting.calls != 2 {
+		t.Errorf("expected 2 verification attempts, got %d", counting.calls)
+	}
+
+	// Bad signatures aren't retried.
+	counting = &countingKeyRing{JSONVerifier: &failingKeyRing{verifyErr: errors.New("bad signature")}}
+	_ = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, counting, true)
+	if counting.calls != 1 {
+		t.Errorf("expected 1 verification attempt for a bad signature, got %d", counting.calls)
+	}
+}
+
+// staticKeyDatabase is a gomatrixserverlib.KeyDatabase which always returns
+// the same key for every request.
+type staticKeyDatabase struct {
+	key gomatrixserverlib.PublicKeyLookupResult
+}
+
+func (d *staticKeyDatabase) FetcherName() string {
+	return "staticKeyDatabase"
+}
+
+func (d *staticKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(requests))
+	for req := range requests {
+		results[req] = d.key
+	}
+	return results, nil
+}
+
+func (d *staticKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+func TestValidateLeaveEventStrictKeyValidity(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	leave := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{"membership": gomatrixserverlib.Leave})
+
+	// The key hasn't been marked as expired, but its valid_until_ts passed
+	// just before the leave was sent, as with a server that hasn't refreshed
+	// its keys.
+	keys := &gomatrixserverlib.KeyRing{
+		KeyDatabase: &staticKeyDatabase{
+			key: gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes(pub)},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: leave.OriginServerTS() - 1,
+			},
+		},
+	}
+	err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, keys, true)
+	if verr, ok := err.(*LeaveEventError); !ok || verr.Code != LeaveEventBadSignature {
+		t.Errorf("expected bad signature error with strict key validity, got %v", err)
+	}
+	if err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, keys, false); err != nil {
+		t.Errorf("expected leave to be valid without strict key validity, got %s", err)
+	}
+
+	// Keys which have expired are rejected either way.
+	keys.KeyDatabase = &staticKeyDatabase{
+		key: gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes(pub)},
+			ExpiredTS: leave.OriginServerTS() - 1,
+		},
+	}
+	for _, strict := range []bool{true, false} {
+		err = ValidateLeaveEvent(context.Background(), leave, roomID, leave.EventID(), testDestination, keys, strict)
+		if verr, ok := err.(*LeaveEventError); !ok || verr.Code != LeaveEventBadSignature {
+			t.Errorf("expected bad signature error for an expired key (strict: %v), got %v", strict, err)
+		}
+	}
+}
+
+type countingKeyRing struct {
+	gomatrixserverlib.JSONVerifier
+	calls int
+}
+
+func (k *countingKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	k.calls++
+	return k.JSONVerifier.VerifyJSONs(ctx, reqs)
+}
+
+func TestLeaveOutcome(t *testing.T) {
+	testCases := []struct {
+		code int
+		want string
+	}{
+		{http.StatusOK, "ok"},
+		{http.StatusBadRequest, "bad_json"},
+		{http.StatusForbidden, "forbidden"},
+		{http.StatusNotFound, "not_found"},
+		{http.StatusInternalServerError, "internal_error"},
+		{http.StatusServiceUnavailable, "internal_error"},
+	}
+	for _, tc := range testCases {
+		if got := leaveOutcome(util.JSONResponse{Code: tc.code}); got != tc.want {
+			t.Errorf("code %d: expected outcome %q, got %q", tc.code, tc.want, got)
+		}
+	}
+	if leaveOriginBucket(testOrigin) != leaveOriginBucket(testOrigin) {
+		t.Errorf("expected origin buckets to be stable")
+	}
+}
+
+func TestLeaveOutcomeMetrics(t *testing.T) {
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testDestination,
+		},
+	}
+	rsAPI := &notReadyRoomserverAPI{}
+	roomID := "!roomid:kaer.morhen"
+	makeReq := gomatrixserverlib.NewFederationRequest(
+		"GET", testDestination, "/_matrix/federation/v1/make_leave/"+roomID+"/@userid:white.orchard",
+	)
+	bucket := leaveOriginBucket(makeReq.Origin())
+	makeCounter := leaveOutcomesTotal.WithLabelValues("make_leave", bucket, "internal_error")
+	sendCounter := leaveOutcomesTotal.WithLabelValues("send_leave", bucket, "internal_error")
+	makeBefore, sendBefore := testutil.ToFloat64(makeCounter), testutil.ToFloat64(sendCounter)
+
+	MakeLeave(
+		httptest.NewRequest("GET", makeReq.RequestURI(), nil), &makeReq,
+		cfg, rsAPI, roomID, "@userid:white.orchard",
+	)
+	sendReq := gomatrixserverlib.NewFederationRequest(
+		"PUT", testDestination, "/_matrix/federation/v2/send_leave/"+roomID+"/$event:white.orchard",
+	)
+	SendLeave(
+		httptest.NewRequest("PUT", sendReq.RequestURI(), nil), &sendReq,
+		cfg, rsAPI, nil, nil, nil, roomID, "$event:white.orchard",
+	)
+
+	if got := testutil.ToFloat64(makeCounter) - makeBefore; got != 1 {
+		t.Errorf("expected make_leave outcome to be counted once, got %v", got)
+	}
+	if got := testutil.ToFloat64(sendCounter) - sendBefore; got != 1 {
+		t.Errorf("expected send_leave outcome to be counted once, got %v", got)
+	}
+}
+
+func TestSendLeaveNotifiesLeave(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+
+	for _, allow := range []bool{true, false} {
+		cfg := &config.FederationAPI{
+			Matrix: &config.Global{
+				ServerName: testOrigin,
+			},
+			AllowLeaveFromBan: allow,
+		}
+		// Leaves are only accepted from a ban if allow_leave_from_ban is set,
+		// so the notifier should only be called then.
+		rsAPI := &leaveTestRoomserverAPI{
+			prevMembership: mustCreateMemberEvent(t, key, testOrigin, roomID, "@mod:kaer.morhen", userID, gomatrixserverlib.Ban),
+		}
+		leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		notifier := &leaveTestNotifier{}
+		SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, notifier, nil, roomID, leave.EventID(),
+		)
+
+		if !allow {
+			if len(notifier.notifications) != 0 {
+				t.Errorf("expected no notifications for a rejected leave, got %+v", notifier.notifications)
+			}
+			if len(rsAPI.evictions) != 0 {
+				t.Errorf("expected no eviction for a rejected leave, got %v", rsAPI.evictions)
+			}
+			continue
+		}
+		if len(notifier.notifications) != 1 {
+			t.Fatalf("expected 1 notification, got %d", len(notifier.notifications))
+		}
+		n := notifier.notifications[0]
+		if n.RoomID != roomID || n.UserID != userID || n.EventID != leave.EventID() || n.Timestamp == 0 {
+			t.Errorf("unexpected notification %+v", n)
+		}
+		if !reflect.DeepEqual(rsAPI.evictions, []string{roomID}) {
+			t.Errorf("expected eviction to be scheduled for %s, got %v", roomID, rsAPI.evictions)
+		}
+	}
+}
+
+func TestSendLeaveTombstoneHint(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	emptyStateKey := ""
+	tombstoneBuilder := gomatrixserverlib.EventBuilder{
+		Sender:   "@mod:kaer.morhen",
+		RoomID:   roomID,
+		Type:     "m.room.tombstone",
+		StateKey: &emptyStateKey,
+	}
+	if err = tombstoneBuilder.SetContent(map[string]interface{}{
+		"body":             "This room has moved",
+		"replacement_room": "!newroom:kaer.morhen",
+	}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	tombstone, err := tombstoneBuilder.Build(time.Now(), testOrigin, "ed25519:test", key, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		hint      bool
+		tombstone *gomatrixserverlib.HeaderedEvent
+		want      *LeaveReplacementRoom
+	}{
+		{"hint disabled", false, tombstone.Headered(testRoomVersion), nil},
+		{"no tombstone", true, nil, nil},
+		{"tombstone", true, tombstone.Headered(testRoomVersion), &LeaveReplacementRoom{
+			RoomID: "!newroom:kaer.morhen",
+			Body:   "This room has moved",
+		}},
+	} {
+		cfg := &config.FederationAPI{
+			Matrix: &config.Global{
+				ServerName: testOrigin,
+			},
+			LeaveTombstoneHint: tc.hint,
+		}
+		rsAPI := &leaveTestRoomserverAPI{
+			prevMembership: mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join),
+			tombstone:      tc.tombstone,
+		}
+		leave := mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Leave)
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+		)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d: %+v", tc.name, http.StatusOK, res.Code, res.JSON)
+		}
+		if len(rsAPI.inputRoomEvents) != 1 {
+			t.Errorf("%s: expected the leave to be accepted, got %d events", tc.name, len(rsAPI.inputRoomEvents))
+		}
+		got := res.JSON.(SendLeaveResponse).ReplacementRoom
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected replacement room %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestSendLeaveKeepsThirdPartyInviteContent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	rsAPI := &leaveTestRoomserverAPI{
+		prevMembership: mustCreateMemberEvent(t, key, testDestination, roomID, userID, userID, gomatrixserverlib.Join),
+	}
+	leave := mustCreateEvent(t, key, roomID, userID, &userID, map[string]interface{}{
+		"membership": gomatrixserverlib.Leave,
+		"third_party_invite": map[string]interface{}{
+			"display_name": "Geralt",
+			"signed": map[string]interface{}{
+				"mxid":  userID,
+				"token": "abc123",
+				"signatures": map[string]interface{}{
+					"kaer.morhen": map[string]interface{}{
+						"ed25519:0": "c2lnbmF0dXJl",
+					},
+				},
+			},
+		},
+	})
+	// The signature is checked against the redacted event, which doesn't
+	// have the third party invite, but the roomserver needs all of it.
+	if bytes.Contains(leave.Redact().Content(), []byte("third_party_invite")) {
+		t.Fatalf("expected redaction to strip third_party_invite")
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+leave.EventID(),
+	)
+	if err = fedReq.SetContent(json.RawMessage(leave.JSON())); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	res := SendLeave(
+		httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+		cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, leave.EventID(),
+	)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+	}
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Fatalf("expected 1 input event, got %d", len(rsAPI.inputRoomEvents))
+	}
+	sent := rsAPI.inputRoomEvents[0].Event
+	if sent.EventID() != leave.EventID() {
+		t.Errorf("expected event %s, got %s", leave.EventID(), sent.EventID())
+	}
+	if !bytes.Equal(sent.Content(), leave.Content()) {
+		t.Errorf("expected content %s, got %s", leave.Content(), sent.Content())
+	}
+}
+
+// flakyInputRoomserverAPI returns each of the responses to InputRoomEvents in
+// turn, repeating the last one once they run out.
+type flakyInputRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	responses []api.InputRoomEventsResponse
+	calls     int
+}
+
+func (r *flakyInputRoomserverAPI) InputRoomEvents(
+	ctx context.Context,
+	req *api.InputRoomEventsRequest,
+	res *api.InputRoomEventsResponse,
+) {
+	i := r.calls
+	if i >= len(r.responses) {
+		i = len(r.responses) - 1
+	}
+	*res = r.responses[i]
+	r.calls++
+}
+
+func TestInputLeaveEventRetries(t *testing.T) {
+	busy := api.InputRoomEventsResponse{ErrMsg: "database is locked", Transient: true}
+	testCases := []struct {
+		name        string
+		retries     int
+		responses   []api.InputRoomEventsResponse
+		wantCalls   int
+		wantRetries float64
+		wantErr     bool
+	}{
+		{"transient error then success", 3, []api.InputRoomEventsResponse{busy, {}}, 2, 1, false},
+		{"transient error until out of retries", 1, []api.InputRoomEventsResponse{busy}, 2, 1, true},
+		{"not allowed", 3, []api.InputRoomEventsResponse{{ErrMsg: "leave is not allowed", NotAllowed: true}}, 1, 0, true},
+		{"deterministic error", 3, []api.InputRoomEventsResponse{{ErrMsg: "invalid auth events"}}, 1, 0, true},
+	}
+	for _, tc := range testCases {
+		rsAPI := &flakyInputRoomserverAPI{responses: tc.responses}
+		cfg := &config.FederationAPI{SendEventsRetries: tc.retries}
+		before := testutil.ToFloat64(sendLeaveRetriesTotal)
+		res := inputLeaveEvent(context.Background(), cfg, rsAPI, &api.InputRoomEventsRequest{})
+		if rsAPI.calls != tc.wantCalls {
+			t.Errorf("%s: expected %d inputs, got %d", tc.name, tc.wantCalls, rsAPI.calls)
+		}
+		if got := testutil.ToFloat64(sendLeaveRetriesTotal) - before; got != tc.wantRetries {
+			t.Errorf("%s: expected %v retries to be counted, got %v", tc.name, tc.wantRetries, got)
+		}
+		if (res.ErrMsg != "") != tc.wantErr {
+			t.Errorf("%s: expected error %v, got %q", tc.name, tc.wantErr, res.ErrMsg)
+		}
+	}
+}
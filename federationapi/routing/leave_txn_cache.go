@@ -0,0 +1,154 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// MakeLeaveTxnIDHeader is the header that a remote server can set on
+// make_leave requests to get the same event template back when it retries.
+const MakeLeaveTxnIDHeader = "X-Matrix-Txn-Id"
+
+const (
+	// makeLeaveTxnTTL is how long a make_leave response is returned for
+	// repeated requests with the same transaction ID.
+	makeLeaveTxnTTL = 5 * time.Minute
+	// makeLeaveTxnCacheSize is the maximum number of make_leave responses
+	// that are cached at once.
+	makeLeaveTxnCacheSize = 10000
+)
+
+type makeLeaveTxnKey struct {
+	origin gomatrixserverlib.ServerName
+	txnID  string
+	roomID string
+	userID string
+}
+
+type makeLeaveTxnEntry struct {
+	key     makeLeaveTxnKey
+	res     util.JSONResponse
+	expires time.Time
+}
+
+// makeLeaveTxnCache remembers successful make_leave responses by the
+// transaction ID given by the requesting server, so that retries get an
+// identical event template to sign. Transaction IDs are scoped to the
+// requesting server, room and user. Entries expire after a fixed TTL and,
+// as they all have the same TTL, the oldest entry is evicted first when
+// the cache is full.
+type makeLeaveTxnCache struct {
+	mu      sync.Mutex
+	entries map[makeLeaveTxnKey]*list.Element
+	order   *list.List // of *makeLeaveTxnEntry, oldest first
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+}
+
+func newMakeLeaveTxnCache(ttl time.Duration, maxSize int) *makeLeaveTxnCache {
+	return &makeLeaveTxnCache{
+		entries: make(map[makeLeaveTxnKey]*list.Element),
+		order:   list.New(),
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+	}
+}
+
+// MakeLeave returns the cached response for the transaction ID in the
+// request, if there is one, or otherwise calls makeLeave and caches the
+// response if it was successful. Requests without a transaction ID are
+// passed straight through.
+func (c *makeLeaveTxnCache) MakeLeave(
+	httpReq *http.Request, request *gomatrixserverlib.FederationRequest,
+	roomID, userID string, makeLeave func() util.JSONResponse,
+) util.JSONResponse {
+	txnID := httpReq.Header.Get(MakeLeaveTxnIDHeader)
+	if txnID == "" {
+		return makeLeave()
+	}
+	key := makeLeaveTxnKey{
+		origin: request.Origin(),
+		txnID:  txnID,
+		roomID: roomID,
+		userID: userID,
+	}
+	if res, ok := c.get(key); ok {
+		return res
+	}
+	res := makeLeave()
+	if res.Code == http.StatusOK {
+		res = c.add(key, res)
+	}
+	return res
+}
+
+func (c *makeLeaveTxnCache) get(key makeLeaveTxnKey) (util.JSONResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictExpired()
+	el, ok := c.entries[key]
+	if !ok {
+		return util.JSONResponse{}, false
+	}
+	return el.Value.(*makeLeaveTxnEntry).res, true
+}
+
+// add stores the response for the key and returns the stored response, which
+// is the response of an earlier request if one raced this one to the cache.
+func (c *makeLeaveTxnCache) add(key makeLeaveTxnKey, res util.JSONResponse) util.JSONResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictExpired()
+	if el, ok := c.entries[key]; ok {
+		// Another request with the same transaction ID got here first, so
+		// keep its response as that may already have been returned.
+		return el.Value.(*makeLeaveTxnEntry).res
+	}
+	for c.order.Len() >= c.maxSize {
+		c.remove(c.order.Front())
+	}
+	c.entries[key] = c.order.PushBack(&makeLeaveTxnEntry{
+		key:     key,
+		res:     res,
+		expires: c.now().Add(c.ttl),
+	})
+	return res
+}
+
+// evictExpired removes expired entries. The caller must hold the lock.
+func (c *makeLeaveTxnCache) evictExpired() {
+	now := c.now()
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		if now.Before(el.Value.(*makeLeaveTxnEntry).expires) {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+// remove removes the entry. The caller must hold the lock.
+func (c *makeLeaveTxnCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*makeLeaveTxnEntry).key)
+}
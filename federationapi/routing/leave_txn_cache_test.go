@@ -0,0 +1,170 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func TestMakeLeaveTxnCache(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID,
+	)
+	if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+
+	now := time.Unix(1000, 0)
+	cache := newMakeLeaveTxnCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	// Each call to makeLeave builds a different response.
+	builds := 0
+	code := http.StatusOK
+	makeLeave := func() util.JSONResponse {
+		builds++
+		return util.JSONResponse{Code: code, JSON: builds}
+	}
+	call := func(txnID string) util.JSONResponse {
+		t.Helper()
+		httpReq := httptest.NewRequest("GET", fedReq.RequestURI(), nil)
+		if txnID != "" {
+			httpReq.Header.Set(MakeLeaveTxnIDHeader, txnID)
+		}
+		return cache.MakeLeave(httpReq, &fedReq, roomID, userID, makeLeave)
+	}
+
+	// Without a transaction ID nothing is cached.
+	if call("").JSON != 1 || call("").JSON != 2 {
+		t.Errorf("expected requests without a transaction ID to be rebuilt")
+	}
+
+	// Repeated requests with the same transaction ID get the same response.
+	first := call("txn1")
+	if first.JSON != 3 {
+		t.Fatalf("expected a new response, got %+v", first.JSON)
+	}
+	if res := call("txn1"); res.JSON != first.JSON {
+		t.Errorf("expected the cached response %+v, got %+v", first.JSON, res.JSON)
+	}
+	if res := call("txn2"); res.JSON != 4 {
+		t.Errorf("expected a new response for a different transaction ID, got %+v", res.JSON)
+	}
+
+	// Once expired the response is rebuilt.
+	now = now.Add(time.Minute)
+	if res := call("txn1"); res.JSON != 5 {
+		t.Errorf("expected a new response after expiry, got %+v", res.JSON)
+	}
+
+	// The cache is bounded, so adding a third entry evicts the oldest.
+	call("txn2") // 6
+	call("txn3") // 7
+	if res := call("txn1"); res.JSON != 8 {
+		t.Errorf("expected the oldest entry to have been evicted, got %+v", res.JSON)
+	}
+	if res := call("txn3"); res.JSON != 7 {
+		t.Errorf("expected the newest entry to be cached, got %+v", res.JSON)
+	}
+
+	// Failed responses aren't cached.
+	code = http.StatusInternalServerError
+	call("txn4")
+	code = http.StatusOK
+	if res := call("txn4"); res.JSON != 10 {
+		t.Errorf("expected a failed response not to be cached, got %+v", res.JSON)
+	}
+}
+
+func TestMakeLeaveTxnCacheScopedToOrigin(t *testing.T) {
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cache := newMakeLeaveTxnCache(time.Minute, 10)
+	builds := 0
+	makeLeave := func() util.JSONResponse {
+		builds++
+		return util.JSONResponse{Code: http.StatusOK, JSON: jsonerror.Unknown("unused")}
+	}
+	for _, origin := range []gomatrixserverlib.ServerName{testDestination, "other.server"} {
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID,
+		)
+		if err = fedReq.Sign(origin, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		httpReq := httptest.NewRequest("GET", fedReq.RequestURI(), nil)
+		httpReq.Header.Set(MakeLeaveTxnIDHeader, "txn")
+		cache.MakeLeave(httpReq, &fedReq, roomID, userID, makeLeave)
+	}
+	if builds != 2 {
+		t.Errorf("expected transaction IDs from different servers not to collide, got %d builds", builds)
+	}
+}
+
+func TestMakeLeaveTxnCacheRace(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		"GET", testOrigin, "/_matrix/federation/v1/make_leave/"+roomID+"/"+userID,
+	)
+	if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	cache := newMakeLeaveTxnCache(time.Minute, 10)
+	call := func(makeLeave func() util.JSONResponse) util.JSONResponse {
+		httpReq := httptest.NewRequest("GET", fedReq.RequestURI(), nil)
+		httpReq.Header.Set(MakeLeaveTxnIDHeader, "txn")
+		return cache.MakeLeave(httpReq, &fedReq, roomID, userID, makeLeave)
+	}
+
+	// A second request with the same transaction ID completes while the
+	// first is still building its response, so both must get the response
+	// of the second.
+	var second util.JSONResponse
+	first := call(func() util.JSONResponse {
+		second = call(func() util.JSONResponse {
+			return util.JSONResponse{Code: http.StatusOK, JSON: "second"}
+		})
+		return util.JSONResponse{Code: http.StatusOK, JSON: "first"}
+	})
+	if second.JSON != "second" {
+		t.Fatalf("expected the second request to build its own response, got %+v", second.JSON)
+	}
+	if first.JSON != second.JSON {
+		t.Errorf("expected racing requests to get the same response, got %+v and %+v", first.JSON, second.JSON)
+	}
+}
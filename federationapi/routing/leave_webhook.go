@@ -0,0 +1,152 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// leaveWebhookInitialBackoff is how long to wait before the first retry
+// when the leave webhook fails.
+const leaveWebhookInitialBackoff = time.Second
+
+// leaveWebhookRequestsTotal counts leave webhook delivery attempts by
+// outcome: "success", "retry" or "failure", where failure means that
+// all retries were exhausted.
+var leaveWebhookRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "leave_webhook_requests",
+		Help:      "Number of leave webhook delivery attempts by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(leaveWebhookRequestsTotal)
+}
+
+// LeaveNotification is sent to the leave webhook when a remote user has
+// left a room via /send_leave.
+type LeaveNotification struct {
+	RoomID  string `json:"room_id"`
+	UserID  string `json:"user_id"`
+	EventID string `json:"event_id"`
+	// The time that this server accepted the leave, in milliseconds since
+	// the epoch. The origin_server_ts of the event is set by the remote
+	// server so can't be relied upon.
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+// LeaveNotifier is told about remote users leaving rooms via /send_leave.
+// NotifyLeave must not block, as it is called while handling the request.
+type LeaveNotifier interface {
+	NotifyLeave(notification LeaveNotification)
+}
+
+// LeaveWebhook is a LeaveNotifier which POSTs each notification as JSON to
+// an HTTP endpoint in the background. Failed requests are retried with an
+// exponential backoff, and given up on after the configured number of
+// retries. Failures are logged and metered but otherwise ignored.
+type LeaveWebhook struct {
+	url        string
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// NewLeaveWebhook returns a LeaveWebhook for the given config, or nil if no
+// webhook URL is configured.
+func NewLeaveWebhook(cfg *config.LeaveWebhook) *LeaveWebhook {
+	if cfg.URL == "" {
+		return nil
+	}
+	return &LeaveWebhook{
+		url: cfg.URL,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond,
+		},
+		maxRetries: cfg.MaxRetries,
+		backoff:    leaveWebhookInitialBackoff,
+	}
+}
+
+// NotifyLeave implements LeaveNotifier.
+func (w *LeaveWebhook) NotifyLeave(notification LeaveNotification) {
+	go func() {
+		if err := w.deliver(context.Background(), notification); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"room_id":  notification.RoomID,
+				"user_id":  notification.UserID,
+				"event_id": notification.EventID,
+			}).Error("Failed to call leave webhook")
+		}
+	}()
+}
+
+// deliver POSTs the notification to the webhook, retrying on failure.
+func (w *LeaveWebhook) deliver(ctx context.Context, notification LeaveNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		if err = w.post(ctx, body); err == nil {
+			leaveWebhookRequestsTotal.WithLabelValues("success").Inc()
+			return nil
+		}
+		if attempt >= w.maxRetries {
+			leaveWebhookRequestsTotal.WithLabelValues("failure").Inc()
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		leaveWebhookRequestsTotal.WithLabelValues("retry").Inc()
+		logrus.WithError(err).Warnf("Leave webhook failed, retrying in %s", backoff)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *LeaveWebhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestLeaveWebhookRetries(t *testing.T) {
+	want := LeaveNotification{
+		RoomID:    "!roomid:kaer.morhen",
+		UserID:    "@userid:white.orchard",
+		EventID:   "$event:white.orchard",
+		Timestamp: 1234,
+	}
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var got LeaveNotification
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode webhook body: %s", err)
+		}
+		if got != want {
+			t.Errorf("expected notification %+v, got %+v", want, got)
+		}
+		// Fail the first two requests.
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	webhook := NewLeaveWebhook(&config.LeaveWebhook{URL: srv.URL, MaxRetries: 3, TimeoutMS: 1000})
+	webhook.backoff = time.Millisecond
+	if err := webhook.deliver(context.Background(), want); err != nil {
+		t.Fatalf("expected delivery to succeed, got %s", err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestLeaveWebhookGivesUp(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	webhook := NewLeaveWebhook(&config.LeaveWebhook{URL: srv.URL, MaxRetries: 1, TimeoutMS: 1000})
+	webhook.backoff = time.Millisecond
+	if err := webhook.deliver(context.Background(), LeaveNotification{}); err == nil {
+		t.Fatalf("expected delivery to fail")
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestLeaveWebhookTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	webhook := NewLeaveWebhook(&config.LeaveWebhook{URL: srv.URL, MaxRetries: 0, TimeoutMS: 10})
+	if err := webhook.deliver(context.Background(), LeaveNotification{}); err == nil {
+		t.Fatalf("expected delivery to time out")
+	}
+}
+
+func TestNewLeaveWebhookDisabled(t *testing.T) {
+	if webhook := NewLeaveWebhook(&config.LeaveWebhook{}); webhook != nil {
+		t.Errorf("expected no webhook without a URL")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// federationHandler is the signature of the handlers passed to
+// httputil.MakeFedAPI, which are called once the request has been
+// authenticated.
+type federationHandler func(
+	httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string,
+) util.JSONResponse
+
+// federationMiddleware wraps a federationHandler, e.g. to check something
+// about the request before calling the next handler. A middleware rejects a
+// request by returning a response without calling the next handler.
+type federationMiddleware func(next federationHandler) federationHandler
+
+// chainFederationMiddleware wraps the handler in the middlewares. The first
+// middleware is the outermost, so sees the request first.
+func chainFederationMiddleware(handler federationHandler, middlewares ...federationMiddleware) federationHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// recoverFromPanics turns a panic in the next handler, e.g. from a bug in
+// gomatrixserverlib, into a 500 response so that it doesn't take down the
+// server. The stack is logged along with the request.
+func recoverFromPanics() federationMiddleware {
+	return func(next federationHandler) federationHandler {
+		return func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) (res util.JSONResponse) {
+			defer func() {
+				if r := recover(); r != nil {
+					util.GetLogger(httpReq.Context()).WithFields(logrus.Fields{
+						"origin": request.Origin(),
+						"method": httpReq.Method,
+						"path":   httpReq.URL.Path,
+						"stack":  string(debug.Stack()),
+					}).WithError(fmt.Errorf("%v", r)).Error("Federation handler panicked")
+					res = jsonerror.InternalServerError()
+				}
+			}()
+			return next(httpReq, request, vars)
+		}
+	}
+}
+
+// requireServerAllowedInRoom rejects requests from servers which are banned
+// from the room in the roomID path variable by the server ACLs.
+func requireServerAllowedInRoom(rsAPI roomserverAPI.RoomserverInternalAPI) federationMiddleware {
+	return func(next federationHandler) federationHandler {
+		return func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			return next(httpReq, request, vars)
+		}
+	}
+}
+
+// requireUserFromOrigin rejects requests where the user ID in the given
+// path variable isn't valid or doesn't belong to the origin server, so that
+// servers can only act on behalf of their own users. The action is used in
+// the error message, e.g. "leave".
+func requireUserFromOrigin(userIDVar, action string) federationMiddleware {
+	return func(next federationHandler) federationHandler {
+		return func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			_, domain, err := validateUserID(vars[userIDVar])
+			if err != nil {
+				return invalidUserIDResponse(err)
+			}
+			if domain != request.Origin() {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("The " + action + " must be sent by the server of the user"),
+				}
+			}
+			return next(httpReq, request, vars)
+		}
+	}
+}
+
+// requireRoomAllowed rejects requests for rooms in the roomID path variable
+// which match the denylist, or which don't match the allowlist if it isn't
+// empty. The action is used in the error message, e.g. "leave".
+func requireRoomAllowed(allowlist, denylist []*regexp.Regexp, action string) federationMiddleware {
+	return func(next federationHandler) federationHandler {
+		return func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if !roomAllowed(vars["roomID"], allowlist, denylist) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("This server does not accept federated " + action + "s for this room"),
+				}
+			}
+			return next(httpReq, request, vars)
+		}
+	}
+}
+
+func roomAllowed(roomID string, allowlist, denylist []*regexp.Regexp) bool {
+	for _, re := range denylist {
+		if re.MatchString(roomID) {
+			return false
+		}
+	}
+	if len(allowlist) == 0 {
+		return true
+	}
+	for _, re := range allowlist {
+		if re.MatchString(roomID) {
+			return true
+		}
+	}
+	return false
+}
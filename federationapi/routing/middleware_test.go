@@ -0,0 +1,349 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type aclTestRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	bannedRooms map[string]bool
+}
+
+func (r *aclTestRoomserverAPI) QueryServerBannedFromRoom(
+	ctx context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse,
+) error {
+	res.Banned = r.bannedRooms[req.RoomID]
+	return nil
+}
+
+func mustCreateMiddlewareRequest(t *testing.T, path string) (*http.Request, *gomatrixserverlib.FederationRequest) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	fedReq := gomatrixserverlib.NewFederationRequest("GET", testOrigin, path)
+	if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	return httptest.NewRequest("GET", fedReq.RequestURI(), nil), &fedReq
+}
+
+func TestChainFederationMiddleware(t *testing.T) {
+	var calls []string
+	recordingMiddleware := func(name string, reject bool) federationMiddleware {
+		return func(next federationHandler) federationHandler {
+			return func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				calls = append(calls, name)
+				if reject {
+					return util.JSONResponse{Code: http.StatusTeapot}
+				}
+				return next(httpReq, request, vars)
+			}
+		}
+	}
+	handler := func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+		calls = append(calls, "handler")
+		return util.JSONResponse{Code: http.StatusOK}
+	}
+	httpReq, fedReq := mustCreateMiddlewareRequest(t, "/test")
+
+	tests := []struct {
+		name      string
+		rejectB   bool
+		wantCode  int
+		wantCalls []string
+	}{
+		{
+			name:      "all pass",
+			wantCode:  http.StatusOK,
+			wantCalls: []string{"a", "b", "handler"},
+		},
+		{
+			name:      "second rejects",
+			rejectB:   true,
+			wantCode:  http.StatusTeapot,
+			wantCalls: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		calls = nil
+		chained := chainFederationMiddleware(handler, recordingMiddleware("a", false), recordingMiddleware("b", tt.rejectB))
+		res := chained(httpReq, fedReq, nil)
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantCode, res.Code)
+		}
+		if !reflect.DeepEqual(calls, tt.wantCalls) {
+			t.Errorf("%s: expected calls %v, got %v", tt.name, tt.wantCalls, calls)
+		}
+	}
+}
+
+func TestLeaveMiddleware(t *testing.T) {
+	rsAPI := &aclTestRoomserverAPI{
+		bannedRooms: map[string]bool{"!banned:kaer.morhen": true},
+	}
+	// the same checks as make_leave, in the same order
+	handler := chainFederationMiddleware(
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return util.JSONResponse{Code: http.StatusOK}
+		},
+		requireServerAllowedInRoom(rsAPI),
+		requireUserFromOrigin("userID", "leave"),
+	)
+	tests := []struct {
+		name     string
+		roomID   string
+		userID   string
+		wantCode int
+		wantErr  string
+	}{
+		{
+			name:     "allowed",
+			roomID:   "!room:kaer.morhen",
+			userID:   "@alice:white.orchard",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "banned by ACLs",
+			roomID:   "!banned:kaer.morhen",
+			userID:   "@alice:white.orchard",
+			wantCode: http.StatusForbidden,
+			wantErr:  "M_FORBIDDEN",
+		},
+		{
+			name:     "user on another server",
+			roomID:   "!room:kaer.morhen",
+			userID:   "@alice:kaer.morhen",
+			wantCode: http.StatusForbidden,
+			wantErr:  "M_FORBIDDEN",
+		},
+		{
+			name:     "empty localpart",
+			roomID:   "!room:kaer.morhen",
+			userID:   "@:white.orchard",
+			wantCode: http.StatusBadRequest,
+			wantErr:  "M_INVALID_PARAM",
+		},
+		{
+			name:     "no domain",
+			roomID:   "!room:kaer.morhen",
+			userID:   "@alice",
+			wantCode: http.StatusBadRequest,
+			wantErr:  "M_INVALID_PARAM",
+		},
+		{
+			name:     "IDN domain",
+			roomID:   "!room:kaer.morhen",
+			userID:   "@alice:bücher.example",
+			wantCode: http.StatusBadRequest,
+			wantErr:  "M_INVALID_PARAM",
+		},
+		{
+			name:     "too long",
+			roomID:   "!room:kaer.morhen",
+			userID:   "@" + strings.Repeat("a", maxUserIDLength) + ":white.orchard",
+			wantCode: http.StatusBadRequest,
+			wantErr:  "M_INVALID_PARAM",
+		},
+	}
+	httpReq, fedReq := mustCreateMiddlewareRequest(t, "/test")
+	for _, tt := range tests {
+		res := handler(httpReq, fedReq, map[string]string{"roomID": tt.roomID, "userID": tt.userID})
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: expected status %d, got %d: %+v", tt.name, tt.wantCode, res.Code, res.JSON)
+			continue
+		}
+		if tt.wantErr != "" && errCode(t, res) != tt.wantErr {
+			t.Errorf("%s: expected %s, got %+v", tt.name, tt.wantErr, res.JSON)
+		}
+	}
+}
+
+func TestRequireRoomAllowed(t *testing.T) {
+	mustCompile := func(patterns ...string) []*regexp.Regexp {
+		t.Helper()
+		compiled, err := config.CompileRoomIDPatterns(patterns)
+		if err != nil {
+			t.Fatalf("failed to compile patterns: %s", err)
+		}
+		return compiled
+	}
+	tests := []struct {
+		name      string
+		allowlist []*regexp.Regexp
+		denylist  []*regexp.Regexp
+		roomID    string
+		want      bool
+	}{
+		{
+			name:   "default permit",
+			roomID: "!room:kaer.morhen",
+			want:   true,
+		},
+		{
+			name:      "allowed by room ID",
+			allowlist: mustCompile("!room:kaer.morhen"),
+			roomID:    "!room:kaer.morhen",
+			want:      true,
+		},
+		{
+			name:      "allowed by regex",
+			allowlist: mustCompile("^!.*:kaer\\.morhen"),
+			roomID:    "!room:kaer.morhen",
+			want:      true,
+		},
+		{
+			name:      "not in allowlist",
+			allowlist: mustCompile("!other:kaer.morhen", "^!.*:white\\.orchard"),
+			roomID:    "!room:kaer.morhen",
+			want:      false,
+		},
+		{
+			name:      "room ID must match exactly",
+			allowlist: mustCompile("!room:kaer.morhe"),
+			roomID:    "!room:kaer.morhen",
+			want:      false,
+		},
+		{
+			name:      "room ID is not a regex",
+			allowlist: mustCompile("!room:kaer.morhe."),
+			roomID:    "!room:kaer.morhen",
+			want:      false,
+		},
+		{
+			name:      "regex must match whole room ID",
+			allowlist: mustCompile("^!room"),
+			roomID:    "!room:kaer.morhen",
+			want:      false,
+		},
+		{
+			name:     "denied by room ID",
+			denylist: mustCompile("!room:kaer.morhen"),
+			roomID:   "!room:kaer.morhen",
+			want:     false,
+		},
+		{
+			name:     "not in denylist",
+			denylist: mustCompile("^!.*:white\\.orchard"),
+			roomID:   "!room:kaer.morhen",
+			want:     true,
+		},
+		{
+			name:      "denylist takes precedence",
+			allowlist: mustCompile("^!.*:kaer\\.morhen"),
+			denylist:  mustCompile("!room:kaer.morhen"),
+			roomID:    "!room:kaer.morhen",
+			want:      false,
+		},
+	}
+	httpReq, fedReq := mustCreateMiddlewareRequest(t, "/test")
+	for _, tt := range tests {
+		handler := chainFederationMiddleware(
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				return util.JSONResponse{Code: http.StatusOK}
+			},
+			requireRoomAllowed(tt.allowlist, tt.denylist, "leave"),
+		)
+		res := handler(httpReq, fedReq, map[string]string{"roomID": tt.roomID})
+		if tt.want && res.Code != http.StatusOK {
+			t.Errorf("%s: expected room to be allowed, got %d: %+v", tt.name, res.Code, res.JSON)
+		}
+		if !tt.want && (res.Code != http.StatusForbidden || errCode(t, res) != "M_FORBIDDEN") {
+			t.Errorf("%s: expected 403 M_FORBIDDEN, got %d: %+v", tt.name, res.Code, res.JSON)
+		}
+	}
+}
+
+// panickingRoomserverAPI panics when asked about a room, as if there were a
+// bug somewhere underneath the leave handlers.
+type panickingRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+}
+
+func (r *panickingRoomserverAPI) Ready(ctx context.Context) bool {
+	return true
+}
+
+func (r *panickingRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	panic("QueryLatestEventsAndState")
+}
+
+func (r *panickingRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse,
+) error {
+	panic("QueryRoomVersionForRoom")
+}
+
+func TestRecoverFromPanics(t *testing.T) {
+	rsAPI := &panickingRoomserverAPI{}
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	roomID := "!room:kaer.morhen"
+	userID := "@alice:white.orchard"
+	tests := []struct {
+		name    string
+		handler federationHandler
+	}{
+		{
+			name: "make_leave",
+			handler: func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				return MakeLeave(httpReq, request, cfg, rsAPI, vars["roomID"], vars["eventID"])
+			},
+		},
+		{
+			name: "send_leave",
+			handler: func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				return SendLeave(httpReq, request, cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, vars["roomID"], vars["eventID"])
+			},
+		},
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	// send_leave needs a body to get as far as the roomserver
+	fedReq := gomatrixserverlib.NewFederationRequest("PUT", testOrigin, "/test")
+	if err = fedReq.SetContent(map[string]interface{}{"type": gomatrixserverlib.MRoomMember}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	httpReq := httptest.NewRequest("PUT", fedReq.RequestURI(), nil)
+	for _, tt := range tests {
+		handler := chainFederationMiddleware(tt.handler, recoverFromPanics())
+		res := handler(httpReq, &fedReq, map[string]string{"roomID": roomID, "eventID": userID})
+		if res.Code != http.StatusInternalServerError || errCode(t, res) != "M_UNKNOWN" {
+			t.Errorf("%s: expected 500 M_UNKNOWN, got %d: %+v", tt.name, res.Code, res.JSON)
+		}
+	}
+
+	// Responses from handlers which don't panic are left alone.
+	handler := chainFederationMiddleware(
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return util.JSONResponse{Code: http.StatusOK}
+		},
+		recoverFromPanics(),
+	)
+	if res := handler(httpReq, &fedReq, nil); res.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %+v", res.Code, res.JSON)
+	}
+}
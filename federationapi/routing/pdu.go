@@ -0,0 +1,198 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// InboundPDUError is returned by parseInboundPDU when an event received
+// over federation is malformed for its room version.
+type InboundPDUError struct {
+	Err error
+}
+
+func (e *InboundPDUError) Error() string {
+	return fmt.Sprintf("malformed event: %s", e.Err)
+}
+
+func (e *InboundPDUError) Unwrap() error {
+	return e.Err
+}
+
+// parseInboundPDU parses an event received over federation in the given
+// room version. Unlike NewEventFromUntrustedJSON on its own it also checks
+// that the fields that the rest of Dendrite relies on are present, and it
+// never panics, however broken the JSON is. It returns an
+// UnsupportedRoomVersionError if the room version isn't supported, and an
+// *InboundPDUError if the event is malformed.
+func parseInboundPDU(pdu []byte, roomVersion gomatrixserverlib.RoomVersion) (event *gomatrixserverlib.Event, err error) {
+	return parseInboundPDUWith(pdu, roomVersion, gomatrixserverlib.NewEventFromUntrustedJSON)
+}
+
+// parseTrustedInboundPDU is like parseInboundPDU but skips the content hash
+// checks. It is only for the v1 invite API, where the unsigned section of
+// the event must be kept.
+func parseTrustedInboundPDU(pdu []byte, roomVersion gomatrixserverlib.RoomVersion) (event *gomatrixserverlib.Event, err error) {
+	return parseInboundPDUWith(pdu, roomVersion, func(pdu []byte, roomVersion gomatrixserverlib.RoomVersion) (*gomatrixserverlib.Event, error) {
+		return gomatrixserverlib.NewEventFromTrustedJSON(pdu, false, roomVersion)
+	})
+}
+
+func parseInboundPDUWith(
+	pdu []byte, roomVersion gomatrixserverlib.RoomVersion,
+	parse func([]byte, gomatrixserverlib.RoomVersion) (*gomatrixserverlib.Event, error),
+) (event *gomatrixserverlib.Event, err error) {
+	defer func() {
+		// gomatrixserverlib can panic on some malformed events, which would
+		// otherwise take the whole request down with it.
+		if r := recover(); r != nil {
+			event = nil
+			err = &InboundPDUError{fmt.Errorf("failed to parse event: %v", r)}
+		}
+	}()
+	event, err = parse(pdu, roomVersion)
+	if err != nil {
+		if _, ok := err.(gomatrixserverlib.UnsupportedRoomVersionError); ok {
+			return nil, err
+		}
+		return nil, &InboundPDUError{err}
+	}
+	if err = validateInboundPDU(event); err != nil {
+		return nil, &InboundPDUError{err}
+	}
+	return event, nil
+}
+
+// validateInboundPDU checks the fields of a parsed event which
+// gomatrixserverlib doesn't.
+func validateInboundPDU(event *gomatrixserverlib.Event) error {
+	if event.Type() == "" {
+		return errors.New("event has no type")
+	}
+	if event.Depth() < 0 {
+		return fmt.Errorf("event has negative depth %d", event.Depth())
+	}
+	if event.Type() == gomatrixserverlib.MRoomMember {
+		if event.StateKey() == nil {
+			return errors.New("membership event has no state key")
+		}
+		membership, err := event.Membership()
+		if err != nil {
+			return fmt.Errorf("membership event has invalid membership: %w", err)
+		}
+		switch membership {
+		case gomatrixserverlib.Join, gomatrixserverlib.Leave, gomatrixserverlib.Invite,
+			gomatrixserverlib.Ban, gomatrixserverlib.Knock:
+		default:
+			return fmt.Errorf("membership event has unknown membership %q", membership)
+		}
+	}
+	return nil
+}
+
+// checkInboundPDUFormat checks that the IDs of the event and of the events
+// that it references are in the format used by the room version. An event
+// built for a different room version can otherwise decode successfully,
+// e.g. a v4 event whose prev_events are v1 event IDs, but it can never be
+// valid in the room.
+func checkInboundPDUFormat(event *gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+	format, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return err
+	}
+	if err = checkEventIDFormat(event.EventID(), format); err != nil {
+		return &InboundPDUError{fmt.Errorf("event ID: %w", err)}
+	}
+	for _, eventID := range event.PrevEventIDs() {
+		if err = checkEventIDFormat(eventID, format); err != nil {
+			return &InboundPDUError{fmt.Errorf("prev_events: %w", err)}
+		}
+	}
+	for _, eventID := range event.AuthEventIDs() {
+		if err = checkEventIDFormat(eventID, format); err != nil {
+			return &InboundPDUError{fmt.Errorf("auth_events: %w", err)}
+		}
+	}
+	return nil
+}
+
+// checkEventIDFormat checks that the event ID is in the given format: a
+// random local part and server name for v1, or the reference hash in
+// standard or URL-safe unpadded base64 for v2 and v3 respectively.
+func checkEventIDFormat(eventID string, format gomatrixserverlib.EventIDFormat) error {
+	switch format {
+	case gomatrixserverlib.EventIDFormatV1:
+		if _, _, err := gomatrixserverlib.SplitID('$', eventID); err != nil {
+			return fmt.Errorf("%q is not a room version 1 or 2 event ID", eventID)
+		}
+		return nil
+	case gomatrixserverlib.EventIDFormatV2, gomatrixserverlib.EventIDFormatV3:
+		encoding := base64.RawStdEncoding
+		if format == gomatrixserverlib.EventIDFormatV3 {
+			encoding = base64.RawURLEncoding
+		}
+		if !strings.HasPrefix(eventID, "$") {
+			return fmt.Errorf("%q is not an event ID", eventID)
+		}
+		hash, err := encoding.Strict().DecodeString(eventID[1:])
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%q is not a reference hash in the format used by the room version", eventID)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown event ID format %d", format)
+	}
+}
+
+// inboundPDUErrorResponse returns a suitable response for an error from
+// parseInboundPDU, for APIs which receive a single event.
+func inboundPDUErrorResponse(err error) util.JSONResponse {
+	if e, ok := err.(gomatrixserverlib.UnsupportedRoomVersionError); ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(
+				fmt.Sprintf("Room version %q is not supported by this server.", e.Version),
+			),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.BadJSON(err.Error()),
+	}
+}
+
+// checkRequestBodyNotEmpty returns a 400 M_NOT_JSON response if the request
+// body is empty or only whitespace, which otherwise fails to decode with an
+// unhelpful error, or nil if there is something to decode.
+func checkRequestBodyNotEmpty(content []byte) *util.JSONResponse {
+	if len(bytes.TrimSpace(content)) != 0 {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.NotJSON("The request body is empty"),
+	}
+}
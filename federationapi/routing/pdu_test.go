@@ -0,0 +1,355 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/sjson"
+)
+
+type malformedPDU struct {
+	name    string
+	eventID string
+	pdu     json.RawMessage
+}
+
+// mustCreateMalformedPDUs returns variations of the test message and join
+// events which are broken in different ways.
+func mustCreateMalformedPDUs(t *testing.T) []malformedPDU {
+	t.Helper()
+	message := testData[len(testData)-1]
+	messageID := testEvents[len(testEvents)-1].EventID()
+	join := testData[1]
+	joinID := testEvents[1].EventID()
+	set := func(pdu json.RawMessage, path string, value interface{}) json.RawMessage {
+		t.Helper()
+		res, err := sjson.SetBytes(pdu, path, value)
+		if err != nil {
+			t.Fatalf("failed to set %s: %s", path, err)
+		}
+		return res
+	}
+	del := func(pdu json.RawMessage, path string) json.RawMessage {
+		t.Helper()
+		res, err := sjson.DeleteBytes(pdu, path)
+		if err != nil {
+			t.Fatalf("failed to delete %s: %s", path, err)
+		}
+		return res
+	}
+	return []malformedPDU{
+		{"depth of wrong type", messageID, set(message, "depth", "five")},
+		{"negative depth", messageID, set(message, "depth", -1)},
+		{"missing type", messageID, del(message, "type")},
+		{"type of wrong type", messageID, set(message, "type", 5)},
+		{"sender of wrong type", messageID, set(message, "sender", []string{"@userid:kaer.morhen"})},
+		{"prev_events of wrong type", messageID, set(message, "prev_events", "nope")},
+		{"membership without state key", joinID, del(join, "state_key")},
+		{"membership of wrong type", joinID, set(join, "content.membership", 5)},
+		{"missing membership", joinID, del(join, "content.membership")},
+	}
+}
+
+func TestParseInboundPDU(t *testing.T) {
+	pdus := mustCreateMalformedPDUs(t)
+	pdus = append(pdus,
+		malformedPDU{"not JSON", "", []byte(`{"type":`)},
+		malformedPDU{"not an object", "", []byte(`["m.room.message"]`)},
+		malformedPDU{"empty object", "", []byte(`{}`)},
+	)
+	for _, tc := range pdus {
+		_, err := parseInboundPDU(tc.pdu, testRoomVersion)
+		if _, ok := err.(*InboundPDUError); !ok {
+			t.Errorf("%s: expected an *InboundPDUError, got %v", tc.name, err)
+		}
+	}
+	if _, err := parseInboundPDU(testData[len(testData)-1], testRoomVersion); err != nil {
+		t.Errorf("expected a well formed event to be parsed, got %s", err)
+	}
+	if _, err := parseInboundPDU(testData[len(testData)-1], "unsupported"); err == nil {
+		t.Errorf("expected an unsupported room version to fail")
+	} else if _, ok := err.(gomatrixserverlib.UnsupportedRoomVersionError); !ok {
+		t.Errorf("expected an UnsupportedRoomVersionError, got %T", err)
+	}
+}
+
+func TestTransactionMalformedPDUs(t *testing.T) {
+	for _, tc := range mustCreateMalformedPDUs(t) {
+		rsAPI := &testRoomserverAPI{
+			queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+				return api.QueryMissingAuthPrevEventsResponse{
+					RoomExists:          true,
+					MissingAuthEventIDs: []string{},
+					MissingPrevEventIDs: []string{},
+				}
+			},
+		}
+		good := testData[len(testData)-2]
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{tc.pdu, good})
+		res, jsonErr := txn.processTransaction(context.Background())
+		if jsonErr != nil {
+			t.Errorf("%s: expected the transaction to be processed, got %+v", tc.name, jsonErr)
+			continue
+		}
+		if res.PDUs[tc.eventID].Error == "" {
+			t.Errorf("%s: expected an error for event %s", tc.name, tc.eventID)
+		}
+		assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-2]})
+	}
+}
+
+func TestSingleEventHandlersMalformedPDUs(t *testing.T) {
+	roomID := "!roomid:kaer.morhen"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testDestination,
+		},
+	}
+	handlers := map[string]func(fedReq *gomatrixserverlib.FederationRequest, eventID string) util.JSONResponse{
+		"send_join": func(fedReq *gomatrixserverlib.FederationRequest, eventID string) util.JSONResponse {
+			return SendJoin(
+				httptest.NewRequest("PUT", fedReq.RequestURI(), nil), fedReq,
+				cfg, &leaveTestRoomserverAPI{}, &leaveTestKeyRing{}, roomID, eventID, false,
+			)
+		},
+		"send_leave": func(fedReq *gomatrixserverlib.FederationRequest, eventID string) util.JSONResponse {
+			return SendLeave(
+				httptest.NewRequest("PUT", fedReq.RequestURI(), nil), fedReq,
+				cfg, &leaveTestRoomserverAPI{}, &leaveTestKeyRing{}, nil, nil, roomID, eventID,
+			)
+		},
+		"invite_v1": func(fedReq *gomatrixserverlib.FederationRequest, eventID string) util.JSONResponse {
+			return InviteV1(
+				httptest.NewRequest("PUT", fedReq.RequestURI(), nil), fedReq,
+				roomID, eventID, cfg, &inviteTestRoomserverAPI{}, &leaveTestKeyRing{},
+			)
+		},
+	}
+	for _, tc := range mustCreateMalformedPDUs(t) {
+		for name, handler := range handlers {
+			fedReq := gomatrixserverlib.NewFederationRequest("PUT", testDestination, "/"+name)
+			if err := fedReq.SetContent(tc.pdu); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+			res := handler(&fedReq, tc.eventID)
+			if res.Code != http.StatusBadRequest || errCode(t, res) != "M_BAD_JSON" {
+				t.Errorf("%s: %s: expected M_BAD_JSON, got %d: %+v", name, tc.name, res.Code, res.JSON)
+			}
+		}
+
+		fedReq := gomatrixserverlib.NewFederationRequest("PUT", testDestination, "/invite_v2")
+		if err := fedReq.SetContent(map[string]interface{}{
+			"event":        tc.pdu,
+			"room_version": testRoomVersion,
+		}); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		res := InviteV2(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			roomID, tc.eventID, cfg, &inviteTestRoomserverAPI{}, &leaveTestKeyRing{},
+		)
+		if code := errCode(t, res); res.Code != http.StatusBadRequest || (code != "M_BAD_JSON" && code != "M_NOT_JSON") {
+			t.Errorf("invite_v2: %s: expected M_BAD_JSON or M_NOT_JSON, got %d: %+v", tc.name, res.Code, res.JSON)
+		}
+	}
+}
+
+func TestCheckEventIDFormat(t *testing.T) {
+	// The last character of an unpadded SHA-256 hash only has two bits set.
+	stdHash := "$+" + strings.Repeat("a", 41) + "A"
+	urlHash := "$-" + strings.Repeat("a", 41) + "A"
+	for _, tc := range []struct {
+		eventID string
+		format  gomatrixserverlib.EventIDFormat
+		wantErr bool
+	}{
+		{"$abc:kaer.morhen", gomatrixserverlib.EventIDFormatV1, false},
+		{"$abc", gomatrixserverlib.EventIDFormatV1, true},
+		{stdHash, gomatrixserverlib.EventIDFormatV1, true},
+		{stdHash, gomatrixserverlib.EventIDFormatV2, false},
+		{urlHash, gomatrixserverlib.EventIDFormatV2, true},
+		{urlHash, gomatrixserverlib.EventIDFormatV3, false},
+		{stdHash, gomatrixserverlib.EventIDFormatV3, true},
+		{"$abc:kaer.morhen", gomatrixserverlib.EventIDFormatV3, true},
+		{"$" + strings.Repeat("a", 40), gomatrixserverlib.EventIDFormatV3, true},
+		{strings.Repeat("a", 43), gomatrixserverlib.EventIDFormatV3, true},
+		{"", gomatrixserverlib.EventIDFormatV3, true},
+	} {
+		err := checkEventIDFormat(tc.eventID, tc.format)
+		if tc.wantErr && err == nil {
+			t.Errorf("%q in format %d: expected an error", tc.eventID, tc.format)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%q in format %d: unexpected error: %s", tc.eventID, tc.format, err)
+		}
+	}
+}
+
+func TestSendLeaveRoomVersionMismatch(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	userID := "@userid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+		SignatureVerifyConcurrency: 1,
+	}
+	buildLeave := func(roomVersion gomatrixserverlib.RoomVersion, prevEvents interface{}) *gomatrixserverlib.Event {
+		t.Helper()
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:     userID,
+			RoomID:     roomID,
+			Type:       gomatrixserverlib.MRoomMember,
+			StateKey:   &userID,
+			PrevEvents: prevEvents,
+			AuthEvents: prevEvents,
+		}
+		if err = eb.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave}); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(time.Now(), testDestination, "ed25519:test", key, roomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		return ev
+	}
+	v4Prev := "$-" + strings.Repeat("a", 41) + "A"
+	v1Refs := []gomatrixserverlib.EventReference{{EventID: "$prev:kaer.morhen", EventSHA256: []byte("hash")}}
+
+	for _, tc := range []struct {
+		name        string
+		roomVersion gomatrixserverlib.RoomVersion
+		leave       *gomatrixserverlib.Event
+		wantCode    int
+	}{
+		{"v4 leave in v4 room", gomatrixserverlib.RoomVersionV4, buildLeave(gomatrixserverlib.RoomVersionV4, []string{v4Prev}), http.StatusOK},
+		{"v1 leave in v1 room", gomatrixserverlib.RoomVersionV1, buildLeave(gomatrixserverlib.RoomVersionV1, v1Refs), http.StatusOK},
+		{"v1 leave in v4 room", gomatrixserverlib.RoomVersionV4, buildLeave(gomatrixserverlib.RoomVersionV1, v1Refs), http.StatusBadRequest},
+		{"v4 leave in v1 room", gomatrixserverlib.RoomVersionV1, buildLeave(gomatrixserverlib.RoomVersionV4, []string{v4Prev}), http.StatusBadRequest},
+		{"v4 leave referencing v1 events", gomatrixserverlib.RoomVersionV4, buildLeave(gomatrixserverlib.RoomVersionV4, []string{"$prev:kaer.morhen"}), http.StatusBadRequest},
+		{"v4 leave in v3 room", gomatrixserverlib.RoomVersionV3, buildLeave(gomatrixserverlib.RoomVersionV4, []string{v4Prev}), http.StatusBadRequest},
+	} {
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+tc.leave.EventID(),
+		)
+		if err = fedReq.SetContent(json.RawMessage(tc.leave.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		rsAPI := &leaveTestRoomserverAPI{roomVersion: tc.roomVersion}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, tc.leave.EventID(),
+		)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: expected status %d, got %d: %+v", tc.name, tc.wantCode, res.Code, res.JSON)
+			continue
+		}
+		if tc.wantCode == http.StatusBadRequest && errCode(t, res) != "M_BAD_JSON" {
+			t.Errorf("%s: expected M_BAD_JSON, got %+v", tc.name, res.JSON)
+		}
+	}
+}
+
+func TestSendLeaveEmptyBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		empty   bool
+	}{
+		{"zero length", "", true},
+		{"whitespace only", " \r\n\t ", true},
+		{"object", "{}", false},
+		{"malformed", "{\"type\":", false},
+	} {
+		res := checkRequestBodyNotEmpty([]byte(tc.content))
+		if !tc.empty {
+			if res != nil {
+				t.Errorf("%s: expected body to be accepted, got %+v", tc.name, res.JSON)
+			}
+			continue
+		}
+		if res == nil {
+			t.Errorf("%s: expected body to be rejected", tc.name)
+			continue
+		}
+		if res.Code != http.StatusBadRequest || errCode(t, *res) != "M_NOT_JSON" {
+			t.Errorf("%s: expected 400 M_NOT_JSON, got %d: %+v", tc.name, res.Code, res.JSON)
+		}
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	roomID := "!roomid:kaer.morhen"
+	eventID := "$eventid:white.orchard"
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			ServerName: testOrigin,
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		content  interface{}
+		wantCode string
+		wantMsg  string
+	}{
+		{"empty body", nil, "M_NOT_JSON", "The request body is empty"},
+		{"not an event", "not an event", "M_BAD_JSON", ""},
+	} {
+		fedReq := gomatrixserverlib.NewFederationRequest(
+			"PUT", testOrigin, "/_matrix/federation/v2/send_leave/"+roomID+"/"+eventID,
+		)
+		if tc.content != nil {
+			if err = fedReq.SetContent(tc.content); err != nil {
+				t.Fatalf("failed to set content: %s", err)
+			}
+		}
+		if err = fedReq.Sign(testDestination, "ed25519:test", key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		rsAPI := &leaveTestRoomserverAPI{}
+		res := SendLeave(
+			httptest.NewRequest("PUT", fedReq.RequestURI(), nil), &fedReq,
+			cfg, rsAPI, &leaveTestKeyRing{}, nil, nil, roomID, eventID,
+		)
+		if res.Code != http.StatusBadRequest || errCode(t, res) != tc.wantCode {
+			t.Errorf("%s: expected 400 %s, got %d: %+v", tc.name, tc.wantCode, res.Code, res.JSON)
+			continue
+		}
+		if merr := res.JSON.(*jsonerror.MatrixError); tc.wantMsg != "" && merr.Err != tc.wantMsg {
+			t.Errorf("%s: expected message %q, got %q", tc.name, tc.wantMsg, merr.Err)
+		}
+	}
+}
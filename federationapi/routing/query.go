@@ -19,7 +19,6 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
-	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrix"
@@ -33,7 +32,6 @@ func RoomAliasToID(
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.FederationAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
-	senderAPI federationSenderAPI.FederationSenderInternalAPI,
 ) util.JSONResponse {
 	roomAlias := httpReq.FormValue("room_alias")
 	if roomAlias == "" {
@@ -64,10 +62,10 @@ func RoomAliasToID(
 		}
 
 		if queryRes.RoomID != "" {
-			serverQueryReq := federationSenderAPI.QueryJoinedHostServerNamesInRoomRequest{RoomID: queryRes.RoomID}
-			var serverQueryRes federationSenderAPI.QueryJoinedHostServerNamesInRoomResponse
-			if err = senderAPI.QueryJoinedHostServerNamesInRoom(httpReq.Context(), &serverQueryReq, &serverQueryRes); err != nil {
-				util.GetLogger(httpReq.Context()).WithError(err).Error("senderAPI.QueryJoinedHostServerNamesInRoom failed")
+			serverQueryReq := roomserverAPI.QueryServersInRoomRequest{RoomID: queryRes.RoomID}
+			var serverQueryRes roomserverAPI.QueryServersInRoomResponse
+			if err = rsAPI.QueryServersInRoom(httpReq.Context(), &serverQueryReq, &serverQueryRes); err != nil {
+				util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServersInRoom failed")
 				return jsonerror.InternalServerError()
 			}
 
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -30,6 +31,7 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 // Setup registers HTTP handlers with the given ServeMux.
@@ -146,11 +148,14 @@ func Setup(
 
 	v1fedmux.Handle("/exchange_third_party_invite/{roomID}", httputil.MakeFedAPI(
 		"exchange_third_party_invite", cfg.Matrix.ServerName, keys, wakeup,
-		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
-			return ExchangeThirdPartyInvite(
-				httpReq, request, vars["roomID"], rsAPI, cfg, federation,
-			)
-		},
+		chainFederationMiddleware(
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				return ExchangeThirdPartyInvite(
+					httpReq, request, vars["roomID"], rsAPI, cfg, federation,
+				)
+			},
+			requireServerAllowedInRoom(rsAPI),
+		),
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v1fedmux.Handle("/event/{eventID}", httputil.MakeFedAPI(
@@ -211,7 +216,7 @@ func Setup(
 		"federation_query_room_alias", cfg.Matrix.ServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return RoomAliasToID(
-				httpReq, federation, cfg, rsAPI, fsAPI,
+				httpReq, federation, cfg, rsAPI,
 			)
 		},
 	)).Methods(http.MethodGet)
@@ -310,6 +315,7 @@ func Setup(
 			eventID := vars["eventID"]
 			res := SendJoin(
 				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
+				mscCfg.Enabled("msc3706") && httpReq.URL.Query().Get("org.matrix.msc3706.partial_state") == "true",
 			)
 			// not all responses get wrapped in [code, body]
 			var body interface{}
@@ -342,75 +348,13 @@ func Setup(
 			eventID := vars["eventID"]
 			return SendJoin(
 				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
+				mscCfg.Enabled("msc3706") && httpReq.URL.Query().Get("org.matrix.msc3706.partial_state") == "true",
 			)
 		},
 	)).Methods(http.MethodPut)
 
-	v1fedmux.Handle("/make_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_make_leave", cfg.Matrix.ServerName, keys, wakeup,
-		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
-			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
-				return util.JSONResponse{
-					Code: http.StatusForbidden,
-					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
-				}
-			}
-			roomID := vars["roomID"]
-			eventID := vars["eventID"]
-			return MakeLeave(
-				httpReq, request, cfg, rsAPI, roomID, eventID,
-			)
-		},
-	)).Methods(http.MethodGet)
-
-	v1fedmux.Handle("/send_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup,
-		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
-			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
-				return util.JSONResponse{
-					Code: http.StatusForbidden,
-					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
-				}
-			}
-			roomID := vars["roomID"]
-			eventID := vars["eventID"]
-			res := SendLeave(
-				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
-			)
-			// not all responses get wrapped in [code, body]
-			var body interface{}
-			body = []interface{}{
-				res.Code, res.JSON,
-			}
-			jerr, ok := res.JSON.(*jsonerror.MatrixError)
-			if ok {
-				body = jerr
-			}
-
-			return util.JSONResponse{
-				Headers: res.Headers,
-				Code:    res.Code,
-				JSON:    body,
-			}
-		},
-	)).Methods(http.MethodPut)
-
-	v2fedmux.Handle("/send_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup,
-		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
-			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
-				return util.JSONResponse{
-					Code: http.StatusForbidden,
-					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
-				}
-			}
-			roomID := vars["roomID"]
-			eventID := vars["eventID"]
-			return SendLeave(
-				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
-			)
-		},
-	)).Methods(http.MethodPut)
+	setupLeaveRoutes(fedMux, v1fedmux, v2fedmux, cfg, rsAPI, keys, wakeup, mscCfg)
+	setupKnockRoutes(fedMux, v1fedmux, cfg, rsAPI, keys, wakeup, mscCfg)
 
 	v1fedmux.Handle("/version", httputil.MakeExternalAPI(
 		"federation_version",
@@ -449,7 +393,7 @@ func Setup(
 		httputil.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
 			return GetPostPublicRooms(req, rsAPI)
 		}),
-	).Methods(http.MethodGet)
+	).Methods(http.MethodGet, http.MethodPost)
 
 	v1fedmux.Handle("/user/keys/claim", httputil.MakeFedAPI(
 		"federation_keys_claim", cfg.Matrix.ServerName, keys, wakeup,
@@ -471,3 +415,174 @@ func Setup(
 		}),
 	).Methods(http.MethodGet)
 }
+
+// unstableLeavePrefixes are the unstable prefixes, by MSC, that make_leave
+// and send_leave are also registered under when that MSC is enabled, so that
+// servers implementing it before it is stable can use them. The handlers are
+// the same as for the stable endpoints.
+var unstableLeavePrefixes = map[string]string{
+	// Retracting or rejecting a knock is done with make_leave/send_leave.
+	"msc2403": unstableKnockPrefix,
+}
+
+// unstableKnockPrefix is the unstable prefix of MSC2403, which make_knock and
+// send_knock are also registered under when the MSC is enabled.
+const unstableKnockPrefix = "/unstable/xyz.amorgan.knock"
+
+// setupLeaveRoutes registers make_leave and send_leave under the stable v1
+// and v2 paths and under the unstable prefixes of any enabled MSCs.
+func setupLeaveRoutes(
+	fedMux, v1fedmux, v2fedmux *mux.Router,
+	cfg *config.FederationAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	keys gomatrixserverlib.JSONVerifier,
+	wakeup *httputil.FederationWakeups,
+	mscCfg *config.MSCs,
+) {
+	leaveRoomAllowlist, err := config.CompileRoomIDPatterns(cfg.LeaveRoomAllowlist)
+	if err != nil {
+		logrus.WithError(err).Panic("Invalid federation_api.leave_room_allowlist")
+	}
+	leaveRoomDenylist, err := config.CompileRoomIDPatterns(cfg.LeaveRoomDenylist)
+	if err != nil {
+		logrus.WithError(err).Panic("Invalid federation_api.leave_room_denylist")
+	}
+
+	makeLeaveTxns := newMakeLeaveTxnCache(makeLeaveTxnTTL, makeLeaveTxnCacheSize)
+	makeLeave := httputil.MakeFedAPI(
+		"federation_make_leave", cfg.Matrix.ServerName, keys, wakeup,
+		chainFederationMiddleware(
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				roomID := vars["roomID"]
+				eventID := vars["eventID"]
+				return makeLeaveTxns.MakeLeave(httpReq, request, roomID, eventID, func() util.JSONResponse {
+					return MakeLeave(
+						httpReq, request, cfg, rsAPI, roomID, eventID,
+					)
+				})
+			},
+			recoverFromPanics(),
+			requireRoomAllowed(leaveRoomAllowlist, leaveRoomDenylist, "leave"),
+			requireServerAllowedInRoom(rsAPI),
+			// the eventID path variable is actually the user ID
+			requireUserFromOrigin("eventID", "leave"),
+		),
+	)
+
+	var leaveNotifier LeaveNotifier
+	if webhook := NewLeaveWebhook(&cfg.LeaveWebhook); webhook != nil {
+		leaveNotifier = webhook
+	}
+
+	leaveBreaker := NewLeaveCircuitBreaker(&cfg.LeaveCircuitBreaker)
+
+	leaveKeys := keys
+	if cfg.LeaveSignatureCacheTTLMS > 0 {
+		leaveKeys = newCachingKeyRing(keys, time.Duration(cfg.LeaveSignatureCacheTTLMS)*time.Millisecond, verifyCacheSize)
+	}
+
+	sendLeave := chainFederationMiddleware(
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			roomID := vars["roomID"]
+			eventID := vars["eventID"]
+			return SendLeave(
+				httpReq, request, cfg, rsAPI, leaveKeys, leaveNotifier, leaveBreaker, roomID, eventID,
+			)
+		},
+		recoverFromPanics(),
+		requireRoomAllowed(leaveRoomAllowlist, leaveRoomDenylist, "leave"),
+		requireServerAllowedInRoom(rsAPI),
+	)
+
+	sendLeaveV1 := httputil.MakeFedAPI(
+		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			res := sendLeave(httpReq, request, vars)
+			// not all responses get wrapped in [code, body]
+			var body interface{}
+			body = []interface{}{
+				res.Code, res.JSON,
+			}
+			jerr, ok := res.JSON.(*jsonerror.MatrixError)
+			if ok {
+				body = jerr
+			}
+
+			return util.JSONResponse{
+				Headers: res.Headers,
+				Code:    res.Code,
+				JSON:    body,
+			}
+		},
+	)
+
+	sendLeaveV2 := httputil.MakeFedAPI(
+		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup, sendLeave,
+	)
+
+	v1fedmux.Handle("/make_leave/{roomID}/{eventID}", makeLeave).Methods(http.MethodGet)
+	v1fedmux.Handle("/send_leave/{roomID}/{eventID}", sendLeaveV1).Methods(http.MethodPut)
+	v2fedmux.Handle("/send_leave/{roomID}/{eventID}", sendLeaveV2).Methods(http.MethodPut)
+
+	for msc, prefix := range unstableLeavePrefixes {
+		if !mscCfg.Enabled(msc) {
+			continue
+		}
+		unstablemux := fedMux.PathPrefix(prefix).Subrouter()
+		unstablemux.Handle("/make_leave/{roomID}/{eventID}", makeLeave).Methods(http.MethodGet)
+		unstablemux.Handle("/send_leave/{roomID}/{eventID}", sendLeaveV2).Methods(http.MethodPut)
+	}
+}
+
+// setupKnockRoutes registers make_knock and send_knock under the stable v1
+// paths, and under the unstable prefix of MSC2403 if it is enabled.
+func setupKnockRoutes(
+	fedMux, v1fedmux *mux.Router,
+	cfg *config.FederationAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	keys gomatrixserverlib.JSONVerifier,
+	wakeup *httputil.FederationWakeups,
+	mscCfg *config.MSCs,
+) {
+	makeKnock := httputil.MakeFedAPI(
+		"federation_make_knock", cfg.Matrix.ServerName, keys, wakeup,
+		chainFederationMiddleware(
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				// Knocking was added in room version 7, so unlike make_join
+				// there's no point assuming room version 1 if there's no ?ver=.
+				remoteVersions := []gomatrixserverlib.RoomVersion{}
+				for _, v := range httpReq.URL.Query()["ver"] {
+					remoteVersions = append(remoteVersions, gomatrixserverlib.RoomVersion(v))
+				}
+				return MakeKnock(
+					httpReq, request, cfg, rsAPI, vars["roomID"], vars["userID"], remoteVersions,
+				)
+			},
+			recoverFromPanics(),
+			requireServerAllowedInRoom(rsAPI),
+			requireUserFromOrigin("userID", "knock"),
+		),
+	)
+
+	sendKnock := httputil.MakeFedAPI(
+		"federation_send_knock", cfg.Matrix.ServerName, keys, wakeup,
+		chainFederationMiddleware(
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				return SendKnock(
+					httpReq, request, cfg, rsAPI, keys, vars["roomID"], vars["eventID"],
+				)
+			},
+			recoverFromPanics(),
+			requireServerAllowedInRoom(rsAPI),
+		),
+	)
+
+	v1fedmux.Handle("/make_knock/{roomID}/{userID}", makeKnock).Methods(http.MethodGet)
+	v1fedmux.Handle("/send_knock/{roomID}/{eventID}", sendKnock).Methods(http.MethodPut)
+
+	if mscCfg.Enabled("msc2403") {
+		unstablemux := fedMux.PathPrefix(unstableKnockPrefix).Subrouter()
+		unstablemux.Handle("/make_knock/{roomID}/{userID}", makeKnock).Methods(http.MethodGet)
+		unstablemux.Handle("/send_knock/{roomID}/{eventID}", sendKnock).Methods(http.MethodPut)
+	}
+}
@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestLeaveRoutes(t *testing.T) {
+	testCases := []struct {
+		method    string
+		path      string
+		mscs      []string
+		wantMatch bool
+	}{
+		{http.MethodGet, "/v1/make_leave/!room:kaer.morhen/@user:white.orchard", nil, true},
+		{http.MethodPut, "/v1/send_leave/!room:kaer.morhen/$event%2Fwith%2Fslashes", nil, true},
+		{http.MethodPut, "/v2/send_leave/!room:kaer.morhen/$event%2Fwith%2Fslashes", nil, true},
+		{http.MethodGet, "/unstable/xyz.amorgan.knock/make_leave/!room:kaer.morhen/@user:white.orchard", nil, false},
+		{http.MethodGet, "/unstable/xyz.amorgan.knock/make_leave/!room:kaer.morhen/@user:white.orchard", []string{"msc2403"}, true},
+		{http.MethodPut, "/unstable/xyz.amorgan.knock/send_leave/!room:kaer.morhen/$event%2Fwith%2Fslashes", []string{"msc2403"}, true},
+	}
+	for _, tc := range testCases {
+		cfg := &config.FederationAPI{
+			Matrix: &config.Global{
+				ServerName: testOrigin,
+			},
+		}
+		fedMux := mux.NewRouter().SkipClean(true).UseEncodedPath()
+		setupLeaveRoutes(
+			fedMux, fedMux.PathPrefix("/v1").Subrouter(), fedMux.PathPrefix("/v2").Subrouter(),
+			cfg, nil, nil, nil, &config.MSCs{MSCs: tc.mscs},
+		)
+		var match mux.RouteMatch
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if got := fedMux.Match(req, &match); got != tc.wantMatch {
+			t.Errorf("%s %s with MSCs %v: expected match %v, got %v", tc.method, tc.path, tc.mscs, tc.wantMatch, got)
+		}
+	}
+}
+
+func TestKnockRoutes(t *testing.T) {
+	testCases := []struct {
+		method    string
+		path      string
+		mscs      []string
+		wantMatch bool
+	}{
+		{http.MethodGet, "/v1/make_knock/!room:kaer.morhen/@user:white.orchard", nil, true},
+		{http.MethodPut, "/v1/send_knock/!room:kaer.morhen/$event%2Fwith%2Fslashes", nil, true},
+		{http.MethodPut, "/v1/make_knock/!room:kaer.morhen/@user:white.orchard", nil, false},
+		{http.MethodGet, "/unstable/xyz.amorgan.knock/make_knock/!room:kaer.morhen/@user:white.orchard", nil, false},
+		{http.MethodGet, "/unstable/xyz.amorgan.knock/make_knock/!room:kaer.morhen/@user:white.orchard", []string{"msc2403"}, true},
+		{http.MethodPut, "/unstable/xyz.amorgan.knock/send_knock/!room:kaer.morhen/$event%2Fwith%2Fslashes", []string{"msc2403"}, true},
+	}
+	for _, tc := range testCases {
+		cfg := &config.FederationAPI{
+			Matrix: &config.Global{
+				ServerName: testOrigin,
+			},
+		}
+		fedMux := mux.NewRouter().SkipClean(true).UseEncodedPath()
+		setupKnockRoutes(
+			fedMux, fedMux.PathPrefix("/v1").Subrouter(),
+			cfg, nil, nil, nil, &config.MSCs{MSCs: tc.mscs},
+		)
+		var match mux.RouteMatch
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if got := fedMux.Match(req, &match); got != tc.wantMatch {
+			t.Errorf("%s %s with MSCs %v: expected match %v, got %v", tc.method, tc.path, tc.mscs, tc.wantMatch, got)
+		}
+	}
+}
@@ -27,6 +27,8 @@ import (
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/txnlog"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -54,6 +56,10 @@ const (
 	MetricsWorkMissingPrevEvents = "missing_prev_events"
 )
 
+// federationTypingTimeout is how long a remote user is shown as typing
+// for, unless their server tells us again.
+const federationTypingTimeout = 30 * 1000
+
 var (
 	pduCountTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -174,6 +180,16 @@ func Send(
 		servers:    servers,
 		keyAPI:     keyAPI,
 		roomsMu:    mu,
+		// the tolerance for event timestamps in the future
+		futureEventTolerance: time.Duration(cfg.FutureEventToleranceMS) * time.Millisecond,
+		// the bounds on fetching missing auth events
+		maxAuthChainDepth:  cfg.MaxAuthChainFetchDepth,
+		maxAuthChainEvents: cfg.MaxAuthChainFetchEvents,
+		// whether one bad PDU rejects the whole transaction
+		rejectBadPDUs: cfg.RejectTransactionsWithBadPDUs,
+	}
+	if cfg.ValidateEventContent {
+		t.contentValidators = eventutil.DefaultContentValidators
 	}
 
 	var txnEvents struct {
@@ -204,6 +220,7 @@ func Send(
 	t.Destination = cfg.Matrix.ServerName
 
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q from %q containing %d PDUs, %d EDUs", txnID, request.Origin(), len(t.PDUs), len(t.EDUs))
+	txnlog.Default.LogTransaction(txnlog.Inbound, request.Origin(), &t.Transaction)
 
 	resp, jsonErr := t.processTransaction(httpReq.Context())
 	if jsonErr != nil {
@@ -238,7 +255,17 @@ type txnReq struct {
 	// which the roomserver is unaware of.
 	haveEvents      map[string]*gomatrixserverlib.HeaderedEvent
 	haveEventsMutex sync.Mutex
-	work            string // metrics
+	// how far in the future an event's origin_server_ts may be, 0 if unchecked
+	futureEventTolerance time.Duration
+	// how deep and how many missing auth events we'll fetch for an event, 0 if unbounded
+	maxAuthChainDepth  int
+	maxAuthChainEvents int
+	// whether to reject the whole transaction if a PDU has bad JSON, rather
+	// than only failing that PDU
+	rejectBadPDUs bool
+	// validators to check the content of PDUs against, nil if unchecked
+	contentValidators *eventutil.ContentValidators
+	work              string // metrics
 }
 
 func (t *txnReq) hadEvent(eventID string, had bool) {
@@ -247,6 +274,21 @@ func (t *txnReq) hadEvent(eventID string, had bool) {
 	t.hadEvents[eventID] = had
 }
 
+func (t *txnReq) haveHadEvent(eventID string) bool {
+	t.hadEventsMutex.Lock()
+	defer t.hadEventsMutex.Unlock()
+	return t.hadEvents[eventID]
+}
+
+// isTooFarInFuture returns true if the origin_server_ts of the event is
+// further in the future than the configured tolerance.
+func (t *txnReq) isTooFarInFuture(event *gomatrixserverlib.Event, now time.Time) bool {
+	if t.futureEventTolerance <= 0 {
+		return false
+	}
+	return event.OriginServerTS().Time().After(now.Add(t.futureEventTolerance))
+}
+
 // A subset of FederationClient functionality that txn requires. Useful for testing.
 type txnFederationClient interface {
 	LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
@@ -266,7 +308,8 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 	for _, pdu := range t.PDUs {
 		pduCountTotal.WithLabelValues("total").Inc()
 		var header struct {
-			RoomID string `json:"room_id"`
+			RoomID  string `json:"room_id"`
+			EventID string `json:"event_id"`
 		}
 		if err := json.Unmarshal(pdu, &header); err != nil {
 			util.GetLogger(ctx).WithError(err).Warn("Transaction: Failed to extract room ID from event")
@@ -282,9 +325,9 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 			// failure in the PDU results
 			continue
 		}
-		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, verRes.RoomVersion)
+		event, err := parseInboundPDU(pdu, verRes.RoomVersion)
 		if err != nil {
-			if _, ok := err.(gomatrixserverlib.BadJSONError); ok {
+			if t.rejectBadPDUs && errors.As(err, &gomatrixserverlib.BadJSONError{}) {
 				// Room version 6 states that homeservers should strictly enforce canonical JSON
 				// on PDUs.
 				//
@@ -298,8 +341,35 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 				}
 			}
 			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %s", string(pdu))
+			// Older room versions include the event ID, so we can at least
+			// tell the sending server which event was bad. In newer ones the
+			// event ID is a hash of the event, which we can't work out for
+			// an event that we can't parse.
+			if header.EventID != "" {
+				results[header.EventID] = gomatrixserverlib.PDUResult{
+					Error: err.Error(),
+				}
+			}
+			continue
+		}
+		if t.isTooFarInFuture(event, time.Now()) {
+			// The timestamp is covered by the event hashes and signatures so we
+			// can't clamp it, but we don't want it upsetting ordering and retention.
+			util.GetLogger(ctx).Warnf("Transaction: Rejecting event %q with origin_server_ts %d too far in the future", event.EventID(), event.OriginServerTS())
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: "Event origin_server_ts is too far in the future",
+			}
 			continue
 		}
+		if t.contentValidators != nil {
+			if err = t.contentValidators.ValidateEvent(event); err != nil {
+				util.GetLogger(ctx).WithError(err).Warnf("Transaction: Rejecting event %q with invalid content", event.EventID())
+				results[event.EventID()] = gomatrixserverlib.PDUResult{
+					Error: err.Error(),
+				}
+				continue
+			}
+		}
 		if api.IsServerBannedFromRoom(ctx, t.rsAPI, event.RoomID(), t.Origin) {
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: "Forbidden by server ACLs",
@@ -414,6 +484,11 @@ type missingPrevEventsError struct {
 	eventID string
 	err     error
 }
+type authChainBoundError struct {
+	eventID string
+	depth   int
+	fetched int
+}
 
 func (e roomNotFoundError) Error() string { return fmt.Sprintf("room %q not found", e.roomID) }
 func (e verifySigError) Error() string {
@@ -422,6 +497,9 @@ func (e verifySigError) Error() string {
 func (e missingPrevEventsError) Error() string {
 	return fmt.Sprintf("unable to get prev_events for event %q: %s", e.eventID, e.err)
 }
+func (e authChainBoundError) Error() string {
+	return fmt.Sprintf("gave up fetching the auth chain of event %q at depth %d after %d events", e.eventID, e.depth, e.fetched)
+}
 
 func (t *txnReq) processEDUs(ctx context.Context) {
 	for _, e := range t.EDUs {
@@ -447,7 +525,26 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 				util.GetLogger(ctx).Warnf("Dropping typing event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
 				continue
 			}
-			if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
+			if api.IsServerBannedFromRoom(ctx, t.rsAPI, typingPayload.RoomID, t.Origin) {
+				util.GetLogger(ctx).Debugf("Dropping typing event from %q which is banned from %q by server ACLs", t.Origin, typingPayload.RoomID)
+				continue
+			}
+			// Only users who are joined to the room can be typing in it.
+			var membershipRes api.QueryMembershipForUserResponse
+			if err := t.rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+				RoomID: typingPayload.RoomID,
+				UserID: typingPayload.UserID,
+			}, &membershipRes); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to query membership for typing event sender")
+				continue
+			}
+			if !membershipRes.IsInRoom {
+				util.GetLogger(ctx).Debugf("Dropping typing event from %q which isn't joined to %q", typingPayload.UserID, typingPayload.RoomID)
+				continue
+			}
+			// Remote servers don't send a timeout, and are expected to send
+			// the typing notification again if the user is still typing.
+			if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, federationTypingTimeout); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("Failed to send typing event to edu server")
 			}
 		case gomatrixserverlib.MDirectToDevice:
@@ -457,9 +554,24 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 				util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal send-to-device events")
 				continue
 			}
+			_, senderDomain, err := gomatrixserverlib.SplitID('@', directPayload.Sender)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to split domain from send-to-device sender")
+				continue
+			}
+			if senderDomain != t.Origin {
+				util.GetLogger(ctx).Warnf("Dropping send-to-device events where sender domain (%q) doesn't match origin (%q)", senderDomain, t.Origin)
+				continue
+			}
 			for userID, byUser := range directPayload.Messages {
+				// Only deliver to our own users, so the messages can't be
+				// bounced on to other servers.
+				if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != t.Destination {
+					util.GetLogger(ctx).Warnf("Dropping send-to-device events for %q which isn't a local user", userID)
+					continue
+				}
 				for deviceID, message := range byUser {
-					// TODO: check that the user and the device actually exist here
+					// TODO: check that the device actually exists here
 					if err := eduserverAPI.SendToDevice(ctx, t.eduAPI, directPayload.Sender, userID, deviceID, directPayload.Type, message); err != nil {
 						util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
 							"sender":    directPayload.Sender,
@@ -471,6 +583,8 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 			}
 		case gomatrixserverlib.MDeviceListUpdate:
 			t.processDeviceListUpdate(ctx, e)
+		case keyapi.MSigningKeyUpdate:
+			t.processSigningKeyUpdate(ctx, e)
 		case gomatrixserverlib.MReceipt:
 			// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
 			payload := map[string]eduserverAPI.FederationReceiptMRead{}
@@ -481,6 +595,10 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 			}
 
 			for roomID, receipt := range payload {
+				if api.IsServerBannedFromRoom(ctx, t.rsAPI, roomID, t.Origin) {
+					util.GetLogger(ctx).Debugf("Dropping receipt events from %q which is banned from %q by server ACLs", t.Origin, roomID)
+					continue
+				}
 				for userID, mread := range receipt.User {
 					_, domain, err := gomatrixserverlib.SplitID('@', userID)
 					if err != nil {
@@ -502,6 +620,8 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 					}
 				}
 			}
+		case eduserverAPI.MPresence:
+			t.processPresence(ctx, e)
 		default:
 			util.GetLogger(ctx).WithField("type", e.Type).Debug("Unhandled EDU")
 		}
@@ -534,12 +654,50 @@ func (t *txnReq) processReceiptEvent(ctx context.Context,
 	return nil
 }
 
+// processPresence sends the presence updates of the origin's users to the edu server
+func (t *txnReq) processPresence(ctx context.Context, e gomatrixserverlib.EDU) {
+	// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+	var payload eduserverAPI.FederationPresence
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal presence event")
+		return
+	}
+	now := time.Now()
+	for _, update := range payload.Push {
+		_, domain, err := gomatrixserverlib.SplitID('@', update.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to split domain from presence event user")
+			continue
+		}
+		if t.Origin != domain {
+			util.GetLogger(ctx).Warnf("Dropping presence event where user domain (%q) doesn't match origin (%q)", domain, t.Origin)
+			continue
+		}
+		lastActiveTS := gomatrixserverlib.AsTimestamp(now.Add(-time.Duration(update.LastActiveAgo) * time.Millisecond))
+		err = eduserverAPI.SendPresence(ctx, t.eduAPI, update.UserID, update.Presence, update.StatusMsg, lastActiveTS)
+		if err == eduserverAPI.ErrPresenceStatusMsgTooLong {
+			util.GetLogger(ctx).WithField("user_id", update.UserID).Warn("Dropping presence event with an oversized status message")
+		} else if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", update.UserID).Error("Failed to send presence event to edu server")
+		}
+	}
+}
+
 func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverlib.EDU) {
 	var payload gomatrixserverlib.DeviceListUpdateEvent
 	if err := json.Unmarshal(e.Content, &payload); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal device list update event")
 		return
 	}
+	_, domain, err := gomatrixserverlib.SplitID('@', payload.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to split domain from device list update event")
+		return
+	}
+	if t.Origin != domain {
+		util.GetLogger(ctx).Warnf("Dropping device list update where user domain (%q) doesn't match origin (%q)", domain, t.Origin)
+		return
+	}
 	var inputRes keyapi.InputDeviceListUpdateResponse
 	t.keyAPI.InputDeviceListUpdate(context.Background(), &keyapi.InputDeviceListUpdateRequest{
 		Event: payload,
@@ -549,6 +707,30 @@ func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverli
 	}
 }
 
+func (t *txnReq) processSigningKeyUpdate(ctx context.Context, e gomatrixserverlib.EDU) {
+	var payload keyapi.CrossSigningKeyUpdate
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal signing key update event")
+		return
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', payload.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to split domain from signing key update event")
+		return
+	}
+	if t.Origin != domain {
+		util.GetLogger(ctx).Warnf("Dropping signing key update where user domain (%q) doesn't match origin (%q)", domain, t.Origin)
+		return
+	}
+	var inputRes keyapi.InputCrossSigningKeyUpdateResponse
+	t.keyAPI.InputCrossSigningKeyUpdate(context.Background(), &keyapi.InputCrossSigningKeyUpdateRequest{
+		CrossSigningKeyUpdate: payload,
+	}, &inputRes)
+	if inputRes.Error != nil {
+		util.GetLogger(ctx).WithError(inputRes.Error).WithField("user_id", payload.UserID).Error("failed to InputCrossSigningKeyUpdate")
+	}
+}
+
 func (t *txnReq) getServers(ctx context.Context, roomID string, event *gomatrixserverlib.Event) []gomatrixserverlib.ServerName {
 	// The server that sent us the event should be sufficient to tell us about missing
 	// prev and auth events.
@@ -565,6 +747,25 @@ func (t *txnReq) getServers(ctx context.Context, roomID string, event *gomatrixs
 	// be used for the P2P demos.
 	if t.servers != nil {
 		servers = append(servers, t.servers.GetServersForRoom(ctx, roomID, event)...)
+		return servers
+	}
+	// Otherwise fall back to the servers that the roomserver thinks have
+	// joined members in the room, any of which should be able to help.
+	var res api.QueryServersInRoomResponse
+	if err := t.rsAPI.QueryServersInRoom(ctx, &api.QueryServersInRoomRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("failed to query servers in room")
+		return servers
+	}
+	for _, server := range res.ServerNames {
+		if server == t.Destination || server == t.Origin {
+			continue
+		}
+		if event != nil && server == event.Origin() {
+			continue
+		}
+		servers = append(servers, server)
 	}
 	return servers
 }
@@ -619,6 +820,12 @@ func (t *txnReq) processEvent(ctx context.Context, e *gomatrixserverlib.Event) e
 		t.work = MetricsWorkMissingAuthEvents
 		logger.Infof("Event refers to %d unknown auth_events", len(stateResp.MissingAuthEventIDs))
 		if err := t.retrieveMissingAuthEvents(ctx, e, &stateResp); err != nil {
+			if _, ok := err.(authChainBoundError); ok {
+				// Soft-fail the event rather than continuing to walk an auth
+				// chain that may never end.
+				logger.WithError(err).Warn("Auth chain fetch bound hit, soft-failing event")
+				return err
+			}
 			return fmt.Errorf("t.retrieveMissingAuthEvents: %w", err)
 		}
 	}
@@ -647,16 +854,41 @@ func (t *txnReq) processEvent(ctx context.Context, e *gomatrixserverlib.Event) e
 
 func (t *txnReq) retrieveMissingAuthEvents(
 	ctx context.Context, e *gomatrixserverlib.Event, stateResp *api.QueryMissingAuthPrevEventsResponse,
+) error {
+	fetched := 0
+	return t.retrieveAuthEvents(ctx, e, stateResp.MissingAuthEventIDs, stateResp.RoomVersion, 1, &fetched)
+}
+
+// retrieveAuthEvents fetches the given missing auth events of e, along with
+// any of their own auth events that are missing, and sends them to the
+// roomserver as outliers. Missing auth events are fetched at most
+// maxAuthChainDepth levels deep and at most maxAuthChainEvents in total, so
+// that a malicious or broken server can't keep us fetching forever. If either
+// bound is hit then an authChainBoundError is returned.
+func (t *txnReq) retrieveAuthEvents(
+	ctx context.Context, e *gomatrixserverlib.Event, missingAuthEventIDs []string,
+	roomVersion gomatrixserverlib.RoomVersion, depth int, fetched *int,
 ) error {
 	logger := util.GetLogger(ctx).WithField("event_id", e.EventID()).WithField("room_id", e.RoomID())
+	if t.maxAuthChainDepth > 0 && depth > t.maxAuthChainDepth {
+		return authChainBoundError{e.EventID(), depth, *fetched}
+	}
 
 	missingAuthEvents := make(map[string]struct{})
-	for _, missingAuthEventID := range stateResp.MissingAuthEventIDs {
+	for _, missingAuthEventID := range missingAuthEventIDs {
 		missingAuthEvents[missingAuthEventID] = struct{}{}
 	}
 
 withNextEvent:
 	for missingAuthEventID := range missingAuthEvents {
+		if t.haveHadEvent(missingAuthEventID) {
+			// We fetched it further down the auth chain already.
+			delete(missingAuthEvents, missingAuthEventID)
+			continue withNextEvent
+		}
+		if t.maxAuthChainEvents > 0 && *fetched >= t.maxAuthChainEvents {
+			return authChainBoundError{e.EventID(), depth, *fetched}
+		}
 	withNextServer:
 		for _, server := range t.getServers(ctx, e.RoomID(), e) {
 			logger.Infof("Retrieving missing auth event %q from %q", missingAuthEventID, server)
@@ -668,18 +900,27 @@ withNextEvent:
 				}
 				continue withNextServer
 			}
-			ev, err := gomatrixserverlib.NewEventFromUntrustedJSON(tx.PDUs[0], stateResp.RoomVersion)
+			if len(tx.PDUs) == 0 {
+				logger.Warnf("Server %q returned no PDUs for auth event %q", server, missingAuthEventID)
+				continue withNextServer
+			}
+			ev, err := parseInboundPDU(tx.PDUs[0], roomVersion)
 			if err != nil {
 				logger.WithError(err).Warnf("Failed to unmarshal auth event %q", missingAuthEventID)
 				continue withNextServer
 			}
+			*fetched++
+			// The roomserver needs the auth events of the auth event too.
+			if err = t.retrieveAuthEventsOf(ctx, e, ev, roomVersion, depth, fetched); err != nil {
+				return err
+			}
 			if err = api.SendInputRoomEvents(
 				context.Background(),
 				t.rsAPI,
 				[]api.InputRoomEvent{
 					{
 						Kind:         api.KindOutlier,
-						Event:        ev.Headered(stateResp.RoomVersion),
+						Event:        ev.Headered(roomVersion),
 						AuthEventIDs: ev.AuthEventIDs(),
 						SendAsServer: api.DoNotSendToOtherServers,
 					},
@@ -688,7 +929,7 @@ withNextEvent:
 				return fmt.Errorf("api.SendEvents: %w", err)
 			}
 			t.hadEvent(ev.EventID(), true) // if the roomserver didn't know about the event before, it does now
-			t.cacheAndReturn(ev.Headered(stateResp.RoomVersion))
+			t.cacheAndReturn(ev.Headered(roomVersion))
 			delete(missingAuthEvents, missingAuthEventID)
 			continue withNextEvent
 		}
@@ -700,6 +941,29 @@ withNextEvent:
 	return nil
 }
 
+// retrieveAuthEventsOf fetches any missing auth events of the auth event ev,
+// which is at the given depth in the auth chain of e.
+func (t *txnReq) retrieveAuthEventsOf(
+	ctx context.Context, e, ev *gomatrixserverlib.Event,
+	roomVersion gomatrixserverlib.RoomVersion, depth int, fetched *int,
+) error {
+	if len(ev.AuthEventIDs()) == 0 {
+		return nil
+	}
+	stateReq := api.QueryMissingAuthPrevEventsRequest{
+		RoomID:       e.RoomID(),
+		AuthEventIDs: ev.AuthEventIDs(),
+	}
+	var stateResp api.QueryMissingAuthPrevEventsResponse
+	if err := t.rsAPI.QueryMissingAuthPrevEvents(ctx, &stateReq, &stateResp); err != nil {
+		return fmt.Errorf("t.rsAPI.QueryMissingAuthPrevEvents: %w", err)
+	}
+	if len(stateResp.MissingAuthEventIDs) == 0 {
+		return nil
+	}
+	return t.retrieveAuthEvents(ctx, e, stateResp.MissingAuthEventIDs, roomVersion, depth+1, fetched)
+}
+
 func checkAllowedByState(e *gomatrixserverlib.Event, stateEvents []*gomatrixserverlib.Event) error {
 	authUsingState := gomatrixserverlib.NewAuthEvents(nil)
 	for i := range stateEvents {
@@ -1330,7 +1594,7 @@ func (t *txnReq) lookupEvent(ctx context.Context, roomVersion gomatrixserverlib.
 			}
 			continue
 		}
-		event, err = gomatrixserverlib.NewEventFromUntrustedJSON(txn.PDUs[0], roomVersion)
+		event, err = parseInboundPDU(txn.PDUs[0], roomVersion)
 		if err != nil {
 			util.GetLogger(ctx).WithError(err).WithField("event_id", missingEventID).Warnf("Transaction: Failed to parse event JSON of event")
 			continue
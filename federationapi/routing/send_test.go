@@ -2,17 +2,23 @@ package routing
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Shopify/sarama"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	eduInput "github.com/matrix-org/dendrite/eduserver/input"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/sjson"
 )
 
 const (
@@ -57,6 +63,10 @@ func init() {
 type testEDUProducer struct {
 	// this producer keeps track of calls to InputTypingEvent
 	invocations []eduAPI.InputTypingEventRequest
+	// and calls to InputPresence
+	presenceInvocations []eduAPI.InputPresenceRequest
+	// and calls to InputSendToDeviceEvent
+	sendToDeviceInvocations []eduAPI.InputSendToDeviceEventRequest
 }
 
 func (p *testEDUProducer) InputTypingEvent(
@@ -73,6 +83,7 @@ func (p *testEDUProducer) InputSendToDeviceEvent(
 	request *eduAPI.InputSendToDeviceEventRequest,
 	response *eduAPI.InputSendToDeviceEventResponse,
 ) error {
+	p.sendToDeviceInvocations = append(p.sendToDeviceInvocations, *request)
 	return nil
 }
 
@@ -84,6 +95,15 @@ func (o *testEDUProducer) InputReceiptEvent(
 	return nil
 }
 
+func (o *testEDUProducer) InputPresence(
+	ctx context.Context,
+	request *eduAPI.InputPresenceRequest,
+	response *eduAPI.InputPresenceResponse,
+) error {
+	o.presenceInvocations = append(o.presenceInvocations, *request)
+	return nil
+}
+
 type testRoomserverAPI struct {
 	api.RoomserverInternalAPITrace
 	inputRoomEvents            []api.InputRoomEvent
@@ -91,6 +111,8 @@ type testRoomserverAPI struct {
 	queryStateAfterEvents      func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
 	queryEventsByID            func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse
 	queryLatestEventsAndState  func(*api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse
+	queryMembershipForUser     func(*api.QueryMembershipForUserRequest) api.QueryMembershipForUserResponse
+	queryServerBannedFromRoom  func(*api.QueryServerBannedFromRoomRequest) bool
 }
 
 func (t *testRoomserverAPI) InputRoomEvents(
@@ -164,7 +186,11 @@ func (t *testRoomserverAPI) QueryMembershipForUser(
 	request *api.QueryMembershipForUserRequest,
 	response *api.QueryMembershipForUserResponse,
 ) error {
-	return fmt.Errorf("not implemented")
+	if t.queryMembershipForUser == nil {
+		return fmt.Errorf("not implemented")
+	}
+	*response = t.queryMembershipForUser(request)
+	return nil
 }
 
 func (t *testRoomserverAPI) QueryPublishedRooms(
@@ -318,6 +344,13 @@ func (t *testRoomserverAPI) QueryKnownUsers(ctx context.Context, req *api.QueryK
 }
 
 func (t *testRoomserverAPI) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse) error {
+	if t.queryServerBannedFromRoom != nil {
+		res.Banned = t.queryServerBannedFromRoom(req)
+	}
+	return nil
+}
+
+func (t *testRoomserverAPI) QueryServersInRoom(ctx context.Context, req *api.QueryServersInRoomRequest, res *api.QueryServersInRoomResponse) error {
 	return nil
 }
 
@@ -457,6 +490,391 @@ func TestBasicTransaction(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to check that events with an origin_server_ts too far in the future are rejected and not
+// passed to the roomserver, while other events in the same transaction are still processed.
+func TestTransactionPresence(t *testing.T) {
+	rsAPI := &testRoomserverAPI{}
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	statusMsg := "away from keyboard"
+	content, err := json.Marshal(eduAPI.FederationPresence{
+		Push: []eduAPI.FederationPresenceUpdate{
+			{UserID: "@alice:" + string(testOrigin), Presence: eduAPI.PresenceUnavailable, StatusMsg: &statusMsg, LastActiveAgo: 60000},
+			// Servers can only send the presence of their own users.
+			{UserID: "@mallory:evil.example", Presence: eduAPI.PresenceOnline},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.EDUs = []gomatrixserverlib.EDU{{Type: eduAPI.MPresence, Content: content}}
+	mustProcessTransaction(t, txn, nil)
+
+	if len(eduProducer.presenceInvocations) != 1 {
+		t.Fatalf("got %d presence updates, want 1", len(eduProducer.presenceInvocations))
+	}
+	got := eduProducer.presenceInvocations[0].InputPresence
+	if got.UserID != "@alice:"+string(testOrigin) || got.Presence != eduAPI.PresenceUnavailable || got.StatusMsg == nil || *got.StatusMsg != statusMsg {
+		t.Errorf("unexpected presence update %+v", got)
+	}
+	if ago := time.Since(got.LastActiveTS.Time()); ago < time.Minute || ago > 2*time.Minute {
+		t.Errorf("got last active %s ago, want about a minute", ago)
+	}
+}
+
+// testPresenceProducer records the presence events which the EDU server
+// produces.
+type testPresenceProducer struct {
+	sarama.SyncProducer
+	events []eduAPI.OutputPresenceEvent
+}
+
+func (p *testPresenceProducer) SendMessage(m *sarama.ProducerMessage) (int32, int64, error) {
+	b, err := m.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	var ev eduAPI.OutputPresenceEvent
+	if err = json.Unmarshal(b, &ev); err != nil {
+		return 0, 0, err
+	}
+	p.events = append(p.events, ev)
+	return 0, 0, nil
+}
+
+// Remote status messages go through the same checks as local ones, as they
+// end up in the syncs of local users.
+func TestTransactionPresenceStatusMsg(t *testing.T) {
+	producer := &testPresenceProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduAPI = &eduInput.EDUServerInputAPI{
+		Producer:                   producer,
+		ServerName:                 testDestination,
+		PresenceStatusMsgMaxLength: 16,
+	}
+	oversized := "\u0000" + strings.Repeat("a", 17) + "\u001b"
+	sanitised := "at\u0000 lunch\u001b[31m"
+	content, err := json.Marshal(eduAPI.FederationPresence{
+		Push: []eduAPI.FederationPresenceUpdate{
+			{UserID: "@alice:" + string(testOrigin), Presence: eduAPI.PresenceOnline, StatusMsg: &oversized},
+			{UserID: "@bob:" + string(testOrigin), Presence: eduAPI.PresenceOnline, StatusMsg: &sanitised},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.EDUs = []gomatrixserverlib.EDU{{Type: eduAPI.MPresence, Content: content}}
+	mustProcessTransaction(t, txn, nil)
+
+	if len(producer.events) != 1 {
+		t.Fatalf("got %d presence events, want 1: %+v", len(producer.events), producer.events)
+	}
+	got := producer.events[0]
+	if got.UserID != "@bob:"+string(testOrigin) || got.StatusMsg == nil || *got.StatusMsg != "at lunch[31m" {
+		t.Errorf("unexpected presence event %+v", got)
+	}
+}
+
+func TestTransactionTyping(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMembershipForUser: func(req *api.QueryMembershipForUserRequest) api.QueryMembershipForUserResponse {
+			return api.QueryMembershipForUserResponse{IsInRoom: req.UserID == "@alice:"+string(testOrigin)}
+		},
+	}
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	for _, userID := range []string{"@alice:" + string(testOrigin), "@bob:" + string(testOrigin), "@mallory:evil.example"} {
+		content, err := json.Marshal(map[string]interface{}{
+			"room_id": "!roomid:kaer.morhen",
+			"user_id": userID,
+			"typing":  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping, Content: content})
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	// Only alice is joined to the room and belongs to the origin.
+	if len(eduProducer.invocations) != 1 {
+		t.Fatalf("got %d typing updates, want 1", len(eduProducer.invocations))
+	}
+	got := eduProducer.invocations[0].InputTypingEvent
+	if got.UserID != "@alice:"+string(testOrigin) || !got.Typing || got.TimeoutMS != federationTypingTimeout {
+		t.Errorf("unexpected typing update %+v", got)
+	}
+}
+
+func TestTransactionServerACLs(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMembershipForUser: func(req *api.QueryMembershipForUserRequest) api.QueryMembershipForUserResponse {
+			return api.QueryMembershipForUserResponse{IsInRoom: true}
+		},
+		queryServerBannedFromRoom: func(req *api.QueryServerBannedFromRoomRequest) bool {
+			return req.RoomID == "!banned:kaer.morhen"
+		},
+	}
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	for _, roomID := range []string{"!banned:kaer.morhen", "!allowed:kaer.morhen"} {
+		content, err := json.Marshal(map[string]interface{}{
+			"room_id": roomID,
+			"user_id": "@alice:" + string(testOrigin),
+			"typing":  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping, Content: content})
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	// Typing in the room which the origin is banned from by ACLs is dropped.
+	if len(eduProducer.invocations) != 1 {
+		t.Fatalf("got %d typing updates, want 1", len(eduProducer.invocations))
+	}
+	if got := eduProducer.invocations[0].InputTypingEvent.RoomID; got != "!allowed:kaer.morhen" {
+		t.Errorf("got typing update for %q, want !allowed:kaer.morhen", got)
+	}
+}
+
+func TestTransactionSendToDevice(t *testing.T) {
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	for _, sender := range []string{"@alice:" + string(testOrigin), "@mallory:evil.example"} {
+		content, err := json.Marshal(gomatrixserverlib.ToDeviceMessage{
+			Sender:    sender,
+			Type:      "m.room_key_request",
+			MessageID: "abc",
+			Messages: map[string]map[string]json.RawMessage{
+				"@bob:" + string(testDestination): {"*": []byte(`{}`)},
+				"@carol:" + string(testOrigin):    {"DEVICE": []byte(`{}`)},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{Type: gomatrixserverlib.MDirectToDevice, Content: content})
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	// Only the message from the origin to our own user is delivered.
+	if len(eduProducer.sendToDeviceInvocations) != 1 {
+		t.Fatalf("got %d send-to-device events, want 1", len(eduProducer.sendToDeviceInvocations))
+	}
+	got := eduProducer.sendToDeviceInvocations[0].InputSendToDeviceEvent
+	if got.Sender != "@alice:"+string(testOrigin) || got.UserID != "@bob:"+string(testDestination) || got.DeviceID != "*" {
+		t.Errorf("unexpected send-to-device event %+v", got)
+	}
+}
+
+type testKeyAPI struct {
+	keyapi.KeyInternalAPI
+	deviceListUpdates []gomatrixserverlib.DeviceListUpdateEvent
+}
+
+func (k *testKeyAPI) InputDeviceListUpdate(ctx context.Context, req *keyapi.InputDeviceListUpdateRequest, res *keyapi.InputDeviceListUpdateResponse) {
+	k.deviceListUpdates = append(k.deviceListUpdates, req.Event)
+}
+
+func TestTransactionDeviceListUpdate(t *testing.T) {
+	keyAPI := &testKeyAPI{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.keyAPI = keyAPI
+	for _, userID := range []string{"@alice:" + string(testOrigin), "@mallory:evil.example"} {
+		content, err := json.Marshal(gomatrixserverlib.DeviceListUpdateEvent{
+			UserID:   userID,
+			DeviceID: "DEVICE",
+			StreamID: 2,
+			PrevID:   []int{1},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{Type: gomatrixserverlib.MDeviceListUpdate, Content: content})
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	// Only the update for a user on the origin server is passed on.
+	if len(keyAPI.deviceListUpdates) != 1 {
+		t.Fatalf("got %d device list updates, want 1", len(keyAPI.deviceListUpdates))
+	}
+	if got := keyAPI.deviceListUpdates[0]; got.UserID != "@alice:"+string(testOrigin) || got.DeviceID != "DEVICE" {
+		t.Errorf("unexpected device list update %+v", got)
+	}
+}
+
+func TestTransactionRejectsFutureEvents(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingAuthEventIDs: []string{},
+				MissingPrevEventIDs: []string{},
+			}
+		},
+	}
+	future := time.Now().Add(48 * time.Hour)
+	futurePDU, err := sjson.SetBytes(testData[len(testData)-2], "origin_server_ts", gomatrixserverlib.AsTimestamp(future))
+	if err != nil {
+		t.Fatalf("failed to set origin_server_ts: %s", err)
+	}
+	pdus := []json.RawMessage{
+		futurePDU,
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.futureEventTolerance = time.Hour
+	futureEventID := testEvents[len(testEvents)-2].EventID()
+	res, jsonErr := txn.processTransaction(context.Background())
+	if jsonErr != nil {
+		t.Fatalf("txn.processTransaction returned an error: %v", jsonErr)
+	}
+	if res.PDUs[futureEventID].Error == "" {
+		t.Errorf("expected event %s to be rejected", futureEventID)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+
+	// The same event is accepted when the tolerance allows it.
+	txn.futureEventTolerance = 72 * time.Hour
+	if txn.isTooFarInFuture(mustParseEvent(t, futurePDU), time.Now()) {
+		t.Errorf("expected event within tolerance to be accepted")
+	}
+	// And when the check is disabled.
+	txn.futureEventTolerance = 0
+	if txn.isTooFarInFuture(mustParseEvent(t, futurePDU), time.Now()) {
+		t.Errorf("expected event to be accepted with the check disabled")
+	}
+}
+
+func mustParseEvent(t *testing.T, pdu json.RawMessage) *gomatrixserverlib.Event {
+	t.Helper()
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to parse event: %s", err)
+	}
+	return event
+}
+
+// mustCreateAuthChain creates a chain of n events where each event's only auth event is the next one in the chain, as if each
+// were authorised by the one before it. The first event is the newest.
+func mustCreateAuthChain(t *testing.T, n int) []*gomatrixserverlib.Event {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	chain := make([]*gomatrixserverlib.Event, n)
+	for i := n - 1; i >= 0; i-- {
+		stateKey := ""
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:   "@userid:kaer.morhen",
+			RoomID:   "!roomid:kaer.morhen",
+			Type:     "m.room.power_levels",
+			StateKey: &stateKey,
+			Depth:    int64(n - i),
+		}
+		if i < n-1 {
+			eb.AuthEvents = []gomatrixserverlib.EventReference{chain[i+1].EventReference()}
+		}
+		if err = eb.SetContent(map[string]interface{}{"users_default": i}); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		chain[i], err = eb.Build(time.Now(), testOrigin, "ed25519:test", key, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+	}
+	return chain
+}
+
+// The purpose of this test is to check that an event whose auth chain is missing further back than we are willing to fetch
+// is soft-failed rather than fetching the auth chain forever, and that an auth chain within the bounds is fetched oldest first.
+func TestTransactionBoundsAuthChainFetching(t *testing.T) {
+	chain := mustCreateAuthChain(t, 20)
+	fedClient := &txnFedClient{
+		getEvent: make(map[string]gomatrixserverlib.Transaction),
+	}
+	for _, ev := range chain[1:] {
+		fedClient.getEvent[ev.EventID()] = gomatrixserverlib.Transaction{
+			PDUs: []json.RawMessage{ev.JSON()},
+		}
+	}
+	newRoomserverAPI := func() *testRoomserverAPI {
+		rsAPI := &testRoomserverAPI{}
+		// The roomserver knows nothing about any of the events until we send them to it.
+		rsAPI.queryMissingAuthPrevEvents = func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			res := api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingPrevEventIDs: []string{},
+			}
+		NextAuthEvent:
+			for _, eventID := range req.AuthEventIDs {
+				for _, ire := range rsAPI.inputRoomEvents {
+					if ire.Event.EventID() == eventID {
+						continue NextAuthEvent
+					}
+				}
+				res.MissingAuthEventIDs = append(res.MissingAuthEventIDs, eventID)
+			}
+			return res
+		}
+		return rsAPI
+	}
+
+	for _, tt := range []struct {
+		name      string
+		maxDepth  int
+		maxEvents int
+		wantErr   bool
+	}{
+		{name: "within bounds", maxDepth: 19, maxEvents: 19},
+		{name: "unbounded", maxDepth: 0, maxEvents: 0},
+		{name: "too deep", maxDepth: 10, maxEvents: 100, wantErr: true},
+		{name: "too many", maxDepth: 100, maxEvents: 10, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rsAPI := newRoomserverAPI()
+			txn := mustCreateTransaction(rsAPI, fedClient, []json.RawMessage{chain[0].JSON()})
+			txn.maxAuthChainDepth = tt.maxDepth
+			txn.maxAuthChainEvents = tt.maxEvents
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				var pdusWithErrors []string
+				if tt.wantErr {
+					pdusWithErrors = []string{chain[0].EventID()}
+				}
+				mustProcessTransaction(t, txn, pdusWithErrors)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out processing transaction")
+			}
+
+			if tt.wantErr {
+				for _, ire := range rsAPI.inputRoomEvents {
+					if ire.Event.EventID() == chain[0].EventID() {
+						t.Errorf("expected event with unresolvable auth chain not to be sent to the roomserver")
+					}
+				}
+				return
+			}
+			want := make([]*gomatrixserverlib.HeaderedEvent, len(chain))
+			for i := range chain {
+				want[len(chain)-1-i] = chain[i].Headered(testRoomVersion)
+			}
+			assertInputRoomEvents(t, rsAPI.inputRoomEvents, want)
+		})
+	}
+}
+
 // The purpose of this test is to check that if the event received fails auth checks the event is still sent to the roomserver
 // as it does the auth check.
 func TestTransactionFailAuthChecks(t *testing.T) {
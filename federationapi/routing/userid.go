@@ -0,0 +1,67 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// maxUserIDLength is the maximum length of a user ID in bytes, including
+// the sigil and the domain.
+// https://matrix.org/docs/spec/appendices#user-identifiers
+const maxUserIDLength = 255
+
+// validateUserID checks that the user ID is well-formed, returning its
+// localpart and domain. SplitID on its own accepts an empty localpart and
+// anything at all as the domain. The localpart is allowed to contain any
+// printable ASCII other than ':', as older servers permitted user IDs which
+// don't follow the current grammar, and the domain must be a valid server
+// name, so internationalised domains must be given in punycode.
+func validateUserID(userID string) (string, gomatrixserverlib.ServerName, error) {
+	if len(userID) > maxUserIDLength {
+		return "", "", fmt.Errorf("user ID must be no more than %d bytes", maxUserIDLength)
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", "", errors.New("user ID must be of the form @localpart:domain")
+	}
+	if localpart == "" {
+		return "", "", errors.New("user ID localpart must not be empty")
+	}
+	for _, r := range localpart {
+		if r < 0x21 || r > 0x7e {
+			return "", "", errors.New("user ID localpart must only contain printable ASCII characters")
+		}
+	}
+	if _, _, ok := gomatrixserverlib.ParseAndValidateServerName(domain); !ok {
+		return "", "", fmt.Errorf("user ID domain %q is not a valid server name", domain)
+	}
+	return localpart, domain, nil
+}
+
+// invalidUserIDResponse returns the 400 response for a user ID rejected by
+// validateUserID.
+func invalidUserIDResponse(err error) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidParam(err.Error()),
+	}
+}
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestValidateUserID(t *testing.T) {
+	longest := "@" + strings.Repeat("a", maxUserIDLength-len(":white.orchard")-1) + ":white.orchard"
+	tests := []struct {
+		name       string
+		userID     string
+		wantErr    bool
+		wantDomain gomatrixserverlib.ServerName
+	}{
+		{name: "valid", userID: "@alice:white.orchard", wantDomain: "white.orchard"},
+		{name: "valid with port", userID: "@alice:white.orchard:8448", wantDomain: "white.orchard:8448"},
+		{name: "valid IPv4 domain", userID: "@alice:127.0.0.1", wantDomain: "127.0.0.1"},
+		{name: "valid IPv6 domain", userID: "@alice:[::1]:8448", wantDomain: "[::1]:8448"},
+		{name: "historical localpart", userID: "@Alice!#~:white.orchard", wantDomain: "white.orchard"},
+		{name: "maximum length", userID: longest, wantDomain: "white.orchard"},
+		{name: "empty", userID: "", wantErr: true},
+		{name: "no sigil", userID: "alice:white.orchard", wantErr: true},
+		{name: "wrong sigil", userID: "!alice:white.orchard", wantErr: true},
+		{name: "no domain separator", userID: "@alice", wantErr: true},
+		{name: "empty localpart", userID: "@:white.orchard", wantErr: true},
+		{name: "empty domain", userID: "@alice:", wantErr: true},
+		{name: "space in localpart", userID: "@al ice:white.orchard", wantErr: true},
+		{name: "control character in localpart", userID: "@al\x00ice:white.orchard", wantErr: true},
+		{name: "non-ASCII localpart", userID: "@ålice:white.orchard", wantErr: true},
+		{name: "IDN domain", userID: "@alice:bücher.example", wantErr: true},
+		{name: "space in domain", userID: "@alice:white orchard", wantErr: true},
+		{name: "slash in domain", userID: "@alice:white.orchard/path", wantErr: true},
+		{name: "unterminated IPv6 domain", userID: "@alice:[::1", wantErr: true},
+		{name: "too long", userID: "@a" + longest[1:], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, domain, err := validateUserID(tt.userID)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected %q to be rejected", tt.userID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected %q to be accepted, got %s", tt.userID, err)
+			}
+			if domain != tt.wantDomain {
+				t.Errorf("expected domain %q, got %q", tt.wantDomain, domain)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// verifyJSONsMinBatchSize is the smallest number of requests that will be
+// handed to a single worker by VerifyJSONsConcurrently. Smaller batches
+// aren't worth the overhead of a goroutine, and batching lets the key ring
+// fetch the keys for several requests at once.
+const verifyJSONsMinBatchSize = 8
+
+// VerifyJSONsConcurrently verifies the given requests, splitting them into
+// batches that are verified in parallel by at most maxWorkers goroutines.
+// The results are returned in the same order as the requests. If any batch
+// fails then the first error is returned.
+func VerifyJSONsConcurrently(
+	ctx context.Context,
+	keys gomatrixserverlib.JSONVerifier,
+	reqs []gomatrixserverlib.VerifyJSONRequest,
+	maxWorkers int,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	workers := (len(reqs) + verifyJSONsMinBatchSize - 1) / verifyJSONsMinBatchSize
+	if workers > maxWorkers {
+		workers = maxWorkers
+	}
+	if workers <= 1 {
+		return keys.VerifyJSONs(ctx, reqs)
+	}
+
+	batchSize := (len(reqs) + workers - 1) / workers
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(reqs))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * batchSize
+		if start >= len(reqs) {
+			break
+		}
+		end := start + batchSize
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			res, err := keys.VerifyJSONs(ctx, reqs[start:end])
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			copy(results[start:end], res)
+		}(w, start, end)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// concurrentKeyRing is a JSONVerifier which verifies large numbers of
+// requests using VerifyJSONsConcurrently.
+type concurrentKeyRing struct {
+	keys       gomatrixserverlib.JSONVerifier
+	maxWorkers int
+}
+
+func (k *concurrentKeyRing) VerifyJSONs(
+	ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	return VerifyJSONsConcurrently(ctx, k.keys, reqs, k.maxWorkers)
+}
+
+// RefreshKeys passes through to the wrapped key ring if it is a KeyRefresher.
+func (k *concurrentKeyRing) RefreshKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	if refresher, ok := k.keys.(KeyRefresher); ok {
+		return refresher.RefreshKeys(ctx, serverName)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// verifyCacheSize is the maximum number of successful verifications that
+// are remembered at once.
+const verifyCacheSize = 10000
+
+// verifyCacheLookupsTotal counts lookups in the signature verification
+// cache by outcome: "hit" or "miss".
+var verifyCacheLookupsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "leave_verify_cache_lookups",
+		Help:      "Number of lookups in the send_leave signature verification cache by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(verifyCacheLookupsTotal)
+}
+
+// verifyCacheKey identifies a verification request. The hash covers the
+// whole signed message, including the signatures and so the key IDs. The
+// timestamp and validity checking are included as they change which keys
+// the key ring will accept.
+type verifyCacheKey struct {
+	serverName gomatrixserverlib.ServerName
+	hash       [sha256.Size]byte
+	atTS       gomatrixserverlib.Timestamp
+	strict     bool
+}
+
+type verifyCacheEntry struct {
+	key     verifyCacheKey
+	expires time.Time
+}
+
+// cachingKeyRing is a JSONVerifier which remembers which requests passed
+// verification for a short time, so that the same signed message, e.g. a
+// retried send_leave, isn't verified again. Only successful verifications
+// are cached, so failures always go to the key ring, and the cached entries
+// for a server are dropped whenever its keys are refreshed. Otherwise a key
+// that expires or is revoked can still be trusted for up to the TTL, which
+// should therefore be kept short.
+type cachingKeyRing struct {
+	keys    gomatrixserverlib.JSONVerifier
+	mu      sync.Mutex
+	entries map[verifyCacheKey]*list.Element
+	order   *list.List // of *verifyCacheEntry, oldest first
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+}
+
+func newCachingKeyRing(keys gomatrixserverlib.JSONVerifier, ttl time.Duration, maxSize int) *cachingKeyRing {
+	return &cachingKeyRing{
+		keys:    keys,
+		entries: make(map[verifyCacheKey]*list.Element),
+		order:   list.New(),
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+	}
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier. Requests which are
+// in the cache pass straight away and only the rest are verified.
+func (k *cachingKeyRing) VerifyJSONs(
+	ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(reqs))
+	keys := make([]verifyCacheKey, len(reqs))
+	var missReqs []gomatrixserverlib.VerifyJSONRequest
+	var missIdxs []int
+	for i, req := range reqs {
+		keys[i] = verifyCacheKey{
+			serverName: req.ServerName,
+			hash:       sha256.Sum256(req.Message),
+			atTS:       req.AtTS,
+			strict:     req.StrictValidityChecking,
+		}
+		if k.has(keys[i]) {
+			verifyCacheLookupsTotal.WithLabelValues("hit").Inc()
+			continue
+		}
+		verifyCacheLookupsTotal.WithLabelValues("miss").Inc()
+		missReqs = append(missReqs, req)
+		missIdxs = append(missIdxs, i)
+	}
+	if len(missReqs) == 0 {
+		return results, nil
+	}
+	missResults, err := k.keys.VerifyJSONs(ctx, missReqs)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range missIdxs {
+		results[i] = missResults[j]
+		if missResults[j].Error == nil {
+			k.add(keys[i])
+		}
+	}
+	return results, nil
+}
+
+// RefreshKeys drops the cached verifications for the server and then passes
+// through to the wrapped key ring if it is a KeyRefresher.
+func (k *cachingKeyRing) RefreshKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	k.forget(serverName)
+	if refresher, ok := k.keys.(KeyRefresher); ok {
+		return refresher.RefreshKeys(ctx, serverName)
+	}
+	return nil
+}
+
+func (k *cachingKeyRing) has(key verifyCacheKey) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.evictExpired()
+	_, ok := k.entries[key]
+	return ok
+}
+
+func (k *cachingKeyRing) add(key verifyCacheKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.evictExpired()
+	if _, ok := k.entries[key]; ok {
+		return
+	}
+	for k.order.Len() >= k.maxSize {
+		k.remove(k.order.Front())
+	}
+	k.entries[key] = k.order.PushBack(&verifyCacheEntry{
+		key:     key,
+		expires: k.now().Add(k.ttl),
+	})
+}
+
+func (k *cachingKeyRing) forget(serverName gomatrixserverlib.ServerName) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for el := k.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*verifyCacheEntry).key.serverName == serverName {
+			k.remove(el)
+		}
+		el = next
+	}
+}
+
+// evictExpired removes expired entries. The caller must hold the lock.
+func (k *cachingKeyRing) evictExpired() {
+	now := k.now()
+	for el := k.order.Front(); el != nil; el = k.order.Front() {
+		if now.Before(el.Value.(*verifyCacheEntry).expires) {
+			return
+		}
+		k.remove(el)
+	}
+}
+
+// remove removes the entry. The caller must hold the lock.
+func (k *cachingKeyRing) remove(el *list.Element) {
+	k.order.Remove(el)
+	delete(k.entries, el.Value.(*verifyCacheEntry).key)
+}
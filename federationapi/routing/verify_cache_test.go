@@ -0,0 +1,146 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recordingKeyRing records every request it is asked to verify, failing
+// those whose message is "bad".
+type recordingKeyRing struct {
+	echoKeyRing
+	verified  []gomatrixserverlib.VerifyJSONRequest
+	refreshed []gomatrixserverlib.ServerName
+}
+
+func (k *recordingKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	k.verified = append(k.verified, reqs...)
+	return k.echoKeyRing.VerifyJSONs(ctx, reqs)
+}
+
+func (k *recordingKeyRing) RefreshKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	k.refreshed = append(k.refreshed, serverName)
+	return nil
+}
+
+func TestCachingKeyRing(t *testing.T) {
+	ctx := context.Background()
+	inner := &recordingKeyRing{}
+	keys := newCachingKeyRing(inner, time.Minute, 10)
+	now := time.Unix(1000, 0)
+	keys.now = func() time.Time { return now }
+
+	req := gomatrixserverlib.VerifyJSONRequest{
+		ServerName:             testOrigin,
+		Message:                []byte("good"),
+		AtTS:                   1000,
+		StrictValidityChecking: true,
+	}
+	bad := req
+	bad.Message = []byte("bad")
+	verify := func(reqs ...gomatrixserverlib.VerifyJSONRequest) []gomatrixserverlib.VerifyJSONResult {
+		t.Helper()
+		res, err := keys.VerifyJSONs(ctx, reqs)
+		if err != nil {
+			t.Fatalf("VerifyJSONs failed: %s", err)
+		}
+		if len(res) != len(reqs) {
+			t.Fatalf("got %d results for %d requests", len(res), len(reqs))
+		}
+		return res
+	}
+
+	hits := verifyCacheLookupsTotal.WithLabelValues("hit")
+	misses := verifyCacheLookupsTotal.WithLabelValues("miss")
+	hitsBefore, missesBefore := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+
+	// The first verification goes to the key ring, the second doesn't.
+	verify(req)
+	if res := verify(req, bad); res[0].Error != nil || res[1].Error == nil {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+	if len(inner.verified) != 2 || string(inner.verified[1].Message) != "bad" {
+		t.Fatalf("expected only the uncached request to be verified, got %d verifications", len(inner.verified))
+	}
+	if got := testutil.ToFloat64(hits) - hitsBefore; got != 1 {
+		t.Errorf("expected 1 cache hit, got %v", got)
+	}
+	if got := testutil.ToFloat64(misses) - missesBefore; got != 2 {
+		t.Errorf("expected 2 cache misses, got %v", got)
+	}
+
+	// Failures are never cached.
+	if res := verify(bad); res[0].Error == nil {
+		t.Fatalf("expected bad request to fail again")
+	}
+	if len(inner.verified) != 3 {
+		t.Fatalf("expected failed request to be verified again, got %d verifications", len(inner.verified))
+	}
+
+	// A different timestamp or validity checking is a different question for
+	// the key ring, as it may change which keys are acceptable.
+	otherTS := req
+	otherTS.AtTS = 2000
+	notStrict := req
+	notStrict.StrictValidityChecking = false
+	verify(otherTS, notStrict)
+	if len(inner.verified) != 5 {
+		t.Fatalf("expected requests with different validity to be verified, got %d verifications", len(inner.verified))
+	}
+
+	// Refreshing the server's keys forgets what was verified with them.
+	if err := keys.RefreshKeys(ctx, testOrigin); err != nil {
+		t.Fatalf("RefreshKeys failed: %s", err)
+	}
+	if len(inner.refreshed) != 1 {
+		t.Errorf("expected refresh to be passed through to the key ring")
+	}
+	verify(req)
+	if len(inner.verified) != 6 {
+		t.Fatalf("expected request to be verified again after refresh, got %d verifications", len(inner.verified))
+	}
+
+	// Entries expire after the TTL.
+	verify(req)
+	if len(inner.verified) != 6 {
+		t.Fatalf("expected request to be cached, got %d verifications", len(inner.verified))
+	}
+	now = now.Add(time.Minute)
+	verify(req)
+	if len(inner.verified) != 7 {
+		t.Fatalf("expected request to be verified again after TTL, got %d verifications", len(inner.verified))
+	}
+}
+
+func TestCachingKeyRingSizeBound(t *testing.T) {
+	keys := newCachingKeyRing(&recordingKeyRing{}, time.Minute, 2)
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := keys.VerifyJSONs(context.Background(), []gomatrixserverlib.VerifyJSONRequest{{
+			ServerName: testOrigin,
+			Message:    []byte(msg),
+		}}); err != nil {
+			t.Fatalf("VerifyJSONs failed: %s", err)
+		}
+	}
+	if got := keys.order.Len(); got != 2 {
+		t.Errorf("expected 2 cached entries, got %d", got)
+	}
+}
@@ -0,0 +1,118 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// echoKeyRing fails verification of any request whose message is "bad",
+// and records how many requests it is asked to verify concurrently.
+type echoKeyRing struct {
+	mu      sync.Mutex
+	calls   int
+	active  int
+	peak    int
+	barrier chan struct{}
+	err     error
+}
+
+func (k *echoKeyRing) VerifyJSONs(ctx context.Context, reqs []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	k.mu.Lock()
+	k.calls++
+	k.active++
+	if k.active > k.peak {
+		k.peak = k.active
+	}
+	k.mu.Unlock()
+	if k.barrier != nil {
+		<-k.barrier
+	}
+	k.mu.Lock()
+	k.active--
+	k.mu.Unlock()
+	if k.err != nil {
+		return nil, k.err
+	}
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(reqs))
+	for i := range reqs {
+		if string(reqs[i].Message) == "bad" {
+			results[i].Error = fmt.Errorf("bad signature on request %d", i)
+		}
+	}
+	return results, nil
+}
+
+func makeVerifyRequests(n int, bad map[int]bool) []gomatrixserverlib.VerifyJSONRequest {
+	reqs := make([]gomatrixserverlib.VerifyJSONRequest, n)
+	for i := range reqs {
+		reqs[i].Message = []byte("good")
+		if bad[i] {
+			reqs[i].Message = []byte("bad")
+		}
+	}
+	return reqs
+}
+
+func TestVerifyJSONsConcurrentlyPreservesOrder(t *testing.T) {
+	bad := map[int]bool{0: true, 17: true, 63: true, 99: true}
+	reqs := makeVerifyRequests(100, bad)
+	keys := &echoKeyRing{}
+	results, err := VerifyJSONsConcurrently(context.Background(), keys, reqs, 4)
+	if err != nil {
+		t.Fatalf("VerifyJSONsConcurrently: %s", err)
+	}
+	if len(results) != len(reqs) {
+		t.Fatalf("expected %d results, got %d", len(reqs), len(results))
+	}
+	for i, res := range results {
+		if bad[i] != (res.Error != nil) {
+			t.Errorf("request %d: expected failure %v, got error %v", i, bad[i], res.Error)
+		}
+	}
+	if keys.calls != 4 {
+		t.Errorf("expected requests to be split into 4 batches, got %d", keys.calls)
+	}
+}
+
+func TestVerifyJSONsConcurrentlyBoundsWorkers(t *testing.T) {
+	keys := &echoKeyRing{barrier: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := VerifyJSONsConcurrently(context.Background(), keys, makeVerifyRequests(1000, nil), 3); err != nil {
+			t.Errorf("VerifyJSONsConcurrently: %s", err)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		keys.barrier <- struct{}{}
+	}
+	<-done
+	if keys.peak > 3 {
+		t.Errorf("expected at most 3 concurrent verifications, got %d", keys.peak)
+	}
+	if keys.calls != 3 {
+		t.Errorf("expected 3 batches, got %d", keys.calls)
+	}
+}
+
+func TestVerifyJSONsConcurrentlySmallBatch(t *testing.T) {
+	keys := &echoKeyRing{}
+	if _, err := VerifyJSONsConcurrently(context.Background(), keys, makeVerifyRequests(3, nil), 8); err != nil {
+		t.Fatalf("VerifyJSONsConcurrently: %s", err)
+	}
+	if keys.calls != 1 {
+		t.Errorf("expected a small batch to be verified in one call, got %d", keys.calls)
+	}
+}
+
+func TestVerifyJSONsConcurrentlyError(t *testing.T) {
+	keys := &echoKeyRing{err: errors.New("key ring unavailable")}
+	if _, err := VerifyJSONsConcurrently(context.Background(), keys, makeVerifyRequests(100, nil), 4); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
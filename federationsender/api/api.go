@@ -87,12 +87,46 @@ type FederationSenderInternalAPI interface {
 		request *PerformServersAliveRequest,
 		response *PerformServersAliveResponse,
 	) error
+	// Returns the destinations which are currently blacklisted, blocked or backing off.
+	QueryServerBackoff(
+		ctx context.Context,
+		request *QueryServerBackoffRequest,
+		response *QueryServerBackoffResponse,
+	) error
+	// Blocks or unblocks sending to a destination. Unlike the blacklist, a block
+	// persists until it is explicitly lifted.
+	PerformBlockServer(
+		ctx context.Context,
+		request *PerformBlockServerRequest,
+		response *PerformBlockServerResponse,
+	) error
 	// Broadcasts an EDU to all servers in rooms we are joined to.
 	PerformBroadcastEDU(
 		ctx context.Context,
 		request *PerformBroadcastEDURequest,
 		response *PerformBroadcastEDUResponse,
 	) error
+	// Asks a remote server for the MSC3266 summary of a room. Errors are
+	// of type FederationClientError, as with the FederationClient functions.
+	MSC3266RoomSummary(ctx context.Context, dst gomatrixserverlib.ServerName, roomID string) (res MSC3266RoomSummary, err error)
+}
+
+// MSC3266RoomSummary is the summary of a room, as returned by the MSC3266
+// client and federation room summary endpoints.
+type MSC3266RoomSummary struct {
+	RoomID           string `json:"room_id"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	AvatarURL        string `json:"avatar_url,omitempty"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	JoinRule         string `json:"join_rule,omitempty"`
+	RoomType         string `json:"room_type,omitempty"`
+	NumJoinedMembers int    `json:"num_joined_members"`
+	WorldReadable    bool   `json:"world_readable"`
+	GuestCanJoin     bool   `json:"guest_can_join"`
+	// The membership of the requesting user in the room, if any. This is
+	// only set in responses to clients.
+	Membership string `json:"membership,omitempty"`
 }
 
 type QueryServerKeysRequest struct {
@@ -173,6 +207,30 @@ type PerformServersAliveRequest struct {
 type PerformServersAliveResponse struct {
 }
 
+type QueryServerBackoffRequest struct {
+}
+
+// ServerBackoff describes the backoff state of a single destination.
+type ServerBackoff struct {
+	ServerName   gomatrixserverlib.ServerName `json:"server_name"`
+	Blacklisted  bool                         `json:"blacklisted"`
+	Blocked      bool                         `json:"blocked"`
+	BackoffUntil gomatrixserverlib.Timestamp  `json:"backoff_until_ts,omitempty"`
+	FailureCount uint32                       `json:"failure_count"`
+}
+
+type QueryServerBackoffResponse struct {
+	Servers []ServerBackoff `json:"servers"`
+}
+
+type PerformBlockServerRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	Blocked    bool                         `json:"blocked"`
+}
+
+type PerformBlockServerResponse struct {
+}
+
 // QueryJoinedHostServerNamesInRoomRequest is a request to QueryJoinedHostServerNames
 type QueryJoinedHostServerNamesInRoomRequest struct {
 	RoomID string `json:"room_id"`
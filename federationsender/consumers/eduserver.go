@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/internal"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -36,8 +37,10 @@ type OutputEDUConsumer struct {
 	typingConsumer       *internal.ContinualConsumer
 	sendToDeviceConsumer *internal.ContinualConsumer
 	receiptConsumer      *internal.ContinualConsumer
+	presenceConsumer     *internal.ContinualConsumer
 	db                   storage.Database
 	queues               *queue.OutgoingQueues
+	rsAPI                roomserverAPI.RoomserverInternalAPI
 	ServerName           gomatrixserverlib.ServerName
 	TypingTopic          string
 	SendToDeviceTopic    string
@@ -50,6 +53,7 @@ func NewOutputEDUConsumer(
 	kafkaConsumer sarama.Consumer,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) *OutputEDUConsumer {
 	c := &OutputEDUConsumer{
 		typingConsumer: &internal.ContinualConsumer{
@@ -73,7 +77,15 @@ func NewOutputEDUConsumer(
 			Consumer:       kafkaConsumer,
 			PartitionStore: store,
 		},
+		presenceConsumer: &internal.ContinualConsumer{
+			Process:        process,
+			ComponentName:  "eduserver/presence",
+			Topic:          cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: store,
+		},
 		queues:            queues,
+		rsAPI:             rsAPI,
 		db:                store,
 		ServerName:        cfg.Matrix.ServerName,
 		TypingTopic:       cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent),
@@ -82,6 +94,7 @@ func NewOutputEDUConsumer(
 	c.typingConsumer.ProcessMessage = c.onTypingEvent
 	c.sendToDeviceConsumer.ProcessMessage = c.onSendToDeviceEvent
 	c.receiptConsumer.ProcessMessage = c.onReceiptEvent
+	c.presenceConsumer.ProcessMessage = c.onPresenceEvent
 
 	return c
 }
@@ -97,6 +110,9 @@ func (t *OutputEDUConsumer) Start() error {
 	if err := t.receiptConsumer.Start(); err != nil {
 		return fmt.Errorf("t.receiptConsumer.Start: %w", err)
 	}
+	if err := t.presenceConsumer.Start(); err != nil {
+		return fmt.Errorf("t.presenceConsumer.Start: %w", err)
+	}
 	return nil
 }
 
@@ -247,3 +263,66 @@ func (t *OutputEDUConsumer) onReceiptEvent(msg *sarama.ConsumerMessage) error {
 
 	return t.queues.SendEDU(edu, t.ServerName, names)
 }
+
+// onPresenceEvent is called in response to a message received on the presence
+// events topic from the EDU server.
+func (t *OutputEDUConsumer) onPresenceEvent(msg *sarama.ConsumerMessage) error {
+	// Extract the presence event from msg.
+	var presence api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &presence); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected presence)")
+		return nil
+	}
+
+	// only send presence events which originated from us
+	_, presenceServerName, err := gomatrixserverlib.SplitID('@', presence.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", presence.UserID).Error("Failed to extract domain from presence sender")
+		return nil
+	}
+	if presenceServerName != t.ServerName {
+		return nil // don't log, very spammy as it logs for each remote presence update
+	}
+
+	// send this presence update to all servers who share rooms with this user.
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	err = t.rsAPI.QueryRoomsForUser(context.TODO(), &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         presence.UserID,
+		WantMembership: "join",
+	}, &queryRes)
+	if err != nil {
+		log.WithError(err).WithField("user_id", presence.UserID).Error("Failed to calculate joined rooms for presence sender")
+		return nil
+	}
+	if len(queryRes.RoomIDs) == 0 {
+		return nil
+	}
+	names, err := t.db.GetJoinedHostsForRooms(context.TODO(), queryRes.RoomIDs)
+	if err != nil {
+		return err
+	}
+
+	clientContent := api.NewPresenceContent(&presence)
+	content := api.FederationPresence{
+		Push: []api.FederationPresenceUpdate{
+			{
+				UserID:          presence.UserID,
+				Presence:        clientContent.Presence,
+				StatusMsg:       clientContent.StatusMsg,
+				LastActiveAgo:   clientContent.LastActiveAgo,
+				CurrentlyActive: clientContent.CurrentlyActive,
+			},
+		},
+	}
+
+	edu := &gomatrixserverlib.EDU{
+		Type:   api.MPresence,
+		Origin: string(t.ServerName),
+	}
+	if edu.Content, err = json.Marshal(content); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
@@ -111,6 +111,10 @@ func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return nil
 	}
 
+	if m.Type == api.TypeCrossSigningUpdate {
+		return t.sendCrossSigningKeyUpdate(m, destinations)
+	}
+
 	// Pack the EDU and marshal it
 	edu := &gomatrixserverlib.EDU{
 		Type:   gomatrixserverlib.MDeviceListUpdate,
@@ -133,6 +137,25 @@ func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 	return t.queues.SendEDU(edu, t.serverName, destinations)
 }
 
+// sendCrossSigningKeyUpdate sends the public cross-signing keys of the user
+// to the servers in the destinations.
+func (t *KeyChangeConsumer) sendCrossSigningKeyUpdate(m api.DeviceMessage, destinations []gomatrixserverlib.ServerName) error {
+	if m.CrossSigningKeyUpdate == nil {
+		return nil
+	}
+	edu := &gomatrixserverlib.EDU{
+		Type:   api.MSigningKeyUpdate,
+		Origin: string(t.serverName),
+	}
+	var err error
+	if edu.Content, err = json.Marshal(m.CrossSigningKeyUpdate); err != nil {
+		return err
+	}
+
+	log.Infof("Sending signing key update message to %q", destinations)
+	return t.queues.SendEDU(edu, t.serverName, destinations)
+}
+
 func prevID(streamID int) []int {
 	if streamID <= 1 {
 		return nil
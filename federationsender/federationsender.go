@@ -57,8 +57,11 @@ func NewInternalAPI(
 	}
 
 	stats := &statistics.Statistics{
-		DB:                     federationSenderDB,
-		FailuresUntilBlacklist: cfg.FederationMaxRetries,
+		DB:                      federationSenderDB,
+		FailuresUntilBlacklist:  cfg.FederationMaxRetries,
+		MaxPDUsPerTransaction:   cfg.MaxPDUsPerTransaction,
+		MaxEDUsPerTransaction:   cfg.MaxEDUsPerTransaction,
+		AdaptiveTransactionSize: cfg.AdaptiveTransactionSize,
 	}
 
 	consumer, _ := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
@@ -72,6 +75,7 @@ func NewInternalAPI(
 			PrivateKey: cfg.Matrix.PrivateKey,
 			ServerName: cfg.Matrix.ServerName,
 		},
+		cfg.QueueTTL,
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -83,7 +87,7 @@ func NewInternalAPI(
 	}
 
 	tsConsumer := consumers.NewOutputEDUConsumer(
-		base.ProcessContext, cfg, consumer, queues, federationSenderDB,
+		base.ProcessContext, cfg, consumer, queues, federationSenderDB, rsAPI,
 	)
 	if err := tsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start typing server consumer")
@@ -2,6 +2,8 @@ package internal
 
 import (
 	"context"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -244,3 +246,30 @@ func (a *FederationSenderInternalAPI) MSC2946Spaces(
 	}
 	return ires.(gomatrixserverlib.MSC2946SpacesResponse), nil
 }
+
+func (a *FederationSenderInternalAPI) MSC3266RoomSummary(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string,
+) (res api.MSC3266RoomSummary, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	ires, err := a.doRequest(s, func() (interface{}, error) {
+		// gomatrixserverlib doesn't know about this endpoint yet, so build
+		// and sign the request ourselves.
+		path := "/_matrix/federation/unstable/im.nheko.summary/summary/" + url.PathEscape(roomID)
+		req := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+		if err := req.Sign(a.cfg.Matrix.ServerName, a.cfg.Matrix.KeyID, a.cfg.Matrix.PrivateKey); err != nil {
+			return nil, err
+		}
+		httpReq, err := req.HTTPRequest()
+		if err != nil {
+			return nil, err
+		}
+		var summary api.MSC3266RoomSummary
+		err = a.federation.DoRequestAndParseResponse(ctx, httpReq, &summary)
+		return summary, err
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.MSC3266RoomSummary), nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/api"
@@ -561,10 +562,45 @@ func (r *FederationSenderInternalAPI) PerformInvite(
 		return fmt.Errorf("r.federation.SendInviteV2: %w", err)
 	}
 
-	response.Event = inviteRes.Event.Headered(request.RoomVersion)
+	event, altered, err := checkInviteResponse(request.Event.Unwrap(), inviteRes.Event)
+	if err != nil {
+		return err
+	}
+	if altered {
+		// Keep the content we sent, e.g. the invite reason, rather than
+		// storing an event that the invitee's server mangled.
+		logrus.WithField("event_id", event.EventID()).Warnf(
+			"Invite event content was altered by %q, using the original event", destination,
+		)
+	}
+
+	response.Event = event.Headered(request.RoomVersion)
 	return nil
 }
 
+// checkInviteResponse checks that the invite event returned by the invitee's
+// server is the event that we sent. If the content was altered, which results
+// in the event being redacted if the content hashes no longer match, then the
+// sent event is returned instead so that the reason etc. isn't lost.
+func checkInviteResponse(sent, received *gomatrixserverlib.Event) (*gomatrixserverlib.Event, bool, error) {
+	if received == nil {
+		return nil, false, errors.New("invite response is missing the event")
+	}
+	if received.EventID() != sent.EventID() {
+		return nil, false, fmt.Errorf(
+			"invite response event ID %q doesn't match sent event ID %q", received.EventID(), sent.EventID(),
+		)
+	}
+	var sentContent, receivedContent interface{}
+	if err := json.Unmarshal(sent.Content(), &sentContent); err != nil {
+		return nil, false, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if err := json.Unmarshal(received.Content(), &receivedContent); err != nil || !reflect.DeepEqual(sentContent, receivedContent) {
+		return sent, true, nil
+	}
+	return received, false, nil
+}
+
 // PerformServersAlive implements api.FederationSenderInternalAPI
 func (r *FederationSenderInternalAPI) PerformServersAlive(
 	ctx context.Context,
@@ -579,7 +615,24 @@ func (r *FederationSenderInternalAPI) PerformServersAlive(
 	return nil
 }
 
-// PerformServersAlive implements api.FederationSenderInternalAPI
+// PerformBlockServer implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformBlockServer(
+	ctx context.Context,
+	request *api.PerformBlockServerRequest,
+	response *api.PerformBlockServerResponse,
+) error {
+	if err := r.statistics.ForServer(request.ServerName).SetBlocked(request.Blocked); err != nil {
+		return fmt.Errorf("SetBlocked: %w", err)
+	}
+	if !request.Blocked {
+		// Start sending anything that was held back while the server
+		// was blocked.
+		r.queues.RetryServer(request.ServerName)
+	}
+	return nil
+}
+
+// PerformBroadcastEDU implements api.FederationSenderInternalAPI
 func (r *FederationSenderInternalAPI) PerformBroadcastEDU(
 	ctx context.Context,
 	request *api.PerformBroadcastEDURequest,
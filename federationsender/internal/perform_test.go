@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func mustCreateInviteEvent(t *testing.T, key ed25519.PrivateKey, content map[string]interface{}) *gomatrixserverlib.Event {
+	t.Helper()
+	stateKey := "@bob:remote"
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   "@alice:localhost",
+		RoomID:   "!room:localhost",
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &stateKey,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev
+}
+
+func TestCheckInviteResponse(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	sent := mustCreateInviteEvent(t, key, map[string]interface{}{
+		"membership": gomatrixserverlib.Invite,
+		"reason":     "come and chat",
+	})
+	signed := sent.Sign("remote", "ed25519:remote", key)
+
+	event, altered, err := checkInviteResponse(sent, &signed)
+	if err != nil || altered || event != &signed {
+		t.Errorf("expected the signed event to be used, got altered=%v err=%v", altered, err)
+	}
+
+	// The invitee's server drops the reason, so the content hashes no longer
+	// match and the event is redacted when it is received.
+	tampered, err := sjson.DeleteBytes(signed.JSON(), "content.reason")
+	if err != nil {
+		t.Fatalf("failed to remove reason: %s", err)
+	}
+	received, err := gomatrixserverlib.NewEventFromUntrustedJSON(tampered, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to parse tampered event: %s", err)
+	}
+	event, altered, err = checkInviteResponse(sent, received)
+	if err != nil || !altered {
+		t.Fatalf("expected altered content to be detected, got altered=%v err=%v", altered, err)
+	}
+	if reason := gjson.GetBytes(event.Content(), "reason").Str; reason != "come and chat" {
+		t.Errorf("expected reason to be preserved, got %q", reason)
+	}
+
+	other := mustCreateInviteEvent(t, key, map[string]interface{}{"membership": gomatrixserverlib.Invite})
+	if _, _, err = checkInviteResponse(sent, other); err == nil {
+		t.Errorf("expected an error for a different event")
+	}
+}
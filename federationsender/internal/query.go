@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/api"
@@ -25,6 +26,35 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return
 }
 
+// QueryServerBackoff implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryServerBackoff(
+	ctx context.Context,
+	request *api.QueryServerBackoffRequest,
+	response *api.QueryServerBackoffResponse,
+) error {
+	servers, err := f.statistics.Servers()
+	if err != nil {
+		return fmt.Errorf("f.statistics.Servers: %w", err)
+	}
+	response.Servers = make([]api.ServerBackoff, 0, len(servers))
+	for _, server := range servers {
+		info := api.ServerBackoff{
+			ServerName:   server.ServerName,
+			Blacklisted:  server.Blacklisted,
+			Blocked:      server.Blocked,
+			FailureCount: server.FailureCount,
+		}
+		if !server.BackoffUntil.IsZero() {
+			info.BackoffUntil = gomatrixserverlib.AsTimestamp(server.BackoffUntil)
+		}
+		response.Servers = append(response.Servers, info)
+	}
+	sort.Slice(response.Servers, func(i, j int) bool {
+		return response.Servers[i].ServerName < response.Servers[j].ServerName
+	})
+	return nil
+}
+
 func (a *FederationSenderInternalAPI) fetchServerKeysDirectly(ctx context.Context, serverName gomatrixserverlib.ServerName) (*gomatrixserverlib.ServerKeys, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
@@ -16,6 +16,7 @@ import (
 const (
 	FederationSenderQueryJoinedHostServerNamesInRoomPath = "/federationsender/queryJoinedHostServerNamesInRoom"
 	FederationSenderQueryServerKeysPath                  = "/federationsender/queryServerKeys"
+	FederationSenderQueryServerBackoffPath               = "/federationsender/queryServerBackoff"
 
 	FederationSenderPerformDirectoryLookupRequestPath = "/federationsender/performDirectoryLookup"
 	FederationSenderPerformJoinRequestPath            = "/federationsender/performJoinRequest"
@@ -24,6 +25,7 @@ const (
 	FederationSenderPerformOutboundPeekRequestPath    = "/federationsender/performOutboundPeekRequest"
 	FederationSenderPerformServersAlivePath           = "/federationsender/performServersAlive"
 	FederationSenderPerformBroadcastEDUPath           = "/federationsender/performBroadcastEDU"
+	FederationSenderPerformBlockServerPath            = "/federationsender/performBlockServer"
 
 	FederationSenderGetUserDevicesPath     = "/federationsender/client/getUserDevices"
 	FederationSenderClaimKeysPath          = "/federationsender/client/claimKeys"
@@ -35,6 +37,7 @@ const (
 	FederationSenderLookupServerKeysPath   = "/federationsender/client/lookupServerKeys"
 	FederationSenderEventRelationshipsPath = "/federationsender/client/msc2836eventRelationships"
 	FederationSenderSpacesSummaryPath      = "/federationsender/client/msc2946spacesSummary"
+	FederationSenderRoomSummaryPath        = "/federationsender/client/msc3266roomSummary"
 )
 
 // NewFederationSenderClient creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
@@ -102,6 +105,32 @@ func (h *httpFederationSenderInternalAPI) PerformServersAlive(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryServerBackoff implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryServerBackoff(
+	ctx context.Context,
+	request *api.QueryServerBackoffRequest,
+	response *api.QueryServerBackoffResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerBackoff")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryServerBackoffPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformBlockServer implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) PerformBlockServer(
+	ctx context.Context,
+	request *api.PerformBlockServerRequest,
+	response *api.PerformBlockServerResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformBlockServer")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformBlockServerPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryJoinedHostServerNamesInRoom implements FederationSenderInternalAPI
 func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	ctx context.Context,
@@ -478,3 +507,32 @@ func (h *httpFederationSenderInternalAPI) MSC2946Spaces(
 	}
 	return response.Res, nil
 }
+
+type roomSummaryReq struct {
+	S      gomatrixserverlib.ServerName
+	RoomID string
+	Res    api.MSC3266RoomSummary
+	Err    *api.FederationClientError
+}
+
+func (h *httpFederationSenderInternalAPI) MSC3266RoomSummary(
+	ctx context.Context, dst gomatrixserverlib.ServerName, roomID string,
+) (res api.MSC3266RoomSummary, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MSC3266RoomSummary")
+	defer span.Finish()
+
+	request := roomSummaryReq{
+		S:      dst,
+		RoomID: roomID,
+	}
+	var response roomSummaryReq
+	apiURL := h.federationSenderURL + FederationSenderRoomSummaryPath
+	err = httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+	if err != nil {
+		return res, err
+	}
+	if response.Err != nil {
+		return res, response.Err
+	}
+	return response.Res, nil
+}
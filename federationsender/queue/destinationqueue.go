@@ -17,13 +17,17 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/statistics"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/storage/shared"
+	"github.com/matrix-org/dendrite/internal/txnlog"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrix"
@@ -34,11 +38,9 @@ import (
 )
 
 const (
-	maxPDUsPerTransaction = 50
-	maxEDUsPerTransaction = 50
-	maxPDUsInMemory       = 128
-	maxEDUsInMemory       = 128
-	queueIdleTimeout      = time.Second * 30
+	maxPDUsInMemory  = 128
+	maxEDUsInMemory  = 128
+	queueIdleTimeout = time.Second * 30
 )
 
 // destinationQueue is a queue of events for a single destination.
@@ -248,6 +250,10 @@ func (oq *destinationQueue) backgroundSend() {
 	defer oq.queues.clearQueue(oq)
 	defer oq.running.Store(false)
 
+	// Queue up the latest events from any rooms that we couldn't send
+	// to this destination while it was blacklisted.
+	oq.catchUp()
+
 	// Mark the queue as overflowed, so we will consult the database
 	// to see if there's anything new to send.
 	oq.overflowed.Store(true)
@@ -310,14 +316,17 @@ func (oq *destinationQueue) backgroundSend() {
 		}
 
 		// Work out which PDUs/EDUs to include in the next transaction.
+		// The transaction size may have been reduced if this destination
+		// has been timing out.
+		maxPDUs, maxEDUs := oq.statistics.TransactionSize()
 		oq.pendingMutex.RLock()
 		pduCount := len(oq.pendingPDUs)
 		eduCount := len(oq.pendingEDUs)
-		if pduCount > maxPDUsPerTransaction {
-			pduCount = maxPDUsPerTransaction
+		if pduCount > maxPDUs {
+			pduCount = maxPDUs
 		}
-		if eduCount > maxEDUsPerTransaction {
-			eduCount = maxEDUsPerTransaction
+		if eduCount > maxEDUs {
+			eduCount = maxEDUs
 		}
 		toSendPDUs := oq.pendingPDUs[:pduCount]
 		toSendEDUs := oq.pendingEDUs[:eduCount]
@@ -348,6 +357,46 @@ func (oq *destinationQueue) backgroundSend() {
 	}
 }
 
+// catchUp queues the latest event per room which wasn't sent to this
+// destination while it was blacklisted. The destination can then fetch
+// any events in between with /get_missing_events.
+func (oq *destinationQueue) catchUp() {
+	ctx := oq.process.Context()
+	eventIDs, err := oq.db.GetCatchUpEventIDs(ctx, oq.destination)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to get catch-up events for %q", oq.destination)
+		return
+	}
+	if len(eventIDs) == 0 {
+		return
+	}
+	var res api.QueryEventsByIDResponse
+	if err = oq.rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: eventIDs}, &res); err != nil {
+		log.WithError(err).Errorf("Failed to get catch-up events for %q", oq.destination)
+		return
+	}
+	for _, ev := range res.Events {
+		if api.IsServerBannedFromRoom(ctx, oq.rsAPI, ev.RoomID(), oq.destination) {
+			continue
+		}
+		headeredJSON, err := json.Marshal(ev)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to marshal catch-up event %q", ev.EventID())
+			continue
+		}
+		receipt, err := oq.db.StoreJSON(ctx, string(headeredJSON))
+		if err != nil {
+			log.WithError(err).Errorf("Failed to store catch-up event %q", ev.EventID())
+			continue
+		}
+		oq.sendEvent(ev, receipt)
+	}
+	log.Infof("Catching up %q with %d rooms", oq.destination, len(res.Events))
+	if err = oq.db.DeleteCatchUpEvents(ctx, oq.destination); err != nil {
+		log.WithError(err).Errorf("Failed to delete catch-up events for %q", oq.destination)
+	}
+}
+
 // nextTransaction creates a new transaction from the pending event
 // queue and sends it. Returns true if a transaction was sent or
 // false otherwise.
@@ -407,6 +456,7 @@ func (oq *destinationQueue) nextTransaction(
 	}
 
 	logrus.WithField("server_name", oq.destination).Debugf("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
+	txnlog.Default.LogTransaction(txnlog.Outbound, oq.destination, &t)
 
 	// Try to send the transaction to the destination server.
 	// TODO: we should check for 500-ish fails vs 400-ish here,
@@ -414,9 +464,16 @@ func (oq *destinationQueue) nextTransaction(
 	// to a 400-ish error
 	ctx, cancel := context.WithTimeout(oq.process.Context(), time.Minute*5)
 	defer cancel()
+	started := time.Now()
 	_, err := oq.client.SendTransaction(ctx, t)
+	if isTimeout(err) {
+		// The destination didn't manage to deal with the transaction in
+		// time, so send smaller transactions to it in the future.
+		oq.statistics.TransactionTimedOut()
+	}
 	switch err.(type) {
 	case nil:
+		oq.statistics.TransactionSent(time.Since(started))
 		// Clean up the transaction in the database.
 		if pduReceipts != nil {
 			//logrus.Infof("Cleaning PDUs %q", pduReceipt.String())
@@ -447,3 +504,23 @@ func (oq *destinationQueue) nextTransaction(
 		return false, 0, 0, err
 	}
 }
+
+// isTimeout returns true if the error suggests that the destination
+// took too long to respond to the transaction.
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var httpErr gomatrix.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code == http.StatusGatewayTimeout || httpErr.Code == http.StatusRequestTimeout
+	}
+	return false
+}
@@ -89,6 +89,7 @@ func NewOutgoingQueues(
 	rsAPI api.RoomserverInternalAPI,
 	statistics *statistics.Statistics,
 	signing *SigningInfo,
+	queueTTL time.Duration,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
 		disabled:   disabled,
@@ -125,10 +126,34 @@ func NewOutgoingQueues(
 				}
 			}
 		})
+		if queueTTL > 0 {
+			go queues.expireQueues(queueTTL)
+		}
 	}
 	return queues
 }
 
+// queueExpiryInterval is how often we check the persistent queues for
+// PDUs and EDUs which have outlived the queue TTL.
+const queueExpiryInterval = time.Hour
+
+// expireQueues periodically drops anything which has been waiting in the
+// persistent queues for longer than the TTL, e.g. because the destination
+// has been unreachable for a long time.
+func (oqs *OutgoingQueues) expireQueues(ttl time.Duration) {
+	ctx := oqs.process.Context()
+	for {
+		if err := oqs.db.ExpireQueuedJSON(ctx, time.Now().Add(-ttl)); err != nil {
+			log.WithError(err).Error("Failed to expire queued PDUs and EDUs")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(queueExpiryInterval):
+		}
+	}
+}
+
 // TODO: Move this somewhere useful for other components as we often need to ferry these 3 variables
 // around together
 type SigningInfo struct {
@@ -250,6 +275,13 @@ func (oqs *OutgoingQueues) SendEvent(
 	for destination := range destmap {
 		if queue := oqs.getQueue(destination); queue != nil {
 			queue.sendEvent(ev, nid)
+		} else {
+			// The destination is blacklisted, so rather than queueing up
+			// every event for it, remember the latest event in the room
+			// and send that when the destination comes back.
+			if err = oqs.db.UpdateCatchUpEvent(context.TODO(), destination, ev.RoomID(), ev.EventID()); err != nil {
+				log.WithError(err).Errorf("failed to record catch-up event %q for destination %q", ev.EventID(), destination)
+			}
 		}
 	}
 
@@ -333,6 +365,7 @@ func (oqs *OutgoingQueues) RetryServer(srv gomatrixserverlib.ServerName) {
 	if oqs.disabled {
 		return
 	}
+	oqs.statistics.ForServer(srv).Unblacklist()
 	if queue := oqs.getQueue(srv); queue != nil {
 		queue.wakeQueueIfNeeded()
 	}
@@ -23,8 +23,24 @@ type Statistics struct {
 	// just blacklist the host altogether? The backoff is exponential,
 	// so the max time here to attempt is 2**failures seconds.
 	FailuresUntilBlacklist uint32
+
+	// The largest transactions that we are allowed to send to a host, and
+	// whether we should shrink and grow the transaction size for each host
+	// based on how quickly it responds.
+	MaxPDUsPerTransaction   uint32
+	MaxEDUsPerTransaction   uint32
+	AdaptiveTransactionSize bool
 }
 
+const (
+	// defaultMaxPerTransaction is used when no maximum transaction size
+	// has been configured.
+	defaultMaxPerTransaction = 50
+	// fastTransactionThreshold is how quickly a host must accept a
+	// transaction for us to consider growing the transaction size.
+	fastTransactionThreshold = time.Second * 5
+)
+
 // ForServer returns server statistics for the given server name. If it
 // does not exist, it will create empty statistics and return those.
 func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerStatistics {
@@ -54,23 +70,85 @@ func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerS
 		} else {
 			server.blacklisted.Store(blacklisted)
 		}
+		blocked, err := s.DB.IsServerBlocked(serverName)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get blocked entry %q", serverName)
+		} else {
+			server.blocked.Store(blocked)
+		}
+		if s.AdaptiveTransactionSize {
+			maxPDUs, maxEDUs, err := s.DB.GetTransactionSize(serverName)
+			if err != nil {
+				logrus.WithError(err).Errorf("Failed to get transaction size %q", serverName)
+			} else {
+				server.transactionPDUs.Store(maxPDUs)
+				server.transactionEDUs.Store(maxEDUs)
+			}
+		}
 	}
 	return server
 }
 
+// ServerBackoff is a snapshot of the backoff state of a remote host.
+type ServerBackoff struct {
+	ServerName   gomatrixserverlib.ServerName
+	Blacklisted  bool
+	Blocked      bool
+	BackoffUntil time.Time
+	FailureCount uint32
+}
+
+// Servers returns the backoff state of all hosts which are currently
+// blacklisted, blocked or backing off.
+func (s *Statistics) Servers() ([]ServerBackoff, error) {
+	// Blocked servers might not have been seen since startup, so make
+	// sure that we have statistics for all of them.
+	if s.DB != nil {
+		blocked, err := s.DB.GetBlockedServers()
+		if err != nil {
+			return nil, err
+		}
+		for _, serverName := range blocked {
+			s.ForServer(serverName)
+		}
+	}
+	now := time.Now()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []ServerBackoff
+	for serverName, server := range s.servers {
+		info := ServerBackoff{
+			ServerName:   serverName,
+			Blacklisted:  server.blacklisted.Load(),
+			Blocked:      server.blocked.Load(),
+			FailureCount: server.backoffCount.Load(),
+		}
+		if until, ok := server.backoffUntil.Load().(time.Time); ok && until.After(now) {
+			info.BackoffUntil = until
+		}
+		if info.Blacklisted || info.Blocked || !info.BackoffUntil.IsZero() {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
 // ServerStatistics contains information about our interactions with a
 // remote federated host, e.g. how many times we were successful, how
 // many times we failed etc. It also manages the backoff time and black-
 // listing a remote host if it remains uncooperative.
 type ServerStatistics struct {
-	statistics     *Statistics                  //
-	serverName     gomatrixserverlib.ServerName //
-	blacklisted    atomic.Bool                  // is the node blacklisted
-	backoffStarted atomic.Bool                  // is the backoff started
-	backoffUntil   atomic.Value                 // time.Time until this backoff interval ends
-	backoffCount   atomic.Uint32                // number of times BackoffDuration has been called
-	interrupt      chan struct{}                // interrupts the backoff goroutine
-	successCounter atomic.Uint32                // how many times have we succeeded?
+	statistics      *Statistics                  //
+	serverName      gomatrixserverlib.ServerName //
+	blacklisted     atomic.Bool                  // is the node blacklisted
+	blocked         atomic.Bool                  // has the node been blocked by an admin
+	backoffStarted  atomic.Bool                  // is the backoff started
+	backoffUntil    atomic.Value                 // time.Time until this backoff interval ends
+	backoffCount    atomic.Uint32                // number of times BackoffDuration has been called
+	interrupt       chan struct{}                // interrupts the backoff goroutine
+	successCounter  atomic.Uint32                // how many times have we succeeded?
+	transactionPDUs atomic.Uint32                // learned max PDUs per transaction, or 0 if not known
+	transactionEDUs atomic.Uint32                // learned max EDUs per transaction, or 0 if not known
 }
 
 // duration returns how long the next backoff interval should be.
@@ -103,6 +181,19 @@ func (s *ServerStatistics) Success() {
 	}
 }
 
+// Unblacklist removes the host from the blacklist and resets the
+// backoff, e.g. because it has contacted us and so is probably
+// reachable again.
+func (s *ServerStatistics) Unblacklist() {
+	s.cancel()
+	s.backoffCount.Store(0)
+	if s.statistics.DB != nil {
+		if err := s.statistics.DB.RemoveServerFromBlacklist(s.serverName); err != nil {
+			logrus.WithError(err).Errorf("Failed to remove %q from blacklist", s.serverName)
+		}
+	}
+}
+
 // Failure marks a failure and starts backing off if needed.
 // The next call to BackoffIfRequired will do the right thing
 // after this. It will return the time that the current failure
@@ -137,7 +228,7 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 	}
 
 	// Check if we have blacklisted this node.
-	if s.blacklisted.Load() {
+	if s.Blacklisted() {
 		return time.Now(), true
 	}
 
@@ -162,15 +253,39 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 func (s *ServerStatistics) BackoffInfo() (*time.Time, bool) {
 	until, ok := s.backoffUntil.Load().(time.Time)
 	if ok {
-		return &until, s.blacklisted.Load()
+		return &until, s.Blacklisted()
 	}
-	return nil, s.blacklisted.Load()
+	return nil, s.Blacklisted()
 }
 
-// Blacklisted returns true if the server is blacklisted and false
-// otherwise.
+// Blacklisted returns true if the server is blacklisted or has been
+// blocked by an admin and false otherwise.
 func (s *ServerStatistics) Blacklisted() bool {
-	return s.blacklisted.Load()
+	return s.blacklisted.Load() || s.blocked.Load()
+}
+
+// Blocked returns true if the server has been blocked by an admin.
+func (s *ServerStatistics) Blocked() bool {
+	return s.blocked.Load()
+}
+
+// SetBlocked blocks or unblocks the server. A blocked server is
+// treated as blacklisted, but isn't unblacklisted by Success or
+// Unblacklist, and stays blocked across restarts.
+func (s *ServerStatistics) SetBlocked(blocked bool) error {
+	if s.statistics.DB != nil {
+		var err error
+		if blocked {
+			err = s.statistics.DB.BlockServer(s.serverName)
+		} else {
+			err = s.statistics.DB.UnblockServer(s.serverName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.blocked.Store(blocked)
+	return nil
 }
 
 // SuccessCount returns the number of successful requests. This is
@@ -178,3 +293,79 @@ func (s *ServerStatistics) Blacklisted() bool {
 func (s *ServerStatistics) SuccessCount() uint32 {
 	return s.successCounter.Load()
 }
+
+// maxTransactionSize returns the configured upper bounds on the
+// number of PDUs and EDUs in a transaction.
+func (s *ServerStatistics) maxTransactionSize() (uint32, uint32) {
+	maxPDUs, maxEDUs := s.statistics.MaxPDUsPerTransaction, s.statistics.MaxEDUsPerTransaction
+	if maxPDUs == 0 {
+		maxPDUs = defaultMaxPerTransaction
+	}
+	if maxEDUs == 0 {
+		maxEDUs = defaultMaxPerTransaction
+	}
+	return maxPDUs, maxEDUs
+}
+
+// TransactionSize returns the maximum number of PDUs and EDUs that
+// should be included in the next transaction to this server. If the
+// transaction size isn't adaptive then this is always the configured
+// maximum.
+func (s *ServerStatistics) TransactionSize() (int, int) {
+	maxPDUs, maxEDUs := s.maxTransactionSize()
+	if !s.statistics.AdaptiveTransactionSize {
+		return int(maxPDUs), int(maxEDUs)
+	}
+	pdus, edus := s.transactionPDUs.Load(), s.transactionEDUs.Load()
+	if pdus == 0 || pdus > maxPDUs {
+		pdus = maxPDUs
+	}
+	if edus == 0 || edus > maxEDUs {
+		edus = maxEDUs
+	}
+	return int(pdus), int(edus)
+}
+
+// TransactionTimedOut halves the transaction size for this server,
+// since it was unable to process the last transaction in time.
+func (s *ServerStatistics) TransactionTimedOut() {
+	if !s.statistics.AdaptiveTransactionSize {
+		return
+	}
+	pdus, edus := s.TransactionSize()
+	s.updateTransactionSize(uint32(pdus+1)/2, uint32(edus+1)/2)
+}
+
+// TransactionSent records how long it took this server to accept
+// a transaction. If it was fast then the transaction size grows by
+// one, up to the configured maximum.
+func (s *ServerStatistics) TransactionSent(duration time.Duration) {
+	if !s.statistics.AdaptiveTransactionSize || duration >= fastTransactionThreshold {
+		return
+	}
+	pdus, edus := s.TransactionSize()
+	maxPDUs, maxEDUs := s.maxTransactionSize()
+	if uint32(pdus) < maxPDUs {
+		pdus++
+	}
+	if uint32(edus) < maxEDUs {
+		edus++
+	}
+	s.updateTransactionSize(uint32(pdus), uint32(edus))
+}
+
+// updateTransactionSize stores the new transaction size and persists
+// it to the database if it has changed.
+func (s *ServerStatistics) updateTransactionSize(pdus, edus uint32) {
+	oldPDUs, oldEDUs := s.TransactionSize()
+	if uint32(oldPDUs) == pdus && uint32(oldEDUs) == edus {
+		return
+	}
+	s.transactionPDUs.Store(pdus)
+	s.transactionEDUs.Store(edus)
+	if s.statistics.DB != nil {
+		if err := s.statistics.DB.SetTransactionSize(s.serverName, pdus, edus); err != nil {
+			logrus.WithError(err).Errorf("Failed to update transaction size for %q", s.serverName)
+		}
+	}
+}
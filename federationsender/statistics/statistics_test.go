@@ -4,6 +4,8 @@ import (
 	"math"
 	"testing"
 	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestBackoff(t *testing.T) {
@@ -62,3 +64,148 @@ func TestBackoff(t *testing.T) {
 		}
 	}
 }
+
+func TestUnblacklist(t *testing.T) {
+	stats := Statistics{
+		FailuresUntilBlacklist: 1,
+	}
+	server := ServerStatistics{
+		statistics: &stats,
+		serverName: "test.com",
+		interrupt:  make(chan struct{}),
+	}
+
+	// A single failure is enough to blacklist the server.
+	if _, blacklisted := server.Failure(); !blacklisted {
+		t.Fatalf("Expected server to be blacklisted")
+	}
+
+	// Unblacklisting should reset the backoff so that we try again
+	// straight away.
+	server.Unblacklist()
+	if server.Blacklisted() {
+		t.Fatalf("Expected server to no longer be blacklisted")
+	}
+	if count := server.backoffCount.Load(); count != 0 {
+		t.Fatalf("Expected backoff count 0, got %d", count)
+	}
+	if until, _ := server.BackoffInfo(); until != nil && until.After(time.Now()) {
+		t.Fatalf("Expected no backoff, got backoff until %s", until)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	stats := Statistics{
+		FailuresUntilBlacklist: 7,
+	}
+	server := &ServerStatistics{
+		statistics: &stats,
+		serverName: "test.com",
+		interrupt:  make(chan struct{}),
+	}
+	stats.servers = map[gomatrixserverlib.ServerName]*ServerStatistics{
+		server.serverName: server,
+	}
+
+	if err := server.SetBlocked(true); err != nil {
+		t.Fatalf("Failed to block server: %s", err)
+	}
+	if !server.Blacklisted() {
+		t.Fatalf("Expected blocked server to be treated as blacklisted")
+	}
+
+	// Neither succeeding nor being told that the server is alive should
+	// unblock it.
+	server.Success()
+	server.Unblacklist()
+	if !server.Blocked() || !server.Blacklisted() {
+		t.Fatalf("Expected server to still be blocked")
+	}
+
+	servers, err := stats.Servers()
+	if err != nil {
+		t.Fatalf("Failed to list servers: %s", err)
+	}
+	if len(servers) != 1 || servers[0].ServerName != "test.com" || !servers[0].Blocked {
+		t.Fatalf("Expected only test.com to be listed as blocked, got %+v", servers)
+	}
+
+	if err = server.SetBlocked(false); err != nil {
+		t.Fatalf("Failed to unblock server: %s", err)
+	}
+	if server.Blacklisted() {
+		t.Fatalf("Expected server to no longer be blacklisted")
+	}
+	if servers, _ = stats.Servers(); len(servers) != 0 {
+		t.Fatalf("Expected no servers to be listed, got %+v", servers)
+	}
+}
+
+func TestAdaptiveTransactionSize(t *testing.T) {
+	stats := Statistics{
+		FailuresUntilBlacklist:  7,
+		MaxPDUsPerTransaction:   50,
+		MaxEDUsPerTransaction:   20,
+		AdaptiveTransactionSize: true,
+	}
+	server := ServerStatistics{
+		statistics: &stats,
+		serverName: "test.com",
+	}
+
+	// With nothing learned yet we should start at the maximum.
+	if pdus, edus := server.TransactionSize(); pdus != 50 || edus != 20 {
+		t.Fatalf("Expected initial transaction size 50/20, got %d/%d", pdus, edus)
+	}
+
+	// A destination that keeps timing out should get smaller batches
+	// each time, until we are sending a single PDU/EDU at a time.
+	lastPDUs, lastEDUs := server.TransactionSize()
+	for i := 0; i < 10; i++ {
+		server.TransactionTimedOut()
+		pdus, edus := server.TransactionSize()
+		t.Logf("Timeout %d gives transaction size %d/%d", i+1, pdus, edus)
+		if pdus < 1 || edus < 1 {
+			t.Fatalf("Transaction size %d/%d should never drop below 1", pdus, edus)
+		}
+		if lastPDUs > 1 && pdus >= lastPDUs {
+			t.Fatalf("Timeout %d should have reduced PDUs below %d but got %d", i+1, lastPDUs, pdus)
+		}
+		if lastEDUs > 1 && edus >= lastEDUs {
+			t.Fatalf("Timeout %d should have reduced EDUs below %d but got %d", i+1, lastEDUs, edus)
+		}
+		lastPDUs, lastEDUs = pdus, edus
+	}
+	if lastPDUs != 1 || lastEDUs != 1 {
+		t.Fatalf("Expected transaction size 1/1 after repeated timeouts, got %d/%d", lastPDUs, lastEDUs)
+	}
+
+	// Slow successes shouldn't grow the transaction size.
+	server.TransactionSent(fastTransactionThreshold * 2)
+	if pdus, edus := server.TransactionSize(); pdus != 1 || edus != 1 {
+		t.Fatalf("Slow transaction should not have grown the size, got %d/%d", pdus, edus)
+	}
+
+	// Fast successes should grow it again, but never beyond the maximum.
+	for i := 0; i < 100; i++ {
+		server.TransactionSent(time.Millisecond)
+	}
+	if pdus, edus := server.TransactionSize(); pdus != 50 || edus != 20 {
+		t.Fatalf("Expected transaction size to recover to 50/20, got %d/%d", pdus, edus)
+	}
+}
+
+func TestFixedTransactionSize(t *testing.T) {
+	stats := Statistics{
+		MaxPDUsPerTransaction: 30,
+		MaxEDUsPerTransaction: 40,
+	}
+	server := ServerStatistics{
+		statistics: &stats,
+		serverName: "test.com",
+	}
+	server.TransactionTimedOut()
+	if pdus, edus := server.TransactionSize(); pdus != 30 || edus != 40 {
+		t.Fatalf("Non-adaptive transaction size should stay at 30/40, got %d/%d", pdus, edus)
+	}
+}
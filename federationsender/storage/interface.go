@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/storage/shared"
 	"github.com/matrix-org/dendrite/federationsender/types"
@@ -45,6 +46,10 @@ type Database interface {
 	CleanPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, receipts []*shared.Receipt) error
 	CleanEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, receipts []*shared.Receipt) error
 
+	// ExpireQueuedJSON removes PDUs and EDUs which were queued before the given time and
+	// still haven't been sent to all of their destinations.
+	ExpireQueuedJSON(ctx context.Context, before time.Time) error
+
 	GetPendingPDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
 	GetPendingEDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
 
@@ -57,6 +62,25 @@ type Database interface {
 	RemoveAllServersFromBlacklist() error
 	IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error)
 
+	// BlockServer and UnblockServer manage the list of destinations which have been blocked
+	// by an admin. Unlike the blacklist, blocked servers are never unblocked automatically.
+	BlockServer(serverName gomatrixserverlib.ServerName) error
+	UnblockServer(serverName gomatrixserverlib.ServerName) error
+	IsServerBlocked(serverName gomatrixserverlib.ServerName) (bool, error)
+	GetBlockedServers() ([]gomatrixserverlib.ServerName, error)
+
+	// SetTransactionSize persists the learned transaction size for a destination. GetTransactionSize
+	// returns zeroes if nothing has been learned about the destination yet.
+	SetTransactionSize(serverName gomatrixserverlib.ServerName, maxPDUs, maxEDUs uint32) error
+	GetTransactionSize(serverName gomatrixserverlib.ServerName) (maxPDUs, maxEDUs uint32, err error)
+
+	// UpdateCatchUpEvent records the latest event in a room which couldn't be sent to a destination
+	// because it was blacklisted. GetCatchUpEventIDs returns those events for the destination, one
+	// per room, and DeleteCatchUpEvents forgets them once they have been queued again.
+	UpdateCatchUpEvent(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, eventID string) error
+	GetCatchUpEventIDs(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]string, error)
+	DeleteCatchUpEvents(ctx context.Context, serverName gomatrixserverlib.ServerName) error
+
 	AddOutboundPeek(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, peekID string, renewalInterval int64) error
 	RenewOutboundPeek(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, peekID string, renewalInterval int64) error
 	GetOutboundPeek(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, peekID string) (*types.OutboundPeek, error)
@@ -0,0 +1,50 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func LoadAddQueueJSONCreatedTSColumn(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddQueueJSONCreatedTSColumn, DownAddQueueJSONCreatedTSColumn)
+}
+
+func UpAddQueueJSONCreatedTSColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE federationsender_queue_json ADD COLUMN IF NOT EXISTS created_ts BIGINT NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	// Treat anything that was already queued as having been queued now,
+	// so that it isn't expired straight away.
+	_, err = tx.Exec(`UPDATE federationsender_queue_json SET created_ts = $1 WHERE created_ts = 0;`, gomatrixserverlib.AsTimestamp(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddQueueJSONCreatedTSColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE federationsender_queue_json DROP COLUMN IF EXISTS created_ts;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -17,10 +17,12 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const queueJSONSchema = `
@@ -31,13 +33,15 @@ CREATE TABLE IF NOT EXISTS federationsender_queue_json (
 	-- cross-reference to find the JSON blob.
 	json_nid BIGSERIAL,
 	-- The JSON body. Text so that we preserve UTF-8.
-	json_body TEXT NOT NULL
+	json_body TEXT NOT NULL,
+	-- When the JSON was queued, so that it can be expired.
+	created_ts BIGINT NOT NULL DEFAULT 0
 );
 `
 
 const insertJSONSQL = "" +
-	"INSERT INTO federationsender_queue_json (json_body)" +
-	" VALUES ($1)" +
+	"INSERT INTO federationsender_queue_json (json_body, created_ts)" +
+	" VALUES ($1, $2)" +
 	" RETURNING json_nid"
 
 const deleteJSONSQL = "" +
@@ -47,11 +51,25 @@ const selectJSONSQL = "" +
 	"SELECT json_nid, json_body FROM federationsender_queue_json" +
 	" WHERE json_nid = ANY($1)"
 
+const deleteExpiredQueuePDUsSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE json_nid IN" +
+	" (SELECT json_nid FROM federationsender_queue_json WHERE created_ts < $1)"
+
+const deleteExpiredQueueEDUsSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE json_nid IN" +
+	" (SELECT json_nid FROM federationsender_queue_json WHERE created_ts < $1)"
+
+const deleteExpiredJSONSQL = "" +
+	"DELETE FROM federationsender_queue_json WHERE created_ts < $1"
+
 type queueJSONStatements struct {
-	db             *sql.DB
-	insertJSONStmt *sql.Stmt
-	deleteJSONStmt *sql.Stmt
-	selectJSONStmt *sql.Stmt
+	db                         *sql.DB
+	insertJSONStmt             *sql.Stmt
+	deleteJSONStmt             *sql.Stmt
+	selectJSONStmt             *sql.Stmt
+	deleteExpiredQueuePDUsStmt *sql.Stmt
+	deleteExpiredQueueEDUsStmt *sql.Stmt
+	deleteExpiredJSONStmt      *sql.Stmt
 }
 
 func NewPostgresQueueJSONTable(db *sql.DB) (s *queueJSONStatements, err error) {
@@ -71,6 +89,15 @@ func NewPostgresQueueJSONTable(db *sql.DB) (s *queueJSONStatements, err error) {
 	if s.selectJSONStmt, err = s.db.Prepare(selectJSONSQL); err != nil {
 		return
 	}
+	if s.deleteExpiredQueuePDUsStmt, err = s.db.Prepare(deleteExpiredQueuePDUsSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredQueueEDUsStmt, err = s.db.Prepare(deleteExpiredQueueEDUsSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredJSONStmt, err = s.db.Prepare(deleteExpiredJSONSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -79,7 +106,7 @@ func (s *queueJSONStatements) InsertQueueJSON(
 ) (int64, error) {
 	stmt := sqlutil.TxStmt(txn, s.insertJSONStmt)
 	var lastid int64
-	if err := stmt.QueryRowContext(ctx, json).Scan(&lastid); err != nil {
+	if err := stmt.QueryRowContext(ctx, json, gomatrixserverlib.AsTimestamp(time.Now())).Scan(&lastid); err != nil {
 		return 0, err
 	}
 	return lastid, nil
@@ -113,3 +140,20 @@ func (s *queueJSONStatements) SelectQueueJSON(
 	}
 	return blobs, err
 }
+
+// DeleteExpiredQueueJSON removes the JSON which was queued before the given
+// timestamp, along with any destinations that it was still queued for.
+func (s *queueJSONStatements) DeleteExpiredQueueJSON(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) error {
+	for _, stmt := range []*sql.Stmt{
+		s.deleteExpiredQueuePDUsStmt,
+		s.deleteExpiredQueueEDUsStmt,
+		s.deleteExpiredJSONStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -78,8 +78,21 @@ func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationS
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresNotaryServerKeysMetadataTable: %s", err)
 	}
+	blockedServers, err := NewPostgresBlockedServersTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	transactionSizes, err := NewPostgresTransactionSizesTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	catchUpEvents, err := NewPostgresCatchUpEventsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadRemoveRoomsTable(m)
+	deltas.LoadAddQueueJSONCreatedTSColumn(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -92,6 +105,9 @@ func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationS
 		FederationSenderQueueEDUs:     queueEDUs,
 		FederationSenderQueueJSON:     queueJSON,
 		FederationSenderBlacklist:     blacklist,
+		FederationSenderBlocked:       blockedServers,
+		FederationSenderTxnSizes:      transactionSizes,
+		FederationSenderCatchUp:       catchUpEvents,
 		FederationSenderInboundPeeks:  inboundPeeks,
 		FederationSenderOutboundPeeks: outboundPeeks,
 		NotaryServerKeysJSON:          notaryJSON,
@@ -0,0 +1,85 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const transactionSizesSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_transaction_sizes (
+    -- The destination server name
+	server_name TEXT NOT NULL PRIMARY KEY,
+    -- The learned maximum number of PDUs per transaction
+	max_pdus BIGINT NOT NULL,
+    -- The learned maximum number of EDUs per transaction
+	max_edus BIGINT NOT NULL
+);
+`
+
+const upsertTransactionSizeSQL = "" +
+	"INSERT INTO federationsender_transaction_sizes (server_name, max_pdus, max_edus) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (server_name) DO UPDATE SET max_pdus = $2, max_edus = $3"
+
+const selectTransactionSizeSQL = "" +
+	"SELECT max_pdus, max_edus FROM federationsender_transaction_sizes WHERE server_name = $1"
+
+type transactionSizesStatements struct {
+	db                        *sql.DB
+	upsertTransactionSizeStmt *sql.Stmt
+	selectTransactionSizeStmt *sql.Stmt
+}
+
+func NewPostgresTransactionSizesTable(db *sql.DB) (s *transactionSizesStatements, err error) {
+	s = &transactionSizesStatements{
+		db: db,
+	}
+	_, err = db.Exec(transactionSizesSchema)
+	if err != nil {
+		return
+	}
+
+	if s.upsertTransactionSizeStmt, err = db.Prepare(upsertTransactionSizeSQL); err != nil {
+		return
+	}
+	if s.selectTransactionSizeStmt, err = db.Prepare(selectTransactionSizeSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *transactionSizesStatements) UpsertTransactionSize(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, maxPDUs, maxEDUs uint32,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertTransactionSizeStmt)
+	_, err := stmt.ExecContext(ctx, serverName, maxPDUs, maxEDUs)
+	return err
+}
+
+func (s *transactionSizesStatements) SelectTransactionSize(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (maxPDUs, maxEDUs uint32, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectTransactionSizeStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&maxPDUs, &maxEDUs)
+	if err == sql.ErrNoRows {
+		// We haven't learned anything about this server yet.
+		return 0, 0, nil
+	}
+	return
+}
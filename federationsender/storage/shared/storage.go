@@ -36,6 +36,9 @@ type Database struct {
 	FederationSenderQueueJSON     tables.FederationSenderQueueJSON
 	FederationSenderJoinedHosts   tables.FederationSenderJoinedHosts
 	FederationSenderBlacklist     tables.FederationSenderBlacklist
+	FederationSenderBlocked       tables.FederationSenderBlockedServers
+	FederationSenderTxnSizes      tables.FederationSenderTransactionSizes
+	FederationSenderCatchUp       tables.FederationSenderCatchUpEvents
 	FederationSenderOutboundPeeks tables.FederationSenderOutboundPeeks
 	FederationSenderInboundPeeks  tables.FederationSenderInboundPeeks
 	NotaryServerKeysJSON          tables.FederationSenderNotaryServerKeysJSON
@@ -161,6 +164,58 @@ func (d *Database) IsServerBlacklisted(serverName gomatrixserverlib.ServerName)
 	return d.FederationSenderBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
 
+func (d *Database) BlockServer(serverName gomatrixserverlib.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderBlocked.InsertBlockedServer(context.TODO(), txn, serverName)
+	})
+}
+
+func (d *Database) UnblockServer(serverName gomatrixserverlib.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderBlocked.DeleteBlockedServer(context.TODO(), txn, serverName)
+	})
+}
+
+func (d *Database) IsServerBlocked(serverName gomatrixserverlib.ServerName) (bool, error) {
+	return d.FederationSenderBlocked.SelectBlockedServer(context.TODO(), nil, serverName)
+}
+
+func (d *Database) GetBlockedServers() ([]gomatrixserverlib.ServerName, error) {
+	return d.FederationSenderBlocked.SelectAllBlockedServers(context.TODO(), nil)
+}
+
+func (d *Database) SetTransactionSize(serverName gomatrixserverlib.ServerName, maxPDUs, maxEDUs uint32) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderTxnSizes.UpsertTransactionSize(context.TODO(), txn, serverName, maxPDUs, maxEDUs)
+	})
+}
+
+func (d *Database) GetTransactionSize(serverName gomatrixserverlib.ServerName) (maxPDUs, maxEDUs uint32, err error) {
+	return d.FederationSenderTxnSizes.SelectTransactionSize(context.TODO(), nil, serverName)
+}
+
+func (d *Database) ExpireQueuedJSON(ctx context.Context, before time.Time) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderQueueJSON.DeleteExpiredQueueJSON(ctx, txn, gomatrixserverlib.AsTimestamp(before))
+	})
+}
+
+func (d *Database) UpdateCatchUpEvent(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, eventID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderCatchUp.UpsertCatchUpEvent(ctx, txn, serverName, roomID, eventID)
+	})
+}
+
+func (d *Database) GetCatchUpEventIDs(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]string, error) {
+	return d.FederationSenderCatchUp.SelectCatchUpEventIDs(ctx, nil, serverName)
+}
+
+func (d *Database) DeleteCatchUpEvents(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderCatchUp.DeleteCatchUpEvents(ctx, txn, serverName)
+	})
+}
+
 func (d *Database) AddOutboundPeek(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, peekID string, renewalInterval int64) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.FederationSenderOutboundPeeks.InsertOutboundPeek(ctx, txn, serverName, roomID, peekID, renewalInterval)
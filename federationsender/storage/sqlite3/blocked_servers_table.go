@@ -0,0 +1,129 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Unlike the blacklist, which is managed automatically based on
+// failures, servers in this table have been blocked by an admin and
+// stay blocked until an admin unblocks them.
+const blockedServersSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_blocked_servers (
+    -- The blocked server name
+	server_name TEXT NOT NULL,
+	UNIQUE (server_name)
+);
+`
+
+const insertBlockedServerSQL = "" +
+	"INSERT INTO federationsender_blocked_servers (server_name) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectBlockedServerSQL = "" +
+	"SELECT server_name FROM federationsender_blocked_servers WHERE server_name = $1"
+
+const selectAllBlockedServersSQL = "" +
+	"SELECT server_name FROM federationsender_blocked_servers"
+
+const deleteBlockedServerSQL = "" +
+	"DELETE FROM federationsender_blocked_servers WHERE server_name = $1"
+
+type blockedServersStatements struct {
+	db                          *sql.DB
+	insertBlockedServerStmt     *sql.Stmt
+	selectBlockedServerStmt     *sql.Stmt
+	selectAllBlockedServersStmt *sql.Stmt
+	deleteBlockedServerStmt     *sql.Stmt
+}
+
+func NewSQLiteBlockedServersTable(db *sql.DB) (s *blockedServersStatements, err error) {
+	s = &blockedServersStatements{
+		db: db,
+	}
+	_, err = db.Exec(blockedServersSchema)
+	if err != nil {
+		return
+	}
+
+	if s.insertBlockedServerStmt, err = db.Prepare(insertBlockedServerSQL); err != nil {
+		return
+	}
+	if s.selectBlockedServerStmt, err = db.Prepare(selectBlockedServerSQL); err != nil {
+		return
+	}
+	if s.selectAllBlockedServersStmt, err = db.Prepare(selectAllBlockedServersSQL); err != nil {
+		return
+	}
+	if s.deleteBlockedServerStmt, err = db.Prepare(deleteBlockedServerSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *blockedServersStatements) InsertBlockedServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertBlockedServerStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+func (s *blockedServersStatements) SelectBlockedServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectBlockedServerStmt)
+	res, err := stmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return false, err
+	}
+	defer res.Close() // nolint:errcheck
+	return res.Next(), nil
+}
+
+func (s *blockedServersStatements) SelectAllBlockedServers(
+	ctx context.Context, txn *sql.Tx,
+) ([]gomatrixserverlib.ServerName, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAllBlockedServersStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAllBlockedServers: rows.close() failed")
+
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, serverName)
+	}
+	return result, rows.Err()
+}
+
+func (s *blockedServersStatements) DeleteBlockedServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteBlockedServerStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const catchUpEventsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_catchup_events (
+    -- The destination server name
+	server_name TEXT NOT NULL,
+    -- The room ID
+	room_id TEXT NOT NULL,
+    -- The latest event in the room which we weren't able to send to the destination
+	event_id TEXT NOT NULL,
+	PRIMARY KEY (server_name, room_id)
+);
+`
+
+const upsertCatchUpEventSQL = "" +
+	"INSERT INTO federationsender_catchup_events (server_name, room_id, event_id) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (server_name, room_id) DO UPDATE SET event_id = $3"
+
+const selectCatchUpEventIDsSQL = "" +
+	"SELECT event_id FROM federationsender_catchup_events WHERE server_name = $1"
+
+const deleteCatchUpEventsSQL = "" +
+	"DELETE FROM federationsender_catchup_events WHERE server_name = $1"
+
+type catchUpEventsStatements struct {
+	db                        *sql.DB
+	upsertCatchUpEventStmt    *sql.Stmt
+	selectCatchUpEventIDsStmt *sql.Stmt
+	deleteCatchUpEventsStmt   *sql.Stmt
+}
+
+func NewSQLiteCatchUpEventsTable(db *sql.DB) (s *catchUpEventsStatements, err error) {
+	s = &catchUpEventsStatements{
+		db: db,
+	}
+	_, err = db.Exec(catchUpEventsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.upsertCatchUpEventStmt, err = db.Prepare(upsertCatchUpEventSQL); err != nil {
+		return
+	}
+	if s.selectCatchUpEventIDsStmt, err = db.Prepare(selectCatchUpEventIDsSQL); err != nil {
+		return
+	}
+	if s.deleteCatchUpEventsStmt, err = db.Prepare(deleteCatchUpEventsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *catchUpEventsStatements) UpsertCatchUpEvent(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, roomID, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertCatchUpEventStmt)
+	_, err := stmt.ExecContext(ctx, serverName, roomID, eventID)
+	return err
+}
+
+func (s *catchUpEventsStatements) SelectCatchUpEventIDs(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectCatchUpEventIDsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectCatchUpEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *catchUpEventsStatements) DeleteCatchUpEvents(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteCatchUpEventsStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func LoadAddQueueJSONCreatedTSColumn(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddQueueJSONCreatedTSColumn, DownAddQueueJSONCreatedTSColumn)
+}
+
+func UpAddQueueJSONCreatedTSColumn(tx *sql.Tx) error {
+	// The queue JSON table is created with the latest schema before the
+	// deltas run, so the column may already exist.
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('federationsender_queue_json') WHERE name = 'created_ts';`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for column: %w", err)
+	}
+	if count == 0 {
+		_, err = tx.Exec(`ALTER TABLE federationsender_queue_json ADD COLUMN created_ts INTEGER NOT NULL DEFAULT 0;`)
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	// Treat anything that was already queued as having been queued now,
+	// so that it isn't expired straight away.
+	_, err = tx.Exec(`UPDATE federationsender_queue_json SET created_ts = $1 WHERE created_ts = 0;`, gomatrixserverlib.AsTimestamp(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddQueueJSONCreatedTSColumn(tx *sql.Tx) error {
+	// SQLite can't drop columns, but the column is harmless to leave behind.
+	return nil
+}
@@ -20,9 +20,11 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const queueJSONSchema = `
@@ -33,13 +35,15 @@ CREATE TABLE IF NOT EXISTS federationsender_queue_json (
 	-- cross-reference to find the JSON blob.
 	json_nid INTEGER PRIMARY KEY AUTOINCREMENT,
 	-- The JSON body. Text so that we preserve UTF-8.
-	json_body TEXT NOT NULL
+	json_body TEXT NOT NULL,
+	-- When the JSON was queued, so that it can be expired.
+	created_ts INTEGER NOT NULL DEFAULT 0
 );
 `
 
 const insertJSONSQL = "" +
-	"INSERT INTO federationsender_queue_json (json_body)" +
-	" VALUES ($1)"
+	"INSERT INTO federationsender_queue_json (json_body, created_ts)" +
+	" VALUES ($1, $2)"
 
 const deleteJSONSQL = "" +
 	"DELETE FROM federationsender_queue_json WHERE json_nid IN ($1)"
@@ -48,11 +52,25 @@ const selectJSONSQL = "" +
 	"SELECT json_nid, json_body FROM federationsender_queue_json" +
 	" WHERE json_nid IN ($1)"
 
+const deleteExpiredQueuePDUsSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE json_nid IN" +
+	" (SELECT json_nid FROM federationsender_queue_json WHERE created_ts < $1)"
+
+const deleteExpiredQueueEDUsSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE json_nid IN" +
+	" (SELECT json_nid FROM federationsender_queue_json WHERE created_ts < $1)"
+
+const deleteExpiredJSONSQL = "" +
+	"DELETE FROM federationsender_queue_json WHERE created_ts < $1"
+
 type queueJSONStatements struct {
 	db             *sql.DB
 	insertJSONStmt *sql.Stmt
 	//deleteJSONStmt *sql.Stmt - prepared at runtime due to variadic
 	//selectJSONStmt *sql.Stmt - prepared at runtime due to variadic
+	deleteExpiredQueuePDUsStmt *sql.Stmt
+	deleteExpiredQueueEDUsStmt *sql.Stmt
+	deleteExpiredJSONStmt      *sql.Stmt
 }
 
 func NewSQLiteQueueJSONTable(db *sql.DB) (s *queueJSONStatements, err error) {
@@ -66,6 +84,15 @@ func NewSQLiteQueueJSONTable(db *sql.DB) (s *queueJSONStatements, err error) {
 	if s.insertJSONStmt, err = db.Prepare(insertJSONSQL); err != nil {
 		return
 	}
+	if s.deleteExpiredQueuePDUsStmt, err = db.Prepare(deleteExpiredQueuePDUsSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredQueueEDUsStmt, err = db.Prepare(deleteExpiredQueueEDUsSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredJSONStmt, err = db.Prepare(deleteExpiredJSONSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -73,7 +100,7 @@ func (s *queueJSONStatements) InsertQueueJSON(
 	ctx context.Context, txn *sql.Tx, json string,
 ) (lastid int64, err error) {
 	stmt := sqlutil.TxStmt(txn, s.insertJSONStmt)
-	res, err := stmt.ExecContext(ctx, json)
+	res, err := stmt.ExecContext(ctx, json, gomatrixserverlib.AsTimestamp(time.Now()))
 	if err != nil {
 		return 0, fmt.Errorf("stmt.QueryContext: %w", err)
 	}
@@ -134,3 +161,20 @@ func (s *queueJSONStatements) SelectQueueJSON(
 	}
 	return blobs, err
 }
+
+// DeleteExpiredQueueJSON removes the JSON which was queued before the given
+// timestamp, along with any destinations that it was still queued for.
+func (s *queueJSONStatements) DeleteExpiredQueueJSON(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) error {
+	for _, stmt := range []*sql.Stmt{
+		s.deleteExpiredQueuePDUsStmt,
+		s.deleteExpiredQueueEDUsStmt,
+		s.deleteExpiredJSONStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -77,8 +77,21 @@ func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationS
 	if err != nil {
 		return nil, err
 	}
+	blockedServers, err := NewSQLiteBlockedServersTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	transactionSizes, err := NewSQLiteTransactionSizesTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	catchUpEvents, err := NewSQLiteCatchUpEventsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadRemoveRoomsTable(m)
+	deltas.LoadAddQueueJSONCreatedTSColumn(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -91,6 +104,9 @@ func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationS
 		FederationSenderQueueEDUs:     queueEDUs,
 		FederationSenderQueueJSON:     queueJSON,
 		FederationSenderBlacklist:     blacklist,
+		FederationSenderBlocked:       blockedServers,
+		FederationSenderTxnSizes:      transactionSizes,
+		FederationSenderCatchUp:       catchUpEvents,
 		FederationSenderOutboundPeeks: outboundPeeks,
 		FederationSenderInboundPeeks:  inboundPeeks,
 		NotaryServerKeysJSON:          notaryKeys,
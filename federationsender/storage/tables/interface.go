@@ -46,6 +46,7 @@ type FederationSenderQueueJSON interface {
 	InsertQueueJSON(ctx context.Context, txn *sql.Tx, json string) (int64, error)
 	DeleteQueueJSON(ctx context.Context, txn *sql.Tx, nids []int64) error
 	SelectQueueJSON(ctx context.Context, txn *sql.Tx, jsonNIDs []int64) (map[int64][]byte, error)
+	DeleteExpiredQueueJSON(ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp) error
 }
 
 type FederationSenderJoinedHosts interface {
@@ -65,6 +66,26 @@ type FederationSenderBlacklist interface {
 	DeleteAllBlacklist(ctx context.Context, txn *sql.Tx) error
 }
 
+type FederationSenderBlockedServers interface {
+	InsertBlockedServer(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
+	SelectBlockedServer(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (bool, error)
+	SelectAllBlockedServers(ctx context.Context, txn *sql.Tx) ([]gomatrixserverlib.ServerName, error)
+	DeleteBlockedServer(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
+}
+
+type FederationSenderTransactionSizes interface {
+	UpsertTransactionSize(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, maxPDUs, maxEDUs uint32) error
+	SelectTransactionSize(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (maxPDUs, maxEDUs uint32, err error)
+}
+
+// FederationSenderCatchUpEvents stores the latest event per room which couldn't
+// be sent to a destination, so that it can be sent when the destination is back.
+type FederationSenderCatchUpEvents interface {
+	UpsertCatchUpEvent(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, roomID, eventID string) error
+	SelectCatchUpEventIDs(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) ([]string, error)
+	DeleteCatchUpEvents(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
+}
+
 type FederationSenderOutboundPeeks interface {
 	InsertOutboundPeek(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, roomID, peekID string, renewalInterval int64) (err error)
 	RenewOutboundPeek(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, roomID, peekID string, renewalInterval int64) (err error)
@@ -24,6 +24,7 @@ const (
 type RoomInfoCache interface {
 	GetRoomInfo(roomID string) (roomInfo types.RoomInfo, ok bool)
 	StoreRoomInfo(roomID string, roomInfo types.RoomInfo)
+	EvictRoomInfo(roomID string)
 }
 
 // GetRoomInfo must only be called from the roomserver only. It is not
@@ -43,3 +44,9 @@ func (c Caches) GetRoomInfo(roomID string) (types.RoomInfo, bool) {
 func (c Caches) StoreRoomInfo(roomID string, roomInfo types.RoomInfo) {
 	c.RoomInfos.Set(roomID, roomInfo)
 }
+
+// EvictRoomInfo must only be called from the roomserver only. It is not
+// safe for use from other components.
+func (c Caches) EvictRoomInfo(roomID string) {
+	c.RoomInfos.Unset(roomID)
+}
@@ -0,0 +1,273 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ContentValidator checks the content of events of a particular type. It
+// is given the state key, which is nil for non-state events, and the raw
+// JSON content, and returns an error describing what is wrong with it.
+type ContentValidator interface {
+	ValidateContent(stateKey *string, content []byte) error
+}
+
+// ContentValidatorFunc allows an ordinary function to be used as a
+// ContentValidator.
+type ContentValidatorFunc func(stateKey *string, content []byte) error
+
+// ValidateContent implements ContentValidator.
+func (f ContentValidatorFunc) ValidateContent(stateKey *string, content []byte) error {
+	return f(stateKey, content)
+}
+
+// ContentValidationError is returned when an event's content is rejected
+// by a ContentValidator.
+type ContentValidationError struct {
+	EventType string
+	Err       error
+}
+
+func (e *ContentValidationError) Error() string {
+	return fmt.Sprintf("invalid content for %s event: %s", e.EventType, e.Err)
+}
+
+func (e *ContentValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ContentValidators is a registry of ContentValidators by event type. It is
+// safe for concurrent use.
+type ContentValidators struct {
+	mu         sync.RWMutex
+	validators map[string][]ContentValidator
+}
+
+// NewContentValidators returns a registry with the validators for the core
+// event types already registered.
+func NewContentValidators() *ContentValidators {
+	v := &ContentValidators{
+		validators: make(map[string][]ContentValidator),
+	}
+	v.Register(gomatrixserverlib.MRoomPowerLevels, ContentValidatorFunc(validatePowerLevelsContent))
+	v.Register(gomatrixserverlib.MRoomJoinRules, ContentValidatorFunc(validateJoinRulesContent))
+	v.Register(gomatrixserverlib.MRoomMember, ContentValidatorFunc(validateMemberContent))
+	v.Register(gomatrixserverlib.MRoomEncryption, ContentValidatorFunc(validateEncryptionContent))
+	return v
+}
+
+// Register adds a validator for the given event type. If more than one
+// validator is registered for a type then the content must pass all of them.
+func (v *ContentValidators) Register(eventType string, validator ContentValidator) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.validators[eventType] = append(v.validators[eventType], validator)
+}
+
+// Validate checks the content against the validators registered for the
+// event type, returning a *ContentValidationError if any of them rejects it.
+// Content of event types with no validators is always valid.
+func (v *ContentValidators) Validate(eventType string, stateKey *string, content []byte) error {
+	v.mu.RLock()
+	validators := v.validators[eventType]
+	v.mu.RUnlock()
+	for _, validator := range validators {
+		if err := validator.ValidateContent(stateKey, content); err != nil {
+			return &ContentValidationError{
+				EventType: eventType,
+				Err:       err,
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateEvent is like Validate but takes the type, state key and content
+// from the event.
+func (v *ContentValidators) ValidateEvent(event *gomatrixserverlib.Event) error {
+	return v.Validate(event.Type(), event.StateKey(), event.Content())
+}
+
+// DefaultContentValidators is the registry used when sending events. Custom
+// validators should be added with RegisterContentValidator before Dendrite
+// starts handling requests.
+var DefaultContentValidators = NewContentValidators()
+
+// RegisterContentValidator adds a validator for the given event type to
+// DefaultContentValidators.
+func RegisterContentValidator(eventType string, validator ContentValidator) {
+	DefaultContentValidators.Register(eventType, validator)
+}
+
+func validateCanonicalInt(name string, value *int64) error {
+	if value != nil && (*value > maxCanonicalJSONInt || *value < -maxCanonicalJSONInt) {
+		return fmt.Errorf("%s is out of range", name)
+	}
+	return nil
+}
+
+// validatePowerLevelsContent requires all power levels to be integers.
+// gomatrixserverlib also accepts strings and floats, for the benefit of old
+// rooms, but there's no reason to create new events like that.
+func validatePowerLevelsContent(stateKey *string, content []byte) error {
+	if stateKey == nil || *stateKey != "" {
+		return errors.New("state key must be empty")
+	}
+	var c struct {
+		Ban           *int64           `json:"ban"`
+		Invite        *int64           `json:"invite"`
+		Kick          *int64           `json:"kick"`
+		Redact        *int64           `json:"redact"`
+		EventsDefault *int64           `json:"events_default"`
+		StateDefault  *int64           `json:"state_default"`
+		UsersDefault  *int64           `json:"users_default"`
+		Events        map[string]int64 `json:"events"`
+		Users         map[string]int64 `json:"users"`
+		Notifications map[string]int64 `json:"notifications"`
+	}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return fmt.Errorf("power levels must be integers: %w", err)
+	}
+	for name, value := range map[string]*int64{
+		"ban":            c.Ban,
+		"invite":         c.Invite,
+		"kick":           c.Kick,
+		"redact":         c.Redact,
+		"events_default": c.EventsDefault,
+		"state_default":  c.StateDefault,
+		"users_default":  c.UsersDefault,
+	} {
+		if err := validateCanonicalInt(name, value); err != nil {
+			return err
+		}
+	}
+	for eventType, level := range c.Events {
+		level := level
+		if err := validateCanonicalInt("events."+eventType, &level); err != nil {
+			return err
+		}
+	}
+	for userID, level := range c.Users {
+		level := level
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			return fmt.Errorf("users contains invalid user ID %q", userID)
+		}
+		if err := validateCanonicalInt("users."+userID, &level); err != nil {
+			return err
+		}
+	}
+	for key, level := range c.Notifications {
+		level := level
+		if err := validateCanonicalInt("notifications."+key, &level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateJoinRulesContent requires a known join rule, and for restricted
+// rooms a list of conditions to allow.
+func validateJoinRulesContent(stateKey *string, content []byte) error {
+	if stateKey == nil || *stateKey != "" {
+		return errors.New("state key must be empty")
+	}
+	var c struct {
+		JoinRule *string           `json:"join_rule"`
+		Allow    []json.RawMessage `json:"allow"`
+	}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return err
+	}
+	if c.JoinRule == nil {
+		return errors.New("join_rule is required")
+	}
+	switch *c.JoinRule {
+	case gomatrixserverlib.Public, gomatrixserverlib.Invite, gomatrixserverlib.Knock, "private":
+	case "restricted":
+		for _, allow := range c.Allow {
+			var condition struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(allow, &condition); err != nil || condition.Type == "" {
+				return errors.New("allow must be a list of objects with a type")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown join_rule %q", *c.JoinRule)
+	}
+	return nil
+}
+
+// validateMemberContent requires a known membership for a user ID, and that
+// the profile fields, if present, are strings.
+func validateMemberContent(stateKey *string, content []byte) error {
+	if stateKey == nil {
+		return errors.New("state key is required")
+	}
+	if _, _, err := gomatrixserverlib.SplitID('@', *stateKey); err != nil {
+		return fmt.Errorf("state key %q is not a user ID", *stateKey)
+	}
+	var c struct {
+		Membership  *string `json:"membership"`
+		DisplayName *string `json:"displayname"`
+		AvatarURL   *string `json:"avatar_url"`
+		IsDirect    *bool   `json:"is_direct"`
+	}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return err
+	}
+	if c.Membership == nil {
+		return errors.New("membership is required")
+	}
+	switch *c.Membership {
+	case gomatrixserverlib.Join, gomatrixserverlib.Leave, gomatrixserverlib.Invite,
+		gomatrixserverlib.Ban, gomatrixserverlib.Knock:
+	default:
+		return fmt.Errorf("unknown membership %q", *c.Membership)
+	}
+	return nil
+}
+
+// validateEncryptionContent requires an algorithm and non-negative rotation
+// periods.
+func validateEncryptionContent(stateKey *string, content []byte) error {
+	if stateKey == nil || *stateKey != "" {
+		return errors.New("state key must be empty")
+	}
+	var c struct {
+		Algorithm          *string `json:"algorithm"`
+		RotationPeriodMS   *int64  `json:"rotation_period_ms"`
+		RotationPeriodMsgs *int64  `json:"rotation_period_msgs"`
+	}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return err
+	}
+	if c.Algorithm == nil || *c.Algorithm == "" {
+		return errors.New("algorithm is required")
+	}
+	if c.RotationPeriodMS != nil && *c.RotationPeriodMS < 0 {
+		return errors.New("rotation_period_ms must not be negative")
+	}
+	if c.RotationPeriodMsgs != nil && *c.RotationPeriodMsgs < 0 {
+		return errors.New("rotation_period_msgs must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestCustomContentValidator(t *testing.T) {
+	v := NewContentValidators()
+	v.Register("com.example.vote", ContentValidatorFunc(func(stateKey *string, content []byte) error {
+		var c struct {
+			Choice string `json:"choice"`
+		}
+		if err := json.Unmarshal(content, &c); err != nil {
+			return err
+		}
+		if c.Choice != "yes" && c.Choice != "no" {
+			return errors.New("choice must be yes or no")
+		}
+		return nil
+	}))
+
+	if err := v.Validate("com.example.vote", nil, []byte(`{"choice":"yes"}`)); err != nil {
+		t.Errorf("expected valid content to pass, got %s", err)
+	}
+	err := v.Validate("com.example.vote", nil, []byte(`{"choice":"maybe"}`))
+	var verr *ContentValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a *ContentValidationError, got %v", err)
+	}
+	if verr.EventType != "com.example.vote" {
+		t.Errorf("expected event type com.example.vote, got %s", verr.EventType)
+	}
+	if err = v.Validate("com.example.other", nil, []byte(`{"choice":"maybe"}`)); err != nil {
+		t.Errorf("expected unregistered event type to pass, got %s", err)
+	}
+	if err = NewContentValidators().Validate("com.example.vote", nil, []byte(`{"choice":"maybe"}`)); err != nil {
+		t.Errorf("expected validator not to leak into other registries, got %s", err)
+	}
+}
+
+func TestCoreContentValidators(t *testing.T) {
+	empty := ""
+	alice := "@alice:localhost"
+	notAUser := "alice"
+	v := NewContentValidators()
+	for _, tt := range []struct {
+		name      string
+		eventType string
+		stateKey  *string
+		content   string
+		wantErr   bool
+	}{
+		{"power levels", gomatrixserverlib.MRoomPowerLevels, &empty, `{"ban":50,"events":{"m.room.name":50},"users":{"@alice:localhost":100},"notifications":{"room":50}}`, false},
+		{"power levels as string", gomatrixserverlib.MRoomPowerLevels, &empty, `{"ban":"50"}`, true},
+		{"power levels as float", gomatrixserverlib.MRoomPowerLevels, &empty, `{"events":{"m.room.name":50.5}}`, true},
+		{"power levels out of range", gomatrixserverlib.MRoomPowerLevels, &empty, `{"kick":9007199254740992}`, true},
+		{"power levels for invalid user", gomatrixserverlib.MRoomPowerLevels, &empty, `{"users":{"alice":100}}`, true},
+		{"power levels with state key", gomatrixserverlib.MRoomPowerLevels, &alice, `{}`, true},
+		{"join rules", gomatrixserverlib.MRoomJoinRules, &empty, `{"join_rule":"invite"}`, false},
+		{"restricted join rules", gomatrixserverlib.MRoomJoinRules, &empty, `{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!a:localhost"}]}`, false},
+		{"unknown join rule", gomatrixserverlib.MRoomJoinRules, &empty, `{"join_rule":"everyone"}`, true},
+		{"missing join rule", gomatrixserverlib.MRoomJoinRules, &empty, `{}`, true},
+		{"join rule of wrong type", gomatrixserverlib.MRoomJoinRules, &empty, `{"join_rule":1}`, true},
+		{"restricted join rules with bad allow", gomatrixserverlib.MRoomJoinRules, &empty, `{"join_rule":"restricted","allow":["!a:localhost"]}`, true},
+		{"member", gomatrixserverlib.MRoomMember, &alice, `{"membership":"join","displayname":"Alice"}`, false},
+		{"unknown membership", gomatrixserverlib.MRoomMember, &alice, `{"membership":"lurk"}`, true},
+		{"missing membership", gomatrixserverlib.MRoomMember, &alice, `{"displayname":"Alice"}`, true},
+		{"displayname of wrong type", gomatrixserverlib.MRoomMember, &alice, `{"membership":"join","displayname":["Alice"]}`, true},
+		{"member with invalid state key", gomatrixserverlib.MRoomMember, &notAUser, `{"membership":"join"}`, true},
+		{"member without state key", gomatrixserverlib.MRoomMember, nil, `{"membership":"join"}`, true},
+		{"encryption", gomatrixserverlib.MRoomEncryption, &empty, `{"algorithm":"m.megolm.v1.aes-sha2","rotation_period_ms":604800000}`, false},
+		{"encryption without algorithm", gomatrixserverlib.MRoomEncryption, &empty, `{"rotation_period_msgs":100}`, true},
+		{"encryption with negative rotation", gomatrixserverlib.MRoomEncryption, &empty, `{"algorithm":"m.megolm.v1.aes-sha2","rotation_period_msgs":-1}`, true},
+		{"content not an object", gomatrixserverlib.MRoomEncryption, &empty, `[]`, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Validate(tt.eventType, tt.stateKey, []byte(tt.content))
+			if tt.wantErr && err == nil {
+				t.Errorf("expected content to be rejected")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("expected content to be accepted, got %s", err)
+			}
+		})
+	}
+}
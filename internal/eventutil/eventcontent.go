@@ -41,6 +41,12 @@ type CanonicalAlias struct {
 	Alias string `json:"alias"`
 }
 
+// TombstoneContent is the event content for https://matrix.org/docs/spec/client_server/r0.6.1#m-room-tombstone
+type TombstoneContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
 // InitialPowerLevelsContent returns the initial values for m.room.power_levels on room creation
 // if they have not been specified.
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-power-levels
@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -30,11 +31,40 @@ import (
 // doesn't exist
 var ErrRoomNoExists = errors.New("Room does not exist")
 
+// ErrRoomPurged is returned when trying to lookup the state of a room that
+// this server knows about but no longer has any state for, e.g. because it
+// was purged or forgotten locally, or we only ever received an invite for it.
+// The room may well still exist on other servers.
+var ErrRoomPurged = errors.New("Room state is not available on this server")
+
+// ErrDepthExceeded is returned when trying to build an event in a room whose
+// latest events are already deeper than the room version allows, as any new
+// event would be rejected by other servers.
+var ErrDepthExceeded = errors.New("Room depth exceeds the maximum allowed by the room version")
+
+// maxCanonicalJSONInt is the largest integer allowed in canonical JSON, which
+// newer room versions enforce for all event fields including depth.
+const maxCanonicalJSONInt = 1<<53 - 1
+
+// MaxDepth returns the maximum depth that an event can have in the given room
+// version.
+func MaxDepth(roomVersion gomatrixserverlib.RoomVersion) (int64, error) {
+	canonical, err := roomVersion.EnforceCanonicalJSON()
+	if err != nil {
+		return 0, err
+	}
+	if canonical {
+		return maxCanonicalJSONInt, nil
+	}
+	return math.MaxInt64, nil
+}
+
 // QueryAndBuildEvent builds a Matrix event using the event builder and roomserver query
 // API client provided. If also fills roomserver query API response (if provided)
 // in case the function calling FillBuilder needs to use it.
 // Returns ErrRoomNoExists if the state of the room could not be retrieved because
-// the room doesn't exist
+// the room doesn't exist, or ErrRoomPurged if the room is known but has no state
+// Returns ErrDepthExceeded if the room is too deep to add another event to
 // Returns an error if something else went wrong
 func QueryAndBuildEvent(
 	ctx context.Context,
@@ -47,7 +77,7 @@ func QueryAndBuildEvent(
 
 	eventsNeeded, err := queryRequiredEventsForBuilder(ctx, builder, rsAPI, queryRes)
 	if err != nil {
-		// This can pass through a ErrRoomNoExists to the caller
+		// This can pass through a ErrRoomNoExists or ErrRoomPurged to the caller
 		return nil, err
 	}
 	return BuildEvent(ctx, builder, cfg, evTime, eventsNeeded, queryRes)
@@ -106,6 +136,9 @@ func addPrevEventsToEvent(
 	queryRes *api.QueryLatestEventsAndStateResponse,
 ) error {
 	if !queryRes.RoomExists {
+		if queryRes.RoomIsStub {
+			return ErrRoomPurged
+		}
 		return ErrRoomNoExists
 	}
 
@@ -114,7 +147,22 @@ func addPrevEventsToEvent(
 		return fmt.Errorf("queryRes.RoomVersion.EventFormat: %w", err)
 	}
 
-	builder.Depth = queryRes.Depth
+	maxDepth, err := MaxDepth(queryRes.RoomVersion)
+	if err != nil {
+		return fmt.Errorf("MaxDepth: %w", err)
+	}
+	// queryRes.Depth is one more than the depth of the deepest latest event. If
+	// those are already at the maximum then the new event shares their depth,
+	// but if they are beyond it (or the addition overflowed) the room's DAG is
+	// malformed and we refuse to extend it.
+	switch {
+	case queryRes.Depth < 0 || queryRes.Depth-1 > maxDepth:
+		return ErrDepthExceeded
+	case queryRes.Depth > maxDepth:
+		builder.Depth = maxDepth
+	default:
+		builder.Depth = queryRes.Depth
+	}
 
 	authEvents := gomatrixserverlib.NewAuthEvents(nil)
 
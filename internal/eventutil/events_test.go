@@ -0,0 +1,107 @@
+package eventutil
+
+import (
+	"context"
+	"crypto/ed25519"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type buildEventRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	roomIsStub bool
+}
+
+func (r *buildEventRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	req *api.QueryLatestEventsAndStateRequest,
+	res *api.QueryLatestEventsAndStateResponse,
+) error {
+	res.RoomExists = false
+	res.RoomIsStub = r.roomIsStub
+	return nil
+}
+
+func TestQueryAndBuildEventMissingRoom(t *testing.T) {
+	userID := "@alice:localhost"
+	for _, tt := range []struct {
+		name       string
+		roomIsStub bool
+		wantErr    error
+	}{
+		{name: "never existed", roomIsStub: false, wantErr: ErrRoomNoExists},
+		{name: "purged", roomIsStub: true, wantErr: ErrRoomPurged},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := gomatrixserverlib.EventBuilder{
+				Sender:   userID,
+				RoomID:   "!room:localhost",
+				Type:     gomatrixserverlib.MRoomMember,
+				StateKey: &userID,
+			}
+			if err := builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave}); err != nil {
+				t.Fatalf("builder.SetContent: %s", err)
+			}
+			rsAPI := &buildEventRoomserverAPI{roomIsStub: tt.roomIsStub}
+			_, err := QueryAndBuildEvent(context.Background(), &builder, &config.Global{ServerName: "localhost"}, time.Now(), rsAPI, nil)
+			if err != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBuildEventDepth(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cfg := &config.Global{ServerName: "localhost", KeyID: "ed25519:test", PrivateKey: key}
+	userID := "@alice:localhost"
+	for _, tt := range []struct {
+		name        string
+		roomVersion gomatrixserverlib.RoomVersion
+		depth       int64
+		wantDepth   int64
+		wantErr     error
+	}{
+		{name: "normal depth", roomVersion: gomatrixserverlib.RoomVersionV6, depth: 10, wantDepth: 10},
+		{name: "clamped to canonical JSON maximum", roomVersion: gomatrixserverlib.RoomVersionV6, depth: maxCanonicalJSONInt + 1, wantDepth: maxCanonicalJSONInt},
+		{name: "beyond canonical JSON maximum", roomVersion: gomatrixserverlib.RoomVersionV6, depth: maxCanonicalJSONInt + 2, wantErr: ErrDepthExceeded},
+		{name: "allowed in older room versions", roomVersion: gomatrixserverlib.RoomVersionV5, depth: maxCanonicalJSONInt + 2, wantDepth: maxCanonicalJSONInt + 2},
+		{name: "overflowed", roomVersion: gomatrixserverlib.RoomVersionV5, depth: math.MinInt64, wantErr: ErrDepthExceeded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := gomatrixserverlib.EventBuilder{
+				Sender:   userID,
+				RoomID:   "!room:localhost",
+				Type:     gomatrixserverlib.MRoomMember,
+				StateKey: &userID,
+			}
+			if err = builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave}); err != nil {
+				t.Fatalf("builder.SetContent: %s", err)
+			}
+			eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+			if err != nil {
+				t.Fatalf("StateNeededForEventBuilder: %s", err)
+			}
+			queryRes := &api.QueryLatestEventsAndStateResponse{
+				RoomExists:  true,
+				RoomVersion: tt.roomVersion,
+				Depth:       tt.depth,
+			}
+			ev, err := BuildEvent(context.Background(), &builder, cfg, time.Now(), &eventsNeeded, queryRes)
+			if err != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && ev.Depth() != tt.wantDepth {
+				t.Errorf("expected depth %d, got %d", tt.wantDepth, ev.Depth())
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// MemberContentError is returned by ValidateMemberContent if a field of
+// the m.room.member content is missing or malformed.
+type MemberContentError struct {
+	// Field is the name of the offending content field, or empty if the
+	// content as a whole is malformed.
+	Field string
+	Msg   string
+}
+
+func (e *MemberContentError) Error() string {
+	if e.Field == "" {
+		return "content " + e.Msg
+	}
+	return fmt.Sprintf("content.%s %s", e.Field, e.Msg)
+}
+
+var validMemberships = map[string]bool{
+	gomatrixserverlib.Invite: true,
+	gomatrixserverlib.Join:   true,
+	gomatrixserverlib.Knock:  true,
+	gomatrixserverlib.Leave:  true,
+	gomatrixserverlib.Ban:    true,
+}
+
+// memberContentTypes are the expected JSON types of the optional fields of
+// m.room.member content. Other fields are allowed and not checked.
+var memberContentTypes = []struct {
+	field     string
+	jsonType  gjson.Type
+	nullable  bool
+	typeLabel string
+}{
+	{"reason", gjson.String, false, "a string"},
+	{"displayname", gjson.String, true, "a string or null"},
+	{"avatar_url", gjson.String, true, "a string or null"},
+	{"join_authorised_via_users_server", gjson.String, false, "a string"},
+}
+
+// ValidateMemberContent checks that the content of an m.room.member event
+// is a JSON object with a valid membership, and that the optional fields
+// have the types given in the spec. It returns a *MemberContentError
+// naming the offending field if not.
+func ValidateMemberContent(content []byte) error {
+	if !gjson.ValidBytes(content) {
+		return &MemberContentError{Msg: "is not valid JSON"}
+	}
+	parsed := gjson.ParseBytes(content)
+	if !parsed.IsObject() {
+		return &MemberContentError{Msg: "must be an object"}
+	}
+
+	membership := parsed.Get("membership")
+	switch {
+	case !membership.Exists():
+		return &MemberContentError{Field: "membership", Msg: "is missing"}
+	case membership.Type != gjson.String:
+		return &MemberContentError{Field: "membership", Msg: "must be a string"}
+	case !validMemberships[membership.Str]:
+		return &MemberContentError{Field: "membership", Msg: fmt.Sprintf("has unknown value %q", membership.Str)}
+	}
+
+	for _, t := range memberContentTypes {
+		value := parsed.Get(t.field)
+		if !value.Exists() || value.Type == t.jsonType || (t.nullable && value.Type == gjson.Null) {
+			continue
+		}
+		return &MemberContentError{Field: t.field, Msg: "must be " + t.typeLabel}
+	}
+	if value := parsed.Get("is_direct"); value.Exists() && value.Type != gjson.True && value.Type != gjson.False {
+		return &MemberContentError{Field: "is_direct", Msg: "must be a boolean"}
+	}
+	if value := parsed.Get("third_party_invite"); value.Exists() && !value.IsObject() {
+		return &MemberContentError{Field: "third_party_invite", Msg: "must be an object"}
+	}
+	return nil
+}
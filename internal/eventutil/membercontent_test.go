@@ -0,0 +1,46 @@
+package eventutil
+
+import (
+	"testing"
+)
+
+func TestValidateMemberContent(t *testing.T) {
+	testCases := []struct {
+		name      string
+		content   string
+		wantField string
+		wantErr   bool
+	}{
+		{"valid leave", `{"membership":"leave"}`, "", false},
+		{"valid with optional fields", `{"membership":"join","displayname":"Alice","avatar_url":null,"reason":"hi","is_direct":true,"third_party_invite":{},"custom":1}`, "", false},
+		{"not JSON", `{"membership":`, "", true},
+		{"not an object", `["leave"]`, "", true},
+		{"missing membership", `{"reason":"bye"}`, "membership", true},
+		{"numeric membership", `{"membership":1}`, "membership", true},
+		{"unknown membership", `{"membership":"gone"}`, "membership", true},
+		{"numeric reason", `{"membership":"leave","reason":42}`, "reason", true},
+		{"null reason", `{"membership":"leave","reason":null}`, "reason", true},
+		{"object displayname", `{"membership":"leave","displayname":{}}`, "displayname", true},
+		{"numeric avatar_url", `{"membership":"leave","avatar_url":1}`, "avatar_url", true},
+		{"string is_direct", `{"membership":"invite","is_direct":"true"}`, "is_direct", true},
+		{"string third_party_invite", `{"membership":"invite","third_party_invite":"x"}`, "third_party_invite", true},
+		{"numeric join_authorised_via_users_server", `{"membership":"join","join_authorised_via_users_server":1}`, "join_authorised_via_users_server", true},
+	}
+	for _, tc := range testCases {
+		err := ValidateMemberContent([]byte(tc.content))
+		if !tc.wantErr {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %s", tc.name, err)
+			}
+			continue
+		}
+		cerr, ok := err.(*MemberContentError)
+		if !ok {
+			t.Errorf("%s: expected *MemberContentError, got %v", tc.name, err)
+			continue
+		}
+		if cerr.Field != tc.wantField {
+			t.Errorf("%s: expected field %q, got %q (%s)", tc.name, tc.wantField, cerr.Field, cerr)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationsenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -47,16 +48,42 @@ type BasicAuth struct {
 	Password string `yaml:"password"`
 }
 
+// AuthAPIOption is an option to MakeAuthAPI.
+type AuthAPIOption func(*authAPIOptions)
+
+type authAPIOptions struct {
+	allowGuests bool
+}
+
+// WithAllowGuests allows guest users to access the API. Guests are
+// forbidden from APIs by default.
+func WithAllowGuests() AuthAPIOption {
+	return func(o *authAPIOptions) {
+		o.allowGuests = true
+	}
+}
+
 // MakeAuthAPI turns a util.JSONRequestHandler function into an http.Handler which authenticates the request.
 func MakeAuthAPI(
 	metricsName string, userAPI userapi.UserInternalAPI,
 	f func(*http.Request, *userapi.Device) util.JSONResponse,
+	opts ...AuthAPIOption,
 ) http.Handler {
+	var options authAPIOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
 	h := func(req *http.Request) util.JSONResponse {
 		device, err := auth.VerifyUserFromRequest(req, userAPI)
 		if err != nil {
 			return *err
 		}
+		if device.AccountType == userapi.AccountTypeGuest && !options.allowGuests {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guest access not allowed"),
+			}
+		}
 		// add the user ID to the logger
 		logger := util.GetLogger((req.Context()))
 		logger = logger.WithField("user_id", device.UserID)
@@ -15,9 +15,13 @@
 package httputil
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +111,42 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+type guestUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (a *guestUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	res.Device = &userapi.Device{
+		ID:          "GUEST",
+		UserID:      "@1:localhost",
+		AccessToken: req.AccessToken,
+		AccountType: userapi.AccountTypeGuest,
+	}
+	return nil
+}
+
+func TestMakeAuthAPIGuests(t *testing.T) {
+	handler := func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+	tests := []struct {
+		name string
+		opts []AuthAPIOption
+		want int
+	}{
+		{name: "guests forbidden by default", want: http.StatusForbidden},
+		{name: "guests allowed", opts: []AuthAPIOption{WithAllowGuests()}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer guest_token")
+			w := httptest.NewRecorder()
+			MakeAuthAPI("test", &guestUserAPI{}, handler, tt.opts...).ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("expected HTTP %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets is the complete set of default push rules
+// for an account.
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName) *AccountRuleSets {
+	return &AccountRuleSets{
+		Global: *DefaultGlobalRuleSet(localpart, serverName),
+	}
+}
+
+// DefaultGlobalRuleSet returns the default ruleset for a given (fully
+// qualified) MXID.
+// https://spec.matrix.org/unstable/client-server-api/#predefined-rules
+func DefaultGlobalRuleSet(localpart string, serverName gomatrixserverlib.ServerName) *RuleSet {
+	userID := "@" + localpart + ":" + string(serverName)
+	return &RuleSet{
+		Override: []*Rule{
+			{
+				RuleID:     MRuleMaster,
+				Default:    true,
+				Enabled:    false,
+				Conditions: []*Condition{},
+				Actions:    []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  MRuleSuppressNotices,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("content.msgtype", "m.notice"),
+				},
+				Actions: []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  MRuleInviteForMe,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", gomatrixserverlib.MRoomMember),
+					eventMatch("content.membership", gomatrixserverlib.Invite),
+					eventMatch("state_key", userID),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					soundTweak("default"),
+					highlightTweak(false),
+				},
+			},
+			{
+				RuleID:  MRuleMemberEvent,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", gomatrixserverlib.MRoomMember),
+				},
+				Actions: []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  MRuleContainsDisplayName,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: ContainsDisplayNameCondition},
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					soundTweak("default"),
+					highlightTweak(true),
+				},
+			},
+			{
+				RuleID:  MRuleTombstone,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.tombstone"),
+					eventMatch("state_key", ""),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					highlightTweak(true),
+				},
+			},
+			{
+				RuleID:  MRuleRoomNotif,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("content.body", "@room"),
+					{Kind: SenderNotificationPermissionCondition, Key: "room"},
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					highlightTweak(true),
+				},
+			},
+		},
+		Content: []*Rule{
+			{
+				RuleID:  MRuleContainsUserName,
+				Default: true,
+				Enabled: true,
+				Pattern: localpart,
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					soundTweak("default"),
+					highlightTweak(true),
+				},
+			},
+		},
+		Room:   []*Rule{},
+		Sender: []*Rule{},
+		Underride: []*Rule{
+			{
+				RuleID:  MRuleCall,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.call.invite"),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					soundTweak("ring"),
+					highlightTweak(false),
+				},
+			},
+			{
+				RuleID:  MRuleEncryptedRoomOneToOne,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: RoomMemberCountCondition, Is: "2"},
+					eventMatch("type", "m.room.encrypted"),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					soundTweak("default"),
+					highlightTweak(false),
+				},
+			},
+			{
+				RuleID:  MRuleRoomOneToOne,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: RoomMemberCountCondition, Is: "2"},
+					eventMatch("type", "m.room.message"),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					soundTweak("default"),
+					highlightTweak(false),
+				},
+			},
+			{
+				RuleID:  MRuleMessage,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.message"),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					highlightTweak(false),
+				},
+			},
+			{
+				RuleID:  MRuleEncrypted,
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.encrypted"),
+				},
+				Actions: []*Action{
+					{Kind: NotifyAction},
+					highlightTweak(false),
+				},
+			},
+		},
+	}
+}
+
+// The IDs of the predefined rules.
+const (
+	MRuleMaster                = ".m.rule.master"
+	MRuleSuppressNotices       = ".m.rule.suppress_notices"
+	MRuleInviteForMe           = ".m.rule.invite_for_me"
+	MRuleMemberEvent           = ".m.rule.member_event"
+	MRuleContainsDisplayName   = ".m.rule.contains_display_name"
+	MRuleTombstone             = ".m.rule.tombstone"
+	MRuleRoomNotif             = ".m.rule.roomnotif"
+	MRuleContainsUserName      = ".m.rule.contains_user_name"
+	MRuleCall                  = ".m.rule.call"
+	MRuleEncryptedRoomOneToOne = ".m.rule.encrypted_room_one_to_one"
+	MRuleRoomOneToOne          = ".m.rule.room_one_to_one"
+	MRuleMessage               = ".m.rule.message"
+	MRuleEncrypted             = ".m.rule.encrypted"
+)
+
+func eventMatch(key, pattern string) *Condition {
+	return &Condition{Kind: EventMatchCondition, Key: key, Pattern: pattern}
+}
+
+func soundTweak(sound string) *Action {
+	return &Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: sound}
+}
+
+func highlightTweak(highlight bool) *Action {
+	return &Action{Kind: SetTweakAction, Tweak: HighlightTweak, Value: highlight}
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeEvaluationContext struct {
+	displayName string
+	memberCount int
+	powerLevels map[string]bool
+}
+
+func (ec fakeEvaluationContext) UserDisplayName() string       { return ec.displayName }
+func (ec fakeEvaluationContext) RoomMemberCount() (int, error) { return ec.memberCount, nil }
+func (ec fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	return ec.powerLevels[userID], nil
+}
+
+func mustEventFromJSON(t *testing.T, s string) *gomatrixserverlib.Event {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(s), false, gomatrixserverlib.RoomVersionV7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestDefaultRules(t *testing.T) {
+	ec := fakeEvaluationContext{
+		displayName: "Geralt of Rivia",
+		memberCount: 3,
+		powerLevels: map[string]bool{"@admin:localhost": true},
+	}
+	tsts := []struct {
+		Name     string
+		EC       fakeEvaluationContext
+		Event    string
+		Want     string
+		WantKind ActionKind
+	}{
+		{"message", ec, `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hello"}}`, MRuleMessage, NotifyAction},
+		{"oneToOne", fakeEvaluationContext{memberCount: 2}, `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hello"}}`, MRuleRoomOneToOne, NotifyAction},
+		{"encrypted", ec, `{"type":"m.room.encrypted","sender":"@bob:localhost","content":{}}`, MRuleEncrypted, NotifyAction},
+		{"notice", ec, `{"type":"m.room.message","sender":"@bob:localhost","content":{"msgtype":"m.notice","body":"alice"}}`, MRuleSuppressNotices, DontNotifyAction},
+		{"userName", ec, `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi Alice!"}}`, MRuleContainsUserName, NotifyAction},
+		{"userNameInWord", ec, `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"malice"}}`, MRuleMessage, NotifyAction},
+		{"displayName", ec, `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"GERALT OF RIVIA: come here"}}`, MRuleContainsDisplayName, NotifyAction},
+		{"inviteForMe", ec, `{"type":"m.room.member","state_key":"@alice:localhost","sender":"@bob:localhost","content":{"membership":"invite"}}`, MRuleInviteForMe, NotifyAction},
+		{"member", ec, `{"type":"m.room.member","state_key":"@bob:localhost","sender":"@bob:localhost","content":{"membership":"join"}}`, MRuleMemberEvent, DontNotifyAction},
+		{"roomNotif", ec, `{"type":"m.room.message","sender":"@admin:localhost","content":{"body":"@room: news"}}`, MRuleRoomNotif, NotifyAction},
+		{"roomNotifNoPower", ec, `{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"@room: news"}}`, MRuleMessage, NotifyAction},
+		{"tombstone", ec, `{"type":"m.room.tombstone","state_key":"","sender":"@bob:localhost","content":{}}`, MRuleTombstone, NotifyAction},
+		{"call", ec, `{"type":"m.call.invite","sender":"@bob:localhost","content":{}}`, MRuleCall, NotifyAction},
+		{"other", ec, `{"type":"m.room.topic","state_key":"","sender":"@bob:localhost","content":{}}`, "", UnknownAction},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rse := NewRuleSetEvaluator(tst.EC, DefaultGlobalRuleSet("alice", "localhost"))
+			rule, err := rse.MatchEvent(mustEventFromJSON(t, tst.Event))
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			var got string
+			var kind ActionKind
+			if rule != nil {
+				got = rule.RuleID
+				kind, _, err = ActionsToTweaks(rule.Actions)
+				if err != nil {
+					t.Fatalf("ActionsToTweaks failed: %v", err)
+				}
+			}
+			if got != tst.Want || kind != tst.WantKind {
+				t.Errorf("MatchEvent rule: got %q (%s), want %q (%s)", got, kind, tst.Want, tst.WantKind)
+			}
+		})
+	}
+}
+
+func TestRulePriority(t *testing.T) {
+	rs := DefaultGlobalRuleSet("alice", "localhost")
+	ev := mustEventFromJSON(t, `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","content":{"body":"hello"}}`)
+	ec := fakeEvaluationContext{memberCount: 3}
+
+	// User-defined overrides come before the default overrides.
+	rs.Override = append(rs.Override, &Rule{
+		RuleID:     "mute_hello",
+		Enabled:    true,
+		Conditions: []*Condition{eventMatch("content.body", "hel*")},
+		Actions:    []*Action{{Kind: DontNotifyAction}},
+	})
+	// Room rules only apply to the room.
+	rs.Room = append(rs.Room, &Rule{RuleID: "!other:localhost", Enabled: true, Actions: []*Action{{Kind: NotifyAction}}})
+	rule, err := NewRuleSetEvaluator(ec, rs).MatchEvent(ev)
+	if err != nil {
+		t.Fatalf("MatchEvent failed: %v", err)
+	}
+	if rule == nil || rule.RuleID != "mute_hello" {
+		t.Fatalf("MatchEvent: got %+v, want the user override", rule)
+	}
+
+	// The master rule comes before everything, when enabled.
+	rs.Override[0].Enabled = true
+	if rule, err = NewRuleSetEvaluator(ec, rs).MatchEvent(ev); err != nil || rule == nil || rule.RuleID != MRuleMaster {
+		t.Fatalf("MatchEvent: got %+v, %v, want the master rule", rule, err)
+	}
+}
+
+func TestParseRoomMemberCountCondition(t *testing.T) {
+	tsts := []struct {
+		Is   string
+		N    int
+		Want bool
+	}{
+		{"2", 2, true},
+		{"==2", 3, false},
+		{"<2", 1, true},
+		{"<=2", 2, true},
+		{">2", 2, false},
+		{">=2", 3, true},
+	}
+	for _, tst := range tsts {
+		cmp, err := parseRoomMemberCountCondition(tst.Is)
+		if err != nil {
+			t.Fatalf("parseRoomMemberCountCondition(%q) failed: %v", tst.Is, err)
+		}
+		if got := cmp(tst.N); got != tst.Want {
+			t.Errorf("parseRoomMemberCountCondition(%q)(%d): got %v, want %v", tst.Is, tst.N, got, tst.Want)
+		}
+	}
+	if _, err := parseRoomMemberCountCondition("lots"); err == nil {
+		t.Errorf("parseRoomMemberCountCondition(\"lots\"): want an error")
+	}
+}
+
+func TestActionJSON(t *testing.T) {
+	tsts := []struct {
+		Action Action
+		JSON   string
+	}{
+		{Action{Kind: NotifyAction}, `"notify"`},
+		{Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"}, `{"set_tweak":"sound","value":"default"}`},
+		{Action{Kind: SetTweakAction, Tweak: HighlightTweak}, `{"set_tweak":"highlight"}`},
+	}
+	for _, tst := range tsts {
+		bs, err := json.Marshal(&tst.Action)
+		if err != nil {
+			t.Fatalf("Marshal(%+v) failed: %v", tst.Action, err)
+		}
+		if string(bs) != tst.JSON {
+			t.Errorf("Marshal(%+v): got %s, want %s", tst.Action, bs, tst.JSON)
+		}
+		var got Action
+		if err = json.Unmarshal([]byte(tst.JSON), &got); err != nil {
+			t.Fatalf("Unmarshal(%s) failed: %v", tst.JSON, err)
+		}
+		if !reflect.DeepEqual(got, tst.Action) {
+			t.Errorf("Unmarshal(%s): got %+v, want %+v", tst.JSON, got, tst.Action)
+		}
+	}
+
+	kind, tweaks, err := ActionsToTweaks([]*Action{
+		{Kind: NotifyAction},
+		{Kind: SetTweakAction, Tweak: HighlightTweak},
+	})
+	if err != nil || kind != NotifyAction || !BoolTweakOr(tweaks, HighlightTweak, false) {
+		t.Errorf("ActionsToTweaks: got %s, %v, %v, want notify with highlight", kind, tweaks, err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spamcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+)
+
+// httpCallback asks an external service about each request. The service
+// is sent a callbackRequest and must respond with a callbackResponse.
+type httpCallback struct {
+	url      string
+	failOpen bool
+	hc       *http.Client
+}
+
+type callbackRequest struct {
+	Check   string      `json:"check"`
+	Request interface{} `json:"request"`
+}
+
+type callbackResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func newHTTPCallback(url string, timeout time.Duration, failOpen bool) *httpCallback {
+	return &httpCallback{
+		url:      url,
+		failOpen: failOpen,
+		hc: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (h *httpCallback) CheckEvent(ctx context.Context, req *EventRequest) error {
+	return h.check(ctx, "event", req)
+}
+
+func (h *httpCallback) CheckInvite(ctx context.Context, req *InviteRequest) error {
+	return h.check(ctx, "invite", req)
+}
+
+func (h *httpCallback) CheckRoomCreation(ctx context.Context, req *RoomCreationRequest) error {
+	return h.check(ctx, "room_creation", req)
+}
+
+func (h *httpCallback) CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) error {
+	return h.check(ctx, "media_upload", req)
+}
+
+func (h *httpCallback) check(ctx context.Context, check string, req interface{}) error {
+	res, err := h.do(ctx, check, req)
+	if err != nil {
+		if h.failOpen {
+			logrus.WithError(err).Warnf("Spam checker callback failed, allowing %s", check)
+			return nil
+		}
+		return err
+	}
+	if !res.Allowed {
+		reason := res.Reason
+		if reason == "" {
+			reason = "Rejected by spam checker"
+		}
+		return &RejectedError{Reason: reason}
+	}
+	return nil
+}
+
+func (h *httpCallback) do(ctx context.Context, check string, req interface{}) (*callbackResponse, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "SpamCheck")
+	defer span.Finish()
+
+	body, err := json.Marshal(callbackRequest{Check: check, Request: req})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hres, err := h.hc.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hres.Body.Close() // nolint: errcheck
+
+	if hres.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, hres.Body)
+		return nil, fmt.Errorf("spam checker: %d from %s", hres.StatusCode, h.url)
+	}
+	var res callbackResponse
+	if err = json.NewDecoder(hres.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("spam checker: invalid response from %s: %w", h.url, err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// contentRules rejects anything containing text which matches one of a
+// set of regular expressions.
+type contentRules struct {
+	rules []*regexp.Regexp
+}
+
+func newContentRules(rules []string) (*contentRules, error) {
+	c := &contentRules{}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile(%q): %w", rule, err)
+		}
+		c.rules = append(c.rules, re)
+	}
+	return c, nil
+}
+
+func (c *contentRules) check(texts ...string) error {
+	for _, text := range texts {
+		for _, re := range c.rules {
+			if re.MatchString(text) {
+				return &RejectedError{Reason: "Content is not allowed on this server"}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *contentRules) CheckEvent(ctx context.Context, req *EventRequest) error {
+	var content interface{}
+	if err := json.Unmarshal(req.Content, &content); err != nil {
+		// The event will be rejected for other reasons, so there is
+		// nothing for us to look at.
+		return nil
+	}
+	return c.check(stringValues(content, nil)...)
+}
+
+func (c *contentRules) CheckInvite(ctx context.Context, req *InviteRequest) error {
+	return nil
+}
+
+func (c *contentRules) CheckRoomCreation(ctx context.Context, req *RoomCreationRequest) error {
+	return c.check(req.Name, req.Topic)
+}
+
+func (c *contentRules) CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) error {
+	return c.check(req.Filename)
+}
+
+// stringValues appends all of the strings found anywhere in the given
+// unmarshalled JSON value to texts.
+func stringValues(v interface{}, texts []string) []string {
+	switch v := v.(type) {
+	case string:
+		texts = append(texts, v)
+	case []interface{}:
+		for _, e := range v {
+			texts = stringValues(e, texts)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			texts = stringValues(e, texts)
+		}
+	}
+	return texts
+}
+
+// inviteRateLimit limits how many invites each user can send in a period.
+type inviteRateLimit struct {
+	invites int
+	period  time.Duration
+	mutex   sync.Mutex
+	sent    map[string][]time.Time // user ID -> when recent invites were sent
+}
+
+func newInviteRateLimit(invites int, period time.Duration) *inviteRateLimit {
+	return &inviteRateLimit{
+		invites: invites,
+		period:  period,
+		sent:    make(map[string][]time.Time),
+	}
+}
+
+func (l *inviteRateLimit) CheckEvent(ctx context.Context, req *EventRequest) error {
+	return nil
+}
+
+func (l *inviteRateLimit) CheckInvite(ctx context.Context, req *InviteRequest) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	// Forget about invites which were sent before the start of the period.
+	recent := l.sent[req.Inviter][:0]
+	for _, t := range l.sent[req.Inviter] {
+		if now.Sub(t) < l.period {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.invites {
+		l.sent[req.Inviter] = recent
+		return &RejectedError{
+			Reason:     "Too many invites",
+			RetryAfter: l.period - now.Sub(recent[0]),
+		}
+	}
+	l.sent[req.Inviter] = append(recent, now)
+	return nil
+}
+
+func (l *inviteRateLimit) CheckRoomCreation(ctx context.Context, req *RoomCreationRequest) error {
+	return nil
+}
+
+func (l *inviteRateLimit) CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) error {
+	return nil
+}
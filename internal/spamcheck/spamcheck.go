@@ -0,0 +1,139 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spamcheck decides whether client events, invites, room creation
+// and media uploads should be accepted before they are acted upon.
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Checker is asked about requests before they are accepted. Each method
+// returns a *RejectedError if the request should be rejected, or another
+// error if the check itself failed.
+type Checker interface {
+	CheckEvent(ctx context.Context, req *EventRequest) error
+	CheckInvite(ctx context.Context, req *InviteRequest) error
+	CheckRoomCreation(ctx context.Context, req *RoomCreationRequest) error
+	CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) error
+}
+
+// EventRequest describes an event which a local user wants to send.
+type EventRequest struct {
+	Sender   string          `json:"sender"`
+	RoomID   string          `json:"room_id"`
+	Type     string          `json:"type"`
+	StateKey *string         `json:"state_key,omitempty"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// InviteRequest describes an invite which a local user wants to send.
+type InviteRequest struct {
+	Inviter string `json:"inviter"`
+	Invitee string `json:"invitee"`
+	RoomID  string `json:"room_id"`
+}
+
+// RoomCreationRequest describes a room which a local user wants to create.
+type RoomCreationRequest struct {
+	Creator  string   `json:"creator"`
+	Name     string   `json:"name,omitempty"`
+	Topic    string   `json:"topic,omitempty"`
+	Invitees []string `json:"invitees,omitempty"`
+}
+
+// MediaUploadRequest describes media which a local user wants to upload.
+type MediaUploadRequest struct {
+	UserID      string `json:"user_id"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// RejectedError is returned by a Checker when a request should be rejected.
+type RejectedError struct {
+	Reason string
+	// If set, the request was rejected because of a rate limit and may be
+	// retried after this long.
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected by spam checker: %s", e.Reason)
+}
+
+// Checkers runs each of its checkers in turn, stopping at the first one
+// which rejects the request. An empty Checkers allows everything.
+type Checkers []Checker
+
+// New returns the checkers enabled in the given configuration.
+func New(cfg *config.SpamChecker) (Checkers, error) {
+	var checkers Checkers
+	if len(cfg.ContentRules) > 0 {
+		rules, err := newContentRules(cfg.ContentRules)
+		if err != nil {
+			return nil, err
+		}
+		checkers = append(checkers, rules)
+	}
+	if cfg.InviteRateLimit.Invites > 0 {
+		checkers = append(checkers, newInviteRateLimit(cfg.InviteRateLimit.Invites, cfg.InviteRateLimit.Period))
+	}
+	if cfg.HTTPCallback.URL != "" {
+		checkers = append(checkers, newHTTPCallback(cfg.HTTPCallback.URL, cfg.HTTPCallback.Timeout, cfg.HTTPCallback.FailOpen))
+	}
+	return checkers, nil
+}
+
+func (c Checkers) CheckEvent(ctx context.Context, req *EventRequest) error {
+	for _, checker := range c {
+		if err := checker.CheckEvent(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Checkers) CheckInvite(ctx context.Context, req *InviteRequest) error {
+	for _, checker := range c {
+		if err := checker.CheckInvite(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Checkers) CheckRoomCreation(ctx context.Context, req *RoomCreationRequest) error {
+	for _, checker := range c {
+		if err := checker.CheckRoomCreation(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Checkers) CheckMediaUpload(ctx context.Context, req *MediaUploadRequest) error {
+	for _, checker := range c {
+		if err := checker.CheckMediaUpload(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
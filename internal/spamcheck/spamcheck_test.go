@@ -0,0 +1,115 @@
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func isRejected(err error) bool {
+	var rejected *RejectedError
+	return errors.As(err, &rejected)
+}
+
+func TestContentRules(t *testing.T) {
+	cfg := &config.SpamChecker{
+		ContentRules: []string{`(?i)buy cheap`, `^bad\.exe$`},
+	}
+	checker, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	ctx := context.Background()
+
+	for content, want := range map[string]bool{
+		`{"msgtype":"m.text","body":"hello"}`:                           false,
+		`{"msgtype":"m.text","body":"BUY CHEAP watches"}`:               true,
+		`{"m.new_content":{"body":"now buy cheap watches"},"body":"*"}`: true,
+		`{"list":["ok","buy cheap"]}`:                                   true,
+	} {
+		err = checker.CheckEvent(ctx, &EventRequest{Type: "m.room.message", Content: json.RawMessage(content)})
+		if isRejected(err) != want {
+			t.Errorf("content %s: expected rejected=%v, got %v", content, want, err)
+		}
+	}
+	if err = checker.CheckRoomCreation(ctx, &RoomCreationRequest{Topic: "Buy cheap stuff"}); !isRejected(err) {
+		t.Errorf("expected room creation to be rejected, got %v", err)
+	}
+	if err = checker.CheckMediaUpload(ctx, &MediaUploadRequest{Filename: "bad.exe"}); !isRejected(err) {
+		t.Errorf("expected media upload to be rejected, got %v", err)
+	}
+	if err = checker.CheckMediaUpload(ctx, &MediaUploadRequest{Filename: "not-bad.exe"}); err != nil {
+		t.Errorf("expected media upload to be allowed, got %v", err)
+	}
+}
+
+func TestInviteRateLimit(t *testing.T) {
+	limit := newInviteRateLimit(2, time.Hour)
+	ctx := context.Background()
+	alice := &InviteRequest{Inviter: "@alice:test", Invitee: "@bob:test"}
+	for i := 0; i < 2; i++ {
+		if err := limit.CheckInvite(ctx, alice); err != nil {
+			t.Fatalf("invite %d: expected to be allowed, got %s", i, err)
+		}
+	}
+	err := limit.CheckInvite(ctx, alice)
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.RetryAfter <= 0 {
+		t.Fatalf("expected rate limited rejection, got %v", err)
+	}
+	if err = limit.CheckInvite(ctx, &InviteRequest{Inviter: "@charlie:test"}); err != nil {
+		t.Fatalf("expected other users to be unaffected, got %s", err)
+	}
+
+	// Invites from before the period shouldn't count.
+	limit.sent["@alice:test"] = []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-2 * time.Hour)}
+	if err = limit.CheckInvite(ctx, alice); err != nil {
+		t.Fatalf("expected old invites to be forgotten, got %s", err)
+	}
+}
+
+func TestHTTPCallback(t *testing.T) {
+	var got callbackRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if got.Check == "invite" {
+			_, _ = w.Write([]byte(`{"allowed":false,"reason":"No invites"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"allowed":true}`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	callback := newHTTPCallback(srv.URL, time.Second, false)
+	if err := callback.CheckEvent(ctx, &EventRequest{Sender: "@alice:test"}); err != nil {
+		t.Fatalf("expected event to be allowed, got %s", err)
+	}
+	if got.Check != "event" {
+		t.Fatalf("expected check %q, got %q", "event", got.Check)
+	}
+	err := callback.CheckInvite(ctx, &InviteRequest{Inviter: "@alice:test"})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != "No invites" {
+		t.Fatalf("expected invite to be rejected with reason, got %v", err)
+	}
+
+	// An unreachable service fails closed or open depending on configuration.
+	srv.Close()
+	if err = callback.CheckEvent(ctx, &EventRequest{}); err == nil || isRejected(err) {
+		t.Fatalf("expected error from unreachable service, got %v", err)
+	}
+	callback.failOpen = true
+	if err = callback.CheckEvent(ctx, &EventRequest{}); err != nil {
+		t.Fatalf("expected fail open, got %s", err)
+	}
+}
@@ -16,10 +16,32 @@
 
 package sqlutil
 
-import "github.com/lib/pq"
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
 
 // IsUniqueConstraintViolationErr returns true if the error is a postgresql unique_violation error
 func IsUniqueConstraintViolationErr(err error) bool {
 	pqErr, ok := err.(*pq.Error)
 	return ok && pqErr.Code == "23505"
 }
+
+// isTransientPostgresErr returns true if the error is a postgresql error caused
+// by contention with other transactions or the server starting up, rather than
+// by the query itself.
+func isTransientPostgresErr(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"55P03", // lock_not_available
+		"57P03": // cannot_connect_now
+		return true
+	}
+	return false
+}
@@ -20,3 +20,8 @@ package sqlutil
 func IsUniqueConstraintViolationErr(err error) bool {
 	return false
 }
+
+// isTransientPostgresErr no-ops for this architecture
+func isTransientPostgresErr(err error) bool {
+	return false
+}
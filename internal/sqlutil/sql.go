@@ -17,6 +17,7 @@ package sqlutil
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"strings"
@@ -27,6 +28,24 @@ import (
 // ErrUserExists is returned if a username already exists in the database.
 var ErrUserExists = errors.New("Username already exists")
 
+// IsTransientErr returns true if the error was caused by a temporary condition,
+// such as the database being busy or a deadline being exceeded, rather than by
+// the operation itself, so that the operation may succeed if it is retried.
+func IsTransientErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	// sqlite returns SQLITE_BUSY and SQLITE_LOCKED as these errors
+	msg := err.Error()
+	if strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked") {
+		return true
+	}
+	return isTransientPostgresErr(err)
+}
+
 // A Transaction is something that can be committed or rolledback.
 type Transaction interface {
 	// Commit the transaction
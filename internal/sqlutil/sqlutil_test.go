@@ -3,10 +3,13 @@ package sqlutil
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 )
 
 func TestShouldReturnCorrectAmountOfResulstIfFewerVariablesThanLimit(t *testing.T) {
@@ -171,3 +174,23 @@ func assertNoError(t *testing.T, err error, msg string) {
 	}
 	t.Fatalf(msg)
 }
+
+func TestIsTransientErr(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("invalid auth events"), false},
+		{sql.ErrNoRows, false},
+		{fmt.Errorf("r.DB.StoreEvent: %w", context.DeadlineExceeded), true},
+		{fmt.Errorf("r.DB.StoreEvent: %w", errors.New("database is locked")), true},
+		{fmt.Errorf("r.DB.SetState: %w", &pq.Error{Code: "40P01"}), true},
+		{&pq.Error{Code: "23505"}, false},
+	}
+	for _, tc := range testCases {
+		if got := IsTransientErr(tc.err); got != tc.want {
+			t.Errorf("IsTransientErr(%v): got %v want %v", tc.err, got, tc.want)
+		}
+	}
+}
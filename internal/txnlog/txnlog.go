@@ -0,0 +1,226 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package txnlog logs the full contents of federation transactions for
+// debugging. Only transactions to or from selected servers, or containing
+// events for selected rooms, are logged so that it doesn't flood the logs
+// with all federation traffic.
+package txnlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Inbound is the direction of transactions received from other servers.
+	Inbound = "inbound"
+	// Outbound is the direction of transactions sent to other servers.
+	Outbound = "outbound"
+)
+
+// redactedKeys are JSON keys whose values are replaced before logging, at
+// any depth, as they can contain secrets or key material.
+var redactedKeys = map[string]bool{
+	"signatures":   true,
+	"messages":     true, // m.direct_to_device
+	"keys":         true, // m.device_list_update, m.signing_key_update
+	"ciphertext":   true,
+	"session_key":  true,
+	"access_token": true,
+	"password":     true,
+}
+
+const redacted = "<redacted>"
+
+// Default is the process-wide transaction logger. It logs nothing until
+// targets are set, either from the config at startup or via the admin API.
+var Default = NewLogger(nil, nil)
+
+// Logger logs transactions for a set of target servers and rooms. It is
+// safe for concurrent use and the targets can be changed at runtime.
+type Logger struct {
+	log     logrus.FieldLogger
+	mu      sync.RWMutex
+	servers map[gomatrixserverlib.ServerName]struct{}
+	rooms   map[string]struct{}
+}
+
+// Targets are the servers and rooms that transactions are logged for.
+type Targets struct {
+	Servers []gomatrixserverlib.ServerName `json:"servers"`
+	Rooms   []string                       `json:"rooms"`
+}
+
+// NewLogger returns a logger for the given servers and rooms.
+func NewLogger(servers []gomatrixserverlib.ServerName, rooms []string) *Logger {
+	l := &Logger{
+		log: logrus.StandardLogger(),
+	}
+	l.SetTargets(Targets{Servers: servers, Rooms: rooms})
+	return l
+}
+
+// SetTargets replaces the servers and rooms that transactions are logged for.
+func (l *Logger) SetTargets(targets Targets) {
+	servers := make(map[gomatrixserverlib.ServerName]struct{}, len(targets.Servers))
+	for _, s := range targets.Servers {
+		servers[s] = struct{}{}
+	}
+	rooms := make(map[string]struct{}, len(targets.Rooms))
+	for _, r := range targets.Rooms {
+		rooms[r] = struct{}{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.servers, l.rooms = servers, rooms
+}
+
+// Targets returns the servers and rooms that transactions are logged for.
+func (l *Logger) Targets() Targets {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	targets := Targets{
+		Servers: make([]gomatrixserverlib.ServerName, 0, len(l.servers)),
+		Rooms:   make([]string, 0, len(l.rooms)),
+	}
+	for s := range l.servers {
+		targets.Servers = append(targets.Servers, s)
+	}
+	for r := range l.rooms {
+		targets.Rooms = append(targets.Rooms, r)
+	}
+	sort.Slice(targets.Servers, func(i, j int) bool {
+		return targets.Servers[i] < targets.Servers[j]
+	})
+	sort.Strings(targets.Rooms)
+	return targets
+}
+
+// shouldLog returns true if the transaction is with a target server or
+// contains a PDU for a target room.
+func (l *Logger) shouldLog(server gomatrixserverlib.ServerName, t *gomatrixserverlib.Transaction) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.servers) == 0 && len(l.rooms) == 0 {
+		return false
+	}
+	if _, ok := l.servers[server]; ok {
+		return true
+	}
+	if len(l.rooms) == 0 {
+		return false
+	}
+	for _, pdu := range t.PDUs {
+		var header struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := json.Unmarshal(pdu, &header); err != nil {
+			continue
+		}
+		if _, ok := l.rooms[header.RoomID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LogTransaction logs the contents of the transaction at debug level if it
+// is with a target server or contains PDUs for a target room. The server is
+// the origin of inbound transactions and the destination of outbound ones.
+func (l *Logger) LogTransaction(direction string, server gomatrixserverlib.ServerName, t *gomatrixserverlib.Transaction) {
+	if !l.shouldLog(server, t) {
+		return
+	}
+	pdus := make([]interface{}, 0, len(t.PDUs))
+	for _, pdu := range t.PDUs {
+		pdus = append(pdus, redactJSON(pdu))
+	}
+	edus := make([]interface{}, 0, len(t.EDUs))
+	for _, edu := range t.EDUs {
+		edus = append(edus, map[string]interface{}{
+			"type":    edu.Type,
+			"content": redactJSON(edu.Content),
+		})
+	}
+	l.log.WithFields(logrus.Fields{
+		"direction":      direction,
+		"server_name":    server,
+		"transaction_id": t.TransactionID,
+		"pdus":           pdus,
+		"edus":           edus,
+	}).Debug("Federation transaction")
+}
+
+// redactJSON decodes the given JSON and replaces the values of any sensitive
+// keys. If the JSON can't be decoded then it is redacted entirely.
+func redactJSON(raw []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return redacted
+	}
+	return redact(v)
+}
+
+func redact(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if redactedKeys[k] {
+				val[k] = redacted
+			} else {
+				val[k] = redact(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = redact(child)
+		}
+	}
+	return v
+}
+
+// AdminHandler returns an HTTP handler that returns the current targets on
+// GET and replaces them on PUT, so that logging can be toggled at runtime.
+func AdminHandler(l *Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var targets Targets
+			if err := json.NewDecoder(req.Body).Decode(&targets); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.SetTargets(targets)
+			util.GetLogger(req.Context()).WithFields(logrus.Fields{
+				"servers": targets.Servers,
+				"rooms":   targets.Rooms,
+			}).Info("Updated federation transaction logging targets")
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(l.Targets()); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to encode federation transaction logging targets")
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package txnlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func newTestLogger(servers []gomatrixserverlib.ServerName, rooms []string) (*Logger, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	l := NewLogger(servers, rooms)
+	l.log = logger
+	return l, hook
+}
+
+func mustMakeTransaction(t *testing.T, roomID string) *gomatrixserverlib.Transaction {
+	t.Helper()
+	pdu, err := json.Marshal(map[string]interface{}{
+		"room_id": roomID,
+		"type":    "m.room.message",
+		"content": map[string]interface{}{"body": "hello"},
+		"signatures": map[string]interface{}{
+			"remote": map[string]string{"ed25519:auto": "sig"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal PDU: %s", err)
+	}
+	return &gomatrixserverlib.Transaction{
+		TransactionID: "txn",
+		PDUs:          []json.RawMessage{pdu},
+		EDUs: []gomatrixserverlib.EDU{
+			{
+				Type:    gomatrixserverlib.MDirectToDevice,
+				Content: []byte(`{"sender":"@alice:remote","messages":{"@bob:localhost":{"DEVICE":{"ciphertext":"secret"}}}}`),
+			},
+		},
+	}
+}
+
+func TestLogTransactionOnlyForTargets(t *testing.T) {
+	testCases := []struct {
+		name    string
+		servers []gomatrixserverlib.ServerName
+		rooms   []string
+		server  gomatrixserverlib.ServerName
+		roomID  string
+		wantLog bool
+	}{
+		{"no targets", nil, nil, "remote", "!room:remote", false},
+		{"target server", []gomatrixserverlib.ServerName{"remote"}, nil, "remote", "!room:remote", true},
+		{"other server", []gomatrixserverlib.ServerName{"remote"}, nil, "other", "!room:remote", false},
+		{"target room", nil, []string{"!room:remote"}, "other", "!room:remote", true},
+		{"other room", nil, []string{"!room:remote"}, "other", "!other:remote", false},
+	}
+	for _, tc := range testCases {
+		l, hook := newTestLogger(tc.servers, tc.rooms)
+		l.LogTransaction(Inbound, tc.server, mustMakeTransaction(t, tc.roomID))
+		if got := len(hook.AllEntries()) > 0; got != tc.wantLog {
+			t.Errorf("%s: expected logged=%v, got %v", tc.name, tc.wantLog, got)
+		}
+	}
+}
+
+func TestLogTransactionRedacts(t *testing.T) {
+	l, hook := newTestLogger([]gomatrixserverlib.ServerName{"remote"}, nil)
+	l.LogTransaction(Outbound, "remote", mustMakeTransaction(t, "!room:remote"))
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatalf("expected transaction to be logged")
+	}
+	if entry.Level != logrus.DebugLevel {
+		t.Errorf("expected debug level, got %s", entry.Level)
+	}
+	logged, err := json.Marshal(entry.Data)
+	if err != nil {
+		t.Fatalf("failed to marshal log fields: %s", err)
+	}
+	if bytes.Contains(logged, []byte("secret")) || bytes.Contains(logged, []byte(`"sig"`)) {
+		t.Errorf("expected sensitive fields to be redacted, got %s", logged)
+	}
+	if !bytes.Contains(logged, []byte("hello")) {
+		t.Errorf("expected PDU content to be logged, got %s", logged)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	l, hook := newTestLogger(nil, nil)
+	h := AdminHandler(l)
+
+	body := []byte(`{"servers":[],"rooms":["!room:remote"]}`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/federation_debug", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/federation_debug", nil))
+	var got Targets
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	want := Targets{Servers: []gomatrixserverlib.ServerName{}, Rooms: []string{"!room:remote"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got targets %+v want %+v", got, want)
+	}
+
+	l.LogTransaction(Inbound, "remote", mustMakeTransaction(t, "!room:remote"))
+	if len(hook.AllEntries()) != 1 {
+		t.Fatalf("expected transaction to be logged after enabling the room")
+	}
+}
@@ -29,7 +29,13 @@ type KeyInternalAPI interface {
 	SetUserAPI(i userapi.UserInternalAPI)
 	// InputDeviceListUpdate from a federated server EDU
 	InputDeviceListUpdate(ctx context.Context, req *InputDeviceListUpdateRequest, res *InputDeviceListUpdateResponse)
+	// InputCrossSigningKeyUpdate from a federated server EDU
+	InputCrossSigningKeyUpdate(ctx context.Context, req *InputCrossSigningKeyUpdateRequest, res *InputCrossSigningKeyUpdateResponse)
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse)
+	// PerformUploadDeviceKeys uploads the cross-signing keys of a local user
+	PerformUploadDeviceKeys(ctx context.Context, req *PerformUploadDeviceKeysRequest, res *PerformUploadDeviceKeysResponse)
+	// PerformUploadDeviceSignatures stores signatures of device and cross-signing keys made by a local user
+	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse)
 	// PerformClaimKeys claims one-time keys for use in pre-key messages
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
@@ -40,16 +46,34 @@ type KeyInternalAPI interface {
 
 // KeyError is returned if there was a problem performing/querying the server
 type KeyError struct {
-	Err string
+	Err                string
+	IsInvalidSignature bool // M_INVALID_SIGNATURE
+	IsMissingParam     bool // M_MISSING_PARAM
+	IsInvalidParam     bool // M_INVALID_PARAM
 }
 
 func (k *KeyError) Error() string {
 	return k.Err
 }
 
+// DeviceMessageType is the kind of key change in a DeviceMessage.
+type DeviceMessageType int
+
+const (
+	// TypeDeviceKeyUpdate is a change to the keys of a device.
+	TypeDeviceKeyUpdate DeviceMessageType = iota
+	// TypeCrossSigningUpdate is a change to the cross-signing keys of a user,
+	// or to the signatures of their keys.
+	TypeCrossSigningUpdate
+)
+
 // DeviceMessage represents the message produced into Kafka by the key server.
 type DeviceMessage struct {
+	Type DeviceMessageType `json:",omitempty"`
+	// Only the UserID is set for cross-signing updates.
 	DeviceKeys
+	// Set for cross-signing updates
+	CrossSigningKeyUpdate *CrossSigningKeyUpdate `json:",omitempty"`
 	// A monotonically increasing number which represents device changes for this user.
 	StreamID int
 }
@@ -112,6 +136,9 @@ type PerformUploadKeysRequest struct {
 	DeviceID    string // Optional - Device performing the request, for fetching OTK count
 	DeviceKeys  []DeviceKeys
 	OneTimeKeys []OneTimeKeys
+	// FallbackKeys replace the existing fallback keys of the device, which are claimed when
+	// it runs out of one-time keys. https://github.com/matrix-org/matrix-doc/pull/2732
+	FallbackKeys []OneTimeKeys
 	// OnlyDisplayNameUpdates should be `true` if ALL the DeviceKeys are present to update
 	// the display name for their respective device, and NOT to modify the keys. The key
 	// itself doesn't change but it's easier to pretend upload new keys and reuse the same code paths.
@@ -152,6 +179,9 @@ type PerformClaimKeysResponse struct {
 }
 
 type QueryKeysRequest struct {
+	// The user making the query, if any. Only they see their user-signing key and their
+	// signatures of other users' keys.
+	UserID string
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
@@ -162,6 +192,10 @@ type QueryKeysResponse struct {
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross-signing key
+	MasterKeys      map[string]CrossSigningKey
+	SelfSigningKeys map[string]CrossSigningKey
+	UserSigningKeys map[string]CrossSigningKey
 	// Set if there was a fatal error processing this query
 	Error *KeyError
 }
@@ -197,7 +231,9 @@ type QueryOneTimeKeysRequest struct {
 type QueryOneTimeKeysResponse struct {
 	// OTK key counts, in the extended /sync form described by https://matrix.org/docs/spec/client_server/r0.6.1#id84
 	Count OneTimeKeysCount
-	Error *KeyError
+	// The algorithms of the fallback keys of the device which haven't been claimed yet
+	UnusedFallbackAlgorithms []string
+	Error                    *KeyError
 }
 
 type QueryDeviceMessagesRequest struct {
@@ -218,3 +254,40 @@ type InputDeviceListUpdateRequest struct {
 type InputDeviceListUpdateResponse struct {
 	Error *KeyError
 }
+
+type InputCrossSigningKeyUpdateRequest struct {
+	CrossSigningKeyUpdate
+}
+
+type InputCrossSigningKeyUpdateResponse struct {
+	Error *KeyError
+}
+
+// PerformUploadDeviceKeysRequest is the request to PerformUploadDeviceKeys
+type PerformUploadDeviceKeysRequest struct {
+	CrossSigningKeys
+	// The user that uploaded the keys
+	UserID string
+}
+
+// PerformUploadDeviceKeysResponse is the response to PerformUploadDeviceKeys
+type PerformUploadDeviceKeysResponse struct {
+	Error *KeyError
+}
+
+// PerformUploadDeviceSignaturesRequest is the request to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesRequest struct {
+	// Map of user_id to key_id to the signed device key or cross-signing key, where
+	// key_id is either a device ID or the unpadded base64 public key of a cross-signing key.
+	Signatures map[string]map[string]json.RawMessage
+	// The user that uploaded the signatures
+	UserID string
+}
+
+// PerformUploadDeviceSignaturesResponse is the response to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesResponse struct {
+	// A fatal error when processing e.g database failures
+	Error *KeyError
+	// A map of user_id -> key_id -> Error for the signatures which weren't stored.
+	Failures map[string]map[string]*KeyError
+}
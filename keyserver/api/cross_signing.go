@@ -0,0 +1,88 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MSigningKeyUpdate is the type of the EDU which tells other servers about
+// changes to the cross-signing keys of a user.
+const MSigningKeyUpdate = "m.signing_key_update"
+
+// CrossSigningKeyPurpose is the usage of a cross-signing key.
+type CrossSigningKeyPurpose string
+
+const (
+	CrossSigningKeyPurposeMaster      CrossSigningKeyPurpose = "master"
+	CrossSigningKeyPurposeSelfSigning CrossSigningKeyPurpose = "self_signing"
+	CrossSigningKeyPurposeUserSigning CrossSigningKeyPurpose = "user_signing"
+)
+
+// CrossSigningSignatures maps user IDs to key IDs to signatures.
+type CrossSigningSignatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes
+
+// CrossSigningKey is a public cross-signing key of a user.
+// https://spec.matrix.org/unstable/client-server-api/#post_matrixclientr0keysdevice_signingupload
+type CrossSigningKey struct {
+	UserID     string                                                    `json:"user_id"`
+	Usage      []CrossSigningKeyPurpose                                  `json:"usage"`
+	Keys       map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+	Signatures CrossSigningSignatures                                    `json:"signatures,omitempty"`
+}
+
+// PublicKey returns the ID and the value of the public key. Cross-signing
+// keys only have one key, which is identified by its unpadded base64 value,
+// so ok is false if there isn't exactly one key or the ID doesn't match.
+func (k *CrossSigningKey) PublicKey() (keyID gomatrixserverlib.KeyID, key gomatrixserverlib.Base64Bytes, ok bool) {
+	if len(k.Keys) != 1 {
+		return "", nil, false
+	}
+	for id, value := range k.Keys {
+		keyID, key = id, value
+	}
+	if keyID != gomatrixserverlib.KeyID("ed25519:"+key.Encode()) {
+		return "", nil, false
+	}
+	return keyID, key, true
+}
+
+// HasUsage returns true if the key is for the purpose.
+func (k *CrossSigningKey) HasUsage(purpose CrossSigningKeyPurpose) bool {
+	for _, usage := range k.Usage {
+		if usage == purpose {
+			return true
+		}
+	}
+	return false
+}
+
+// CrossSigningKeys are the cross-signing keys of a user which are uploaded
+// together in /keys/device_signing/upload.
+type CrossSigningKeys struct {
+	MasterKey      *CrossSigningKey `json:"master_key,omitempty"`
+	SelfSigningKey *CrossSigningKey `json:"self_signing_key,omitempty"`
+	UserSigningKey *CrossSigningKey `json:"user_signing_key,omitempty"`
+}
+
+// CrossSigningKeyUpdate is the content of a m.signing_key_update EDU. The
+// user-signing key is private to the user, so it is never sent to other
+// servers.
+// https://spec.matrix.org/unstable/server-server-api/#mtypem-signing-key-update
+type CrossSigningKeyUpdate struct {
+	UserID         string           `json:"user_id"`
+	MasterKey      *CrossSigningKey `json:"master_key,omitempty"`
+	SelfSigningKey *CrossSigningKey `json:"self_signing_key,omitempty"`
+}
@@ -0,0 +1,436 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signedKey is the part of a device key or cross-signing key which is needed
+// to check signatures of it.
+type signedKey struct {
+	UserID     string                                                    `json:"user_id"`
+	DeviceID   string                                                    `json:"device_id"`
+	Keys       map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+	Signatures api.CrossSigningSignatures                                `json:"signatures"`
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.PerformUploadDeviceKeysRequest, res *api.PerformUploadDeviceKeysResponse) {
+	_, serverName, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || serverName != a.ThisServer {
+		res.Error = &api.KeyError{
+			Err:            "cross-signing keys can only be uploaded for local users",
+			IsInvalidParam: true,
+		}
+		return
+	}
+	existingKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+		}
+		return
+	}
+	keys, keyErr := validateCrossSigningKeys(req.UserID, existingKeys, map[api.CrossSigningKeyPurpose]*api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster:      req.MasterKey,
+		api.CrossSigningKeyPurposeSelfSigning: req.SelfSigningKey,
+		api.CrossSigningKeyPurposeUserSigning: req.UserSigningKey,
+	})
+	if keyErr != nil {
+		res.Error = keyErr
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err = a.DB.StoreCrossSigningKeysForUser(ctx, req.UserID, keys); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+		return
+	}
+	if err = a.emitCrossSigningKeyUpdate(ctx, req.UserID); err != nil {
+		util.GetLogger(ctx).WithError(err).Errorf("Failed to emitCrossSigningKeyUpdate")
+	}
+}
+
+func (a *KeyInternalAPI) InputCrossSigningKeyUpdate(ctx context.Context, req *api.InputCrossSigningKeyUpdateRequest, res *api.InputCrossSigningKeyUpdateResponse) {
+	existingKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+		}
+		return
+	}
+	// Other servers never send user-signing keys, as they are private to the user.
+	keys, keyErr := validateCrossSigningKeys(req.UserID, existingKeys, map[api.CrossSigningKeyPurpose]*api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster:      req.MasterKey,
+		api.CrossSigningKeyPurposeSelfSigning: req.SelfSigningKey,
+	})
+	if keyErr != nil {
+		res.Error = keyErr
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err = a.DB.StoreCrossSigningKeysForUser(ctx, req.UserID, keys); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+		return
+	}
+	if err = a.emitCrossSigningKeyUpdate(ctx, req.UserID); err != nil {
+		util.GetLogger(ctx).WithError(err).Errorf("Failed to emitCrossSigningKeyUpdate")
+	}
+}
+
+// validateCrossSigningKeys checks that the uploaded keys belong to the user and have the right usage, and that
+// the self-signing and user-signing keys are signed by the master key, which is either uploaded with them or
+// already exists. Returns the keys which were uploaded.
+func validateCrossSigningKeys(
+	userID string, existingKeys map[api.CrossSigningKeyPurpose]api.CrossSigningKey, uploads map[api.CrossSigningKeyPurpose]*api.CrossSigningKey,
+) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, *api.KeyError) {
+	keys := make(map[api.CrossSigningKeyPurpose]api.CrossSigningKey)
+	for purpose, key := range uploads {
+		if key == nil {
+			continue
+		}
+		if key.UserID != userID {
+			return nil, &api.KeyError{
+				Err:            fmt.Sprintf("%s key has user_id %q but belongs to %q", purpose, key.UserID, userID),
+				IsInvalidParam: true,
+			}
+		}
+		if !key.HasUsage(purpose) {
+			return nil, &api.KeyError{
+				Err:            fmt.Sprintf("%s key doesn't have usage %q", purpose, purpose),
+				IsInvalidParam: true,
+			}
+		}
+		if _, _, ok := key.PublicKey(); !ok {
+			return nil, &api.KeyError{
+				Err:            fmt.Sprintf("%s key must have exactly one ed25519 key, identified by its public key", purpose),
+				IsInvalidParam: true,
+			}
+		}
+		keys[purpose] = *key
+	}
+
+	masterKey, ok := keys[api.CrossSigningKeyPurposeMaster]
+	if !ok {
+		masterKey, ok = existingKeys[api.CrossSigningKeyPurposeMaster]
+	}
+	for purpose, key := range keys {
+		if purpose == api.CrossSigningKeyPurposeMaster {
+			continue
+		}
+		if !ok {
+			return nil, &api.KeyError{
+				Err:            "a master key must be uploaded before the " + string(purpose) + " key",
+				IsMissingParam: true,
+			}
+		}
+		masterKeyID, masterPublicKey, _ := masterKey.PublicKey()
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return nil, &api.KeyError{
+				Err: fmt.Sprintf("failed to marshal %s key: %s", purpose, err),
+			}
+		}
+		if err = gomatrixserverlib.VerifyJSON(userID, masterKeyID, ed25519.PublicKey(masterPublicKey), keyJSON); err != nil {
+			return nil, &api.KeyError{
+				Err:                fmt.Sprintf("%s key isn't signed by the master key: %s", purpose, err),
+				IsInvalidSignature: true,
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req *api.PerformUploadDeviceSignaturesRequest, res *api.PerformUploadDeviceSignaturesResponse) {
+	res.Failures = make(map[string]map[string]*api.KeyError)
+	signingKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+		}
+		return
+	}
+	changedUserIDs := make(map[string]bool)
+	for targetUserID, targets := range req.Signatures {
+		for targetKeyID, object := range targets {
+			if keyErr := a.storeSignatures(ctx, req.UserID, signingKeys, targetUserID, targetKeyID, object); keyErr != nil {
+				if res.Failures[targetUserID] == nil {
+					res.Failures[targetUserID] = make(map[string]*api.KeyError)
+				}
+				res.Failures[targetUserID][targetKeyID] = keyErr
+				continue
+			}
+			changedUserIDs[targetUserID] = true
+		}
+	}
+	for userID := range changedUserIDs {
+		if err = a.emitCrossSigningKeyUpdate(ctx, userID); err != nil {
+			util.GetLogger(ctx).WithError(err).Errorf("Failed to emitCrossSigningKeyUpdate")
+		}
+	}
+}
+
+// storeSignatures checks and stores the signatures of the signed device key or cross-signing key which were made
+// by the origin user. Users can sign their own devices with their self-signing key, their own master key with
+// their devices, and the master keys of other users with their user-signing key.
+func (a *KeyInternalAPI) storeSignatures(
+	ctx context.Context, originUserID string, signingKeys map[api.CrossSigningKeyPurpose]api.CrossSigningKey,
+	targetUserID, targetKeyID string, object json.RawMessage,
+) *api.KeyError {
+	var signed signedKey
+	if err := json.Unmarshal(object, &signed); err != nil {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("failed to unmarshal signed key: %s", err),
+			IsInvalidParam: true,
+		}
+	}
+	if signed.UserID != targetUserID {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("signed key has user_id %q but was uploaded for %q", signed.UserID, targetUserID),
+			IsInvalidParam: true,
+		}
+	}
+	isDevice := signed.DeviceID != ""
+	if isDevice && signed.DeviceID != targetKeyID {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("signed key has device_id %q but was uploaded for %q", signed.DeviceID, targetKeyID),
+			IsInvalidParam: true,
+		}
+	}
+	if !isDevice {
+		targetKeys, err := a.DB.CrossSigningKeysForUser(ctx, targetUserID)
+		if err != nil {
+			return &api.KeyError{
+				Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+			}
+		}
+		masterKey, ok := targetKeys[api.CrossSigningKeyPurposeMaster]
+		if _, publicKey, _ := masterKey.PublicKey(); !ok || publicKey.Encode() != targetKeyID {
+			return &api.KeyError{
+				Err:            "only the master key of a user can be signed",
+				IsInvalidParam: true,
+			}
+		}
+	}
+
+	if len(signed.Signatures[originUserID]) == 0 {
+		return &api.KeyError{
+			Err:            fmt.Sprintf("key has no signatures from %s", originUserID),
+			IsInvalidParam: true,
+		}
+	}
+	for keyID, signature := range signed.Signatures[originUserID] {
+		publicKey, purpose, err := a.signingPublicKey(ctx, originUserID, signingKeys, keyID)
+		if err != nil {
+			return &api.KeyError{
+				Err:            err.Error(),
+				IsInvalidParam: true,
+			}
+		}
+		var allowed bool
+		switch purpose {
+		case api.CrossSigningKeyPurposeSelfSigning:
+			allowed = isDevice && targetUserID == originUserID
+		case api.CrossSigningKeyPurposeUserSigning:
+			allowed = !isDevice && targetUserID != originUserID
+		case "":
+			// Signed with a device key.
+			allowed = !isDevice && targetUserID == originUserID
+		}
+		if !allowed {
+			return &api.KeyError{
+				Err:            fmt.Sprintf("key %s can't sign this key", keyID),
+				IsInvalidParam: true,
+			}
+		}
+		if err = gomatrixserverlib.VerifyJSON(originUserID, keyID, publicKey, object); err != nil {
+			return &api.KeyError{
+				Err:                fmt.Sprintf("invalid signature by %s: %s", keyID, err),
+				IsInvalidSignature: true,
+			}
+		}
+		err = a.DB.StoreCrossSigningSigsForTarget(
+			ctx, originUserID, keyID, targetUserID, gomatrixserverlib.KeyID(targetKeyID), signature,
+		)
+		if err != nil {
+			return &api.KeyError{
+				Err: fmt.Sprintf("failed to store signature: %s", err),
+			}
+		}
+	}
+	return nil
+}
+
+// signingPublicKey returns the public key of the origin user with the key ID, which is either one of their
+// cross-signing keys or the ed25519 key of one of their devices, in which case the purpose is empty.
+func (a *KeyInternalAPI) signingPublicKey(
+	ctx context.Context, originUserID string, signingKeys map[api.CrossSigningKeyPurpose]api.CrossSigningKey, keyID gomatrixserverlib.KeyID,
+) (ed25519.PublicKey, api.CrossSigningKeyPurpose, error) {
+	for purpose, key := range signingKeys {
+		if signingKeyID, publicKey, _ := key.PublicKey(); signingKeyID == keyID {
+			return ed25519.PublicKey(publicKey), purpose, nil
+		}
+	}
+	const prefix = "ed25519:"
+	if len(keyID) <= len(prefix) || keyID[:len(prefix)] != prefix {
+		return nil, "", fmt.Errorf("unknown signing key %s", keyID)
+	}
+	deviceID := string(keyID[len(prefix):])
+	devices, err := a.DB.DeviceKeysForUser(ctx, originUserID, []string{deviceID})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query device keys: %w", err)
+	}
+	for _, device := range devices {
+		var deviceKey signedKey
+		if len(device.KeyJSON) == 0 || json.Unmarshal(device.KeyJSON, &deviceKey) != nil {
+			continue
+		}
+		if publicKey, ok := deviceKey.Keys[keyID]; ok {
+			return ed25519.PublicKey(publicKey), "", nil
+		}
+	}
+	return nil, "", fmt.Errorf("unknown signing key %s", keyID)
+}
+
+// emitCrossSigningKeyUpdate produces a key change for the user, with the public cross-signing keys of the user
+// so that they can be sent to other servers.
+func (a *KeyInternalAPI) emitCrossSigningKeyUpdate(ctx context.Context, userID string) error {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("a.DB.CrossSigningKeysForUser: %w", err)
+	}
+	update := &api.CrossSigningKeyUpdate{
+		UserID: userID,
+	}
+	// Signatures of the keys by other users are private to them.
+	if key, ok := keys[api.CrossSigningKeyPurposeMaster]; ok {
+		key.Signatures = filterSignatures(key.Signatures, userID, "")
+		update.MasterKey = &key
+	}
+	if key, ok := keys[api.CrossSigningKeyPurposeSelfSigning]; ok {
+		key.Signatures = filterSignatures(key.Signatures, userID, "")
+		update.SelfSigningKey = &key
+	}
+	return a.Producer.ProduceKeyChanges([]api.DeviceMessage{
+		{
+			Type: api.TypeCrossSigningUpdate,
+			DeviceKeys: api.DeviceKeys{
+				UserID: userID,
+			},
+			CrossSigningKeyUpdate: update,
+		},
+	})
+}
+
+// crossSigningKeysFromDatabase adds the cross-signing keys of the queried users to the response, and the
+// signatures which have been uploaded for the device keys of local users.
+func (a *KeyInternalAPI) crossSigningKeysFromDatabase(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
+	res.MasterKeys = make(map[string]api.CrossSigningKey)
+	res.SelfSigningKeys = make(map[string]api.CrossSigningKey)
+	res.UserSigningKeys = make(map[string]api.CrossSigningKey)
+	for userID := range req.UserToDevices {
+		keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", userID).Error("Failed to query cross-signing keys")
+			continue
+		}
+		for purpose, key := range keys {
+			key.Signatures = filterSignatures(key.Signatures, userID, req.UserID)
+			switch purpose {
+			case api.CrossSigningKeyPurposeMaster:
+				res.MasterKeys[userID] = key
+			case api.CrossSigningKeyPurposeSelfSigning:
+				res.SelfSigningKeys[userID] = key
+			case api.CrossSigningKeyPurposeUserSigning:
+				if userID == req.UserID {
+					res.UserSigningKeys[userID] = key
+				}
+			}
+		}
+
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || serverName != a.ThisServer {
+			continue
+		}
+		for deviceID, keyJSON := range res.DeviceKeys[userID] {
+			sigs, err := a.DB.CrossSigningSigsForTarget(ctx, userID, gomatrixserverlib.KeyID(deviceID))
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("user_id", userID).Error("Failed to query device key signatures")
+				continue
+			}
+			if sigs = filterSignatures(sigs, userID, ""); len(sigs) == 0 {
+				continue
+			}
+			if keyJSON, err = addSignatures(keyJSON, sigs); err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("user_id", userID).Error("Failed to add device key signatures")
+				continue
+			}
+			res.DeviceKeys[userID][deviceID] = keyJSON
+		}
+	}
+}
+
+// filterSignatures returns the signatures made by the given users.
+func filterSignatures(sigs api.CrossSigningSignatures, userIDs ...string) api.CrossSigningSignatures {
+	result := make(api.CrossSigningSignatures)
+	for _, userID := range userIDs {
+		if userSigs, ok := sigs[userID]; ok {
+			result[userID] = userSigs
+		}
+	}
+	return result
+}
+
+// addSignatures adds the signatures to the signatures of the key JSON.
+func addSignatures(keyJSON json.RawMessage, sigs api.CrossSigningSignatures) (json.RawMessage, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(keyJSON, &object); err != nil {
+		return nil, err
+	}
+	existing := make(api.CrossSigningSignatures)
+	if raw, ok := object["signatures"]; ok {
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return nil, err
+		}
+	}
+	for userID, userSigs := range sigs {
+		if existing[userID] == nil {
+			existing[userID] = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+		}
+		for keyID, sig := range userSigs {
+			existing[userID][keyID] = sig
+		}
+	}
+	raw, err := json.Marshal(existing)
+	if err != nil {
+		return nil, err
+	}
+	object["signatures"] = raw
+	return json.Marshal(object)
+}
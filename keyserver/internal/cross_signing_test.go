@@ -0,0 +1,267 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type mockSyncProducer struct {
+	sarama.SyncProducer
+	messages []api.DeviceMessage
+}
+
+func (p *mockSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	var m api.DeviceMessage
+	if err := json.Unmarshal(msg.Value.(sarama.ByteEncoder), &m); err != nil {
+		return 0, 0, err
+	}
+	p.messages = append(p.messages, m)
+	return 0, int64(len(p.messages)), nil
+}
+
+type testCrossSigningKey struct {
+	key     api.CrossSigningKey
+	private ed25519.PrivateKey
+}
+
+func newTestCrossSigningKey(t *testing.T, userID string, purpose api.CrossSigningKeyPurpose) *testCrossSigningKey {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %s", err)
+	}
+	return &testCrossSigningKey{
+		key: api.CrossSigningKey{
+			UserID: userID,
+			Usage:  []api.CrossSigningKeyPurpose{purpose},
+			Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+				gomatrixserverlib.KeyID("ed25519:" + gomatrixserverlib.Base64Bytes(public).Encode()): gomatrixserverlib.Base64Bytes(public),
+			},
+		},
+		private: private,
+	}
+}
+
+func (k *testCrossSigningKey) keyID() gomatrixserverlib.KeyID {
+	keyID, _, _ := k.key.PublicKey()
+	return keyID
+}
+
+// sign signs the JSON object with the key
+func (k *testCrossSigningKey) sign(t *testing.T, object interface{}) json.RawMessage {
+	objectJSON, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	signed, err := gomatrixserverlib.SignJSON(k.key.UserID, k.keyID(), k.private, objectJSON)
+	if err != nil {
+		t.Fatalf("gomatrixserverlib.SignJSON: %s", err)
+	}
+	return signed
+}
+
+// signKey signs the cross-signing key with the key
+func (k *testCrossSigningKey) signKey(t *testing.T, key *testCrossSigningKey) {
+	var signed api.CrossSigningKey
+	if err := json.Unmarshal(k.sign(t, key.key), &signed); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	key.key = signed
+}
+
+func mustCreateKeyInternalAPI(t *testing.T) (*KeyInternalAPI, *mockSyncProducer, func()) {
+	tmpfile, err := ioutil.TempFile("", "keyserver_cross_signing_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("Failed to NewDatabase: %s", err)
+	}
+	producer := &mockSyncProducer{}
+	return &KeyInternalAPI{
+		DB:         db,
+		ThisServer: "localhost",
+		Producer: &producers.KeyChange{
+			Topic:    "keychange",
+			Producer: producer,
+			DB:       db,
+		},
+	}, producer, func() {
+		os.Remove(tmpfile.Name()) // nolint: errcheck
+	}
+}
+
+func TestCrossSigning(t *testing.T) {
+	a, producer, clean := mustCreateKeyInternalAPI(t)
+	defer clean()
+	alice, bob := "@alice:localhost", "@bob:localhost"
+
+	aliceMaster := newTestCrossSigningKey(t, alice, api.CrossSigningKeyPurposeMaster)
+	aliceSelfSigning := newTestCrossSigningKey(t, alice, api.CrossSigningKeyPurposeSelfSigning)
+	aliceUserSigning := newTestCrossSigningKey(t, alice, api.CrossSigningKeyPurposeUserSigning)
+	bobMaster := newTestCrossSigningKey(t, bob, api.CrossSigningKeyPurposeMaster)
+
+	// The self-signing key can't be uploaded without a master key.
+	aliceMaster.signKey(t, aliceSelfSigning)
+	var uploadRes api.PerformUploadDeviceKeysResponse
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID: alice,
+		CrossSigningKeys: api.CrossSigningKeys{
+			SelfSigningKey: &aliceSelfSigning.key,
+		},
+	}, &uploadRes)
+	if uploadRes.Error == nil || !uploadRes.Error.IsMissingParam {
+		t.Fatalf("PerformUploadDeviceKeys without a master key: got error %v, want missing param", uploadRes.Error)
+	}
+
+	// The user-signing key must be signed by the master key.
+	bobMaster.signKey(t, aliceUserSigning)
+	uploadRes = api.PerformUploadDeviceKeysResponse{}
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID: alice,
+		CrossSigningKeys: api.CrossSigningKeys{
+			MasterKey:      &aliceMaster.key,
+			UserSigningKey: &aliceUserSigning.key,
+		},
+	}, &uploadRes)
+	if uploadRes.Error == nil || !uploadRes.Error.IsInvalidSignature {
+		t.Fatalf("PerformUploadDeviceKeys with a bad signature: got error %v, want invalid signature", uploadRes.Error)
+	}
+
+	aliceUserSigning.key.Signatures = nil
+	aliceMaster.signKey(t, aliceUserSigning)
+	uploadRes = api.PerformUploadDeviceKeysResponse{}
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID: alice,
+		CrossSigningKeys: api.CrossSigningKeys{
+			MasterKey:      &aliceMaster.key,
+			SelfSigningKey: &aliceSelfSigning.key,
+			UserSigningKey: &aliceUserSigning.key,
+		},
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys failed: %s", uploadRes.Error)
+	}
+	if len(producer.messages) != 1 || producer.messages[0].Type != api.TypeCrossSigningUpdate {
+		t.Fatalf("PerformUploadDeviceKeys produced %+v, want one cross-signing update", producer.messages)
+	}
+	if update := producer.messages[0].CrossSigningKeyUpdate; update == nil || update.MasterKey == nil || update.SelfSigningKey == nil {
+		t.Fatalf("PerformUploadDeviceKeys produced update %+v, want master and self-signing keys", update)
+	}
+
+	var inputRes api.InputCrossSigningKeyUpdateResponse
+	a.InputCrossSigningKeyUpdate(ctx, &api.InputCrossSigningKeyUpdateRequest{
+		CrossSigningKeyUpdate: api.CrossSigningKeyUpdate{
+			UserID:    bob,
+			MasterKey: &bobMaster.key,
+		},
+	}, &inputRes)
+	if inputRes.Error != nil {
+		t.Fatalf("InputCrossSigningKeyUpdate failed: %s", inputRes.Error)
+	}
+
+	// Alice signs her device with her self-signing key, and Bob's master key
+	// with her user-signing key.
+	deviceKey := map[string]interface{}{
+		"user_id":    alice,
+		"device_id":  "ALICEDEVICE",
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2"},
+		"keys": map[string]string{
+			"ed25519:ALICEDEVICE": "ZWQyNTUxOSBwdWJsaWMga2V5IG9mIHRoZSBkZXZpY2U",
+		},
+	}
+	deviceKeyJSON, err := json.Marshal(deviceKey)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	err = a.DB.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{UserID: alice, DeviceID: "ALICEDEVICE", KeyJSON: deviceKeyJSON}},
+	})
+	if err != nil {
+		t.Fatalf("StoreLocalDeviceKeys failed: %s", err)
+	}
+	var sigRes api.PerformUploadDeviceSignaturesResponse
+	a.PerformUploadDeviceSignatures(ctx, &api.PerformUploadDeviceSignaturesRequest{
+		UserID: alice,
+		Signatures: map[string]map[string]json.RawMessage{
+			alice: {
+				"ALICEDEVICE": aliceSelfSigning.sign(t, deviceKey),
+			},
+			bob: {
+				bobMaster.key.Keys[bobMaster.keyID()].Encode(): aliceUserSigning.sign(t, bobMaster.key),
+				// The self-signing key can't sign other users.
+				"WRONGKEY": aliceSelfSigning.sign(t, bobMaster.key),
+			},
+		},
+	}, &sigRes)
+	if sigRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceSignatures failed: %s", sigRes.Error)
+	}
+	if len(sigRes.Failures) != 1 || len(sigRes.Failures[bob]) != 1 || sigRes.Failures[bob]["WRONGKEY"] == nil {
+		t.Fatalf("PerformUploadDeviceSignatures: got failures %+v, want one for WRONGKEY", sigRes.Failures)
+	}
+
+	// Alice sees her signature of Bob's master key, and the signature of her device.
+	queryRes := api.QueryKeysResponse{
+		DeviceKeys: map[string]map[string]json.RawMessage{
+			alice: {"ALICEDEVICE": deviceKeyJSON},
+		},
+	}
+	a.crossSigningKeysFromDatabase(ctx, &api.QueryKeysRequest{
+		UserID:        alice,
+		UserToDevices: map[string][]string{alice: nil, bob: nil},
+	}, &queryRes)
+	if _, ok := queryRes.UserSigningKeys[alice]; !ok {
+		t.Errorf("QueryKeys didn't return the user-signing key of the requester")
+	}
+	if _, ok := queryRes.MasterKeys[bob].Signatures[alice][aliceUserSigning.keyID()]; !ok {
+		t.Errorf("QueryKeys didn't return the signature of Bob's master key, got %+v", queryRes.MasterKeys[bob])
+	}
+	var signedDevice signedKey
+	if err = json.Unmarshal(queryRes.DeviceKeys[alice]["ALICEDEVICE"], &signedDevice); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if _, ok := signedDevice.Signatures[alice][aliceSelfSigning.keyID()]; !ok {
+		t.Errorf("QueryKeys didn't return the signature of the device, got %s", queryRes.DeviceKeys[alice]["ALICEDEVICE"])
+	}
+
+	// Bob doesn't see Alice's signature of his master key, or her user-signing key.
+	queryRes = api.QueryKeysResponse{}
+	a.crossSigningKeysFromDatabase(ctx, &api.QueryKeysRequest{
+		UserID:        bob,
+		UserToDevices: map[string][]string{alice: nil, bob: nil},
+	}, &queryRes)
+	if _, ok := queryRes.UserSigningKeys[alice]; ok {
+		t.Errorf("QueryKeys returned the user-signing key of another user")
+	}
+	if _, ok := queryRes.MasterKeys[bob].Signatures[alice]; ok {
+		t.Errorf("QueryKeys returned a signature by another user")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// StartOneTimeKeyCleanup periodically removes the one-time keys and fallback
+// keys of deleted devices, which would otherwise never be claimed. If maxAge is
+// non-zero then unclaimed one-time keys older than maxAge are removed as well.
+// Fallback keys of current devices are never removed.
+func StartOneTimeKeyCleanup(db storage.Database, interval, maxAge time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			CleanupOneTimeKeys(context.Background(), db, maxAge, time.Now())
+		}
+	}()
+}
+
+// CleanupOneTimeKeys performs a single pass of the one-time key cleanup as of
+// the given time.
+func CleanupOneTimeKeys(ctx context.Context, db storage.Database, maxAge time.Duration, now time.Time) {
+	var olderThan time.Time
+	if maxAge > 0 {
+		olderThan = now.Add(-maxAge)
+	}
+	deleted, err := db.DeleteStaleOneTimeKeys(ctx, olderThan)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to clean up stale one-time keys")
+		return
+	}
+	if deleted > 0 {
+		logrus.WithField("deleted", deleted).Info("Cleaned up stale one-time keys")
+	}
+	deleted, err = db.DeleteStaleFallbackKeys(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to clean up stale fallback keys")
+		return
+	}
+	if deleted > 0 {
+		logrus.WithField("deleted", deleted).Info("Cleaned up stale fallback keys")
+	}
+}
@@ -15,6 +15,8 @@
 package keyserver
 
 import (
+	"time"
+
 	"github.com/gorilla/mux"
 	fedsenderapi "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -55,6 +57,13 @@ func NewInternalAPI(
 			logrus.WithError(err).Panicf("failed to start device list updater")
 		}
 	}()
+	if cfg.OneTimeKeyCleanupIntervalMS > 0 {
+		internal.StartOneTimeKeyCleanup(
+			db,
+			time.Duration(cfg.OneTimeKeyCleanupIntervalMS)*time.Millisecond,
+			time.Duration(cfg.OneTimeKeyMaxAgeMS)*time.Millisecond,
+		)
+	}
 	return &internal.KeyInternalAPI{
 		DB:         db,
 		ThisServer: cfg.Matrix.ServerName,
@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -33,6 +34,19 @@ type Database interface {
 	// OneTimeKeysCount returns a count of all OTKs for this device.
 	OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error)
 
+	// StoreFallbackKeys persists the given fallback keys, replacing the existing fallback key of the device for each algorithm.
+	StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error
+
+	// UnusedFallbackKeyAlgorithms returns the algorithms of the fallback keys of this device which haven't been claimed.
+	UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+
+	// DeleteStaleOneTimeKeys deletes the one-time keys of deleted devices. If olderThan is non-zero then unclaimed
+	// one-time keys uploaded before then are also deleted. Returns the number of keys deleted.
+	DeleteStaleOneTimeKeys(ctx context.Context, olderThan time.Time) (int64, error)
+
+	// DeleteStaleFallbackKeys deletes the fallback keys of deleted devices. Returns the number of keys deleted.
+	DeleteStaleFallbackKeys(ctx context.Context) (int64, error)
+
 	// DeviceKeysJSON populates the KeyJSON for the given keys. If any proided `keys` have a `KeyJSON` or `StreamID` already then it will be replaced.
 	DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 
@@ -56,6 +70,7 @@ type Database interface {
 
 	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. Returns no error if a key
 	// cannot be claimed or if none exist for this (user, device, algorithm), instead it is omitted from the returned slice.
+	// If a device has no one-time keys left for the algorithm then its fallback key is returned instead.
 	ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error)
 
 	// StoreKeyChange stores key change metadata after the change has been sent to Kafka. `userID` is the the user who has changed
@@ -73,4 +88,18 @@ type Database interface {
 
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// CrossSigningKeysForUser returns the cross-signing keys of the user, with the signatures which have been uploaded
+	// for them. Keys which haven't been uploaded are omitted from the map.
+	CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error)
+
+	// StoreCrossSigningKeysForUser persists the cross-signing keys of the user, replacing any existing keys for the same purposes.
+	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]api.CrossSigningKey) error
+
+	// CrossSigningSigsForTarget returns the signatures which have been uploaded for the target key, which is either a
+	// device ID or the unpadded base64 public key of a cross-signing key.
+	CrossSigningSigsForTarget(ctx context.Context, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSignatures, error)
+
+	// StoreCrossSigningSigsForTarget persists a signature of the target key, replacing any existing signature by the same key.
+	StoreCrossSigningSigsForTarget(ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID, targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes) error
 }
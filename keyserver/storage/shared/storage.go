@@ -18,6 +18,8 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -29,9 +31,12 @@ type Database struct {
 	DB                    *sql.DB
 	Writer                sqlutil.Writer
 	OneTimeKeysTable      tables.OneTimeKeys
+	FallbackKeysTable     tables.FallbackKeys
 	DeviceKeysTable       tables.DeviceKeys
 	KeyChangesTable       tables.KeyChanges
 	StaleDeviceListsTable tables.StaleDeviceLists
+	CrossSigningKeysTable tables.CrossSigningKeys
+	CrossSigningSigsTable tables.CrossSigningSigs
 }
 
 func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -50,6 +55,41 @@ func (d *Database) OneTimeKeysCount(ctx context.Context, userID, deviceID string
 	return d.OneTimeKeysTable.CountOneTimeKeys(ctx, userID, deviceID)
 }
 
+func (d *Database) StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FallbackKeysTable.InsertFallbackKeys(ctx, txn, keys)
+	})
+}
+
+func (d *Database) UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error) {
+	return d.FallbackKeysTable.SelectUnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+}
+
+func (d *Database) DeleteStaleOneTimeKeys(ctx context.Context, olderThan time.Time) (deleted int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.OneTimeKeysTable.DeleteOneTimeKeysForDeletedDevices(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if olderThan.IsZero() {
+			return nil
+		}
+		var old int64
+		old, err = d.OneTimeKeysTable.DeleteOneTimeKeysOlderThan(ctx, txn, olderThan)
+		deleted += old
+		return err
+	})
+	return
+}
+
+func (d *Database) DeleteStaleFallbackKeys(ctx context.Context) (deleted int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.FallbackKeysTable.DeleteFallbackKeysForDeletedDevices(ctx, txn)
+		return err
+	})
+	return
+}
+
 func (d *Database) DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error {
 	return d.DeviceKeysTable.SelectDeviceKeysJSON(ctx, keys)
 }
@@ -116,6 +156,13 @@ func (d *Database) ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[st
 				if err != nil {
 					return err
 				}
+				if keyJSON == nil {
+					// The device has run out of one-time keys, so use its fallback key instead.
+					keyJSON, err = d.FallbackKeysTable.SelectAndMarkFallbackKeyUsed(ctx, txn, userID, deviceID, algo)
+					if err != nil {
+						return err
+					}
+				}
 				if keyJSON != nil {
 					result = append(result, api.OneTimeKeys{
 						UserID:   userID,
@@ -152,3 +199,72 @@ func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isSta
 		return d.StaleDeviceListsTable.InsertStaleDeviceList(ctx, userID, isStale)
 	})
 }
+
+// CrossSigningKeysForUser returns the cross-signing keys of the user, with the signatures which have been uploaded for them.
+func (d *Database) CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error) {
+	keyData, err := d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, nil, userID)
+	if err != nil {
+		return nil, fmt.Errorf("d.CrossSigningKeysTable.SelectCrossSigningKeysForUser: %w", err)
+	}
+	result := make(map[api.CrossSigningKeyPurpose]api.CrossSigningKey, len(keyData))
+	for purpose, data := range keyData {
+		var key api.CrossSigningKey
+		if err = json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		keyID, _, ok := key.PublicKey()
+		if !ok {
+			continue
+		}
+		sigs, err := d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, nil, userID, keyID[len("ed25519:"):])
+		if err != nil {
+			return nil, fmt.Errorf("d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget: %w", err)
+		}
+		for originUserID, originSigs := range sigs {
+			if key.Signatures == nil {
+				key.Signatures = make(api.CrossSigningSignatures)
+			}
+			if key.Signatures[originUserID] == nil {
+				key.Signatures[originUserID] = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+			}
+			for originKeyID, sig := range originSigs {
+				key.Signatures[originUserID][originKeyID] = sig
+			}
+		}
+		result[purpose] = key
+	}
+	return result, nil
+}
+
+// StoreCrossSigningKeysForUser persists the cross-signing keys of the user, replacing any existing keys for the same purposes.
+func (d *Database) StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]api.CrossSigningKey) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for purpose, key := range keys {
+			keyData, err := json.Marshal(key)
+			if err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+			if err = d.CrossSigningKeysTable.UpsertCrossSigningKeysForUser(ctx, txn, userID, purpose, keyData); err != nil {
+				return fmt.Errorf("d.CrossSigningKeysTable.UpsertCrossSigningKeysForUser: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// CrossSigningSigsForTarget returns the signatures which have been uploaded for the target key.
+func (d *Database) CrossSigningSigsForTarget(ctx context.Context, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSignatures, error) {
+	return d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, nil, targetUserID, targetKeyID)
+}
+
+// StoreCrossSigningSigsForTarget persists a signature of the target key, replacing any existing signature by the same key.
+func (d *Database) StoreCrossSigningSigsForTarget(
+	ctx context.Context,
+	originUserID string, originKeyID gomatrixserverlib.KeyID,
+	targetUserID string, targetKeyID gomatrixserverlib.KeyID,
+	signature gomatrixserverlib.Base64Bytes,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.CrossSigningSigsTable.UpsertCrossSigningSigsForTarget(ctx, txn, originUserID, originKeyID, targetUserID, targetKeyID, signature)
+	})
+}
@@ -58,13 +58,26 @@ const deleteOneTimeKeySQL = "" +
 const selectKeyByAlgorithmSQL = "" +
 	"SELECT key_id, key_json FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1"
 
+// Deleted devices keep a device keys row with empty key JSON, so that their
+// stream ID is preserved, which is how we find their one-time keys.
+const deleteOneTimeKeysForDeletedDevicesSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE EXISTS (" +
+	" SELECT 1 FROM keyserver_device_keys WHERE keyserver_device_keys.user_id = keyserver_one_time_keys.user_id" +
+	" AND keyserver_device_keys.device_id = keyserver_one_time_keys.device_id AND keyserver_device_keys.key_json = ''" +
+	")"
+
+const deleteOneTimeKeysOlderThanSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE ts_added_secs < $1"
+
 type oneTimeKeysStatements struct {
-	db                       *sql.DB
-	upsertKeysStmt           *sql.Stmt
-	selectKeysStmt           *sql.Stmt
-	selectKeysCountStmt      *sql.Stmt
-	selectKeyByAlgorithmStmt *sql.Stmt
-	deleteOneTimeKeyStmt     *sql.Stmt
+	db                          *sql.DB
+	upsertKeysStmt              *sql.Stmt
+	selectKeysStmt              *sql.Stmt
+	selectKeysCountStmt         *sql.Stmt
+	selectKeyByAlgorithmStmt    *sql.Stmt
+	deleteOneTimeKeyStmt        *sql.Stmt
+	deleteForDeletedDevicesStmt *sql.Stmt
+	deleteOlderThanStmt         *sql.Stmt
 }
 
 func NewSqliteOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
@@ -90,6 +103,12 @@ func NewSqliteOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
 	if s.deleteOneTimeKeyStmt, err = db.Prepare(deleteOneTimeKeySQL); err != nil {
 		return nil, err
 	}
+	if s.deleteForDeletedDevicesStmt, err = db.Prepare(deleteOneTimeKeysForDeletedDevicesSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteOlderThanStmt, err = db.Prepare(deleteOneTimeKeysOlderThanSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -201,3 +220,19 @@ func (s *oneTimeKeysStatements) SelectAndDeleteOneTimeKey(
 		algorithm + ":" + keyID: json.RawMessage(keyJSON),
 	}, err
 }
+
+func (s *oneTimeKeysStatements) DeleteOneTimeKeysForDeletedDevices(ctx context.Context, txn *sql.Tx) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.deleteForDeletedDevicesStmt).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *oneTimeKeysStatements) DeleteOneTimeKeysOlderThan(ctx context.Context, txn *sql.Tx, ts time.Time) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.deleteOlderThanStmt).ExecContext(ctx, ts.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
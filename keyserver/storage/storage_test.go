@@ -2,12 +2,14 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -174,3 +176,168 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteStaleOneTimeKeys(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:TestDeleteStaleOneTimeKeys"
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{DeviceID: "CURRENT", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)}},
+		{DeviceKeys: api.DeviceKeys{DeviceID: "DELETED", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)}},
+	}))
+	for _, deviceID := range []string{"CURRENT", "DELETED"} {
+		_, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+			UserID:   alice,
+			DeviceID: deviceID,
+			KeyJSON: map[string]json.RawMessage{
+				"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"a"}`),
+				"signed_curve25519:AAAAAg": json.RawMessage(`{"key":"b"}`),
+			},
+		})
+		MustNotError(t, err)
+	}
+	// deleting a device stores empty device keys for it
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{DeviceID: "DELETED", UserID: alice}},
+	}))
+
+	deleted, err := db.DeleteStaleOneTimeKeys(ctx, time.Time{})
+	MustNotError(t, err)
+	if deleted != 2 {
+		t.Errorf("DeleteStaleOneTimeKeys: got %d deleted keys, want 2", deleted)
+	}
+	counts, err := db.OneTimeKeysCount(ctx, alice, "DELETED")
+	MustNotError(t, err)
+	if len(counts.KeyCount) != 0 {
+		t.Errorf("expected no one-time keys for the deleted device, got %v", counts.KeyCount)
+	}
+	counts, err = db.OneTimeKeysCount(ctx, alice, "CURRENT")
+	MustNotError(t, err)
+	if counts.KeyCount["signed_curve25519"] != 2 {
+		t.Errorf("expected one-time keys for the current device to be kept, got %v", counts.KeyCount)
+	}
+
+	// keys uploaded after the cut-off are kept
+	_, err = db.DeleteStaleOneTimeKeys(ctx, time.Now().Add(-time.Hour))
+	MustNotError(t, err)
+	counts, err = db.OneTimeKeysCount(ctx, alice, "CURRENT")
+	MustNotError(t, err)
+	if counts.KeyCount["signed_curve25519"] != 2 {
+		t.Errorf("expected recent one-time keys to be kept, got %v", counts.KeyCount)
+	}
+
+	// keys uploaded before the cut-off are removed
+	deleted, err = db.DeleteStaleOneTimeKeys(ctx, time.Now().Add(time.Hour))
+	MustNotError(t, err)
+	if deleted != 2 {
+		t.Errorf("DeleteStaleOneTimeKeys: got %d deleted old keys, want 2", deleted)
+	}
+}
+
+func TestFallbackKeys(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:TestFallbackKeys"
+	_, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"otk"}`),
+		},
+	})
+	MustNotError(t, err)
+	MustNotError(t, db.StoreFallbackKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:AAAAAg": json.RawMessage(`{"key":"fallback1","fallback":true}`),
+		},
+	}))
+	// replaces the first fallback key
+	MustNotError(t, db.StoreFallbackKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:AAAAAw": json.RawMessage(`{"key":"fallback2","fallback":true}`),
+		},
+	}))
+	algorithms, err := db.UnusedFallbackKeyAlgorithms(ctx, alice, "DEVICE")
+	MustNotError(t, err)
+	if !reflect.DeepEqual(algorithms, []string{"signed_curve25519"}) {
+		t.Fatalf("UnusedFallbackKeyAlgorithms: got %v want [signed_curve25519]", algorithms)
+	}
+
+	// the one-time key is claimed first, then the fallback key every time after that
+	claim := map[string]map[string]string{alice: {"DEVICE": "signed_curve25519"}}
+	for i, want := range []string{"signed_curve25519:AAAAAQ", "signed_curve25519:AAAAAw", "signed_curve25519:AAAAAw"} {
+		keys, err := db.ClaimKeys(ctx, claim)
+		MustNotError(t, err)
+		if len(keys) != 1 || keys[0].KeyJSON[want] == nil {
+			t.Fatalf("ClaimKeys %d: got %+v want %s", i, keys, want)
+		}
+	}
+	algorithms, err = db.UnusedFallbackKeyAlgorithms(ctx, alice, "DEVICE")
+	MustNotError(t, err)
+	if len(algorithms) != 0 {
+		t.Fatalf("UnusedFallbackKeyAlgorithms: got %v want none after claiming the fallback key", algorithms)
+	}
+}
+
+func TestDeleteStaleFallbackKeys(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:TestDeleteStaleFallbackKeys"
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{DeviceID: "CURRENT", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)}},
+		{DeviceKeys: api.DeviceKeys{DeviceID: "DELETED", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)}},
+	}))
+	for _, deviceID := range []string{"CURRENT", "DELETED"} {
+		_, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+			UserID:   alice,
+			DeviceID: deviceID,
+			KeyJSON: map[string]json.RawMessage{
+				"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"otk"}`),
+			},
+		})
+		MustNotError(t, err)
+		MustNotError(t, db.StoreFallbackKeys(ctx, api.OneTimeKeys{
+			UserID:   alice,
+			DeviceID: deviceID,
+			KeyJSON: map[string]json.RawMessage{
+				"signed_curve25519:AAAAAg": json.RawMessage(`{"key":"fallback","fallback":true}`),
+			},
+		}))
+	}
+	// deleting a device stores empty device keys for it
+	MustNotError(t, db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{DeviceID: "DELETED", UserID: alice}},
+	}))
+
+	// cleaning up one-time keys leaves fallback keys alone
+	deleted, err := db.DeleteStaleOneTimeKeys(ctx, time.Time{})
+	MustNotError(t, err)
+	if deleted != 1 {
+		t.Errorf("DeleteStaleOneTimeKeys: got %d deleted keys, want 1", deleted)
+	}
+	algorithms, err := db.UnusedFallbackKeyAlgorithms(ctx, alice, "DELETED")
+	MustNotError(t, err)
+	if len(algorithms) != 1 {
+		t.Errorf("expected the fallback key of the deleted device to be kept, got %v", algorithms)
+	}
+
+	deleted, err = db.DeleteStaleFallbackKeys(ctx)
+	MustNotError(t, err)
+	if deleted != 1 {
+		t.Errorf("DeleteStaleFallbackKeys: got %d deleted keys, want 1", deleted)
+	}
+	algorithms, err = db.UnusedFallbackKeyAlgorithms(ctx, alice, "DELETED")
+	MustNotError(t, err)
+	if len(algorithms) != 0 {
+		t.Errorf("expected no fallback keys for the deleted device, got %v", algorithms)
+	}
+	algorithms, err = db.UnusedFallbackKeyAlgorithms(ctx, alice, "CURRENT")
+	MustNotError(t, err)
+	if len(algorithms) != 1 {
+		t.Errorf("expected the fallback key of the current device to be kept, got %v", algorithms)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -30,6 +31,25 @@ type OneTimeKeys interface {
 	// SelectAndDeleteOneTimeKey selects a single one time key matching the user/device/algorithm specified and returns the algo:key_id => JSON.
 	// Returns an empty map if the key does not exist.
 	SelectAndDeleteOneTimeKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// DeleteOneTimeKeysForDeletedDevices deletes all one-time keys for devices whose device keys have been deleted.
+	// Returns the number of keys deleted.
+	DeleteOneTimeKeysForDeletedDevices(ctx context.Context, txn *sql.Tx) (int64, error)
+	// DeleteOneTimeKeysOlderThan deletes all one-time keys which were uploaded before the given time.
+	// Returns the number of keys deleted.
+	DeleteOneTimeKeysOlderThan(ctx context.Context, txn *sql.Tx, ts time.Time) (int64, error)
+}
+
+type FallbackKeys interface {
+	// InsertFallbackKeys stores the fallback keys, replacing the existing fallback key of the device for each algorithm.
+	InsertFallbackKeys(ctx context.Context, txn *sql.Tx, keys api.OneTimeKeys) error
+	// SelectAndMarkFallbackKeyUsed selects the fallback key matching the user/device/algorithm specified and returns the algo:key_id => JSON.
+	// The key is kept so that it can be claimed again until it is replaced. Returns nil if the key does not exist.
+	SelectAndMarkFallbackKeyUsed(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// SelectUnusedFallbackKeyAlgorithms returns the algorithms of the fallback keys of the device which haven't been claimed.
+	SelectUnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+	// DeleteFallbackKeysForDeletedDevices deletes all fallback keys for devices whose device keys have been deleted.
+	// Returns the number of keys deleted.
+	DeleteFallbackKeysForDeletedDevices(ctx context.Context, txn *sql.Tx) (int64, error)
 }
 
 type DeviceKeys interface {
@@ -52,3 +72,13 @@ type StaleDeviceLists interface {
 	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
 	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
 }
+
+type CrossSigningKeys interface {
+	SelectCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[api.CrossSigningKeyPurpose]json.RawMessage, error)
+	UpsertCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string, keyType api.CrossSigningKeyPurpose, keyData json.RawMessage) error
+}
+
+type CrossSigningSigs interface {
+	SelectCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSignatures, error)
+	UpsertCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID, targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes) error
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(purgedMediaCount, purgedMediaBytesCount)
+}
+
+var purgedMediaCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "purged_media_total",
+		Help:      "Number of media files purged along with events by message retention policies",
+	},
+)
+
+var purgedMediaBytesCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "purged_media_bytes_total",
+		Help:      "Size of the media files purged along with events by message retention policies",
+	},
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server.
+type OutputRoomEventConsumer struct {
+	cfg        *config.MediaAPI
+	rsConsumer *internal.ContinualConsumer
+	db         storage.Database
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.MediaAPI,
+	kafkaConsumer sarama.Consumer,
+	store storage.Database,
+) *OutputRoomEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Process:        process,
+		ComponentName:  "mediaapi/roomserver",
+		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputRoomEventConsumer{
+		cfg:        cfg,
+		rsConsumer: &consumer,
+		db:         store,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	return s.rsConsumer.Start()
+}
+
+// onMessage is called when the media API receives a new event from the room
+// server output log. Only purged events are of interest, so that the media
+// they referred to can be purged too.
+func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+
+	if output.Type != api.OutputTypePurgedEvents {
+		return nil
+	}
+
+	for _, uri := range output.PurgedEvents.MediaURIs {
+		if err := s.purgeMedia(context.TODO(), uri); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"room_id":   output.PurgedEvents.RoomID,
+				"media_uri": uri,
+			}).Error("Failed to purge media")
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeMedia removes the media with the given mxc:// URI, if we have it. The
+// file is only removed once no other media is stored in it.
+func (s *OutputRoomEventConsumer) purgeMedia(ctx context.Context, uri string) error {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "mxc://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil
+	}
+	mediaOrigin := gomatrixserverlib.ServerName(parts[0])
+	mediaID := types.MediaID(parts[1])
+
+	mediaMetadata, err := s.db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return err
+	}
+	if mediaMetadata == nil {
+		return nil
+	}
+	if err = s.db.DeleteMedia(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	count, err := s.db.CountMediaByHash(ctx, mediaMetadata.Base64Hash)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, s.cfg.AbsBasePath)
+	if err != nil {
+		return err
+	}
+	// The thumbnails are stored alongside the file, so remove them all at once.
+	fileutils.RemoveDir(types.Path(filepath.Dir(filePath)), log.WithField("media_uri", uri))
+	purgedMediaCount.Inc()
+	purgedMediaBytesCount.Add(float64(mediaMetadata.FileSizeBytes))
+	return nil
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/storageprovider"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -76,6 +77,7 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	provider storageprovider.Provider,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -117,13 +119,13 @@ func Download(
 	}
 
 	// request validation
-	if resErr := dReq.Validate(); resErr != nil {
+	if resErr := dReq.Validate(cfg.MaxThumbnailDimension); resErr != nil {
 		dReq.jsonErrorResponse(w, *resErr)
 		return
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
+		req.Context(), w, cfg, db, provider, client,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
 	if err != nil {
@@ -164,7 +166,7 @@ func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSON
 }
 
 // Validate validates the downloadRequest fields
-func (r *downloadRequest) Validate() *util.JSONResponse {
+func (r *downloadRequest) Validate(maxThumbnailDimension int) *util.JSONResponse {
 	if !mediaIDRegex.MatchString(string(r.MediaMetadata.MediaID)) {
 		return &util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -187,6 +189,12 @@ func (r *downloadRequest) Validate() *util.JSONResponse {
 				JSON: jsonerror.Unknown("width and height must be greater than 0"),
 			}
 		}
+		if r.ThumbnailSize.Width > maxThumbnailDimension || r.ThumbnailSize.Height > maxThumbnailDimension {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown(fmt.Sprintf("width and height must not be greater than %d", maxThumbnailDimension)),
+			}
+		}
 		// Default method to scale if not set
 		if r.ThumbnailSize.ResizeMethod == "" {
 			r.ThumbnailSize.ResizeMethod = types.Scale
@@ -206,6 +214,7 @@ func (r *downloadRequest) doDownload(
 	w http.ResponseWriter,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	provider storageprovider.Provider,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -224,7 +233,7 @@ func (r *downloadRequest) doDownload(
 		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, cfg, db, provider, activeRemoteRequests, activeThumbnailGeneration,
 		)
 		if resErr != nil {
 			return nil, resErr
@@ -235,7 +244,7 @@ func (r *downloadRequest) doDownload(
 	}
 	return r.respondFromLocalFile(
 		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
-		cfg.MaxThumbnailGenerators, db,
+		cfg.MaxThumbnailGenerators, db, provider,
 		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
 	)
 }
@@ -249,6 +258,7 @@ func (r *downloadRequest) respondFromLocalFile(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	provider storageprovider.Provider,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*types.MediaMetadata, error) {
@@ -256,6 +266,9 @@ func (r *downloadRequest) respondFromLocalFile(
 	if err != nil {
 		return nil, fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
 	}
+	if err = storageprovider.FetchFileIfMissing(ctx, provider, absBasePath, types.Path(filePath)); err != nil {
+		return nil, fmt.Errorf("storageprovider.FetchFileIfMissing: %w", err)
+	}
 	file, err := os.Open(filePath)
 	defer file.Close() // nolint: errcheck, staticcheck, megacheck
 	if err != nil {
@@ -278,8 +291,8 @@ func (r *downloadRequest) respondFromLocalFile(
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
-			db, dynamicThumbnails, thumbnailSizes,
+			ctx, absBasePath, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
+			db, provider, dynamicThumbnails, thumbnailSizes,
 		)
 		if thumbFile != nil {
 			defer thumbFile.Close() // nolint: errcheck
@@ -395,10 +408,12 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
+	absBasePath config.Path,
 	filePath types.Path,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	provider storageprovider.Provider,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*os.File, *types.ThumbnailMetadata, error) {
@@ -407,8 +422,8 @@ func (r *downloadRequest) getThumbnailFile(
 
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
-			maxThumbnailGenerators, db,
+			ctx, absBasePath, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			maxThumbnailGenerators, db, provider,
 		)
 		if err != nil {
 			return nil, nil, err
@@ -438,8 +453,8 @@ func (r *downloadRequest) getThumbnailFile(
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Info("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
-				maxThumbnailGenerators, db,
+				ctx, absBasePath, filePath, *thumbnailSize, activeThumbnailGeneration,
+				maxThumbnailGenerators, db, provider,
 			)
 			if err != nil {
 				return nil, nil, err
@@ -457,6 +472,9 @@ func (r *downloadRequest) getThumbnailFile(
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
 	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
+	if err = storageprovider.FetchFileIfMissing(ctx, provider, absBasePath, types.Path(thumbPath)); err != nil {
+		return nil, nil, fmt.Errorf("storageprovider.FetchFileIfMissing: %w", err)
+	}
 	thumbFile, err := os.Open(string(thumbPath))
 	if err != nil {
 		thumbFile.Close() // nolint: errcheck
@@ -476,17 +494,23 @@ func (r *downloadRequest) getThumbnailFile(
 
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
+	absBasePath config.Path,
 	filePath types.Path,
 	thumbnailSize types.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	provider storageprovider.Provider,
 ) (*types.ThumbnailMetadata, error) {
 	r.Logger.WithFields(log.Fields{
 		"Width":        thumbnailSize.Width,
 		"Height":       thumbnailSize.Height,
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
+	// Only thumbnails which are generated here need to be copied to the
+	// storage provider, not ones which already exist.
+	thumbPath := thumbnailer.GetThumbnailPath(filePath, thumbnailSize)
+	_, statErr := os.Stat(string(thumbPath))
 	busy, err := thumbnailer.GenerateThumbnail(
 		ctx, filePath, thumbnailSize, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
@@ -497,6 +521,11 @@ func (r *downloadRequest) generateThumbnail(
 	if busy {
 		return nil, nil
 	}
+	if _, err = os.Stat(string(thumbPath)); os.IsNotExist(statErr) && err == nil {
+		if err = storageprovider.StoreFile(ctx, provider, absBasePath, thumbPath); err != nil {
+			return nil, fmt.Errorf("storageprovider.StoreFile: %w", err)
+		}
+	}
 	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
@@ -517,6 +546,7 @@ func (r *downloadRequest) getRemoteFile(
 	client *gomatrixserverlib.Client,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	provider storageprovider.Provider,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
@@ -551,7 +581,7 @@ func (r *downloadRequest) getRemoteFile(
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
 				ctx, client,
-				cfg.AbsBasePath, *cfg.MaxFileSizeBytes, db,
+				cfg.AbsBasePath, *cfg.MaxFileSizeBytes, db, provider,
 				cfg.ThumbnailSizes, activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
 			)
@@ -619,6 +649,7 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
 	db storage.Database,
+	provider storageprovider.Provider,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -629,6 +660,12 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	if err != nil {
 		return err
 	}
+	if !duplicate {
+		if err = storageprovider.StoreFile(ctx, provider, absBasePath, finalPath); err != nil {
+			fileutils.RemoveDir(types.Path(filepath.Dir(string(finalPath))), r.Logger)
+			return fmt.Errorf("storageprovider.StoreFile: %w", err)
+		}
+	}
 
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
@@ -662,6 +699,7 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		if busy {
 			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
 		}
+		storeThumbnails(context.Background(), provider, absBasePath, db, r.MediaMetadata, finalPath, r.Logger)
 	}()
 
 	r.Logger.WithFields(log.Fields{
@@ -817,3 +855,30 @@ func (r *downloadRequest) createRemoteRequest(
 
 	return resp, nil
 }
+
+// storeThumbnails copies the thumbnails of the media to the storage provider
+// once they have been generated.
+func storeThumbnails(
+	ctx context.Context,
+	provider storageprovider.Provider,
+	absBasePath config.Path,
+	db storage.Database,
+	mediaMetadata *types.MediaMetadata,
+	filePath types.Path,
+	logger *log.Entry,
+) {
+	if provider == nil {
+		return
+	}
+	thumbnails, err := db.GetThumbnails(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		logger.WithError(err).Warn("Error getting thumbnails to store")
+		return
+	}
+	for _, thumbnail := range thumbnails {
+		thumbPath := thumbnailer.GetThumbnailPath(filePath, thumbnail.ThumbnailSize)
+		if err = storageprovider.StoreFile(ctx, provider, absBasePath, thumbPath); err != nil {
+			logger.WithError(err).WithField("thumbnail", thumbPath).Warn("Error storing thumbnail in storage provider")
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package routing
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func Test_downloadRequest_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     types.ThumbnailSize
+		wantCode int
+	}{
+		{"ok", types.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: types.Crop}, 0},
+		{"at maximum", types.ThumbnailSize{Width: 640, Height: 640}, 0},
+		{"too wide", types.ThumbnailSize{Width: 641, Height: 96}, http.StatusBadRequest},
+		{"too high", types.ThumbnailSize{Width: 96, Height: 641}, http.StatusBadRequest},
+		{"zero", types.ThumbnailSize{Width: 0, Height: 96}, http.StatusBadRequest},
+		{"bad method", types.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: "stretch"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &downloadRequest{
+				MediaMetadata: &types.MediaMetadata{
+					MediaID: "1337",
+					Origin:  "localhost",
+				},
+				IsThumbnailRequest: true,
+				ThumbnailSize:      tt.size,
+			}
+			resErr := r.Validate(640)
+			switch {
+			case tt.wantCode == 0 && resErr != nil:
+				t.Errorf("Validate() = %+v, want nil", resErr)
+			case tt.wantCode != 0 && (resErr == nil || resErr.Code != tt.wantCode):
+				t.Errorf("Validate() = %+v, want code %d", resErr, tt.wantCode)
+			}
+		})
+	}
+}
@@ -22,7 +22,9 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/storageprovider"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -30,6 +32,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 // Setup registers the media API HTTP handlers
@@ -51,10 +54,20 @@ func Setup(
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
 	}
 
+	provider, err := storageprovider.New(&cfg.StorageProvider)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to set up media storage provider")
+	}
+
+	spamChecker, err := spamcheck.New(&cfg.Matrix.SpamChecker)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to set up spam checker")
+	}
+
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			return Upload(req, cfg, dev, db, provider, activeThumbnailGeneration, spamChecker)
 		},
 	)
 
@@ -65,21 +78,32 @@ func Setup(
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration)
+	downloadHandler := makeDownloadAPI("download", cfg, db, provider, client, activeRemoteRequests, activeThumbnailGeneration)
 	r0mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v1mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)                // TODO: remove when synapse is fixed
 	v1mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions) // TODO: remove when synapse is fixed
 
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", cfg, db, provider, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.URLPreviews.Enabled {
+		previewer, err := newURLPreviewer(cfg, db, provider, activeThumbnailGeneration)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up URL previews")
+		}
+		r0mux.Handle("/preview_url", httputil.MakeAuthAPI(
+			"preview_url", userAPI, previewer.PreviewURL,
+		)).Methods(http.MethodGet, http.MethodOptions)
+	}
 }
 
 func makeDownloadAPI(
 	name string,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	provider storageprovider.Provider,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -119,6 +143,7 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			provider,
 			client,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
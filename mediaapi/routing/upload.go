@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -26,8 +27,10 @@ import (
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/storageprovider"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -56,13 +59,30 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, provider storageprovider.Provider, activeThumbnailGeneration *types.ActiveThumbnailGeneration, spamChecker spamcheck.Checker) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if err := spamChecker.CheckMediaUpload(req.Context(), &spamcheck.MediaUploadRequest{
+		UserID:      dev.UserID,
+		ContentType: string(r.MediaMetadata.ContentType),
+		Filename:    req.FormValue("filename"),
+		Size:        int64(r.MediaMetadata.FileSizeBytes),
+	}); err != nil {
+		var rejected *spamcheck.RejectedError
+		if !errors.As(err, &rejected) {
+			r.Logger.WithError(err).Error("spam check failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(rejected.Reason),
+		}
+	}
+
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, provider, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
@@ -128,6 +148,7 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	provider storageprovider.Provider,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -230,7 +251,7 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, cfg.AbsBasePath, db, provider, cfg.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
@@ -280,6 +301,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 	tmpDir types.Path,
 	absBasePath config.Path,
 	db storage.Database,
+	provider storageprovider.Provider,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -294,6 +316,13 @@ func (r *uploadRequest) storeFileAndMetadata(
 	}
 	if duplicate {
 		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+	} else if err = storageprovider.StoreFile(ctx, provider, absBasePath, finalPath); err != nil {
+		r.Logger.WithError(err).Error("Failed to store file in storage provider")
+		fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Failed to upload"),
+		}
 	}
 
 	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
@@ -321,6 +350,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		if busy {
 			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
 		}
+		storeThumbnails(context.Background(), provider, absBasePath, db, r.MediaMetadata, finalPath, r.Logger)
 	}()
 
 	return nil
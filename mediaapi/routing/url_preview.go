@@ -0,0 +1,371 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register the gif decoder for image sizes.
+	_ "image/jpeg" // Register the jpeg decoder for image sizes.
+	_ "image/png"  // Register the png decoder for image sizes.
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/storageprovider"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	"golang.org/x/net/html"
+)
+
+// maxURLPreviewRedirects is the number of redirects that are followed when
+// fetching a page or image to preview.
+const maxURLPreviewRedirects = 10
+
+// urlPreviewer generates the OpenGraph previews of URLs for /preview_url.
+// Images are stored in the media repository, so that clients don't have to
+// fetch them from the site themselves.
+type urlPreviewer struct {
+	cfg                       *config.MediaAPI
+	db                        storage.Database
+	provider                  storageprovider.Provider
+	client                    *http.Client
+	allowlist                 []*regexp.Regexp
+	denylist                  []*regexp.Regexp
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration
+}
+
+func newURLPreviewer(
+	cfg *config.MediaAPI, db storage.Database, provider storageprovider.Provider,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) (*urlPreviewer, error) {
+	allowlist, err := config.CompileURLPatterns(cfg.URLPreviews.URLAllowlist)
+	if err != nil {
+		return nil, err
+	}
+	denylist, err := config.CompileURLPatterns(cfg.URLPreviews.URLDenylist)
+	if err != nil {
+		return nil, err
+	}
+	ipDenylist, err := config.ParseIPRanges(cfg.URLPreviews.IPRangeDenylist)
+	if err != nil {
+		return nil, err
+	}
+	p := &urlPreviewer{
+		cfg:                       cfg,
+		db:                        db,
+		provider:                  provider,
+		allowlist:                 allowlist,
+		denylist:                  denylist,
+		activeThumbnailGeneration: activeThumbnailGeneration,
+	}
+	// The IP address is checked when connecting, rather than when resolving
+	// the host name, so that DNS can't be used to get around the denylist.
+	dialer := &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q", host)
+			}
+			for _, ipNet := range ipDenylist {
+				if ipNet.Contains(ip) {
+					return fmt.Errorf("IP address %s is denied", ip)
+				}
+			}
+			return nil
+		},
+	}
+	p.client = &http.Client{
+		Timeout: time.Duration(cfg.URLPreviews.TimeoutMS) * time.Millisecond,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxURLPreviewRedirects {
+				return errors.New("too many redirects")
+			}
+			if !p.allowed(req.URL) {
+				return fmt.Errorf("redirected to %s which can't be previewed", req.URL)
+			}
+			return nil
+		},
+	}
+	return p, nil
+}
+
+// allowed returns true if the URL is an http or https URL which is allowed
+// by the URL allowlist and denylist.
+func (p *urlPreviewer) allowed(u *url.URL) bool {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	s := u.String()
+	for _, re := range p.denylist {
+		if re.MatchString(s) {
+			return false
+		}
+	}
+	if len(p.allowlist) == 0 {
+		return true
+	}
+	for _, re := range p.allowlist {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PreviewURL implements GET /preview_url
+// Previews are cached, so the ts parameter is ignored and the latest
+// preview is always returned.
+func (p *urlPreviewer) PreviewURL(req *http.Request, dev *userapi.Device) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx)
+	pageURL := req.URL.Query().Get("url")
+	if pageURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing url parameter"),
+		}
+	}
+	u, err := url.Parse(pageURL)
+	if err != nil || !u.IsAbs() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid url parameter"),
+		}
+	}
+	if !p.allowed(u) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This URL can't be previewed"),
+		}
+	}
+
+	previewJSON, creationTS, err := p.db.GetURLPreview(ctx, u.String())
+	if err != nil {
+		logger.WithError(err).Error("p.db.GetURLPreview failed")
+		return jsonerror.InternalServerError()
+	}
+	now := types.UnixMs(time.Now().UnixNano() / int64(time.Millisecond))
+	if previewJSON != nil && int64(now-creationTS) < p.cfg.URLPreviews.CacheLifetimeMS {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: json.RawMessage(previewJSON),
+		}
+	}
+
+	preview, err := p.generatePreview(ctx, u, dev)
+	if err != nil {
+		logger.WithError(err).WithField("url", u.String()).Warn("Failed to preview URL")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to preview URL"),
+		}
+	}
+	previewJSON, err = json.Marshal(preview)
+	if err != nil {
+		logger.WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = p.db.StoreURLPreview(ctx, u.String(), previewJSON, now); err != nil {
+		// The preview can still be returned, it just won't be cached.
+		logger.WithError(err).Error("p.db.StoreURLPreview failed")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: json.RawMessage(previewJSON),
+	}
+}
+
+// generatePreview fetches the URL and returns its OpenGraph properties. An
+// image is previewed as itself.
+func (p *urlPreviewer) generatePreview(ctx context.Context, u *url.URL, dev *userapi.Device) (map[string]interface{}, error) {
+	body, mediaType, err := p.fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	preview := make(map[string]interface{})
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		if err = p.storeImage(ctx, preview, body, mediaType, u, dev); err != nil {
+			return nil, err
+		}
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		og := parseOpenGraph(body)
+		for property, content := range og {
+			if property != "og:image" {
+				preview[property] = content
+			}
+		}
+		if og["og:image"] == "" {
+			break
+		}
+		// Images that can't be fetched are left out rather than failing
+		// the whole preview.
+		imageURL, err := u.Parse(og["og:image"])
+		if err != nil || !p.allowed(imageURL) {
+			break
+		}
+		imageBody, imageType, err := p.fetch(ctx, imageURL)
+		if err != nil || !strings.HasPrefix(imageType, "image/") {
+			break
+		}
+		if err = p.storeImage(ctx, preview, imageBody, imageType, imageURL, dev); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("url", imageURL.String()).Warn("Failed to store URL preview image")
+		}
+	default:
+		return nil, fmt.Errorf("can't preview content type %q", mediaType)
+	}
+	return preview, nil
+}
+
+// fetch returns the body of the URL and its media type. Fails if the body
+// is larger than the maximum page size.
+func (p *urlPreviewer) fetch(ctx context.Context, u *url.URL) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "text/html, application/xhtml+xml, image/*")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("got HTTP status %d", res.StatusCode)
+	}
+	maxSize := int64(p.cfg.URLPreviews.MaxPageSizeBytes)
+	if res.ContentLength > maxSize {
+		return nil, "", fmt.Errorf("content length %d is larger than the maximum of %d", res.ContentLength, maxSize)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, "", fmt.Errorf("body is larger than the maximum of %d", maxSize)
+	}
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = http.DetectContentType(body)
+		mediaType, _, _ = mime.ParseMediaType(mediaType)
+	}
+	return body, mediaType, nil
+}
+
+// storeImage stores the image in the media repository, as if the user had
+// uploaded it, and adds it to the preview.
+func (p *urlPreviewer) storeImage(
+	ctx context.Context, preview map[string]interface{}, body []byte, mediaType string, u *url.URL, dev *userapi.Device,
+) error {
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        p.cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(len(body)),
+			ContentType:   types.ContentType(mediaType),
+			UploadName:    types.Filename(url.PathEscape(path.Base(u.Path))),
+			UserID:        types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(ctx).WithField("Origin", p.cfg.Matrix.ServerName),
+	}
+	if resErr := r.Validate(*p.cfg.MaxFileSizeBytes); resErr != nil {
+		return fmt.Errorf("image is not valid: %v", resErr.JSON)
+	}
+	if resErr := r.doUpload(ctx, bytes.NewReader(body), p.cfg, p.db, p.provider, p.activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("failed to store image: %v", resErr.JSON)
+	}
+	preview["og:image"] = fmt.Sprintf("mxc://%s/%s", p.cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	preview["og:image:type"] = mediaType
+	preview["matrix:image:size"] = r.MediaMetadata.FileSizeBytes
+	if imageConfig, _, err := image.DecodeConfig(bytes.NewReader(body)); err == nil {
+		preview["og:image:width"] = imageConfig.Width
+		preview["og:image:height"] = imageConfig.Height
+	}
+	return nil
+}
+
+// parseOpenGraph returns the OpenGraph properties in the meta tags of the
+// page. The title and description are taken from the title tag and the
+// description meta tag if the page doesn't have OpenGraph ones.
+func parseOpenGraph(body []byte) map[string]string {
+	og := make(map[string]string)
+	var title, description string
+	inTitle := false
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if og["og:title"] == "" && title != "" {
+				og["og:title"] = title
+			}
+			if og["og:description"] == "" && description != "" {
+				og["og:description"] = description
+			}
+			return og
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				var property, name, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property":
+						property = attr.Val
+					case "name":
+						name = attr.Val
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				if strings.HasPrefix(property, "og:") && og[property] == "" {
+					og[property] = content
+				} else if name == "description" {
+					description = content
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+}
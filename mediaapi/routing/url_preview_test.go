@@ -0,0 +1,193 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+const testPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Kaer Morhen</title>
+	<meta name="description" content="A witcher keep">
+	<meta property="og:title" content=" The keep of the wolf school ">
+	<meta property="og:image" content="/keep.png">
+</head>
+<body><title>Not the title</title></body>
+</html>`
+
+func TestParseOpenGraph(t *testing.T) {
+	og := parseOpenGraph([]byte(testPage))
+	want := map[string]string{
+		"og:title":       "The keep of the wolf school",
+		"og:description": "A witcher keep",
+		"og:image":       "/keep.png",
+	}
+	if len(og) != len(want) {
+		t.Errorf("got %v, want %v", og, want)
+	}
+	for property, content := range want {
+		if og[property] != content {
+			t.Errorf("got %q for %s, want %q", og[property], property, content)
+		}
+	}
+
+	og = parseOpenGraph([]byte(`<html><head><title>Novigrad</title></head></html>`))
+	if og["og:title"] != "Novigrad" {
+		t.Errorf("got title %q, want the title tag", og["og:title"])
+	}
+}
+
+func mustCreateURLPreviewer(t *testing.T, ipRangeDenylist []string) (*urlPreviewer, func()) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current working directory: %v", err)
+	}
+	testdataPath := filepath.Join(wd, "./testdata_url_preview")
+	_ = os.Mkdir(testdataPath, os.ModePerm)
+
+	maxSize := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{ServerName: "kaer.morhen"},
+		MaxFileSizeBytes: &maxSize,
+		BasePath:         config.Path(testdataPath),
+		AbsBasePath:      config.Path(testdataPath),
+	}
+	cfg.URLPreviews.Defaults()
+	cfg.URLPreviews.Enabled = true
+	cfg.URLPreviews.MaxPageSizeBytes = maxSize
+	cfg.URLPreviews.IPRangeDenylist = ipRangeDenylist
+	cfg.URLPreviews.URLDenylist = []string{`.*/denied`}
+
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString:       "file::memory:?cache=shared",
+		MaxOpenConnections:     100,
+		MaxIdleConnections:     2,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+	p, err := newURLPreviewer(cfg, db, nil, &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	})
+	if err != nil {
+		t.Fatalf("failed to create URL previewer: %v", err)
+	}
+	return p, func() { fileutils.RemoveDir(types.Path(testdataPath), nil) }
+}
+
+func previewURL(t *testing.T, p *urlPreviewer, pageURL string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/preview_url?url="+url.QueryEscape(pageURL), nil)
+	res := p.PreviewURL(req, &userapi.Device{UserID: "@geralt:kaer.morhen"})
+	preview := make(map[string]interface{})
+	if raw, ok := res.JSON.(json.RawMessage); ok {
+		if err := json.Unmarshal(raw, &preview); err != nil {
+			t.Fatalf("failed to unmarshal preview: %v", err)
+		}
+	}
+	return res.Code, preview
+}
+
+func TestPreviewURL(t *testing.T) {
+	var imageBody bytes.Buffer
+	if err := png.Encode(&imageBody, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/keep":
+			fetches++
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(testPage))
+		case "/keep.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(imageBody.Bytes())
+		case "/large":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(strings.Repeat("a", 2*1024*1024)))
+		case "/redirect":
+			http.Redirect(w, req, "/denied", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p, cleanup := mustCreateURLPreviewer(t, []string{})
+	defer cleanup()
+
+	code, preview := previewURL(t, p, srv.URL+"/keep")
+	if code != http.StatusOK {
+		t.Fatalf("got code %d, want %d", code, http.StatusOK)
+	}
+	if preview["og:title"] != "The keep of the wolf school" {
+		t.Errorf("got title %v", preview["og:title"])
+	}
+	if imageURL, _ := preview["og:image"].(string); !strings.HasPrefix(imageURL, "mxc://kaer.morhen/") {
+		t.Errorf("got image %v, want an mxc URL", preview["og:image"])
+	}
+	if preview["og:image:width"] != float64(4) || preview["og:image:height"] != float64(3) {
+		t.Errorf("got image size %vx%v, want 4x3", preview["og:image:width"], preview["og:image:height"])
+	}
+	if preview["matrix:image:size"] != float64(imageBody.Len()) {
+		t.Errorf("got image file size %v, want %d", preview["matrix:image:size"], imageBody.Len())
+	}
+
+	// The second preview comes from the cache.
+	if code, _ = previewURL(t, p, srv.URL+"/keep"); code != http.StatusOK || fetches != 1 {
+		t.Errorf("got code %d after %d fetches, want the cached preview", code, fetches)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{"not found", srv.URL + "/missing", http.StatusBadGateway},
+		{"too large", srv.URL + "/large", http.StatusBadGateway},
+		{"denied URL", srv.URL + "/denied", http.StatusForbidden},
+		{"redirect to denied URL", srv.URL + "/redirect", http.StatusBadGateway},
+		{"not http", "ftp://kaer.morhen/keep", http.StatusForbidden},
+		{"relative", "/keep", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := previewURL(t, p, tt.url); code != tt.wantCode {
+				t.Errorf("got code %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPreviewURLDeniedIPRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("the server in a denied IP range was requested")
+	}))
+	defer srv.Close()
+
+	p, cleanup := mustCreateURLPreviewer(t, config.DefaultURLPreviewIPRangeDenylist)
+	defer cleanup()
+
+	if code, _ := previewURL(t, p, srv.URL+"/keep"); code != http.StatusBadGateway {
+		t.Errorf("got code %d, want %d", code, http.StatusBadGateway)
+	}
+}
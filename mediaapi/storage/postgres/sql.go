@@ -20,8 +20,9 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media      mediaStatements
+	thumbnail  thumbnailStatements
+	urlPreview urlPreviewStatements
 }
 
 func (s *statements) prepare(db *sql.DB) (err error) {
@@ -31,6 +32,9 @@ func (s *statements) prepare(db *sql.DB) (err error) {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return
 	}
+	if err = s.urlPreview.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
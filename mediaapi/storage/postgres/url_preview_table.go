@@ -0,0 +1,76 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const urlPreviewSchema = `
+-- The mediaapi_url_preview table caches the previews generated by /preview_url,
+-- so that the same page isn't fetched again every time that someone sends it.
+CREATE TABLE IF NOT EXISTS mediaapi_url_preview (
+    -- The URL which was previewed.
+    url TEXT NOT NULL PRIMARY KEY,
+    -- The preview as returned to clients, with any image already stored in the media repository.
+    preview_json TEXT NOT NULL,
+    -- When the preview was generated in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL
+);
+`
+
+const upsertURLPreviewSQL = `
+INSERT INTO mediaapi_url_preview (url, preview_json, creation_ts) VALUES ($1, $2, $3)
+  ON CONFLICT (url) DO UPDATE SET preview_json = $2, creation_ts = $3
+`
+
+const selectURLPreviewSQL = `
+SELECT preview_json, creation_ts FROM mediaapi_url_preview WHERE url = $1
+`
+
+type urlPreviewStatements struct {
+	upsertURLPreviewStmt *sql.Stmt
+	selectURLPreviewStmt *sql.Stmt
+}
+
+func (s *urlPreviewStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(urlPreviewSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertURLPreviewStmt, upsertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+	}.prepare(db)
+}
+
+func (s *urlPreviewStatements) upsertURLPreview(
+	ctx context.Context, url string, previewJSON []byte, creationTS types.UnixMs,
+) error {
+	_, err := s.upsertURLPreviewStmt.ExecContext(ctx, url, string(previewJSON), creationTS)
+	return err
+}
+
+func (s *urlPreviewStatements) selectURLPreview(
+	ctx context.Context, url string,
+) (previewJSON []byte, creationTS types.UnixMs, err error) {
+	var preview string
+	err = s.selectURLPreviewStmt.QueryRowContext(ctx, url).Scan(&preview, &creationTS)
+	return []byte(preview), creationTS, err
+}
@@ -22,8 +22,9 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media      mediaStatements
+	thumbnail  thumbnailStatements
+	urlPreview urlPreviewStatements
 }
 
 func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -33,6 +34,9 @@ func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
 	if err = s.thumbnail.prepare(db, writer); err != nil {
 		return
 	}
+	if err = s.urlPreview.prepare(db, writer); err != nil {
+		return
+	}
 
 	return
 }
@@ -28,6 +28,7 @@ import (
 
 // Database is used to store metadata about a repository of media files.
 type Database struct {
+	sqlutil.PartitionOffsetStatements
 	statements statements
 	db         *sql.DB
 	writer     sqlutil.Writer
@@ -45,6 +46,9 @@ func Open(dbProperties *config.DatabaseOptions) (*Database, error) {
 	if err = d.statements.prepare(d.db, d.writer); err != nil {
 		return nil, err
 	}
+	if err = d.PartitionOffsetStatements.Prepare(d.db, d.writer, "mediaapi"); err != nil {
+		return nil, err
+	}
 	return &d, nil
 }
 
@@ -121,3 +125,42 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// StoreURLPreview stores the preview of a URL, replacing any older preview
+// of it.
+func (d *Database) StoreURLPreview(
+	ctx context.Context, url string, previewJSON []byte, creationTS types.UnixMs,
+) error {
+	return d.statements.urlPreview.upsertURLPreview(ctx, url, previewJSON, creationTS)
+}
+
+// GetURLPreview returns the stored preview of a URL and when it was made.
+// Returns a nil preview if the URL hasn't been previewed.
+func (d *Database) GetURLPreview(
+	ctx context.Context, url string,
+) ([]byte, types.UnixMs, error) {
+	previewJSON, creationTS, err := d.statements.urlPreview.selectURLPreview(ctx, url)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+	return previewJSON, creationTS, err
+}
+
+// DeleteMedia removes the metadata about the media and its thumbnails. The
+// files themselves are left for the caller to remove.
+func (d *Database) DeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	if err := d.statements.thumbnail.deleteThumbnails(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	return d.statements.media.deleteMedia(ctx, mediaID, mediaOrigin)
+}
+
+// CountMediaByHash returns how much media from any origin is stored in the
+// file with the given hash.
+func (d *Database) CountMediaByHash(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (int, error) {
+	return d.statements.media.selectMediaCountByHash(ctx, mediaHash)
+}
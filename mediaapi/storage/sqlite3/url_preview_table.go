@@ -0,0 +1,81 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const urlPreviewSchema = `
+-- The mediaapi_url_preview table caches the previews generated by /preview_url,
+-- so that the same page isn't fetched again every time that someone sends it.
+CREATE TABLE IF NOT EXISTS mediaapi_url_preview (
+    url TEXT NOT NULL PRIMARY KEY,
+    preview_json TEXT NOT NULL,
+    creation_ts INTEGER NOT NULL
+);
+`
+
+const upsertURLPreviewSQL = `
+INSERT INTO mediaapi_url_preview (url, preview_json, creation_ts) VALUES ($1, $2, $3)
+  ON CONFLICT (url) DO UPDATE SET preview_json = $2, creation_ts = $3
+`
+
+const selectURLPreviewSQL = `
+SELECT preview_json, creation_ts FROM mediaapi_url_preview WHERE url = $1
+`
+
+type urlPreviewStatements struct {
+	db                   *sql.DB
+	writer               sqlutil.Writer
+	upsertURLPreviewStmt *sql.Stmt
+	selectURLPreviewStmt *sql.Stmt
+}
+
+func (s *urlPreviewStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
+	_, err = db.Exec(urlPreviewSchema)
+	if err != nil {
+		return
+	}
+	s.db = db
+	s.writer = writer
+
+	return statementList{
+		{&s.upsertURLPreviewStmt, upsertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+	}.prepare(db)
+}
+
+func (s *urlPreviewStatements) upsertURLPreview(
+	ctx context.Context, url string, previewJSON []byte, creationTS types.UnixMs,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.upsertURLPreviewStmt)
+		_, err := stmt.ExecContext(ctx, url, string(previewJSON), creationTS)
+		return err
+	})
+}
+
+func (s *urlPreviewStatements) selectURLPreview(
+	ctx context.Context, url string,
+) (previewJSON []byte, creationTS types.UnixMs, err error) {
+	var preview string
+	err = s.selectURLPreviewStmt.QueryRowContext(ctx, url).Scan(&preview, &creationTS)
+	return []byte(preview), creationTS, err
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storageprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ErrNotFound is returned by Provider.Fetch if the file isn't stored.
+var ErrNotFound = errors.New("file not found in storage provider")
+
+// Provider stores media files somewhere other than the local media store,
+// e.g. in object storage shared by several media API instances. Files are
+// named by their slash-separated path relative to the local media store,
+// which is used as a cache of them.
+type Provider interface {
+	// Store streams the size bytes from the reader into the file, replacing
+	// it if it already exists.
+	Store(ctx context.Context, path string, r io.Reader, size int64) error
+	// Fetch returns a reader for the file which must be closed, or
+	// ErrNotFound if the file isn't stored.
+	Fetch(ctx context.Context, path string) (io.ReadCloser, error)
+}
+
+// New returns the configured storage provider, or nil if media files are
+// only stored in the local media store.
+func New(cfg *config.MediaStorageProvider) (Provider, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "s3":
+		return NewS3(&cfg.S3, http.DefaultClient)
+	default:
+		return nil, fmt.Errorf("unknown storage provider type %q", cfg.Type)
+	}
+}
+
+// StoreFile copies a file in the local media store to the storage provider.
+// It does nothing if the provider is nil.
+func StoreFile(ctx context.Context, p Provider, absBasePath config.Path, filePath types.Path) error {
+	if p == nil {
+		return nil
+	}
+	path, err := relativePath(absBasePath, filePath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(string(filePath))
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("file.Stat: %w", err)
+	}
+	if err = p.Store(ctx, path, file, stat.Size()); err != nil {
+		return fmt.Errorf("p.Store: %w", err)
+	}
+	return nil
+}
+
+// FetchFileIfMissing copies a file from the storage provider into the local
+// media store if it isn't there, e.g. because it was stored by another
+// instance or the local cache was cleared. It does nothing if the provider
+// is nil.
+func FetchFileIfMissing(ctx context.Context, p Provider, absBasePath config.Path, filePath types.Path) error {
+	if p == nil {
+		return nil
+	}
+	if _, err := os.Stat(string(filePath)); !os.IsNotExist(err) {
+		return nil
+	}
+	path, err := relativePath(absBasePath, filePath)
+	if err != nil {
+		return err
+	}
+	body, err := p.Fetch(ctx, path)
+	if err != nil {
+		return fmt.Errorf("p.Fetch: %w", err)
+	}
+	defer body.Close() // nolint: errcheck
+
+	// Write to a temporary file first so that other requests never see a
+	// partially fetched file.
+	dir := filepath.Dir(string(filePath))
+	if err = os.MkdirAll(dir, 0770); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".fetch-")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %w", err)
+	}
+	defer os.Remove(tmpFile.Name()) // nolint: errcheck
+	if _, err = io.Copy(tmpFile, body); err != nil {
+		tmpFile.Close() // nolint: errcheck
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("tmpFile.Close: %w", err)
+	}
+	if err = os.Rename(tmpFile.Name(), string(filePath)); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+func relativePath(absBasePath config.Path, filePath types.Path) (string, error) {
+	path, err := filepath.Rel(string(absBasePath), string(filePath))
+	if err != nil {
+		return "", fmt.Errorf("filepath.Rel: %w", err)
+	}
+	return filepath.ToSlash(path), nil
+}
@@ -0,0 +1,135 @@
+package thumbnailer
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+func mustCreateImage(t *testing.T, dir string, width, height int) types.Path {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	src := filepath.Join(dir, "file")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatalf("failed to create image file: %s", err)
+	}
+	defer f.Close() // nolint: errcheck
+	if err = png.Encode(f, img); err != nil {
+		t.Fatalf("failed to encode image: %s", err)
+	}
+	return types.Path(src)
+}
+
+func mustOpenDatabase(t *testing.T, dir string) storage.Database {
+	t.Helper()
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(dir, "mediaapi.db")),
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open mediaapi database: %s", err)
+	}
+	return db
+}
+
+func newActiveThumbnailGeneration() *types.ActiveThumbnailGeneration {
+	return &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+}
+
+func TestGenerateThumbnailsPreGeneratesConfiguredSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	src := mustCreateImage(t, dir, 200, 150)
+	db := mustOpenDatabase(t, dir)
+	metadata := &types.MediaMetadata{MediaID: "media", Origin: "localhost"}
+	sizes := []config.ThumbnailSize{
+		{Width: 32, Height: 32, ResizeMethod: types.Crop},
+		{Width: 96, Height: 96, ResizeMethod: types.Scale},
+	}
+
+	busy, err := GenerateThumbnails(
+		context.Background(), src, sizes, metadata, newActiveThumbnailGeneration(), 10, db, log.WithField("test", t.Name()),
+	)
+	if err != nil || busy {
+		t.Fatalf("GenerateThumbnails: busy=%v err=%v", busy, err)
+	}
+	for _, size := range sizes {
+		thumbnail, err := db.GetThumbnail(context.Background(), metadata.MediaID, metadata.Origin, size.Width, size.Height, size.ResizeMethod)
+		if err != nil {
+			t.Fatalf("failed to get thumbnail: %s", err)
+		}
+		if thumbnail == nil {
+			t.Errorf("expected thumbnail %+v to be pre-generated", size)
+			continue
+		}
+		if _, err = os.Stat(string(GetThumbnailPath(src, types.ThumbnailSize(size)))); err != nil {
+			t.Errorf("expected thumbnail file for %+v: %s", size, err)
+		}
+	}
+}
+
+func TestGenerateThumbnailCachesArbitrarySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	src := mustCreateImage(t, dir, 200, 150)
+	db := mustOpenDatabase(t, dir)
+	metadata := &types.MediaMetadata{MediaID: "media", Origin: "localhost"}
+	size := types.ThumbnailSize{Width: 50, Height: 40, ResizeMethod: types.Scale}
+	active := newActiveThumbnailGeneration()
+	logger := log.WithField("test", t.Name())
+
+	if _, err = GenerateThumbnail(context.Background(), src, size, metadata, active, 10, db, logger); err != nil {
+		t.Fatalf("GenerateThumbnail: %s", err)
+	}
+	thumbnail, err := db.GetThumbnail(context.Background(), metadata.MediaID, metadata.Origin, size.Width, size.Height, size.ResizeMethod)
+	if err != nil || thumbnail == nil {
+		t.Fatalf("expected thumbnail to be cached after first request, got %v (err=%v)", thumbnail, err)
+	}
+	dst := string(GetThumbnailPath(src, size))
+	before, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("expected thumbnail file: %s", err)
+	}
+
+	// A second request for the same size should use the cached thumbnail.
+	if err = os.Chtimes(dst, before.ModTime().Add(-time.Hour), before.ModTime().Add(-time.Hour)); err != nil {
+		t.Fatalf("failed to change thumbnail file times: %s", err)
+	}
+	if _, err = GenerateThumbnail(context.Background(), src, size, metadata, active, 10, db, logger); err != nil {
+		t.Fatalf("GenerateThumbnail: %s", err)
+	}
+	after, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("expected thumbnail file: %s", err)
+	}
+	if !after.ModTime().Equal(before.ModTime().Add(-time.Hour)) {
+		t.Errorf("expected cached thumbnail not to be regenerated")
+	}
+}
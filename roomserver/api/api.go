@@ -14,6 +14,10 @@ type RoomserverInternalAPI interface {
 	SetFederationSenderAPI(fsAPI fsAPI.FederationSenderInternalAPI)
 	SetAppserviceAPI(asAPI asAPI.AppServiceQueryAPI)
 
+	// Ready returns whether the roomserver has finished initialising and is
+	// ready to handle requests.
+	Ready(ctx context.Context) bool
+
 	InputRoomEvents(
 		ctx context.Context,
 		request *InputRoomEventsRequest,
@@ -117,6 +121,20 @@ type RoomserverInternalAPI interface {
 		response *QueryServerJoinedToRoomResponse,
 	) error
 
+	// Query which servers have joined members in a room.
+	QueryServersInRoom(
+		ctx context.Context,
+		request *QueryServersInRoomRequest,
+		response *QueryServersInRoomResponse,
+	) error
+
+	// Query a single event from the current state of a room.
+	QuerySingleStateEvent(
+		ctx context.Context,
+		request *QuerySingleStateEventRequest,
+		response *QuerySingleStateEventResponse,
+	) error
+
 	// Query whether a server is allowed to see an event
 	QueryServerAllowedToSeeEvent(
 		ctx context.Context,
@@ -158,7 +176,7 @@ type RoomserverInternalAPI interface {
 	QueryBulkStateContent(ctx context.Context, req *QueryBulkStateContentRequest, res *QueryBulkStateContentResponse) error
 	// QuerySharedUsers returns a list of users who share at least 1 room in common with the given user.
 	QuerySharedUsers(ctx context.Context, req *QuerySharedUsersRequest, res *QuerySharedUsersResponse) error
-	// QueryKnownUsers returns a list of users that we know about from our joined rooms.
+	// QueryKnownUsers searches the user directory for users that we know about from our joined rooms.
 	QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
 	QueryServerBannedFromRoom(ctx context.Context, req *QueryServerBannedFromRoomRequest, res *QueryServerBannedFromRoomResponse) error
@@ -173,6 +191,16 @@ type RoomserverInternalAPI interface {
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
 
+	// PerformScheduleRoomEviction tells the roomserver that a room may no
+	// longer have any local users in it, e.g. because a user has just left.
+	// If none of the local users are joined, invited or knocking then the
+	// room is evicted from the caches in the background.
+	PerformScheduleRoomEviction(
+		ctx context.Context,
+		req *PerformScheduleRoomEvictionRequest,
+		res *PerformScheduleRoomEvictionResponse,
+	) error
+
 	// Asks for the default room version as preferred by the server.
 	QueryRoomVersionCapabilities(
 		ctx context.Context,
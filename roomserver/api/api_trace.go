@@ -24,6 +24,12 @@ func (t *RoomserverInternalAPITrace) SetAppserviceAPI(asAPI asAPI.AppServiceQuer
 	t.Impl.SetAppserviceAPI(asAPI)
 }
 
+func (t *RoomserverInternalAPITrace) Ready(ctx context.Context) bool {
+	ready := t.Impl.Ready(ctx)
+	util.GetLogger(ctx).Infof("Ready ready=%v", ready)
+	return ready
+}
+
 func (t *RoomserverInternalAPITrace) InputRoomEvents(
 	ctx context.Context,
 	req *InputRoomEventsRequest,
@@ -178,6 +184,26 @@ func (t *RoomserverInternalAPITrace) QueryServerJoinedToRoom(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryServersInRoom(
+	ctx context.Context,
+	req *QueryServersInRoomRequest,
+	res *QueryServersInRoomResponse,
+) error {
+	err := t.Impl.QueryServersInRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryServersInRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QuerySingleStateEvent(
+	ctx context.Context,
+	req *QuerySingleStateEventRequest,
+	res *QuerySingleStateEventResponse,
+) error {
+	err := t.Impl.QuerySingleStateEvent(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QuerySingleStateEvent req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
 	req *QueryServerAllowedToSeeEventRequest,
@@ -228,6 +254,16 @@ func (t *RoomserverInternalAPITrace) PerformForget(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) PerformScheduleRoomEviction(
+	ctx context.Context,
+	req *PerformScheduleRoomEvictionRequest,
+	res *PerformScheduleRoomEvictionResponse,
+) error {
+	err := t.Impl.PerformScheduleRoomEviction(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformScheduleRoomEviction req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryRoomVersionCapabilities(
 	ctx context.Context,
 	req *QueryRoomVersionCapabilitiesRequest,
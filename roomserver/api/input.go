@@ -92,6 +92,10 @@ type InputRoomEventsRequest struct {
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	// Transient is true if the error was temporary, e.g. the database was
+	// busy or the roomserver couldn't be reached, so the input may succeed
+	// if it is retried.
+	Transient bool
 }
 
 func (r *InputRoomEventsResponse) Err() error {
@@ -55,6 +55,8 @@ const (
 	OutputTypeNewInboundPeek OutputType = "new_inbound_peek"
 	// OutputTypeRetirePeek indicates that the kafka event is an OutputRetirePeek
 	OutputTypeRetirePeek OutputType = "retire_peek"
+	// OutputTypePurgedEvents indicates that the kafka event is an OutputPurgedEvents
+	OutputTypePurgedEvents OutputType = "purged_events"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -78,6 +80,8 @@ type OutputEvent struct {
 	NewInboundPeek *OutputNewInboundPeek `json:"new_inbound_peek,omitempty"`
 	// The content of event with type OutputTypeRetirePeek
 	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
+	// The content of event with type OutputTypePurgedEvents
+	PurgedEvents *OutputPurgedEvents `json:"purged_events,omitempty"`
 }
 
 // Type of the OutputNewRoomEvent.
@@ -168,6 +172,32 @@ type OutputNewRoomEvent struct {
 	// The transaction ID of the send request if sent by a local user and one
 	// was specified
 	TransactionID *TransactionID `json:"transaction_id"`
+	// Set if the event is an m.room.member event which is now part of the
+	// current state of the room, so that consumers can tell how the user's
+	// membership changed without looking up their previous membership.
+	MembershipChange *OutputMembershipChange `json:"membership_change,omitempty"`
+}
+
+// OutputMembershipChange describes how an m.room.member event changed the
+// membership of the user in its state key.
+type OutputMembershipChange struct {
+	// The user whose membership changed. This is not necessarily the sender
+	// of the event, e.g. for kicks and invites.
+	UserID string `json:"user_id"`
+	// The membership of the user before the event, which is "leave" if the
+	// user had never been in the room.
+	PrevMembership string `json:"prev_membership"`
+	// The membership of the user after the event.
+	Membership string `json:"membership"`
+}
+
+// IsLeave returns true if the event took a user who was joined, invited or
+// knocking out of the room. This includes kicks, which have a sender other
+// than the user, and rejected or retracted invites, which have a previous
+// membership of invite.
+func (ore *OutputNewRoomEvent) IsLeave() bool {
+	c := ore.MembershipChange
+	return c != nil && c.Membership == gomatrixserverlib.Leave && c.PrevMembership != gomatrixserverlib.Leave && c.PrevMembership != gomatrixserverlib.Ban
 }
 
 // AddsState returns all added state events from this event.
@@ -268,3 +298,14 @@ type OutputRetirePeek struct {
 	UserID   string
 	DeviceID string
 }
+
+// An OutputPurgedEvents is written when events in a room have outlived the
+// room's retention policy and have been purged from the roomserver.
+// Downstream components should delete their copies of these events, and
+// the media that the events referred to.
+type OutputPurgedEvents struct {
+	RoomID   string
+	EventIDs []string
+	// The mxc:// URIs of the media referred to by the purged events.
+	MediaURIs []string
+}
@@ -79,6 +79,9 @@ type PerformJoinRequest struct {
 	UserID        string                         `json:"user_id"`
 	Content       map[string]interface{}         `json:"content"`
 	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+	// IsGuest is set if the user is a guest, who can only join rooms which
+	// allow guest access.
+	IsGuest bool `json:"is_guest"`
 }
 
 type PerformJoinResponse struct {
@@ -144,6 +147,9 @@ type PerformBackfillRequest struct {
 	Limit int `json:"limit"`
 	// The server interested in the events.
 	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// Whether to return soft-failed events which aren't referenced by any
+	// accepted event. Rejected events are never returned.
+	IncludeSoftFailed bool `json:"include_soft_failed"`
 }
 
 // PrevEventIDs returns the prev_event IDs of all backwards extremities, de-duplicated in a lexicographically sorted order.
@@ -201,3 +207,15 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformScheduleRoomEvictionRequest is a request to PerformScheduleRoomEviction
+type PerformScheduleRoomEvictionRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// PerformScheduleRoomEvictionResponse is a response to PerformScheduleRoomEviction
+type PerformScheduleRoomEvictionResponse struct {
+	// True if there are no local users left in the room, so it has been
+	// queued for eviction from the caches.
+	Scheduled bool `json:"scheduled"`
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPublicRoomsToken is returned by PaginatePublicRooms if the since
+// token wasn't one of the tokens it returned.
+var ErrInvalidPublicRoomsToken = errors.New("invalid pagination token")
+
+// PublicRoomsFilter is the filter of a /publicRooms request.
+type PublicRoomsFilter struct {
+	SearchTerms string    `json:"generic_search_term,omitempty"`
+	RoomTypes   []*string `json:"room_types,omitempty"`
+}
+
+// FilterPublicRooms returns the rooms which match the filter. The search term
+// is matched case-insensitively against the name, topic and canonical alias.
+func FilterPublicRooms(rooms []PublicRoom, f PublicRoomsFilter) []PublicRoom {
+	if f.SearchTerms == "" && len(f.RoomTypes) == 0 {
+		return rooms
+	}
+
+	normalizedTerm := strings.ToLower(f.SearchTerms)
+
+	result := make([]PublicRoom, 0)
+	for _, room := range rooms {
+		if !RoomTypeMatches(room.RoomType, f.RoomTypes) {
+			continue
+		}
+		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
+			result = append(result, room)
+		}
+	}
+
+	return result
+}
+
+// SortPublicRooms sorts rooms into directory order: by joined member count
+// (big to small) and then by room ID, so that the order is total and
+// pagination tokens always refer to the same position.
+func SortPublicRooms(rooms []PublicRoom) {
+	sort.Slice(rooms, func(i, j int) bool {
+		return publicRoomBefore(rooms[i].JoinedMembersCount, rooms[i].RoomID, rooms[j].JoinedMembersCount, rooms[j].RoomID)
+	})
+}
+
+func publicRoomBefore(aCount int, aRoomID string, bCount int, bRoomID string) bool {
+	if aCount != bCount {
+		return aCount > bCount
+	}
+	return aRoomID < bRoomID
+}
+
+// publicRoomsToken is a pagination token for the public room directory. It
+// refers to the room at the edge of a page rather than to an offset, so that
+// tokens stay valid when rooms are published or unpublished in between
+// requests. Forward tokens are of the form "n<joined>_<room ID>" and return
+// the rooms after that room, backward tokens are of the form "p<joined>_<room ID>"
+// and return the rooms before it.
+type publicRoomsToken struct {
+	backwards     bool
+	joinedMembers int
+	roomID        string
+}
+
+func (t publicRoomsToken) String() string {
+	dir := "n"
+	if t.backwards {
+		dir = "p"
+	}
+	return fmt.Sprintf("%s%d_%s", dir, t.joinedMembers, t.roomID)
+}
+
+func parsePublicRoomsToken(s string) (publicRoomsToken, error) {
+	var t publicRoomsToken
+	if len(s) < 2 {
+		return t, fmt.Errorf("%w %q", ErrInvalidPublicRoomsToken, s)
+	}
+	switch s[0] {
+	case 'n':
+	case 'p':
+		t.backwards = true
+	default:
+		return t, fmt.Errorf("%w %q", ErrInvalidPublicRoomsToken, s)
+	}
+	parts := strings.SplitN(s[1:], "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return t, fmt.Errorf("%w %q", ErrInvalidPublicRoomsToken, s)
+	}
+	joined, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return t, fmt.Errorf("%w %q", ErrInvalidPublicRoomsToken, s)
+	}
+	t.joinedMembers = joined
+	t.roomID = parts[1]
+	return t, nil
+}
+
+// PaginatePublicRooms returns the page of at most limit rooms which the since
+// token refers to, along with the tokens for the previous and next pages. The
+// rooms must already be in the order given by SortPublicRooms. An empty since
+// token returns the first page. Returns ErrInvalidPublicRoomsToken if the since
+// token is invalid.
+func PaginatePublicRooms(rooms []PublicRoom, since string, limit int) (chunk []PublicRoom, prev, next string, err error) {
+	start, end := 0, limit
+	if since != "" {
+		var token publicRoomsToken
+		if token, err = parsePublicRoomsToken(since); err != nil {
+			return nil, "", "", err
+		}
+		// the index of the first room which comes after the token room
+		after := sort.Search(len(rooms), func(i int) bool {
+			return publicRoomBefore(token.joinedMembers, token.roomID, rooms[i].JoinedMembersCount, rooms[i].RoomID)
+		})
+		// the index of the first room which doesn't come before the token room
+		notBefore := sort.Search(len(rooms), func(i int) bool {
+			return !publicRoomBefore(rooms[i].JoinedMembersCount, rooms[i].RoomID, token.joinedMembers, token.roomID)
+		})
+		if token.backwards {
+			start, end = notBefore-limit, notBefore
+		} else {
+			start, end = after, after+limit
+		}
+	}
+
+	// apply sanity caps
+	if start < 0 {
+		start = 0
+	}
+	if end > len(rooms) {
+		end = len(rooms)
+	}
+	if start >= end {
+		return []PublicRoom{}, "", "", nil
+	}
+
+	chunk = rooms[start:end]
+	if start > 0 { // there are more rooms behind us
+		first := chunk[0]
+		prev = publicRoomsToken{true, first.JoinedMembersCount, first.RoomID}.String()
+	}
+	if end < len(rooms) { // there are more rooms ahead of us
+		last := chunk[len(chunk)-1]
+		next = publicRoomsToken{false, last.JoinedMembersCount, last.RoomID}.String()
+	}
+	return chunk, prev, next, nil
+}
+
+// PublicRoomsInNetwork returns the rooms listed in the directory of the given
+// network. Rooms can only be published to the default Matrix network, as
+// application services can't publish rooms into the directory of a third party
+// network, so a third party instance ID never matches any rooms.
+func PublicRoomsInNetwork(rooms []PublicRoom, includeAllNetworks bool, thirdPartyInstanceID string) []PublicRoom {
+	if !includeAllNetworks && thirdPartyInstanceID != "" {
+		return []PublicRoom{}
+	}
+	return rooms
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func pubRoom(roomID string, joined int) PublicRoom {
+	room := PublicRoom{}
+	room.RoomID = roomID
+	room.Name = roomID
+	room.JoinedMembersCount = joined
+	return room
+}
+
+func TestPaginatePublicRooms(t *testing.T) {
+	rooms := []PublicRoom{
+		pubRoom("!e:test", 1), pubRoom("!a:test", 5), pubRoom("!c:test", 3),
+		pubRoom("!g:test", 1), pubRoom("!b:test", 3), pubRoom("!f:test", 1), pubRoom("!d:test", 2),
+	}
+	SortPublicRooms(rooms)
+	var order []string
+	for _, room := range rooms {
+		order = append(order, room.RoomID)
+	}
+	wantOrder := []string{"!a:test", "!b:test", "!c:test", "!d:test", "!e:test", "!f:test", "!g:test"}
+	if !reflect.DeepEqual(order, wantOrder) {
+		t.Fatalf("rooms sorted wrongly, got %v want %v", order, wantOrder)
+	}
+
+	testCases := []struct {
+		since     string
+		wantChunk []PublicRoom
+		wantPrev  string
+		wantNext  string
+	}{
+		{"", rooms[0:3], "", "n3_!c:test"},
+		{"n3_!c:test", rooms[3:6], "p2_!d:test", "n1_!f:test"},
+		{"n1_!f:test", rooms[6:7], "p1_!g:test", ""},
+		{"p2_!d:test", rooms[0:3], "", "n3_!c:test"},
+		{"p1_!g:test", rooms[3:6], "p2_!d:test", "n1_!f:test"},
+		{"n1_!g:test", []PublicRoom{}, "", ""},
+	}
+	for _, tc := range testCases {
+		chunk, prev, next, err := PaginatePublicRooms(rooms, tc.since, 3)
+		if err != nil {
+			t.Fatalf("since=%q: PaginatePublicRooms failed: %s", tc.since, err)
+		}
+		if !reflect.DeepEqual(chunk, tc.wantChunk) {
+			t.Errorf("since=%q: returned chunk is wrong, got %v want %v", tc.since, chunk, tc.wantChunk)
+		}
+		if prev != tc.wantPrev {
+			t.Errorf("since=%q: returned prev is wrong, got %q want %q", tc.since, prev, tc.wantPrev)
+		}
+		if next != tc.wantNext {
+			t.Errorf("since=%q: returned next is wrong, got %q want %q", tc.since, next, tc.wantNext)
+		}
+	}
+
+	// Tokens still work if the room they point at is no longer published
+	chunk, _, _, err := PaginatePublicRooms(append(rooms[:2:2], rooms[3:]...), "n3_!c:test", 2)
+	if err != nil {
+		t.Fatalf("PaginatePublicRooms failed: %s", err)
+	}
+	if !reflect.DeepEqual(chunk, rooms[3:5]) {
+		t.Errorf("returned chunk is wrong, got %v want %v", chunk, rooms[3:5])
+	}
+
+	for _, since := range []string{"T3", "n", "nx_!a:test", "n3_"} {
+		if _, _, _, err = PaginatePublicRooms(rooms, since, 3); !errors.Is(err, ErrInvalidPublicRoomsToken) {
+			t.Errorf("since=%q: expected ErrInvalidPublicRoomsToken, got %v", since, err)
+		}
+	}
+}
+
+func TestFilterPublicRoomsByRoomType(t *testing.T) {
+	space := pubRoom("space", 0)
+	space.RoomType = "m.space"
+	rooms := []PublicRoom{pubRoom("a", 0), space, pubRoom("b", 0)}
+	spaceType := "m.space"
+	testCases := []struct {
+		name      string
+		roomTypes []*string
+		want      []PublicRoom
+	}{
+		{"no filter", nil, rooms},
+		{"spaces", []*string{&spaceType}, []PublicRoom{space}},
+		{"rooms without a type", []*string{nil}, []PublicRoom{rooms[0], rooms[2]}},
+		{"both", []*string{nil, &spaceType}, rooms},
+	}
+	for _, tc := range testCases {
+		got := FilterPublicRooms(rooms, PublicRoomsFilter{RoomTypes: tc.roomTypes})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPublicRoomsInNetwork(t *testing.T) {
+	rooms := []PublicRoom{pubRoom("!a:test", 1)}
+	if got := PublicRoomsInNetwork(rooms, true, ""); len(got) != 1 {
+		t.Errorf("expected all networks to include published rooms, got %v", got)
+	}
+	if got := PublicRoomsInNetwork(rooms, false, "irc|libera"); len(got) != 0 {
+		t.Errorf("expected third party network to have no rooms, got %v", got)
+	}
+}
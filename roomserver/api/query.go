@@ -41,6 +41,9 @@ type QueryLatestEventsAndStateResponse struct {
 	// Does the room exist?
 	// If the room doesn't exist this will be false and LatestEvents will be empty.
 	RoomExists bool `json:"room_exists"`
+	// Is the room known to the roomserver without having any state, e.g. because
+	// it was purged or we have only been invited to it? RoomExists is false if so.
+	RoomIsStub bool `json:"room_is_stub"`
 	// The room version of the room.
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 	// The latest events in the room.
@@ -185,6 +188,39 @@ type QueryServerJoinedToRoomResponse struct {
 	IsInRoom bool `json:"is_in_room"`
 }
 
+// QueryServersInRoomRequest is a request to QueryServersInRoom
+type QueryServersInRoomRequest struct {
+	// ID of the room to find the servers of
+	RoomID string `json:"room_id"`
+}
+
+// QueryServersInRoomResponse is a response to QueryServersInRoom
+type QueryServersInRoomResponse struct {
+	// True if the room exists on the server
+	RoomExists bool `json:"room_exists"`
+	// The distinct set of servers that have joined members in the room,
+	// including the local server if we are joined.
+	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+// QuerySingleStateEventRequest is a request to QuerySingleStateEvent
+type QuerySingleStateEventRequest struct {
+	// ID of the room to look up the state event in
+	RoomID string `json:"room_id"`
+	// The type and state key of the state event
+	EventType string `json:"event_type"`
+	StateKey  string `json:"state_key"`
+}
+
+// QuerySingleStateEventResponse is a response to QuerySingleStateEvent
+type QuerySingleStateEventResponse struct {
+	// True if the room exists on the server
+	RoomExists bool `json:"room_exists"`
+	// The state event from the current state of the room, or nil if the
+	// room has no such state event.
+	Event *gomatrixserverlib.HeaderedEvent `json:"event,omitempty"`
+}
+
 // QueryServerAllowedToSeeEventRequest is a request to QueryServerAllowedToSeeEvent
 type QueryServerAllowedToSeeEventRequest struct {
 	// The event ID to look up invites in.
@@ -356,6 +392,14 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+// ReadyRequest is a request to the HTTP API form of Ready.
+type ReadyRequest struct{}
+
+// ReadyResponse is a response to the HTTP API form of Ready.
+type ReadyResponse struct {
+	Ready bool `json:"ready"`
+}
+
 // MarshalJSON stringifies the room ID and StateKeyTuple keys so they can be sent over the wire in HTTP API mode.
 func (r *QueryBulkStateContentResponse) MarshalJSON() ([]byte, error) {
 	se := make(map[string]string)
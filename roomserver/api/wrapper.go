@@ -16,6 +16,7 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -155,6 +156,28 @@ func GetStateEvent(ctx context.Context, rsAPI RoomserverInternalAPI, roomID stri
 	return nil
 }
 
+// ErrStateEventNotFound is returned by GetSingleStateEvent when the room
+// doesn't exist or doesn't have the requested state event.
+var ErrStateEventNotFound = errors.New("state event not found")
+
+// GetSingleStateEvent returns the current state event in the room, or
+// ErrStateEventNotFound if there isn't one. Unlike GetStateEvent, errors
+// talking to the roomserver are returned rather than logged.
+func GetSingleStateEvent(ctx context.Context, rsAPI RoomserverInternalAPI, roomID string, tuple gomatrixserverlib.StateKeyTuple) (*gomatrixserverlib.HeaderedEvent, error) {
+	var res QuerySingleStateEventResponse
+	if err := rsAPI.QuerySingleStateEvent(ctx, &QuerySingleStateEventRequest{
+		RoomID:    roomID,
+		EventType: tuple.EventType,
+		StateKey:  tuple.StateKey,
+	}, &res); err != nil {
+		return nil, err
+	}
+	if res.Event == nil {
+		return nil, ErrStateEventNotFound
+	}
+	return res.Event, nil
+}
+
 // IsServerBannedFromRoom returns whether the server is banned from a room by server ACLs.
 func IsServerBannedFromRoom(ctx context.Context, rsAPI RoomserverInternalAPI, roomID string, serverName gomatrixserverlib.ServerName) bool {
 	req := &QueryServerBannedFromRoomRequest{
@@ -169,10 +192,45 @@ func IsServerBannedFromRoom(ctx context.Context, rsAPI RoomserverInternalAPI, ro
 	return res.Banned
 }
 
+// PublicRoom is a gomatrixserverlib.PublicRoom along with the type of the room
+// from the m.room.create event, e.g. m.space. It is empty for normal rooms.
+type PublicRoom struct {
+	gomatrixserverlib.PublicRoom
+	RoomType string `json:"room_type,omitempty"`
+}
+
+// RespPublicRooms is a gomatrixserverlib.RespPublicRooms with room types.
+type RespPublicRooms struct {
+	// A paginated chunk of public rooms.
+	Chunk []PublicRoom `json:"chunk"`
+	// A pagination token for the response. The absence of this token means there are no more results to fetch and the client should stop paginating.
+	NextBatch string `json:"next_batch,omitempty"`
+	// A pagination token that allows fetching previous results. The absence of this token means there are no results before this batch, i.e. this is the first batch.
+	PrevBatch string `json:"prev_batch,omitempty"`
+	// An estimate on the total number of public rooms, if the server has an estimate.
+	TotalRoomCountEstimate int `json:"total_room_count_estimate,omitempty"`
+}
+
+// RoomTypeMatches returns true if the room type is one of the given types, as
+// per the room_types filter. A nil entry matches rooms with no type, and an
+// empty filter matches all rooms.
+func RoomTypeMatches(roomType string, roomTypes []*string) bool {
+	if len(roomTypes) == 0 {
+		return true
+	}
+	for _, t := range roomTypes {
+		if (t == nil && roomType == "") || (t != nil && *t == roomType) {
+			return true
+		}
+	}
+	return false
+}
+
 // PopulatePublicRooms extracts PublicRoom information for all the provided room IDs. The IDs are not checked to see if they are visible in the
 // published room directory.
 // due to lots of switches
-func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI RoomserverInternalAPI) ([]gomatrixserverlib.PublicRoom, error) {
+func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI RoomserverInternalAPI) ([]PublicRoom, error) {
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
 	avatarTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.avatar", StateKey: ""}
 	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.name", StateKey: ""}
 	canonicalTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
@@ -186,7 +244,7 @@ func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI Roomserver
 		RoomIDs:        roomIDs,
 		AllowWildcards: true,
 		StateTuples: []gomatrixserverlib.StateKeyTuple{
-			nameTuple, canonicalTuple, topicTuple, guestTuple, visibilityTuple, joinRuleTuple, avatarTuple,
+			createTuple, nameTuple, canonicalTuple, topicTuple, guestTuple, visibilityTuple, joinRuleTuple, avatarTuple,
 			{EventType: gomatrixserverlib.MRoomMember, StateKey: "*"},
 		},
 	}, &stateRes)
@@ -194,12 +252,11 @@ func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI Roomserver
 		util.GetLogger(ctx).WithError(err).Error("QueryBulkStateContent failed")
 		return nil, err
 	}
-	chunk := make([]gomatrixserverlib.PublicRoom, len(roomIDs))
+	chunk := make([]PublicRoom, len(roomIDs))
 	i := 0
 	for roomID, data := range stateRes.Rooms {
-		pub := gomatrixserverlib.PublicRoom{
-			RoomID: roomID,
-		}
+		pub := PublicRoom{}
+		pub.RoomID = roomID
 		joinCount := 0
 		var joinRule, guestAccess string
 		for tuple, contentVal := range data {
@@ -208,6 +265,8 @@ func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI Roomserver
 				continue
 			}
 			switch tuple {
+			case createTuple:
+				pub.RoomType = contentVal
 			case avatarTuple:
 				pub.AvatarURL = contentVal
 			case nameTuple:
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"sync/atomic"
 
 	"github.com/Shopify/sarama"
 	"github.com/getsentry/sentry-go"
@@ -15,7 +16,9 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // RoomserverInternalAPI is an implementation of api.RoomserverInternalAPI
@@ -31,6 +34,8 @@ type RoomserverInternalAPI struct {
 	*perform.Publisher
 	*perform.Backfiller
 	*perform.Forgetter
+	*perform.RoomEvicter
+	Purger                 *perform.Purger
 	DB                     storage.Database
 	Cfg                    *config.RoomServer
 	Producer               sarama.SyncProducer
@@ -41,11 +46,12 @@ type RoomserverInternalAPI struct {
 	asAPI                  asAPI.AppServiceQueryAPI
 	OutputRoomEventTopic   string // Kafka topic for new output room events
 	PerspectiveServerNames []gomatrixserverlib.ServerName
+	ready                  uint32 // atomic, set to 1 once SetFederationSenderAPI has been called
 }
 
 func NewRoomserverAPI(
-	cfg *config.RoomServer, roomserverDB storage.Database, producer sarama.SyncProducer,
-	outputRoomEventTopic string, caches caching.RoomServerCaches,
+	process *process.ProcessContext, cfg *config.RoomServer, roomserverDB storage.Database,
+	producer sarama.SyncProducer, outputRoomEventTopic string, caches caching.RoomServerCaches,
 	keyRing gomatrixserverlib.JSONVerifier, perspectiveServerNames []gomatrixserverlib.ServerName,
 ) *RoomserverInternalAPI {
 	serverACLs := acls.NewServerACLs(roomserverDB)
@@ -68,9 +74,18 @@ func NewRoomserverAPI(
 			Producer:             producer,
 			ServerName:           cfg.Matrix.ServerName,
 			ACLs:                 serverACLs,
+			WriteAheadQueue:      cfg.WriteAheadQueue,
 		},
+		RoomEvicter: perform.NewRoomEvicter(process, roomserverDB, caches),
 		// perform-er structs get initialised when we have a federation sender to use
 	}
+	a.Purger = perform.NewPurger(cfg, roomserverDB, a.Inputer)
+	// Process any events that were accepted but not processed before we last
+	// stopped. This is done even if the write-ahead queue has since been
+	// disabled, so that they aren't lost.
+	if err := a.Inputer.ReplayQueuedInputEvents(context.Background()); err != nil {
+		logrus.WithError(err).Error("Failed to replay queued input events")
+	}
 	return a
 }
 
@@ -135,6 +150,14 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 	r.Forgetter = &perform.Forgetter{
 		DB: r.DB,
 	}
+	atomic.StoreUint32(&r.ready, 1)
+}
+
+// Ready returns true once the perform-er structs have been initialised,
+// which happens when the federation sender API has been set. Until then
+// the Perform* functions cannot be used.
+func (r *RoomserverInternalAPI) Ready(ctx context.Context) bool {
+	return atomic.LoadUint32(&r.ready) == 1
 }
 
 func (r *RoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceQueryAPI) {
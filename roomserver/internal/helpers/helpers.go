@@ -384,6 +384,7 @@ func QueryLatestEventsAndState(
 	}
 	if roomInfo == nil || roomInfo.IsStub {
 		response.RoomExists = false
+		response.RoomIsStub = roomInfo != nil
 		return nil
 	}
 
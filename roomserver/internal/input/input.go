@@ -18,12 +18,14 @@ package input
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/dendrite/internal/hooks"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage"
@@ -46,14 +48,16 @@ type Inputer struct {
 	ServerName           gomatrixserverlib.ServerName
 	ACLs                 *acls.ServerACLs
 	OutputRoomEventTopic string
+	WriteAheadQueue      bool     // record input events in the database before processing them
 	workers              sync.Map // room ID -> *inputWorker
 }
 
 type inputTask struct {
-	ctx   context.Context
-	event *api.InputRoomEvent
-	wg    *sync.WaitGroup
-	err   error // written back by worker, only safe to read when all tasks are done
+	ctx      context.Context
+	event    *api.InputRoomEvent
+	queueNID int64 // position in the write-ahead queue, or 0 if not queued
+	wg       *sync.WaitGroup
+	err      error // written back by worker, only safe to read when all tasks are done
 }
 
 type inputWorker struct {
@@ -75,13 +79,7 @@ func (w *inputWorker) start() {
 			roomserverInputBackpressure.With(prometheus.Labels{
 				"room_id": task.event.Event.RoomID(),
 			}).Dec()
-			hooks.Run(hooks.KindNewEventReceived, task.event.Event)
-			_, task.err = w.r.processRoomEvent(task.ctx, task.event)
-			if task.err == nil {
-				hooks.Run(hooks.KindNewEventPersisted, task.event.Event)
-			} else {
-				sentry.CaptureException(task.err)
-			}
+			task.err = w.r.processInputEvent(task.ctx, task.event, task.queueNID)
 			task.wg.Done()
 		case <-time.After(time.Second * 5):
 			return
@@ -89,6 +87,88 @@ func (w *inputWorker) start() {
 	}
 }
 
+// processInputEvent processes the input event and then removes it from the
+// write-ahead queue, if it was queued.
+func (r *Inputer) processInputEvent(ctx context.Context, event *api.InputRoomEvent, queueNID int64) error {
+	hooks.Run(hooks.KindNewEventReceived, event.Event)
+	_, err := r.processRoomEvent(ctx, event)
+	if err == nil {
+		hooks.Run(hooks.KindNewEventPersisted, event.Event)
+	} else {
+		sentry.CaptureException(err)
+	}
+	// The event has been processed, even if it failed, and any error is
+	// reported back to the caller, so it doesn't need replaying.
+	if queueNID != 0 {
+		if rerr := r.DB.RemoveQueuedInputEvent(ctx, queueNID); rerr != nil {
+			log.WithError(rerr).WithField("event_id", event.Event.EventID()).Error("Failed to remove event from the input queue")
+		}
+	}
+	return err
+}
+
+// queueInputEvents records the input events in the write-ahead queue, if it
+// is enabled, so that they are not lost if we stop before processing them.
+// Returns the positions of the events in the queue.
+func (r *Inputer) queueInputEvents(ctx context.Context, events []api.InputRoomEvent) ([]int64, error) {
+	if !r.WriteAheadQueue {
+		return nil, nil
+	}
+	queueNIDs := make([]int64, 0, len(events))
+	for i := range events {
+		inputEvent, err := json.Marshal(events[i])
+		if err == nil {
+			var queueNID int64
+			queueNID, err = r.DB.QueueInputEvent(ctx, events[i].Event.RoomID(), inputEvent)
+			queueNIDs = append(queueNIDs, queueNID)
+		}
+		if err != nil {
+			// None of the events will be processed so don't replay them either.
+			for _, queueNID := range queueNIDs {
+				if queueNID == 0 {
+					continue
+				}
+				if rerr := r.DB.RemoveQueuedInputEvent(ctx, queueNID); rerr != nil {
+					log.WithError(rerr).Error("Failed to remove event from the input queue")
+				}
+			}
+			return nil, fmt.Errorf("failed to queue input event: %w", err)
+		}
+	}
+	return queueNIDs, nil
+}
+
+// ReplayQueuedInputEvents processes any input events that were queued in the
+// write-ahead queue but not processed, e.g. because the process crashed. This
+// must be called on startup before any new input events are accepted.
+func (r *Inputer) ReplayQueuedInputEvents(ctx context.Context) error {
+	queued, err := r.DB.QueuedInputEvents(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.QueuedInputEvents: %w", err)
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	log.Infof("Replaying %d queued input events", len(queued))
+	for _, q := range queued {
+		var event api.InputRoomEvent
+		if err = json.Unmarshal(q.InputEvent, &event); err != nil {
+			log.WithError(err).WithField("room_id", q.RoomID).Error("Failed to unmarshal queued input event")
+			if err = r.DB.RemoveQueuedInputEvent(ctx, q.QueueNID); err != nil {
+				return fmt.Errorf("r.DB.RemoveQueuedInputEvent: %w", err)
+			}
+			continue
+		}
+		if err = r.processInputEvent(ctx, &event, q.QueueNID); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"room_id":  q.RoomID,
+				"event_id": event.Event.EventID(),
+			}).Warn("Failed to process queued input event")
+		}
+	}
+	return nil
+}
+
 // WriteOutputEvents implements OutputRoomEventWriter
 func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
 	messages := make([]*sarama.ProducerMessage, len(updates))
@@ -167,9 +247,18 @@ func (r *Inputer) InputRoomEvents(
 	// this wait group so that we know when all of our events have been
 	// processed.
 	wg := &sync.WaitGroup{}
-	wg.Add(len(request.InputRoomEvents))
 	tasks := make([]*inputTask, len(request.InputRoomEvents))
 
+	// Record the events before we start processing them so that they can
+	// be replayed if we stop part way through.
+	queueNIDs, err := r.queueInputEvents(context.Background(), request.InputRoomEvents)
+	if err != nil {
+		response.ErrMsg = err.Error()
+		response.Transient = sqlutil.IsTransientErr(err)
+		return
+	}
+	wg.Add(len(request.InputRoomEvents))
+
 	for i, e := range request.InputRoomEvents {
 		// Work out if we are running per-room workers or if we're just doing
 		// it on a global basis (e.g. SQLite).
@@ -195,6 +284,9 @@ func (r *Inputer) InputRoomEvents(
 			event: &request.InputRoomEvents[i],
 			wg:    wg,
 		}
+		if queueNIDs != nil {
+			tasks[i].queueNID = queueNIDs[i]
+		}
 
 		// Send the task to the worker.
 		if worker.running.CAS(false, true) {
@@ -216,6 +308,7 @@ func (r *Inputer) InputRoomEvents(
 			response.ErrMsg = task.err.Error()
 			_, rejected := task.err.(*gomatrixserverlib.NotAllowed)
 			response.NotAllowed = rejected
+			response.Transient = !rejected && sqlutil.IsTransientErr(task.err)
 			return
 		}
 	}
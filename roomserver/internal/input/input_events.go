@@ -178,6 +178,14 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// Remember that the event was soft-failed, so that it doesn't leak out to
+	// clients later on, e.g. when it is returned by a backfill.
+	if softfail && !isRejected {
+		if err = r.DB.SetSoftFailed(ctx, stateAtEvent.EventNID); err != nil {
+			return "", fmt.Errorf("r.DB.SetSoftFailed: %w", err)
+		}
+	}
+
 	// We stop here if the event is rejected: We've stored it but won't update forward extremities or notify anyone about it.
 	if isRejected || softfail {
 		logrus.WithFields(logrus.Fields{
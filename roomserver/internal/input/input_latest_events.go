@@ -385,6 +385,10 @@ func (u *latestEventsUpdater) makeOutputNewRoomEvent() (*api.OutputEvent, error)
 
 	ore.SendAsServer = u.sendAsServer
 
+	if ore.MembershipChange, err = u.membershipChange(); err != nil {
+		return nil, fmt.Errorf("u.membershipChange: %w", err)
+	}
+
 	// include extra state events if they were added as nearly every downstream component will care about it
 	// and we'd rather not have them all hit QueryEventsByID at the same time!
 	if len(ore.AddsStateEventIDs) > 0 {
@@ -424,6 +428,50 @@ func (u *latestEventsUpdater) extraEventsForIDs(roomVersion gomatrixserverlib.Ro
 	return h, nil
 }
 
+// membershipChange describes how the event changed the membership of its
+// target user, or returns nil if it isn't a membership event or didn't make
+// it into the current state.
+func (u *latestEventsUpdater) membershipChange() (*api.OutputMembershipChange, error) {
+	if u.event.Type() != gomatrixserverlib.MRoomMember || u.event.StateKey() == nil {
+		return nil, nil
+	}
+	inCurrentState := false
+	for _, entry := range u.added {
+		if entry.EventNID == u.stateAtEvent.EventNID {
+			inCurrentState = true
+			break
+		}
+	}
+	if !inCurrentState {
+		return nil, nil
+	}
+	membership, err := u.event.Membership()
+	if err != nil {
+		return nil, fmt.Errorf("u.event.Membership: %w", err)
+	}
+	prevMembership := gomatrixserverlib.Leave
+	for _, entry := range u.removed {
+		if entry.StateKeyTuple != u.stateAtEvent.StateKeyTuple {
+			continue
+		}
+		events, err := u.api.DB.Events(u.ctx, []types.EventNID{entry.EventNID})
+		if err != nil {
+			return nil, fmt.Errorf("u.api.DB.Events: %w", err)
+		}
+		if len(events) == 1 {
+			if prevMembership, err = events[0].Membership(); err != nil {
+				return nil, fmt.Errorf("events[0].Membership: %w", err)
+			}
+		}
+		break
+	}
+	return &api.OutputMembershipChange{
+		UserID:         *u.event.StateKey(),
+		PrevMembership: prevMembership,
+		Membership:     membership,
+	}, nil
+}
+
 // retrieve an event nid -> event ID map for all events that need updating
 func (u *latestEventsUpdater) stateEventMap() (map[types.EventNID]string, error) {
 	var stateEventNIDs []types.EventNID
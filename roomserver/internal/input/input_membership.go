@@ -165,6 +165,9 @@ func updateToJoinMembership(
 		if err != nil {
 			return nil, err
 		}
+		if err = mu.SetProfile(add); err != nil {
+			return nil, err
+		}
 		return updates, nil
 	}
 	// When we mark a user as being joined we will invalidate any invites that
@@ -175,6 +178,9 @@ func updateToJoinMembership(
 	if err != nil {
 		return nil, err
 	}
+	if err = mu.SetProfile(add); err != nil {
+		return nil, err
+	}
 	for _, eventID := range retired {
 		orie := api.OutputRetireInviteEvent{
 			EventID:          eventID,
@@ -157,10 +157,50 @@ func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.Perform
 
 	// TODO: update backwards extremities, as that should be moved from syncapi to roomserver at some point.
 
-	res.Events = events
+	// Events that we previously rejected or soft-failed may well have been
+	// returned to us again by the remote server. Don't hand them to clients.
+	eventIDs := make([]string, 0, len(events))
+	for _, ev := range events {
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	rejected, softFailed, err := r.DB.EventsRejected(ctx, eventIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsRejected: %w", err)
+	}
+
+	res.Events = filterBackfilledEvents(events, rejected, softFailed, req.IncludeSoftFailed)
 	return nil
 }
 
+// filterBackfilledEvents removes rejected events from the given events, as
+// well as soft-failed events unless includeSoftFailed is set. Soft-failed
+// events which are referenced as a prev_event by an accepted event are kept,
+// in the same way that they would be if they arrived over /sync.
+func filterBackfilledEvents(
+	events []*gomatrixserverlib.HeaderedEvent, rejected, softFailed map[string]bool, includeSoftFailed bool,
+) []*gomatrixserverlib.HeaderedEvent {
+	referenced := make(map[string]bool)
+	for _, ev := range events {
+		if rejected[ev.EventID()] || softFailed[ev.EventID()] {
+			continue
+		}
+		for _, prevEventID := range ev.PrevEventIDs() {
+			referenced[prevEventID] = true
+		}
+	}
+	filtered := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		switch {
+		case rejected[ev.EventID()]:
+			continue
+		case softFailed[ev.EventID()] && !includeSoftFailed && !referenced[ev.EventID()]:
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
 // fetchAndStoreMissingEvents does a best-effort fetch and store of missing events specified in stateIDs. Returns no error as it is just
 // best effort.
 func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gomatrixserverlib.RoomVersion,
@@ -0,0 +1,109 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateBackfillEvent(t *testing.T, eventID string, prevEventIDs ...string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	prevEvents := []gomatrixserverlib.EventReference{}
+	for _, prevEventID := range prevEventIDs {
+		prevEvents = append(prevEvents, gomatrixserverlib.EventReference{
+			EventID: prevEventID,
+		})
+	}
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"event_id":    eventID,
+		"room_id":     "!room:localhost",
+		"type":        "m.room.message",
+		"sender":      "@alice:localhost",
+		"prev_events": prevEvents,
+		"auth_events": []gomatrixserverlib.EventReference{},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %s", err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return event.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func backfilledEventIDs(events []*gomatrixserverlib.HeaderedEvent) map[string]bool {
+	eventIDs := make(map[string]bool, len(events))
+	for _, ev := range events {
+		eventIDs[ev.EventID()] = true
+	}
+	return eventIDs
+}
+
+func TestFilterBackfilledEventsSoftFailed(t *testing.T) {
+	events := []*gomatrixserverlib.HeaderedEvent{
+		mustCreateBackfillEvent(t, "$a:localhost"),
+		mustCreateBackfillEvent(t, "$softfailed:localhost", "$a:localhost"),
+		mustCreateBackfillEvent(t, "$b:localhost", "$a:localhost"),
+	}
+	softFailed := map[string]bool{"$softfailed:localhost": true}
+
+	got := backfilledEventIDs(filterBackfilledEvents(events, nil, softFailed, false))
+	if got["$softfailed:localhost"] {
+		t.Fatalf("expected soft-failed event to be hidden, got %v", got)
+	}
+	if !got["$a:localhost"] || !got["$b:localhost"] {
+		t.Fatalf("expected accepted events to be returned, got %v", got)
+	}
+
+	got = backfilledEventIDs(filterBackfilledEvents(events, nil, softFailed, true))
+	if !got["$softfailed:localhost"] {
+		t.Fatalf("expected soft-failed event to be returned when requested, got %v", got)
+	}
+}
+
+func TestFilterBackfilledEventsReferencedSoftFailed(t *testing.T) {
+	events := []*gomatrixserverlib.HeaderedEvent{
+		mustCreateBackfillEvent(t, "$softfailed:localhost"),
+		mustCreateBackfillEvent(t, "$a:localhost", "$softfailed:localhost"),
+	}
+	softFailed := map[string]bool{"$softfailed:localhost": true}
+
+	got := backfilledEventIDs(filterBackfilledEvents(events, nil, softFailed, false))
+	if !got["$softfailed:localhost"] {
+		t.Fatalf("expected soft-failed event referenced by an accepted event to be returned, got %v", got)
+	}
+}
+
+func TestFilterBackfilledEventsRejected(t *testing.T) {
+	events := []*gomatrixserverlib.HeaderedEvent{
+		mustCreateBackfillEvent(t, "$rejected:localhost"),
+		mustCreateBackfillEvent(t, "$softfailed:localhost", "$rejected:localhost"),
+		mustCreateBackfillEvent(t, "$a:localhost", "$rejected:localhost"),
+	}
+	rejected := map[string]bool{"$rejected:localhost": true}
+	softFailed := map[string]bool{"$softfailed:localhost": true}
+
+	got := backfilledEventIDs(filterBackfilledEvents(events, rejected, softFailed, true))
+	if got["$rejected:localhost"] {
+		t.Fatalf("expected rejected event to never be returned, got %v", got)
+	}
+	if !got["$softfailed:localhost"] || !got["$a:localhost"] {
+		t.Fatalf("expected other events to be returned, got %v", got)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// evictionQueueSize is the number of rooms which can be waiting to be
+// evicted. Rooms scheduled while the queue is full are dropped, and will
+// be scheduled again the next time someone leaves them.
+const evictionQueueSize = 128
+
+// RoomEvicter evicts rooms which no longer have any local users in them from
+// the caches, so that dormant rooms don't keep using memory.
+type RoomEvicter struct {
+	DB      storage.Database
+	Cache   caching.RoomServerCaches
+	process *process.ProcessContext
+	queue   chan string
+}
+
+// NewRoomEvicter returns a RoomEvicter and starts evicting scheduled rooms in
+// the background, until the process is shut down.
+func NewRoomEvicter(process *process.ProcessContext, db storage.Database, cache caching.RoomServerCaches) *RoomEvicter {
+	c := &RoomEvicter{
+		DB:      db,
+		Cache:   cache,
+		process: process,
+		queue:   make(chan string, evictionQueueSize),
+	}
+	process.ComponentStarted()
+	go c.run()
+	return c
+}
+
+// PerformScheduleRoomEviction implements api.RoomserverInternalAPI
+func (c *RoomEvicter) PerformScheduleRoomEviction(
+	ctx context.Context,
+	req *api.PerformScheduleRoomEvictionRequest,
+	res *api.PerformScheduleRoomEvictionResponse,
+) error {
+	dormant, err := c.isDormant(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if !dormant {
+		return nil
+	}
+	select {
+	case c.queue <- req.RoomID:
+		res.Scheduled = true
+	default:
+		logrus.WithField("room_id", req.RoomID).Warn("Room eviction queue is full, not evicting room")
+	}
+	return nil
+}
+
+// isDormant returns true if the room exists and none of the local users in
+// it are joined, invited or knocking.
+func (c *RoomEvicter) isDormant(ctx context.Context, roomID string) (bool, error) {
+	info, err := c.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return false, fmt.Errorf("c.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return false, nil
+	}
+	eventNIDs, err := c.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, false, true)
+	if err != nil {
+		return false, fmt.Errorf("c.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	events, err := c.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return false, fmt.Errorf("c.DB.Events: %w", err)
+	}
+	for _, event := range events {
+		membership, err := event.Membership()
+		if err != nil {
+			return false, fmt.Errorf("event.Membership: %w", err)
+		}
+		if membership != gomatrixserverlib.Leave && membership != gomatrixserverlib.Ban {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *RoomEvicter) run() {
+	defer c.process.ComponentFinished()
+	ctx := c.process.Context()
+	for {
+		select {
+		case <-c.process.WaitForShutdown():
+			return
+		case roomID := <-c.queue:
+			logger := logrus.WithField("room_id", roomID)
+			// Someone may have joined the room since it was scheduled.
+			dormant, err := c.isDormant(ctx, roomID)
+			if err != nil {
+				logger.WithError(err).Error("Failed to check if room can be evicted")
+				continue
+			}
+			if !dormant {
+				continue
+			}
+			c.Cache.EvictRoomInfo(roomID)
+			logger.Debug("Evicted room with no local users from the caches")
+		}
+	}
+}
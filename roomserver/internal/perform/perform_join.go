@@ -16,6 +16,7 @@ package perform
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -217,6 +218,14 @@ func (r *Joiner) performJoinRoomByID(
 	serverInRoom := inRoomRes.IsInRoom
 	forceFederatedJoin := len(req.ServerNames) > 0 && !serverInRoom
 
+	// Guests can only join rooms which allow guest access. We can only tell
+	// that if we're in the room, so guests can't join rooms over federation.
+	if req.IsGuest {
+		if err = r.checkGuestCanJoin(ctx, req.RoomIDOrAlias, serverInRoom); err != nil {
+			return "", "", err
+		}
+	}
+
 	// Force a federated join if we're dealing with a pending invite
 	// and we aren't in the room.
 	isInvitePending, inviteSender, _, err := helpers.IsInvitePending(ctx, r.DB, req.RoomIDOrAlias, req.UserID)
@@ -287,7 +296,7 @@ func (r *Joiner) performJoinRoomByID(
 			}
 		}
 
-	case eventutil.ErrRoomNoExists:
+	case eventutil.ErrRoomNoExists, eventutil.ErrRoomPurged:
 		// The room doesn't exist locally. If the room ID looks like it should
 		// be ours then this probably means that we've nuked our database at
 		// some point.
@@ -319,6 +328,30 @@ func (r *Joiner) performJoinRoomByID(
 	return req.RoomIDOrAlias, r.Cfg.Matrix.ServerName, nil
 }
 
+// checkGuestCanJoin returns a PerformError unless the room allows guests to
+// join it.
+func (r *Joiner) checkGuestCanJoin(ctx context.Context, roomID string, serverInRoom bool) error {
+	forbidden := &api.PerformError{
+		Code: api.PerformErrorNotAllowed,
+		Msg:  "Guest access is not allowed in this room",
+	}
+	if !serverInRoom {
+		return forbidden
+	}
+	ev, err := r.DB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomGuestAccess, "")
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if ev == nil {
+		return forbidden
+	}
+	var content eventutil.GuestAccessContent
+	if err = json.Unmarshal(ev.Content(), &content); err != nil || content.GuestAccess != "can_join" {
+		return forbidden
+	}
+	return nil
+}
+
 func (r *Joiner) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
@@ -0,0 +1,192 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// MRoomRetention is the state event holding a room's retention policy (MSC1763).
+const MRoomRetention = "m.room.retention"
+
+func init() {
+	prometheus.MustRegister(purgedEventsCount, purgedEventBytesCount)
+}
+
+var purgedEventsCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "purged_events_total",
+		Help:      "Number of events purged by message retention policies",
+	},
+)
+
+var purgedEventBytesCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "purged_event_bytes_total",
+		Help:      "Size of the event JSON purged by message retention policies",
+	},
+)
+
+// Purger periodically purges events which have outlived the retention policy
+// of their room. State events and the latest events in a room are never
+// purged, as they are still needed to send new events into the room.
+type Purger struct {
+	Cfg     *config.RoomServer
+	DB      storage.Database
+	Inputer *input.Inputer
+}
+
+// NewPurger returns a Purger and, if retention is enabled, starts purging
+// expired events in the background.
+func NewPurger(cfg *config.RoomServer, db storage.Database, inputer *input.Inputer) *Purger {
+	p := &Purger{
+		Cfg:     cfg,
+		DB:      db,
+		Inputer: inputer,
+	}
+	if cfg.Retention.Enabled {
+		go p.run()
+	}
+	return p
+}
+
+func (p *Purger) run() {
+	for {
+		p.purge(context.Background(), time.Now())
+		time.Sleep(p.Cfg.Retention.PurgeInterval)
+	}
+}
+
+// purge purges expired events from all of the rooms that we know about.
+func (p *Purger) purge(ctx context.Context, now time.Time) {
+	roomIDs, err := p.DB.GetKnownRooms(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get rooms to purge")
+		return
+	}
+	for _, roomID := range roomIDs {
+		if err = p.purgeRoom(ctx, roomID, now); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to purge expired events")
+		}
+	}
+}
+
+func (p *Purger) purgeRoom(ctx context.Context, roomID string, now time.Time) error {
+	lifetime, err := p.maxLifetime(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if lifetime <= 0 {
+		return nil
+	}
+	info, err := p.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("p.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	eventIDs, eventJSONs, err := p.DB.PurgeExpiredEvents(ctx, info, now.Add(-lifetime))
+	if err != nil {
+		return fmt.Errorf("p.DB.PurgeExpiredEvents: %w", err)
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	purgedBytes := 0
+	for _, eventJSON := range eventJSONs {
+		purgedBytes += len(eventJSON)
+	}
+	purgedEventsCount.Add(float64(len(eventIDs)))
+	purgedEventBytesCount.Add(float64(purgedBytes))
+	logrus.WithFields(logrus.Fields{
+		"room_id": roomID,
+		"events":  len(eventIDs),
+		"bytes":   purgedBytes,
+	}).Info("Purged expired events")
+	return p.Inputer.WriteOutputEvents(roomID, []api.OutputEvent{
+		{
+			Type: api.OutputTypePurgedEvents,
+			PurgedEvents: &api.OutputPurgedEvents{
+				RoomID:    roomID,
+				EventIDs:  eventIDs,
+				MediaURIs: mediaURIs(eventJSONs),
+			},
+		},
+	})
+}
+
+// mediaContentPaths are the places in the content of an event where media
+// can be referred to, e.g. an m.image message and its thumbnail.
+var mediaContentPaths = []string{
+	"content.url",
+	"content.file.url",
+	"content.info.thumbnail_url",
+	"content.info.thumbnail_file.url",
+}
+
+// mediaURIs returns the mxc:// URIs of the media referred to by the events.
+func mediaURIs(eventJSONs [][]byte) []string {
+	var uris []string
+	seen := make(map[string]bool)
+	for _, eventJSON := range eventJSONs {
+		for _, res := range gjson.GetManyBytes(eventJSON, mediaContentPaths...) {
+			uri := res.String()
+			if !strings.HasPrefix(uri, "mxc://") || seen[uri] {
+				continue
+			}
+			seen[uri] = true
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// maxLifetime returns how long events in the room should be kept for, or 0
+// if they should be kept forever.
+func (p *Purger) maxLifetime(ctx context.Context, roomID string) (time.Duration, error) {
+	lifetime := p.Cfg.Retention.DefaultMaxLifetime
+	ev, err := p.DB.GetStateEvent(ctx, roomID, MRoomRetention, "")
+	if err != nil {
+		return 0, fmt.Errorf("p.DB.GetStateEvent: %w", err)
+	}
+	if ev == nil {
+		return lifetime, nil
+	}
+	var content struct {
+		MaxLifetime *int64 `json:"max_lifetime"`
+	}
+	if err = json.Unmarshal(ev.Content(), &content); err != nil || content.MaxLifetime == nil || *content.MaxLifetime <= 0 {
+		// Fall back to the server default if the room's policy is unusable.
+		return lifetime, nil
+	}
+	return p.Cfg.Retention.ClampLifetime(time.Duration(*content.MaxLifetime) * time.Millisecond), nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMediaURIs(t *testing.T) {
+	eventJSONs := [][]byte{
+		[]byte(`{"type":"m.room.message","content":{"msgtype":"m.text","body":"mxc://localhost/text"}}`),
+		[]byte(`{"type":"m.room.message","content":{"msgtype":"m.image","url":"mxc://localhost/image","info":{"thumbnail_url":"mxc://localhost/thumb"}}}`),
+		[]byte(`{"type":"m.room.message","content":{"msgtype":"m.file","file":{"url":"mxc://remote/encrypted"},"info":{"thumbnail_file":{"url":"mxc://remote/encthumb"}}}}`),
+		[]byte(`{"type":"m.room.message","content":{"msgtype":"m.image","url":"mxc://localhost/image"}}`),
+		[]byte(`{"type":"m.room.message","content":{"msgtype":"m.image","url":"https://example.com/image"}}`),
+	}
+	want := []string{
+		"mxc://localhost/image",
+		"mxc://localhost/thumb",
+		"mxc://remote/encrypted",
+		"mxc://remote/encthumb",
+	}
+	got := mediaURIs(eventJSONs)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mediaURIs: got %v want %v", got, want)
+	}
+}
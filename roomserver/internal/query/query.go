@@ -344,6 +344,48 @@ func (r *Queryer) QueryServerJoinedToRoom(
 	return nil
 }
 
+// QueryServersInRoom implements api.RoomserverInternalAPI
+func (r *Queryer) QueryServersInRoom(
+	ctx context.Context,
+	request *api.QueryServersInRoomRequest,
+	response *api.QueryServersInRoomResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	response.RoomExists = true
+	response.ServerNames, err = r.DB.GetServersInRoom(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetServersInRoom: %w", err)
+	}
+	return nil
+}
+
+// QuerySingleStateEvent implements api.RoomserverInternalAPI
+func (r *Queryer) QuerySingleStateEvent(
+	ctx context.Context,
+	request *api.QuerySingleStateEventRequest,
+	response *api.QuerySingleStateEventResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	response.RoomExists = true
+	response.Event, err = r.DB.GetStateEvent(ctx, request.RoomID, request.EventType, request.StateKey)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	return nil
+}
+
 // QueryServerAllowedToSeeEvent implements api.RoomserverInternalAPI
 func (r *Queryer) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
@@ -665,7 +707,9 @@ func (r *Queryer) QueryKnownUsers(ctx context.Context, req *api.QueryKnownUsersR
 	}
 	for _, user := range users {
 		res.Users = append(res.Users, authtypes.FullyQualifiedProfile{
-			UserID: user,
+			UserID:      user.UserID,
+			DisplayName: user.DisplayName,
+			AvatarURL:   user.AvatarURL,
 		})
 	}
 	return nil
@@ -26,15 +26,16 @@ const (
 	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
 
 	// Perform operations
-	RoomserverPerformInvitePath      = "/roomserver/performInvite"
-	RoomserverPerformPeekPath        = "/roomserver/performPeek"
-	RoomserverPerformUnpeekPath      = "/roomserver/performUnpeek"
-	RoomserverPerformJoinPath        = "/roomserver/performJoin"
-	RoomserverPerformLeavePath       = "/roomserver/performLeave"
-	RoomserverPerformBackfillPath    = "/roomserver/performBackfill"
-	RoomserverPerformPublishPath     = "/roomserver/performPublish"
-	RoomserverPerformInboundPeekPath = "/roomserver/performInboundPeek"
-	RoomserverPerformForgetPath      = "/roomserver/performForget"
+	RoomserverPerformInvitePath               = "/roomserver/performInvite"
+	RoomserverPerformPeekPath                 = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath               = "/roomserver/performUnpeek"
+	RoomserverPerformJoinPath                 = "/roomserver/performJoin"
+	RoomserverPerformLeavePath                = "/roomserver/performLeave"
+	RoomserverPerformBackfillPath             = "/roomserver/performBackfill"
+	RoomserverPerformPublishPath              = "/roomserver/performPublish"
+	RoomserverPerformInboundPeekPath          = "/roomserver/performInboundPeek"
+	RoomserverPerformForgetPath               = "/roomserver/performForget"
+	RoomserverPerformScheduleRoomEvictionPath = "/roomserver/performScheduleRoomEviction"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -44,6 +45,8 @@ const (
 	RoomserverQueryMembershipForUserPath       = "/roomserver/queryMembershipForUser"
 	RoomserverQueryMembershipsForRoomPath      = "/roomserver/queryMembershipsForRoom"
 	RoomserverQueryServerJoinedToRoomPath      = "/roomserver/queryServerJoinedToRoomPath"
+	RoomserverQueryServersInRoomPath           = "/roomserver/queryServersInRoom"
+	RoomserverQuerySingleStateEventPath        = "/roomserver/querySingleStateEvent"
 	RoomserverQueryServerAllowedToSeeEventPath = "/roomserver/queryServerAllowedToSeeEvent"
 	RoomserverQueryMissingEventsPath           = "/roomserver/queryMissingEvents"
 	RoomserverQueryStateAndAuthChainPath       = "/roomserver/queryStateAndAuthChain"
@@ -57,6 +60,9 @@ const (
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
 	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
+
+	// Health
+	RoomserverReadyPath = "/roomserver/ready"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -90,6 +96,20 @@ func (h *httpRoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsInputAPI.Fede
 func (h *httpRoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceQueryAPI) {
 }
 
+// Ready implements RoomserverInternalAPI. If the roomserver can't be
+// reached then it is treated as not ready.
+func (h *httpRoomserverInternalAPI) Ready(ctx context.Context) bool {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Ready")
+	defer span.Finish()
+
+	var res api.ReadyResponse
+	apiURL := h.roomserverURL + RoomserverReadyPath
+	if err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, &api.ReadyRequest{}, &res); err != nil {
+		return false
+	}
+	return res.Ready
+}
+
 // SetRoomAlias implements RoomserverAliasAPI
 func (h *httpRoomserverInternalAPI) SetRoomAlias(
 	ctx context.Context,
@@ -167,7 +187,9 @@ func (h *httpRoomserverInternalAPI) InputRoomEvents(
 	apiURL := h.roomserverURL + RoomserverInputRoomEventsPath
 	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 	if err != nil {
+		// The roomserver couldn't be reached, e.g. because it is restarting.
 		response.ErrMsg = err.Error()
+		response.Transient = true
 	}
 }
 
@@ -378,6 +400,32 @@ func (h *httpRoomserverInternalAPI) QueryServerJoinedToRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryServersInRoom implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryServersInRoom(
+	ctx context.Context,
+	request *api.QueryServersInRoomRequest,
+	response *api.QueryServersInRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServersInRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryServersInRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QuerySingleStateEvent implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QuerySingleStateEvent(
+	ctx context.Context,
+	request *api.QuerySingleStateEventRequest,
+	response *api.QuerySingleStateEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QuerySingleStateEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQuerySingleStateEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryServerAllowedToSeeEvent implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
@@ -549,3 +597,15 @@ func (h *httpRoomserverInternalAPI) PerformForget(ctx context.Context, req *api.
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 
 }
+
+func (h *httpRoomserverInternalAPI) PerformScheduleRoomEviction(
+	ctx context.Context,
+	req *api.PerformScheduleRoomEvictionRequest,
+	res *api.PerformScheduleRoomEvictionResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformScheduleRoomEviction")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformScheduleRoomEvictionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/test"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -19,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 )
@@ -94,7 +97,7 @@ type fledglingEvent struct {
 	RoomID   string
 }
 
-func mustCreateEvents(t *testing.T, roomVer gomatrixserverlib.RoomVersion, events []fledglingEvent) (result []*gomatrixserverlib.HeaderedEvent) {
+func mustCreateEvents(t testing.TB, roomVer gomatrixserverlib.RoomVersion, events []fledglingEvent) (result []*gomatrixserverlib.HeaderedEvent) {
 	t.Helper()
 	depth := int64(1)
 	seed := make([]byte, ed25519.SeedSize) // zero seed
@@ -156,7 +159,7 @@ func mustLoadRawEvents(t *testing.T, ver gomatrixserverlib.RoomVersion, events [
 	return hs
 }
 
-func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyProducer) {
+func mustCreateRoomserverAPI(t testing.TB) (api.RoomserverInternalAPI, *dummyProducer) {
 	t.Helper()
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
@@ -180,8 +183,14 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
+	// Stop the background workers before the next test replaces the database.
+	processCtx := process.NewProcessContext()
+	t.Cleanup(func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForComponentsToFinish()
+	})
 	return internal.NewRoomserverAPI(
-		&cfg.RoomServer, roomserverDB, dp, string(cfg.Global.Kafka.TopicFor(config.TopicOutputRoomEvent)),
+		processCtx, &cfg.RoomServer, roomserverDB, dp, string(cfg.Global.Kafka.TopicFor(config.TopicOutputRoomEvent)),
 		base.Caches, &test.NopJSONVerifier{}, nil,
 	), dp
 }
@@ -406,3 +415,653 @@ func TestOutputRewritesState(t *testing.T) {
 		t.Errorf("Output event did not overwrite room state")
 	}
 }
+
+// This tests that input events which were accepted into the write-ahead queue
+// but never processed, e.g. because the process crashed, are replayed when the
+// roomserver starts up again.
+func TestReplayQueuedInputEvents(t *testing.T) {
+	roomID := "!replay:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.create",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"creator":      alice,
+				"room_version": "6",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.member",
+			StateKey: &alice,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+	})
+	deleteDatabase()
+	defer deleteDatabase()
+
+	cache, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.Open(&config.DatabaseOptions{ConnectionString: roomserverDBFileURI}, cache)
+	if err != nil {
+		t.Fatalf("failed to open roomserver db: %s", err)
+	}
+	// Accept the events into the queue and then "crash" before processing them.
+	for _, ev := range events {
+		inputEvent, err := json.Marshal(api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        ev,
+			AuthEventIDs: ev.AuthEventIDs(),
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal input event: %s", err)
+		}
+		if _, err = db.QueueInputEvent(ctx, roomID, inputEvent); err != nil {
+			t.Fatalf("failed to queue input event: %s", err)
+		}
+	}
+
+	// Starting the roomserver again should process the queued events.
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+	var newRoomEvents []string
+	for _, msg := range producer.producedMessages {
+		if msg.Type == api.OutputTypeNewRoomEvent {
+			newRoomEvents = append(newRoomEvents, msg.NewRoomEvent.Event.EventID())
+		}
+	}
+	wantEventIDs := []string{events[0].EventID(), events[1].EventID()}
+	if !reflect.DeepEqual(newRoomEvents, wantEventIDs) {
+		t.Errorf("got output events %v, want %v", newRoomEvents, wantEventIDs)
+	}
+	var queryRes api.QueryEventsByIDResponse
+	if err = rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: wantEventIDs}, &queryRes); err != nil {
+		t.Fatalf("failed to QueryEventsByID: %s", err)
+	}
+	if len(queryRes.Events) != len(wantEventIDs) {
+		t.Errorf("got %d persisted events, want %d", len(queryRes.Events), len(wantEventIDs))
+	}
+	queued, err := db.QueuedInputEvents(ctx)
+	if err != nil {
+		t.Fatalf("failed to get queued input events: %s", err)
+	}
+	if len(queued) != 0 {
+		t.Errorf("got %d queued input events after replay, want 0", len(queued))
+	}
+}
+
+func TestQueryServersInRoom(t *testing.T) {
+	roomID := "!servers:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	charlie := "@charlie:remote.server"
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.create",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"creator":      alice,
+				"room_version": "6",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.member",
+			StateKey: &alice,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.join_rules",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"join_rule": "public",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Type:     "m.room.member",
+			StateKey: &bob,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   charlie,
+			Type:     "m.room.member",
+			StateKey: &charlie,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Type:     "m.room.member",
+			StateKey: &bob,
+			Content: map[string]interface{}{
+				"membership": "leave",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   charlie,
+			Type:     "m.room.member",
+			StateKey: &charlie,
+			Content: map[string]interface{}{
+				"membership": "leave",
+			},
+		},
+	})
+	deleteDatabase()
+	defer deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+
+	queryServers := func() []gomatrixserverlib.ServerName {
+		t.Helper()
+		var res api.QueryServersInRoomResponse
+		if err := rsAPI.QueryServersInRoom(ctx, &api.QueryServersInRoomRequest{RoomID: roomID}, &res); err != nil {
+			t.Fatalf("failed to QueryServersInRoom: %s", err)
+		}
+		if !res.RoomExists {
+			t.Fatalf("QueryServersInRoom: room does not exist")
+		}
+		sort.Slice(res.ServerNames, func(i, j int) bool {
+			return res.ServerNames[i] < res.ServerNames[j]
+		})
+		return res.ServerNames
+	}
+
+	for _, tc := range []struct {
+		events []*gomatrixserverlib.HeaderedEvent
+		want   []gomatrixserverlib.ServerName
+	}{
+		// alice creates the room and joins it
+		{events[:3], []gomatrixserverlib.ServerName{testOrigin}},
+		// bob and charlie join from the same server, which is only listed once
+		{events[3:5], []gomatrixserverlib.ServerName{testOrigin, "remote.server"}},
+		// bob leaves but charlie is still there
+		{events[5:6], []gomatrixserverlib.ServerName{testOrigin, "remote.server"}},
+		// charlie leaves so the remote server is no longer in the room
+		{events[6:7], []gomatrixserverlib.ServerName{testOrigin}},
+	} {
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, tc.events, testOrigin, nil); err != nil {
+			t.Fatalf("failed to SendEvents: %s", err)
+		}
+		if got := queryServers(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("after %s: got servers %v, want %v", tc.events[len(tc.events)-1].EventID(), got, tc.want)
+		}
+	}
+
+	var res api.QueryServersInRoomResponse
+	if err := rsAPI.QueryServersInRoom(ctx, &api.QueryServersInRoomRequest{RoomID: "!unknown:" + string(testOrigin)}, &res); err != nil {
+		t.Fatalf("failed to QueryServersInRoom: %s", err)
+	}
+	if res.RoomExists {
+		t.Errorf("QueryServersInRoom: unknown room exists")
+	}
+}
+
+// mustCreatePublicRoomEvents creates a public room on testOrigin with the
+// given number of remote members joined to it.
+func mustCreatePublicRoomEvents(t testing.TB, roomID string, members int) []*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	fledglings := []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.create",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"creator":      alice,
+				"room_version": "6",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.member",
+			StateKey: &alice,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.join_rules",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"join_rule": "public",
+			},
+		},
+	}
+	for i := 0; i < members; i++ {
+		userID := fmt.Sprintf("@user%d:remote.server", i)
+		fledglings = append(fledglings, fledglingEvent{
+			RoomID:   roomID,
+			Sender:   userID,
+			Type:     "m.room.member",
+			StateKey: &userID,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		})
+	}
+	return mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, fledglings)
+}
+
+func TestQuerySingleStateEvent(t *testing.T) {
+	roomID := "!single:" + string(testOrigin)
+	events := mustCreatePublicRoomEvents(t, roomID, 1)
+	deleteDatabase()
+	defer deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	var res api.QuerySingleStateEventResponse
+	if err := rsAPI.QuerySingleStateEvent(ctx, &api.QuerySingleStateEventRequest{
+		RoomID:    roomID,
+		EventType: "m.room.join_rules",
+		StateKey:  "",
+	}, &res); err != nil {
+		t.Fatalf("failed to QuerySingleStateEvent: %s", err)
+	}
+	if !res.RoomExists {
+		t.Errorf("QuerySingleStateEvent: room does not exist")
+	}
+	if res.Event == nil || res.Event.EventID() != events[2].EventID() {
+		t.Errorf("QuerySingleStateEvent: got event %v, want %s", res.Event, events[2].EventID())
+	}
+
+	ev, err := api.GetSingleStateEvent(ctx, rsAPI, roomID, gomatrixserverlib.StateKeyTuple{
+		EventType: "m.room.member",
+		StateKey:  "@user0:remote.server",
+	})
+	if err != nil {
+		t.Fatalf("GetSingleStateEvent: %s", err)
+	}
+	if ev.EventID() != events[3].EventID() {
+		t.Errorf("GetSingleStateEvent: got event %s, want %s", ev.EventID(), events[3].EventID())
+	}
+
+	for _, tc := range []struct {
+		name   string
+		roomID string
+		tuple  gomatrixserverlib.StateKeyTuple
+	}{
+		{"missing state event", roomID, gomatrixserverlib.StateKeyTuple{EventType: "m.room.name", StateKey: ""}},
+		{"missing state key", roomID, gomatrixserverlib.StateKeyTuple{EventType: "m.room.member", StateKey: "@nobody:remote.server"}},
+		{"unknown room", "!unknown:" + string(testOrigin), gomatrixserverlib.StateKeyTuple{EventType: "m.room.join_rules", StateKey: ""}},
+	} {
+		if _, err = api.GetSingleStateEvent(ctx, rsAPI, tc.roomID, tc.tuple); err != api.ErrStateEventNotFound {
+			t.Errorf("%s: got error %v, want ErrStateEventNotFound", tc.name, err)
+		}
+	}
+}
+
+func BenchmarkQuerySingleStateEvent(b *testing.B) {
+	roomID := "!bench:" + string(testOrigin)
+	events := mustCreatePublicRoomEvents(b, roomID, 200)
+	deleteDatabase()
+	defer deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(b)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		b.Fatalf("failed to SendEvents: %s", err)
+	}
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.join_rules", StateKey: ""}
+
+	b.Run("QuerySingleStateEvent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := api.GetSingleStateEvent(ctx, rsAPI, roomID, tuple); err != nil {
+				b.Fatalf("GetSingleStateEvent: %s", err)
+			}
+		}
+	})
+	b.Run("QueryLatestEventsAndState", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var res api.QueryLatestEventsAndStateResponse
+			if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+				RoomID: roomID,
+			}, &res); err != nil {
+				b.Fatalf("QueryLatestEventsAndState: %s", err)
+			}
+			found := false
+			for _, ev := range res.StateEvents {
+				if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+					found = true
+				}
+			}
+			if !found {
+				b.Fatalf("QueryLatestEventsAndState: join rules not found")
+			}
+		}
+	})
+}
+
+func TestPerformScheduleRoomEviction(t *testing.T) {
+	roomID := "!eviction:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	charlie := "@charlie:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.create",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"creator":      alice,
+				"room_version": "6",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.member",
+			StateKey: &alice,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.join_rules",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"join_rule": "public",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Type:     "m.room.member",
+			StateKey: &bob,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   charlie,
+			Type:     "m.room.member",
+			StateKey: &charlie,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.member",
+			StateKey: &alice,
+			Content: map[string]interface{}{
+				"membership": "leave",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   charlie,
+			Type:     "m.room.member",
+			StateKey: &charlie,
+			Content: map[string]interface{}{
+				"membership": "leave",
+			},
+		},
+	})
+	deleteDatabase()
+	defer deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+
+	schedule := func(roomID string) bool {
+		t.Helper()
+		var res api.PerformScheduleRoomEvictionResponse
+		if err := rsAPI.PerformScheduleRoomEviction(ctx, &api.PerformScheduleRoomEvictionRequest{
+			RoomID: roomID,
+		}, &res); err != nil {
+			t.Fatalf("failed to PerformScheduleRoomEviction: %s", err)
+		}
+		return res.Scheduled
+	}
+
+	tests := []struct {
+		name   string
+		events []*gomatrixserverlib.HeaderedEvent
+		want   bool
+	}{
+		{"local users joined", events[:5], false},
+		{"one local user left", events[5:6], false},
+		{"last local user left", events[6:7], true},
+	}
+	for _, tc := range tests {
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, tc.events, testOrigin, nil); err != nil {
+			t.Fatalf("%s: failed to SendEvents: %s", tc.name, err)
+		}
+		if got := schedule(roomID); got != tc.want {
+			t.Errorf("%s: got scheduled %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if schedule("!unknown:" + string(testOrigin)) {
+		t.Errorf("unknown room: expected not to be scheduled")
+	}
+}
+
+func TestOutputMembershipChange(t *testing.T) {
+	roomID := "!membership:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.create",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"creator":      alice,
+				"room_version": "6",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.member",
+			StateKey: &alice,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Type:     "m.room.join_rules",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"join_rule": "public",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Type:     "m.room.member",
+			StateKey: &bob,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Type:     "m.room.member",
+			StateKey: &bob,
+			Content: map[string]interface{}{
+				"membership": "leave",
+			},
+		},
+	})
+	deleteDatabase()
+	defer deleteDatabase()
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+
+	tests := []struct {
+		name       string
+		event      *gomatrixserverlib.HeaderedEvent
+		origin     gomatrixserverlib.ServerName
+		wantChange *api.OutputMembershipChange
+		wantLeave  bool
+	}{
+		{"create", events[0], testOrigin, nil, false},
+		{"local join", events[1], testOrigin, &api.OutputMembershipChange{UserID: alice, PrevMembership: "leave", Membership: "join"}, false},
+		{"join rules", events[2], testOrigin, nil, false},
+		{"federated join", events[3], "remote.server", &api.OutputMembershipChange{UserID: bob, PrevMembership: "leave", Membership: "join"}, false},
+		{"federated leave", events[4], "remote.server", &api.OutputMembershipChange{UserID: bob, PrevMembership: "join", Membership: "leave"}, true},
+	}
+	for _, tc := range tests {
+		producer.producedMessages = nil
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{tc.event}, tc.origin, nil); err != nil {
+			t.Fatalf("%s: failed to SendEvents: %s", tc.name, err)
+		}
+		var ore *api.OutputNewRoomEvent
+		for _, msg := range producer.producedMessages {
+			if msg.Type == api.OutputTypeNewRoomEvent && msg.NewRoomEvent.Event.EventID() == tc.event.EventID() {
+				ore = msg.NewRoomEvent
+			}
+		}
+		if ore == nil {
+			t.Fatalf("%s: no output event produced", tc.name)
+		}
+		if !reflect.DeepEqual(ore.MembershipChange, tc.wantChange) {
+			t.Errorf("%s: got membership change %+v, want %+v", tc.name, ore.MembershipChange, tc.wantChange)
+		}
+		if ore.IsLeave() != tc.wantLeave {
+			t.Errorf("%s: got IsLeave %v, want %v", tc.name, ore.IsLeave(), tc.wantLeave)
+		}
+	}
+}
+
+func TestQueryKnownUsers(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	carol := "@carol:" + string(testOrigin)
+	emptyKey := ""
+	memberEvent := func(roomID, userID, displayName string) fledglingEvent {
+		return fledglingEvent{
+			RoomID:   roomID,
+			Sender:   userID,
+			Type:     "m.room.member",
+			StateKey: &userID,
+			Content: map[string]interface{}{
+				"membership":  "join",
+				"displayname": displayName,
+			},
+		}
+	}
+	createEvent := func(roomID, creator string) fledglingEvent {
+		return fledglingEvent{
+			RoomID:   roomID,
+			Sender:   creator,
+			Type:     "m.room.create",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"creator":      creator,
+				"room_version": "6",
+			},
+		}
+	}
+	joinRulesEvent := func(roomID, sender string) fledglingEvent {
+		return fledglingEvent{
+			RoomID:   roomID,
+			Sender:   sender,
+			Type:     "m.room.join_rules",
+			StateKey: &emptyKey,
+			Content: map[string]interface{}{
+				"join_rule": "public",
+			},
+		}
+	}
+
+	// Alice shares a room with Bob, who later changes his display name, but not with Carol.
+	sharedRoomID := "!shared:" + string(testOrigin)
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		createEvent(sharedRoomID, alice),
+		memberEvent(sharedRoomID, alice, "Alice"),
+		joinRulesEvent(sharedRoomID, alice),
+		memberEvent(sharedRoomID, bob, "Bob"),
+		memberEvent(sharedRoomID, bob, "Robert Smith"),
+	})
+	otherRoomID := "!other:" + string(testOrigin)
+	events = append(events, mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		createEvent(otherRoomID, carol),
+		memberEvent(otherRoomID, carol, "Carol Smith"),
+	})...)
+	deleteDatabase()
+	defer deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	tests := []struct {
+		searchString string
+		want         []authtypes.FullyQualifiedProfile
+	}{
+		{"rob", []authtypes.FullyQualifiedProfile{{UserID: bob, DisplayName: "Robert Smith"}}},
+		{"SMITH", []authtypes.FullyQualifiedProfile{{UserID: bob, DisplayName: "Robert Smith"}}},
+		{"robert sm", []authtypes.FullyQualifiedProfile{{UserID: bob, DisplayName: "Robert Smith"}}},
+		{"@bob:remote", []authtypes.FullyQualifiedProfile{{UserID: bob, DisplayName: "Robert Smith"}}},
+		{"al", []authtypes.FullyQualifiedProfile{{UserID: alice, DisplayName: "Alice"}}},
+		{"ert", nil},
+		{"robert carol", nil},
+		{"carol", nil},
+	}
+	for _, tc := range tests {
+		var res api.QueryKnownUsersResponse
+		if err := rsAPI.QueryKnownUsers(ctx, &api.QueryKnownUsersRequest{
+			UserID:       alice,
+			SearchString: tc.searchString,
+			Limit:        10,
+		}, &res); err != nil {
+			t.Fatalf("%q: failed to QueryKnownUsers: %s", tc.searchString, err)
+		}
+		if !reflect.DeepEqual(res.Users, tc.want) {
+			t.Errorf("%q: got users %+v, want %+v", tc.searchString, res.Users, tc.want)
+		}
+	}
+
+	// Users who aren't in any rooms don't know about anyone
+	var res api.QueryKnownUsersResponse
+	if err := rsAPI.QueryKnownUsers(ctx, &api.QueryKnownUsersRequest{
+		UserID:       "@nobody:" + string(testOrigin),
+		SearchString: "bob",
+		Limit:        10,
+	}, &res); err != nil {
+		t.Fatalf("failed to QueryKnownUsers for unknown user: %s", err)
+	}
+	if len(res.Users) != 0 {
+		t.Errorf("got users %+v for unknown user, want none", res.Users)
+	}
+}
@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
@@ -82,6 +83,11 @@ type Database interface {
 	// Look up the numeric IDs for a list of events.
 	// Returns an error if there was a problem talking to the database.
 	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	// Look up which of a list of events were rejected or soft-failed.
+	// Events that aren't in the database are omitted from both sets.
+	EventsRejected(ctx context.Context, eventIDs []string) (rejected, softFailed map[string]bool, err error)
+	// Mark an event as having been soft-failed, so that it isn't served to clients.
+	SetSoftFailed(ctx context.Context, eventNID types.EventNID) error
 	// Set the state at an event. FIXME TODO: "at"
 	SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	// Lookup the event IDs for a batch of event numeric IDs.
@@ -140,6 +146,13 @@ type Database interface {
 	PublishRoom(ctx context.Context, roomID string, publish bool) error
 	// Returns a list of room IDs for rooms which are published.
 	GetPublishedRooms(ctx context.Context) ([]string, error)
+	// QueueInputEvent records an accepted input event before it is processed.
+	// Returns the position of the event in the queue.
+	QueueInputEvent(ctx context.Context, roomID string, inputEvent []byte) (queueNID int64, err error)
+	// RemoveQueuedInputEvent removes an input event from the queue once it has been processed.
+	RemoveQueuedInputEvent(ctx context.Context, queueNID int64) error
+	// QueuedInputEvents returns the input events which were queued but never processed.
+	QueuedInputEvents(ctx context.Context) ([]tables.QueuedInputEvent, error)
 
 	// TODO: factor out - from currentstateserver
 
@@ -158,10 +171,16 @@ type Database interface {
 	GetLocalServerInRoom(ctx context.Context, roomNID types.RoomNID) (bool, error)
 	// GetServerInRoom returns true if we think a server is in a given room or false otherwise.
 	GetServerInRoom(ctx context.Context, roomNID types.RoomNID, serverName gomatrixserverlib.ServerName) (bool, error)
-	// GetKnownUsers searches all users that userID knows about.
-	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error)
+	// GetServersInRoom returns the distinct set of servers that have joined members in a given room.
+	GetServersInRoom(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.ServerName, error)
+	// GetKnownUsers searches the user directory for users that userID knows about.
+	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]tables.UserDirectoryEntry, error)
 	// GetKnownRooms returns a list of all rooms we know about.
 	GetKnownRooms(ctx context.Context) ([]string, error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
 	ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error
+	// PurgeExpiredEvents removes non-state events in the room which were sent before the given
+	// time, other than the latest events in the room. It returns the IDs of the purged events
+	// and, in the same order, the JSON that was removed.
+	PurgeExpiredEvents(ctx context.Context, roomInfo *types.RoomInfo, before time.Time) (eventIDs []string, eventJSONs [][]byte, err error)
 }
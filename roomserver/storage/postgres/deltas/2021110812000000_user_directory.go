@@ -0,0 +1,84 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func LoadUserDirectory(m *sqlutil.Migrations) {
+	m.AddMigration(UpUserDirectory, DownUserDirectory)
+}
+
+// UpUserDirectory populates the user directory from the join events of the
+// users that are currently joined to rooms.
+func UpUserDirectory(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT m.target_nid, k.event_state_key, j.event_json FROM roomserver_membership m
+		INNER JOIN roomserver_event_state_keys k ON m.target_nid = k.event_state_key_nid
+		INNER JOIN roomserver_event_json j ON m.event_nid = j.event_nid
+		WHERE m.membership_nid = 3 -- join
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to select join events: %w", err)
+	}
+	type profile struct {
+		userNID                        int64
+		displayName, avatarURL, userID string
+	}
+	var profiles []profile
+	for rows.Next() {
+		var p profile
+		var eventJSON []byte
+		if err = rows.Scan(&p.userNID, &p.userID, &eventJSON); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan join event: %w", err)
+		}
+		var event struct {
+			Content gomatrixserverlib.MemberContent `json:"content"`
+		}
+		_ = json.Unmarshal(eventJSON, &event)
+		p.displayName, p.avatarURL = event.Content.DisplayName, event.Content.AvatarURL
+		profiles = append(profiles, p)
+	}
+	if err = rows.Close(); err != nil {
+		return fmt.Errorf("failed to close rows: %w", err)
+	}
+	for _, p := range profiles {
+		_, err = tx.Exec(`
+			INSERT INTO roomserver_user_directory (user_nid, display_name, avatar_url, search_terms)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_nid) DO UPDATE SET display_name = $2, avatar_url = $3, search_terms = $4
+		`, p.userNID, p.displayName, p.avatarURL, types.UserDirectorySearchTerms(p.userID, p.displayName))
+		if err != nil {
+			return fmt.Errorf("failed to insert user directory profile: %w", err)
+		}
+	}
+	return nil
+}
+
+func DownUserDirectory(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM roomserver_user_directory;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
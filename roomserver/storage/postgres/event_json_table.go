@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -54,9 +55,22 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+// Select the JSON of non-state events in a room which are candidates for
+// purging by the retention policy.
+const selectPurgeableEventJSONSQL = "" +
+	"SELECT roomserver_event_json.event_nid, event_json FROM roomserver_event_json" +
+	" JOIN roomserver_events ON roomserver_event_json.event_nid = roomserver_events.event_nid" +
+	" WHERE room_nid = $1 AND event_state_key_nid = 0 AND roomserver_event_json.event_nid > $2" +
+	" ORDER BY roomserver_event_json.event_nid ASC LIMIT $3"
+
+const bulkDeleteEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY($1)"
+
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt          *sql.Stmt
+	bulkSelectEventJSONStmt      *sql.Stmt
+	selectPurgeableEventJSONStmt *sql.Stmt
+	bulkDeleteEventJSONStmt      *sql.Stmt
 }
 
 func createEventJSONTable(db *sql.DB) error {
@@ -70,6 +84,8 @@ func prepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectPurgeableEventJSONStmt, selectPurgeableEventJSONSQL},
+		{&s.bulkDeleteEventJSONStmt, bulkDeleteEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -105,3 +121,35 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) SelectPurgeableEventJSON(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]tables.EventJSONPair, error) {
+	rows, err := s.selectPurgeableEventJSONStmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPurgeableEventJSON: rows.close() failed")
+	var results []tables.EventJSONPair
+	for rows.Next() {
+		var eventNID int64
+		var result tables.EventJSONPair
+		if err = rows.Scan(&eventNID, &result.EventJSON); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) BulkDeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	_, err := sqlutil.TxStmt(txn, s.bulkDeleteEventJSONStmt).ExecContext(ctx, pq.Int64Array(nids))
+	return err
+}
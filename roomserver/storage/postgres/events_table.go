@@ -66,7 +66,10 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
 	auth_event_nids BIGINT[] NOT NULL,
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	-- Whether the event was soft-failed, i.e. it passed auth against its
+	-- own state but not against the current state of the room.
+	is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE
 );
 `
 
@@ -111,6 +114,9 @@ const selectEventSentToOutputSQL = "" +
 const updateEventSentToOutputSQL = "" +
 	"UPDATE roomserver_events SET sent_to_output = TRUE WHERE event_nid = $1"
 
+const updateEventSoftFailedSQL = "" +
+	"UPDATE roomserver_events SET is_soft_failed = TRUE WHERE event_nid = $1"
+
 const selectEventIDSQL = "" +
 	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
 
@@ -127,12 +133,18 @@ const bulkSelectEventIDSQL = "" +
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id = ANY($1)"
 
+const bulkSelectEventRejectedSQL = "" +
+	"SELECT event_id, is_rejected, is_soft_failed FROM roomserver_events WHERE event_id = ANY($1)"
+
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid = ANY($1)"
 
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const bulkDeleteEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid = ANY($1)"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -142,13 +154,16 @@ type eventStatements struct {
 	updateEventStateStmt                   *sql.Stmt
 	selectEventSentToOutputStmt            *sql.Stmt
 	updateEventSentToOutputStmt            *sql.Stmt
+	updateEventSoftFailedStmt              *sql.Stmt
 	selectEventIDStmt                      *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
+	bulkSelectEventRejectedStmt            *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
 	selectRoomNIDsForEventNIDsStmt         *sql.Stmt
+	bulkDeleteEventsStmt                   *sql.Stmt
 }
 
 func createEventsTable(db *sql.DB) error {
@@ -167,14 +182,17 @@ func prepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.updateEventSoftFailedStmt, updateEventSoftFailedSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.bulkSelectEventRejectedStmt, bulkSelectEventRejectedSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
+		{&s.bulkDeleteEventsStmt, bulkDeleteEventsSQL},
 	}.Prepare(db)
 }
 
@@ -350,6 +368,12 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 	return err
 }
 
+func (s *eventStatements) UpdateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventSoftFailedStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
@@ -471,6 +495,30 @@ func (s *eventStatements) BulkSelectEventNID(ctx context.Context, eventIDs []str
 	return results, rows.Err()
 }
 
+func (s *eventStatements) BulkSelectEventRejected(ctx context.Context, eventIDs []string) (rejected, softFailed map[string]bool, err error) {
+	rows, err := s.bulkSelectEventRejectedStmt.QueryContext(ctx, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventRejected: rows.close() failed")
+	rejected = make(map[string]bool)
+	softFailed = make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		var isRejected, isSoftFailed bool
+		if err = rows.Scan(&eventID, &isRejected, &isSoftFailed); err != nil {
+			return nil, nil, err
+		}
+		if isRejected {
+			rejected[eventID] = true
+		}
+		if isSoftFailed {
+			softFailed[eventID] = true
+		}
+	}
+	return rejected, softFailed, rows.Err()
+}
+
 func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error) {
 	var result int64
 	stmt := s.selectMaxEventDepthStmt
@@ -501,6 +549,13 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) BulkDeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.bulkDeleteEventsStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
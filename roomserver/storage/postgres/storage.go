@@ -53,6 +53,8 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	m := sqlutil.NewMigrations()
 	deltas.LoadAddForgottenColumn(m)
 	deltas.LoadStateBlocksRefactor(m)
+	deltas.LoadAddSoftFailedColumn(m)
+	deltas.LoadUserDirectory(m)
 	if err := m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -109,6 +111,12 @@ func (d *Database) create(db *sql.DB) error {
 	if err := createRedactionsTable(db); err != nil {
 		return err
 	}
+	if err := createInputQueueTable(db); err != nil {
+		return err
+	}
+	if err := createUserDirectoryTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -170,6 +178,14 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	inputQueue, err := prepareInputQueueTable(db)
+	if err != nil {
+		return err
+	}
+	userDirectory, err := prepareUserDirectoryTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  db,
 		Cache:               cache,
@@ -187,6 +203,8 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		InvitesTable:        invites,
 		MembershipTable:     membership,
 		PublishedTable:      published,
+		InputQueueTable:     inputQueue,
+		UserDirectoryTable:  userDirectory,
 		RedactionsTable:     redactions,
 	}
 	return nil
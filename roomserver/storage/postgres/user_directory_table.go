@@ -0,0 +1,121 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const userDirectorySchema = `
+-- The user directory index, which stores the profile of every user that has
+-- joined a room. It is updated from join events, which also carry profile
+-- changes, and is searched by the words of the user ID and display name.
+CREATE TABLE IF NOT EXISTS roomserver_user_directory (
+	-- Numeric state key ID for the user ID.
+	user_nid BIGINT PRIMARY KEY,
+	-- The display name and avatar URL from the latest join event of the user.
+	display_name TEXT NOT NULL DEFAULT '',
+	avatar_url TEXT NOT NULL DEFAULT '',
+	-- The lowercase words of the user ID and display name, each preceded by a
+	-- space, so that searches can match word prefixes.
+	search_terms TEXT NOT NULL DEFAULT ''
+);
+`
+
+const upsertUserDirectoryProfileSQL = "" +
+	"INSERT INTO roomserver_user_directory (user_nid, display_name, avatar_url, search_terms)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (user_nid) DO UPDATE SET display_name = $2, avatar_url = $3, search_terms = $4"
+
+// selectUserDirectorySQL only returns users that are joined to a room that the
+// searching user is joined to, so that users are only found by those who would
+// ordinarily be able to see them anyway. A search term condition is appended
+// for every search word.
+var selectUserDirectorySQL = "" +
+	"SELECT event_state_key, display_name, avatar_url FROM roomserver_user_directory" +
+	" INNER JOIN roomserver_event_state_keys ON roomserver_user_directory.user_nid = roomserver_event_state_keys.event_state_key_nid" +
+	" WHERE user_nid IN (" +
+	"  SELECT target_nid FROM roomserver_membership WHERE membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) +
+	"  AND room_nid IN (" +
+	"   SELECT room_nid FROM roomserver_membership WHERE target_nid = $1 AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) +
+	"  )" +
+	" )"
+
+type userDirectoryStatements struct {
+	db                             *sql.DB
+	upsertUserDirectoryProfileStmt *sql.Stmt
+}
+
+func createUserDirectoryTable(db *sql.DB) error {
+	_, err := db.Exec(userDirectorySchema)
+	return err
+}
+
+func prepareUserDirectoryTable(db *sql.DB) (tables.UserDirectory, error) {
+	s := &userDirectoryStatements{
+		db: db,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertUserDirectoryProfileStmt, upsertUserDirectoryProfileSQL},
+	}.Prepare(db)
+}
+
+func (s *userDirectoryStatements) UpsertUserDirectoryProfile(
+	ctx context.Context, txn *sql.Tx, userNID types.EventStateKeyNID,
+	displayName, avatarURL, searchTerms string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertUserDirectoryProfileStmt)
+	_, err := stmt.ExecContext(ctx, userNID, displayName, avatarURL, searchTerms)
+	return err
+}
+
+func (s *userDirectoryStatements) SelectUserDirectory(
+	ctx context.Context, searcherNID types.EventStateKeyNID, words []string, limit int,
+) ([]tables.UserDirectoryEntry, error) {
+	// The statement depends on the number of search words, so it can't be prepared.
+	var query strings.Builder
+	query.WriteString(selectUserDirectorySQL)
+	params := []interface{}{searcherNID}
+	for _, word := range words {
+		params = append(params, types.UserDirectoryLikePattern(word))
+		fmt.Fprintf(&query, " AND search_terms LIKE $%d ESCAPE '\\'", len(params))
+	}
+	params = append(params, limit)
+	fmt.Fprintf(&query, " ORDER BY event_state_key LIMIT $%d", len(params))
+
+	rows, err := s.db.QueryContext(ctx, query.String(), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserDirectory: rows.close() failed")
+	var entries []tables.UserDirectoryEntry
+	for rows.Next() {
+		var entry tables.UserDirectoryEntry
+		if err = rows.Scan(&entry.UserID, &entry.DisplayName, &entry.AvatarURL); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -3,6 +3,7 @@ package shared
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -153,6 +154,29 @@ func (u *MembershipUpdater) SetToJoin(senderUserID string, eventID string, isUpd
 	return inviteEventIDs, err
 }
 
+// SetProfile updates the user directory with the profile from the join
+// event of the target user. Profile changes are sent as join events too.
+func (u *MembershipUpdater) SetProfile(event *gomatrixserverlib.Event) error {
+	// Malformed profiles are indexed as an empty profile rather than failing the
+	// join, as the user should still be found by their user ID.
+	var content gomatrixserverlib.MemberContent
+	_ = json.Unmarshal(event.Content(), &content)
+	userID := ""
+	if event.StateKey() != nil {
+		userID = *event.StateKey()
+	}
+	searchTerms := types.UserDirectorySearchTerms(userID, content.DisplayName)
+
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		if err := u.d.UserDirectoryTable.UpsertUserDirectoryProfile(
+			u.ctx, u.txn, u.targetUserNID, content.DisplayName, content.AvatarURL, searchTerms,
+		); err != nil {
+			return fmt.Errorf("u.d.UserDirectoryTable.UpsertUserDirectoryProfile: %w", err)
+		}
+		return nil
+	})
+}
+
 // SetToLeave implements types.MembershipUpdater
 func (u *MembershipUpdater) SetToLeave(senderUserID string, eventID string) ([]string, error) {
 	var inviteEventIDs []string
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -44,6 +45,8 @@ type Database struct {
 	MembershipTable            tables.Membership
 	PublishedTable             tables.Published
 	RedactionsTable            tables.Redactions
+	InputQueueTable            tables.InputQueue
+	UserDirectoryTable         tables.UserDirectory
 	GetLatestEventsForUpdateFn func(ctx context.Context, roomInfo types.RoomInfo) (*LatestEventsUpdater, error)
 }
 
@@ -203,6 +206,20 @@ func (d *Database) EventNIDs(
 	return d.EventsTable.BulkSelectEventNID(ctx, eventIDs)
 }
 
+func (d *Database) EventsRejected(
+	ctx context.Context, eventIDs []string,
+) (rejected, softFailed map[string]bool, err error) {
+	return d.EventsTable.BulkSelectEventRejected(ctx, eventIDs)
+}
+
+func (d *Database) SetSoftFailed(
+	ctx context.Context, eventNID types.EventNID,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EventsTable.UpdateEventSoftFailed(ctx, txn, eventNID)
+	})
+}
+
 func (d *Database) SetState(
 	ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID,
 ) error {
@@ -621,6 +638,24 @@ func (d *Database) GetPublishedRooms(ctx context.Context) ([]string, error) {
 	return d.PublishedTable.SelectAllPublishedRooms(ctx, true)
 }
 
+func (d *Database) QueueInputEvent(ctx context.Context, roomID string, inputEvent []byte) (queueNID int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		queueNID, err = d.InputQueueTable.InsertInputEvent(ctx, txn, roomID, inputEvent)
+		return err
+	})
+	return
+}
+
+func (d *Database) RemoveQueuedInputEvent(ctx context.Context, queueNID int64) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.InputQueueTable.DeleteInputEvent(ctx, txn, queueNID)
+	})
+}
+
+func (d *Database) QueuedInputEvents(ctx context.Context) ([]tables.QueuedInputEvent, error) {
+	return d.InputQueueTable.SelectInputEvents(ctx)
+}
+
 func (d *Database) assignRoomNID(
 	ctx context.Context, txn *sql.Tx,
 	roomID string, roomVersion gomatrixserverlib.RoomVersion,
@@ -1076,13 +1111,21 @@ func (d *Database) GetServerInRoom(ctx context.Context, roomNID types.RoomNID, s
 	return d.MembershipTable.SelectServerInRoom(ctx, roomNID, serverName)
 }
 
-// GetKnownUsers searches all users that userID knows about.
-func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error) {
+// GetServersInRoom returns the distinct set of servers that have joined members in a given room.
+func (d *Database) GetServersInRoom(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.ServerName, error) {
+	return d.MembershipTable.SelectServersInRoom(ctx, roomNID)
+}
+
+// GetKnownUsers searches the user directory for users that userID knows about.
+func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]tables.UserDirectoryEntry, error) {
 	stateKeyNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		// The user has never been in a room, so doesn't know about anyone.
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
-	return d.MembershipTable.SelectKnownUsers(ctx, stateKeyNID, searchString, limit)
+	return d.UserDirectoryTable.SelectUserDirectory(ctx, stateKeyNID, types.UserDirectoryWords(searchString), limit)
 }
 
 // GetKnownRooms returns a list of all rooms we know about.
@@ -1090,6 +1133,77 @@ func (d *Database) GetKnownRooms(ctx context.Context) ([]string, error) {
 	return d.RoomsTable.SelectRoomIDs(ctx)
 }
 
+// purgeBatchSize is the number of events which are considered for purging at a time.
+const purgeBatchSize = 100
+
+// PurgeExpiredEvents removes non-state events in the room which were sent before the
+// given time, other than the latest events in the room. Both the event JSON and the
+// event itself are deleted, so that the events are treated as unknown afterwards.
+func (d *Database) PurgeExpiredEvents(
+	ctx context.Context, roomInfo *types.RoomInfo, before time.Time,
+) (eventIDs []string, eventJSONs [][]byte, err error) {
+	latestNIDs, _, err := d.RoomsTable.SelectLatestEventNIDs(ctx, nil, roomInfo.RoomNID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("d.RoomsTable.SelectLatestEventNIDs: %w", err)
+	}
+	latest := make(map[types.EventNID]bool, len(latestNIDs))
+	for _, nid := range latestNIDs {
+		latest[nid] = true
+	}
+	beforeTS := int64(gomatrixserverlib.AsTimestamp(before))
+	var afterNID types.EventNID
+	for {
+		var pairs []tables.EventJSONPair
+		pairs, err = d.EventJSONTable.SelectPurgeableEventJSON(ctx, roomInfo.RoomNID, afterNID, purgeBatchSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("d.EventJSONTable.SelectPurgeableEventJSON: %w", err)
+		}
+		var nids []types.EventNID
+		var jsons [][]byte
+		expired := true
+		for _, pair := range pairs {
+			afterNID = pair.EventNID
+			// Events are roughly in the order that they were sent, so stop at
+			// the first one which is still within the retention period.
+			if gjson.GetBytes(pair.EventJSON, "origin_server_ts").Int() >= beforeTS {
+				expired = false
+				break
+			}
+			if latest[pair.EventNID] {
+				continue
+			}
+			nids = append(nids, pair.EventNID)
+			jsons = append(jsons, pair.EventJSON)
+		}
+		if len(nids) > 0 {
+			var ids map[types.EventNID]string
+			ids, err = d.EventsTable.BulkSelectEventID(ctx, nids)
+			if err != nil {
+				return nil, nil, fmt.Errorf("d.EventsTable.BulkSelectEventID: %w", err)
+			}
+			err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+				if err = d.EventJSONTable.BulkDeleteEventJSON(ctx, txn, nids); err != nil {
+					return fmt.Errorf("d.EventJSONTable.BulkDeleteEventJSON: %w", err)
+				}
+				if err = d.EventsTable.BulkDeleteEvents(ctx, txn, nids); err != nil {
+					return fmt.Errorf("d.EventsTable.BulkDeleteEvents: %w", err)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, nid := range nids {
+				eventIDs = append(eventIDs, ids[nid])
+			}
+			eventJSONs = append(eventJSONs, jsons...)
+		}
+		if !expired || len(pairs) < purgeBatchSize {
+			return eventIDs, eventJSONs, nil
+		}
+	}
+}
+
 // ForgetRoom sets a users room to forgotten
 func (d *Database) ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error {
 	roomNIDs, err := d.RoomsTable.BulkSelectRoomNIDs(ctx, []string{roomID})
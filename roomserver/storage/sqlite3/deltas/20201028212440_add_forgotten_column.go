@@ -25,6 +25,7 @@ import (
 func LoadFromGoose() {
 	goose.AddMigration(UpAddForgottenColumn, DownAddForgottenColumn)
 	goose.AddMigration(UpStateBlocksRefactor, DownStateBlocksRefactor)
+	goose.AddMigration(UpAddSoftFailedColumn, DownAddSoftFailedColumn)
 }
 
 func LoadAddForgottenColumn(m *sqlutil.Migrations) {
@@ -0,0 +1,49 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAddSoftFailedColumn(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddSoftFailedColumn, DownAddSoftFailedColumn)
+}
+
+func UpAddSoftFailedColumn(tx *sql.Tx) error {
+	// The events table is created with the latest schema before the deltas
+	// run, so the column may already exist.
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('roomserver_events') WHERE name = 'is_soft_failed';`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for column: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE roomserver_events ADD COLUMN is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddSoftFailedColumn(tx *sql.Tx) error {
+	// SQLite can't drop columns, but the column is harmless to leave behind.
+	return nil
+}
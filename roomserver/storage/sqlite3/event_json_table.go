@@ -46,10 +46,24 @@ const bulkSelectEventJSONSQL = `
 	  ORDER BY event_nid ASC
 `
 
+// Select the JSON of non-state events in a room which are candidates for
+// purging by the retention policy.
+const selectPurgeableEventJSONSQL = `
+	SELECT roomserver_event_json.event_nid, event_json FROM roomserver_event_json
+	  JOIN roomserver_events ON roomserver_event_json.event_nid = roomserver_events.event_nid
+	  WHERE room_nid = $1 AND event_state_key_nid = 0 AND roomserver_event_json.event_nid > $2
+	  ORDER BY roomserver_event_json.event_nid ASC LIMIT $3
+`
+
+const bulkDeleteEventJSONSQL = `
+	DELETE FROM roomserver_event_json WHERE event_nid IN ($1)
+`
+
 type eventJSONStatements struct {
-	db                      *sql.DB
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	db                           *sql.DB
+	insertEventJSONStmt          *sql.Stmt
+	bulkSelectEventJSONStmt      *sql.Stmt
+	selectPurgeableEventJSONStmt *sql.Stmt
 }
 
 func createEventJSONTable(db *sql.DB) error {
@@ -65,6 +79,7 @@ func prepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectPurgeableEventJSONStmt, selectPurgeableEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -106,3 +121,41 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], nil
 }
+
+func (s *eventJSONStatements) SelectPurgeableEventJSON(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]tables.EventJSONPair, error) {
+	rows, err := s.selectPurgeableEventJSONStmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPurgeableEventJSON: rows.close() failed")
+	var results []tables.EventJSONPair
+	for rows.Next() {
+		var eventNID int64
+		var result tables.EventJSONPair
+		if err = rows.Scan(&eventNID, &result.EventJSON); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) BulkDeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = int64(v)
+	}
+	deleteSQL := strings.Replace(bulkDeleteEventJSONSQL, "($1)", sqlutil.QueryVariadic(len(iEventNIDs)), 1)
+	deletePrep, err := s.db.Prepare(deleteSQL)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, deletePrep, "bulkDeleteEventJSON: stmt.close() failed")
+	_, err = sqlutil.TxStmt(txn, deletePrep).ExecContext(ctx, iEventNIDs...)
+	return err
+}
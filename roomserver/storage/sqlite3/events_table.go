@@ -42,7 +42,8 @@ const eventsSchema = `
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	is_soft_failed BOOLEAN NOT NULL DEFAULT FALSE
   );
 `
 
@@ -81,6 +82,9 @@ const selectEventSentToOutputSQL = "" +
 const updateEventSentToOutputSQL = "" +
 	"UPDATE roomserver_events SET sent_to_output = TRUE WHERE event_nid = $1"
 
+const updateEventSoftFailedSQL = "" +
+	"UPDATE roomserver_events SET is_soft_failed = TRUE WHERE event_nid = $1"
+
 const selectEventIDSQL = "" +
 	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
 
@@ -97,12 +101,18 @@ const bulkSelectEventIDSQL = "" +
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id IN ($1)"
 
+const bulkSelectEventRejectedSQL = "" +
+	"SELECT event_id, is_rejected, is_soft_failed FROM roomserver_events WHERE event_id IN ($1)"
+
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid IN ($1)"
 
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
 
+const bulkDeleteEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid IN ($1)"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -112,6 +122,7 @@ type eventStatements struct {
 	updateEventStateStmt                   *sql.Stmt
 	selectEventSentToOutputStmt            *sql.Stmt
 	updateEventSentToOutputStmt            *sql.Stmt
+	updateEventSoftFailedStmt              *sql.Stmt
 	selectEventIDStmt                      *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
@@ -137,6 +148,7 @@ func prepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.updateEventSoftFailedStmt, updateEventSoftFailedSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
@@ -364,6 +376,12 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 	return err
 }
 
+func (s *eventStatements) UpdateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	updateStmt := sqlutil.TxStmt(txn, s.updateEventSoftFailedStmt)
+	_, err := updateStmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
@@ -523,6 +541,39 @@ func (s *eventStatements) BulkSelectEventNID(ctx context.Context, eventIDs []str
 	return results, nil
 }
 
+func (s *eventStatements) BulkSelectEventRejected(ctx context.Context, eventIDs []string) (rejected, softFailed map[string]bool, err error) {
+	iEventIDs := make([]interface{}, len(eventIDs))
+	for k, v := range eventIDs {
+		iEventIDs[k] = v
+	}
+	selectOrig := strings.Replace(bulkSelectEventRejectedSQL, "($1)", sqlutil.QueryVariadic(len(iEventIDs)), 1)
+	selectStmt, err := s.db.Prepare(selectOrig)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := selectStmt.QueryContext(ctx, iEventIDs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventRejected: rows.close() failed")
+	rejected = make(map[string]bool)
+	softFailed = make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		var isRejected, isSoftFailed bool
+		if err = rows.Scan(&eventID, &isRejected, &isSoftFailed); err != nil {
+			return nil, nil, err
+		}
+		if isRejected {
+			rejected[eventID] = true
+		}
+		if isSoftFailed {
+			softFailed[eventID] = true
+		}
+	}
+	return rejected, softFailed, rows.Err()
+}
+
 func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error) {
 	var result int64
 	iEventIDs := make([]interface{}, len(eventNIDs))
@@ -570,6 +621,23 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) BulkDeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = int64(v)
+	}
+	deleteSQL := strings.Replace(bulkDeleteEventsSQL, "($1)", sqlutil.QueryVariadic(len(iEventNIDs)), 1)
+	deletePrep, err := s.db.Prepare(deleteSQL)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, deletePrep, "bulkDeleteEvents: stmt.close() failed")
+	_, err = sqlutil.TxStmt(txn, deletePrep).ExecContext(ctx, iEventNIDs...)
+	return err
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
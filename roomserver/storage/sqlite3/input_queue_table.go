@@ -0,0 +1,109 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const inputQueueSchema = `
+-- Stores input events that have been accepted but not yet processed, so
+-- that they can be replayed if the process stops before processing them.
+CREATE TABLE IF NOT EXISTS roomserver_input_queue (
+    -- The position of the event in the queue
+    queue_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The room ID of the event
+    room_id TEXT NOT NULL,
+    -- The JSON encoded api.InputRoomEvent
+    input_event TEXT NOT NULL
+);
+`
+
+const insertInputEventSQL = "" +
+	"INSERT INTO roomserver_input_queue (room_id, input_event) VALUES ($1, $2)"
+
+const deleteInputEventSQL = "" +
+	"DELETE FROM roomserver_input_queue WHERE queue_nid = $1"
+
+const selectInputEventsSQL = "" +
+	"SELECT queue_nid, room_id, input_event FROM roomserver_input_queue ORDER BY queue_nid ASC"
+
+type inputQueueStatements struct {
+	db                    *sql.DB
+	insertInputEventStmt  *sql.Stmt
+	deleteInputEventStmt  *sql.Stmt
+	selectInputEventsStmt *sql.Stmt
+}
+
+func createInputQueueTable(db *sql.DB) error {
+	_, err := db.Exec(inputQueueSchema)
+	return err
+}
+
+func prepareInputQueueTable(db *sql.DB) (tables.InputQueue, error) {
+	s := &inputQueueStatements{
+		db: db,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertInputEventStmt, insertInputEventSQL},
+		{&s.deleteInputEventStmt, deleteInputEventSQL},
+		{&s.selectInputEventsStmt, selectInputEventsSQL},
+	}.Prepare(db)
+}
+
+func (s *inputQueueStatements) InsertInputEvent(
+	ctx context.Context, txn *sql.Tx, roomID string, inputEvent []byte,
+) (int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.insertInputEventStmt)
+	res, err := stmt.ExecContext(ctx, roomID, inputEvent)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *inputQueueStatements) DeleteInputEvent(
+	ctx context.Context, txn *sql.Tx, queueNID int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteInputEventStmt)
+	_, err := stmt.ExecContext(ctx, queueNID)
+	return err
+}
+
+func (s *inputQueueStatements) SelectInputEvents(
+	ctx context.Context,
+) ([]tables.QueuedInputEvent, error) {
+	rows, err := s.selectInputEventsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectInputEventsStmt: rows.close() failed")
+
+	var events []tables.QueuedInputEvent
+	for rows.Next() {
+		var ev tables.QueuedInputEvent
+		if err = rows.Scan(&ev.QueueNID, &ev.RoomID, &ev.InputEvent); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
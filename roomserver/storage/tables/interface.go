@@ -19,6 +19,11 @@ type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 	BulkSelectEventJSON(ctx context.Context, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	// SelectPurgeableEventJSON returns the JSON of up to limit non-state events in the room with a
+	// numeric ID greater than afterEventNID, ordered by numeric event ID.
+	SelectPurgeableEventJSON(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]EventJSONPair, error)
+	// BulkDeleteEventJSON deletes the JSON of the given events.
+	BulkDeleteEventJSON(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
 }
 
 type EventTypes interface {
@@ -51,6 +56,7 @@ type Events interface {
 	UpdateEventState(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	SelectEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error)
 	UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	UpdateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
 	SelectEventID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (eventID string, err error)
 	BulkSelectStateAtEventAndReference(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]types.StateAtEventAndReference, error)
 	BulkSelectEventReference(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]gomatrixserverlib.EventReference, error)
@@ -59,8 +65,13 @@ type Events interface {
 	// BulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 	// If an event ID is not in the database then it is omitted from the map.
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	// BulkSelectEventRejected returns the sets of event IDs which were rejected or soft-failed.
+	// If an event ID is not in the database then it is omitted from both sets.
+	BulkSelectEventRejected(ctx context.Context, eventIDs []string) (rejected, softFailed map[string]bool, err error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
+	// BulkDeleteEvents deletes the given events, so that they are treated as unknown from then on.
+	BulkDeleteEvents(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error
 }
 
 type Rooms interface {
@@ -134,10 +145,11 @@ type Membership interface {
 	// SelectJoinedUsersSetForRooms returns the set of all users in the rooms who are joined to any of these rooms, along with the
 	// counts of how many rooms they are joined.
 	SelectJoinedUsersSetForRooms(ctx context.Context, roomNIDs []types.RoomNID) (map[types.EventStateKeyNID]int, error)
-	SelectKnownUsers(ctx context.Context, userID types.EventStateKeyNID, searchString string, limit int) ([]string, error)
 	UpdateForgetMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, forget bool) error
 	SelectLocalServerInRoom(ctx context.Context, roomNID types.RoomNID) (bool, error)
 	SelectServerInRoom(ctx context.Context, roomNID types.RoomNID, serverName gomatrixserverlib.ServerName) (bool, error)
+	// SelectServersInRoom returns the distinct server names of the joined members of the room.
+	SelectServersInRoom(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.ServerName, error)
 }
 
 type Published interface {
@@ -146,6 +158,37 @@ type Published interface {
 	SelectAllPublishedRooms(ctx context.Context, published bool) ([]string, error)
 }
 
+// QueuedInputEvent is an input event that was accepted but not yet processed.
+type QueuedInputEvent struct {
+	QueueNID   int64
+	RoomID     string
+	InputEvent []byte
+}
+
+type InputQueue interface {
+	InsertInputEvent(ctx context.Context, txn *sql.Tx, roomID string, inputEvent []byte) (queueNID int64, err error)
+	DeleteInputEvent(ctx context.Context, txn *sql.Tx, queueNID int64) error
+	// SelectInputEvents returns all queued input events in the order they were queued.
+	SelectInputEvents(ctx context.Context) ([]QueuedInputEvent, error)
+}
+
+// UserDirectoryEntry is a user found in the user directory.
+type UserDirectoryEntry struct {
+	UserID      string
+	DisplayName string
+	AvatarURL   string
+}
+
+type UserDirectory interface {
+	// UpsertUserDirectoryProfile stores the profile and search terms of a user, as
+	// taken from their latest join event.
+	UpsertUserDirectoryProfile(ctx context.Context, txn *sql.Tx, userNID types.EventStateKeyNID, displayName, avatarURL, searchTerms string) error
+	// SelectUserDirectory returns the users which are joined to a room that the
+	// searching user is joined to, and for each of the given words have a word
+	// in their search terms starting with it.
+	SelectUserDirectory(ctx context.Context, searcherNID types.EventStateKeyNID, words []string, limit int) ([]UserDirectoryEntry, error)
+}
+
 type RedactionInfo struct {
 	// whether this redaction is validated (we have both events)
 	Validated bool
@@ -182,7 +225,8 @@ func ExtractContentValue(ev *gomatrixserverlib.HeaderedEvent) string {
 	key := ""
 	switch ev.Type() {
 	case gomatrixserverlib.MRoomCreate:
-		key = "creator"
+		// The room type, e.g. m.space. The creator is always the sender.
+		key = "type"
 	case gomatrixserverlib.MRoomCanonicalAlias:
 		key = "alias"
 	case gomatrixserverlib.MRoomHistoryVisibility:
@@ -24,3 +24,17 @@ func TestDeduplicateStateEntries(t *testing.T) {
 		}
 	}
 }
+
+func TestUserDirectoryLikePattern(t *testing.T) {
+	tests := map[string]string{
+		"alice":   `% alice%`,
+		"100%":    `% 100\%%`,
+		"a_b":     `% a\_b%`,
+		`back\sl`: `% back\\sl%`,
+	}
+	for word, want := range tests {
+		if got := UserDirectoryLikePattern(word); got != want {
+			t.Errorf("UserDirectoryLikePattern(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"strings"
+	"unicode"
+)
+
+// UserDirectoryWords splits a search string, user ID or display name into the
+// lowercase words used by the user directory. Words are runs of letters and
+// digits.
+func UserDirectoryWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// UserDirectorySearchTerms returns the indexed search terms of a user, which
+// are the words of the user ID and display name. Every word is preceded by a
+// space, so that a search word matches any word it is a prefix of with
+// LIKE '% word%'.
+func UserDirectorySearchTerms(userID, displayName string) string {
+	words := append(UserDirectoryWords(userID), UserDirectoryWords(displayName)...)
+	return " " + strings.Join(words, " ") + " "
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// UserDirectoryLikePattern returns the LIKE pattern which matches the search
+// terms of users with a word that the given search word is a prefix of. The
+// pattern must be used with ESCAPE '\'.
+func UserDirectoryLikePattern(word string) string {
+	return "% " + likeEscaper.Replace(word) + "%"
+}
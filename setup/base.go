@@ -31,6 +31,7 @@ import (
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/txnlog"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/atomic"
@@ -132,6 +133,13 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 		}
 	}
 
+	if cfg.Global.FederationDebug.Enabled {
+		txnlog.Default.SetTargets(txnlog.Targets{
+			Servers: cfg.Global.FederationDebug.Servers,
+			Rooms:   cfg.Global.FederationDebug.Rooms,
+		})
+	}
+
 	cache, err := caching.NewInMemoryLRUCache(true)
 	if err != nil {
 		logrus.WithError(err).Warnf("Failed to create cache")
@@ -370,6 +378,9 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 	if b.Cfg.Global.Metrics.Enabled {
 		internalRouter.Handle("/metrics", httputil.WrapHandlerInBasicAuth(promhttp.Handler(), b.Cfg.Global.Metrics.BasicAuth))
 	}
+	if b.Cfg.Global.FederationDebug.Enabled {
+		internalRouter.Handle("/admin/federation_debug", httputil.WrapHandlerInBasicAuth(txnlog.AdminHandler(txnlog.Default), b.Cfg.Global.FederationDebug.BasicAuth))
+	}
 
 	var clientHandler http.Handler
 	clientHandler = b.PublicClientAPIMux
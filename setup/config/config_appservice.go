@@ -92,6 +92,9 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// Whether the application service should also receive ephemeral events,
+	// i.e. receipts, typing notifications and presence (MSC2409)
+	PushEphemeral bool `yaml:"de.sorunome.msc2409.push_ephemeral"`
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
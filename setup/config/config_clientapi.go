@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -15,9 +18,15 @@ type ClientAPI struct {
 	// If set disables new users from registering (except via shared
 	// secrets)
 	RegistrationDisabled bool `yaml:"registration_disabled"`
+	// If set, prevents guest accounts from being registered.
+	GuestsDisabled bool `yaml:"guests_disabled"`
 	// If set, allows registration by anyone who also has the shared
 	// secret, even if registration is otherwise disabled.
 	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+	// If set, users must provide a registration token to register (except
+	// via shared secrets or application services). Tokens are managed with
+	// the registration tokens admin endpoints.
+	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
 
 	// Boolean stating whether catpcha registration is enabled
 	// and required
@@ -38,6 +47,30 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// The maximum length of a presence status message, in characters. Longer
+	// status messages are rejected, whether they are set by local clients or
+	// received over federation. 0 means no limit.
+	PresenceStatusMsgMaxLength int `yaml:"presence_status_msg_max_length"`
+
+	// Which state events may be redacted by clients.
+	Redactions Redactions `yaml:"redactions"`
+
+	// The admin endpoint for listing the servers participating in a room.
+	RoomServersAdmin AdminEndpoint `yaml:"room_servers_admin"`
+
+	// The admin endpoints for inspecting and managing federation backoff.
+	FederationAdmin AdminEndpoint `yaml:"federation_admin"`
+
+	// The admin endpoints for managing registration tokens.
+	RegistrationTokensAdmin AdminEndpoint `yaml:"registration_tokens_admin"`
+
+	// Verification of email addresses by the homeserver itself, rather than
+	// through an identity server.
+	Email EmailVerification `yaml:"email"`
+
+	// Single sign-on (m.login.sso) through OpenID Connect providers.
+	SSO SSO `yaml:"sso"`
+
 	MSCs *MSCs `yaml:"mscs"`
 }
 
@@ -52,7 +85,15 @@ func (c *ClientAPI) Defaults() {
 	c.RecaptchaBypassSecret = ""
 	c.RecaptchaSiteVerifyAPI = ""
 	c.RegistrationDisabled = false
+	c.GuestsDisabled = false
+	c.RegistrationRequiresToken = false
 	c.RateLimiting.Defaults()
+	c.PresenceStatusMsgMaxLength = 256
+	c.RoomServersAdmin.Enabled = false
+	c.FederationAdmin.Enabled = false
+	c.RegistrationTokensAdmin.Enabled = false
+	c.Email.Defaults()
+	c.Redactions.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -66,8 +107,198 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", string(c.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", string(c.RecaptchaSiteVerifyAPI))
 	}
+	checkPositive(configErrs, "client_api.presence_status_msg_max_length", int64(c.PresenceStatusMsgMaxLength))
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.RoomServersAdmin.Verify(configErrs, "client_api.room_servers_admin")
+	c.FederationAdmin.Verify(configErrs, "client_api.federation_admin")
+	c.RegistrationTokensAdmin.Verify(configErrs, "client_api.registration_tokens_admin")
+	c.Email.Verify(configErrs)
+	c.SSO.Verify(configErrs)
+}
+
+type Redactions struct {
+	// State event types which clients may not redact, as doing so can break
+	// the room. Redactions of any other event follow the room version rules.
+	ProtectedStateEvents []string `yaml:"protected_state_events"`
+}
+
+func (r *Redactions) Defaults() {
+	r.ProtectedStateEvents = []string{"m.room.create", "m.room.power_levels"}
+}
+
+// IsProtected returns true if clients may not redact state events of the
+// given type.
+func (r *Redactions) IsProtected(eventType string) bool {
+	for _, protected := range r.ProtectedStateEvents {
+		if protected == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// The configuration for a set of admin endpoints
+type AdminEndpoint struct {
+	// Whether or not the endpoints are enabled
+	Enabled bool `yaml:"enabled"`
+	// HTTP basic authentication to protect the endpoints
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+}
+
+func (c *AdminEndpoint) Verify(configErrs *ConfigErrors, configKey string) {
+	if c.Enabled {
+		checkNotEmpty(configErrs, configKey+".basic_auth.username", c.BasicAuth.Username)
+		checkNotEmpty(configErrs, configKey+".basic_auth.password", c.BasicAuth.Password)
+	}
+}
+
+// The configuration for verifying email addresses without an identity server
+type EmailVerification struct {
+	// Whether or not the homeserver sends the validation emails itself
+	Enabled bool `yaml:"enabled"`
+	// Whether or not new users must verify an email address to register
+	RequireForRegistration bool `yaml:"require_for_registration"`
+	// The public URL of the client API, used to build the validation links
+	// sent in the emails, e.g. https://matrix.example.com
+	PublicBaseURL string `yaml:"public_base_url"`
+	// How long a validation token can be used for after it was sent
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+	// The SMTP server used to send the emails
+	SMTP struct {
+		// The address of the server, as host:port
+		Host     string `yaml:"host"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		// The address the emails are sent from
+		From string `yaml:"from"`
+	} `yaml:"smtp"`
+}
+
+func (c *EmailVerification) Defaults() {
+	c.Enabled = false
+	c.RequireForRegistration = false
+	c.TokenLifetime = time.Hour
+}
+
+func (c *EmailVerification) Verify(configErrs *ConfigErrors) {
+	if c.RequireForRegistration && !c.Enabled {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: email verification must be enabled", "client_api.email.require_for_registration"))
+	}
+	if c.Enabled {
+		checkURL(configErrs, "client_api.email.public_base_url", c.PublicBaseURL)
+		checkPositive(configErrs, "client_api.email.token_lifetime", int64(c.TokenLifetime))
+		checkNotEmpty(configErrs, "client_api.email.smtp.host", c.SMTP.Host)
+		checkNotEmpty(configErrs, "client_api.email.smtp.from", c.SMTP.From)
+	}
+}
+
+// The configuration for single sign-on through OpenID Connect providers
+type SSO struct {
+	// Whether or not users can log in with the identity providers
+	Enabled bool `yaml:"enabled"`
+	// The public URL of the client API, used to build the URL which the
+	// identity providers redirect users back to, e.g. https://matrix.example.com
+	PublicBaseURL string `yaml:"public_base_url"`
+	// The URLs of the clients which users can be sent back to with a login
+	// token. A client URL is allowed if it has the same scheme and host as
+	// one of these and its path starts with the path of it.
+	AllowedRedirectURLs []string `yaml:"allowed_redirect_urls"`
+	// The identity providers users can log in with
+	Providers []IdentityProvider `yaml:"providers"`
+}
+
+// The configuration for an OpenID Connect identity provider
+type IdentityProvider struct {
+	// The ID of the provider, which is used in URLs and to remember which
+	// accounts its users were mapped to, so it shouldn't change
+	ID string `yaml:"id"`
+	// The name of the provider shown to users
+	Name string `yaml:"name"`
+	// An optional mxc:// URI of the icon shown to users
+	Icon string `yaml:"icon"`
+	// The issuer URL of the provider, from which the OpenID Connect discovery
+	// document is fetched
+	Issuer string `yaml:"issuer"`
+	// The credentials of the homeserver at the provider
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The scopes requested from the provider, defaults to openid and profile
+	Scopes []string `yaml:"scopes"`
+	// The claim the localpart of new users is derived from, defaults to
+	// preferred_username. The subject (sub) is used if the claim is missing.
+	LocalpartClaim string `yaml:"localpart_claim"`
+	// The claim the display name of new users is taken from, defaults to name
+	DisplayNameClaim string `yaml:"display_name_claim"`
+	// Whether or not accounts are created for users of the provider who
+	// haven't logged in before
+	AllowRegistration bool `yaml:"allow_registration"`
+}
+
+var validIdentityProviderID = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,255}$`)
+
+func (c *SSO) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkURL(configErrs, "client_api.sso.public_base_url", c.PublicBaseURL)
+	if len(c.AllowedRedirectURLs) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key %q", "client_api.sso.allowed_redirect_urls"))
+	}
+	for _, allowed := range c.AllowedRedirectURLs {
+		// Mobile clients may use their own URL schemes, so these aren't
+		// restricted to http:// and https://.
+		if u, err := url.Parse(allowed); err != nil || !u.IsAbs() || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "client_api.sso.allowed_redirect_urls", allowed))
+		}
+	}
+	if len(c.Providers) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key %q", "client_api.sso.providers"))
+	}
+	seen := map[string]bool{}
+	for _, p := range c.Providers {
+		if !validIdentityProviderID.MatchString(p.ID) || seen[p.ID] {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "client_api.sso.providers.id", p.ID))
+		}
+		seen[p.ID] = true
+		checkNotEmpty(configErrs, "client_api.sso.providers.name", p.Name)
+		checkURL(configErrs, "client_api.sso.providers.issuer", p.Issuer)
+		checkNotEmpty(configErrs, "client_api.sso.providers.client_id", p.ClientID)
+	}
+}
+
+// RedirectURLAllowed returns whether users can be sent back to the given
+// client URL with a login token.
+func (c *SSO) RedirectURLAllowed(redirectURL string) bool {
+	u, err := url.Parse(redirectURL)
+	if err != nil || !u.IsAbs() {
+		return false
+	}
+	for _, allowed := range c.AllowedRedirectURLs {
+		a, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, a.Scheme) && strings.EqualFold(u.Host, a.Host) &&
+			u.User == nil && strings.HasPrefix(u.Path, a.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Provider returns the identity provider with the given ID, or nil if there
+// is none.
+func (c *SSO) Provider(id string) *IdentityProvider {
+	for i := range c.Providers {
+		if c.Providers[i].ID == id {
+			return &c.Providers[i]
+		}
+	}
+	return nil
 }
 
 type TURN struct {
@@ -1,5 +1,13 @@
 package config
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 type FederationAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -12,12 +20,199 @@ type FederationAPI struct {
 	// to match one of these certificates.
 	// The certificates should be in PEM format.
 	FederationCertificatePaths []Path `yaml:"federation_certificates"`
+
+	// How many times to retry sending an event received over federation to the
+	// roomserver when it fails transiently, e.g. because the roomserver is
+	// restarting. Retries use an exponential backoff. 0 disables retries.
+	SendEventsRetries int `yaml:"send_events_retries"`
+
+	// Whether to accept a leave over federation for a user whose previous
+	// membership was ban. The spec allows this, but some deployments treat
+	// bans as sticky and would rather reject it outright.
+	AllowLeaveFromBan bool `yaml:"allow_leave_from_ban"`
+
+	// Whether to point servers at the replacement room in the response to
+	// /send_leave when the room has been tombstoned, so that they can guide
+	// the user to the new room. The leave is accepted either way.
+	LeaveTombstoneHint bool `yaml:"leave_tombstone_hint"`
+
+	// Whether the key that signed a leave or knock received over federation
+	// must still be valid now, rather than just when the event was sent.
+	// Turning this off helps with older servers which don't refresh their
+	// keys, but means that events signed with expired keys are accepted.
+	StrictKeyValidity bool `yaml:"strict_key_validity"`
+
+	// How far in the future, in milliseconds, the origin_server_ts of an event
+	// received over federation may be before the event is rejected. This stops
+	// events with wildly wrong timestamps from upsetting ordering and retention.
+	// 0 disables the check.
+	FutureEventToleranceMS int64 `yaml:"future_event_tolerance_ms"`
+
+	// Whether to reject a whole transaction received over federation if
+	// any of its PDUs has bad JSON. By default only the bad PDUs fail.
+	RejectTransactionsWithBadPDUs bool `yaml:"reject_transactions_with_bad_pdus"`
+
+	// Whether to check the content of PDUs received in transactions against
+	// the same content validators as events sent by local clients. Other
+	// servers may be less strict, so this can reject events which are valid
+	// as far as the rest of the room is concerned.
+	ValidateEventContent bool `yaml:"validate_event_content"`
+
+	// Users whose leaves received over federation are accepted but silently
+	// dropped rather than sent into the room. This is a moderation tool and
+	// is empty by default.
+	ShadowBannedUsers []string `yaml:"shadow_banned_users"`
+
+	// Rooms for which /make_leave and /send_leave are accepted. Each entry is
+	// either a regular expression starting with "^", which must match the
+	// whole room ID, or otherwise an exact room ID. If the allowlist is empty
+	// then all rooms are allowed. Rooms matching the denylist are never
+	// allowed, even if they are also in the allowlist.
+	LeaveRoomAllowlist []string `yaml:"leave_room_allowlist"`
+	LeaveRoomDenylist  []string `yaml:"leave_room_denylist"`
+
+	// The maximum number of goroutines used to verify the signatures of a
+	// large batch of events received over federation at once, e.g. when a
+	// server sends many leaves while deactivating an account.
+	SignatureVerifyConcurrency int `yaml:"signature_verify_concurrency"`
+
+	// How long, in milliseconds, to remember that a /send_leave event passed
+	// signature verification, so that retries don't verify it again. Keys
+	// which expire or are revoked may still be trusted for this long, so keep
+	// it short. 0 disables the cache.
+	LeaveSignatureCacheTTLMS int64 `yaml:"leave_signature_cache_ttl_ms"`
+
+	// Servers which may ask /make_leave to include the auth events that it
+	// checked the leave against, for debugging. Empty by default.
+	DebugAuthChainServers []gomatrixserverlib.ServerName `yaml:"debug_auth_chain_servers"`
+
+	// How many levels deep, and how many events in total, to fetch missing
+	// auth events for an event received over federation. Events whose auth
+	// chain can't be fetched within these bounds are soft-failed. 0 means
+	// no limit.
+	MaxAuthChainFetchDepth  int `yaml:"max_auth_chain_fetch_depth"`
+	MaxAuthChainFetchEvents int `yaml:"max_auth_chain_fetch_events"`
+
+	// An HTTP webhook which is called whenever a remote user leaves a room
+	// via /send_leave, for integrating with external systems.
+	LeaveWebhook LeaveWebhook `yaml:"leave_webhook"`
+
+	// Stops accepting leaves from a server for a while if the roomserver
+	// keeps failing to process them.
+	LeaveCircuitBreaker LeaveCircuitBreaker `yaml:"leave_circuit_breaker"`
+}
+
+// The configuration for the webhook called when a remote user leaves a room
+type LeaveWebhook struct {
+	// The URL to POST to. The webhook is disabled if this is empty.
+	URL string `yaml:"url"`
+	// How many times to retry a failed request. Retries use an exponential
+	// backoff. 0 disables retries.
+	MaxRetries int `yaml:"max_retries"`
+	// How long to wait for each request to complete, in milliseconds.
+	TimeoutMS int64 `yaml:"timeout_ms"`
+}
+
+func (c *LeaveWebhook) Defaults() {
+	c.MaxRetries = 3
+	c.TimeoutMS = 5000
+}
+
+func (c *LeaveWebhook) Verify(configErrs *ConfigErrors) {
+	if c.URL == "" {
+		return
+	}
+	checkURL(configErrs, "federation_api.leave_webhook.url", c.URL)
+	checkPositive(configErrs, "federation_api.leave_webhook.max_retries", int64(c.MaxRetries))
+	if c.TimeoutMS < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "federation_api.leave_webhook.timeout_ms", c.TimeoutMS))
+	}
+}
+
+// The configuration for the circuit breaker on leaves received over federation
+type LeaveCircuitBreaker struct {
+	// How many leaves in a row from the same server the roomserver must fail
+	// to process before further leaves from that server are rejected. The
+	// circuit breaker is disabled if this is 0.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// How long to reject leaves from the server for, in milliseconds. After
+	// this the next leave is processed as normal, and the circuit breaker is
+	// reset if it succeeds or tripped again if it fails.
+	CooldownMS int64 `yaml:"cooldown_ms"`
+}
+
+func (c *LeaveCircuitBreaker) Defaults() {
+	c.CooldownMS = 60000
+}
+
+func (c *LeaveCircuitBreaker) Verify(configErrs *ConfigErrors) {
+	if c.FailureThreshold < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must not be negative)", "federation_api.leave_circuit_breaker.failure_threshold", c.FailureThreshold))
+	}
+	if c.FailureThreshold == 0 {
+		return
+	}
+	if c.CooldownMS < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "federation_api.leave_circuit_breaker.cooldown_ms", c.CooldownMS))
+	}
+}
+
+// AllowsDebugAuthChain returns true if the server is in the
+// debug_auth_chain_servers list.
+func (c *FederationAPI) AllowsDebugAuthChain(serverName gomatrixserverlib.ServerName) bool {
+	for _, s := range c.DebugAuthChainServers {
+		if s == serverName {
+			return true
+		}
+	}
+	return false
+}
+
+// IsShadowBanned returns true if the user is in the shadow_banned_users list.
+func (c *FederationAPI) IsShadowBanned(userID string) bool {
+	for _, u := range c.ShadowBannedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// CompileRoomIDPatterns compiles a list of room IDs and room ID regular
+// expressions, as used by leave_room_allowlist and leave_room_denylist, into
+// regular expressions which match the whole room ID.
+func CompileRoomIDPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := compileRoomIDPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("room ID pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func compileRoomIDPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "^") {
+		return regexp.Compile("(?:" + pattern + ")$")
+	}
+	return regexp.Compile("^" + regexp.QuoteMeta(pattern) + "$")
 }
 
 func (c *FederationAPI) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7772"
 	c.InternalAPI.Connect = "http://localhost:7772"
 	c.ExternalAPI.Listen = "http://[::]:8072"
+	c.SendEventsRetries = 3
+	c.AllowLeaveFromBan = true
+	c.StrictKeyValidity = true
+	c.FutureEventToleranceMS = 24 * 60 * 60 * 1000
+	c.SignatureVerifyConcurrency = 8
+	c.MaxAuthChainFetchDepth = 50
+	c.MaxAuthChainFetchEvents = 500
+	c.LeaveWebhook.Defaults()
+	c.LeaveCircuitBreaker.Defaults()
 }
 
 func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -26,6 +221,33 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if !isMonolith {
 		checkURL(configErrs, "federation_api.external_api.listen", string(c.ExternalAPI.Listen))
 	}
+	checkPositive(configErrs, "federation_api.send_events_retries", int64(c.SendEventsRetries))
+	checkPositive(configErrs, "federation_api.future_event_tolerance_ms", c.FutureEventToleranceMS)
+	checkPositive(configErrs, "federation_api.max_auth_chain_fetch_depth", int64(c.MaxAuthChainFetchDepth))
+	checkPositive(configErrs, "federation_api.max_auth_chain_fetch_events", int64(c.MaxAuthChainFetchEvents))
+	if c.SignatureVerifyConcurrency < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "federation_api.signature_verify_concurrency", c.SignatureVerifyConcurrency))
+	}
+	if c.LeaveSignatureCacheTTLMS < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must not be negative)", "federation_api.leave_signature_cache_ttl_ms", c.LeaveSignatureCacheTTLMS))
+	}
+	c.LeaveWebhook.Verify(configErrs)
+	c.LeaveCircuitBreaker.Verify(configErrs)
+	for key, patterns := range map[string][]string{
+		"federation_api.leave_room_allowlist": c.LeaveRoomAllowlist,
+		"federation_api.leave_room_denylist":  c.LeaveRoomDenylist,
+	} {
+		for _, pattern := range patterns {
+			if _, err := compileRoomIDPattern(pattern); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s (%s)", key, pattern, err))
+			}
+		}
+	}
+	for _, userID := range c.ShadowBannedUsers {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "federation_api.shadow_banned_users", userID))
+		}
+	}
 	// TODO: not applicable always, e.g. in demos
 	//checkNotZero(configErrs, "federation_api.federation_certificates", int64(len(c.FederationCertificatePaths)))
 }
@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type FederationSender struct {
 	Matrix *Global `yaml:"-"`
 
@@ -15,6 +20,21 @@ type FederationSender struct {
 	// The default value is 16 if not specified, which is circa 18 hours.
 	FederationMaxRetries uint32 `yaml:"send_max_retries"`
 
+	// The maximum number of PDUs and EDUs that we will include in a single
+	// outbound transaction. The spec allows no more than 50 PDUs and 100 EDUs.
+	MaxPDUsPerTransaction uint32 `yaml:"max_pdus_per_transaction"`
+	MaxEDUsPerTransaction uint32 `yaml:"max_edus_per_transaction"`
+
+	// Adaptively shrink the transaction size for destinations that are timing
+	// out and grow it again for destinations that respond quickly, up to the
+	// maximums above. The learned size is remembered per destination.
+	AdaptiveTransactionSize bool `yaml:"adaptive_transaction_size"`
+
+	// How long PDUs and EDUs are kept in the persistent send queue for
+	// destinations that we can't reach before they are dropped. Zero
+	// means that they are kept until they are sent.
+	QueueTTL time.Duration `yaml:"queue_ttl"`
+
 	// FederationDisableTLSValidation disables the validation of X.509 TLS certs
 	// on remote federation endpoints. This is not recommended in production!
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
@@ -29,6 +49,10 @@ func (c *FederationSender) Defaults() {
 	c.Database.ConnectionString = "file:federationsender.db"
 
 	c.FederationMaxRetries = 16
+	c.MaxPDUsPerTransaction = 50
+	c.MaxEDUsPerTransaction = 50
+	c.AdaptiveTransactionSize = true
+	c.QueueTTL = time.Hour * 24 * 7
 	c.DisableTLSValidation = false
 
 	c.Proxy.Defaults()
@@ -38,6 +62,17 @@ func (c *FederationSender) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "federation_sender.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "federation_sender.internal_api.connect", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "federation_sender.database.connection_string", string(c.Database.ConnectionString))
+	checkNotZero(configErrs, "federation_sender.max_pdus_per_transaction", int64(c.MaxPDUsPerTransaction))
+	checkNotZero(configErrs, "federation_sender.max_edus_per_transaction", int64(c.MaxEDUsPerTransaction))
+	if c.MaxPDUsPerTransaction > 50 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be no more than 50)", "federation_sender.max_pdus_per_transaction", c.MaxPDUsPerTransaction))
+	}
+	if c.MaxEDUsPerTransaction > 100 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be no more than 100)", "federation_sender.max_edus_per_transaction", c.MaxEDUsPerTransaction))
+	}
+	if c.QueueTTL < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s (must not be negative)", "federation_sender.queue_ttl", c.QueueTTL))
+	}
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"math/rand"
+	"regexp"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -38,6 +40,11 @@ type Global struct {
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
 
+	// Disables presence. Presence updates from clients and other servers are
+	// ignored, and no presence is sent in /sync or over federation. This saves
+	// a lot of work on busy servers.
+	DisablePresence bool `yaml:"disable_presence"`
+
 	// List of domains that the server will trust as identity servers to
 	// verify third-party identifiers.
 	// Defaults to an empty array.
@@ -54,6 +61,12 @@ type Global struct {
 
 	// DNS caching options for all outbound HTTP requests
 	DNSCache DNSCacheOptions `yaml:"dns_cache"`
+
+	// Selective logging of federation transactions for debugging
+	FederationDebug FederationDebug `yaml:"federation_debug"`
+
+	// Spam checking of client events, invites, room creation and media uploads
+	SpamChecker SpamChecker `yaml:"spam_checker"`
 }
 
 func (c *Global) Defaults() {
@@ -67,6 +80,8 @@ func (c *Global) Defaults() {
 	c.Metrics.Defaults()
 	c.DNSCache.Defaults()
 	c.Sentry.Defaults()
+	c.FederationDebug.Defaults()
+	c.SpamChecker.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -77,6 +92,8 @@ func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.Metrics.Verify(configErrs, isMonolith)
 	c.Sentry.Verify(configErrs, isMonolith)
 	c.DNSCache.Verify(configErrs, isMonolith)
+	c.FederationDebug.Verify(configErrs, isMonolith)
+	c.SpamChecker.Verify(configErrs, isMonolith)
 }
 
 type OldVerifyKeys struct {
@@ -134,6 +151,80 @@ func (c *Sentry) Defaults() {
 func (c *Sentry) Verify(configErrs *ConfigErrors, isMonolith bool) {
 }
 
+// The configuration to use for logging the contents of federation transactions
+type FederationDebug struct {
+	// Whether or not transaction logging and its admin endpoint are enabled
+	Enabled bool `yaml:"enabled"`
+	// Log transactions to or from these servers
+	Servers []gomatrixserverlib.ServerName `yaml:"servers"`
+	// Log transactions containing events for these rooms
+	Rooms []string `yaml:"rooms"`
+	// HTTP basic authentication to protect the admin endpoint
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+}
+
+func (c *FederationDebug) Defaults() {
+	c.Enabled = false
+}
+
+func (c *FederationDebug) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.Enabled {
+		checkNotEmpty(configErrs, "global.federation_debug.basic_auth.username", c.BasicAuth.Username)
+		checkNotEmpty(configErrs, "global.federation_debug.basic_auth.password", c.BasicAuth.Password)
+	}
+}
+
+// The configuration for checking client events, invites, room creation and
+// media uploads for spam before accepting them
+type SpamChecker struct {
+	// Regular expressions which are matched against the text in client events,
+	// the name and topic of new rooms and the filenames of uploaded media.
+	// Anything matching one of them is rejected.
+	ContentRules []string `yaml:"content_rules"`
+	// Limits how many invites a single user can send
+	InviteRateLimit struct {
+		// The number of invites allowed per period, or 0 for no limit
+		Invites int `yaml:"invites"`
+		// The period over which invites are counted
+		Period time.Duration `yaml:"period"`
+	} `yaml:"invite_rate_limit"`
+	// An external service which is asked about everything that is checked
+	HTTPCallback struct {
+		// The URL to POST checks to, or empty to disable the callback
+		URL string `yaml:"url"`
+		// How long to wait for the service to respond
+		Timeout time.Duration `yaml:"timeout"`
+		// Whether to allow requests when the service can't be reached
+		FailOpen bool `yaml:"fail_open"`
+	} `yaml:"http_callback"`
+}
+
+func (c *SpamChecker) Defaults() {
+	c.InviteRateLimit.Period = time.Hour
+	c.HTTPCallback.Timeout = time.Second * 10
+	c.HTTPCallback.FailOpen = true
+}
+
+func (c *SpamChecker) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	for _, rule := range c.ContentRules {
+		if _, err := regexp.Compile(rule); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid regular expression %q in config key %q: %s", rule, "global.spam_checker.content_rules", err))
+		}
+	}
+	checkPositive(configErrs, "global.spam_checker.invite_rate_limit.invites", int64(c.InviteRateLimit.Invites))
+	if c.InviteRateLimit.Invites > 0 {
+		checkNotZero(configErrs, "global.spam_checker.invite_rate_limit.period", int64(c.InviteRateLimit.Period))
+		checkPositive(configErrs, "global.spam_checker.invite_rate_limit.period", int64(c.InviteRateLimit.Period))
+	}
+	if c.HTTPCallback.URL != "" {
+		checkURL(configErrs, "global.spam_checker.http_callback.url", c.HTTPCallback.URL)
+		checkPositive(configErrs, "global.spam_checker.http_callback.timeout", int64(c.HTTPCallback.Timeout))
+	}
+}
+
 type DatabaseOptions struct {
 	// The connection string, file:filename.db or postgres://server....
 	ConnectionString DataSource `yaml:"connection_string"`
@@ -6,6 +6,14 @@ type KeyServer struct {
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// How often, in milliseconds, to remove the one-time keys of deleted
+	// devices. 0 disables the cleanup.
+	OneTimeKeyCleanupIntervalMS int64 `yaml:"one_time_key_cleanup_interval_ms"`
+
+	// How old, in milliseconds, an unclaimed one-time key must be before it
+	// is also removed by the cleanup. 0 keeps unclaimed keys forever.
+	OneTimeKeyMaxAgeMS int64 `yaml:"one_time_key_max_age_ms"`
 }
 
 func (c *KeyServer) Defaults() {
@@ -13,10 +21,13 @@ func (c *KeyServer) Defaults() {
 	c.InternalAPI.Connect = "http://localhost:7779"
 	c.Database.Defaults(10)
 	c.Database.ConnectionString = "file:keyserver.db"
+	c.OneTimeKeyCleanupIntervalMS = 60 * 60 * 1000
 }
 
 func (c *KeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "key_server.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "key_server.database.connection_string", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "key_server.one_time_key_cleanup_interval_ms", c.OneTimeKeyCleanupIntervalMS)
+	checkPositive(configErrs, "key_server.one_time_key_max_age_ms", c.OneTimeKeyMaxAgeMS)
 }
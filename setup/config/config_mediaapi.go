@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 )
 
 type MediaAPI struct {
@@ -33,6 +35,162 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// The maximum width or height of a thumbnail that can be requested. default: 2048
+	MaxThumbnailDimension int `yaml:"max_thumbnail_dimension"`
+
+	// The configuration for generating previews of URLs.
+	URLPreviews URLPreviews `yaml:"url_previews"`
+
+	// Where to store media files other than base_path, e.g. so that several
+	// media API instances can share them. base_path is still used as a local
+	// cache of the files.
+	StorageProvider MediaStorageProvider `yaml:"storage_provider"`
+}
+
+// The configuration for storing media files somewhere other than base_path
+type MediaStorageProvider struct {
+	// The type of storage provider, either "s3" or empty to only store media
+	// files in base_path.
+	Type string `yaml:"type"`
+	// The configuration for the "s3" storage provider.
+	S3 S3StorageProvider `yaml:"s3"`
+}
+
+// The configuration for storing media files in an S3 compatible bucket
+type S3StorageProvider struct {
+	// The URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com. Buckets
+	// are addressed in the path rather than the host name, so that any S3
+	// compatible service can be used.
+	Endpoint string `yaml:"endpoint"`
+	// The region to sign requests for, e.g. eu-west-1.
+	Region string `yaml:"region"`
+	// The bucket to store media files in, which must already exist.
+	Bucket string `yaml:"bucket"`
+	// A prefix for the keys of the media files in the bucket, e.g. "media/".
+	Prefix string `yaml:"prefix"`
+	// The credentials to access the bucket with.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+}
+
+func (c *MediaStorageProvider) Verify(configErrs *ConfigErrors) {
+	switch c.Type {
+	case "":
+	case "s3":
+		checkURL(configErrs, "media_api.storage_provider.s3.endpoint", c.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.storage_provider.s3.region", c.S3.Region)
+		checkNotEmpty(configErrs, "media_api.storage_provider.s3.bucket", c.S3.Bucket)
+		checkNotEmpty(configErrs, "media_api.storage_provider.s3.access_key_id", c.S3.AccessKeyID)
+		checkNotEmpty(configErrs, "media_api.storage_provider.s3.secret_access_key", c.S3.SecretAccessKey)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.storage_provider.type", c.Type))
+	}
+}
+
+// The configuration for the /preview_url endpoint
+type URLPreviews struct {
+	// Whether to generate previews of URLs for clients. The server fetches
+	// the pages itself, so make sure that ip_range_denylist covers any
+	// internal networks before enabling this.
+	Enabled bool `yaml:"enabled"`
+	// URLs which can be previewed, as regular expressions which must match
+	// the whole URL. If the allowlist is empty then all URLs can be. URLs
+	// matching the denylist are never previewed.
+	URLAllowlist []string `yaml:"url_allowlist"`
+	URLDenylist  []string `yaml:"url_denylist"`
+	// IP ranges in CIDR notation which previews are never fetched from, even
+	// by following a redirect. Defaults to the loopback, private, link-local
+	// and other special purpose ranges.
+	IPRangeDenylist []string `yaml:"ip_range_denylist"`
+	// The maximum size of a page or image to fetch, in bytes.
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// How long to wait for a page or image to be fetched, in milliseconds.
+	TimeoutMS int64 `yaml:"timeout_ms"`
+	// How long to reuse a preview for before fetching the page again, in
+	// milliseconds. 0 means that pages are fetched every time.
+	CacheLifetimeMS int64 `yaml:"cache_lifetime_ms"`
+}
+
+// DefaultURLPreviewIPRangeDenylist are the IP ranges which URL previews are
+// never fetched from by default.
+var DefaultURLPreviewIPRangeDenylist = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"169.254.0.0/16",
+	"192.88.99.0/24",
+	"198.18.0.0/15",
+	"192.0.2.0/24",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"0.0.0.0/8",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+	"2001:db8::/32",
+	"ff00::/8",
+	"fec0::/10",
+}
+
+func (c *URLPreviews) Defaults() {
+	c.IPRangeDenylist = DefaultURLPreviewIPRangeDenylist
+	c.MaxPageSizeBytes = 10485760
+	c.TimeoutMS = 10000
+	c.CacheLifetimeMS = 86400000
+}
+
+func (c *URLPreviews) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if _, err := CompileURLPatterns(c.URLAllowlist); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.url_previews.url_allowlist", err))
+	}
+	if _, err := CompileURLPatterns(c.URLDenylist); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.url_previews.url_denylist", err))
+	}
+	if _, err := ParseIPRanges(c.IPRangeDenylist); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.url_previews.ip_range_denylist", err))
+	}
+	if c.MaxPageSizeBytes < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "media_api.url_previews.max_page_size_bytes", c.MaxPageSizeBytes))
+	}
+	if c.TimeoutMS < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "media_api.url_previews.timeout_ms", c.TimeoutMS))
+	}
+	checkPositive(configErrs, "media_api.url_previews.cache_lifetime_ms", c.CacheLifetimeMS)
+}
+
+// CompileURLPatterns compiles the regular expressions in url_allowlist and
+// url_denylist so that they must match the whole URL.
+func CompileURLPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("URL pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// ParseIPRanges parses the CIDR ranges in ip_range_denylist.
+func ParseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -47,7 +205,9 @@ func (c *MediaAPI) Defaults() {
 
 	c.MaxFileSizeBytes = &DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.MaxThumbnailDimension = 2048
 	c.BasePath = "./media_store"
+	c.URLPreviews.Defaults()
 }
 
 func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -62,8 +222,20 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(*c.MaxFileSizeBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
 
+	checkPositive(configErrs, "media_api.max_thumbnail_dimension", int64(c.MaxThumbnailDimension))
+	c.URLPreviews.Verify(configErrs)
+	c.StorageProvider.Verify(configErrs)
+
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
+		if size.Width > c.MaxThumbnailDimension || size.Height > c.MaxThumbnailDimension {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: must not be greater than media_api.max_thumbnail_dimension", fmt.Sprintf("media_api.thumbnail_sizes[%d]", i)))
+		}
+		switch size.ResizeMethod {
+		case "", "crop", "scale":
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.thumbnail_sizes[%d].method", i), size.ResizeMethod))
+		}
 	}
 }
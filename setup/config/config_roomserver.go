@@ -1,11 +1,20 @@
 package config
 
+import "time"
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// Whether to record input events in the database before processing them,
+	// so that they are replayed on startup if we stopped before processing them.
+	WriteAheadQueue bool `yaml:"write_ahead_queue"`
+
+	// Message retention policies (MSC1763).
+	Retention RetentionOptions `yaml:"retention"`
 }
 
 func (c *RoomServer) Defaults() {
@@ -13,10 +22,59 @@ func (c *RoomServer) Defaults() {
 	c.InternalAPI.Connect = "http://localhost:7770"
 	c.Database.Defaults(10)
 	c.Database.ConnectionString = "file:roomserver.db"
+	c.Retention.Defaults()
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	c.Retention.Verify(configErrs, isMonolith)
+}
+
+type RetentionOptions struct {
+	// Whether to purge events which have outlived the retention policy of
+	// their room.
+	Enabled bool `yaml:"enabled"`
+	// How long to keep events for in rooms which don't have a max_lifetime
+	// in their m.room.retention event. 0 keeps them forever.
+	DefaultMaxLifetime time.Duration `yaml:"default_max_lifetime"`
+	// The range that a room's max_lifetime is clamped to. 0 means no limit.
+	AllowedLifetimeMin time.Duration `yaml:"allowed_lifetime_min"`
+	AllowedLifetimeMax time.Duration `yaml:"allowed_lifetime_max"`
+	// How often to look for expired events.
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+func (c *RetentionOptions) Defaults() {
+	c.Enabled = false
+	c.PurgeInterval = time.Hour
+}
+
+func (c *RetentionOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "room_server.retention.purge_interval", int64(c.PurgeInterval))
+	if c.DefaultMaxLifetime < 0 {
+		configErrs.Add("room_server.retention.default_max_lifetime must not be negative")
+	}
+	if c.AllowedLifetimeMin < 0 || c.AllowedLifetimeMax < 0 {
+		configErrs.Add("room_server.retention.allowed_lifetime_min and allowed_lifetime_max must not be negative")
+	}
+	if c.AllowedLifetimeMax > 0 && c.AllowedLifetimeMin > c.AllowedLifetimeMax {
+		configErrs.Add("room_server.retention.allowed_lifetime_min must not be greater than allowed_lifetime_max")
+	}
+}
+
+// ClampLifetime returns the given max_lifetime from a room's retention
+// policy, limited to the allowed range.
+func (c *RetentionOptions) ClampLifetime(lifetime time.Duration) time.Duration {
+	if c.AllowedLifetimeMin > 0 && lifetime < c.AllowedLifetimeMin {
+		return c.AllowedLifetimeMin
+	}
+	if c.AllowedLifetimeMax > 0 && lifetime > c.AllowedLifetimeMax {
+		return c.AllowedLifetimeMax
+	}
+	return lifetime
 }
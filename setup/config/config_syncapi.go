@@ -1,5 +1,17 @@
 package config
 
+import "fmt"
+
+// The policies for handling invites from users that the invitee is ignoring.
+const (
+	// Show invites from ignored users as normal.
+	IgnoredUserInvitesAllow = "allow"
+	// Don't show invites from ignored users in /sync.
+	IgnoredUserInvitesHide = "hide"
+	// Reject invites from ignored users automatically.
+	IgnoredUserInvitesReject = "reject"
+)
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -9,6 +21,52 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	// Whether soft-failed events should be returned from /messages. They are
+	// hidden by default, as they are from /sync, but moderation tooling may
+	// want to see them. Rejected events are never returned.
+	MessagesIncludeSoftFailed bool `yaml:"messages_include_soft_failed"`
+
+	// What to do with invites from users that are in the invitee's
+	// m.ignored_user_list: one of "allow", "hide" or "reject".
+	IgnoredUserInvites string `yaml:"ignored_user_invites"`
+
+	// The maximum number of rooms to build /sync responses for concurrently.
+	// Higher values speed up syncs after a long gap at the cost of CPU and
+	// database load.
+	RoomSyncConcurrency int `yaml:"room_sync_concurrency"`
+
+	// The admin endpoint for exporting all of the data held about a user.
+	UserDataExport UserDataExport `yaml:"user_data_export"`
+}
+
+// The configuration for the user data export admin endpoint
+type UserDataExport struct {
+	// Whether or not the export endpoint is enabled
+	Enabled bool `yaml:"enabled"`
+	// HTTP basic authentication to protect the endpoint
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+	// How many events to read from the database at a time
+	BatchSize int `yaml:"batch_size"`
+}
+
+func (c *UserDataExport) Defaults() {
+	c.Enabled = false
+	c.BatchSize = 1000
+}
+
+func (c *UserDataExport) Verify(configErrs *ConfigErrors) {
+	if c.Enabled {
+		// Unlike metrics, the export must never be served unauthenticated.
+		checkNotEmpty(configErrs, "sync_api.user_data_export.basic_auth.username", c.BasicAuth.Username)
+		checkNotEmpty(configErrs, "sync_api.user_data_export.basic_auth.password", c.BasicAuth.Password)
+	}
+	if c.BatchSize < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "sync_api.user_data_export.batch_size", c.BatchSize))
+	}
 }
 
 func (c *SyncAPI) Defaults() {
@@ -17,6 +75,9 @@ func (c *SyncAPI) Defaults() {
 	c.ExternalAPI.Listen = "http://localhost:8073"
 	c.Database.Defaults(10)
 	c.Database.ConnectionString = "file:syncapi.db"
+	c.IgnoredUserInvites = IgnoredUserInvitesHide
+	c.RoomSyncConcurrency = 256
+	c.UserDataExport.Defaults()
 }
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -26,4 +87,13 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkURL(configErrs, "sync_api.external_api.listen", string(c.ExternalAPI.Listen))
 	}
 	checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
+	if c.RoomSyncConcurrency < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least 1)", "sync_api.room_sync_concurrency", c.RoomSyncConcurrency))
+	}
+	c.UserDataExport.Verify(configErrs)
+	switch c.IgnoredUserInvites {
+	case IgnoredUserInvitesAllow, IgnoredUserInvitesHide, IgnoredUserInvitesReject:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s (must be one of %q, %q or %q)", "sync_api.ignored_user_invites", c.IgnoredUserInvites, IgnoredUserInvitesAllow, IgnoredUserInvitesHide, IgnoredUserInvitesReject))
+	}
 }
@@ -17,6 +17,7 @@ package config
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -32,6 +33,25 @@ func TestLoadConfigRelative(t *testing.T) {
 	}
 }
 
+func TestRetentionClampLifetime(t *testing.T) {
+	c := RetentionOptions{
+		AllowedLifetimeMin: time.Hour,
+		AllowedLifetimeMax: 24 * time.Hour,
+	}
+	for _, tc := range []struct {
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{time.Minute, time.Hour},
+		{2 * time.Hour, 2 * time.Hour},
+		{48 * time.Hour, 24 * time.Hour},
+	} {
+		if got := c.ClampLifetime(tc.lifetime); got != tc.want {
+			t.Errorf("ClampLifetime(%s): got %s, want %s", tc.lifetime, got, tc.want)
+		}
+	}
+}
+
 const testConfig = `
 version: 1
 global:
@@ -57,6 +77,20 @@ global:
     basic_auth:
       username: metrics
       password: metrics
+  federation_debug:
+    enabled: false
+    servers: []
+    rooms: []
+    basic_auth:
+      username: ""
+      password: ""
+  spam_checker:
+    content_rules: []
+    invite_rate_limit:
+      invites: 0
+      period: 1h
+    http_callback:
+      url: ""
 app_service_api:
   internal_api:
     listen: http://localhost:7777
@@ -74,7 +108,9 @@ client_api:
   external_api:
     listen: http://[::]:8071
   registration_disabled: false
+  guests_disabled: false
   registration_shared_secret: ""
+  registration_requires_token: false
   enable_registration_captcha: false
   recaptcha_public_key: ""
   recaptcha_private_key: ""
@@ -86,6 +122,19 @@ client_api:
     turn_shared_secret: ""
     turn_username: ""
     turn_password: ""
+  presence_status_msg_max_length: 256
+  redactions:
+    protected_state_events: [m.room.create, m.room.power_levels]
+  room_servers_admin:
+    enabled: false
+  federation_admin:
+    enabled: false
+  registration_tokens_admin:
+    enabled: false
+  email:
+    enabled: false
+  sso:
+    enabled: false
 current_state_server:
   internal_api:
     listen: http://localhost:7782
@@ -106,6 +155,28 @@ federation_api:
   external_api:
     listen: http://[::]:8072
   federation_certificates: []
+  send_events_retries: 3
+  allow_leave_from_ban: true
+  leave_tombstone_hint: false
+  strict_key_validity: true
+  future_event_tolerance_ms: 86400000
+  reject_transactions_with_bad_pdus: false
+  validate_event_content: false
+  shadow_banned_users: []
+  leave_room_allowlist: []
+  leave_room_denylist: []
+  signature_verify_concurrency: 8
+  leave_signature_cache_ttl_ms: 0
+  debug_auth_chain_servers: []
+  max_auth_chain_fetch_depth: 50
+  max_auth_chain_fetch_events: 500
+  leave_webhook:
+    url: ""
+    max_retries: 3
+    timeout_ms: 5000
+  leave_circuit_breaker:
+    failure_threshold: 0
+    cooldown_ms: 60000
 federation_sender:
   internal_api:
     listen: http://localhost:7775
@@ -116,6 +187,10 @@ federation_sender:
     max_idle_conns: 2
     conn_max_lifetime: -1
   send_max_retries: 16
+  max_pdus_per_transaction: 50
+  max_edus_per_transaction: 50
+  adaptive_transaction_size: true
+  queue_ttl: 168h
   disable_tls_validation: false
   proxy_outbound:
     enabled: false
@@ -131,6 +206,8 @@ key_server:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  one_time_key_cleanup_interval_ms: 3600000
+  one_time_key_max_age_ms: 0
 media_api:
   internal_api:
     listen: http://localhost:7774
@@ -146,6 +223,7 @@ media_api:
   max_file_size_bytes: 10485760
   dynamic_thumbnails: false
   max_thumbnail_generators: 10
+  max_thumbnail_dimension: 2048
   thumbnail_sizes:
   - width: 32
     height: 32
@@ -156,6 +234,22 @@ media_api:
   - width: 640
     height: 480
     method: scale
+  url_previews:
+    enabled: false
+    url_allowlist: []
+    url_denylist: []
+    max_page_size_bytes: 10485760
+    timeout_ms: 10000
+    cache_lifetime_ms: 86400000
+  storage_provider:
+    type: ""
+    s3:
+      endpoint: ""
+      region: ""
+      bucket: ""
+      prefix: ""
+      access_key_id: ""
+      secret_access_key: ""
 room_server:
   internal_api:
     listen: http://localhost:7770
@@ -165,6 +259,10 @@ room_server:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  write_ahead_queue: false
+  retention:
+    enabled: false
+    purge_interval: 1h
 server_key_api:
   internal_api:
     listen: http://localhost:7780
@@ -190,6 +288,12 @@ sync_api:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  messages_include_soft_failed: false
+  ignored_user_invites: hide
+  room_sync_concurrency: 256
+  user_data_export:
+    enabled: false
+    batch_size: 1000
 user_api:
   internal_api:
     listen: http://localhost:7781
@@ -204,6 +308,8 @@ user_api:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+  max_devices_per_user: 0
+  device_limit_policy: reject
 tracing:
   enabled: false
   jaeger:
@@ -1,6 +1,11 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -13,16 +18,41 @@ type UserAPI struct {
 	// The length of time an OpenID token is condidered valid in milliseconds
 	OpenIDTokenLifetimeMS int64 `yaml:"openid_token_lifetime_ms"`
 
+	// How long a login token (m.login.token) can be exchanged for an access
+	// token after it was issued.
+	LoginTokenLifetime time.Duration `yaml:"login_token_lifetime"`
+
+	// How long access tokens are valid for if the client supports refresh
+	// tokens. Zero means that access tokens don't expire and no refresh
+	// tokens are issued.
+	AccessTokenLifetime time.Duration `yaml:"access_token_lifetime"`
+
 	// The Account database stores the login details and account information
 	// for local users. It is accessed by the UserAPI.
 	AccountDatabase DatabaseOptions `yaml:"account_database"`
 	// The Device database stores session information for the devices of logged
 	// in local users. It is accessed by the UserAPI.
 	DeviceDatabase DatabaseOptions `yaml:"device_database"`
+
+	// The maximum number of devices that a single user can have. Zero means
+	// no limit. Appservice users are exempt.
+	MaxDevicesPerUser int `yaml:"max_devices_per_user"`
+	// What to do when a user at the device limit creates a new device, either
+	// "reject" or "evict".
+	DeviceLimitPolicy string `yaml:"device_limit_policy"`
 }
 
+const (
+	// DeviceLimitReject rejects new devices with M_LIMIT_EXCEEDED.
+	DeviceLimitReject = "reject"
+	// DeviceLimitEvict removes the least recently seen devices to make room.
+	DeviceLimitEvict = "evict"
+)
+
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
 
+const DefaultLoginTokenLifetime = 2 * time.Minute
+
 func (c *UserAPI) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7781"
 	c.InternalAPI.Connect = "http://localhost:7781"
@@ -32,6 +62,8 @@ func (c *UserAPI) Defaults() {
 	c.DeviceDatabase.ConnectionString = "file:userapi_devices.db"
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.LoginTokenLifetime = DefaultLoginTokenLifetime
+	c.DeviceLimitPolicy = DeviceLimitReject
 }
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -40,4 +72,16 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	checkNotEmpty(configErrs, "user_api.device_database.connection_string", string(c.DeviceDatabase.ConnectionString))
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.login_token_lifetime", int64(c.LoginTokenLifetime))
+	if c.AccessTokenLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.access_token_lifetime", c.AccessTokenLifetime))
+	}
+	if c.MaxDevicesPerUser < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.max_devices_per_user", c.MaxDevicesPerUser))
+	}
+	switch c.DeviceLimitPolicy {
+	case DeviceLimitReject, DeviceLimitEvict:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.device_limit_policy", c.DeviceLimitPolicy))
+	}
 }
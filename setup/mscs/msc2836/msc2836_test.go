@@ -527,6 +527,15 @@ func (u *testUserAPI) PerformAccountDeactivation(ctx context.Context, req *usera
 func (u *testUserAPI) PerformOpenIDTokenCreation(ctx context.Context, req *userapi.PerformOpenIDTokenCreationRequest, res *userapi.PerformOpenIDTokenCreationResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformLoginTokenCreation(ctx context.Context, req *userapi.PerformLoginTokenCreationRequest, res *userapi.PerformLoginTokenCreationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformLoginTokenConsumption(ctx context.Context, req *userapi.PerformLoginTokenConsumptionRequest, res *userapi.PerformLoginTokenConsumptionResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformTokenRefresh(ctx context.Context, req *userapi.PerformTokenRefreshRequest, res *userapi.PerformTokenRefreshResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
 	return nil
 }
@@ -542,6 +551,9 @@ func (u *testUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAc
 func (u *testUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
 	return nil
 }
+func (u *testUserAPI) QueryThreePIDs(ctx context.Context, req *userapi.QueryThreePIDsRequest, res *userapi.QueryThreePIDsResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
 	return nil
 }
@@ -559,6 +571,22 @@ func (u *testUserAPI) PerformKeyBackup(ctx context.Context, req *userapi.Perform
 func (u *testUserAPI) QueryKeyBackup(ctx context.Context, req *userapi.QueryKeyBackupRequest, res *userapi.QueryKeyBackupResponse) {
 }
 
+func (u *testUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *userapi.PerformPusherSetResponse) error {
+	return nil
+}
+
+func (u *testUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	return nil
+}
+
+func (u *testUserAPI) PerformPushRulesPut(ctx context.Context, req *userapi.PerformPushRulesPutRequest, res *userapi.PerformPushRulesPutResponse) error {
+	return nil
+}
+
+func (u *testUserAPI) QueryPushRules(ctx context.Context, req *userapi.QueryPushRulesRequest, res *userapi.QueryPushRulesResponse) error {
+	return nil
+}
+
 type testRoomserverAPI struct {
 	// use a trace API as it implements method stubs so we don't need to have them here.
 	// We'll override the functions we care about.
@@ -20,7 +20,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -50,6 +49,14 @@ func Defaults(r *gomatrixserverlib.MSC2946SpacesRequest) {
 	r.MaxRoomsPerSpace = -1
 }
 
+// spacesRequest is a MSC2946SpacesRequest which can also filter the returned
+// rooms by their room type.
+type spacesRequest struct {
+	gomatrixserverlib.MSC2946SpacesRequest
+	// The room types to return. A nil entry matches rooms without a type.
+	RoomTypes []*string `json:"room_types,omitempty"`
+}
+
 // Enable this MSC
 func Enable(
 	base *setup.BaseDendrite, rsAPI roomserver.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
@@ -100,8 +107,8 @@ func federatedSpacesHandler(
 	thisServer gomatrixserverlib.ServerName,
 ) util.JSONResponse {
 	inMemoryBatchCache := make(map[string]set)
-	var r gomatrixserverlib.MSC2946SpacesRequest
-	Defaults(&r)
+	var r spacesRequest
+	Defaults(&r.MSC2946SpacesRequest)
 	if err := json.Unmarshal(fedReq.Content(), &r); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -139,8 +146,8 @@ func spacesHandler(
 			return util.ErrorResponse(err)
 		}
 		roomID := params["roomID"]
-		var r gomatrixserverlib.MSC2946SpacesRequest
-		Defaults(&r)
+		var r spacesRequest
+		Defaults(&r.MSC2946SpacesRequest)
 		if resErr := chttputil.UnmarshalJSONRequest(req, &r); resErr != nil {
 			return *resErr
 		}
@@ -165,7 +172,7 @@ func spacesHandler(
 }
 
 type walker struct {
-	req        *gomatrixserverlib.MSC2946SpacesRequest
+	req        *spacesRequest
 	rootRoomID string
 	caller     *userapi.Device
 	serverName gomatrixserverlib.ServerName
@@ -250,18 +257,12 @@ func (w *walker) walk() *gomatrixserverlib.MSC2946SpacesResponse {
 			discoveredEvents = events
 
 			pubRoom := w.publicRoomsChunk(roomID)
-			roomType := ""
-			create := w.stateEvent(roomID, gomatrixserverlib.MRoomCreate, "")
-			if create != nil {
-				// escape the `.`s so gjson doesn't think it's nested
-				roomType = gjson.GetBytes(create.Content(), strings.ReplaceAll(ConstCreateEventContentKey, ".", `\.`)).Str
-			}
 
 			// Add the total number of events to `PublicRoomsChunk` under `num_refs`. Add `PublicRoomsChunk` to `rooms`.
 			discoveredRooms = append(discoveredRooms, gomatrixserverlib.MSC2946Room{
-				PublicRoom: *pubRoom,
+				PublicRoom: pubRoom.PublicRoom,
 				NumRefs:    len(discoveredEvents),
-				RoomType:   roomType,
+				RoomType:   pubRoom.RoomType,
 			})
 		} else {
 			// attempt to query this room over federation, as either we've never heard of it before
@@ -277,8 +278,12 @@ func (w *walker) walk() *gomatrixserverlib.MSC2946SpacesResponse {
 			}
 		}
 
-		// If this room has not ever been in `rooms` (across multiple requests), send it now
+		// If this room has not ever been in `rooms` (across multiple requests), send it now. Rooms
+		// which don't match the requested room types are left out, but we still walk through them.
 		for _, room := range discoveredRooms {
+			if room.RoomID != w.rootRoomID && !roomserver.RoomTypeMatches(room.RoomType, w.req.RoomTypes) {
+				continue
+			}
 			if !w.alreadySent(room.RoomID) && !w.roomIsExcluded(room.RoomID) {
 				res.Rooms = append(res.Rooms, room)
 				w.markSent(room.RoomID)
@@ -336,23 +341,7 @@ func (w *walker) walk() *gomatrixserverlib.MSC2946SpacesResponse {
 	return &res
 }
 
-func (w *walker) stateEvent(roomID, evType, stateKey string) *gomatrixserverlib.HeaderedEvent {
-	var queryRes roomserver.QueryCurrentStateResponse
-	tuple := gomatrixserverlib.StateKeyTuple{
-		EventType: evType,
-		StateKey:  stateKey,
-	}
-	err := w.rsAPI.QueryCurrentState(w.ctx, &roomserver.QueryCurrentStateRequest{
-		RoomID:      roomID,
-		StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
-	}, &queryRes)
-	if err != nil {
-		return nil
-	}
-	return queryRes.StateEvents[tuple]
-}
-
-func (w *walker) publicRoomsChunk(roomID string) *gomatrixserverlib.PublicRoom {
+func (w *walker) publicRoomsChunk(roomID string) *roomserver.PublicRoom {
 	pubRooms, err := roomserver.PopulatePublicRooms(w.ctx, []string{roomID}, w.rsAPI)
 	if err != nil {
 		util.GetLogger(w.ctx).WithError(err).Error("failed to PopulatePublicRooms")
@@ -178,6 +178,10 @@ func TestMSC2946(t *testing.T) {
 		EventType: "m.room.history_visibility",
 		StateKey:  "",
 	}
+	createTuple := gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomCreate,
+		StateKey:  "",
+	}
 	nopRsAPI := &testRoomserverAPI{
 		joinEvents: joinEvents,
 		events: map[string]*gomatrixserverlib.HeaderedEvent{
@@ -193,14 +197,17 @@ func TestMSC2946(t *testing.T) {
 		pubRoomState: map[string]map[gomatrixserverlib.StateKeyTuple]string{
 			rootSpace: {
 				roomNameTuple: "Root",
+				createTuple:   "m.space",
 				hisVisTuple:   "shared",
 			},
 			subSpaceS1: {
 				roomNameTuple: "Sub-Space 1",
+				createTuple:   "m.space",
 				hisVisTuple:   "joined",
 			},
 			subSpaceS2: {
 				roomNameTuple: "Sub-Space 2",
+				createTuple:   "m.space",
 				hisVisTuple:   "shared",
 			},
 			room1: {
@@ -248,6 +255,19 @@ func TestMSC2946(t *testing.T) {
 			t.Errorf("got %d rooms, want %d", len(res.Rooms), len(allRooms))
 		}
 	})
+	t.Run("reports and filters by room type", func(t *testing.T) {
+		res := postSpaces(t, 200, "alice", rootSpace, map[string]interface{}{
+			"room_types": []string{"m.space"},
+		})
+		if len(res.Rooms) != 3 {
+			t.Errorf("got %d rooms, want 3", len(res.Rooms))
+		}
+		for _, room := range res.Rooms {
+			if room.RoomType != "m.space" {
+				t.Errorf("room %s has room type %q, want m.space", room.RoomID, room.RoomType)
+			}
+		}
+	})
 	t.Run("can update the graph", func(t *testing.T) {
 		// remove R3 from the graph
 		rmS1ToR3 := mustCreateEvent(t, fledglingEvent{
@@ -300,7 +320,7 @@ func runServer(t *testing.T, router *mux.Router) func() {
 	}
 }
 
-func postSpaces(t *testing.T, expectCode int, accessToken, roomID string, req *gomatrixserverlib.MSC2946SpacesRequest) *gomatrixserverlib.MSC2946SpacesResponse {
+func postSpaces(t *testing.T, expectCode int, accessToken, roomID string, req interface{}) *gomatrixserverlib.MSC2946SpacesResponse {
 	t.Helper()
 	var r gomatrixserverlib.MSC2946SpacesRequest
 	msc2946.Defaults(&r)
@@ -370,6 +390,15 @@ func (u *testUserAPI) PerformAccountDeactivation(ctx context.Context, req *usera
 func (u *testUserAPI) PerformOpenIDTokenCreation(ctx context.Context, req *userapi.PerformOpenIDTokenCreationRequest, res *userapi.PerformOpenIDTokenCreationResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformLoginTokenCreation(ctx context.Context, req *userapi.PerformLoginTokenCreationRequest, res *userapi.PerformLoginTokenCreationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformLoginTokenConsumption(ctx context.Context, req *userapi.PerformLoginTokenConsumptionRequest, res *userapi.PerformLoginTokenConsumptionResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformTokenRefresh(ctx context.Context, req *userapi.PerformTokenRefreshRequest, res *userapi.PerformTokenRefreshResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
 	return nil
 }
@@ -377,6 +406,18 @@ func (u *testUserAPI) PerformKeyBackup(ctx context.Context, req *userapi.Perform
 }
 func (u *testUserAPI) QueryKeyBackup(ctx context.Context, req *userapi.QueryKeyBackupRequest, res *userapi.QueryKeyBackupResponse) {
 }
+func (u *testUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *userapi.PerformPusherSetResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPushRulesPut(ctx context.Context, req *userapi.PerformPushRulesPutRequest, res *userapi.PerformPushRulesPutResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushRules(ctx context.Context, req *userapi.QueryPushRulesRequest, res *userapi.QueryPushRulesResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
 	dev, ok := u.accessTokens[req.AccessToken]
 	if !ok {
@@ -389,6 +430,9 @@ func (u *testUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAc
 func (u *testUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
 	return nil
 }
+func (u *testUserAPI) QueryThreePIDs(ctx context.Context, req *userapi.QueryThreePIDsRequest, res *userapi.QueryThreePIDsResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
 	return nil
 }
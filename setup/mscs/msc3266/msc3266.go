@@ -0,0 +1,348 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msc3266 'Room Summary' implements https://github.com/matrix-org/matrix-doc/pull/3266
+package msc3266
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	ConstCreateEventContentKey = "type"
+	ConstJoinRuleKnock         = "knock"
+)
+
+// Enable this MSC
+func Enable(
+	base *setup.BaseDendrite, rsAPI roomserver.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
+	fsAPI fs.FederationSenderInternalAPI, keyRing gomatrixserverlib.JSONVerifier,
+) error {
+	base.PublicClientAPIMux.Handle("/unstable/im.nheko.summary/rooms/{roomIDOrAlias}/summary",
+		httputil.MakeAuthAPI("msc3266_summary", userAPI, summaryHandler(rsAPI, fsAPI, base.Cfg.Global.ServerName)),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	base.PublicFederationAPIMux.Handle("/unstable/im.nheko.summary/summary/{roomID}", httputil.MakeExternalAPI(
+		"msc3266_fed_summary", func(req *http.Request) util.JSONResponse {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), base.Cfg.Global.ServerName, keyRing,
+			)
+			if fedReq == nil {
+				return errResp
+			}
+			params, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			s := summariser{
+				ctx:        req.Context(),
+				rsAPI:      rsAPI,
+				fsAPI:      fsAPI,
+				serverName: fedReq.Origin(),
+				thisServer: base.Cfg.Global.ServerName,
+			}
+			return s.federatedSummary(params["roomID"])
+		},
+	)).Methods(http.MethodGet)
+	return nil
+}
+
+func summaryHandler(
+	rsAPI roomserver.RoomserverInternalAPI, fsAPI fs.FederationSenderInternalAPI,
+	thisServer gomatrixserverlib.ServerName,
+) func(*http.Request, *userapi.Device) util.JSONResponse {
+	return func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		params, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		var vias []gomatrixserverlib.ServerName
+		for _, via := range req.URL.Query()["via"] {
+			vias = append(vias, gomatrixserverlib.ServerName(via))
+		}
+		s := summariser{
+			ctx:        req.Context(),
+			rsAPI:      rsAPI,
+			fsAPI:      fsAPI,
+			caller:     device,
+			thisServer: thisServer,
+		}
+		return s.clientSummary(params["roomIDOrAlias"], vias)
+	}
+}
+
+type summariser struct {
+	ctx        context.Context
+	rsAPI      roomserver.RoomserverInternalAPI
+	fsAPI      fs.FederationSenderInternalAPI
+	caller     *userapi.Device
+	serverName gomatrixserverlib.ServerName
+	thisServer gomatrixserverlib.ServerName
+}
+
+func (s *summariser) clientSummary(roomIDOrAlias string, vias []gomatrixserverlib.ServerName) util.JSONResponse {
+	roomID, servers, resErr := s.resolveRoom(roomIDOrAlias)
+	if resErr != nil {
+		return *resErr
+	}
+	vias = append(vias, servers...)
+
+	summary, known, visible := s.localSummary(roomID)
+	if known {
+		if !visible {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not allowed to view the summary of this room"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: summary,
+		}
+	}
+
+	// We aren't in the room, so ask the resident servers instead. They will
+	// apply their own visibility rules.
+	tried := make(map[gomatrixserverlib.ServerName]bool)
+	for _, serverName := range vias {
+		if tried[serverName] || serverName == s.thisServer {
+			continue
+		}
+		tried[serverName] = true
+		res, err := s.fsAPI.MSC3266RoomSummary(s.ctx, serverName, roomID)
+		if err != nil {
+			util.GetLogger(s.ctx).WithError(err).Warnf("failed to call MSC3266RoomSummary on server %s", serverName)
+			continue
+		}
+		res.RoomID = roomID
+		res.Membership = s.callerMembership(roomID)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Unable to find a summary of the room"),
+	}
+}
+
+func (s *summariser) federatedSummary(roomID string) util.JSONResponse {
+	summary, known, visible := s.localSummary(roomID)
+	if !known {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+	if !visible {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to view the summary of this room"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: summary,
+	}
+}
+
+// resolveRoom returns the room ID for the given room ID or alias, along with
+// any servers that are known to be in the room as a result of the lookup.
+func (s *summariser) resolveRoom(roomIDOrAlias string) (string, []gomatrixserverlib.ServerName, *util.JSONResponse) {
+	if len(roomIDOrAlias) == 0 {
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Expected a room ID or a room alias"),
+		}
+	}
+	switch roomIDOrAlias[0] {
+	case '!':
+		_, domain, err := gomatrixserverlib.SplitID('!', roomIDOrAlias)
+		if err != nil {
+			return "", nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid room ID"),
+			}
+		}
+		return roomIDOrAlias, []gomatrixserverlib.ServerName{domain}, nil
+	case '#':
+		_, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias)
+		if err != nil {
+			return "", nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid room alias"),
+			}
+		}
+		if domain == s.thisServer {
+			var aliasRes roomserver.GetRoomIDForAliasResponse
+			err = s.rsAPI.GetRoomIDForAlias(s.ctx, &roomserver.GetRoomIDForAliasRequest{
+				Alias:              roomIDOrAlias,
+				IncludeAppservices: true,
+			}, &aliasRes)
+			if err != nil {
+				util.GetLogger(s.ctx).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+				resErr := jsonerror.InternalServerError()
+				return "", nil, &resErr
+			}
+			if aliasRes.RoomID != "" {
+				return aliasRes.RoomID, nil, nil
+			}
+		} else {
+			var dirRes fs.PerformDirectoryLookupResponse
+			err = s.fsAPI.PerformDirectoryLookup(s.ctx, &fs.PerformDirectoryLookupRequest{
+				RoomAlias:  roomIDOrAlias,
+				ServerName: domain,
+			}, &dirRes)
+			if err != nil {
+				util.GetLogger(s.ctx).WithError(err).Warn("fsAPI.PerformDirectoryLookup failed")
+			} else if dirRes.RoomID != "" {
+				return dirRes.RoomID, dirRes.ServerNames, nil
+			}
+		}
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room alias not found"),
+		}
+	default:
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Expected a room ID or a room alias"),
+		}
+	}
+}
+
+// localSummary builds the summary of the room from our own copy of the room
+// state. Returns known=false if we aren't participating in the room, in which
+// case our state may be stale, and visible=false if the requester isn't
+// allowed to see the summary.
+func (s *summariser) localSummary(roomID string) (summary *fs.MSC3266RoomSummary, known, visible bool) {
+	var joinedRes roomserver.QueryServerJoinedToRoomResponse
+	err := s.rsAPI.QueryServerJoinedToRoom(s.ctx, &roomserver.QueryServerJoinedToRoomRequest{
+		RoomID:     roomID,
+		ServerName: s.thisServer,
+	}, &joinedRes)
+	if err != nil {
+		util.GetLogger(s.ctx).WithError(err).Error("failed to QueryServerJoinedToRoom")
+		return nil, false, false
+	}
+	if !joinedRes.RoomExists || !joinedRes.IsInRoom {
+		return nil, false, false
+	}
+
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
+	joinRuleTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}
+	hisVisTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""}
+	tuples := []gomatrixserverlib.StateKeyTuple{createTuple, joinRuleTuple, hisVisTuple}
+	var memberTuple gomatrixserverlib.StateKeyTuple
+	if s.caller != nil {
+		memberTuple = gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: s.caller.UserID}
+		tuples = append(tuples, memberTuple)
+	}
+	var stateRes roomserver.QueryCurrentStateResponse
+	err = s.rsAPI.QueryCurrentState(s.ctx, &roomserver.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: tuples,
+	}, &stateRes)
+	if err != nil {
+		util.GetLogger(s.ctx).WithError(err).Error("failed to QueryCurrentState")
+		return nil, false, false
+	}
+
+	summary = &fs.MSC3266RoomSummary{RoomID: roomID}
+	if ev := stateRes.StateEvents[createTuple]; ev != nil {
+		summary.RoomType = gjson.GetBytes(ev.Content(), ConstCreateEventContentKey).Str
+	}
+	if ev := stateRes.StateEvents[joinRuleTuple]; ev != nil {
+		summary.JoinRule, _ = ev.JoinRule()
+	}
+	if ev := stateRes.StateEvents[hisVisTuple]; ev != nil {
+		hisVis, _ := ev.HistoryVisibility()
+		summary.WorldReadable = hisVis == "world_readable"
+	}
+	if ev := stateRes.StateEvents[memberTuple]; s.caller != nil && ev != nil {
+		summary.Membership, _ = ev.Membership()
+	}
+
+	if !s.visible(roomID, summary) {
+		return nil, true, false
+	}
+
+	pubRooms, err := roomserver.PopulatePublicRooms(s.ctx, []string{roomID}, s.rsAPI)
+	if err != nil {
+		util.GetLogger(s.ctx).WithError(err).Error("failed to PopulatePublicRooms")
+		return nil, false, false
+	}
+	if len(pubRooms) > 0 {
+		summary.Name = pubRooms[0].Name
+		summary.Topic = pubRooms[0].Topic
+		summary.AvatarURL = pubRooms[0].AvatarURL
+		summary.CanonicalAlias = pubRooms[0].CanonicalAlias
+		summary.NumJoinedMembers = pubRooms[0].JoinedMembersCount
+		summary.GuestCanJoin = pubRooms[0].GuestCanJoin
+	}
+	return summary, true, true
+}
+
+// visible returns true if the requester is allowed to see the summary of the
+// room, i.e. the room is public, knockable or world_readable, or the user is
+// joined or invited, or the requesting server is in the room.
+func (s *summariser) visible(roomID string, summary *fs.MSC3266RoomSummary) bool {
+	switch {
+	case summary.JoinRule == gomatrixserverlib.Public, summary.JoinRule == ConstJoinRuleKnock:
+		return true
+	case summary.WorldReadable:
+		return true
+	}
+	if s.caller != nil {
+		return summary.Membership == gomatrixserverlib.Join || summary.Membership == gomatrixserverlib.Invite
+	}
+	var joinedRes roomserver.QueryServerJoinedToRoomResponse
+	err := s.rsAPI.QueryServerJoinedToRoom(s.ctx, &roomserver.QueryServerJoinedToRoomRequest{
+		RoomID:     roomID,
+		ServerName: s.serverName,
+	}, &joinedRes)
+	if err != nil {
+		util.GetLogger(s.ctx).WithError(err).Error("failed to QueryServerJoinedToRoom")
+		return false
+	}
+	return joinedRes.IsInRoom
+}
+
+// callerMembership returns the membership of the requesting user in a room
+// that we aren't participating in, e.g. because they've been invited to it.
+func (s *summariser) callerMembership(roomID string) string {
+	var memberRes roomserver.QueryMembershipForUserResponse
+	err := s.rsAPI.QueryMembershipForUser(s.ctx, &roomserver.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: s.caller.UserID,
+	}, &memberRes)
+	if err != nil {
+		return ""
+	}
+	return memberRes.Membership
+}
@@ -0,0 +1,304 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msc3266
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var roomVer = gomatrixserverlib.RoomVersionV6
+
+const (
+	alice      = "@alice:localhost"
+	bob        = "@bob:localhost"
+	publicRoom = "!public:localhost"
+	inviteRoom = "!invite:localhost"
+	remoteRoom = "!remote:remote"
+)
+
+type testRoomserverAPI struct {
+	// use a trace API as it implements method stubs so we don't need to have them here.
+	// We'll override the functions we care about.
+	roomserver.RoomserverInternalAPITrace
+	events        []*gomatrixserverlib.HeaderedEvent
+	joinedServers map[string][]gomatrixserverlib.ServerName
+	pubRoomState  map[string]map[gomatrixserverlib.StateKeyTuple]string
+	memberships   map[string]string
+}
+
+func (r *testRoomserverAPI) QueryServerJoinedToRoom(ctx context.Context, req *roomserver.QueryServerJoinedToRoomRequest, res *roomserver.QueryServerJoinedToRoomResponse) error {
+	servers, ok := r.joinedServers[req.RoomID]
+	res.RoomExists = ok
+	for _, serverName := range servers {
+		if serverName == req.ServerName {
+			res.IsInRoom = true
+		}
+	}
+	return nil
+}
+
+func (r *testRoomserverAPI) QueryCurrentState(ctx context.Context, req *roomserver.QueryCurrentStateRequest, res *roomserver.QueryCurrentStateResponse) error {
+	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent)
+	for _, he := range r.events {
+		if he.RoomID() != req.RoomID || he.StateKey() == nil {
+			continue
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{
+			EventType: he.Type(),
+			StateKey:  *he.StateKey(),
+		}
+		for _, t := range req.StateTuples {
+			if t == tuple {
+				res.StateEvents[t] = he
+			}
+		}
+	}
+	return nil
+}
+
+func (r *testRoomserverAPI) QueryBulkStateContent(ctx context.Context, req *roomserver.QueryBulkStateContentRequest, res *roomserver.QueryBulkStateContentResponse) error {
+	res.Rooms = make(map[string]map[gomatrixserverlib.StateKeyTuple]string)
+	for _, roomID := range req.RoomIDs {
+		if data, ok := r.pubRoomState[roomID]; ok {
+			res.Rooms[roomID] = data
+		}
+	}
+	return nil
+}
+
+func (r *testRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *roomserver.QueryMembershipForUserRequest, res *roomserver.QueryMembershipForUserResponse) error {
+	res.Membership = r.memberships[req.RoomID+"|"+req.UserID]
+	return nil
+}
+
+type testFederationSenderAPI struct {
+	// only the functions we care about are implemented.
+	fs.FederationSenderInternalAPI
+	summaries map[gomatrixserverlib.ServerName]fs.MSC3266RoomSummary
+	requests  int
+}
+
+func (f *testFederationSenderAPI) MSC3266RoomSummary(ctx context.Context, dst gomatrixserverlib.ServerName, roomID string) (fs.MSC3266RoomSummary, error) {
+	f.requests++
+	summary, ok := f.summaries[dst]
+	if !ok || summary.RoomID != roomID {
+		return fs.MSC3266RoomSummary{}, &fs.FederationClientError{Err: fmt.Sprintf("no summary for %s on %s", roomID, dst)}
+	}
+	return summary, nil
+}
+
+func newTestRoomserverAPI(t *testing.T) *testRoomserverAPI {
+	t.Helper()
+	empty := ""
+	aliceStateKey := alice
+	return &testRoomserverAPI{
+		events: []*gomatrixserverlib.HeaderedEvent{
+			mustCreateEvent(t, fledglingEvent{
+				RoomID: publicRoom, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &empty,
+				Content: map[string]interface{}{"creator": alice, "type": "m.space"},
+			}),
+			mustCreateEvent(t, fledglingEvent{
+				RoomID: publicRoom, Sender: alice, Type: gomatrixserverlib.MRoomJoinRules, StateKey: &empty,
+				Content: map[string]interface{}{"join_rule": gomatrixserverlib.Public},
+			}),
+			mustCreateEvent(t, fledglingEvent{
+				RoomID: inviteRoom, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &empty,
+				Content: map[string]interface{}{"creator": alice},
+			}),
+			mustCreateEvent(t, fledglingEvent{
+				RoomID: inviteRoom, Sender: alice, Type: gomatrixserverlib.MRoomJoinRules, StateKey: &empty,
+				Content: map[string]interface{}{"join_rule": gomatrixserverlib.Invite},
+			}),
+			mustCreateEvent(t, fledglingEvent{
+				RoomID: inviteRoom, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &aliceStateKey,
+				Content: map[string]interface{}{"membership": gomatrixserverlib.Join},
+			}),
+		},
+		joinedServers: map[string][]gomatrixserverlib.ServerName{
+			publicRoom: {"localhost"},
+			inviteRoom: {"localhost", "joined"},
+		},
+		pubRoomState: map[string]map[gomatrixserverlib.StateKeyTuple]string{
+			publicRoom: {
+				{EventType: "m.room.name", StateKey: ""}:                          "Public Room",
+				{EventType: "m.room.topic", StateKey: ""}:                         "A room for everyone",
+				{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}:       gomatrixserverlib.Public,
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: alice}:       gomatrixserverlib.Join,
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: "@c:remote"}: gomatrixserverlib.Join,
+			},
+			inviteRoom: {
+				{EventType: "m.room.name", StateKey: ""}:                    "Private Room",
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: alice}: gomatrixserverlib.Join,
+			},
+		},
+		memberships: map[string]string{
+			remoteRoom + "|" + bob: gomatrixserverlib.Invite,
+		},
+	}
+}
+
+func TestClientSummaryLocal(t *testing.T) {
+	s := summariser{
+		ctx:        context.Background(),
+		rsAPI:      newTestRoomserverAPI(t),
+		fsAPI:      &testFederationSenderAPI{},
+		caller:     &userapi.Device{UserID: bob},
+		thisServer: "localhost",
+	}
+	res := s.clientSummary(publicRoom, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	summary := res.JSON.(*fs.MSC3266RoomSummary)
+	if summary.Name != "Public Room" || summary.Topic != "A room for everyone" {
+		t.Errorf("wrong name/topic: %+v", summary)
+	}
+	if summary.JoinRule != gomatrixserverlib.Public || summary.RoomType != "m.space" {
+		t.Errorf("wrong join rule/room type: %+v", summary)
+	}
+	if summary.NumJoinedMembers != 2 {
+		t.Errorf("expected 2 joined members, got %d", summary.NumJoinedMembers)
+	}
+	if summary.Membership != "" {
+		t.Errorf("expected no membership, got %q", summary.Membership)
+	}
+
+	// The room is invite-only, so bob isn't allowed to see it but alice is.
+	res = s.clientSummary(inviteRoom, nil)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected HTTP 403 for a private room, got %d: %+v", res.Code, res.JSON)
+	}
+	s.caller = &userapi.Device{UserID: alice}
+	res = s.clientSummary(inviteRoom, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200 for a member, got %d: %+v", res.Code, res.JSON)
+	}
+	summary = res.JSON.(*fs.MSC3266RoomSummary)
+	if summary.Name != "Private Room" || summary.Membership != gomatrixserverlib.Join {
+		t.Errorf("wrong summary for a member: %+v", summary)
+	}
+}
+
+func TestClientSummaryFederated(t *testing.T) {
+	fsAPI := &testFederationSenderAPI{
+		summaries: map[gomatrixserverlib.ServerName]fs.MSC3266RoomSummary{
+			"resident": {
+				RoomID:           remoteRoom,
+				Name:             "Remote Room",
+				JoinRule:         gomatrixserverlib.Public,
+				NumJoinedMembers: 10,
+			},
+		},
+	}
+	s := summariser{
+		ctx:        context.Background(),
+		rsAPI:      newTestRoomserverAPI(t),
+		fsAPI:      fsAPI,
+		caller:     &userapi.Device{UserID: bob},
+		thisServer: "localhost",
+	}
+	// The server in the room ID doesn't have a summary for us, so the via
+	// is needed. We shouldn't ask ourselves over federation either.
+	res := s.clientSummary(remoteRoom, []gomatrixserverlib.ServerName{"localhost", "resident"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	summary := res.JSON.(fs.MSC3266RoomSummary)
+	if summary.Name != "Remote Room" || summary.NumJoinedMembers != 10 {
+		t.Errorf("wrong summary: %+v", summary)
+	}
+	if summary.Membership != gomatrixserverlib.Invite {
+		t.Errorf("expected membership %q, got %q", gomatrixserverlib.Invite, summary.Membership)
+	}
+	if fsAPI.requests != 1 {
+		t.Errorf("expected 1 federation request, got %d", fsAPI.requests)
+	}
+
+	res = s.clientSummary("!unknown:remote", nil)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected HTTP 404 for an unknown room, got %d: %+v", res.Code, res.JSON)
+	}
+}
+
+func TestFederatedSummary(t *testing.T) {
+	s := summariser{
+		ctx:        context.Background(),
+		rsAPI:      newTestRoomserverAPI(t),
+		thisServer: "localhost",
+	}
+	testCases := []struct {
+		serverName gomatrixserverlib.ServerName
+		roomID     string
+		wantCode   int
+	}{
+		{"other", publicRoom, http.StatusOK},
+		{"other", inviteRoom, http.StatusForbidden},
+		{"joined", inviteRoom, http.StatusOK},
+		{"other", remoteRoom, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		s.serverName = tc.serverName
+		res := s.federatedSummary(tc.roomID)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s requesting %s: expected HTTP %d, got %d", tc.serverName, tc.roomID, tc.wantCode, res.Code)
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		if summary := res.JSON.(*fs.MSC3266RoomSummary); summary.Membership != "" {
+			t.Errorf("expected no membership in a federated summary, got %q", summary.Membership)
+		}
+	}
+}
+
+type fledglingEvent struct {
+	Type     string
+	StateKey *string
+	Content  interface{}
+	Sender   string
+	RoomID   string
+}
+
+func mustCreateEvent(t *testing.T, ev fledglingEvent) (result *gomatrixserverlib.HeaderedEvent) {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize) // zero seed
+	key := ed25519.NewKeyFromSeed(seed)
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   ev.Sender,
+		Depth:    999,
+		Type:     ev.Type,
+		StateKey: ev.StateKey,
+		RoomID:   ev.RoomID,
+	}
+	err := eb.SetContent(ev.Content)
+	if err != nil {
+		t.Fatalf("mustCreateEvent: failed to marshal event content %+v", ev.Content)
+	}
+	signedEvent, err := eb.Build(time.Now(), gomatrixserverlib.ServerName("localhost"), "ed25519:test", key, roomVer)
+	if err != nil {
+		t.Fatalf("mustCreateEvent: failed to sign event: %s", err)
+	}
+	return signedEvent.Headered(roomVer)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/setup"
 	"github.com/matrix-org/dendrite/setup/mscs/msc2836"
 	"github.com/matrix-org/dendrite/setup/mscs/msc2946"
+	"github.com/matrix-org/dendrite/setup/mscs/msc3266"
 	"github.com/matrix-org/util"
 )
 
@@ -42,8 +43,14 @@ func EnableMSC(base *setup.BaseDendrite, monolith *setup.Monolith, msc string) e
 		return msc2836.Enable(base, monolith.RoomserverAPI, monolith.FederationSenderAPI, monolith.UserAPI, monolith.KeyRing)
 	case "msc2946":
 		return msc2946.Enable(base, monolith.RoomserverAPI, monolith.UserAPI, monolith.FederationSenderAPI, monolith.KeyRing)
+	case "msc3266":
+		return msc3266.Enable(base, monolith.RoomserverAPI, monolith.UserAPI, monolith.FederationSenderAPI, monolith.KeyRing)
+	case "msc2403": // enabled inside federationapi
 	case "msc2444": // enabled inside federationapi
 	case "msc2753": // enabled inside clientapi
+	case "msc3575": // enabled inside syncapi
+	case "msc3706": // enabled inside federationapi
+	case "msc3882": // enabled inside clientapi
 	default:
 		return fmt.Errorf("EnableMSC: unknown msc '%s'", msc)
 	}
@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/push"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	log "github.com/sirupsen/logrus"
@@ -36,6 +37,7 @@ type OutputReceiptEventConsumer struct {
 	db              storage.Database
 	stream          types.StreamProvider
 	notifier        *notifier.Notifier
+	pushWorker      *push.Worker
 }
 
 // NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
@@ -47,6 +49,7 @@ func NewOutputReceiptEventConsumer(
 	store storage.Database,
 	notifier *notifier.Notifier,
 	stream types.StreamProvider,
+	pushWorker *push.Worker,
 ) *OutputReceiptEventConsumer {
 
 	consumer := internal.ContinualConsumer{
@@ -62,6 +65,7 @@ func NewOutputReceiptEventConsumer(
 		db:              store,
 		notifier:        notifier,
 		stream:          stream,
+		pushWorker:      pushWorker,
 	}
 
 	consumer.ProcessMessage = s.onMessage
@@ -96,6 +100,13 @@ func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) erro
 		return err
 	}
 
+	// Mark the notifications as read before waking up any syncing
+	// clients, so that their unread counts take the receipt into account.
+	if err = s.pushWorker.OnReceipt(context.TODO(), output.UserID, output.RoomID, output.Type, output.EventID); err != nil {
+		log.WithError(err).Error("Failed to update notifications for receipt")
+		sentry.CaptureException(err)
+	}
+
 	s.stream.Advance(streamPos)
 	s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
 
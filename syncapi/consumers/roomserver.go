@@ -16,6 +16,7 @@ package consumers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 
@@ -26,8 +27,10 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/push"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
@@ -36,11 +39,13 @@ import (
 type OutputRoomEventConsumer struct {
 	cfg          *config.SyncAPI
 	rsAPI        api.RoomserverInternalAPI
+	userAPI      userapi.UserInternalAPI
 	rsConsumer   *internal.ContinualConsumer
 	db           storage.Database
 	pduStream    types.StreamProvider
 	inviteStream types.StreamProvider
 	notifier     *notifier.Notifier
+	pushWorker   *push.Worker
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -53,6 +58,8 @@ func NewOutputRoomEventConsumer(
 	pduStream types.StreamProvider,
 	inviteStream types.StreamProvider,
 	rsAPI api.RoomserverInternalAPI,
+	userAPI userapi.UserInternalAPI,
+	pushWorker *push.Worker,
 ) *OutputRoomEventConsumer {
 
 	consumer := internal.ContinualConsumer{
@@ -70,6 +77,8 @@ func NewOutputRoomEventConsumer(
 		pduStream:    pduStream,
 		inviteStream: inviteStream,
 		rsAPI:        rsAPI,
+		userAPI:      userAPI,
+		pushWorker:   pushWorker,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -118,6 +127,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onRetirePeek(context.TODO(), *output.RetirePeek)
 	case api.OutputTypeRedactedEvent:
 		return s.onRedactEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypePurgedEvents:
+		return s.onPurgedEvents(context.TODO(), *output.PurgedEvents)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -141,6 +152,16 @@ func (s *OutputRoomEventConsumer) onRedactEvent(
 	})
 }
 
+func (s *OutputRoomEventConsumer) onPurgedEvents(
+	ctx context.Context, msg api.OutputPurgedEvents,
+) error {
+	if err := s.db.PurgeEvents(ctx, msg.EventIDs); err != nil {
+		log.WithError(err).WithField("room_id", msg.RoomID).Error("PurgeEvents error'd")
+		return err
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	ctx context.Context, msg api.OutputNewRoomEvent,
 ) error {
@@ -195,6 +216,13 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		return err
 	}
 
+	// Record the notifications before waking up any syncing clients, so
+	// that their unread counts include the event.
+	if err = s.pushWorker.OnNewEvent(ctx, ev, pduPos); err != nil {
+		log.WithError(err).Errorf("Failed to send push notifications for PDU pos %d", pduPos)
+		sentry.CaptureException(err)
+	}
+
 	s.pduStream.Advance(pduPos)
 	s.notifier.OnNewEvent(ev, ev.RoomID(), nil, types.StreamingToken{PDUPosition: pduPos})
 
@@ -282,6 +310,19 @@ func (s *OutputRoomEventConsumer) onNewInviteEvent(
 		}).Panicf("roomserver output log: invite has no state key")
 		return nil
 	}
+	if s.cfg.IgnoredUserInvites != config.IgnoredUserInvitesAllow && s.inviterIgnored(ctx, msg.Event) {
+		log.WithFields(log.Fields{
+			"event_id": msg.Event.EventID(),
+			"sender":   msg.Event.Sender(),
+			"policy":   s.cfg.IgnoredUserInvites,
+		}).Info("Ignoring invite from ignored user")
+		if s.cfg.IgnoredUserInvites == config.IgnoredUserInvitesReject {
+			// The rejection will come back to us through the roomserver
+			// output log, so don't wait for it here.
+			go s.rejectInvite(msg.Event)
+		}
+		return nil
+	}
 	pduPos, err := s.db.AddInviteEvent(ctx, msg.Event)
 	if err != nil {
 		sentry.CaptureException(err)
@@ -301,10 +342,53 @@ func (s *OutputRoomEventConsumer) onNewInviteEvent(
 	return nil
 }
 
+// inviterIgnored returns true if the sender of the invite is in the
+// m.ignored_user_list of the invitee.
+func (s *OutputRoomEventConsumer) inviterIgnored(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent,
+) bool {
+	var res userapi.QueryAccountDataResponse
+	err := s.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   *event.StateKey(),
+		DataType: "m.ignored_user_list",
+	}, &res)
+	if err != nil {
+		log.WithError(err).WithField("event_id", event.EventID()).Error("failed to query ignored users")
+		return false
+	}
+	data, ok := res.GlobalAccountData["m.ignored_user_list"]
+	if !ok {
+		return false
+	}
+	var content struct {
+		IgnoredUsers map[string]interface{} `json:"ignored_users"`
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return false
+	}
+	_, ignored := content.IgnoredUsers[event.Sender()]
+	return ignored
+}
+
+func (s *OutputRoomEventConsumer) rejectInvite(event *gomatrixserverlib.HeaderedEvent) {
+	err := s.rsAPI.PerformLeave(context.Background(), &api.PerformLeaveRequest{
+		RoomID: event.RoomID(),
+		UserID: *event.StateKey(),
+	}, &api.PerformLeaveResponse{})
+	if err != nil {
+		log.WithError(err).WithField("event_id", event.EventID()).Error("failed to reject invite from ignored user")
+	}
+}
+
 func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	ctx context.Context, msg api.OutputRetireInviteEvent,
 ) error {
 	pduPos, err := s.db.RetireInviteEvent(ctx, msg.EventID)
+	if err == sql.ErrNoRows {
+		// We never stored the invite, e.g. because it was from an ignored
+		// user, so there is nothing to retire.
+		return nil
+	}
 	if err != nil {
 		sentry.CaptureException(err)
 		// panic rather than continue with an inconsistent database
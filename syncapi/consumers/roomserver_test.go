@@ -0,0 +1,157 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	inviter = "@spammer:remote"
+	invitee = "@alice:localhost"
+)
+
+type inviteTestDatabase struct {
+	storage.Database
+	invites []string
+}
+
+func (d *inviteTestDatabase) AddInviteEvent(ctx context.Context, inviteEvent *gomatrixserverlib.HeaderedEvent) (types.StreamPosition, error) {
+	d.invites = append(d.invites, inviteEvent.EventID())
+	return types.StreamPosition(len(d.invites)), nil
+}
+
+type inviteTestStreamProvider struct {
+	types.StreamProvider
+}
+
+func (p *inviteTestStreamProvider) Advance(latest types.StreamPosition) {}
+
+type inviteTestUserAPI struct {
+	userapi.UserInternalAPI
+	ignoredUsers map[string]interface{}
+}
+
+func (u *inviteTestUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"ignored_users": u.ignoredUsers,
+	})
+	if err != nil {
+		return err
+	}
+	res.GlobalAccountData = map[string]json.RawMessage{
+		"m.ignored_user_list": data,
+	}
+	return nil
+}
+
+type inviteTestRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	leaves chan *api.PerformLeaveRequest
+}
+
+func (r *inviteTestRoomserverAPI) PerformLeave(ctx context.Context, req *api.PerformLeaveRequest, res *api.PerformLeaveResponse) error {
+	r.leaves <- req
+	return nil
+}
+
+func mustCreateInviteEvent(t *testing.T) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	stateKey := invitee
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   inviter,
+		RoomID:   "!room:remote",
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &stateKey,
+	}
+	if err = eb.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Invite}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "remote", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
+
+func newInviteTestConsumer(policy string, ignoredUsers map[string]interface{}) (*OutputRoomEventConsumer, *inviteTestDatabase, *inviteTestRoomserverAPI) {
+	db := &inviteTestDatabase{}
+	rsAPI := &inviteTestRoomserverAPI{leaves: make(chan *api.PerformLeaveRequest, 1)}
+	return &OutputRoomEventConsumer{
+		cfg: &config.SyncAPI{
+			IgnoredUserInvites: policy,
+		},
+		db:           db,
+		rsAPI:        rsAPI,
+		userAPI:      &inviteTestUserAPI{ignoredUsers: ignoredUsers},
+		inviteStream: &inviteTestStreamProvider{},
+		notifier:     notifier.NewNotifier(types.StreamingToken{}),
+	}, db, rsAPI
+}
+
+func TestInviteFromIgnoredUser(t *testing.T) {
+	ignored := map[string]interface{}{inviter: struct{}{}}
+	testCases := []struct {
+		policy       string
+		ignoredUsers map[string]interface{}
+		wantStored   bool
+		wantRejected bool
+	}{
+		{config.IgnoredUserInvitesAllow, ignored, true, false},
+		{config.IgnoredUserInvitesHide, ignored, false, false},
+		{config.IgnoredUserInvitesReject, ignored, false, true},
+		{config.IgnoredUserInvitesReject, nil, true, false},
+	}
+	for _, tc := range testCases {
+		s, db, rsAPI := newInviteTestConsumer(tc.policy, tc.ignoredUsers)
+		err := s.onNewInviteEvent(context.Background(), api.OutputNewInviteEvent{
+			Event: mustCreateInviteEvent(t),
+		})
+		if err != nil {
+			t.Fatalf("policy %q: onNewInviteEvent failed: %s", tc.policy, err)
+		}
+		if stored := len(db.invites) > 0; stored != tc.wantStored {
+			t.Errorf("policy %q: expected invite stored=%v, got %v", tc.policy, tc.wantStored, stored)
+		}
+		if tc.wantRejected {
+			select {
+			case req := <-rsAPI.leaves:
+				if req.UserID != invitee || req.RoomID != "!room:remote" {
+					t.Errorf("policy %q: rejected the wrong invite: %+v", tc.policy, req)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("policy %q: expected invite to be rejected", tc.policy)
+			}
+		} else if len(rsAPI.leaves) > 0 {
+			t.Errorf("policy %q: expected invite not to be rejected", tc.policy)
+		}
+	}
+}
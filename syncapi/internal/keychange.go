@@ -16,7 +16,6 @@ package internal
 
 import (
 	"context"
-	"strings"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -25,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 const DeviceListLogName = "dl"
@@ -40,6 +40,9 @@ func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID,
 		return queryRes.Error
 	}
 	res.DeviceListsOTKCount = queryRes.Count.KeyCount
+	if queryRes.UnusedFallbackAlgorithms != nil {
+		res.DeviceUnusedFallbackKeyTypes = queryRes.UnusedFallbackAlgorithms
+	}
 	return nil
 }
 
@@ -120,8 +123,13 @@ func DeviceListCatchup(
 			userSet[userID] = true
 		}
 	}
+	leftSet := make(map[string]bool)
+	for _, userID := range res.DeviceLists.Left {
+		leftSet[userID] = true
+	}
 	for _, userID := range leaveUserIDs {
-		if sharedUsersMap[userID] == 0 {
+		if sharedUsersMap[userID] == 0 && !leftSet[userID] {
+			leftSet[userID] = true
 			// we no longer share a room with this user when they left, so add to left list.
 			res.DeviceLists.Left = append(res.DeviceLists.Left, userID)
 		}
@@ -294,14 +302,15 @@ func membershipEventPresent(events []gomatrixserverlib.ClientEvent, userID strin
 func membershipEvents(res *types.Response) (joinUserIDs, leaveUserIDs []string) {
 	for _, room := range res.Rooms.Join {
 		for _, ev := range room.Timeline.Events {
-			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
-				if strings.Contains(string(ev.Content), `"join"`) {
-					joinUserIDs = append(joinUserIDs, *ev.StateKey)
-				} else if strings.Contains(string(ev.Content), `"leave"`) {
-					leaveUserIDs = append(leaveUserIDs, *ev.StateKey)
-				} else if strings.Contains(string(ev.Content), `"ban"`) {
-					leaveUserIDs = append(leaveUserIDs, *ev.StateKey)
-				}
+			if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil {
+				continue
+			}
+			// look at the membership key only, other fields like the displayname may contain anything.
+			switch gjson.GetBytes(ev.Content, "membership").Str {
+			case gomatrixserverlib.Join:
+				joinUserIDs = append(joinUserIDs, *ev.StateKey)
+			case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+				leaveUserIDs = append(leaveUserIDs, *ev.StateKey)
 			}
 		}
 	}
@@ -45,6 +45,12 @@ func (k *mockKeyAPI) QueryDeviceMessages(ctx context.Context, req *keyapi.QueryD
 }
 func (k *mockKeyAPI) InputDeviceListUpdate(ctx context.Context, req *keyapi.InputDeviceListUpdateRequest, res *keyapi.InputDeviceListUpdateResponse) {
 
+}
+func (k *mockKeyAPI) InputCrossSigningKeyUpdate(ctx context.Context, req *keyapi.InputCrossSigningKeyUpdateRequest, res *keyapi.InputCrossSigningKeyUpdateResponse) {
+}
+func (k *mockKeyAPI) PerformUploadDeviceKeys(ctx context.Context, req *keyapi.PerformUploadDeviceKeysRequest, res *keyapi.PerformUploadDeviceKeysResponse) {
+}
+func (k *mockKeyAPI) PerformUploadDeviceSignatures(ctx context.Context, req *keyapi.PerformUploadDeviceSignaturesRequest, res *keyapi.PerformUploadDeviceSignaturesResponse) {
 }
 
 type mockRoomserverAPI struct {
@@ -429,3 +435,30 @@ func TestKeyChangeCatchupChangeAndLeftSameRoom(t *testing.T) {
 		left:   []string{newShareUser, newShareUser2},
 	})
 }
+
+func TestMembershipEventsUsesMembershipKey(t *testing.T) {
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	syncResponse := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{
+			Type:     "m.room.member",
+			StateKey: &bob,
+			Content:  []byte(`{"membership":"leave","displayname":"join"}`),
+		},
+		{
+			Type:     "m.room.member",
+			StateKey: &charlie,
+			Content:  []byte(`{"membership":"invite","displayname":"leave"}`),
+		},
+	}
+	syncResponse.Rooms.Join["!room:localhost"] = *jr
+	joins, leaves := membershipEvents(syncResponse)
+	if len(joins) != 0 {
+		t.Errorf("got joins %v want none", joins)
+	}
+	if !reflect.DeepEqual(leaves, []string{bob}) {
+		t.Errorf("got leaves %v want %v", leaves, []string{bob})
+	}
+}
@@ -197,6 +197,18 @@ func (n *Notifier) OnNewReceipt(
 	n.wakeupUsers(n.joinedUsers(roomID), nil, n.currPos)
 }
 
+// OnNewPresence updates the current position and wakes up the user and
+// everyone who shares a room with them.
+func (n *Notifier) OnNewPresence(
+	posUpdate types.StreamingToken, userID string,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers(n.sharedUsers(userID), nil, n.currPos)
+}
+
 func (n *Notifier) OnNewKeyChange(
 	posUpdate types.StreamingToken, wakeUserID, keyChangeUserID string,
 ) {
@@ -388,6 +400,21 @@ func (n *Notifier) joinedUsers(roomID string) (userIDs []string) {
 	return n.roomIDToJoinedUsers[roomID].values()
 }
 
+// sharedUsers returns the user, along with all users who share a room with them.
+// Not thread-safe: must be called with the stream lock held
+func (n *Notifier) sharedUsers(userID string) (userIDs []string) {
+	users := userIDSet{userID: true}
+	for _, joined := range n.roomIDToJoinedUsers {
+		if !joined[userID] {
+			continue
+		}
+		for joinedUserID := range joined {
+			users.add(joinedUserID)
+		}
+	}
+	return users.values()
+}
+
 // Not thread-safe: must be called on the OnNewEvent goroutine only
 func (n *Notifier) addPeekingDevice(roomID, userID, deviceID string) {
 	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
@@ -0,0 +1,340 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package push decides which local users should be notified about new room
+// events, records the notifications and delivers them to the push gateways
+// of the users' pushers.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// Worker records notifications for new room events and sends them to push gateways.
+type Worker struct {
+	serverName gomatrixserverlib.ServerName
+	db         storage.Database
+	userAPI    userapi.UserInternalAPI
+	client     pushgateway.Client
+	// async controls whether pushes are sent in the background, so that
+	// slow push gateways don't hold up the consumers. Tests turn it off.
+	async bool
+}
+
+// NewWorker creates a new push worker.
+func NewWorker(
+	serverName gomatrixserverlib.ServerName,
+	db storage.Database,
+	userAPI userapi.UserInternalAPI,
+	client pushgateway.Client,
+) *Worker {
+	return &Worker{
+		serverName: serverName,
+		db:         db,
+		userAPI:    userAPI,
+		client:     client,
+		async:      true,
+	}
+}
+
+// OnNewEvent is called once a new room event has been written to the
+// database at the given stream position. It records a notification for
+// each local user who should be notified about the event, and sends it
+// to their pushers.
+func (w *Worker) OnNewEvent(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) error {
+	joined, err := w.db.JoinedUsersInRoom(ctx, event.RoomID())
+	if err != nil {
+		return fmt.Errorf("w.db.JoinedUsersInRoom: %w", err)
+	}
+	for _, userID := range w.candidateUsers(event, joined) {
+		ec := &ruleSetEvalContext{
+			ctx:         ctx,
+			db:          w.db,
+			roomID:      event.RoomID(),
+			userID:      userID,
+			memberCount: len(joined),
+		}
+		notify, tweaks, err := w.evaluatePushRules(ctx, ec, event, userID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("Failed to evaluate push rules")
+			continue
+		}
+		if !notify {
+			continue
+		}
+		highlight := pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false)
+		if err = w.db.InsertNotification(ctx, userID, event.RoomID(), event.EventID(), pos, highlight); err != nil {
+			return fmt.Errorf("w.db.InsertNotification: %w", err)
+		}
+		w.push(userID, event, tweaks)
+	}
+	return nil
+}
+
+// OnReceipt is called when a user sends a receipt. Read receipts mark
+// the notifications of the user in the room as read, up to and including
+// the event of the receipt, and update the unread count of the user's
+// pushers.
+func (w *Worker) OnReceipt(
+	ctx context.Context, userID, roomID, receiptType, eventID string,
+) error {
+	if receiptType != "m.read" || !w.isLocalUser(userID) {
+		return nil
+	}
+	_, pos, err := w.db.PositionInTopology(ctx, eventID)
+	if err != nil {
+		// We don't know about the event, so can't tell which notifications it covers.
+		log.WithError(err).WithField("event_id", eventID).Debug("Ignoring read receipt for unknown event")
+		return nil
+	}
+	affected, err := w.db.DeleteNotificationsUpTo(ctx, userID, roomID, pos)
+	if err != nil {
+		return fmt.Errorf("w.db.DeleteNotificationsUpTo: %w", err)
+	}
+	if affected {
+		w.push(userID, nil, nil)
+	}
+	return nil
+}
+
+// candidateUsers returns the local users who might be notified about the
+// event: the users joined to the room and, for invites, the invited user.
+// The sender of the event is never notified.
+func (w *Worker) candidateUsers(event *gomatrixserverlib.HeaderedEvent, joined []string) []string {
+	candidates := joined
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKey() != nil {
+		if membership, err := event.Membership(); err == nil && membership == gomatrixserverlib.Invite {
+			candidates = append(candidates[:len(candidates):len(candidates)], *event.StateKey())
+		}
+	}
+	var userIDs []string
+	seen := make(map[string]bool, len(candidates))
+	for _, userID := range candidates {
+		if seen[userID] || userID == event.Sender() || !w.isLocalUser(userID) {
+			continue
+		}
+		seen[userID] = true
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+func (w *Worker) isLocalUser(userID string) bool {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	return err == nil && domain == w.serverName
+}
+
+// evaluatePushRules matches the event against the push rules of the
+// user. It returns whether the user should be notified, and the tweaks
+// of the matching rule.
+func (w *Worker) evaluatePushRules(
+	ctx context.Context, ec pushrules.EvaluationContext,
+	event *gomatrixserverlib.HeaderedEvent, userID string,
+) (bool, map[string]interface{}, error) {
+	var res userapi.QueryPushRulesResponse
+	if err := w.userAPI.QueryPushRules(ctx, &userapi.QueryPushRulesRequest{UserID: userID}, &res); err != nil {
+		return false, nil, fmt.Errorf("w.userAPI.QueryPushRules: %w", err)
+	}
+	rule, err := pushrules.NewRuleSetEvaluator(ec, &res.RuleSets.Global).MatchEvent(event.Unwrap())
+	if err != nil {
+		return false, nil, fmt.Errorf("MatchEvent: %w", err)
+	}
+	if rule == nil {
+		return false, nil, nil
+	}
+	kind, tweaks, err := pushrules.ActionsToTweaks(rule.Actions)
+	if err != nil {
+		return false, nil, fmt.Errorf("pushrules.ActionsToTweaks: %w", err)
+	}
+	// The coalesce action is unspecified, and is treated like notify.
+	return kind == pushrules.NotifyAction || kind == pushrules.CoalesceAction, tweaks, nil
+}
+
+// A ruleSetEvalContext gives the push rules of a user access to the
+// state of the room of the event.
+type ruleSetEvalContext struct {
+	ctx         context.Context
+	db          storage.Database
+	roomID      string
+	userID      string
+	memberCount int
+}
+
+func (ec *ruleSetEvalContext) UserDisplayName() string {
+	ev, err := ec.db.GetStateEvent(ec.ctx, ec.roomID, gomatrixserverlib.MRoomMember, ec.userID)
+	if err != nil || ev == nil {
+		return ""
+	}
+	var content gomatrixserverlib.MemberContent
+	if err = json.Unmarshal(ev.Content(), &content); err != nil {
+		return ""
+	}
+	return content.DisplayName
+}
+
+func (ec *ruleSetEvalContext) RoomMemberCount() (int, error) {
+	return ec.memberCount, nil
+}
+
+func (ec *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	ev, err := ec.db.GetStateEvent(ec.ctx, ec.roomID, gomatrixserverlib.MRoomPowerLevels, "")
+	if err != nil {
+		return false, err
+	}
+	var plc gomatrixserverlib.PowerLevelContent
+	if ev == nil {
+		plc.Defaults()
+	} else if plc, err = gomatrixserverlib.NewPowerLevelContentFromEvent(ev.Event); err != nil {
+		return false, err
+	}
+	return plc.UserLevel(userID) >= plc.NotificationLevel(levelKey), nil
+}
+
+// push sends the event and the tweaks of the matching push rule to the
+// pushers of the user, along with the unread count of the user. A nil
+// event only updates the unread count.
+func (w *Worker) push(userID string, event *gomatrixserverlib.HeaderedEvent, tweaks map[string]interface{}) {
+	if !w.async {
+		w.sendToPushers(context.Background(), userID, event, tweaks)
+		return
+	}
+	go w.sendToPushers(context.Background(), userID, event, tweaks)
+}
+
+func (w *Worker) sendToPushers(ctx context.Context, userID string, event *gomatrixserverlib.HeaderedEvent, tweaks map[string]interface{}) {
+	logger := log.WithField("user_id", userID)
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to split user ID")
+		return
+	}
+	var res userapi.QueryPushersResponse
+	if err = w.userAPI.QueryPushers(ctx, &userapi.QueryPushersRequest{Localpart: localpart}, &res); err != nil {
+		logger.WithError(err).Error("Failed to query pushers")
+		return
+	}
+	if len(res.Pushers) == 0 {
+		return
+	}
+	unread, err := w.db.UnreadNotificationCount(ctx, userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to count unread notifications")
+		return
+	}
+
+	for i := range res.Pushers {
+		pusher := &res.Pushers[i]
+		if pusher.Kind != userapi.HTTPKind {
+			// TODO: Email pushers
+			continue
+		}
+		url, ok := pusher.Data["url"].(string)
+		if !ok {
+			continue
+		}
+		// The URL is only used by the homeserver, so isn't sent to the push gateway.
+		data := make(map[string]interface{}, len(pusher.Data))
+		for k, v := range pusher.Data {
+			if k != "url" {
+				data[k] = v
+			}
+		}
+		req := pushgateway.NotifyRequest{
+			Notification: pushgateway.Notification{
+				Counts: &pushgateway.Counts{Unread: unread},
+				Devices: []*pushgateway.Device{{
+					AppID:     pusher.AppID,
+					Data:      data,
+					PushKey:   pusher.PushKey,
+					PushKeyTS: pusher.PushKeyTS,
+					Tweaks:    tweaks,
+				}},
+			},
+		}
+		if event != nil {
+			w.fillNotification(ctx, &req.Notification, event, userID, data["format"] == "event_id_only")
+		}
+		var notifyRes pushgateway.NotifyResponse
+		if err = w.client.Notify(ctx, url, &req, &notifyRes); err != nil {
+			logger.WithError(err).WithField("url", url).Warn("Failed to send push notification")
+			continue
+		}
+		for _, pushKey := range notifyRes.Rejected {
+			if pushKey != pusher.PushKey {
+				continue
+			}
+			// The push gateway no longer knows about the push key, so remove the pusher.
+			deleteReq := userapi.PerformPusherSetRequest{
+				Pusher:    userapi.Pusher{AppID: pusher.AppID, PushKey: pushKey},
+				Localpart: localpart,
+			}
+			if err = w.userAPI.PerformPusherSet(ctx, &deleteReq, &userapi.PerformPusherSetResponse{}); err != nil {
+				logger.WithError(err).Error("Failed to remove rejected pusher")
+			}
+		}
+	}
+}
+
+// fillNotification adds the details of the event to the notification. Only the
+// event and room IDs are sent when the pusher asks for the event_id_only format.
+func (w *Worker) fillNotification(
+	ctx context.Context, n *pushgateway.Notification,
+	event *gomatrixserverlib.HeaderedEvent, userID string, eventIDOnly bool,
+) {
+	n.EventID = event.EventID()
+	n.RoomID = event.RoomID()
+	n.Prio = pushgateway.HighPrio
+	if eventIDOnly {
+		return
+	}
+	n.Type = event.Type()
+	n.Sender = event.Sender()
+	n.Content = event.Content()
+	n.UserIsTarget = event.StateKey() != nil && *event.StateKey() == userID
+
+	if ev, err := w.db.GetStateEvent(ctx, event.RoomID(), gomatrixserverlib.MRoomName, ""); err == nil && ev != nil {
+		var content struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(ev.Content(), &content); err == nil {
+			n.RoomName = content.Name
+		}
+	}
+	if ev, err := w.db.GetStateEvent(ctx, event.RoomID(), gomatrixserverlib.MRoomCanonicalAlias, ""); err == nil && ev != nil {
+		var content struct {
+			Alias string `json:"alias"`
+		}
+		if err = json.Unmarshal(ev.Content(), &content); err == nil {
+			n.RoomAlias = content.Alias
+		}
+	}
+	if ev, err := w.db.GetStateEvent(ctx, event.RoomID(), gomatrixserverlib.MRoomMember, event.Sender()); err == nil && ev != nil {
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(ev.Content(), &content); err == nil {
+			n.SenderDisplayName = content.DisplayName
+		}
+	}
+}
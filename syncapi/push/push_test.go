@@ -0,0 +1,292 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testRoomID   = "!room:localhost"
+	testPushURL  = "https://push.example.com/_matrix/push/v1/notify"
+	testAppID    = "com.example.app"
+	testPushKey  = "alice_pushkey"
+	testBadKey   = "stale_pushkey"
+	testSender   = "@bob:localhost"
+	testUserID   = "@alice:localhost"
+	testRemoteID = "@charlie:remote"
+)
+
+type testUserAPI struct {
+	userapi.UserInternalAPI
+	pushers   map[string][]userapi.Pusher
+	pushRules map[string]*pushrules.AccountRuleSets
+}
+
+func (u *testUserAPI) QueryPushRules(ctx context.Context, req *userapi.QueryPushRulesRequest, res *userapi.QueryPushRulesResponse) error {
+	if ruleSets, ok := u.pushRules[req.UserID]; ok {
+		res.RuleSets = ruleSets
+		return nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	res.RuleSets = pushrules.DefaultAccountRuleSets(localpart, "localhost")
+	return nil
+}
+
+func (u *testUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	res.Pushers = u.pushers[req.Localpart]
+	return nil
+}
+
+func (u *testUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *userapi.PerformPusherSetResponse) error {
+	var pushers []userapi.Pusher
+	for _, p := range u.pushers[req.Localpart] {
+		if p.AppID != req.AppID || p.PushKey != req.PushKey {
+			pushers = append(pushers, p)
+		}
+	}
+	if req.Kind != "" {
+		pushers = append(pushers, req.Pusher)
+	}
+	u.pushers[req.Localpart] = pushers
+	return nil
+}
+
+type testPushGateway struct {
+	requests []pushgateway.NotifyRequest
+}
+
+func (g *testPushGateway) Notify(ctx context.Context, url string, req *pushgateway.NotifyRequest, res *pushgateway.NotifyResponse) error {
+	if url != testPushURL {
+		return fmt.Errorf("unexpected URL %s", url)
+	}
+	g.requests = append(g.requests, *req)
+	for _, device := range req.Notification.Devices {
+		if device.PushKey == testBadKey {
+			res.Rejected = append(res.Rejected, device.PushKey)
+		}
+	}
+	return nil
+}
+
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	t.Helper()
+	tmpfile, err := ioutil.TempFile("", "syncapi_push_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewSyncServerDatasource(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource failed: %s", err)
+	}
+	return db, func() {
+		os.Remove(tmpfile.Name()) // nolint: errcheck
+	}
+}
+
+func mustWriteEvent(
+	t *testing.T, db storage.Database, key ed25519.PrivateKey, depth int64,
+	sender, evType string, stateKey *string, content interface{},
+) (*gomatrixserverlib.HeaderedEvent, types.StreamPosition) {
+	t.Helper()
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     testRoomID,
+		Type:       evType,
+		StateKey:   stateKey,
+		Depth:      depth,
+		PrevEvents: []gomatrixserverlib.EventReference{},
+		AuthEvents: []gomatrixserverlib.EventReference{},
+	}
+	if err := builder.SetContent(content); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hev := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	var addState []*gomatrixserverlib.HeaderedEvent
+	var addStateIDs []string
+	if stateKey != nil {
+		addState = []*gomatrixserverlib.HeaderedEvent{hev}
+		addStateIDs = []string{hev.EventID()}
+	}
+	pos, err := db.WriteEvent(context.Background(), hev, addState, addStateIDs, nil, nil, false)
+	if err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	return hev, pos
+}
+
+func TestWorker(t *testing.T) {
+	ctx := context.Background()
+	db, clean := mustCreateDatabase(t)
+	defer clean()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userAPI := &testUserAPI{
+		pushers: map[string][]userapi.Pusher{
+			"alice": {
+				{
+					AppID: testAppID, PushKey: testPushKey, Kind: userapi.HTTPKind,
+					Data: map[string]interface{}{"url": testPushURL},
+				},
+				{
+					AppID: testAppID, PushKey: testBadKey, Kind: userapi.HTTPKind,
+					Data: map[string]interface{}{"url": testPushURL, "format": "event_id_only"},
+				},
+			},
+		},
+	}
+	gateway := &testPushGateway{}
+	w := NewWorker("localhost", db, userAPI, gateway)
+	w.async = false
+
+	empty := ""
+	alice, bob, charlie := testUserID, testSender, testRemoteID
+	mustWriteEvent(t, db, key, 1, bob, gomatrixserverlib.MRoomCreate, &empty, map[string]interface{}{"creator": bob})
+	mustWriteEvent(t, db, key, 2, bob, gomatrixserverlib.MRoomMember, &bob, map[string]interface{}{"membership": "join", "displayname": "Bob"})
+	mustWriteEvent(t, db, key, 3, bob, gomatrixserverlib.MRoomName, &empty, map[string]interface{}{"name": "Kaer Morhen"})
+	mustWriteEvent(t, db, key, 4, alice, gomatrixserverlib.MRoomMember, &alice, map[string]interface{}{"membership": "join"})
+	mustWriteEvent(t, db, key, 5, charlie, gomatrixserverlib.MRoomMember, &charlie, map[string]interface{}{"membership": "join"})
+
+	// Alice is notified about Bob's message, but not Bob or the remote user.
+	msg, pos := mustWriteEvent(t, db, key, 6, bob, "m.room.message", nil, map[string]interface{}{"body": "hello"})
+	if err = w.OnNewEvent(ctx, msg, pos); err != nil {
+		t.Fatalf("OnNewEvent failed: %s", err)
+	}
+	if len(gateway.requests) != 2 {
+		t.Fatalf("got %d push requests, want 2", len(gateway.requests))
+	}
+	n := gateway.requests[0].Notification
+	if n.EventID != msg.EventID() || n.Sender != bob || n.SenderDisplayName != "Bob" || n.RoomName != "Kaer Morhen" {
+		t.Errorf("got notification %+v, want the message details", n)
+	}
+	if n.Counts == nil || n.Counts.Unread != 1 {
+		t.Errorf("got counts %+v, want 1 unread", n.Counts)
+	}
+	if len(n.Devices) != 1 || n.Devices[0].PushKey != testPushKey {
+		t.Fatalf("got devices %+v, want the pusher", n.Devices)
+	}
+	if _, ok := n.Devices[0].Data["url"]; ok {
+		t.Errorf("the pusher URL was sent to the push gateway")
+	}
+	if n = gateway.requests[1].Notification; n.EventID != msg.EventID() || n.Sender != "" || len(n.Content) != 0 {
+		t.Errorf("got notification %+v, want only the event ID", n)
+	}
+
+	// The push gateway rejected the stale push key, so the pusher was removed.
+	if pushers := userAPI.pushers["alice"]; len(pushers) != 1 || pushers[0].PushKey != testPushKey {
+		t.Errorf("got pushers %+v, want the rejected pusher to be removed", pushers)
+	}
+
+	// Events which don't notify are ignored.
+	topic, pos := mustWriteEvent(t, db, key, 7, bob, "m.room.topic", &empty, map[string]interface{}{"topic": "witchers"})
+	if err = w.OnNewEvent(ctx, topic, pos); err != nil {
+		t.Fatalf("OnNewEvent failed: %s", err)
+	}
+	msg2, pos := mustWriteEvent(t, db, key, 8, bob, "m.room.message", nil, map[string]interface{}{"body": "are you there?"})
+	if err = w.OnNewEvent(ctx, msg2, pos); err != nil {
+		t.Fatalf("OnNewEvent failed: %s", err)
+	}
+	if len(gateway.requests) != 3 || gateway.requests[2].Notification.Counts.Unread != 2 {
+		t.Fatalf("got push requests %+v, want one more with 2 unread", gateway.requests)
+	}
+
+	// Reading the first message leaves one unread notification, and
+	// updates the count on the pushers.
+	if err = w.OnReceipt(ctx, alice, testRoomID, "m.read", msg.EventID()); err != nil {
+		t.Fatalf("OnReceipt failed: %s", err)
+	}
+	if count, err := db.UnreadNotificationCount(ctx, alice); err != nil || count != 1 {
+		t.Fatalf("UnreadNotificationCount returned %d, %v, want 1", count, err)
+	}
+	if len(gateway.requests) != 4 {
+		t.Fatalf("got %d push requests, want 4", len(gateway.requests))
+	}
+	if n = gateway.requests[3].Notification; n.EventID != "" || n.Counts == nil || n.Counts.Unread != 1 {
+		t.Errorf("got notification %+v, want only 1 unread", n)
+	}
+
+	// Reading the same message again doesn't change anything.
+	if err = w.OnReceipt(ctx, alice, testRoomID, "m.read", msg.EventID()); err != nil {
+		t.Fatalf("OnReceipt failed: %s", err)
+	}
+	if len(gateway.requests) != 4 {
+		t.Fatalf("got %d push requests, want no more", len(gateway.requests))
+	}
+
+	// Mentioning Alice highlights the notification.
+	msg3, pos := mustWriteEvent(t, db, key, 9, bob, "m.room.message", nil, map[string]interface{}{"body": "alice: hi"})
+	if err = w.OnNewEvent(ctx, msg3, pos); err != nil {
+		t.Fatalf("OnNewEvent failed: %s", err)
+	}
+	if len(gateway.requests) != 5 {
+		t.Fatalf("got %d push requests, want 5", len(gateway.requests))
+	}
+	if tweaks := gateway.requests[4].Notification.Devices[0].Tweaks; tweaks["highlight"] != true || tweaks["sound"] != "default" {
+		t.Errorf("got tweaks %+v, want a highlight with the default sound", tweaks)
+	}
+
+	// A sender rule of Alice's mutes Bob.
+	ruleSets := pushrules.DefaultAccountRuleSets("alice", "localhost")
+	ruleSets.Global.Sender = append(ruleSets.Global.Sender, &pushrules.Rule{
+		RuleID:  bob,
+		Enabled: true,
+		Actions: []*pushrules.Action{{Kind: pushrules.DontNotifyAction}},
+	})
+	userAPI.pushRules = map[string]*pushrules.AccountRuleSets{alice: ruleSets}
+	msg4, pos := mustWriteEvent(t, db, key, 10, bob, "m.room.message", nil, map[string]interface{}{"body": "hello?"})
+	if err = w.OnNewEvent(ctx, msg4, pos); err != nil {
+		t.Fatalf("OnNewEvent failed: %s", err)
+	}
+	if len(gateway.requests) != 5 {
+		t.Fatalf("got %d push requests, want no more", len(gateway.requests))
+	}
+
+	// The second message and the mention are unread, and the mention is highlighted.
+	counts, err := db.RoomUnreadNotificationCounts(ctx, alice)
+	if err != nil {
+		t.Fatalf("RoomUnreadNotificationCounts failed: %s", err)
+	}
+	want := map[string]types.UnreadNotifications{testRoomID: {NotificationCount: 2, HighlightCount: 1}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("RoomUnreadNotificationCounts returned %+v, want %+v", counts, want)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type exportAccount struct {
+	UserID string `json:"user_id"`
+}
+
+type exportProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// exportDevice deliberately omits the access token.
+type exportDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+type exportAccountData struct {
+	Global map[string]json.RawMessage            `json:"global"`
+	Rooms  map[string]map[string]json.RawMessage `json:"rooms"`
+}
+
+// exportRoom describes a room that the user has sent events in, as it
+// currently appears to this server.
+type exportRoom struct {
+	Name           string `json:"name,omitempty"`
+	CanonicalAlias string `json:"canonical_alias,omitempty"`
+	Membership     string `json:"membership,omitempty"`
+}
+
+// ExportUserData implements GET /admin/users/{userID}/export, which streams
+// a zip archive of everything this server holds about a local user. Events
+// are read from the database in batches of cfg.UserDataExport.BatchSize and
+// written straight out, so large accounts are never held in memory.
+func ExportUserData(
+	w http.ResponseWriter, req *http.Request, syncDB storage.Database,
+	userAPI userapi.UserInternalAPI, cfg *config.SyncAPI, userID string,
+) {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		writeJSONResponse(w, util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername("Invalid user ID"),
+		})
+		return
+	}
+	if domain != cfg.Matrix.ServerName {
+		writeJSONResponse(w, util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be exported"),
+		})
+		return
+	}
+	var profileRes userapi.QueryProfileResponse
+	if err = userAPI.QueryProfile(req.Context(), &userapi.QueryProfileRequest{
+		UserID: userID,
+	}, &profileRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryProfile failed")
+		writeJSONResponse(w, jsonerror.InternalServerError())
+		return
+	}
+	if !profileRes.UserExists {
+		writeJSONResponse(w, util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		})
+		return
+	}
+
+	// Once we start writing the archive we can no longer change the status
+	// code, so any errors from here on truncate the archive instead.
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", userID+".zip"))
+	w.WriteHeader(http.StatusOK)
+	if err = exportUserData(req.Context(), w, syncDB, userAPI, userID, &profileRes, cfg.UserDataExport.BatchSize); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to export user data")
+	}
+}
+
+func exportUserData(
+	ctx context.Context, w io.Writer, syncDB storage.Database,
+	userAPI userapi.UserInternalAPI, userID string,
+	profile *userapi.QueryProfileResponse, batchSize int,
+) error {
+	zw := zip.NewWriter(w)
+
+	if err := writeZipJSON(zw, "account.json", exportAccount{
+		UserID: userID,
+	}); err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "profile.json", exportProfile{
+		DisplayName: profile.DisplayName,
+		AvatarURL:   profile.AvatarURL,
+	}); err != nil {
+		return err
+	}
+
+	var devicesRes userapi.QueryDevicesResponse
+	if err := userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{
+		UserID: userID,
+	}, &devicesRes); err != nil {
+		return fmt.Errorf("userAPI.QueryDevices: %w", err)
+	}
+	devices := make([]exportDevice, 0, len(devicesRes.Devices))
+	for _, dev := range devicesRes.Devices {
+		devices = append(devices, exportDevice{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenTS:  dev.LastSeenTS,
+			LastSeenIP:  dev.LastSeenIP,
+			UserAgent:   dev.UserAgent,
+		})
+	}
+	if err := writeZipJSON(zw, "devices.json", devices); err != nil {
+		return err
+	}
+
+	var threePIDsRes userapi.QueryThreePIDsResponse
+	if err := userAPI.QueryThreePIDs(ctx, &userapi.QueryThreePIDsRequest{
+		UserID: userID,
+	}, &threePIDsRes); err != nil {
+		return fmt.Errorf("userAPI.QueryThreePIDs: %w", err)
+	}
+	if err := writeZipJSON(zw, "threepids.json", threePIDsRes.ThreePIDs); err != nil {
+		return err
+	}
+
+	var accountDataRes userapi.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID: userID,
+	}, &accountDataRes); err != nil {
+		return fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	if err := writeZipJSON(zw, "account_data.json", exportAccountData{
+		Global: accountDataRes.GlobalAccountData,
+		Rooms:  accountDataRes.RoomAccountData,
+	}); err != nil {
+		return err
+	}
+
+	// Events are written one per line, oldest first, so that the file can
+	// be produced (and consumed) a batch at a time.
+	ew, err := zw.Create("events.jsonl")
+	if err != nil {
+		return err
+	}
+	roomIDs := map[string]struct{}{}
+	var pos types.StreamPosition
+	for {
+		var events []*gomatrixserverlib.HeaderedEvent
+		events, pos, err = syncDB.EventsSentByUser(ctx, userID, pos, batchSize)
+		if err != nil {
+			return fmt.Errorf("syncDB.EventsSentByUser: %w", err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, ev := range events {
+			roomIDs[ev.RoomID()] = struct{}{}
+			if _, err = ew.Write(append(ev.JSON(), '\n')); err != nil {
+				return err
+			}
+		}
+	}
+
+	rooms := make(map[string]exportRoom, len(roomIDs))
+	for roomID := range roomIDs {
+		if rooms[roomID], err = exportRoomContext(ctx, syncDB, roomID, userID); err != nil {
+			return err
+		}
+	}
+	if err = writeZipJSON(zw, "rooms.json", rooms); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// exportRoomContext returns the current name, alias and user's membership of
+// the given room, where known.
+func exportRoomContext(ctx context.Context, syncDB storage.Database, roomID, userID string) (exportRoom, error) {
+	var room exportRoom
+	var content struct {
+		Name       string `json:"name"`
+		Alias      string `json:"alias"`
+		Membership string `json:"membership"`
+	}
+	for _, tuple := range []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomName, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+	} {
+		ev, err := syncDB.GetStateEvent(ctx, roomID, tuple.EventType, tuple.StateKey)
+		if err != nil {
+			return room, fmt.Errorf("syncDB.GetStateEvent: %w", err)
+		}
+		if ev == nil {
+			continue
+		}
+		if err = json.Unmarshal(ev.Content(), &content); err != nil {
+			continue
+		}
+	}
+	room.Name = content.Name
+	room.CanonicalAlias = content.Alias
+	room.Membership = content.Membership
+	return room, nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(fw).Encode(v)
+}
+
+func writeJSONResponse(w http.ResponseWriter, res util.JSONResponse) {
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	_, _ = w.Write(body)
+}
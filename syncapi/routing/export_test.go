@@ -0,0 +1,238 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	exportTestRoomID = "!room:localhost"
+	exportTestUserID = "@alice:localhost"
+	exportTestOther  = "@bob:localhost"
+)
+
+type exportTestUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *exportTestUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
+	if req.UserID != exportTestUserID {
+		return nil
+	}
+	res.UserExists = true
+	res.DisplayName = "Alice"
+	res.AvatarURL = "mxc://localhost/alice"
+	return nil
+}
+
+func (u *exportTestUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.UserExists = true
+	res.Devices = []userapi.Device{
+		{ID: "PHONE", UserID: exportTestUserID, AccessToken: "secret_token"},
+	}
+	return nil
+}
+
+func (u *exportTestUserAPI) QueryThreePIDs(ctx context.Context, req *userapi.QueryThreePIDsRequest, res *userapi.QueryThreePIDsResponse) error {
+	res.ThreePIDs = []authtypes.ThreePID{{Address: "alice@example.com", Medium: "email"}}
+	return nil
+}
+
+func (u *exportTestUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.GlobalAccountData = map[string]json.RawMessage{
+		"m.direct": json.RawMessage(`{}`),
+	}
+	return nil
+}
+
+func mustCreateExportTestDatabase(t *testing.T) (storage.Database, func()) {
+	t.Helper()
+	tmpfile, err := ioutil.TempFile("", "syncapi_export_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewSyncServerDatasource(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource failed: %s", err)
+	}
+	return db, func() {
+		os.Remove(tmpfile.Name()) // nolint: errcheck
+	}
+}
+
+func mustWriteExportTestEvent(
+	t *testing.T, db storage.Database, key ed25519.PrivateKey, depth int64,
+	sender, evType string, stateKey *string, content interface{},
+) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     exportTestRoomID,
+		Type:       evType,
+		StateKey:   stateKey,
+		Depth:      depth,
+		PrevEvents: []gomatrixserverlib.EventReference{},
+		AuthEvents: []gomatrixserverlib.EventReference{},
+	}
+	if err := builder.SetContent(content); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hev := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	var addState []*gomatrixserverlib.HeaderedEvent
+	var addStateIDs []string
+	if stateKey != nil {
+		addState = []*gomatrixserverlib.HeaderedEvent{hev}
+		addStateIDs = []string{hev.EventID()}
+	}
+	if _, err = db.WriteEvent(context.Background(), hev, addState, addStateIDs, nil, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	return hev
+}
+
+func TestExportUserData(t *testing.T) {
+	db, clean := mustCreateExportTestDatabase(t)
+	defer clean()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty := ""
+	alice := exportTestUserID
+	bob := exportTestOther
+	want := []*gomatrixserverlib.HeaderedEvent{
+		mustWriteExportTestEvent(t, db, key, 1, alice, gomatrixserverlib.MRoomCreate, &empty, map[string]interface{}{"creator": alice}),
+		mustWriteExportTestEvent(t, db, key, 2, alice, gomatrixserverlib.MRoomMember, &alice, map[string]interface{}{"membership": "join"}),
+		mustWriteExportTestEvent(t, db, key, 3, alice, gomatrixserverlib.MRoomName, &empty, map[string]interface{}{"name": "Kaer Morhen"}),
+	}
+	mustWriteExportTestEvent(t, db, key, 4, bob, gomatrixserverlib.MRoomMember, &bob, map[string]interface{}{"membership": "join"})
+	mustWriteExportTestEvent(t, db, key, 5, bob, "m.room.message", nil, map[string]interface{}{"body": "not alice's"})
+	want = append(want, mustWriteExportTestEvent(t, db, key, 6, alice, "m.room.message", nil, map[string]interface{}{"body": "hello"}))
+
+	cfg := &config.SyncAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	cfg.UserDataExport.Defaults()
+	// Use a tiny batch size so that paging through the events is exercised.
+	cfg.UserDataExport.BatchSize = 1
+
+	req := httptest.NewRequest(http.MethodGet, "/export", nil)
+	rec := httptest.NewRecorder()
+	ExportUserData(rec, req, db, &exportTestUserAPI{}, cfg, exportTestUserID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to read archive: %s", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var profile exportProfile
+	if err = json.Unmarshal(files["profile.json"], &profile); err != nil {
+		t.Fatalf("failed to read profile.json: %s", err)
+	}
+	if profile.DisplayName != "Alice" || profile.AvatarURL != "mxc://localhost/alice" {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+	if bytes.Contains(files["devices.json"], []byte("secret_token")) {
+		t.Errorf("devices.json contains an access token: %s", files["devices.json"])
+	}
+
+	var got []string
+	scanner := bufio.NewScanner(bytes.NewReader(files["events.jsonl"]))
+	for scanner.Scan() {
+		var ev struct {
+			EventID string `json:"event_id"`
+			Sender  string `json:"sender"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("failed to read events.jsonl: %s", err)
+		}
+		if ev.Sender != exportTestUserID {
+			t.Errorf("exported event %s sent by %s", ev.EventID, ev.Sender)
+		}
+		got = append(got, ev.EventID)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i].EventID() {
+			t.Errorf("event %d: got %s, want %s", i, got[i], want[i].EventID())
+		}
+	}
+
+	var rooms map[string]exportRoom
+	if err = json.Unmarshal(files["rooms.json"], &rooms); err != nil {
+		t.Fatalf("failed to read rooms.json: %s", err)
+	}
+	if room := rooms[exportTestRoomID]; room.Name != "Kaer Morhen" || room.Membership != "join" {
+		t.Errorf("unexpected room context: %+v", room)
+	}
+}
+
+func TestExportUserDataUnknownUser(t *testing.T) {
+	cfg := &config.SyncAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	cfg.UserDataExport.Defaults()
+
+	for userID, wantCode := range map[string]int{
+		"@nobody:localhost": http.StatusNotFound,
+		"@alice:remote":     http.StatusBadRequest,
+		"not-a-user-id":     http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/export", nil)
+		rec := httptest.NewRecorder()
+		ExportUserData(rec, req, nil, &exportTestUserAPI{}, cfg, userID)
+		if rec.Code != wantCode {
+			t.Errorf("%s: got HTTP %d, want %d", userID, rec.Code, wantCode)
+		}
+	}
+}
@@ -305,41 +305,46 @@ func (r *messagesReq) retrieveEvents() (
 	return clientEvents, start, end, err
 }
 
+// filterHistoryVisible removes the events which the requesting user isn't
+// allowed to see according to the history visibility of the room at the time
+// that each event was sent.
 func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
-	// TODO FIXME: We don't fully implement history visibility yet. To avoid leaking events which the
-	// user shouldn't see, we check the recent events and remove any prior to the join event of the user
-	// which is equiv to history_visibility: joined
-	joinEventIndex := -1
-	for i, ev := range events {
-		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(r.device.UserID) {
-			membership, _ := ev.Membership()
-			if membership == "join" {
-				joinEventIndex = i
-				break
-			}
-		}
+	var membershipRes api.QueryMembershipForUserResponse
+	err := r.rsAPI.QueryMembershipForUser(r.ctx, &api.QueryMembershipForUserRequest{
+		RoomID: r.roomID,
+		UserID: r.device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		util.GetLogger(r.ctx).WithError(err).Error("failed to query membership, omitting events")
+		return []*gomatrixserverlib.HeaderedEvent{}
 	}
 
-	var result []*gomatrixserverlib.HeaderedEvent
-	var eventsToCheck []*gomatrixserverlib.HeaderedEvent
-	if joinEventIndex != -1 {
-		if r.backwardOrdering {
-			result = events[:joinEventIndex+1]
-			eventsToCheck = append(eventsToCheck, result[0])
-		} else {
-			result = events[joinEventIndex:]
-			eventsToCheck = append(eventsToCheck, result[len(result)-1])
+	result := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		visibility, membership, err := r.visibilityAtEvent(ev)
+		if err != nil {
+			util.GetLogger(r.ctx).WithError(err).WithField("event_id", ev.EventID()).Warn("failed to get history visibility, omitting event")
+			continue
 		}
-	} else {
-		eventsToCheck = []*gomatrixserverlib.HeaderedEvent{events[0], events[len(events)-1]}
-		result = events
+		if historyVisibleToUser(visibility, membership, membershipRes.IsInRoom) {
+			result = append(result, ev)
+		}
+	}
+	if omitted := len(events) - len(result); omitted > 0 {
+		util.GetLogger(r.ctx).WithField("num_events", omitted).Debugf("history not visible to %s, omitting events", r.device.UserID)
 	}
-	// make sure the user was in the room for both the earliest and latest events, we need this because
-	// some backpagination results will not have the join event (e.g if they hit /messages at the join event itself)
-	wasJoined := true
-	for _, ev := range eventsToCheck {
+	return result
+}
+
+// visibilityAtEvent returns the history visibility of the room and the membership
+// of the requesting user at the time that the given event was sent.
+func (r *messagesReq) visibilityAtEvent(ev *gomatrixserverlib.HeaderedEvent) (visibility, membership string, err error) {
+	// By default if no history_visibility is set, the visibility is assumed to be shared.
+	visibility = historyVisibilityShared
+	membership = gomatrixserverlib.Leave
+	if len(ev.PrevEventIDs()) > 0 {
 		var queryRes api.QueryStateAfterEventsResponse
-		err := r.rsAPI.QueryStateAfterEvents(r.ctx, &api.QueryStateAfterEventsRequest{
+		err = r.rsAPI.QueryStateAfterEvents(r.ctx, &api.QueryStateAfterEventsRequest{
 			RoomID:       ev.RoomID(),
 			PrevEventIDs: ev.PrevEventIDs(),
 			StateToFetch: []gomatrixserverlib.StateKeyTuple{
@@ -348,44 +353,72 @@ func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedE
 			},
 		}, &queryRes)
 		if err != nil {
-			wasJoined = false
-			break
+			return "", "", fmt.Errorf("r.rsAPI.QueryStateAfterEvents: %w", err)
+		}
+		if !queryRes.RoomExists || !queryRes.PrevEventsExist {
+			return "", "", fmt.Errorf("no state known before event %s", ev.EventID())
 		}
-		var hisVisEvent, membershipEvent *gomatrixserverlib.HeaderedEvent
-		for i := range queryRes.StateEvents {
-			switch queryRes.StateEvents[i].Type() {
+		for _, stateEvent := range queryRes.StateEvents {
+			switch stateEvent.Type() {
 			case gomatrixserverlib.MRoomMember:
-				membershipEvent = queryRes.StateEvents[i]
+				if m, merr := stateEvent.Membership(); merr == nil {
+					membership = m
+				}
 			case gomatrixserverlib.MRoomHistoryVisibility:
-				hisVisEvent = queryRes.StateEvents[i]
+				// Values which aren't understood are also treated as shared.
+				switch v, _ := stateEvent.HistoryVisibility(); v {
+				case historyVisibilityWorldReadable, historyVisibilityShared, historyVisibilityInvited, historyVisibilityJoined:
+					visibility = v
+				}
 			}
 		}
-		if hisVisEvent == nil {
-			return events // apply no filtering as it defaults to Shared.
-		}
-		hisVis, _ := hisVisEvent.HistoryVisibility()
-		if hisVis == "shared" || hisVis == "world_readable" {
-			return events // apply no filtering
-		}
-		if membershipEvent == nil {
-			wasJoined = false
-			break
-		}
-		membership, err := membershipEvent.Membership()
-		if err != nil {
-			wasJoined = false
-			break
-		}
-		if membership != "join" {
-			wasJoined = false
-			break
+	}
+	// Users can always see their own membership changes, so for those use
+	// whichever of the old and new memberships is more visible.
+	if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(r.device.UserID) {
+		if m, merr := ev.Membership(); merr == nil {
+			switch {
+			case m == gomatrixserverlib.Join || membership == gomatrixserverlib.Join:
+				membership = gomatrixserverlib.Join
+			case m == gomatrixserverlib.Invite || membership == gomatrixserverlib.Invite:
+				membership = gomatrixserverlib.Invite
+			default:
+				membership = m
+			}
 		}
 	}
-	if !wasJoined {
-		util.GetLogger(r.ctx).WithField("num_events", len(events)).Warnf("%s was not joined to room during these events, omitting them", r.device.UserID)
-		return []*gomatrixserverlib.HeaderedEvent{}
+	return visibility, membership, nil
+}
+
+const (
+	historyVisibilityWorldReadable = "world_readable"
+	historyVisibilityShared        = "shared"
+	historyVisibilityInvited       = "invited"
+	historyVisibilityJoined        = "joined"
+)
+
+// historyVisibleToUser returns true if a user with the given membership at the
+// time of an event is allowed to see it. This implements
+// https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func historyVisibleToUser(visibility, membershipAtEvent string, currentlyJoined bool) bool {
+	// 1. If the history_visibility was set to world_readable, allow.
+	if visibility == historyVisibilityWorldReadable {
+		return true
 	}
-	return result
+	// 2. If the user's membership was join, allow.
+	if membershipAtEvent == gomatrixserverlib.Join {
+		return true
+	}
+	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+	if visibility == historyVisibilityShared && currentlyJoined {
+		return true
+	}
+	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
+	if visibility == historyVisibilityInvited && membershipAtEvent == gomatrixserverlib.Invite {
+		return true
+	}
+	// 5. Otherwise, deny.
+	return false
 }
 
 func (r *messagesReq) getStartEnd(events []*gomatrixserverlib.HeaderedEvent) (start, end types.TopologyToken, err error) {
@@ -527,6 +560,7 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 		BackwardsExtremities: backwardsExtremities,
 		Limit:                limit,
 		ServerName:           r.cfg.Matrix.ServerName,
+		IncludeSoftFailed:    r.cfg.MessagesIncludeSoftFailed,
 	}, &res)
 	if err != nil {
 		return nil, fmt.Errorf("PerformBackfill failed: %w", err)
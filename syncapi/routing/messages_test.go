@@ -0,0 +1,121 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestHistoryVisibleToUser(t *testing.T) {
+	for _, tc := range []struct {
+		visibility      string
+		membership      string
+		currentlyJoined bool
+		want            bool
+	}{
+		{"world_readable", "leave", false, true},
+		{"shared", "leave", true, true},
+		{"shared", "leave", false, false},
+		{"invited", "invite", false, true},
+		{"invited", "leave", true, false},
+		{"joined", "invite", true, false},
+		{"joined", "join", false, true},
+	} {
+		got := historyVisibleToUser(tc.visibility, tc.membership, tc.currentlyJoined)
+		if got != tc.want {
+			t.Errorf("historyVisibleToUser(%q, %q, %v): got %v, want %v", tc.visibility, tc.membership, tc.currentlyJoined, got, tc.want)
+		}
+	}
+}
+
+// testVisibilityRoomserverAPI returns the given state before each event,
+// keyed by the event's first prev event.
+type testVisibilityRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	isInRoom    bool
+	stateBefore map[string][]*gomatrixserverlib.HeaderedEvent
+}
+
+func (t *testVisibilityRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse,
+) error {
+	res.IsInRoom = t.isInRoom
+	return nil
+}
+
+func (t *testVisibilityRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse,
+) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.StateEvents = t.stateBefore[req.PrevEventIDs[0]]
+	return nil
+}
+
+func mustCreateTestEvent(t *testing.T, eventID, evType string, stateKey *string, content string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	sk := ""
+	if stateKey != nil {
+		sk = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":%s,"depth":1,"event_id":%q,"origin":"test","origin_server_ts":0,"prev_events":[["$prev_%s",{}]],"room_id":"!room:test",%s"sender":"@bob:test","type":%q}`,
+		content, eventID, eventID, sk, evType,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func TestFilterHistoryVisible(t *testing.T) {
+	alice := "@alice:test"
+	empty := ""
+	joined := mustCreateTestEvent(t, "$hisvis", gomatrixserverlib.MRoomHistoryVisibility, &empty, `{"history_visibility":"joined"}`)
+	aliceJoined := mustCreateTestEvent(t, "$alicejoin", gomatrixserverlib.MRoomMember, &alice, `{"membership":"join"}`)
+
+	before := mustCreateTestEvent(t, "$before", "m.room.message", nil, `{"body":"before"}`)
+	join := mustCreateTestEvent(t, "$join", gomatrixserverlib.MRoomMember, &alice, `{"membership":"join"}`)
+	after := mustCreateTestEvent(t, "$after", "m.room.message", nil, `{"body":"after"}`)
+
+	r := messagesReq{
+		ctx:    context.Background(),
+		roomID: "!room:test",
+		device: &userapi.Device{UserID: alice},
+		rsAPI: &testVisibilityRoomserverAPI{
+			isInRoom: true,
+			stateBefore: map[string][]*gomatrixserverlib.HeaderedEvent{
+				"$prev_$before": {joined},
+				"$prev_$join":   {joined},
+				"$prev_$after":  {joined, aliceJoined},
+			},
+		},
+	}
+	got := r.filterHistoryVisible([]*gomatrixserverlib.HeaderedEvent{before, join, after})
+	if len(got) != 2 || got[0].EventID() != "$join" || got[1].EventID() != "$after" {
+		var ids []string
+		for _, ev := range got {
+			ids = append(ids, ev.EventID())
+		}
+		t.Fatalf("expected [$join $after], got %v", ids)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetPresence implements GET /_matrix/client/r0/presence/{userId}/status
+func GetPresence(
+	req *http.Request, device *api.Device, syncDB storage.Database, cfg *config.SyncAPI, userID string,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if cfg.Matrix.DisablePresence {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: eduAPI.PresenceContent{Presence: eduAPI.PresenceOffline},
+		}
+	}
+
+	shared, err := sharesRoom(req.Context(), syncDB, device.UserID, userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sharesRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !shared {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to see the presence of this user"),
+		}
+	}
+
+	presence, err := syncDB.GetPresence(req.Context(), userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.GetPresence failed")
+		return jsonerror.InternalServerError()
+	}
+	if presence == nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: eduAPI.PresenceContent{Presence: eduAPI.PresenceOffline},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: eduAPI.NewPresenceContent(presence),
+	}
+}
+
+// sharesRoom returns whether the user is, or is joined to a room with, the
+// other user.
+func sharesRoom(ctx context.Context, syncDB storage.Database, userID, otherUserID string) (bool, error) {
+	if userID == otherUserID {
+		return true, nil
+	}
+	roomIDs, err := syncDB.RoomIDsWithMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return false, err
+	}
+	for _, roomID := range roomIDs {
+		joined, err := syncDB.JoinedUsersInRoom(ctx, roomID)
+		if err != nil {
+			return false, err
+		}
+		for _, joinedUserID := range joined {
+			if joinedUserID == otherUserID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
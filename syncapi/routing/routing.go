@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/slidingsync"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -38,13 +39,14 @@ func Setup(
 	userAPI userapi.UserInternalAPI, federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.SyncAPI,
+	mscCfg *config.MSCs,
 ) {
 	r0mux := csMux.PathPrefix("/r0").Subrouter()
 
 	// TODO: Add AS support for all handlers below.
 	r0mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
-	})).Methods(http.MethodGet, http.MethodOptions)
+	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/messages", httputil.MakeAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -52,7 +54,7 @@ func Setup(
 			return util.ErrorResponse(err)
 		}
 		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, federation, rsAPI, cfg, srp)
-	})).Methods(http.MethodGet, http.MethodOptions)
+	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/user/{userId}/filter",
 		httputil.MakeAuthAPI("put_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -61,7 +63,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return PutFilter(req, device, syncDB, vars["userId"])
-		}),
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/user/{userId}/filter/{filterId}",
@@ -71,10 +73,43 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return GetFilter(req, device, syncDB, vars["userId"], vars["filterId"])
-		}),
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	// PUT is handled by the client API, which hands the presence to the EDU server.
+	r0mux.Handle("/presence/{userId}/status",
+		httputil.MakeAuthAPI("get_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPresence(req, device, syncDB, cfg, vars["userId"])
+		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/keys/changes", httputil.MakeAuthAPI("keys_changes", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingKeyChangeRequest(req, device)
-	})).Methods(http.MethodGet, http.MethodOptions)
+	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
+
+	if mscCfg.Enabled("msc3575") {
+		ss := slidingsync.NewSlidingSync(syncDB, srp.Notifier)
+		csMux.Handle("/unstable/org.matrix.msc3575/sync", httputil.MakeAuthAPI("sliding_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return ss.OnIncomingRequest(req, device)
+		})).Methods(http.MethodPost, http.MethodOptions)
+	}
+
+	if cfg.UserDataExport.Enabled {
+		unstableMux := csMux.PathPrefix("/unstable/org.matrix.dendrite").Subrouter()
+		unstableMux.Handle("/admin/users/{userID}/export", httputil.WrapHandlerInBasicAuth(
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					writeJSONResponse(w, util.ErrorResponse(err))
+					return
+				}
+				ExportUserData(w, req, syncDB, userAPI, cfg, vars["userID"])
+			}),
+			cfg.UserDataExport.BasicAuth,
+		)).Methods(http.MethodGet)
+	}
 }
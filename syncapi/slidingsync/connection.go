@@ -0,0 +1,151 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slidingsync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// connectionTimeout is how long a connection can go unused before it is
+// forgotten, after which the client has to start again without a pos.
+const connectionTimeout = 30 * time.Minute
+
+// maxConnectionsPerDevice is how many connections are kept for each device.
+// Starting another one forgets the least recently used connection.
+const maxConnectionsPerDevice = 10
+
+type connectionKey struct {
+	userID   string
+	deviceID string
+	connID   string
+}
+
+type deviceKey struct {
+	userID   string
+	deviceID string
+}
+
+// window is the part of a list which was last sent to the client for one
+// of the requested ranges.
+type window struct {
+	rng     [2]int
+	roomIDs []string
+}
+
+// connection is what has already been sent to the client over a sliding
+// sync connection, so that the next response only has to contain what has
+// changed since. It must be locked while a request is being handled.
+type connection struct {
+	mu sync.Mutex
+
+	// The pos which the client must send to continue the connection.
+	pos int64
+	// The notifier position when the last response was built, so that
+	// long-polling requests can wait for anything newer.
+	token types.StreamingToken
+	// The number of rooms and the windows last sent for each list. A nil
+	// window hasn't been sent yet.
+	counts  []int
+	windows [][]*window
+	// The stream position of the latest event sent for each room which is
+	// in a window or subscribed to.
+	rooms map[string]types.StreamPosition
+
+	// Protected by the connections lock rather than mu.
+	lastUsed time.Time
+}
+
+// connections holds the state of every sliding sync connection in memory.
+// The state is lost on restart, in which case clients get M_UNKNOWN_POS
+// and start a new connection.
+type connections struct {
+	mu      sync.Mutex
+	devices map[deviceKey]map[string]*connection
+}
+
+// get returns the connection for the key. If create is true then a new
+// connection replaces any existing one, forgetting about the least recently
+// used connection of the device if it has too many. Returns nil if the
+// connection doesn't exist or hasn't been used for a while.
+func (c *connections) get(key connectionKey, create bool) *connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	dk := deviceKey{key.userID, key.deviceID}
+	conns := c.devices[dk]
+	if create {
+		if c.devices == nil {
+			c.devices = make(map[deviceKey]map[string]*connection)
+		}
+		if conns == nil {
+			conns = make(map[string]*connection)
+			c.devices[dk] = conns
+		}
+		delete(conns, key.connID)
+		if len(conns) >= maxConnectionsPerDevice {
+			var lruConnID string
+			var lru *connection
+			for connID, conn := range conns {
+				if lru == nil || conn.lastUsed.Before(lru.lastUsed) {
+					lruConnID, lru = connID, conn
+				}
+			}
+			delete(conns, lruConnID)
+		}
+		conns[key.connID] = &connection{
+			rooms: make(map[string]types.StreamPosition),
+		}
+	}
+	conn, ok := conns[key.connID]
+	if !ok {
+		return nil
+	}
+	if now.Sub(conn.lastUsed) > connectionTimeout && !create {
+		c.remove(dk, key.connID)
+		return nil
+	}
+	conn.lastUsed = now
+	return conn
+}
+
+// remove forgets about the connection. The lock must be held.
+func (c *connections) remove(dk deviceKey, connID string) {
+	delete(c.devices[dk], connID)
+	if len(c.devices[dk]) == 0 {
+		delete(c.devices, dk)
+	}
+}
+
+// cleanup periodically forgets about connections which haven't been used
+// for a while, so that the state of devices which have gone away doesn't
+// stay around forever.
+func (c *connections) cleanup() {
+	ticker := time.NewTicker(connectionTimeout).C
+	for range ticker {
+		now := time.Now()
+		c.mu.Lock()
+		for dk, conns := range c.devices {
+			for connID, conn := range conns {
+				if now.Sub(conn.lastUsed) > connectionTimeout {
+					c.remove(dk, connID)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slidingsync
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The supported sort orders. Any others are ignored.
+const (
+	sortByRecency = "by_recency"
+	sortByName    = "by_name"
+)
+
+// listedRoom is a room which the user is joined to or invited to, along
+// with what is needed to filter and sort it.
+type listedRoom struct {
+	roomID   string
+	name     string
+	position types.StreamPosition
+	invite   *gomatrixserverlib.HeaderedEvent
+}
+
+// filterRooms returns the rooms which match the filters.
+func filterRooms(rooms []listedRoom, filters *ListFilters) []listedRoom {
+	if filters == nil {
+		return append([]listedRoom(nil), rooms...)
+	}
+	nameLike := strings.ToLower(filters.RoomNameLike)
+	filtered := make([]listedRoom, 0, len(rooms))
+	for _, room := range rooms {
+		if filters.IsInvite != nil && *filters.IsInvite != (room.invite != nil) {
+			continue
+		}
+		if nameLike != "" && !strings.Contains(strings.ToLower(room.name), nameLike) {
+			continue
+		}
+		filtered = append(filtered, room)
+	}
+	return filtered
+}
+
+// sortRooms sorts the rooms by each of the sort orders in turn, and then by
+// room ID so that the order is stable. The most recently active rooms come
+// first if no sort order is given.
+func sortRooms(rooms []listedRoom, by []string) {
+	if len(by) == 0 {
+		by = []string{sortByRecency}
+	}
+	sort.SliceStable(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		for _, s := range by {
+			switch s {
+			case sortByRecency:
+				if a.position != b.position {
+					return a.position > b.position
+				}
+			case sortByName:
+				// Rooms without names go at the end.
+				if (a.name == "") != (b.name == "") {
+					return a.name != ""
+				}
+				if an, bn := strings.ToLower(a.name), strings.ToLower(b.name); an != bn {
+					return an < bn
+				}
+			}
+		}
+		return a.roomID < b.roomID
+	})
+}
+
+// roomsInRange returns the IDs of the rooms in the inclusive range. The end
+// of the range may be past the end of the list.
+func roomsInRange(rooms []listedRoom, rng [2]int) []string {
+	roomIDs := []string{}
+	for i := rng[0]; i <= rng[1] && i < len(rooms); i++ {
+		roomIDs = append(roomIDs, rooms[i].roomID)
+	}
+	return roomIDs
+}
+
+// sameWindow returns true if the window has already been sent for the range
+// with the same rooms in the same order.
+func sameWindow(w *window, rng [2]int, roomIDs []string) bool {
+	if w == nil || w.rng != rng || len(w.roomIDs) != len(roomIDs) {
+		return false
+	}
+	for i := range roomIDs {
+		if w.roomIDs[i] != roomIDs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSubscriptions combines the parameters for a room which is in more
+// than one list, or which is also subscribed to, so that the client gets
+// everything that any of them asked for.
+func mergeSubscriptions(a, b RoomSubscription) RoomSubscription {
+	if b.TimelineLimit > a.TimelineLimit {
+		a.TimelineLimit = b.TimelineLimit
+	}
+	a.RequiredState = append(append([][2]string(nil), a.RequiredState...), b.RequiredState...)
+	return a
+}
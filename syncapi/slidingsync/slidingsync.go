@@ -0,0 +1,453 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package slidingsync implements MSC3575 sliding sync, which lets clients
+// ask for windows of a sorted and filtered room list instead of syncing
+// every room - https://github.com/matrix-org/matrix-doc/pull/3575
+package slidingsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// Request is the body of a sliding sync request. Lists and subscriptions
+// aren't sticky, so every request must contain all of them.
+type Request struct {
+	ConnID            string                      `json:"conn_id"`
+	Lists             []RequestList               `json:"lists"`
+	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
+}
+
+// RoomSubscription is what to send for a room. The state keys in the
+// required state can be "*" for all of them, or "$ME" for the user's own.
+type RoomSubscription struct {
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+// RequestList is a list of rooms, of which the rooms in the inclusive
+// ranges are sent to the client.
+type RequestList struct {
+	RoomSubscription
+	Ranges  [][2]int     `json:"ranges"`
+	Sort    []string     `json:"sort"`
+	Filters *ListFilters `json:"filters"`
+}
+
+// ListFilters are the supported filters for a list.
+type ListFilters struct {
+	IsInvite     *bool  `json:"is_invite"`
+	RoomNameLike string `json:"room_name_like"`
+}
+
+// Response is the response to a sliding sync request.
+type Response struct {
+	Pos   string           `json:"pos"`
+	Lists []ResponseList   `json:"lists"`
+	Rooms map[string]*Room `json:"rooms"`
+}
+
+// ResponseList has the number of rooms in a list, and the operations which
+// update the client's copy of the windows of it. Only SYNC operations are
+// sent, replacing a whole range, and only for the ranges which changed.
+type ResponseList struct {
+	Count int         `json:"count"`
+	Ops   []Operation `json:"ops,omitempty"`
+}
+
+// Operation is an operation on the client's copy of a list.
+type Operation struct {
+	Op      string   `json:"op"`
+	Range   [2]int   `json:"range"`
+	RoomIDs []string `json:"room_ids"`
+}
+
+// Room is what has changed in a room since it was last sent. Initial is set
+// the first time that it is sent over the connection, in which case the
+// required state is sent too.
+type Room struct {
+	Name          string                          `json:"name,omitempty"`
+	Initial       bool                            `json:"initial,omitempty"`
+	RequiredState []gomatrixserverlib.ClientEvent `json:"required_state,omitempty"`
+	Timeline      []gomatrixserverlib.ClientEvent `json:"timeline,omitempty"`
+	Limited       bool                            `json:"limited,omitempty"`
+	InviteState   []json.RawMessage               `json:"invite_state,omitempty"`
+}
+
+// SlidingSync serves sliding sync requests.
+type SlidingSync struct {
+	db       storage.Database
+	notifier *notifier.Notifier
+	conns    connections
+}
+
+// NewSlidingSync returns a SlidingSync which waits on the notifier for
+// updates when long-polling.
+func NewSlidingSync(db storage.Database, notifier *notifier.Notifier) *SlidingSync {
+	s := &SlidingSync{
+		db:       db,
+		notifier: notifier,
+	}
+	go s.conns.cleanup()
+	return s
+}
+
+// OnIncomingRequest handles a sliding sync request. If the pos is given and
+// nothing has changed then it waits for up to the timeout for something to.
+func (s *SlidingSync) OnIncomingRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var body Request
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if err := body.validate(); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	pos := req.URL.Query().Get("pos")
+	timeout := getTimeout(req.URL.Query().Get("timeout"))
+
+	conn := s.conns.get(connectionKey{device.UserID, device.ID, body.ConnID}, pos == "")
+	if conn == nil {
+		return unknownPosResponse()
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if pos != "" && pos != strconv.FormatInt(conn.pos, 10) {
+		return unknownPosResponse()
+	}
+
+	ctx := req.Context()
+	res, changed, err := s.buildResponse(ctx, device, conn, &body)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to build sliding sync response")
+		return jsonerror.InternalServerError()
+	}
+	if pos != "" && !changed && timeout > 0 {
+		listener := s.notifier.GetListener(types.SyncRequest{Context: ctx, Device: device})
+		defer listener.Close()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		case <-listener.GetNotifyChannel(conn.token):
+			res, _, err = s.buildResponse(ctx, device, conn, &body)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to build sliding sync response")
+				return jsonerror.InternalServerError()
+			}
+		}
+	}
+
+	conn.pos++
+	res.Pos = strconv.FormatInt(conn.pos, 10)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+func (r *Request) validate() error {
+	for i, list := range r.Lists {
+		for _, rng := range list.Ranges {
+			if rng[0] < 0 || rng[1] < rng[0] {
+				return fmt.Errorf("list %d has an invalid range %v", i, rng)
+			}
+		}
+		if list.TimelineLimit < 0 {
+			return fmt.Errorf("list %d has a negative timeline_limit", i)
+		}
+	}
+	for roomID, sub := range r.RoomSubscriptions {
+		if sub.TimelineLimit < 0 {
+			return fmt.Errorf("the subscription to %s has a negative timeline_limit", roomID)
+		}
+	}
+	return nil
+}
+
+func unknownPosResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.MatrixError{
+			ErrCode: "M_UNKNOWN_POS",
+			Err:     "Unknown pos, start a new connection",
+		},
+	}
+}
+
+func getTimeout(timeoutMS string) time.Duration {
+	i, err := strconv.Atoi(timeoutMS)
+	if err != nil || i < 0 {
+		return 0
+	}
+	return time.Duration(i) * time.Millisecond
+}
+
+// buildResponse works out what has changed since the last response on the
+// connection, and updates the connection to say that it has been sent.
+// Returns true if anything changed.
+func (s *SlidingSync) buildResponse(
+	ctx context.Context, device *userapi.Device, conn *connection, body *Request,
+) (*Response, bool, error) {
+	conn.token = s.notifier.CurrentPosition()
+	rooms, err := s.listRooms(ctx, device.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res := &Response{
+		Lists: make([]ResponseList, len(body.Lists)),
+		Rooms: make(map[string]*Room),
+	}
+	changed := false
+	if len(conn.windows) != len(body.Lists) {
+		conn.counts = make([]int, len(body.Lists))
+		conn.windows = make([][]*window, len(body.Lists))
+		changed = true
+	}
+
+	// Work out which rooms are in the windows of each list, and send the
+	// windows which are different from last time.
+	wanted := make(map[string]RoomSubscription)
+	for i, list := range body.Lists {
+		listed := filterRooms(rooms, list.Filters)
+		sortRooms(listed, list.Sort)
+		res.Lists[i].Count = len(listed)
+		if conn.counts[i] != len(listed) {
+			conn.counts[i] = len(listed)
+			changed = true
+		}
+		if len(conn.windows[i]) != len(list.Ranges) {
+			conn.windows[i] = make([]*window, len(list.Ranges))
+		}
+		for j, rng := range list.Ranges {
+			roomIDs := roomsInRange(listed, rng)
+			for _, roomID := range roomIDs {
+				wanted[roomID] = mergeSubscriptions(wanted[roomID], list.RoomSubscription)
+			}
+			if sameWindow(conn.windows[i][j], rng, roomIDs) {
+				continue
+			}
+			conn.windows[i][j] = &window{rng: rng, roomIDs: roomIDs}
+			res.Lists[i].Ops = append(res.Lists[i].Ops, Operation{
+				Op:      "SYNC",
+				Range:   rng,
+				RoomIDs: roomIDs,
+			})
+			changed = true
+		}
+	}
+
+	byID := make(map[string]listedRoom, len(rooms))
+	for _, room := range rooms {
+		byID[room.roomID] = room
+	}
+	for roomID, sub := range body.RoomSubscriptions {
+		// The user can only subscribe to rooms that they are in.
+		if _, ok := byID[roomID]; ok {
+			wanted[roomID] = mergeSubscriptions(wanted[roomID], sub)
+		}
+	}
+
+	// Send the rooms which are new to the client or have new events.
+	for roomID, sub := range wanted {
+		room := byID[roomID]
+		sent, ok := conn.rooms[roomID]
+		if ok && room.position <= sent {
+			continue
+		}
+		res.Rooms[roomID], err = s.buildRoom(ctx, device, room, sub, sent, !ok)
+		if err != nil {
+			return nil, false, err
+		}
+		conn.rooms[roomID] = room.position
+		changed = true
+	}
+	// Forget about the rooms which the client no longer needs, so that they
+	// are sent in full if they come back.
+	for roomID := range conn.rooms {
+		if _, ok := wanted[roomID]; !ok {
+			delete(conn.rooms, roomID)
+		}
+	}
+
+	return res, changed, nil
+}
+
+// listRooms returns all of the rooms that the user is joined or invited to.
+func (s *SlidingSync) listRooms(ctx context.Context, userID string) ([]listedRoom, error) {
+	joined, err := s.db.RoomIDsWithMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.RoomIDsWithMembership: %w", err)
+	}
+	positions, err := s.db.MaxStreamPositionsForRooms(ctx, joined)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.MaxStreamPositionsForRooms: %w", err)
+	}
+	rooms := make([]listedRoom, 0, len(joined))
+	isJoined := make(map[string]bool, len(joined))
+	for _, roomID := range joined {
+		isJoined[roomID] = true
+		name, err := s.roomName(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, listedRoom{
+			roomID:   roomID,
+			name:     name,
+			position: positions[roomID],
+		})
+	}
+
+	maxInvitePos, err := s.db.MaxStreamPositionForInvites(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.MaxStreamPositionForInvites: %w", err)
+	}
+	invites, _, err := s.db.InviteEventsInRange(ctx, userID, types.Range{From: 0, To: maxInvitePos})
+	if err != nil {
+		return nil, fmt.Errorf("s.db.InviteEventsInRange: %w", err)
+	}
+	for roomID, invite := range invites {
+		if isJoined[roomID] {
+			continue
+		}
+		rooms = append(rooms, listedRoom{
+			roomID: roomID,
+			name:   inviteRoomName(invite),
+			invite: invite,
+		})
+	}
+	return rooms, nil
+}
+
+func (s *SlidingSync) roomName(ctx context.Context, roomID string) (string, error) {
+	ev, err := s.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomName, "")
+	if err != nil {
+		return "", fmt.Errorf("s.db.GetStateEvent: %w", err)
+	}
+	if ev == nil {
+		return "", nil
+	}
+	return gjson.GetBytes(ev.Content(), "name").String(), nil
+}
+
+// inviteRoomName returns the name of the room from the stripped state sent
+// with the invite, if there is one.
+func inviteRoomName(invite *gomatrixserverlib.HeaderedEvent) string {
+	for _, ev := range gjson.GetBytes(invite.Unsigned(), "invite_room_state").Array() {
+		if ev.Get("type").String() == gomatrixserverlib.MRoomName {
+			return ev.Get("content.name").String()
+		}
+	}
+	return ""
+}
+
+// buildRoom returns what has happened in the room since the given position.
+// Invited users only get the stripped state from the invite.
+func (s *SlidingSync) buildRoom(
+	ctx context.Context, device *userapi.Device, room listedRoom, sub RoomSubscription,
+	since types.StreamPosition, initial bool,
+) (*Room, error) {
+	res := &Room{
+		Name:    room.name,
+		Initial: initial,
+	}
+	if room.invite != nil {
+		res.InviteState = types.NewInviteResponse(room.invite).InviteState.Events
+		return res, nil
+	}
+	if initial {
+		since = 0
+		stateEvents, err := s.requiredState(ctx, room.roomID, device.UserID, sub.RequiredState)
+		if err != nil {
+			return nil, err
+		}
+		res.RequiredState = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+	}
+	if sub.TimelineLimit > 0 {
+		filter := gomatrixserverlib.DefaultRoomEventFilter()
+		filter.Limit = sub.TimelineLimit
+		streamEvents, limited, err := s.db.RecentEvents(
+			ctx, room.roomID, types.Range{From: since, To: room.position}, &filter, true, true,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("s.db.RecentEvents: %w", err)
+		}
+		events := s.db.StreamEventsToEvents(device, streamEvents)
+		res.Timeline = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatSync)
+		res.Limited = limited
+	}
+	return res, nil
+}
+
+// requiredState returns the current state events matching the required
+// state, without duplicates.
+func (s *SlidingSync) requiredState(
+	ctx context.Context, roomID, userID string, required [][2]string,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	seen := make(map[string]bool)
+	add := func(ev *gomatrixserverlib.HeaderedEvent) {
+		if ev != nil && !seen[ev.EventID()] {
+			seen[ev.EventID()] = true
+			events = append(events, ev)
+		}
+	}
+	for _, rs := range required {
+		evType, stateKey := rs[0], rs[1]
+		if stateKey == "$ME" {
+			stateKey = userID
+		}
+		if evType != "*" && stateKey != "*" {
+			ev, err := s.db.GetStateEvent(ctx, roomID, evType, stateKey)
+			if err != nil {
+				return nil, fmt.Errorf("s.db.GetStateEvent: %w", err)
+			}
+			add(ev)
+			continue
+		}
+		filter := gomatrixserverlib.DefaultStateFilter()
+		if evType != "*" {
+			filter.Types = []string{evType}
+		}
+		stateEvents, err := s.db.GetStateEventsForRoom(ctx, roomID, &filter)
+		if err != nil {
+			return nil, fmt.Errorf("s.db.GetStateEventsForRoom: %w", err)
+		}
+		for _, ev := range stateEvents {
+			if stateKey == "*" || ev.StateKeyEquals(stateKey) {
+				add(ev)
+			}
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,284 @@
+package slidingsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testUserID = "@geralt:kaer.morhen"
+
+// slidingSyncDatabase has rooms with the given names and stream positions,
+// none of which have any events in their timelines.
+type slidingSyncDatabase struct {
+	storage.Database
+	names     map[string]string
+	positions map[string]types.StreamPosition
+	invites   map[string]*gomatrixserverlib.HeaderedEvent
+}
+
+func (d *slidingSyncDatabase) RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error) {
+	var roomIDs []string
+	for roomID := range d.positions {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, nil
+}
+
+func (d *slidingSyncDatabase) MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error) {
+	return d.positions, nil
+}
+
+func (d *slidingSyncDatabase) MaxStreamPositionForInvites(ctx context.Context) (types.StreamPosition, error) {
+	return 0, nil
+}
+
+func (d *slidingSyncDatabase) InviteEventsInRange(
+	ctx context.Context, targetUserID string, r types.Range,
+) (map[string]*gomatrixserverlib.HeaderedEvent, map[string]*gomatrixserverlib.HeaderedEvent, error) {
+	return d.invites, nil, nil
+}
+
+func (d *slidingSyncDatabase) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	name, ok := d.names[roomID]
+	if !ok || evType != gomatrixserverlib.MRoomName {
+		return nil, nil
+	}
+	return mustCreateEvent(roomID, gomatrixserverlib.MRoomName, fmt.Sprintf(`{"name":%q}`, name), ""), nil
+}
+
+func (d *slidingSyncDatabase) RecentEvents(
+	ctx context.Context, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool,
+) ([]types.StreamEvent, bool, error) {
+	return nil, false, nil
+}
+
+func (d *slidingSyncDatabase) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent {
+	return nil
+}
+
+func mustCreateEvent(roomID, evType, content, unsigned string) *gomatrixserverlib.HeaderedEvent {
+	eventJSON := fmt.Sprintf(
+		`{"event_id":"$%s:kaer.morhen","room_id":%q,"type":%q,"state_key":"","sender":%q,"content":%s,"unsigned":%s}`,
+		evType, roomID, evType, testUserID, content, unsigned,
+	)
+	if unsigned == "" {
+		eventJSON = fmt.Sprintf(
+			`{"event_id":"$%s:kaer.morhen","room_id":%q,"type":%q,"state_key":"","sender":%q,"content":%s}`,
+			evType, roomID, evType, testUserID, content,
+		)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		panic(err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func slidingSyncRequest(t *testing.T, ss *SlidingSync, pos string, body Request) (int, Response, *jsonerror.MatrixError) {
+	t.Helper()
+	content, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/unstable/org.matrix.msc3575/sync?pos="+pos, bytes.NewReader(content))
+	res := ss.OnIncomingRequest(req, &userapi.Device{UserID: testUserID, ID: "DEVICE"})
+	if matrixErr, ok := res.JSON.(jsonerror.MatrixError); ok {
+		return res.Code, Response{}, &matrixErr
+	}
+	resp, ok := res.JSON.(*Response)
+	if !ok {
+		t.Fatalf("unexpected response %+v", res.JSON)
+	}
+	return res.Code, *resp, nil
+}
+
+func TestSortAndFilterRooms(t *testing.T) {
+	invite := mustCreateEvent("!invite:kaer.morhen", gomatrixserverlib.MRoomMember, `{"membership":"invite"}`, "")
+	rooms := []listedRoom{
+		{roomID: "!a:kaer.morhen", name: "Novigrad", position: 1},
+		{roomID: "!b:kaer.morhen", name: "", position: 3},
+		{roomID: "!c:kaer.morhen", name: "kaer Morhen", position: 2},
+		{roomID: "!d:kaer.morhen", name: "Oxenfurt", position: 2},
+		{roomID: "!invite:kaer.morhen", name: "Vizima", invite: invite},
+	}
+	roomIDs := func(rooms []listedRoom) (ids []string) {
+		for _, room := range rooms {
+			ids = append(ids, room.roomID)
+		}
+		return
+	}
+
+	tests := []struct {
+		name    string
+		sort    []string
+		filters *ListFilters
+		want    string
+	}{
+		{
+			name: "recency by default",
+			want: "[!b:kaer.morhen !c:kaer.morhen !d:kaer.morhen !a:kaer.morhen !invite:kaer.morhen]",
+		},
+		{
+			name: "name",
+			sort: []string{sortByName},
+			want: "[!c:kaer.morhen !a:kaer.morhen !d:kaer.morhen !invite:kaer.morhen !b:kaer.morhen]",
+		},
+		{
+			name: "recency then name",
+			sort: []string{sortByRecency, sortByName},
+			want: "[!b:kaer.morhen !c:kaer.morhen !d:kaer.morhen !a:kaer.morhen !invite:kaer.morhen]",
+		},
+		{
+			name:    "invites",
+			filters: &ListFilters{IsInvite: new(bool)},
+			want:    "[!b:kaer.morhen !c:kaer.morhen !d:kaer.morhen !a:kaer.morhen]",
+		},
+		{
+			name:    "name like",
+			sort:    []string{sortByName},
+			filters: &ListFilters{RoomNameLike: "MOR"},
+			want:    "[!c:kaer.morhen]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed := filterRooms(rooms, tt.filters)
+			sortRooms(listed, tt.sort)
+			if got := fmt.Sprint(roomIDs(listed)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if got := fmt.Sprint(roomsInRange(rooms, [2]int{3, 10})); got != "[!d:kaer.morhen !invite:kaer.morhen]" {
+		t.Errorf("roomsInRange got %s", got)
+	}
+}
+
+func TestSlidingSync(t *testing.T) {
+	db := &slidingSyncDatabase{
+		names: map[string]string{
+			"!a:kaer.morhen": "Novigrad",
+			"!b:kaer.morhen": "Oxenfurt",
+		},
+		positions: map[string]types.StreamPosition{
+			"!a:kaer.morhen": 3,
+			"!b:kaer.morhen": 2,
+			"!c:kaer.morhen": 1,
+		},
+		invites: map[string]*gomatrixserverlib.HeaderedEvent{
+			"!invite:kaer.morhen": mustCreateEvent(
+				"!invite:kaer.morhen", gomatrixserverlib.MRoomMember, `{"membership":"invite"}`,
+				`{"invite_room_state":[{"type":"m.room.name","state_key":"","content":{"name":"Vizima"}}]}`,
+			),
+		},
+	}
+	ss := NewSlidingSync(db, notifier.NewNotifier(types.StreamingToken{}))
+	body := Request{
+		Lists: []RequestList{{
+			Ranges:  [][2]int{{0, 1}},
+			Filters: &ListFilters{IsInvite: new(bool)},
+			RoomSubscription: RoomSubscription{
+				RequiredState: [][2]string{{gomatrixserverlib.MRoomName, ""}},
+			},
+		}},
+	}
+
+	code, res, _ := slidingSyncRequest(t, ss, "", body)
+	if code != http.StatusOK {
+		t.Fatalf("got code %d, want %d", code, http.StatusOK)
+	}
+	if res.Lists[0].Count != 3 {
+		t.Errorf("got count %d, want 3", res.Lists[0].Count)
+	}
+	if got := fmt.Sprint(res.Lists[0].Ops); got != "[{SYNC [0 1] [!a:kaer.morhen !b:kaer.morhen]}]" {
+		t.Errorf("got ops %s", got)
+	}
+	if len(res.Rooms) != 2 || !res.Rooms["!a:kaer.morhen"].Initial || res.Rooms["!a:kaer.morhen"].Name != "Novigrad" {
+		t.Fatalf("unexpected rooms %+v", res.Rooms)
+	}
+	if len(res.Rooms["!a:kaer.morhen"].RequiredState) != 1 {
+		t.Errorf("got %d required state events, want 1", len(res.Rooms["!a:kaer.morhen"].RequiredState))
+	}
+
+	// Nothing has changed, so nothing should be sent.
+	code, res, _ = slidingSyncRequest(t, ss, res.Pos, body)
+	if code != http.StatusOK {
+		t.Fatalf("got code %d, want %d", code, http.StatusOK)
+	}
+	if len(res.Lists[0].Ops) != 0 || len(res.Rooms) != 0 {
+		t.Errorf("expected no changes, got %+v", res)
+	}
+
+	// New activity in !c moves it into the window and !b out of it.
+	db.positions["!c:kaer.morhen"] = 4
+	code, res, _ = slidingSyncRequest(t, ss, res.Pos, body)
+	if code != http.StatusOK {
+		t.Fatalf("got code %d, want %d", code, http.StatusOK)
+	}
+	if got := fmt.Sprint(res.Lists[0].Ops); got != "[{SYNC [0 1] [!c:kaer.morhen !a:kaer.morhen]}]" {
+		t.Errorf("got ops %s", got)
+	}
+	if len(res.Rooms) != 1 || res.Rooms["!c:kaer.morhen"] == nil || !res.Rooms["!c:kaer.morhen"].Initial {
+		t.Errorf("unexpected rooms %+v", res.Rooms)
+	}
+
+	// Invites get the stripped state from the invite.
+	isInvite := true
+	inviteBody := Request{
+		ConnID: "invites",
+		Lists: []RequestList{{
+			Ranges:  [][2]int{{0, 0}},
+			Filters: &ListFilters{IsInvite: &isInvite},
+		}},
+	}
+	_, res, _ = slidingSyncRequest(t, ss, "", inviteBody)
+	invite := res.Rooms["!invite:kaer.morhen"]
+	if invite == nil || invite.Name != "Vizima" || len(invite.InviteState) != 2 {
+		t.Errorf("unexpected invite %+v", invite)
+	}
+
+	// Reusing an old pos isn't allowed.
+	code, _, matrixErr := slidingSyncRequest(t, ss, "1", body)
+	if code != http.StatusBadRequest || matrixErr == nil || matrixErr.ErrCode != "M_UNKNOWN_POS" {
+		t.Errorf("got code %d and error %+v, want M_UNKNOWN_POS", code, matrixErr)
+	}
+}
+
+func TestConnectionsPerDevice(t *testing.T) {
+	var conns connections
+	key := func(deviceID string, i int) connectionKey {
+		return connectionKey{testUserID, deviceID, fmt.Sprintf("conn%d", i)}
+	}
+	for i := 0; i < maxConnectionsPerDevice; i++ {
+		conns.get(key("DEVICE", i), true)
+	}
+	// using the first connection makes the second the least recently used
+	if conns.get(key("DEVICE", 0), false) == nil {
+		t.Fatalf("expected the first connection to exist")
+	}
+	conns.get(key("OTHER", 0), true)
+	conns.get(key("DEVICE", maxConnectionsPerDevice), true)
+	if conns.get(key("DEVICE", 1), false) != nil {
+		t.Fatalf("expected the least recently used connection to be forgotten")
+	}
+	for _, i := range []int{0, 2, maxConnectionsPerDevice} {
+		if conns.get(key("DEVICE", i), false) == nil {
+			t.Fatalf("expected connection %d to exist", i)
+		}
+	}
+	if conns.get(key("OTHER", 0), false) == nil {
+		t.Fatalf("expected the connection of the other device to exist")
+	}
+}
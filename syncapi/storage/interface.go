@@ -34,6 +34,7 @@ type Database interface {
 	MaxStreamPositionForInvites(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForAccountData(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForSendToDeviceMessages(ctx context.Context) (types.StreamPosition, error)
+	MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error)
 
 	CurrentState(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter, excludeEventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
 	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter) ([]types.StateDelta, []string, error)
@@ -48,9 +49,13 @@ type Database interface {
 	InviteEventsInRange(ctx context.Context, targetUserID string, r types.Range) (map[string]*gomatrixserverlib.HeaderedEvent, map[string]*gomatrixserverlib.HeaderedEvent, error)
 	PeeksInRange(ctx context.Context, userID, deviceID string, r types.Range) (peeks []types.Peek, err error)
 	RoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error)
+	// PresenceAfter returns the presence of the given users which changed after the stream position.
+	PresenceAfter(ctx context.Context, userIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputPresenceEvent, error)
 
 	// AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
+	// JoinedUsersInRoom returns the user IDs of all joined users in the room.
+	JoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error)
 	// AllPeekingDevicesInRooms returns a map of room ID to a list of all peeking devices.
 	AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error)
 	// Events lookups a list of event by their event ID.
@@ -59,6 +64,11 @@ type Database interface {
 	// Returns an error if there was a problem talking with the database.
 	// Does not include any transaction IDs in the returned events.
 	Events(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
+	// EventsSentByUser returns up to `limit` events sent by the given user with a stream position
+	// after `afterPos`, oldest first, along with the position of the last event returned. Callers
+	// page through all of a user's events by passing the returned position back in until no
+	// events are returned.
+	EventsSentByUser(ctx context.Context, userID string, afterPos types.StreamPosition, limit int) ([]*gomatrixserverlib.HeaderedEvent, types.StreamPosition, error)
 	// WriteEvent into the database. It is not safe to call this function from multiple goroutines, as it would create races
 	// when generating the sync stream position for this event. Returns the sync stream position for the inserted event.
 	// Returns an error if there was a problem inserting this event.
@@ -67,6 +77,9 @@ type Database interface {
 	// PurgeRoomState completely purges room state from the sync API. This is done when
 	// receiving an output event that completely resets the state.
 	PurgeRoomState(ctx context.Context, roomID string) error
+	// PurgeEvents removes the given events from the sync API. This is done when the
+	// roomserver has purged them because they have outlived the room's retention policy.
+	PurgeEvents(ctx context.Context, eventIDs []string) error
 	// GetStateEvent returns the Matrix state event of a given type for a given room with a given state key
 	// If no event could be found, returns nil
 	// If there was an issue during the retrieval, returns an error
@@ -114,6 +127,9 @@ type Database interface {
 	BackwardExtremitiesForRoom(ctx context.Context, roomID string) (backwardExtremities map[string][]string, err error)
 	// MaxTopologicalPosition returns the highest topological position for a given room.
 	MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error)
+	// MaxStreamPositionsForRooms returns the stream position of the latest event in each of the given rooms,
+	// omitting rooms without any events.
+	MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error)
 	// StreamEventsToEvents converts streamEvent to Event. If device is non-nil and
 	// matches the streamevent.transactionID device then the transaction ID gets
 	// added to the unsigned section of the output event.
@@ -140,4 +156,17 @@ type Database interface {
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
 	GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error)
+	// StorePresence stores the presence of a user. A nil status message keeps the stored one.
+	StorePresence(ctx context.Context, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	// GetPresence returns the presence of a user, or nil if it isn't known.
+	GetPresence(ctx context.Context, userID string) (*eduAPI.OutputPresenceEvent, error)
+	// InsertNotification stores a notification of the event at the given stream position for the user.
+	InsertNotification(ctx context.Context, userID, roomID, eventID string, pos types.StreamPosition, highlight bool) error
+	// DeleteNotificationsUpTo deletes the notifications of the user in the room up to and including the given stream position,
+	// i.e. when the user has read the room up to that point. Returns true if any notifications were deleted.
+	DeleteNotificationsUpTo(ctx context.Context, userID, roomID string, pos types.StreamPosition) (affected bool, err error)
+	// UnreadNotificationCount returns the number of unread notifications of the user across all rooms.
+	UnreadNotificationCount(ctx context.Context, userID string) (int, error)
+	// RoomUnreadNotificationCounts returns the unread notification and highlight counts of the user, by room.
+	RoomUnreadNotificationCounts(ctx context.Context, userID string) (map[string]types.UnreadNotifications, error)
 }
@@ -0,0 +1,136 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The notifications table tracks the events which a local user has been
+// notified about and hasn't read yet. Notifications are deleted when the
+// user sends a read receipt for the event or a later event in the room.
+
+const notificationsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_notifications (
+	id BIGSERIAL PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- The stream position of the event
+	stream_pos BIGINT NOT NULL,
+	-- Whether the event should be highlighted for the user
+	highlight BOOLEAN NOT NULL,
+	-- When the notification was created, as a unix timestamp (ms resolution).
+	ts_ms BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_notifications_user_id_room_id_idx ON syncapi_notifications(user_id, room_id, stream_pos);
+`
+
+const insertNotificationSQL = "" +
+	"INSERT INTO syncapi_notifications (user_id, room_id, event_id, stream_pos, highlight, ts_ms)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const deleteNotificationsUpToSQL = "" +
+	"DELETE FROM syncapi_notifications WHERE user_id = $1 AND room_id = $2 AND stream_pos <= $3"
+
+const selectUnreadNotificationCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_notifications WHERE user_id = $1"
+
+const selectRoomUnreadNotificationCountsSQL = "" +
+	"SELECT room_id, COUNT(*), COALESCE(SUM(CASE WHEN highlight THEN 1 ELSE 0 END), 0)" +
+	" FROM syncapi_notifications WHERE user_id = $1 GROUP BY room_id"
+
+type notificationsStatements struct {
+	insertNotificationStmt            *sql.Stmt
+	deleteNotificationsUpToStmt       *sql.Stmt
+	selectUnreadNotificationCountStmt *sql.Stmt
+	selectRoomUnreadCountsStmt        *sql.Stmt
+}
+
+func NewPostgresNotificationsTable(db *sql.DB) (tables.Notifications, error) {
+	s := &notificationsStatements{}
+	_, err := db.Exec(notificationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertNotificationStmt, err = db.Prepare(insertNotificationSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteNotificationsUpToStmt, err = db.Prepare(deleteNotificationsUpToSQL); err != nil {
+		return nil, err
+	}
+	if s.selectUnreadNotificationCountStmt, err = db.Prepare(selectUnreadNotificationCountSQL); err != nil {
+		return nil, err
+	}
+	if s.selectRoomUnreadCountsStmt, err = db.Prepare(selectRoomUnreadNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *notificationsStatements) InsertNotification(
+	ctx context.Context, txn *sql.Tx, userID, roomID, eventID string,
+	pos types.StreamPosition, highlight bool, ts gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertNotificationStmt).ExecContext(
+		ctx, userID, roomID, eventID, pos, highlight, ts,
+	)
+	return err
+}
+
+func (s *notificationsStatements) DeleteNotificationsUpTo(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition,
+) (affected bool, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteNotificationsUpToStmt).ExecContext(ctx, userID, roomID, pos)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *notificationsStatements) SelectUnreadNotificationCount(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (count int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectUnreadNotificationCountStmt).QueryRowContext(ctx, userID).Scan(&count)
+	return
+}
+
+func (s *notificationsStatements) SelectRoomUnreadNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[string]types.UnreadNotifications, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomUnreadCountsStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomUnreadNotificationCounts: rows.close() failed")
+	counts := make(map[string]types.UnreadNotifications)
+	for rows.Next() {
+		var roomID string
+		var count types.UnreadNotifications
+		if err = rows.Scan(&roomID, &count.NotificationCount, &count.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts[roomID] = count
+	}
+	return counts, rows.Err()
+}
@@ -69,6 +69,8 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   -- were emitted.
   exclude_from_sync BOOL DEFAULT FALSE
 );
+-- for exporting all events sent by a given user
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_sender_idx ON syncapi_output_room_events(sender, id);
 `
 
 const insertEventSQL = "" +
@@ -108,9 +110,17 @@ const selectEarlyEventsSQL = "" +
 	" AND ( $7::text[] IS NULL OR NOT(type LIKE ANY($7)) )" +
 	" ORDER BY id ASC LIMIT $8"
 
+const selectEventsBySenderSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
+	" WHERE sender = $1 AND id > $2" +
+	" ORDER BY id ASC LIMIT $3"
+
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+const selectMaxStreamPositionsForRoomsSQL = "" +
+	"SELECT room_id, MAX(id) FROM syncapi_output_room_events WHERE room_id = ANY($1) GROUP BY room_id"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -130,16 +140,22 @@ const selectStateInRangeSQL = "" +
 const deleteEventsForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = ANY($1)"
+
 type outputRoomEventsStatements struct {
 	insertEventStmt               *sql.Stmt
 	selectEventsStmt              *sql.Stmt
 	selectMaxEventIDStmt          *sql.Stmt
+	selectMaxStreamPositionsStmt  *sql.Stmt
 	selectRecentEventsStmt        *sql.Stmt
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
 	selectStateInRangeStmt        *sql.Stmt
+	selectEventsBySenderStmt      *sql.Stmt
 	updateEventJSONStmt           *sql.Stmt
 	deleteEventsForRoomStmt       *sql.Stmt
+	deleteEventsStmt              *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -157,6 +173,9 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 	if s.selectMaxEventIDStmt, err = db.Prepare(selectMaxEventIDSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMaxStreamPositionsStmt, err = db.Prepare(selectMaxStreamPositionsForRoomsSQL); err != nil {
+		return nil, err
+	}
 	if s.selectRecentEventsStmt, err = db.Prepare(selectRecentEventsSQL); err != nil {
 		return nil, err
 	}
@@ -169,12 +188,18 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventsBySenderStmt, err = db.Prepare(selectEventsBySenderSQL); err != nil {
+		return nil, err
+	}
 	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
 		return nil, err
 	}
 	if s.deleteEventsForRoomStmt, err = db.Prepare(deleteEventsForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteEventsStmt, err = db.Prepare(deleteEventsSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -283,6 +308,28 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectMaxStreamPositionsForRooms returns the stream position of the latest event in each of the given rooms.
+func (s *outputRoomEventsStatements) SelectMaxStreamPositionsForRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMaxStreamPositionsStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMaxStreamPositionsForRooms: rows.close() failed")
+	positions := make(map[string]types.StreamPosition, len(roomIDs))
+	for rows.Next() {
+		var roomID string
+		var pos types.StreamPosition
+		if err = rows.Scan(&roomID, &pos); err != nil {
+			return nil, err
+		}
+		positions[roomID] = pos
+	}
+	return positions, rows.Err()
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
@@ -428,6 +475,20 @@ func (s *outputRoomEventsStatements) SelectEvents(
 	return rowsToStreamEvents(rows)
 }
 
+// SelectEventsBySender returns up to `limit` events sent by the given user
+// with a stream position after `afterPos`, oldest first.
+func (s *outputRoomEventsStatements) SelectEventsBySender(
+	ctx context.Context, txn *sql.Tx, sender string, afterPos types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventsBySenderStmt)
+	rows, err := stmt.QueryContext(ctx, sender, afterPos, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBySender: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
 func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (err error) {
@@ -435,6 +496,13 @@ func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	return err
 }
 
+func (s *outputRoomEventsStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteEventsStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
+
 func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	var result []types.StreamEvent
 	for rows.Next() {
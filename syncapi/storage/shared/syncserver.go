@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -49,6 +50,8 @@ type Database struct {
 	Filter              tables.Filter
 	Receipts            tables.Receipts
 	Memberships         tables.Memberships
+	Notifications       tables.Notifications
+	Presence            tables.Presence
 }
 
 func (d *Database) readOnlySnapshot(ctx context.Context) (*sql.Tx, error) {
@@ -127,6 +130,18 @@ func (d *Database) PeeksInRange(ctx context.Context, userID, deviceID string, r
 	return d.Peeks.SelectPeeksInRange(ctx, nil, userID, deviceID, r)
 }
 
+func (d *Database) MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error) {
+	id, err := d.Presence.SelectMaxPresenceID(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("d.Presence.SelectMaxPresenceID: %w", err)
+	}
+	return types.StreamPosition(id), nil
+}
+
+func (d *Database) PresenceAfter(ctx context.Context, userIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputPresenceEvent, error) {
+	return d.Presence.SelectPresenceAfter(ctx, nil, userIDs, streamPos)
+}
+
 func (d *Database) RoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error) {
 	return d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 }
@@ -147,6 +162,22 @@ func (d *Database) Events(ctx context.Context, eventIDs []string) ([]*gomatrixse
 	return d.StreamEventsToEvents(nil, streamEvents), nil
 }
 
+// EventsSentByUser returns up to `limit` events sent by the given user with a
+// stream position after `afterPos`, oldest first, along with the position of
+// the last event returned.
+func (d *Database) EventsSentByUser(
+	ctx context.Context, userID string, afterPos types.StreamPosition, limit int,
+) ([]*gomatrixserverlib.HeaderedEvent, types.StreamPosition, error) {
+	streamEvents, err := d.OutputEvents.SelectEventsBySender(ctx, nil, userID, afterPos, limit)
+	if err != nil {
+		return nil, afterPos, err
+	}
+	if len(streamEvents) > 0 {
+		afterPos = streamEvents[len(streamEvents)-1].StreamPosition
+	}
+	return d.StreamEventsToEvents(nil, streamEvents), afterPos, nil
+}
+
 // GetEventsInStreamingRange retrieves all of the events on a given ordering using the
 // given extremities and limit.
 func (d *Database) GetEventsInStreamingRange(
@@ -182,6 +213,10 @@ func (d *Database) AllJoinedUsersInRooms(ctx context.Context) (map[string][]stri
 	return d.CurrentRoomState.SelectJoinedUsers(ctx)
 }
 
+func (d *Database) JoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error) {
+	return d.CurrentRoomState.SelectJoinedUsersInRoom(ctx, roomID)
+}
+
 func (d *Database) AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error) {
 	return d.Peeks.SelectPeekingDevices(ctx)
 }
@@ -368,6 +403,20 @@ func (d *Database) PurgeRoomState(
 	})
 }
 
+func (d *Database) PurgeEvents(
+	ctx context.Context, eventIDs []string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.OutputEvents.DeleteEvents(ctx, txn, eventIDs); err != nil {
+			return fmt.Errorf("d.OutputEvents.DeleteEvents: %w", err)
+		}
+		if err := d.Topology.DeleteTopologyForEvents(ctx, txn, eventIDs); err != nil {
+			return fmt.Errorf("d.Topology.DeleteTopologyForEvents: %w", err)
+		}
+		return nil
+	})
+}
+
 func (d *Database) WriteEvent(
 	ctx context.Context,
 	ev *gomatrixserverlib.HeaderedEvent,
@@ -495,6 +544,12 @@ func (d *Database) MaxTopologicalPosition(
 	return types.TopologyToken{Depth: depth, PDUPosition: streamPos}, nil
 }
 
+func (d *Database) MaxStreamPositionsForRooms(
+	ctx context.Context, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	return d.OutputEvents.SelectMaxStreamPositionsForRooms(ctx, nil, roomIDs)
+}
+
 func (d *Database) EventPositionInTopology(
 	ctx context.Context, eventID string,
 ) (types.TopologyToken, error) {
@@ -956,3 +1011,38 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	_, receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 	return receipts, err
 }
+
+func (d *Database) InsertNotification(ctx context.Context, userID, roomID, eventID string, pos types.StreamPosition, highlight bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Notifications.InsertNotification(ctx, txn, userID, roomID, eventID, pos, highlight, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
+
+func (d *Database) DeleteNotificationsUpTo(ctx context.Context, userID, roomID string, pos types.StreamPosition) (affected bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		affected, err = d.Notifications.DeleteNotificationsUpTo(ctx, txn, userID, roomID, pos)
+		return err
+	})
+	return
+}
+
+func (d *Database) UnreadNotificationCount(ctx context.Context, userID string) (int, error) {
+	return d.Notifications.SelectUnreadNotificationCount(ctx, nil, userID)
+}
+
+func (d *Database) RoomUnreadNotificationCounts(ctx context.Context, userID string) (map[string]types.UnreadNotifications, error) {
+	return d.Notifications.SelectRoomUnreadNotificationCounts(ctx, nil, userID)
+}
+
+// StorePresence stores the presence of a user
+func (d *Database) StorePresence(ctx context.Context, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pos, err = d.Presence.UpsertPresence(ctx, txn, userID, presence, statusMsg, lastActiveTS)
+		return err
+	})
+	return
+}
+
+func (d *Database) GetPresence(ctx context.Context, userID string) (*eduAPI.OutputPresenceEvent, error) {
+	return d.Presence.SelectPresenceForUser(ctx, nil, userID)
+}
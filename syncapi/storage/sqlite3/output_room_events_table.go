@@ -48,6 +48,7 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   transaction_id TEXT,
   exclude_from_sync BOOL NOT NULL DEFAULT FALSE
 );
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_sender_idx ON syncapi_output_room_events(sender, id);
 `
 
 const insertEventSQL = "" +
@@ -74,9 +75,17 @@ const selectEarlyEventsSQL = "" +
 	" WHERE room_id = $1 AND id > $2 AND id <= $3"
 	// WHEN, ORDER BY and LIMIT are appended by prepareWithFilters
 
+const selectEventsBySenderSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
+	" WHERE sender = $1 AND id > $2" +
+	" ORDER BY id ASC LIMIT $3"
+
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
+const selectMaxStreamPositionForRoomSQL = "" +
+	"SELECT MAX(id) FROM syncapi_output_room_events WHERE room_id = $1"
+
 const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
@@ -90,14 +99,20 @@ const selectStateInRangeSQL = "" +
 const deleteEventsForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = $1"
+
 type outputRoomEventsStatements struct {
-	db                      *sql.DB
-	streamIDStatements      *streamIDStatements
-	insertEventStmt         *sql.Stmt
-	selectEventsStmt        *sql.Stmt
-	selectMaxEventIDStmt    *sql.Stmt
-	updateEventJSONStmt     *sql.Stmt
-	deleteEventsForRoomStmt *sql.Stmt
+	db                       *sql.DB
+	streamIDStatements       *streamIDStatements
+	insertEventStmt          *sql.Stmt
+	selectEventsStmt         *sql.Stmt
+	selectEventsBySenderStmt *sql.Stmt
+	selectMaxEventIDStmt     *sql.Stmt
+	selectMaxStreamPosStmt   *sql.Stmt
+	updateEventJSONStmt      *sql.Stmt
+	deleteEventsForRoomStmt  *sql.Stmt
+	deleteEventsStmt         *sql.Stmt
 }
 
 func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Events, error) {
@@ -115,15 +130,24 @@ func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Even
 	if s.selectEventsStmt, err = db.Prepare(selectEventsSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventsBySenderStmt, err = db.Prepare(selectEventsBySenderSQL); err != nil {
+		return nil, err
+	}
 	if s.selectMaxEventIDStmt, err = db.Prepare(selectMaxEventIDSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMaxStreamPosStmt, err = db.Prepare(selectMaxStreamPositionForRoomSQL); err != nil {
+		return nil, err
+	}
 	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
 		return nil, err
 	}
 	if s.deleteEventsForRoomStmt, err = db.Prepare(deleteEventsForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteEventsStmt, err = db.Prepare(deleteEventsSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -241,6 +265,24 @@ func (s *outputRoomEventsStatements) SelectMaxEventID(
 	return
 }
 
+// SelectMaxStreamPositionsForRooms returns the stream position of the latest event in each of the given rooms.
+func (s *outputRoomEventsStatements) SelectMaxStreamPositionsForRooms(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]types.StreamPosition, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMaxStreamPosStmt)
+	positions := make(map[string]types.StreamPosition, len(roomIDs))
+	for _, roomID := range roomIDs {
+		var nullablePos sql.NullInt64
+		if err := stmt.QueryRowContext(ctx, roomID).Scan(&nullablePos); err != nil {
+			return nil, err
+		}
+		if nullablePos.Valid {
+			positions[roomID] = types.StreamPosition(nullablePos.Int64)
+		}
+	}
+	return positions, nil
+}
+
 // InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
 // of the inserted event.
 func (s *outputRoomEventsStatements) InsertEvent(
@@ -417,6 +459,20 @@ func (s *outputRoomEventsStatements) SelectEvents(
 	return returnEvents, nil
 }
 
+// SelectEventsBySender returns up to `limit` events sent by the given user
+// with a stream position after `afterPos`, oldest first.
+func (s *outputRoomEventsStatements) SelectEventsBySender(
+	ctx context.Context, txn *sql.Tx, sender string, afterPos types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventsBySenderStmt)
+	rows, err := stmt.QueryContext(ctx, sender, afterPos, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBySender: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
 func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (err error) {
@@ -424,6 +480,18 @@ func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	return err
 }
 
+func (s *outputRoomEventsStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteEventsStmt)
+	for _, eventID := range eventIDs {
+		if _, err = stmt.ExecContext(ctx, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	var result []types.StreamEvent
 	for rows.Next() {
@@ -52,6 +52,9 @@ type Peeks interface {
 type Events interface {
 	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *gomatrixserverlib.StateFilter) (map[string]map[string]bool, map[string]types.StreamEvent, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectMaxStreamPositionsForRooms returns the stream position of the latest event in each of the given rooms.
+	// Rooms without any events are omitted.
+	SelectMaxStreamPositionsForRooms(ctx context.Context, txn *sql.Tx, roomIDs []string) (map[string]types.StreamPosition, error)
 	InsertEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, addState, removeState []string, transactionID *api.TransactionID, excludeFromSync bool) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
 	// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude from sync.
@@ -60,9 +63,13 @@ type Events interface {
 	// SelectEarlyEvents returns the earliest events in the given room.
 	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
+	// SelectEventsBySender returns up to `limit` events sent by the given user after the given stream position, oldest first.
+	SelectEventsBySender(ctx context.Context, txn *sql.Tx, sender string, afterPos types.StreamPosition, limit int) ([]types.StreamEvent, error)
 	UpdateEventJSON(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
 	// DeleteEventsForRoom removes all event information for a room. This should only be done when removing the room entirely.
 	DeleteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteEvents removes the events with the given IDs, e.g. once they have been purged by the roomserver.
+	DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) (err error)
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -82,6 +89,8 @@ type Topology interface {
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
 	// DeleteTopologyForRoom removes all topological information for a room. This should only be done when removing the room entirely.
 	DeleteTopologyForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteTopologyForEvents removes the topological information for the events with the given IDs.
+	DeleteTopologyForEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) (err error)
 }
 
 type CurrentRoomState interface {
@@ -96,6 +105,8 @@ type CurrentRoomState interface {
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
+	// SelectJoinedUsersInRoom returns the user IDs of the users who are joined to the room.
+	SelectJoinedUsersInRoom(ctx context.Context, roomID string) ([]string, error)
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -163,6 +174,31 @@ type Receipts interface {
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
+// Notifications tracks the events which local users have been notified about
+// and haven't read yet.
+type Notifications interface {
+	InsertNotification(ctx context.Context, txn *sql.Tx, userID, roomID, eventID string, pos types.StreamPosition, highlight bool, ts gomatrixserverlib.Timestamp) error
+	// DeleteNotificationsUpTo deletes the notifications of the user in the room up to and including the stream position.
+	// Returns true if any notifications were deleted.
+	DeleteNotificationsUpTo(ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition) (affected bool, err error)
+	// SelectUnreadNotificationCount returns the number of unread notifications of the user across all rooms.
+	SelectUnreadNotificationCount(ctx context.Context, txn *sql.Tx, userID string) (count int, err error)
+	// SelectRoomUnreadNotificationCounts returns the unread notification and highlight counts of the user, by room.
+	// Rooms without unread notifications are left out.
+	SelectRoomUnreadNotificationCounts(ctx context.Context, txn *sql.Tx, userID string) (map[string]types.UnreadNotifications, error)
+}
+
+// Presence stores the latest presence of users, local and remote.
+type Presence interface {
+	// UpsertPresence stores the presence of the user. A nil status message keeps the stored one.
+	UpsertPresence(ctx context.Context, txn *sql.Tx, userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
+	// SelectPresenceForUser returns the presence of the user, or nil if there is none.
+	SelectPresenceForUser(ctx context.Context, txn *sql.Tx, userID string) (*eduAPI.OutputPresenceEvent, error)
+	// SelectPresenceAfter returns the presence of the given users which changed after the stream position.
+	SelectPresenceAfter(ctx context.Context, txn *sql.Tx, userIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputPresenceEvent, error)
+	SelectMaxPresenceID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
 type Memberships interface {
 	UpsertMembership(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, streamPos, topologicalPos types.StreamPosition) error
 	SelectMembership(ctx context.Context, txn *sql.Tx, roomID, userID, memberships []string) (eventID string, streamPos, topologyPos types.StreamPosition, err error)
@@ -2,6 +2,7 @@ package streams
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,18 +12,21 @@ import (
 	"go.uber.org/atomic"
 )
 
-// The max number of per-room goroutines to have running.
-// Too high and this will consume lots of CPU, too low and complete
-// sync responses will take longer to process.
+// The default max number of per-room goroutines to have running.
+// Too high and this will consume lots of CPU, too low and sync
+// responses touching many rooms will take longer to process.
 const PDU_STREAM_WORKERS = 256
 
-// The maximum number of tasks that can be queued in total before
-// backpressure will build up and the rests will start to block.
-const PDU_STREAM_QUEUESIZE = PDU_STREAM_WORKERS * 8
+// The maximum number of tasks per worker that can be queued in total
+// before backpressure will build up and the rests will start to block.
+const PDU_STREAM_QUEUESIZE_PER_WORKER = 8
 
 type PDUStreamProvider struct {
 	StreamProvider
 
+	// The max number of per-room goroutines, PDU_STREAM_WORKERS if unset.
+	MaxWorkers int
+
 	tasks   chan func()
 	workers atomic.Int32
 }
@@ -40,7 +44,7 @@ func (p *PDUStreamProvider) worker() {
 }
 
 func (p *PDUStreamProvider) queue(f func()) {
-	if p.workers.Load() < PDU_STREAM_WORKERS {
+	if p.workers.Load() < int32(p.MaxWorkers) {
 		p.workers.Inc()
 		go p.worker()
 	}
@@ -49,7 +53,10 @@ func (p *PDUStreamProvider) queue(f func()) {
 
 func (p *PDUStreamProvider) Setup() {
 	p.StreamProvider.Setup()
-	p.tasks = make(chan func(), PDU_STREAM_QUEUESIZE)
+	if p.MaxWorkers <= 0 {
+		p.MaxWorkers = PDU_STREAM_WORKERS
+	}
+	p.tasks = make(chan func(), p.MaxWorkers*PDU_STREAM_QUEUESIZE_PER_WORKER)
 
 	p.latestMutex.Lock()
 	defer p.latestMutex.Unlock()
@@ -87,6 +94,13 @@ func (p *PDUStreamProvider) CompleteSync(
 	stateFilter := req.Filter.Room.State
 	eventFilter := req.Filter.Room.Timeline
 
+	// Start with the most recently active rooms, so that they are less
+	// likely to wait behind others when there are more rooms than workers.
+	positions := p.recentActivity(ctx, req, joinedRoomIDs)
+	sort.SliceStable(joinedRoomIDs, func(i, j int) bool {
+		return positions[joinedRoomIDs[i]] > positions[joinedRoomIDs[j]]
+	})
+
 	// Build up a /sync response. Add joined rooms.
 	var reqMutex sync.Mutex
 	var reqWaitGroup sync.WaitGroup
@@ -96,12 +110,11 @@ func (p *PDUStreamProvider) CompleteSync(
 		p.queue(func() {
 			defer reqWaitGroup.Done()
 
-			var jr *types.JoinResponse
-			jr, err = p.getJoinResponseForCompleteSync(
+			jr, jerr := p.getJoinResponseForCompleteSync(
 				ctx, roomID, r, &stateFilter, &eventFilter, req.WantFullState, req.Device,
 			)
-			if err != nil {
-				req.Log.WithError(err).Error("p.getJoinResponseForCompleteSync failed")
+			if jerr != nil {
+				req.Log.WithError(jerr).Error("p.getJoinResponseForCompleteSync failed")
 				return
 			}
 
@@ -172,16 +185,51 @@ func (p *PDUStreamProvider) IncrementalSync(
 		req.Rooms[roomID] = gomatrixserverlib.Join
 	}
 
+	// After a long gap there may be deltas for many rooms, so build their
+	// responses concurrently, most recently active first.
+	roomIDs := make([]string, 0, len(stateDeltas))
 	for _, delta := range stateDeltas {
-		if err = p.addRoomDeltaToResponse(ctx, req.Device, r, delta, &eventFilter, req.Response); err != nil {
-			req.Log.WithError(err).Error("d.addRoomDeltaToResponse failed")
-			return newPos
-		}
+		roomIDs = append(roomIDs, delta.RoomID)
+	}
+	positions := p.recentActivity(ctx, req, roomIDs)
+	sort.SliceStable(stateDeltas, func(i, j int) bool {
+		return positions[stateDeltas[i].RoomID] > positions[stateDeltas[j].RoomID]
+	})
+
+	var resMutex sync.Mutex
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	wg.Add(len(stateDeltas))
+	for _, d := range stateDeltas {
+		delta := d
+		p.queue(func() {
+			defer wg.Done()
+			if derr := p.addRoomDeltaToResponse(ctx, req.Device, r, delta, &eventFilter, req.Response, &resMutex); derr != nil {
+				req.Log.WithError(derr).Error("d.addRoomDeltaToResponse failed")
+				failed.Store(true)
+			}
+		})
+	}
+	wg.Wait()
+	if failed.Load() {
+		return newPos
 	}
 
 	return r.To
 }
 
+// recentActivity returns the stream position of the latest event in each of
+// the given rooms, for ordering rooms by how recently they were active.
+func (p *PDUStreamProvider) recentActivity(
+	ctx context.Context, req *types.SyncRequest, roomIDs []string,
+) map[string]types.StreamPosition {
+	positions, err := p.DB.MaxStreamPositionsForRooms(ctx, roomIDs)
+	if err != nil {
+		req.Log.WithError(err).Warn("p.DB.MaxStreamPositionsForRooms failed")
+	}
+	return positions
+}
+
 func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	ctx context.Context,
 	device *userapi.Device,
@@ -189,6 +237,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	delta types.StateDelta,
 	eventFilter *gomatrixserverlib.RoomEventFilter,
 	res *types.Response,
+	resMutex *sync.Mutex,
 ) error {
 	if delta.MembershipPos > 0 && delta.Membership == gomatrixserverlib.Leave {
 		// make sure we don't leak recent events after the leave event.
@@ -219,6 +268,8 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		return nil
 	}
 
+	resMutex.Lock()
+	defer resMutex.Unlock()
 	switch delta.Membership {
 	case gomatrixserverlib.Join:
 		jr := types.NewJoinResponse()
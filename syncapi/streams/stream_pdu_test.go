@@ -0,0 +1,186 @@
+package streams
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// concurrentSyncDatabase returns the recent events for each room. If allIn is
+// set then it only does so once RecentEvents has been called for all rooms at
+// the same time, so that syncing rooms one at a time would time out.
+type concurrentSyncDatabase struct {
+	storage.Database
+	deltas    []types.StateDelta
+	events    map[string][]types.StreamEvent
+	positions map[string]types.StreamPosition
+
+	mu       sync.Mutex
+	inFlight int
+	started  []string
+	allIn    chan struct{}
+}
+
+func (d *concurrentSyncDatabase) MaxStreamPositionForPDUs(ctx context.Context) (types.StreamPosition, error) {
+	return 0, nil
+}
+
+func (d *concurrentSyncDatabase) GetStateDeltas(
+	ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter,
+) ([]types.StateDelta, []string, error) {
+	var joined []string
+	for _, delta := range d.deltas {
+		joined = append(joined, delta.RoomID)
+	}
+	return d.deltas, joined, nil
+}
+
+func (d *concurrentSyncDatabase) MaxStreamPositionsForRooms(ctx context.Context, roomIDs []string) (map[string]types.StreamPosition, error) {
+	return d.positions, nil
+}
+
+func (d *concurrentSyncDatabase) RecentEvents(
+	ctx context.Context, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool,
+) ([]types.StreamEvent, bool, error) {
+	d.mu.Lock()
+	d.inFlight++
+	d.started = append(d.started, roomID)
+	if d.allIn == nil {
+		d.mu.Unlock()
+		return d.events[roomID], false, nil
+	}
+	if d.inFlight == len(d.deltas) {
+		close(d.allIn)
+	}
+	d.mu.Unlock()
+	select {
+	case <-d.allIn:
+	case <-time.After(5 * time.Second):
+		return nil, false, fmt.Errorf("rooms were not synced concurrently")
+	}
+	return d.events[roomID], false, nil
+}
+
+func (d *concurrentSyncDatabase) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent {
+	out := make([]*gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		out[i] = in[i].HeaderedEvent
+	}
+	return out
+}
+
+func (d *concurrentSyncDatabase) GetBackwardTopologyPos(ctx context.Context, events []types.StreamEvent) (types.TopologyToken, error) {
+	return types.TopologyToken{}, nil
+}
+
+func mustCreateMessage(t *testing.T, key ed25519.PrivateKey, roomID string, n int) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender: "@alice:localhost",
+		RoomID: roomID,
+		Type:   "m.room.message",
+	}
+	if err := eb.SetContent(map[string]interface{}{"body": fmt.Sprintf("%d", n)}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
+
+func newConcurrentSyncDatabase(t *testing.T, numRooms, numEvents int) *concurrentSyncDatabase {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	db := &concurrentSyncDatabase{
+		events:    map[string][]types.StreamEvent{},
+		positions: map[string]types.StreamPosition{},
+	}
+	pos := types.StreamPosition(0)
+	for i := 0; i < numRooms; i++ {
+		roomID := fmt.Sprintf("!room%d:localhost", i)
+		db.deltas = append(db.deltas, types.StateDelta{RoomID: roomID, Membership: gomatrixserverlib.Join})
+		for n := 0; n < numEvents; n++ {
+			pos++
+			db.events[roomID] = append(db.events[roomID], types.StreamEvent{
+				HeaderedEvent:  mustCreateMessage(t, key, roomID, n),
+				StreamPosition: pos,
+			})
+		}
+		// Later rooms are more recently active.
+		db.positions[roomID] = pos
+	}
+	return db
+}
+
+func mustIncrementalSync(t *testing.T, db *concurrentSyncDatabase, maxWorkers int) *types.SyncRequest {
+	t.Helper()
+	p := &PDUStreamProvider{
+		StreamProvider: StreamProvider{DB: db},
+		MaxWorkers:     maxWorkers,
+	}
+	p.Setup()
+	req := &types.SyncRequest{
+		Context:  context.Background(),
+		Log:      logrus.NewEntry(logrus.New()),
+		Device:   &userapi.Device{UserID: "@alice:localhost"},
+		Response: types.NewResponse(),
+		Filter:   gomatrixserverlib.DefaultFilter(),
+		Rooms:    map[string]string{},
+	}
+	to := types.StreamPosition(len(db.deltas) * len(db.events[db.deltas[0].RoomID]))
+	if got := p.IncrementalSync(context.Background(), req, 0, to); got != to {
+		t.Fatalf("expected position %d, got %d", to, got)
+	}
+	return req
+}
+
+func TestIncrementalSyncRoomsConcurrently(t *testing.T) {
+	const numRooms, numEvents = 8, 5
+	db := newConcurrentSyncDatabase(t, numRooms, numEvents)
+	db.allIn = make(chan struct{})
+	req := mustIncrementalSync(t, db, numRooms)
+
+	if len(req.Response.Rooms.Join) != numRooms {
+		t.Fatalf("expected %d joined rooms, got %d", numRooms, len(req.Response.Rooms.Join))
+	}
+	for roomID, jr := range req.Response.Rooms.Join {
+		if len(jr.Timeline.Events) != numEvents {
+			t.Fatalf("%s: expected %d events, got %d", roomID, numEvents, len(jr.Timeline.Events))
+		}
+		for n, ev := range jr.Timeline.Events {
+			if want := db.events[roomID][n].EventID(); ev.EventID != want {
+				t.Errorf("%s: expected event %s at %d, got %s", roomID, want, n, ev.EventID)
+			}
+			if body := gjson.GetBytes(ev.Content, "body").Str; body != fmt.Sprintf("%d", n) {
+				t.Errorf("%s: expected event %d in order, got body %q", roomID, n, body)
+			}
+		}
+	}
+}
+
+func TestIncrementalSyncRecentlyActiveRoomsFirst(t *testing.T) {
+	const numRooms = 4
+	db := newConcurrentSyncDatabase(t, numRooms, 1)
+	mustIncrementalSync(t, db, 1)
+
+	for i, roomID := range db.started {
+		if want := fmt.Sprintf("!room%d:localhost", numRooms-1-i); roomID != want {
+			t.Errorf("expected room %s to be synced at %d, got %s", want, i, roomID)
+		}
+	}
+}
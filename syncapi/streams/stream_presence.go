@@ -0,0 +1,85 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type PresenceStreamProvider struct {
+	StreamProvider
+}
+
+func (p *PresenceStreamProvider) Setup() {
+	p.StreamProvider.Setup()
+
+	id, err := p.DB.MaxStreamPositionForPresence(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	p.latest = id
+}
+
+func (p *PresenceStreamProvider) CompleteSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+) types.StreamPosition {
+	return p.IncrementalSync(ctx, req, 0, p.LatestPosition(ctx))
+}
+
+func (p *PresenceStreamProvider) IncrementalSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+	from, to types.StreamPosition,
+) types.StreamPosition {
+	// Presence is only shared with users who share a room, and the user
+	// themselves.
+	userIDs := map[string]struct{}{
+		req.Device.UserID: {},
+	}
+	for roomID, membership := range req.Rooms {
+		if membership != gomatrixserverlib.Join {
+			continue
+		}
+		joined, err := p.DB.JoinedUsersInRoom(ctx, roomID)
+		if err != nil {
+			req.Log.WithError(err).Error("p.DB.JoinedUsersInRoom failed")
+			return from
+		}
+		for _, userID := range joined {
+			userIDs[userID] = struct{}{}
+		}
+	}
+	sharedUsers := make([]string, 0, len(userIDs))
+	for userID := range userIDs {
+		sharedUsers = append(sharedUsers, userID)
+	}
+
+	lastPos, presences, err := p.DB.PresenceAfter(ctx, sharedUsers, from)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.PresenceAfter failed")
+		return from
+	}
+
+	if len(presences) == 0 || lastPos == 0 {
+		return to
+	}
+
+	for i := range presences {
+		ev := gomatrixserverlib.ClientEvent{
+			Type:   eduAPI.MPresence,
+			Sender: presences[i].UserID,
+		}
+		ev.Content, err = json.Marshal(eduAPI.NewPresenceContent(&presences[i]))
+		if err != nil {
+			req.Log.WithError(err).Error("json.Marshal failed")
+			return from
+		}
+		req.Response.Presence.Events = append(req.Response.Presence.Events, ev)
+	}
+
+	return lastPos
+}
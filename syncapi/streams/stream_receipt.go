@@ -42,6 +42,10 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 		}
 	}
 
+	if len(joinedRooms) == 0 {
+		return to
+	}
+
 	lastPos, receipts, err := p.DB.RoomReceiptsAfter(ctx, joinedRooms, from)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.RoomReceiptsAfter failed")
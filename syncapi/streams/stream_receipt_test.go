@@ -0,0 +1,89 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+type receiptsDatabase struct {
+	storage.Database
+	receipts []eduAPI.OutputReceiptEvent
+	queried  [][]string
+}
+
+func (d *receiptsDatabase) RoomReceiptsAfter(
+	ctx context.Context, roomIDs []string, streamPos types.StreamPosition,
+) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error) {
+	d.queried = append(d.queried, roomIDs)
+	return types.StreamPosition(len(d.receipts)), d.receipts, nil
+}
+
+func TestReceiptStreamIncrementalSync(t *testing.T) {
+	db := &receiptsDatabase{
+		receipts: []eduAPI.OutputReceiptEvent{
+			{UserID: "@alice:localhost", RoomID: "!a:localhost", EventID: "$one", Type: "m.read", Timestamp: 1},
+			{UserID: "@bob:localhost", RoomID: "!a:localhost", EventID: "$one", Type: "m.read", Timestamp: 2},
+			{UserID: "@bob:localhost", RoomID: "!b:localhost", EventID: "$two", Type: "m.read", Timestamp: 3},
+		},
+	}
+	p := &ReceiptStreamProvider{StreamProvider: StreamProvider{DB: db}}
+	req := &types.SyncRequest{
+		Device:   &userapi.Device{UserID: "@alice:localhost"},
+		Response: types.NewResponse(),
+		Rooms: map[string]string{
+			"!a:localhost": gomatrixserverlib.Join,
+			"!b:localhost": gomatrixserverlib.Join,
+			"!c:localhost": gomatrixserverlib.Leave,
+		},
+		Log: logrus.NewEntry(logrus.New()),
+	}
+
+	if pos := p.IncrementalSync(context.Background(), req, 0, 10); pos != 3 {
+		t.Errorf("IncrementalSync returned position %d, want 3", pos)
+	}
+	if len(db.queried) != 1 || len(db.queried[0]) != 2 {
+		t.Fatalf("expected receipts to be queried for the 2 joined rooms, got %v", db.queried)
+	}
+
+	roomA := req.Response.Rooms.Join["!a:localhost"]
+	if len(roomA.Ephemeral.Events) != 1 {
+		t.Fatalf("expected 1 receipt event in room A, got %d", len(roomA.Ephemeral.Events))
+	}
+	var content map[string]eduAPI.ReceiptMRead
+	if err := json.Unmarshal(roomA.Ephemeral.Events[0].Content, &content); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{"@alice:localhost", "@bob:localhost"} {
+		if _, ok := content["$one"].User[userID]; !ok {
+			t.Errorf("expected a receipt of %s in room A, got %+v", userID, content)
+		}
+	}
+	if roomB := req.Response.Rooms.Join["!b:localhost"]; len(roomB.Ephemeral.Events) != 1 {
+		t.Errorf("expected 1 receipt event in room B, got %d", len(roomB.Ephemeral.Events))
+	}
+}
+
+func TestReceiptStreamNoJoinedRooms(t *testing.T) {
+	db := &receiptsDatabase{}
+	p := &ReceiptStreamProvider{StreamProvider: StreamProvider{DB: db}}
+	req := &types.SyncRequest{
+		Device:   &userapi.Device{UserID: "@alice:localhost"},
+		Response: types.NewResponse(),
+		Rooms:    map[string]string{},
+		Log:      logrus.NewEntry(logrus.New()),
+	}
+	if pos := p.IncrementalSync(context.Background(), req, 0, 10); pos != 10 {
+		t.Errorf("IncrementalSync returned position %d, want 10", pos)
+	}
+	if len(db.queried) != 0 {
+		t.Errorf("expected no receipts query without joined rooms, got %v", db.queried)
+	}
+}
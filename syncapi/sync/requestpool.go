@@ -17,6 +17,7 @@
 package sync
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"strings"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -33,8 +35,10 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/streams"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 // RequestPool manages HTTP long-poll connections for /sync
@@ -44,7 +48,9 @@ type RequestPool struct {
 	userAPI  userapi.UserInternalAPI
 	keyAPI   keyapi.KeyInternalAPI
 	rsAPI    roomserverAPI.RoomserverInternalAPI
+	eduAPI   eduAPI.EDUServerInputAPI
 	lastseen sync.Map
+	presence sync.Map
 	streams  *streams.Streams
 	Notifier *notifier.Notifier
 }
@@ -53,7 +59,7 @@ type RequestPool struct {
 func NewRequestPool(
 	db storage.Database, cfg *config.SyncAPI,
 	userAPI userapi.UserInternalAPI, keyAPI keyapi.KeyInternalAPI,
-	rsAPI roomserverAPI.RoomserverInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, eduInputAPI eduAPI.EDUServerInputAPI,
 	streams *streams.Streams, notifier *notifier.Notifier,
 ) *RequestPool {
 	rp := &RequestPool{
@@ -62,7 +68,9 @@ func NewRequestPool(
 		userAPI:  userAPI,
 		keyAPI:   keyAPI,
 		rsAPI:    rsAPI,
+		eduAPI:   eduInputAPI,
 		lastseen: sync.Map{},
+		presence: sync.Map{},
 		streams:  streams,
 		Notifier: notifier,
 	}
@@ -109,6 +117,51 @@ func (rp *RequestPool) updateLastSeen(req *http.Request, device *userapi.Device)
 	rp.lastseen.Store(device.UserID+device.ID, time.Now())
 }
 
+// presenceUpdateInterval is how often syncing marks a user as active, as
+// long as their presence doesn't change.
+const presenceUpdateInterval = time.Minute
+
+type lastPresence struct {
+	presence string
+	sent     time.Time
+}
+
+// updatePresence marks the user with the presence given by set_presence,
+// online by default, since they're syncing. Clients which sync in the
+// background set it to offline, in which case the presence is left as is.
+func (rp *RequestPool) updatePresence(req *http.Request, device *userapi.Device) {
+	if rp.cfg.Matrix.DisablePresence || rp.eduAPI == nil {
+		return
+	}
+	presence := req.URL.Query().Get("set_presence")
+	switch presence {
+	case "":
+		presence = eduAPI.PresenceOnline
+	case eduAPI.PresenceOffline:
+		return
+	case eduAPI.PresenceOnline, eduAPI.PresenceUnavailable:
+	default:
+		return
+	}
+
+	now := time.Now()
+	if v, ok := rp.presence.Load(device.UserID); ok {
+		last := v.(lastPresence)
+		if last.presence == presence && now.Sub(last.sent) < presenceUpdateInterval {
+			return
+		}
+	}
+	rp.presence.Store(device.UserID, lastPresence{presence: presence, sent: now})
+
+	go func() {
+		if err := eduAPI.SendPresence(
+			context.Background(), rp.eduAPI, device.UserID, presence, nil, gomatrixserverlib.AsTimestamp(now),
+		); err != nil {
+			logrus.WithError(err).WithField("user_id", device.UserID).Error("Failed to update presence")
+		}
+	}()
+}
+
 func init() {
 	prometheus.MustRegister(
 		activeSyncRequests, waitingSyncRequests,
@@ -150,6 +203,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	defer activeSyncRequests.Dec()
 
 	rp.updateLastSeen(req, device)
+	rp.updatePresence(req, device)
 
 	waitingSyncRequests.Inc()
 	defer waitingSyncRequests.Dec()
@@ -207,6 +261,9 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			AccountDataPosition: rp.streams.AccountDataStreamProvider.CompleteSync(
 				syncReq.Context, syncReq,
 			),
+			PresencePosition: rp.streams.PresenceStreamProvider.CompleteSync(
+				syncReq.Context, syncReq,
+			),
 			DeviceListPosition: rp.streams.DeviceListStreamProvider.CompleteSync(
 				syncReq.Context, syncReq,
 			),
@@ -238,6 +295,10 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 				syncReq.Context, syncReq,
 				syncReq.Since.AccountDataPosition, currentPos.AccountDataPosition,
 			),
+			PresencePosition: rp.streams.PresenceStreamProvider.IncrementalSync(
+				syncReq.Context, syncReq,
+				syncReq.Since.PresencePosition, currentPos.PresencePosition,
+			),
 			DeviceListPosition: rp.streams.DeviceListStreamProvider.IncrementalSync(
 				syncReq.Context, syncReq,
 				syncReq.Since.DeviceListPosition, currentPos.DeviceListPosition,
@@ -245,12 +306,33 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 		}
 	}
 
+	rp.addUnreadNotifications(syncReq)
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: syncReq.Response,
 	}
 }
 
+// addUnreadNotifications fills in the unread notification counts of the
+// joined rooms in the response. A room only shows up in an incremental
+// sync when something happened in it, such as a new event or a read
+// receipt, which is also when its counts may have changed.
+func (rp *RequestPool) addUnreadNotifications(syncReq *types.SyncRequest) {
+	if len(syncReq.Response.Rooms.Join) == 0 {
+		return
+	}
+	counts, err := rp.db.RoomUnreadNotificationCounts(syncReq.Context, syncReq.Device.UserID)
+	if err != nil {
+		syncReq.Log.WithError(err).Error("rp.db.RoomUnreadNotificationCounts failed")
+		return
+	}
+	for roomID, jr := range syncReq.Response.Rooms.Join {
+		jr.UnreadNotifications = counts[roomID]
+		syncReq.Response.Rooms.Join[roomID] = jr
+	}
+}
+
 func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	from := req.URL.Query().Get("from")
 	to := req.URL.Query().Get("to")
@@ -288,6 +370,13 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 		util.GetLogger(req.Context()).WithError(err).Error("Failed to DeviceListCatchup info")
 		return jsonerror.InternalServerError()
 	}
+	// the spec requires both lists to be present, even if there were no changes.
+	if syncReq.Response.DeviceLists.Changed == nil {
+		syncReq.Response.DeviceLists.Changed = []string{}
+	}
+	if syncReq.Response.DeviceLists.Left == nil {
+		syncReq.Response.DeviceLists.Left = []string{}
+	}
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
@@ -124,6 +124,7 @@ type StreamingToken struct {
 	SendToDevicePosition StreamPosition
 	InvitePosition       StreamPosition
 	AccountDataPosition  StreamPosition
+	PresencePosition     StreamPosition
 	DeviceListPosition   LogPosition
 }
 
@@ -140,10 +141,11 @@ func (s *StreamingToken) UnmarshalText(text []byte) (err error) {
 
 func (t StreamingToken) String() string {
 	posStr := fmt.Sprintf(
-		"s%d_%d_%d_%d_%d_%d",
+		"s%d_%d_%d_%d_%d_%d_%d",
 		t.PDUPosition, t.TypingPosition,
 		t.ReceiptPosition, t.SendToDevicePosition,
 		t.InvitePosition, t.AccountDataPosition,
+		t.PresencePosition,
 	)
 	if dl := t.DeviceListPosition; !dl.IsEmpty() {
 		posStr += fmt.Sprintf(".dl-%d-%d", dl.Partition, dl.Offset)
@@ -166,6 +168,8 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 		return true
 	case t.AccountDataPosition > other.AccountDataPosition:
 		return true
+	case t.PresencePosition > other.PresencePosition:
+		return true
 	case t.DeviceListPosition.IsAfter(&other.DeviceListPosition):
 		return true
 	}
@@ -173,7 +177,7 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 }
 
 func (t *StreamingToken) IsEmpty() bool {
-	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition == 0 && t.DeviceListPosition.IsEmpty()
+	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition+t.PresencePosition == 0 && t.DeviceListPosition.IsEmpty()
 }
 
 // WithUpdates returns a copy of the StreamingToken with updates applied from another StreamingToken.
@@ -208,6 +212,9 @@ func (t *StreamingToken) ApplyUpdates(other StreamingToken) {
 	if other.AccountDataPosition > t.AccountDataPosition {
 		t.AccountDataPosition = other.AccountDataPosition
 	}
+	if other.PresencePosition > t.PresencePosition {
+		t.PresencePosition = other.PresencePosition
+	}
 	if other.DeviceListPosition.IsAfter(&t.DeviceListPosition) {
 		t.DeviceListPosition = other.DeviceListPosition
 	}
@@ -301,9 +308,11 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	}
 	categories := strings.Split(tok[1:], ".")
 	parts := strings.Split(categories[0], "_")
-	var positions [6]StreamPosition
+	// Tokens from before a stream was added have fewer positions, so the
+	// positions of the newer streams are left at zero.
+	var positions [7]StreamPosition
 	for i, p := range parts {
-		if i > len(positions) {
+		if i >= len(positions) {
 			break
 		}
 		var pos int
@@ -320,6 +329,7 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		SendToDevicePosition: positions[3],
 		InvitePosition:       positions[4],
 		AccountDataPosition:  positions[5],
+		PresencePosition:     positions[6],
 	}
 	// dl-0-1234
 	// $log_name-$partition-$offset
@@ -379,6 +389,9 @@ type Response struct {
 		Left    []string `json:"left,omitempty"`
 	} `json:"device_lists"`
 	DeviceListsOTKCount map[string]int `json:"device_one_time_keys_count,omitempty"`
+	// The algorithms of the fallback keys which haven't been claimed, from MSC2732. This is
+	// always sent so that clients know that the server supports fallback keys.
+	DeviceUnusedFallbackKeyTypes []string `json:"device_unused_fallback_key_types"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -399,6 +412,7 @@ func NewResponse() *Response {
 	res.Presence.Events = []gomatrixserverlib.ClientEvent{}
 	res.ToDevice.Events = []gomatrixserverlib.SendToDeviceEvent{}
 	res.DeviceListsOTKCount = map[string]int{}
+	res.DeviceUnusedFallbackKeyTypes = []string{}
 
 	return &res
 }
@@ -430,6 +444,17 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
+}
+
+// UnreadNotifications are the counts of the notifications in a room which
+// the user hasn't read yet.
+type UnreadNotifications struct {
+	// NotificationCount is the number of unread notifications.
+	NotificationCount int `json:"notification_count"`
+	// HighlightCount is the number of unread notifications with the
+	// highlight tweak set.
+	HighlightCount int `json:"highlight_count"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -1,19 +1,22 @@
 package types
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 func TestNewSyncTokenWithLogs(t *testing.T) {
 	tests := map[string]*StreamingToken{
-		"s4_0_0_0_0_0": {
+		"s4_0_0_0_0_0_0": {
 			PDUPosition: 4,
 		},
-		"s4_0_0_0_0_0.dl-0-123": {
+		"s4_0_0_0_0_0_0.dl-0-123": {
 			PDUPosition: 4,
 			DeviceListPosition: LogPosition{
 				Partition: 0,
@@ -40,12 +43,27 @@ func TestNewSyncTokenWithLogs(t *testing.T) {
 	}
 }
 
+func TestOldSyncTokens(t *testing.T) {
+	// Tokens handed out before the presence stream existed are still valid.
+	got, err := NewStreamTokenFromString("s3_1_2_3_5_4")
+	if err != nil {
+		t.Fatalf("NewStreamTokenFromString failed: %s", err)
+	}
+	want := StreamingToken{3, 1, 2, 3, 5, 4, 0, LogPosition{}}
+	if got != want {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	if _, err = NewStreamTokenFromString("s1_2_3_4_5_6_7_8"); err != nil {
+		t.Errorf("NewStreamTokenFromString with extra positions failed: %s", err)
+	}
+}
+
 func TestSyncTokens(t *testing.T) {
 	shouldPass := map[string]string{
-		"s4_0_0_0_0_0":        StreamingToken{4, 0, 0, 0, 0, 0, LogPosition{}}.String(),
-		"s3_1_0_0_0_0.dl-1-2": StreamingToken{3, 1, 0, 0, 0, 0, LogPosition{1, 2}}.String(),
-		"s3_1_2_3_5_0":        StreamingToken{3, 1, 2, 3, 5, 0, LogPosition{}}.String(),
-		"t3_1":                TopologyToken{3, 1}.String(),
+		"s4_0_0_0_0_0_0":        StreamingToken{4, 0, 0, 0, 0, 0, 0, LogPosition{}}.String(),
+		"s3_1_0_0_0_0_0.dl-1-2": StreamingToken{3, 1, 0, 0, 0, 0, 0, LogPosition{1, 2}}.String(),
+		"s3_1_2_3_5_0_6":        StreamingToken{3, 1, 2, 3, 5, 0, 6, LogPosition{}}.String(),
+		"t3_1":                  TopologyToken{3, 1}.String(),
 	}
 
 	for a, b := range shouldPass {
@@ -96,3 +114,35 @@ func TestNewInviteResponse(t *testing.T) {
 		t.Fatalf("Invite response didn't contain correct info")
 	}
 }
+
+func TestNewInviteResponseKeepsReason(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateKey := "@bob:localhost"
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   "@alice:remote",
+		RoomID:   "!room:remote",
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &stateKey,
+	}
+	if err = eb.SetContent(map[string]interface{}{
+		"membership": gomatrixserverlib.Invite,
+		"reason":     "Join us",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := eb.Build(time.Now(), "remote", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := NewInviteResponse(ev.Headered(gomatrixserverlib.RoomVersionV6))
+	if len(res.InviteState.Events) != 1 {
+		t.Fatalf("expected the invite event in the invite state, got %d events", len(res.InviteState.Events))
+	}
+	if reason := gjson.GetBytes(res.InviteState.Events[0], "content.reason").Str; reason != "Join us" {
+		t.Fatalf("expected invite reason %q, got %q", "Join us", reason)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -33,15 +34,23 @@ type UserInternalAPI interface {
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
 	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
+	PerformLoginTokenCreation(ctx context.Context, req *PerformLoginTokenCreationRequest, res *PerformLoginTokenCreationResponse) error
+	PerformLoginTokenConsumption(ctx context.Context, req *PerformLoginTokenConsumptionRequest, res *PerformLoginTokenConsumptionResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformKeyBackup(ctx context.Context, req *PerformKeyBackupRequest, res *PerformKeyBackupResponse)
 	QueryKeyBackup(ctx context.Context, req *QueryKeyBackupRequest, res *QueryKeyBackupResponse)
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
+	QueryThreePIDs(ctx context.Context, req *QueryThreePIDsRequest, res *QueryThreePIDsResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 	QuerySearchProfiles(ctx context.Context, req *QuerySearchProfilesRequest, res *QuerySearchProfilesResponse) error
 	QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error
+	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *PerformPusherSetResponse) error
+	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	PerformPushRulesPut(ctx context.Context, req *PerformPushRulesPutRequest, res *PerformPushRulesPutResponse) error
+	QueryPushRules(ctx context.Context, req *QueryPushRulesRequest, res *QueryPushRulesResponse) error
 }
 
 type PerformKeyBackupRequest struct {
@@ -50,6 +59,10 @@ type PerformKeyBackupRequest struct {
 	AuthData     json.RawMessage
 	Algorithm    string
 	DeleteBackup bool // if true will delete the backup based on 'Version'.
+	DeleteKeys   bool // if true will delete the keys in the backup based on 'Version', optionally filtered by room and session.
+
+	DeleteKeysForRoomID    string // optional string to only delete keys which belong to this room
+	DeleteKeysForSessionID string // optional string to only delete keys which belong to this (room, session)
 
 	// The keys to upload, if any. If blank, creates/updates/deletes key version metadata only.
 	Keys struct {
@@ -70,16 +83,15 @@ type KeyBackupSession struct {
 func (a *KeyBackupSession) ShouldReplaceRoomKey(newKey *KeyBackupSession) bool {
 	// https://spec.matrix.org/unstable/client-server-api/#backup-algorithm-mmegolm_backupv1curve25519-aes-sha2
 	// "if the keys have different values for is_verified, then it will keep the key that has is_verified set to true"
-	if newKey.IsVerified && !a.IsVerified {
-		return true
-	} else if newKey.FirstMessageIndex < a.FirstMessageIndex {
-		// "if they have the same values for is_verified, then it will keep the key with a lower first_message_index"
-		return true
-	} else if newKey.ForwardedCount < a.ForwardedCount {
-		// "and finally, is is_verified and first_message_index are equal, then it will keep the key with a lower forwarded_count"
-		return true
+	if newKey.IsVerified != a.IsVerified {
+		return newKey.IsVerified
+	}
+	// "if they have the same values for is_verified, then it will keep the key with a lower first_message_index"
+	if newKey.FirstMessageIndex != a.FirstMessageIndex {
+		return newKey.FirstMessageIndex < a.FirstMessageIndex
 	}
-	return false
+	// "and finally, is is_verified and first_message_index are equal, then it will keep the key with a lower forwarded_count"
+	return newKey.ForwardedCount < a.ForwardedCount
 }
 
 // Internal KeyBackupData for passing to/from the storage layer
@@ -182,6 +194,9 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    error // e.g ErrorForbidden
+	// SoftLogout is set if the access token has expired. The device still
+	// exists, so the client can refresh the access token or log in again.
+	SoftLogout bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -208,6 +223,16 @@ type QueryDevicesResponse struct {
 	Devices    []Device
 }
 
+// QueryThreePIDsRequest is the request for QueryThreePIDs
+type QueryThreePIDsRequest struct {
+	UserID string
+}
+
+// QueryThreePIDsResponse is the response for QueryThreePIDs
+type QueryThreePIDsResponse struct {
+	ThreePIDs []authtypes.ThreePID
+}
+
 // QueryProfileRequest is the request for QueryProfile
 type QueryProfileRequest struct {
 	// The user ID to query
@@ -290,12 +315,25 @@ type PerformDeviceCreationRequest struct {
 	IPAddr string
 	// Useragent for this device
 	UserAgent string
+	// If the client supports refresh tokens, the access token expires and a
+	// refresh token is issued for it, if the homeserver is configured to.
+	RefreshToken bool
+	// The type of the account the device belongs to. Defaults to a user
+	// account if not set.
+	AccountType AccountType
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
 type PerformDeviceCreationResponse struct {
 	DeviceCreated bool
 	Device        *Device
+	// The refresh token for the access token of the device, if one was issued.
+	RefreshToken string
+	// How long the access token is valid for in milliseconds, if it expires.
+	ExpiresInMS int64
+	// DeviceLimitExceeded is set if the device was not created because the
+	// user already has the maximum number of devices.
+	DeviceLimitExceeded bool
 }
 
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
@@ -329,6 +367,47 @@ type QueryOpenIDTokenResponse struct {
 	ExpiresAtMS int64
 }
 
+// PerformLoginTokenCreationRequest is the request for PerformLoginTokenCreation
+type PerformLoginTokenCreationRequest struct {
+	UserID string
+}
+
+// PerformLoginTokenCreationResponse is the response for PerformLoginTokenCreation
+type PerformLoginTokenCreationResponse struct {
+	Token string
+	// When the token expires, as a unix timestamp (ms resolution).
+	ExpiresAtMS int64
+}
+
+// PerformLoginTokenConsumptionRequest is the request for PerformLoginTokenConsumption
+type PerformLoginTokenConsumptionRequest struct {
+	Token string
+}
+
+// PerformLoginTokenConsumptionResponse is the response for PerformLoginTokenConsumption
+type PerformLoginTokenConsumptionResponse struct {
+	// The user ID the token was issued for, or empty if the token doesn't
+	// exist, has expired or was already used.
+	UserID string
+}
+
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	RefreshToken string
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// The new access token, or empty if the refresh token doesn't exist or
+	// was already used.
+	AccessToken string
+	// The refresh token for the new access token, if it expires.
+	RefreshToken string
+	// How long the new access token is valid for in milliseconds, if it
+	// expires.
+	ExpiresInMS int64
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -336,6 +415,9 @@ type Device struct {
 	// The access_token granted to this device.
 	// This uniquely identifies the device from all other devices and clients.
 	AccessToken string
+	// When the access token expires, as a unix timestamp (ms resolution), or
+	// 0 if it doesn't.
+	AccessTokenExpiresAtMS int64
 	// The unique ID of the session identified by the access token.
 	// Can be used as a secure substitution in places where data needs to be
 	// associated with access tokens.
@@ -347,6 +429,9 @@ type Device struct {
 	// If the device is for an appservice user,
 	// this is the appservice ID.
 	AppserviceID string
+	// The type of the account the device belongs to, e.g. whether it's a
+	// guest account.
+	AccountType AccountType
 }
 
 // Account represents a Matrix account on this home server.
@@ -355,7 +440,8 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	AccountType  AccountType
+	// TODO: Other flags like IsAdmin
 	// TODO: Associations (e.g. with application services)
 }
 
@@ -412,3 +498,89 @@ const (
 	// AccountTypeGuest indicates this is a guest account
 	AccountTypeGuest AccountType = 2
 )
+
+// Pusher represents a push notification subscriber
+// https://spec.matrix.org/unstable/client-server-api/#get_matrixclientr0pushers
+type Pusher struct {
+	PushKey           string                 `json:"pushkey"`
+	PushKeyTS         int64                  `json:"pushkey_ts,omitempty"`
+	Kind              PusherKind             `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+}
+
+// RegistrationToken is a token which allows users to register when
+// registration requires one.
+// https://github.com/matrix-org/matrix-doc/blob/main/proposals/3231-token-authenticated-registration.md
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// How many times the token can be used to register, or nil if unlimited
+	UsesAllowed *int32 `json:"uses_allowed"`
+	// How many registrations were completed with the token
+	Completed int32 `json:"completed"`
+	// When the token expires, as a unix timestamp (ms resolution), or nil if
+	// it never expires
+	ExpiryTime *int64 `json:"expiry_time"`
+}
+
+// Valid returns true if the token can still be used to register at the
+// given time, as a unix timestamp (ms resolution).
+func (t *RegistrationToken) Valid(nowMS int64) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || *t.ExpiryTime > nowMS
+}
+
+type PusherKind string
+
+const (
+	EmailKind PusherKind = "email"
+	HTTPKind  PusherKind = "http"
+)
+
+// PerformPusherSetRequest is the request for PerformPusherSet. A pusher without
+// a kind deletes the pusher with the same app ID and push key.
+// https://spec.matrix.org/unstable/client-server-api/#post_matrixclientr0pushersset
+type PerformPusherSetRequest struct {
+	Pusher    // Anonymous field because that's how clientapi unmarshals it.
+	Localpart string
+	Append    bool `json:"append"`
+}
+
+// PerformPusherSetResponse is the response for PerformPusherSet
+type PerformPusherSetResponse struct{}
+
+// QueryPushersRequest is the request for QueryPushers
+type QueryPushersRequest struct {
+	Localpart string
+}
+
+// QueryPushersResponse is the response for QueryPushers
+type QueryPushersResponse struct {
+	Pushers []Pusher `json:"pushers"`
+}
+
+// PerformPushRulesPutRequest is the request for PerformPushRulesPut
+type PerformPushRulesPutRequest struct {
+	UserID   string                     `json:"user_id"`
+	RuleSets *pushrules.AccountRuleSets `json:"rule_sets"`
+}
+
+// PerformPushRulesPutResponse is the response for PerformPushRulesPut
+type PerformPushRulesPutResponse struct{}
+
+// QueryPushRulesRequest is the request for QueryPushRules
+type QueryPushRulesRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// QueryPushRulesResponse is the response for QueryPushRules. Users who
+// haven't changed their push rules get the default push rules.
+type QueryPushRulesResponse struct {
+	RuleSets *pushrules.AccountRuleSets `json:"rule_sets"`
+}
@@ -20,9 +20,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -38,6 +42,7 @@ type UserInternalAPI struct {
 	AccountDB  accounts.Database
 	DeviceDB   devices.Database
 	ServerName gomatrixserverlib.ServerName
+	Cfg        *config.UserAPI
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
 	KeyAPI      keyapi.KeyInternalAPI
@@ -113,12 +118,35 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 		"device_id":    req.DeviceID,
 		"display_name": req.DeviceDisplayName,
 	}).Info("PerformDeviceCreation")
-	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
+	allowed, err := a.enforceDeviceLimit(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		res.DeviceLimitExceeded = true
+		return nil
+	}
+	accountType := req.AccountType
+	if accountType == 0 {
+		accountType = api.AccountTypeUser
+	}
+	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent, accountType)
 	if err != nil {
 		return err
 	}
 	res.DeviceCreated = true
 	res.Device = dev
+	if req.RefreshToken && a.Cfg != nil && a.Cfg.AccessTokenLifetime > 0 {
+		res.RefreshToken, err = auth.GenerateAccessToken()
+		if err != nil {
+			return err
+		}
+		res.ExpiresInMS = int64(a.Cfg.AccessTokenLifetime / time.Millisecond)
+		expiresAtMS := time.Now().Add(a.Cfg.AccessTokenLifetime).UnixNano() / int64(time.Millisecond)
+		if err = a.DeviceDB.CreateRefreshToken(ctx, res.RefreshToken, dev.AccessToken, req.Localpart, dev.ID, expiresAtMS); err != nil {
+			return err
+		}
+	}
 	// create empty device keys and upload them to trigger device list changes
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID})
 }
@@ -149,6 +177,58 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(req.UserID, deletedDeviceIDs)
 }
 
+// enforceDeviceLimit checks whether the user is allowed to create the device
+// in the request under the configured per-user device limit. If the policy
+// is to evict, the least recently seen devices are removed to make room and
+// the device is always allowed. Replacing an existing device never counts
+// towards the limit, and appservice users are exempt.
+func (a *UserInternalAPI) enforceDeviceLimit(ctx context.Context, req *api.PerformDeviceCreationRequest) (bool, error) {
+	if a.Cfg == nil || a.Cfg.MaxDevicesPerUser <= 0 {
+		return true, nil
+	}
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, req.Localpart)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("a.AccountDB.GetAccountByLocalpart: %w", err)
+	}
+	if acc != nil && acc.AppServiceID != "" {
+		return true, nil
+	}
+	devs, err := a.DeviceDB.GetDevicesByLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return false, fmt.Errorf("a.DeviceDB.GetDevicesByLocalpart: %w", err)
+	}
+	if req.DeviceID != nil {
+		for _, dev := range devs {
+			if dev.ID == *req.DeviceID {
+				return true, nil
+			}
+		}
+	}
+	excess := len(devs) - a.Cfg.MaxDevicesPerUser + 1
+	if excess <= 0 {
+		return true, nil
+	}
+	if a.Cfg.DeviceLimitPolicy != config.DeviceLimitEvict {
+		util.GetLogger(ctx).WithField("localpart", req.Localpart).Info("Rejecting new device as user is at the device limit")
+		return false, nil
+	}
+	sort.SliceStable(devs, func(i, j int) bool {
+		return devs[i].LastSeenTS < devs[j].LastSeenTS
+	})
+	evicted := make([]string, 0, excess)
+	for _, dev := range devs[:excess] {
+		evicted = append(evicted, dev.ID)
+	}
+	util.GetLogger(ctx).WithField("localpart", req.Localpart).WithField("devices", evicted).Info("Evicting devices as user is at the device limit")
+	if err = a.DeviceDB.RemoveDevices(ctx, req.Localpart, evicted); err != nil {
+		return false, fmt.Errorf("a.DeviceDB.RemoveDevices: %w", err)
+	}
+	if err = a.deviceListUpdate(userutil.MakeUserID(req.Localpart, a.ServerName), evicted); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (a *UserInternalAPI) deviceListUpdate(userID string, deviceIDs []string) error {
 	deviceKeys := make([]keyapi.DeviceKeys, len(deviceIDs))
 	for i, did := range deviceIDs {
@@ -306,6 +386,22 @@ func (a *UserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDevice
 	return nil
 }
 
+func (a *UserInternalAPI) QueryThreePIDs(ctx context.Context, req *api.QueryThreePIDsRequest, res *api.QueryThreePIDsResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query 3PIDs of remote users: got %s want %s", domain, a.ServerName)
+	}
+	threepids, err := a.AccountDB.GetThreePIDsForLocalpart(ctx, local)
+	if err != nil {
+		return err
+	}
+	res.ThreePIDs = threepids
+	return nil
+}
+
 func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -357,6 +453,10 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	if expiresAtMS := device.AccessTokenExpiresAtMS; expiresAtMS != 0 && expiresAtMS <= time.Now().UnixNano()/int64(time.Millisecond) {
+		res.SoftLogout = true
+		return nil
+	}
 	res.Device = device
 	return nil
 }
@@ -443,6 +543,69 @@ func (a *UserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOp
 	return nil
 }
 
+// PerformLoginTokenCreation issues a single-use token which can be exchanged
+// for an access token with m.login.token.
+func (a *UserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *api.PerformLoginTokenCreationRequest, res *api.PerformLoginTokenCreationResponse) error {
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expiresAtMS := now.Add(a.Cfg.LoginTokenLifetime).UnixNano() / int64(time.Millisecond)
+	if err = a.AccountDB.CreateLoginToken(ctx, token, req.UserID, expiresAtMS, now.UnixNano()/int64(time.Millisecond)); err != nil {
+		return err
+	}
+	res.Token = token
+	res.ExpiresAtMS = expiresAtMS
+	return nil
+}
+
+// PerformLoginTokenConsumption uses up a login token, returning the user it
+// was issued for if it's still valid.
+func (a *UserInternalAPI) PerformLoginTokenConsumption(ctx context.Context, req *api.PerformLoginTokenConsumptionRequest, res *api.PerformLoginTokenConsumptionResponse) error {
+	userID, err := a.AccountDB.ConsumeLoginToken(ctx, req.Token, time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return err
+	}
+	res.UserID = userID
+	return nil
+}
+
+// PerformTokenRefresh uses up a refresh token, replacing the access token of
+// the device it was issued for. The new access token comes with a new refresh
+// token if access tokens expire.
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		return err
+	}
+	var refreshToken string
+	var expiresAtMS int64
+	if a.Cfg.AccessTokenLifetime > 0 {
+		if refreshToken, err = auth.GenerateAccessToken(); err != nil {
+			return err
+		}
+		expiresAtMS = time.Now().Add(a.Cfg.AccessTokenLifetime).UnixNano() / int64(time.Millisecond)
+	}
+	localpart, deviceID, err := a.DeviceDB.RefreshAccessToken(ctx, req.RefreshToken, accessToken, refreshToken, expiresAtMS)
+	if err != nil {
+		return err
+	}
+	if localpart == "" {
+		return nil
+	}
+	util.GetLogger(ctx).WithFields(logrus.Fields{
+		"localpart": localpart,
+		"device_id": deviceID,
+	}).Info("PerformTokenRefresh")
+	res.AccessToken = accessToken
+	res.RefreshToken = refreshToken
+	if refreshToken != "" {
+		res.ExpiresInMS = int64(a.Cfg.AccessTokenLifetime / time.Millisecond)
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) {
 	// Delete metadata
 	if req.DeleteBackup {
@@ -459,6 +622,11 @@ func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.Perform
 		res.Version = req.Version
 		return
 	}
+	// Delete keys
+	if req.DeleteKeys {
+		a.deleteBackupKeys(ctx, req, res)
+		return
+	}
 	// Create metadata
 	if req.Version == "" {
 		version, err := a.AccountDB.CreateKeyBackup(ctx, req.UserID, req.Algorithm, req.AuthData)
@@ -522,6 +690,37 @@ func (a *UserInternalAPI) uploadBackupKeys(ctx context.Context, req *api.Perform
 	res.KeyETag = etag
 }
 
+func (a *UserInternalAPI) deleteBackupKeys(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) {
+	if req.Version == "" {
+		res.BadInput = true
+		res.Error = "must specify a version to delete keys from"
+		return
+	}
+	_, _, _, _, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			res.Exists = false
+			return
+		}
+		res.Error = fmt.Sprintf("failed to query version: %s", err)
+		return
+	}
+	if deleted {
+		res.Exists = false
+		return
+	}
+	res.Exists = true
+	res.Version = req.Version
+
+	count, etag, err := a.AccountDB.DeleteBackupKeys(ctx, req.Version, req.UserID, req.DeleteKeysForRoomID, req.DeleteKeysForSessionID)
+	if err != nil {
+		res.Error = fmt.Sprintf("failed to delete keys: %s", err)
+		return
+	}
+	res.KeyCount = count
+	res.KeyETag = etag
+}
+
 func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest, res *api.QueryKeyBackupResponse) {
 	version, algorithm, authData, etag, deleted, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
 	res.Version = version
@@ -553,3 +752,70 @@ func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyB
 	}
 	res.Keys = result
 }
+
+// PerformPusherSet creates, replaces or deletes a pusher of the user
+func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	if req.Kind == "" {
+		return a.AccountDB.RemovePusher(ctx, req.AppID, req.PushKey, req.Localpart)
+	}
+	if !req.Append {
+		// Unless the client asks to append, a push key can only be used by one user.
+		if err := a.AccountDB.RemovePushersByAppIDAndPushKey(ctx, req.AppID, req.PushKey); err != nil {
+			return err
+		}
+	}
+	if req.PushKeyTS == 0 {
+		req.PushKeyTS = int64(gomatrixserverlib.AsTimestamp(time.Now()))
+	}
+	return a.AccountDB.UpsertPusher(ctx, req.Localpart, &req.Pusher)
+}
+
+// QueryPushers returns the pushers of the user
+func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	var err error
+	res.Pushers, err = a.AccountDB.GetPushers(ctx, req.Localpart)
+	return err
+}
+
+// PerformPushRulesPut replaces the push rules of the user
+func (a *UserInternalAPI) PerformPushRulesPut(ctx context.Context, req *api.PerformPushRulesPutRequest, res *api.PerformPushRulesPutResponse) error {
+	bs, err := json.Marshal(req.RuleSets)
+	if err != nil {
+		return err
+	}
+	userReq := api.InputAccountDataRequest{
+		UserID:      req.UserID,
+		DataType:    pushRulesAccountDataType,
+		AccountData: json.RawMessage(bs),
+	}
+	var userRes api.InputAccountDataResponse // empty
+	return a.InputAccountData(ctx, &userReq, &userRes)
+}
+
+// QueryPushRules returns the push rules of the user, or the default push
+// rules if the user hasn't changed them
+func (a *UserInternalAPI) QueryPushRules(ctx context.Context, req *api.QueryPushRulesRequest, res *api.QueryPushRulesResponse) error {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to split user ID %q for push rules", req.UserID)
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query push rules of remote users: got %s want %s", domain, a.ServerName)
+	}
+	bs, err := a.AccountDB.GetAccountDataByType(ctx, localpart, "", pushRulesAccountDataType)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query push rules: %w", err)
+	}
+	if len(bs) == 0 {
+		res.RuleSets = pushrules.DefaultAccountRuleSets(localpart, a.ServerName)
+		return nil
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if err = json.Unmarshal(bs, &ruleSets); err != nil {
+		return fmt.Errorf("failed to unmarshal push rules: %w", err)
+	}
+	res.RuleSets = &ruleSets
+	return nil
+}
+
+const pushRulesAccountDataType = "m.push_rules"
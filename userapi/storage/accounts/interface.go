@@ -62,7 +62,44 @@ type Database interface {
 	GetKeyBackup(ctx context.Context, userID, version string) (versionResult, algorithm string, authData json.RawMessage, etag string, deleted bool, err error)
 	UpsertBackupKeys(ctx context.Context, version, userID string, uploads []api.InternalKeyBackupSession) (count int64, etag string, err error)
 	GetBackupKeys(ctx context.Context, version, userID, filterRoomID, filterSessionID string) (result map[string]map[string]api.KeyBackupSession, err error)
+	DeleteBackupKeys(ctx context.Context, version, userID, filterRoomID, filterSessionID string) (count int64, etag string, err error)
 	CountBackupKeys(ctx context.Context, version, userID string) (count int64, err error)
+
+	// Pushers
+	UpsertPusher(ctx context.Context, localpart string, pusher *api.Pusher) error
+	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
+	RemovePusher(ctx context.Context, appID, pushKey, localpart string) error
+	RemovePushersByAppIDAndPushKey(ctx context.Context, appID, pushKey string) error
+
+	// Third-party identifier validation sessions
+	CreateThreePIDValidationSession(ctx context.Context, session *authtypes.ThreePIDValidationSession) error
+	GetThreePIDValidationSession(ctx context.Context, sessionID string) (*authtypes.ThreePIDValidationSession, error)
+	GetThreePIDValidationSessionBySecret(ctx context.Context, clientSecret, medium, address string) (*authtypes.ThreePIDValidationSession, error)
+	UpdateThreePIDValidationSessionToken(ctx context.Context, sessionID, token string, sendAttempt int, createdTS int64) error
+	ValidateThreePIDValidationSession(ctx context.Context, sessionID string, validatedTS int64) error
+	RemoveThreePIDValidationSession(ctx context.Context, sessionID string) error
+	RemoveExpiredThreePIDValidationSessions(ctx context.Context, createdBeforeTS int64) error
+
+	// Registration tokens
+	CreateRegistrationToken(ctx context.Context, token *api.RegistrationToken) (created bool, err error)
+	GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error)
+	GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error)
+	UpdateRegistrationToken(ctx context.Context, token string, usesAllowed *int32, expiryTime *int64) error
+	RemoveRegistrationToken(ctx context.Context, token string) error
+	UseRegistrationToken(ctx context.Context, token string, nowMS int64) (used bool, err error)
+	ReleaseRegistrationToken(ctx context.Context, token string) error
+
+	// Login tokens
+	CreateLoginToken(ctx context.Context, token, userID string, expiresAtMS, nowMS int64) error
+	ConsumeLoginToken(ctx context.Context, token string, nowMS int64) (userID string, err error)
+
+	// Single sign-on identities
+	GetLocalpartForSSOIdentity(ctx context.Context, idpID, subject string) (string, error)
+	SaveSSOIdentity(ctx context.Context, idpID, subject, localpart string) error
+
+	// Single sign-on logins which are in progress
+	CreateSSOLogin(ctx context.Context, state, idpID, redirectURL, nonce string, expiresAtMS, nowMS int64) error
+	ConsumeSSOLogin(ctx context.Context, state string, nowMS int64) (idpID, redirectURL, nonce string, err error)
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
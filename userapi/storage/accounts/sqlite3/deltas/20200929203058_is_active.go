@@ -10,6 +10,7 @@ import (
 
 func LoadFromGoose() {
 	goose.AddMigration(UpIsActive, DownIsActive)
+	goose.AddMigration(UpIsGuest, DownIsGuest)
 }
 
 func LoadIsActive(m *sqlutil.Migrations) {
@@ -0,0 +1,35 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadIsGuest(m *sqlutil.Migrations) {
+	m.AddMigration(UpIsGuest, DownIsGuest)
+}
+
+func UpIsGuest(tx *sql.Tx) error {
+	// The accounts table is created with the latest schema before the deltas
+	// run, so the column may already exist.
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('account_accounts') WHERE name = 'is_guest';`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for column: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE account_accounts ADD COLUMN is_guest BOOLEAN NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownIsGuest(tx *sql.Tx) error {
+	// SQLite can't drop columns, but the column is harmless to leave behind.
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const loginTokensSchema = `
+-- Stores the single-use tokens which can be exchanged for an access token
+-- with m.login.token.
+CREATE TABLE IF NOT EXISTS account_login_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The Matrix user ID the token logs in as
+	user_id TEXT NOT NULL,
+	-- When the token expires, as a unix timestamp (ms resolution).
+	expires_at_ms BIGINT NOT NULL
+);
+`
+
+const insertLoginTokenSQL = "" +
+	"INSERT INTO account_login_tokens (token, user_id, expires_at_ms) VALUES ($1, $2, $3)"
+
+const selectLoginTokenSQL = "" +
+	"SELECT user_id, expires_at_ms FROM account_login_tokens WHERE token = $1"
+
+const deleteLoginTokenSQL = "" +
+	"DELETE FROM account_login_tokens WHERE token = $1"
+
+const deleteExpiredLoginTokensSQL = "" +
+	"DELETE FROM account_login_tokens WHERE expires_at_ms <= $1"
+
+type loginTokensStatements struct {
+	insertTokenStmt         *sql.Stmt
+	selectTokenStmt         *sql.Stmt
+	deleteTokenStmt         *sql.Stmt
+	deleteExpiredTokensStmt *sql.Stmt
+}
+
+func (s *loginTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(loginTokensSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertTokenStmt, insertLoginTokenSQL},
+		{&s.selectTokenStmt, selectLoginTokenSQL},
+		{&s.deleteTokenStmt, deleteLoginTokenSQL},
+		{&s.deleteExpiredTokensStmt, deleteExpiredLoginTokensSQL},
+	}.Prepare(db)
+}
+
+func (s *loginTokensStatements) insertToken(
+	ctx context.Context, txn *sql.Tx, token, userID string, expiresAtMS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertTokenStmt)
+	_, err := stmt.ExecContext(ctx, token, userID, expiresAtMS)
+	return err
+}
+
+// selectToken returns the user ID and expiry of a login token, or an empty
+// user ID if the token doesn't exist.
+func (s *loginTokensStatements) selectToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (userID string, expiresAtMS int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectTokenStmt)
+	err = stmt.QueryRowContext(ctx, token).Scan(&userID, &expiresAtMS)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (s *loginTokensStatements) deleteToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteTokenStmt)
+	_, err := stmt.ExecContext(ctx, token)
+	return err
+}
+
+func (s *loginTokensStatements) deleteExpiredTokens(
+	ctx context.Context, txn *sql.Tx, nowMS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredTokensStmt)
+	_, err := stmt.ExecContext(ctx, nowMS)
+	return err
+}
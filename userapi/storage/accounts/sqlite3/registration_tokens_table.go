@@ -0,0 +1,189 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const registrationTokensSchema = `
+-- Stores the tokens which allow users to register when registration requires one.
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- How many times the token can be used, or NULL if unlimited
+	uses_allowed INTEGER,
+	-- How many registrations were completed with the token
+	completed INTEGER NOT NULL DEFAULT 0,
+	-- When the token expires, as a unix timestamp (ms resolution), or NULL if never.
+	expiry_time BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens (token, uses_allowed, completed, expiry_time) VALUES ($1, $2, 0, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens ORDER BY token"
+
+const updateRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET uses_allowed = $1, expiry_time = $2 WHERE token = $3"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM account_registration_tokens WHERE token = $1"
+
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed + 1 WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed)" +
+	" AND (expiry_time IS NULL OR expiry_time > $2)"
+
+const releaseRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed - 1 WHERE token = $1 AND completed > 0"
+
+type registrationTokensStatements struct {
+	insertTokenStmt  *sql.Stmt
+	selectTokenStmt  *sql.Stmt
+	selectTokensStmt *sql.Stmt
+	updateTokenStmt  *sql.Stmt
+	deleteTokenStmt  *sql.Stmt
+	useTokenStmt     *sql.Stmt
+	releaseTokenStmt *sql.Stmt
+}
+
+func (s *registrationTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertTokenStmt, insertRegistrationTokenSQL},
+		{&s.selectTokenStmt, selectRegistrationTokenSQL},
+		{&s.selectTokensStmt, selectRegistrationTokensSQL},
+		{&s.updateTokenStmt, updateRegistrationTokenSQL},
+		{&s.deleteTokenStmt, deleteRegistrationTokenSQL},
+		{&s.useTokenStmt, useRegistrationTokenSQL},
+		{&s.releaseTokenStmt, releaseRegistrationTokenSQL},
+	}.Prepare(db)
+}
+
+// insertToken inserts a new registration token. Returns false if the token
+// already exists.
+func (s *registrationTokensStatements) insertToken(
+	ctx context.Context, txn *sql.Tx, token *api.RegistrationToken,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.insertTokenStmt)
+	res, err := stmt.ExecContext(ctx, token.Token, token.UsesAllowed, token.ExpiryTime)
+	if err != nil {
+		return false, err
+	}
+	ra, err := res.RowsAffected()
+	return ra == 1, err
+}
+
+// selectToken returns the registration token, or nil if it doesn't exist.
+func (s *registrationTokensStatements) selectToken(
+	ctx context.Context, token string,
+) (*api.RegistrationToken, error) {
+	var t api.RegistrationToken
+	var usesAllowed sql.NullInt32
+	var expiryTime sql.NullInt64
+	err := s.selectTokenStmt.QueryRowContext(ctx, token).Scan(&t.Token, &usesAllowed, &t.Completed, &expiryTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	setRegistrationTokenLimits(&t, usesAllowed, expiryTime)
+	return &t, nil
+}
+
+func (s *registrationTokensStatements) selectTokens(
+	ctx context.Context,
+) ([]api.RegistrationToken, error) {
+	rows, err := s.selectTokensStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectTokens: rows.close() failed")
+
+	var tokens []api.RegistrationToken
+	for rows.Next() {
+		var t api.RegistrationToken
+		var usesAllowed sql.NullInt32
+		var expiryTime sql.NullInt64
+		if err = rows.Scan(&t.Token, &usesAllowed, &t.Completed, &expiryTime); err != nil {
+			return nil, err
+		}
+		setRegistrationTokenLimits(&t, usesAllowed, expiryTime)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *registrationTokensStatements) updateToken(
+	ctx context.Context, txn *sql.Tx, token string, usesAllowed *int32, expiryTime *int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateTokenStmt)
+	_, err := stmt.ExecContext(ctx, usesAllowed, expiryTime, token)
+	return err
+}
+
+func (s *registrationTokensStatements) deleteToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteTokenStmt)
+	_, err := stmt.ExecContext(ctx, token)
+	return err
+}
+
+// useToken counts a registration against the token. Returns false if the
+// token doesn't exist, has expired or has no uses left.
+func (s *registrationTokensStatements) useToken(
+	ctx context.Context, txn *sql.Tx, token string, nowMS int64,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.useTokenStmt)
+	res, err := stmt.ExecContext(ctx, token, nowMS)
+	if err != nil {
+		return false, err
+	}
+	ra, err := res.RowsAffected()
+	return ra == 1, err
+}
+
+func (s *registrationTokensStatements) releaseToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.releaseTokenStmt)
+	_, err := stmt.ExecContext(ctx, token)
+	return err
+}
+
+func setRegistrationTokenLimits(t *api.RegistrationToken, usesAllowed sql.NullInt32, expiryTime sql.NullInt64) {
+	if usesAllowed.Valid {
+		t.UsesAllowed = &usesAllowed.Int32
+	}
+	if expiryTime.Valid {
+		t.ExpiryTime = &expiryTime.Int64
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const ssoIdentitiesSchema = `
+-- Maps the users of single sign-on identity providers to local accounts.
+CREATE TABLE IF NOT EXISTS account_sso_identities (
+	-- The ID of the identity provider in the configuration
+	idp_id TEXT NOT NULL,
+	-- The identifier of the user at the identity provider
+	subject TEXT NOT NULL,
+	-- The localpart of the account the user logs in as
+	localpart TEXT NOT NULL,
+	PRIMARY KEY (idp_id, subject)
+);
+`
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO account_sso_identities (idp_id, subject, localpart) VALUES ($1, $2, $3)"
+
+const selectSSOIdentityLocalpartSQL = "" +
+	"SELECT localpart FROM account_sso_identities WHERE idp_id = $1 AND subject = $2"
+
+type ssoIdentitiesStatements struct {
+	insertIdentityStmt          *sql.Stmt
+	selectIdentityLocalpartStmt *sql.Stmt
+}
+
+func (s *ssoIdentitiesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(ssoIdentitiesSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertIdentityStmt, insertSSOIdentitySQL},
+		{&s.selectIdentityLocalpartStmt, selectSSOIdentityLocalpartSQL},
+	}.Prepare(db)
+}
+
+func (s *ssoIdentitiesStatements) insertIdentity(
+	ctx context.Context, txn *sql.Tx, idpID, subject, localpart string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertIdentityStmt)
+	_, err := stmt.ExecContext(ctx, idpID, subject, localpart)
+	return err
+}
+
+// selectIdentityLocalpart returns the localpart the user of an identity
+// provider is mapped to, or an empty string if they aren't mapped yet.
+func (s *ssoIdentitiesStatements) selectIdentityLocalpart(
+	ctx context.Context, idpID, subject string,
+) (localpart string, err error) {
+	err = s.selectIdentityLocalpartStmt.QueryRowContext(ctx, idpID, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const ssoLoginsSchema = `
+-- Stores the logins which were sent to an identity provider and haven't come
+-- back yet, by the state parameter which the provider sends back.
+CREATE TABLE IF NOT EXISTS account_sso_logins (
+	state TEXT NOT NULL PRIMARY KEY,
+	-- The ID of the identity provider
+	idp_id TEXT NOT NULL,
+	-- The client URL which the user is sent back to with a login token
+	redirect_url TEXT NOT NULL,
+	-- The nonce which the ID token of the provider must contain
+	nonce TEXT NOT NULL,
+	-- When the login expires, as a unix timestamp (ms resolution).
+	expires_at_ms BIGINT NOT NULL
+);
+`
+
+const insertSSOLoginSQL = "" +
+	"INSERT INTO account_sso_logins (state, idp_id, redirect_url, nonce, expires_at_ms) VALUES ($1, $2, $3, $4, $5)"
+
+const selectSSOLoginSQL = "" +
+	"SELECT idp_id, redirect_url, nonce, expires_at_ms FROM account_sso_logins WHERE state = $1"
+
+const deleteSSOLoginSQL = "" +
+	"DELETE FROM account_sso_logins WHERE state = $1"
+
+const deleteExpiredSSOLoginsSQL = "" +
+	"DELETE FROM account_sso_logins WHERE expires_at_ms <= $1"
+
+type ssoLoginsStatements struct {
+	insertLoginStmt         *sql.Stmt
+	selectLoginStmt         *sql.Stmt
+	deleteLoginStmt         *sql.Stmt
+	deleteExpiredLoginsStmt *sql.Stmt
+}
+
+func (s *ssoLoginsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(ssoLoginsSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertLoginStmt, insertSSOLoginSQL},
+		{&s.selectLoginStmt, selectSSOLoginSQL},
+		{&s.deleteLoginStmt, deleteSSOLoginSQL},
+		{&s.deleteExpiredLoginsStmt, deleteExpiredSSOLoginsSQL},
+	}.Prepare(db)
+}
+
+func (s *ssoLoginsStatements) insertLogin(
+	ctx context.Context, txn *sql.Tx, state, idpID, redirectURL, nonce string, expiresAtMS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertLoginStmt)
+	_, err := stmt.ExecContext(ctx, state, idpID, redirectURL, nonce, expiresAtMS)
+	return err
+}
+
+// selectLogin returns the login with the given state, or an empty identity
+// provider ID if there is none.
+func (s *ssoLoginsStatements) selectLogin(
+	ctx context.Context, txn *sql.Tx, state string,
+) (idpID, redirectURL, nonce string, expiresAtMS int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLoginStmt)
+	err = stmt.QueryRowContext(ctx, state).Scan(&idpID, &redirectURL, &nonce, &expiresAtMS)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (s *ssoLoginsStatements) deleteLogin(
+	ctx context.Context, txn *sql.Tx, state string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteLoginStmt)
+	_, err := stmt.ExecContext(ctx, state)
+	return err
+}
+
+func (s *ssoLoginsStatements) deleteExpiredLogins(
+	ctx context.Context, txn *sql.Tx, nowMS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredLoginsStmt)
+	_, err := stmt.ExecContext(ctx, nowMS)
+	return err
+}
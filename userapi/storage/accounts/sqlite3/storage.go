@@ -46,6 +46,12 @@ type Database struct {
 	openIDTokens          tokenStatements
 	keyBackupVersions     keyBackupVersionStatements
 	keyBackups            keyBackupStatements
+	pushers               pushersStatements
+	threepidValidations   threepidValidationSessionsStatements
+	registrationTokens    registrationTokensStatements
+	loginTokens           loginTokensStatements
+	ssoIdentities         ssoIdentitiesStatements
+	ssoLogins             ssoLoginsStatements
 	serverName            gomatrixserverlib.ServerName
 	bcryptCost            int
 	openIDTokenLifetimeMS int64
@@ -77,6 +83,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadIsActive(m)
+	deltas.LoadIsGuest(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -106,6 +113,24 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.keyBackups.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.pushers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.threepidValidations.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.registrationTokens.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.loginTokens.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.ssoIdentities.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.ssoLogins.prepare(db); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -191,7 +216,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", api.AccountTypeGuest)
 		return err
 	})
 	return acc, err
@@ -211,7 +236,7 @@ func (d *Database) CreateAccount(
 	defer d.accountDatasMu.Unlock()
 	defer d.accountsMu.Unlock()
 	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, api.AccountTypeUser)
 		return err
 	})
 	return
@@ -220,7 +245,7 @@ func (d *Database) CreateAccount(
 // WARNING! This function assumes that the relevant mutexes have already
 // been taken out by the caller (e.g. CreateAccount or CreateGuestAccount).
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	var err error
 	var account *api.Account
@@ -232,7 +257,7 @@ func (d *Database) createAccount(
 			return nil, err
 		}
 	}
-	if account, err = d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID); err != nil {
+	if account, err = d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, accountType); err != nil {
 		return nil, sqlutil.ErrUserExists
 	}
 	if err = d.profiles.insertProfile(ctx, txn, localpart); err != nil {
@@ -540,19 +565,11 @@ func (d *Database) UpsertBackupKeys(
 			return err
 		}
 		if changed {
-			// update the etag
-			var newETag string
-			if oldETag == "" {
-				newETag = "1"
-			} else {
-				oldETagInt, err := strconv.ParseInt(oldETag, 10, 64)
-				if err != nil {
-					return fmt.Errorf("failed to parse old etag: %s", err)
-				}
-				newETag = strconv.FormatInt(oldETagInt+1, 10)
+			etag, err = nextBackupETag(oldETag)
+			if err != nil {
+				return err
 			}
-			etag = newETag
-			return d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, newETag)
+			return d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, etag)
 		} else {
 			etag = oldETag
 		}
@@ -561,3 +578,302 @@ func (d *Database) UpsertBackupKeys(
 	})
 	return
 }
+
+// nolint:nakedret
+func (d *Database) DeleteBackupKeys(
+	ctx context.Context, version, userID, filterRoomID, filterSessionID string,
+) (count int64, etag string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		_, _, _, oldETag, deleted, err := d.keyBackupVersions.selectKeyBackup(ctx, txn, userID, version)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return fmt.Errorf("backup was deleted")
+		}
+		removed, err := d.keyBackups.deleteKeys(ctx, txn, userID, version, filterRoomID, filterSessionID)
+		if err != nil {
+			return fmt.Errorf("d.keyBackups.deleteKeys: %w", err)
+		}
+		count, err = d.keyBackups.countKeys(ctx, txn, userID, version)
+		if err != nil {
+			return err
+		}
+		etag = oldETag
+		if removed == 0 {
+			return nil
+		}
+		etag, err = nextBackupETag(oldETag)
+		if err != nil {
+			return err
+		}
+		return d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version, etag)
+	})
+	return
+}
+
+// nextBackupETag returns the etag of a key backup after its keys change.
+func nextBackupETag(oldETag string) (string, error) {
+	if oldETag == "" {
+		return "1", nil
+	}
+	oldETagInt, err := strconv.ParseInt(oldETag, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse old etag: %s", err)
+	}
+	return strconv.FormatInt(oldETagInt+1, 10), nil
+}
+
+// UpsertPusher inserts the pusher for the user, replacing any existing pusher
+// of the user with the same app ID and push key.
+func (d *Database) UpsertPusher(
+	ctx context.Context, localpart string, pusher *api.Pusher,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.upsertPusher(ctx, txn, localpart, pusher)
+	})
+}
+
+// GetPushers returns the pushers of the user.
+func (d *Database) GetPushers(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	return d.pushers.selectPushers(ctx, localpart)
+}
+
+// RemovePusher deletes the pusher of the user with the given app ID and push key.
+func (d *Database) RemovePusher(
+	ctx context.Context, appID, pushKey, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.deletePusher(ctx, txn, appID, pushKey, localpart)
+	})
+}
+
+// RemovePushersByAppIDAndPushKey deletes the pushers of all users with the given
+// app ID and push key.
+func (d *Database) RemovePushersByAppIDAndPushKey(
+	ctx context.Context, appID, pushKey string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.deletePushersByAppIDAndPushKey(ctx, txn, appID, pushKey)
+	})
+}
+
+// CreateThreePIDValidationSession stores a new third-party identifier
+// validation session.
+func (d *Database) CreateThreePIDValidationSession(
+	ctx context.Context, session *authtypes.ThreePIDValidationSession,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidValidations.insertSession(ctx, txn, session)
+	})
+}
+
+// GetThreePIDValidationSession returns the validation session with the given
+// ID, or nil if there is no such session.
+func (d *Database) GetThreePIDValidationSession(
+	ctx context.Context, sessionID string,
+) (*authtypes.ThreePIDValidationSession, error) {
+	return d.threepidValidations.selectSession(ctx, sessionID)
+}
+
+// GetThreePIDValidationSessionBySecret returns the validation session matching
+// the given client secret and third-party identifier, or nil if there is no
+// such session.
+func (d *Database) GetThreePIDValidationSessionBySecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDValidationSession, error) {
+	return d.threepidValidations.selectSessionBySecret(ctx, clientSecret, medium, address)
+}
+
+// UpdateThreePIDValidationSessionToken replaces the token of a validation
+// session after a new one has been sent, which invalidates the session until
+// the new token is submitted.
+func (d *Database) UpdateThreePIDValidationSessionToken(
+	ctx context.Context, sessionID, token string, sendAttempt int, createdTS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidValidations.updateSessionToken(ctx, txn, sessionID, token, sendAttempt, createdTS)
+	})
+}
+
+// ValidateThreePIDValidationSession marks a validation session as validated.
+func (d *Database) ValidateThreePIDValidationSession(
+	ctx context.Context, sessionID string, validatedTS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidValidations.updateSessionValidated(ctx, txn, sessionID, validatedTS)
+	})
+}
+
+// RemoveThreePIDValidationSession deletes a validation session, e.g. once it
+// has been used.
+func (d *Database) RemoveThreePIDValidationSession(
+	ctx context.Context, sessionID string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidValidations.deleteSession(ctx, txn, sessionID)
+	})
+}
+
+// RemoveExpiredThreePIDValidationSessions deletes the validation sessions
+// whose last token was sent before the given timestamp (ms resolution).
+func (d *Database) RemoveExpiredThreePIDValidationSessions(
+	ctx context.Context, createdBeforeTS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidValidations.deleteExpiredSessions(ctx, txn, createdBeforeTS)
+	})
+}
+
+// CreateRegistrationToken stores a new registration token. Returns false if
+// the token already exists.
+func (d *Database) CreateRegistrationToken(
+	ctx context.Context, token *api.RegistrationToken,
+) (created bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		created, err = d.registrationTokens.insertToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// GetRegistrationToken returns the registration token, or nil if it doesn't
+// exist.
+func (d *Database) GetRegistrationToken(
+	ctx context.Context, token string,
+) (*api.RegistrationToken, error) {
+	return d.registrationTokens.selectToken(ctx, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(
+	ctx context.Context,
+) ([]api.RegistrationToken, error) {
+	return d.registrationTokens.selectTokens(ctx)
+}
+
+// UpdateRegistrationToken replaces the limits of a registration token.
+func (d *Database) UpdateRegistrationToken(
+	ctx context.Context, token string, usesAllowed *int32, expiryTime *int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.registrationTokens.updateToken(ctx, txn, token, usesAllowed, expiryTime)
+	})
+}
+
+// RemoveRegistrationToken deletes a registration token.
+func (d *Database) RemoveRegistrationToken(
+	ctx context.Context, token string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.registrationTokens.deleteToken(ctx, txn, token)
+	})
+}
+
+// UseRegistrationToken counts a registration against a registration token.
+// Returns false if the token doesn't exist, has expired or has no uses left
+// at the given time (ms resolution).
+func (d *Database) UseRegistrationToken(
+	ctx context.Context, token string, nowMS int64,
+) (used bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		used, err = d.registrationTokens.useToken(ctx, txn, token, nowMS)
+		return err
+	})
+	return
+}
+
+// ReleaseRegistrationToken gives back a use of a registration token, e.g.
+// if the registration failed after the token was used.
+func (d *Database) ReleaseRegistrationToken(
+	ctx context.Context, token string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.registrationTokens.releaseToken(ctx, txn, token)
+	})
+}
+
+// CreateLoginToken stores a new login token for the given user, and removes
+// the tokens which have expired at the given time (ms resolution).
+func (d *Database) CreateLoginToken(
+	ctx context.Context, token, userID string, expiresAtMS, nowMS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err := d.loginTokens.deleteExpiredTokens(ctx, txn, nowMS); err != nil {
+			return err
+		}
+		return d.loginTokens.insertToken(ctx, txn, token, userID, expiresAtMS)
+	})
+}
+
+// ConsumeLoginToken removes a login token and returns the user ID it was
+// issued for. Returns an empty user ID if the token doesn't exist or has
+// expired at the given time (ms resolution).
+func (d *Database) ConsumeLoginToken(
+	ctx context.Context, token string, nowMS int64,
+) (userID string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		var expiresAtMS int64
+		userID, expiresAtMS, err = d.loginTokens.selectToken(ctx, txn, token)
+		if err != nil || userID == "" {
+			return err
+		}
+		if expiresAtMS <= nowMS {
+			userID = ""
+		}
+		return d.loginTokens.deleteToken(ctx, txn, token)
+	})
+	return
+}
+
+// GetLocalpartForSSOIdentity returns the localpart the user of an identity
+// provider is mapped to, or an empty string if they aren't mapped yet.
+func (d *Database) GetLocalpartForSSOIdentity(
+	ctx context.Context, idpID, subject string,
+) (string, error) {
+	return d.ssoIdentities.selectIdentityLocalpart(ctx, idpID, subject)
+}
+
+// SaveSSOIdentity maps the user of an identity provider to a local account.
+func (d *Database) SaveSSOIdentity(
+	ctx context.Context, idpID, subject, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.ssoIdentities.insertIdentity(ctx, txn, idpID, subject, localpart)
+	})
+}
+
+// CreateSSOLogin stores a login which was sent to an identity provider, and
+// removes the logins which have expired at the given time (ms resolution).
+func (d *Database) CreateSSOLogin(
+	ctx context.Context, state, idpID, redirectURL, nonce string, expiresAtMS, nowMS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err := d.ssoLogins.deleteExpiredLogins(ctx, txn, nowMS); err != nil {
+			return err
+		}
+		return d.ssoLogins.insertLogin(ctx, txn, state, idpID, redirectURL, nonce, expiresAtMS)
+	})
+}
+
+// ConsumeSSOLogin removes the login with the given state and returns it.
+// Returns an empty identity provider ID if the login doesn't exist or has
+// expired at the given time (ms resolution).
+func (d *Database) ConsumeSSOLogin(
+	ctx context.Context, state string, nowMS int64,
+) (idpID, redirectURL, nonce string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		var expiresAtMS int64
+		idpID, redirectURL, nonce, expiresAtMS, err = d.ssoLogins.selectLogin(ctx, txn, state)
+		if err != nil || idpID == "" {
+			return err
+		}
+		if expiresAtMS <= nowMS {
+			idpID, redirectURL, nonce = "", "", ""
+		}
+		return d.ssoLogins.deleteLogin(ctx, txn, state)
+	})
+	return
+}
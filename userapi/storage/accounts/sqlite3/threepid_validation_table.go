@@ -0,0 +1,169 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const threepidValidationSessionsSchema = `
+-- Stores the sessions used to verify the ownership of third-party identifiers
+-- when the homeserver sends the validation tokens itself.
+CREATE TABLE IF NOT EXISTS account_threepid_validation_sessions (
+	session_id TEXT NOT NULL PRIMARY KEY,
+	client_secret TEXT NOT NULL,
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	-- The token sent to the third-party identifier
+	token TEXT NOT NULL,
+	send_attempt INTEGER NOT NULL,
+	-- When the last token was sent, as a unix timestamp (ms resolution).
+	created_ts BIGINT NOT NULL,
+	-- When the token was submitted, as a unix timestamp (ms resolution).
+	validated_ts BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (client_secret, medium, address)
+);
+`
+
+const insertThreePIDValidationSessionSQL = "" +
+	"INSERT INTO account_threepid_validation_sessions (session_id, client_secret, medium, address, token, send_attempt, created_ts, validated_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const selectThreePIDValidationSessionSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, created_ts, validated_ts" +
+	" FROM account_threepid_validation_sessions WHERE session_id = $1"
+
+const selectThreePIDValidationSessionBySecretSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, created_ts, validated_ts" +
+	" FROM account_threepid_validation_sessions WHERE client_secret = $1 AND medium = $2 AND address = $3"
+
+const updateThreePIDValidationSessionTokenSQL = "" +
+	"UPDATE account_threepid_validation_sessions SET token = $1, send_attempt = $2, created_ts = $3, validated_ts = 0" +
+	" WHERE session_id = $4"
+
+const updateThreePIDValidationSessionValidatedSQL = "" +
+	"UPDATE account_threepid_validation_sessions SET validated_ts = $1 WHERE session_id = $2"
+
+const deleteThreePIDValidationSessionSQL = "" +
+	"DELETE FROM account_threepid_validation_sessions WHERE session_id = $1"
+
+const deleteExpiredThreePIDValidationSessionsSQL = "" +
+	"DELETE FROM account_threepid_validation_sessions WHERE created_ts < $1"
+
+type threepidValidationSessionsStatements struct {
+	insertSessionStmt         *sql.Stmt
+	selectSessionStmt         *sql.Stmt
+	selectSessionBySecretStmt *sql.Stmt
+	updateSessionTokenStmt    *sql.Stmt
+	updateSessionValidStmt    *sql.Stmt
+	deleteSessionStmt         *sql.Stmt
+	deleteExpiredSessionsStmt *sql.Stmt
+}
+
+func (s *threepidValidationSessionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(threepidValidationSessionsSchema)
+	if err != nil {
+		return
+	}
+	return sqlutil.StatementList{
+		{&s.insertSessionStmt, insertThreePIDValidationSessionSQL},
+		{&s.selectSessionStmt, selectThreePIDValidationSessionSQL},
+		{&s.selectSessionBySecretStmt, selectThreePIDValidationSessionBySecretSQL},
+		{&s.updateSessionTokenStmt, updateThreePIDValidationSessionTokenSQL},
+		{&s.updateSessionValidStmt, updateThreePIDValidationSessionValidatedSQL},
+		{&s.deleteSessionStmt, deleteThreePIDValidationSessionSQL},
+		{&s.deleteExpiredSessionsStmt, deleteExpiredThreePIDValidationSessionsSQL},
+	}.Prepare(db)
+}
+
+func (s *threepidValidationSessionsStatements) insertSession(
+	ctx context.Context, txn *sql.Tx, session *authtypes.ThreePIDValidationSession,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertSessionStmt)
+	_, err := stmt.ExecContext(
+		ctx, session.SessionID, session.ClientSecret, session.Medium, session.Address,
+		session.Token, session.SendAttempt, session.CreatedTS, session.ValidatedTS,
+	)
+	return err
+}
+
+// selectSession returns the session with the given ID, or nil if there is
+// no such session.
+func (s *threepidValidationSessionsStatements) selectSession(
+	ctx context.Context, sessionID string,
+) (*authtypes.ThreePIDValidationSession, error) {
+	return scanThreePIDValidationSession(s.selectSessionStmt.QueryRowContext(ctx, sessionID))
+}
+
+// selectSessionBySecret returns the session matching the given client secret
+// and third-party identifier, or nil if there is no such session.
+func (s *threepidValidationSessionsStatements) selectSessionBySecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDValidationSession, error) {
+	return scanThreePIDValidationSession(
+		s.selectSessionBySecretStmt.QueryRowContext(ctx, clientSecret, medium, address),
+	)
+}
+
+func (s *threepidValidationSessionsStatements) updateSessionToken(
+	ctx context.Context, txn *sql.Tx, sessionID, token string, sendAttempt int, createdTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateSessionTokenStmt)
+	_, err := stmt.ExecContext(ctx, token, sendAttempt, createdTS, sessionID)
+	return err
+}
+
+func (s *threepidValidationSessionsStatements) updateSessionValidated(
+	ctx context.Context, txn *sql.Tx, sessionID string, validatedTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateSessionValidStmt)
+	_, err := stmt.ExecContext(ctx, validatedTS, sessionID)
+	return err
+}
+
+func (s *threepidValidationSessionsStatements) deleteSession(
+	ctx context.Context, txn *sql.Tx, sessionID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteSessionStmt)
+	_, err := stmt.ExecContext(ctx, sessionID)
+	return err
+}
+
+func (s *threepidValidationSessionsStatements) deleteExpiredSessions(
+	ctx context.Context, txn *sql.Tx, createdBeforeTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredSessionsStmt)
+	_, err := stmt.ExecContext(ctx, createdBeforeTS)
+	return err
+}
+
+func scanThreePIDValidationSession(row *sql.Row) (*authtypes.ThreePIDValidationSession, error) {
+	var session authtypes.ThreePIDValidationSession
+	err := row.Scan(
+		&session.SessionID, &session.ClientSecret, &session.Medium, &session.Address,
+		&session.Token, &session.SendAttempt, &session.CreatedTS, &session.ValidatedTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
@@ -10,6 +10,7 @@ import (
 
 func LoadFromGoose() {
 	goose.AddMigration(UpLastSeenTSIP, DownLastSeenTSIP)
+	goose.AddMigration(UpAccountType, DownAccountType)
 }
 
 func LoadLastSeenTSIP(m *sqlutil.Migrations) {
@@ -0,0 +1,28 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAccountType(m *sqlutil.Migrations) {
+	m.AddMigration(UpAccountType, DownAccountType)
+}
+
+func UpAccountType(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS account_type SMALLINT NOT NULL DEFAULT 1;")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAccountType(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE device_devices DROP COLUMN account_type;")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -32,8 +32,9 @@ var deviceIDByteLength = 6
 
 // Database represents a device database.
 type Database struct {
-	db      *sql.DB
-	devices devicesStatements
+	db            *sql.DB
+	devices       devicesStatements
+	refreshTokens refreshTokensStatements
 }
 
 // NewDatabase creates a new device database
@@ -43,14 +44,19 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 		return nil, err
 	}
 	d := devicesStatements{}
+	r := refreshTokensStatements{}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
 	// and THEN prepare statements so we don't fail due to referencing new columns
 	if err = d.execSchema(db); err != nil {
 		return nil, err
 	}
+	if err = r.execSchema(db); err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadLastSeenTSIP(m)
+	deltas.LoadAccountType(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -58,8 +64,11 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.prepare(db, serverName); err != nil {
 		return nil, err
 	}
+	if err = r.prepare(db); err != nil {
+		return nil, err
+	}
 
-	return &Database{db, d}, nil
+	return &Database{db, d, r}, nil
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
@@ -97,7 +106,7 @@ func (d *Database) GetDevicesByID(ctx context.Context, deviceIDs []string) ([]ap
 // Returns the device on success.
 func (d *Database) CreateDevice(
 	ctx context.Context, localpart string, deviceID *string, accessToken string,
-	displayName *string, ipAddr, userAgent string,
+	displayName *string, ipAddr, userAgent string, accountType api.AccountType,
 ) (dev *api.Device, returnErr error) {
 	if deviceID != nil {
 		returnErr = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
@@ -107,7 +116,7 @@ func (d *Database) CreateDevice(
 				return err
 			}
 
-			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName, ipAddr, userAgent)
+			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName, ipAddr, userAgent, accountType)
 			return err
 		})
 	} else {
@@ -122,7 +131,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName, ipAddr, userAgent)
+				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName, ipAddr, userAgent, accountType)
 				return err
 			})
 			if returnErr == nil {
@@ -210,3 +219,51 @@ func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID
 		return d.devices.updateDeviceLastSeen(ctx, txn, localpart, deviceID, ipAddr)
 	})
 }
+
+// CreateRefreshToken stores a refresh token for the access token of a
+// device, which expires at the given time (ms resolution). The refresh
+// tokens whose access tokens don't exist anymore are removed.
+func (d *Database) CreateRefreshToken(
+	ctx context.Context, refreshToken, accessToken, localpart, deviceID string, expiresAtMS int64,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.refreshTokens.deleteStaleRefreshTokens(ctx, txn); err != nil {
+			return err
+		}
+		return d.refreshTokens.insertRefreshToken(ctx, txn, refreshToken, accessToken, localpart, deviceID, expiresAtMS)
+	})
+}
+
+// RefreshAccessToken uses up a refresh token, replacing the access token it
+// was issued for with a new one which expires at the given time, and storing
+// the new refresh token, if any, for the new access token.
+// Returns the device whose access token was replaced, or empty strings if the
+// refresh token doesn't exist or the device doesn't have the access token
+// anymore.
+func (d *Database) RefreshAccessToken(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, expiresAtMS int64,
+) (localpart, deviceID string, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		accessToken, lp, devID, txnErr := d.refreshTokens.selectRefreshToken(ctx, txn, refreshToken)
+		if txnErr == sql.ErrNoRows {
+			return nil
+		} else if txnErr != nil {
+			return txnErr
+		}
+		if txnErr = d.refreshTokens.deleteRefreshToken(ctx, txn, refreshToken); txnErr != nil {
+			return txnErr
+		}
+		updated, txnErr := d.devices.updateDeviceAccessToken(ctx, txn, lp, devID, accessToken, newAccessToken)
+		if txnErr != nil || !updated {
+			return txnErr
+		}
+		if newRefreshToken != "" {
+			if txnErr = d.refreshTokens.insertRefreshToken(ctx, txn, newRefreshToken, newAccessToken, lp, devID, expiresAtMS); txnErr != nil {
+				return txnErr
+			}
+		}
+		localpart, deviceID = lp, devID
+		return nil
+	})
+	return
+}
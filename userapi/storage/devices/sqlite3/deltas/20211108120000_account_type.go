@@ -0,0 +1,35 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAccountType(m *sqlutil.Migrations) {
+	m.AddMigration(UpAccountType, DownAccountType)
+}
+
+func UpAccountType(tx *sql.Tx) error {
+	// The devices table is created with the latest schema before the deltas
+	// run, so the column may already exist.
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('device_devices') WHERE name = 'account_type';`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for column: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE device_devices ADD COLUMN account_type INTEGER NOT NULL DEFAULT 1;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAccountType(tx *sql.Tx) error {
+	// SQLite can't drop columns, but the column is harmless to leave behind.
+	return nil
+}
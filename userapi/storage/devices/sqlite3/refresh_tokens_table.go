@@ -0,0 +1,107 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const refreshTokensSchema = `
+-- Stores the refresh tokens of devices whose access tokens expire.
+CREATE TABLE IF NOT EXISTS device_refresh_tokens (
+    refresh_token TEXT NOT NULL PRIMARY KEY,
+    -- The access token the refresh token replaces
+    access_token TEXT NOT NULL UNIQUE,
+    localpart TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    -- When the access token expires, as a unix timestamp (ms resolution).
+    access_token_expires_at_ms BIGINT NOT NULL
+);
+`
+
+const insertRefreshTokenSQL = "" +
+	"INSERT INTO device_refresh_tokens (refresh_token, access_token, localpart, device_id, access_token_expires_at_ms)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const selectRefreshTokenSQL = "" +
+	"SELECT access_token, localpart, device_id FROM device_refresh_tokens WHERE refresh_token = $1"
+
+const deleteRefreshTokenSQL = "" +
+	"DELETE FROM device_refresh_tokens WHERE refresh_token = $1"
+
+// The access tokens of deleted devices, or of devices which logged in again,
+// don't exist anymore, so their refresh tokens can't be used.
+const deleteStaleRefreshTokensSQL = "" +
+	"DELETE FROM device_refresh_tokens WHERE NOT EXISTS (" +
+	" SELECT 1 FROM device_devices WHERE device_devices.access_token = device_refresh_tokens.access_token" +
+	")"
+
+type refreshTokensStatements struct {
+	insertRefreshTokenStmt       *sql.Stmt
+	selectRefreshTokenStmt       *sql.Stmt
+	deleteRefreshTokenStmt       *sql.Stmt
+	deleteStaleRefreshTokensStmt *sql.Stmt
+}
+
+func (s *refreshTokensStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(refreshTokensSchema)
+	return err
+}
+
+func (s *refreshTokensStatements) prepare(db *sql.DB) error {
+	return sqlutil.StatementList{
+		{&s.insertRefreshTokenStmt, insertRefreshTokenSQL},
+		{&s.selectRefreshTokenStmt, selectRefreshTokenSQL},
+		{&s.deleteRefreshTokenStmt, deleteRefreshTokenSQL},
+		{&s.deleteStaleRefreshTokensStmt, deleteStaleRefreshTokensSQL},
+	}.Prepare(db)
+}
+
+func (s *refreshTokensStatements) insertRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken, accessToken, localpart, deviceID string, expiresAtMS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, accessToken, localpart, deviceID, expiresAtMS)
+	return err
+}
+
+// selectRefreshToken returns the access token and device a refresh token
+// was issued for. Returns sql.ErrNoRows if the refresh token doesn't exist.
+func (s *refreshTokensStatements) selectRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (accessToken, localpart, deviceID string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRefreshTokenStmt)
+	err = stmt.QueryRowContext(ctx, refreshToken).Scan(&accessToken, &localpart, &deviceID)
+	return
+}
+
+func (s *refreshTokensStatements) deleteRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken)
+	return err
+}
+
+func (s *refreshTokensStatements) deleteStaleRefreshTokens(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteStaleRefreshTokensStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
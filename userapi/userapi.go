@@ -46,6 +46,7 @@ func NewInternalAPI(
 		AccountDB:   accountDB,
 		DeviceDB:    deviceDB,
 		ServerName:  cfg.Matrix.ServerName,
+		Cfg:         cfg,
 		AppServices: appServices,
 		KeyAPI:      keyAPI,
 	}
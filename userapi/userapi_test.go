@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -119,3 +123,434 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+type testKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *testKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+func mustMakeDeviceLimitAPI(t *testing.T, policy string) api.UserInternalAPI {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(context.TODO(), "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	cfg := &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+		MaxDevicesPerUser: 2,
+		DeviceLimitPolicy: policy,
+	}
+	return userapi.NewInternalAPI(accountDB, cfg, nil, &testKeyAPI{})
+}
+
+func createDevice(t *testing.T, userAPI api.UserInternalAPI, deviceID string) api.PerformDeviceCreationResponse {
+	t.Helper()
+	var res api.PerformDeviceCreationResponse
+	err := userAPI.PerformDeviceCreation(context.TODO(), &api.PerformDeviceCreationRequest{
+		Localpart:   "alice",
+		AccessToken: "token_" + deviceID,
+		DeviceID:    &deviceID,
+	}, &res)
+	if err != nil {
+		t.Fatalf("PerformDeviceCreation %s failed: %s", deviceID, err)
+	}
+	// Make sure that each device has a distinct last seen timestamp.
+	time.Sleep(2 * time.Millisecond)
+	return res
+}
+
+func deviceIDs(t *testing.T, userAPI api.UserInternalAPI) []string {
+	t.Helper()
+	var res api.QueryDevicesResponse
+	if err := userAPI.QueryDevices(context.TODO(), &api.QueryDevicesRequest{
+		UserID: fmt.Sprintf("@alice:%s", serverName),
+	}, &res); err != nil {
+		t.Fatalf("QueryDevices failed: %s", err)
+	}
+	ids := make([]string, 0, len(res.Devices))
+	for _, dev := range res.Devices {
+		ids = append(ids, dev.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDeviceLimitReject(t *testing.T) {
+	userAPI := mustMakeDeviceLimitAPI(t, config.DeviceLimitReject)
+	createDevice(t, userAPI, "first")
+	createDevice(t, userAPI, "second")
+
+	res := createDevice(t, userAPI, "third")
+	if res.DeviceCreated || !res.DeviceLimitExceeded {
+		t.Fatalf("expected device creation to be rejected, got %+v", res)
+	}
+	// Logging in again with an existing device ID replaces that device.
+	res = createDevice(t, userAPI, "first")
+	if !res.DeviceCreated {
+		t.Fatalf("expected existing device to be replaced, got %+v", res)
+	}
+	if got, want := deviceIDs(t, userAPI), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got devices %v want %v", got, want)
+	}
+}
+
+func TestDeviceLimitEvict(t *testing.T) {
+	userAPI := mustMakeDeviceLimitAPI(t, config.DeviceLimitEvict)
+	createDevice(t, userAPI, "first")
+	createDevice(t, userAPI, "second")
+	// Make "second" the least recently seen device.
+	if err := userAPI.PerformLastSeenUpdate(context.TODO(), &api.PerformLastSeenUpdateRequest{
+		UserID:   fmt.Sprintf("@alice:%s", serverName),
+		DeviceID: "first",
+	}, &api.PerformLastSeenUpdateResponse{}); err != nil {
+		t.Fatalf("PerformLastSeenUpdate failed: %s", err)
+	}
+
+	res := createDevice(t, userAPI, "third")
+	if !res.DeviceCreated || res.DeviceLimitExceeded {
+		t.Fatalf("expected device to be created, got %+v", res)
+	}
+	if got, want := deviceIDs(t, userAPI), []string{"first", "third"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got devices %v want %v", got, want)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(context.TODO(), "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	cfg := &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+		AccessTokenLifetime: 100 * time.Millisecond,
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, cfg, nil, &testKeyAPI{})
+
+	queryAccessToken := func(token string) api.QueryAccessTokenResponse {
+		t.Helper()
+		var res api.QueryAccessTokenResponse
+		if err := userAPI.QueryAccessToken(context.TODO(), &api.QueryAccessTokenRequest{AccessToken: token}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		return res
+	}
+	refresh := func(refreshToken string) api.PerformTokenRefreshResponse {
+		t.Helper()
+		var res api.PerformTokenRefreshResponse
+		if err := userAPI.PerformTokenRefresh(context.TODO(), &api.PerformTokenRefreshRequest{RefreshToken: refreshToken}, &res); err != nil {
+			t.Fatalf("PerformTokenRefresh failed: %s", err)
+		}
+		return res
+	}
+
+	deviceID := "device"
+	var devRes api.PerformDeviceCreationResponse
+	if err = userAPI.PerformDeviceCreation(context.TODO(), &api.PerformDeviceCreationRequest{
+		Localpart:    "alice",
+		AccessToken:  "token",
+		DeviceID:     &deviceID,
+		RefreshToken: true,
+	}, &devRes); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+	if devRes.RefreshToken == "" || devRes.ExpiresInMS != 100 {
+		t.Fatalf("expected a refresh token expiring in 100ms, got %+v", devRes)
+	}
+	if res := queryAccessToken("token"); res.Device == nil || res.SoftLogout {
+		t.Fatalf("expected the access token to be valid, got %+v", res)
+	}
+
+	// Expired access tokens soft logout the device.
+	time.Sleep(150 * time.Millisecond)
+	if res := queryAccessToken("token"); res.Device != nil || !res.SoftLogout {
+		t.Fatalf("expected the device to be soft logged out, got %+v", res)
+	}
+
+	refreshRes := refresh(devRes.RefreshToken)
+	if refreshRes.AccessToken == "" || refreshRes.RefreshToken == "" || refreshRes.ExpiresInMS != 100 {
+		t.Fatalf("expected new tokens, got %+v", refreshRes)
+	}
+	if res := queryAccessToken(refreshRes.AccessToken); res.Device == nil || res.Device.ID != deviceID {
+		t.Fatalf("expected the new access token to belong to %q, got %+v", deviceID, res)
+	}
+	if res := queryAccessToken("token"); res.Device != nil || res.SoftLogout {
+		t.Fatalf("expected the old access token to be unknown, got %+v", res)
+	}
+	// Refresh tokens can only be used once.
+	if res := refresh(devRes.RefreshToken); res.AccessToken != "" {
+		t.Fatalf("expected the used refresh token to be rejected, got %+v", res)
+	}
+
+	// Refresh tokens are invalidated by logging the device out.
+	if err = userAPI.PerformDeviceDeletion(context.TODO(), &api.PerformDeviceDeletionRequest{
+		UserID:    fmt.Sprintf("@alice:%s", serverName),
+		DeviceIDs: []string{deviceID},
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		t.Fatalf("PerformDeviceDeletion failed: %s", err)
+	}
+	if res := refresh(refreshRes.RefreshToken); res.AccessToken != "" {
+		t.Fatalf("expected the refresh token of a deleted device to be rejected, got %+v", res)
+	}
+}
+
+func TestGuestAccounts(t *testing.T) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cfg := &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{
+			ServerName: serverName,
+		},
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, cfg, nil, &testKeyAPI{})
+
+	var accRes api.PerformAccountCreationResponse
+	if err := userAPI.PerformAccountCreation(context.TODO(), &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeGuest,
+	}, &accRes); err != nil {
+		t.Fatalf("PerformAccountCreation failed: %s", err)
+	}
+	if accRes.Account.AccountType != api.AccountTypeGuest {
+		t.Fatalf("expected a guest account, got %+v", accRes.Account)
+	}
+	if err := userAPI.PerformDeviceCreation(context.TODO(), &api.PerformDeviceCreationRequest{
+		Localpart:   accRes.Account.Localpart,
+		AccessToken: "guest_token",
+		AccountType: api.AccountTypeGuest,
+	}, &api.PerformDeviceCreationResponse{}); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+
+	var res api.QueryAccessTokenResponse
+	if err := userAPI.QueryAccessToken(context.TODO(), &api.QueryAccessTokenRequest{AccessToken: "guest_token"}, &res); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if res.Device == nil || res.Device.AccountType != api.AccountTypeGuest {
+		t.Fatalf("expected the device to belong to a guest, got %+v", res.Device)
+	}
+}
+
+func TestKeyBackup(t *testing.T) {
+	userAPI, _ := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	userID := fmt.Sprintf("@alice:%s", serverName)
+
+	var createRes api.PerformKeyBackupResponse
+	userAPI.PerformKeyBackup(ctx, &api.PerformKeyBackupRequest{
+		UserID:    userID,
+		Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2",
+		AuthData:  []byte(`{}`),
+	}, &createRes)
+	if createRes.Error != "" {
+		t.Fatalf("failed to create backup: %s", createRes.Error)
+	}
+	version := createRes.Version
+
+	upload := func(roomID, sessionID string, key api.KeyBackupSession) api.PerformKeyBackupResponse {
+		t.Helper()
+		req := &api.PerformKeyBackupRequest{UserID: userID, Version: version}
+		req.Keys.Rooms = map[string]struct {
+			Sessions map[string]api.KeyBackupSession `json:"sessions"`
+		}{
+			roomID: {Sessions: map[string]api.KeyBackupSession{sessionID: key}},
+		}
+		var res api.PerformKeyBackupResponse
+		userAPI.PerformKeyBackup(ctx, req, &res)
+		if res.Error != "" {
+			t.Fatalf("failed to upload keys: %s", res.Error)
+		}
+		return res
+	}
+	query := func(roomID, sessionID string) (api.KeyBackupSession, bool) {
+		t.Helper()
+		var res api.QueryKeyBackupResponse
+		userAPI.QueryKeyBackup(ctx, &api.QueryKeyBackupRequest{
+			UserID: userID, Version: version, ReturnKeys: true,
+		}, &res)
+		if res.Error != "" {
+			t.Fatalf("failed to query keys: %s", res.Error)
+		}
+		key, ok := res.Keys[roomID][sessionID]
+		return key, ok
+	}
+
+	upload("!room:example.com", "session", api.KeyBackupSession{
+		FirstMessageIndex: 5, ForwardedCount: 1, IsVerified: true, SessionData: []byte(`"verified"`),
+	})
+	upload("!room:example.com", "other", api.KeyBackupSession{SessionData: []byte(`"other"`)})
+	// An unverified key never replaces a verified one, even with a lower index.
+	upload("!room:example.com", "session", api.KeyBackupSession{
+		FirstMessageIndex: 0, SessionData: []byte(`"unverified"`),
+	})
+	// A key with a higher index doesn't replace one with a lower index, even
+	// if it was forwarded fewer times.
+	upload("!room:example.com", "session", api.KeyBackupSession{
+		FirstMessageIndex: 6, IsVerified: true, SessionData: []byte(`"later"`),
+	})
+	if key, _ := query("!room:example.com", "session"); string(key.SessionData) != `"verified"` {
+		t.Fatalf("got key %s, want the verified key to be kept", key.SessionData)
+	}
+	res := upload("!room:example.com", "session", api.KeyBackupSession{
+		FirstMessageIndex: 5, IsVerified: true, SessionData: []byte(`"fewer forwards"`),
+	})
+	if key, _ := query("!room:example.com", "session"); string(key.SessionData) != `"fewer forwards"` {
+		t.Fatalf("got key %s, want the key forwarded fewer times", key.SessionData)
+	}
+
+	var deleteRes api.PerformKeyBackupResponse
+	userAPI.PerformKeyBackup(ctx, &api.PerformKeyBackupRequest{
+		UserID:                 userID,
+		Version:                version,
+		DeleteKeys:             true,
+		DeleteKeysForRoomID:    "!room:example.com",
+		DeleteKeysForSessionID: "session",
+	}, &deleteRes)
+	if deleteRes.Error != "" || !deleteRes.Exists {
+		t.Fatalf("failed to delete keys: %+v", deleteRes)
+	}
+	if deleteRes.KeyCount != 1 || deleteRes.KeyETag == res.KeyETag {
+		t.Fatalf("got count %d and etag %q after deleting a key", deleteRes.KeyCount, deleteRes.KeyETag)
+	}
+	if _, ok := query("!room:example.com", "session"); ok {
+		t.Fatalf("deleted key was still returned")
+	}
+	if _, ok := query("!room:example.com", "other"); !ok {
+		t.Fatalf("key in another session was deleted")
+	}
+}
+
+func TestPushers(t *testing.T) {
+	userAPI, _ := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+
+	pusher := api.Pusher{
+		PushKey:           "pushkey",
+		Kind:              api.HTTPKind,
+		AppID:             "com.example.app",
+		AppDisplayName:    "Example",
+		DeviceDisplayName: "Phone",
+		Language:          "en",
+		Data:              map[string]interface{}{"url": "https://push.example.com/_matrix/push/v1/notify"},
+	}
+	setPusher := func(localpart string, pusher api.Pusher, appendPusher bool) {
+		t.Helper()
+		err := userAPI.PerformPusherSet(ctx, &api.PerformPusherSetRequest{
+			Pusher:    pusher,
+			Localpart: localpart,
+			Append:    appendPusher,
+		}, &api.PerformPusherSetResponse{})
+		if err != nil {
+			t.Fatalf("PerformPusherSet failed: %s", err)
+		}
+	}
+	queryPushers := func(localpart string) []api.Pusher {
+		t.Helper()
+		var res api.QueryPushersResponse
+		if err := userAPI.QueryPushers(ctx, &api.QueryPushersRequest{Localpart: localpart}, &res); err != nil {
+			t.Fatalf("QueryPushers failed: %s", err)
+		}
+		return res.Pushers
+	}
+
+	setPusher("alice", pusher, false)
+	pushers := queryPushers("alice")
+	if len(pushers) != 1 || pushers[0].PushKey != "pushkey" || pushers[0].Data["url"] != pusher.Data["url"] {
+		t.Fatalf("QueryPushers returned %+v, want the pusher", pushers)
+	}
+	if pushers[0].PushKeyTS == 0 {
+		t.Errorf("PerformPusherSet didn't set the push key timestamp")
+	}
+
+	// Replacing the pusher updates it rather than adding another one.
+	pusher.DeviceDisplayName = "New phone"
+	setPusher("alice", pusher, false)
+	if pushers = queryPushers("alice"); len(pushers) != 1 || pushers[0].DeviceDisplayName != "New phone" {
+		t.Fatalf("QueryPushers returned %+v, want the updated pusher", pushers)
+	}
+
+	// Appending keeps the pushers of other users with the same push key.
+	setPusher("bob", pusher, true)
+	if pushers = queryPushers("alice"); len(pushers) != 1 {
+		t.Fatalf("QueryPushers returned %+v for alice after bob appended, want the pusher", pushers)
+	}
+
+	// Otherwise the push key is taken from the other users.
+	setPusher("charlie", pusher, false)
+	if pushers = queryPushers("alice"); len(pushers) != 0 {
+		t.Fatalf("QueryPushers returned %+v for alice after charlie set the pusher, want none", pushers)
+	}
+	if pushers = queryPushers("bob"); len(pushers) != 0 {
+		t.Fatalf("QueryPushers returned %+v for bob after charlie set the pusher, want none", pushers)
+	}
+
+	// A pusher without a kind deletes the pusher.
+	setPusher("charlie", api.Pusher{AppID: pusher.AppID, PushKey: pusher.PushKey}, false)
+	if pushers = queryPushers("charlie"); len(pushers) != 0 {
+		t.Fatalf("QueryPushers returned %+v after deleting the pusher, want none", pushers)
+	}
+}
+
+func TestPushRules(t *testing.T) {
+	userAPI, _ := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	userID := "@alice:" + string(serverName)
+
+	// Users start with the default push rules.
+	var queryRes api.QueryPushRulesResponse
+	if err := userAPI.QueryPushRules(ctx, &api.QueryPushRulesRequest{UserID: userID}, &queryRes); err != nil {
+		t.Fatalf("QueryPushRules failed: %s", err)
+	}
+	want := pushrules.DefaultAccountRuleSets("alice", serverName)
+	if !reflect.DeepEqual(queryRes.RuleSets, want) {
+		t.Fatalf("QueryPushRules returned %+v, want the default rules", queryRes.RuleSets)
+	}
+
+	want.Global.Sender = append(want.Global.Sender, &pushrules.Rule{
+		RuleID:  "@bob:" + string(serverName),
+		Enabled: true,
+		Actions: []*pushrules.Action{{Kind: pushrules.DontNotifyAction}},
+	})
+	if err := userAPI.PerformPushRulesPut(ctx, &api.PerformPushRulesPutRequest{UserID: userID, RuleSets: want}, &api.PerformPushRulesPutResponse{}); err != nil {
+		t.Fatalf("PerformPushRulesPut failed: %s", err)
+	}
+	queryRes = api.QueryPushRulesResponse{}
+	if err := userAPI.QueryPushRules(ctx, &api.QueryPushRulesRequest{UserID: userID}, &queryRes); err != nil {
+		t.Fatalf("QueryPushRules failed: %s", err)
+	}
+	if got := queryRes.RuleSets.Global.Sender; len(got) != 1 || got[0].RuleID != "@bob:"+string(serverName) {
+		t.Fatalf("QueryPushRules returned sender rules %+v, want the new rule", got)
+	}
+}